@@ -0,0 +1,407 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+//go:embed admin.html
+var adminDashboard []byte
+
+// AdminServer serves the key management API, and a dashboard at its root.
+type AdminServer struct {
+	prefix         string
+	admins         keychain.Authenticator // keys allowed to use this API
+	keychain       *keychain.Keychain     // keys managed by this API
+	auditLog       *keychain.AuditLog     // optional; source of usage statistics
+	quota          int                    // maximum number of keys; 0 for no limit
+	maxRequestSize int64
+}
+
+// AccessKeyRequest represents a request to create or update an access key.
+type AccessKeyRequest struct {
+	Disabled *bool             `json:"disabled,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"` // replaces existing metadata, if present
+}
+
+// AccessKeyResponse represents a newly minted access key. The secret cannot be retrieved again.
+type AccessKeyResponse struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+}
+
+// KeyStateResponse represents a key managed by reference ID, e.g. by infrastructure-as-code tooling.
+type KeyStateResponse struct {
+	keychain.Entry
+	Fingerprint string `json:"fingerprint"`      // changes whenever the key is modified or rotated
+	Created     bool   `json:"created"`          // true if the key was created by this request
+	Secret      string `json:"secret,omitempty"` // set only if the key was created by this request
+}
+
+// DriftResponse lists the attributes of a key that differ from the desired spec.
+type DriftResponse struct {
+	Drift       []string `json:"drift"`
+	Fingerprint string   `json:"fingerprint"`
+}
+
+func newAdminServer(prefix string, admins keychain.Authenticator, keychain *keychain.Keychain, auditLog *keychain.AuditLog, quota int, maxRequestSize int64) *AdminServer {
+	return &AdminServer{prefix, admins, keychain, auditLog, quota, maxRequestSize}
+}
+
+// newAuditHandler serves the API authentication attempts recorded, with every key's usage, IPs and outcomes, to admins.
+func newAuditHandler(audit *keychain.AuditLog, admins keychain.Authenticator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !admins.Guard(w, r) {
+			return
+		}
+		audit.ServeHTTP(w, r)
+	})
+}
+
+func (s *AdminServer) overQuota(w http.ResponseWriter) bool {
+	if s.quota > 0 && s.keychain.Len() >= s.quota {
+		http.Error(w, "access key quota exceeded", http.StatusForbidden)
+		return true
+	}
+	return false
+}
+
+func (s *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.admins.Allow(r) {
+		if a, ok := s.admins.(*policyAdmins); ok && a.challenge(w, r) {
+			return
+		}
+		// Prompt browsers for credentials, so that the dashboard works without extra tooling.
+		w.Header().Set("WWW-Authenticate", `Basic realm="Wave admin", charset="UTF-8"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	// (dashboard), usage, keys, keys/{id}, keys/{id}/rotate, refs/{ref}, refs/{ref}/drift
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, s.prefix), "/")
+	p := strings.Split(path, "/")
+	if r.Method != http.MethodGet && !(p[0] == "refs" && p[len(p)-1] == "drift") && s.keychain.ReadOnly() {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	switch p[0] {
+	case "":
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(adminDashboard)
+		return
+	case "usage":
+		s.serveUsage(w, r)
+		return
+	case "refs":
+		s.serveRef(w, r, strings.Join(p[1:], "/"))
+		return
+	case "keys":
+	default:
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	// IDs may contain "/", e.g. those of keys of tenants, "tenant/id".
+	id := strings.TrimPrefix(strings.TrimPrefix(path, "keys"), "/")
+	if id == "" {
+		switch r.Method {
+		case http.MethodGet:
+			s.writeJSON(w, s.keychain.Entries())
+		case http.MethodPost:
+			s.createKey(w, r)
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	if id, ok := strings.CutSuffix(id, "/rotate"); ok {
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		s.rotateKey(w, id)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		e, ok := s.keychain.Get(id)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		s.writeJSON(w, e)
+	case http.MethodPatch:
+		s.updateKey(w, r, id)
+	case http.MethodDelete:
+		if err := s.keychain.Remove(id); err != nil {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		echo(Log{"t": "admin_key_remove", "id": id})
+		s.save(w)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// serveUsage responds with hourly request counts per key over the last day, if auditing is enabled.
+func (s *AdminServer) serveUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	usage := map[string][]int{}
+	if s.auditLog != nil {
+		usage = s.auditLog.Usage(24, time.Hour)
+	}
+	s.writeJSON(w, usage)
+}
+
+// serveRef handles idempotent operations on keys identified by reference ID.
+func (s *AdminServer) serveRef(w http.ResponseWriter, r *http.Request, ref string) {
+	ref, drift := strings.CutSuffix(ref, "/drift")
+	if ref == "" {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	if drift {
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		spec, ok := s.readSpec(w, r)
+		if !ok {
+			return
+		}
+		e, ok := s.keychain.GetByRef(ref)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		d := e.Drift(*spec)
+		if d == nil {
+			d = []string{}
+		}
+		s.writeJSON(w, DriftResponse{d, e.Fingerprint()})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		e, ok := s.keychain.GetByRef(ref)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		s.writeJSON(w, KeyStateResponse{Entry: e, Fingerprint: e.Fingerprint()})
+	case http.MethodPut:
+		spec, ok := s.readSpec(w, r)
+		if !ok {
+			return
+		}
+		if _, ok := s.keychain.GetByRef(ref); !ok && s.overQuota(w) {
+			return
+		}
+		e, secret, err := s.keychain.Ensure(ref, *spec)
+		if err != nil {
+			echo(Log{"t": "admin_key_ensure", "ref": ref, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if secret != "" {
+			echo(Log{"t": "admin_key_create", "ref": ref, "id": e.ID})
+		} else {
+			echo(Log{"t": "admin_key_update", "ref": ref, "id": e.ID})
+		}
+		if s.save(w) {
+			s.writeJSON(w, KeyStateResponse{e, e.Fingerprint(), secret != "", secret})
+		}
+	case http.MethodDelete: // succeeds even if the key is already gone
+		if s.keychain.RemoveByRef(ref) {
+			echo(Log{"t": "admin_key_remove", "ref": ref})
+			s.save(w)
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *AdminServer) readSpec(w http.ResponseWriter, r *http.Request) (*keychain.KeySpec, bool) {
+	var spec keychain.KeySpec
+	b, err := readRequestWithLimit(w, r.Body, s.maxRequestSize)
+	if err != nil {
+		echo(Log{"t": "read admin request body", "error": err.Error()})
+		if isRequestTooLarge(err) {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, false
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &spec); err != nil {
+			echo(Log{"t": "json_unmarshal", "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return nil, false
+		}
+	}
+	return &spec, true
+}
+
+func (s *AdminServer) readRequest(w http.ResponseWriter, r *http.Request) (*AccessKeyRequest, bool) {
+	var req AccessKeyRequest
+	b, err := readRequestWithLimit(w, r.Body, s.maxRequestSize)
+	if err != nil {
+		echo(Log{"t": "read admin request body", "error": err.Error()})
+		if isRequestTooLarge(err) {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, false
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &req); err != nil {
+			echo(Log{"t": "json_unmarshal", "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return nil, false
+		}
+	}
+	return &req, true
+}
+
+func (s *AdminServer) createKey(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.readRequest(w, r)
+	if !ok {
+		return
+	}
+	if s.overQuota(w) {
+		return
+	}
+	id, secret, hash, err := s.keychain.CreateAccessKey()
+	if err != nil {
+		echo(Log{"t": "admin_key_create", "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if err := s.keychain.Add(id, hash); err != nil {
+		echo(Log{"t": "admin_key_create", "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if err := s.apply(id, req); err != nil {
+		s.notApplied(w, err)
+		return
+	}
+	echo(Log{"t": "admin_key_create", "id": id})
+	if s.save(w) {
+		s.writeJSON(w, AccessKeyResponse{id, secret})
+	}
+}
+
+func (s *AdminServer) updateKey(w http.ResponseWriter, r *http.Request, id string) {
+	req, ok := s.readRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := s.apply(id, req); err != nil {
+		s.notApplied(w, err)
+		return
+	}
+	echo(Log{"t": "admin_key_update", "id": id})
+	if s.save(w) {
+		e, _ := s.keychain.Get(id)
+		s.writeJSON(w, e)
+	}
+}
+
+// apply changes a key as requested. Fails if the key does not exist, e.g. if removed meanwhile,
+// or the keychain is read-only.
+func (s *AdminServer) apply(id string, req *AccessKeyRequest) error {
+	if _, ok := s.keychain.Get(id); !ok {
+		return keychain.ErrKeyNotFound
+	}
+	if req.Disabled != nil {
+		if err := s.keychain.Disable(id, *req.Disabled); err != nil {
+			return err
+		}
+	}
+	if req.Metadata != nil {
+		if err := s.keychain.SetMetadata(id, req.Metadata); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notApplied responds to a request that apply could not carry out.
+func (s *AdminServer) notApplied(w http.ResponseWriter, err error) {
+	echo(Log{"t": "admin_key_update", "error": err.Error()})
+	if errors.Is(err, keychain.ErrReadOnly) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+}
+
+func (s *AdminServer) rotateKey(w http.ResponseWriter, id string) {
+	secret, err := s.keychain.Rotate(id)
+	if err != nil {
+		echo(Log{"t": "admin_key_rotate", "id": id, "error": err.Error()})
+		if errors.Is(err, keychain.ErrKeyNotFound) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	echo(Log{"t": "admin_key_rotate", "id": id})
+	if s.save(w) {
+		s.writeJSON(w, AccessKeyResponse{id, secret})
+	}
+}
+
+func (s *AdminServer) save(w http.ResponseWriter) bool {
+	if err := s.keychain.Save(); err != nil {
+		echo(Log{"t": "admin_keychain_save", "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+func (s *AdminServer) writeJSON(w http.ResponseWriter, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		echo(Log{"t": "admin_marshal", "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.Write(b)
+}
@@ -0,0 +1,232 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/h2oai/wave/pkg/adminpb"
+	"github.com/h2oai/wave/pkg/keychain"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// AdminService implements the gRPC key management service.
+type AdminService struct {
+	adminpb.UnimplementedKeyAdminServer
+	admins   keychain.Authenticator
+	keychain *keychain.Keychain
+}
+
+var (
+	errGRPCUnauthenticated = status.Error(codes.Unauthenticated, "invalid admin credentials")
+	errGRPCKeyNotFound     = status.Error(codes.NotFound, "access key not found")
+	errGRPCSaveFailed      = status.Error(codes.Internal, "failed writing keychain")
+	errGRPCReadOnly        = status.Error(codes.FailedPrecondition, "keychain is read-only")
+)
+
+func newAdminService(admins keychain.Authenticator, keychain *keychain.Keychain) *AdminService {
+	return &AdminService{admins: admins, keychain: keychain}
+}
+
+// authenticate verifies basic auth credentials carried in the call metadata, using the same authenticator as the REST API.
+// The call is presented as an HTTP request so that hooks, auditing and admin policies apply as usual.
+// Since gRPC has no way to challenge for step-up authentication, calls that would require it are refused.
+func (s *AdminService) authenticate(ctx context.Context, method string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	r := &http.Request{
+		Method: http.MethodPost,
+		URL:    &url.URL{Path: method},
+		Header: make(http.Header),
+	}
+	for _, v := range md.Get("authorization") {
+		r.Header.Add("Authorization", v)
+	}
+	for _, v := range md.Get("user-agent") {
+		r.Header.Add("User-Agent", v)
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+	if !s.admins.Allow(r) {
+		return errGRPCUnauthenticated
+	}
+	return nil
+}
+
+func (s *AdminService) intercept(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := s.authenticate(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	if s.keychain.ReadOnly() && !isReadOnlyMethod(info.FullMethod) {
+		return nil, errGRPCReadOnly
+	}
+	return handler(ctx, req)
+}
+
+func isReadOnlyMethod(fullMethod string) bool {
+	return fullMethod == adminpb.KeyAdmin_ListKeys_FullMethodName || fullMethod == adminpb.KeyAdmin_GetKey_FullMethodName
+}
+
+// grpcKeyError translates an error changing a key to the status to respond with.
+func grpcKeyError(err error) error {
+	switch {
+	case errors.Is(err, keychain.ErrKeyNotFound):
+		return errGRPCKeyNotFound
+	case errors.Is(err, keychain.ErrReadOnly):
+		return errGRPCReadOnly
+	}
+	return status.Error(codes.Internal, "failed changing access key")
+}
+
+func (s *AdminService) save() error {
+	if err := s.keychain.Save(); err != nil {
+		echo(Log{"t": "admin_keychain_save", "error": err.Error()})
+		return errGRPCSaveFailed
+	}
+	return nil
+}
+
+func toKey(e keychain.Entry) *adminpb.Key {
+	return &adminpb.Key{Id: e.ID, Disabled: e.Disabled, Metadata: e.Metadata}
+}
+
+func (s *AdminService) ListKeys(ctx context.Context, req *adminpb.ListKeysRequest) (*adminpb.ListKeysResponse, error) {
+	entries := s.keychain.Entries()
+	keys := make([]*adminpb.Key, len(entries))
+	for i, e := range entries {
+		keys[i] = toKey(e)
+	}
+	return &adminpb.ListKeysResponse{Keys: keys}, nil
+}
+
+func (s *AdminService) GetKey(ctx context.Context, req *adminpb.GetKeyRequest) (*adminpb.Key, error) {
+	e, ok := s.keychain.Get(req.Id)
+	if !ok {
+		return nil, errGRPCKeyNotFound
+	}
+	return toKey(e), nil
+}
+
+func (s *AdminService) CreateKey(ctx context.Context, req *adminpb.CreateKeyRequest) (*adminpb.AccessKey, error) {
+	id, secret, hash, err := s.keychain.CreateAccessKey()
+	if err != nil {
+		echo(Log{"t": "admin_key_create", "error": err.Error()})
+		return nil, status.Error(codes.Internal, "failed generating access key")
+	}
+	if err := s.keychain.Add(id, hash); err != nil {
+		echo(Log{"t": "admin_key_create", "error": err.Error()})
+		return nil, status.Error(codes.Internal, "failed adding access key")
+	}
+	if err := s.keychain.Disable(id, req.Disabled); err != nil {
+		return nil, grpcKeyError(err)
+	}
+	if err := s.keychain.SetMetadata(id, req.Metadata); err != nil {
+		return nil, grpcKeyError(err)
+	}
+	echo(Log{"t": "admin_key_create", "id": id})
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	return &adminpb.AccessKey{Id: id, Secret: secret}, nil
+}
+
+func (s *AdminService) UpdateKey(ctx context.Context, req *adminpb.UpdateKeyRequest) (*adminpb.Key, error) {
+	if _, ok := s.keychain.Get(req.Id); !ok {
+		return nil, errGRPCKeyNotFound
+	}
+	if req.Disabled != nil {
+		if err := s.keychain.Disable(req.Id, *req.Disabled); err != nil {
+			return nil, grpcKeyError(err)
+		}
+	}
+	if req.SetMetadata {
+		if err := s.keychain.SetMetadata(req.Id, req.Metadata); err != nil {
+			return nil, grpcKeyError(err)
+		}
+	}
+	echo(Log{"t": "admin_key_update", "id": req.Id})
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	return s.GetKey(ctx, &adminpb.GetKeyRequest{Id: req.Id})
+}
+
+func (s *AdminService) DeleteKey(ctx context.Context, req *adminpb.DeleteKeyRequest) (*adminpb.DeleteKeyResponse, error) {
+	if err := s.keychain.Remove(req.Id); err != nil {
+		return nil, errGRPCKeyNotFound
+	}
+	echo(Log{"t": "admin_key_remove", "id": req.Id})
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	return &adminpb.DeleteKeyResponse{}, nil
+}
+
+func (s *AdminService) RotateKey(ctx context.Context, req *adminpb.RotateKeyRequest) (*adminpb.AccessKey, error) {
+	secret, err := s.keychain.Rotate(req.Id)
+	if errors.Is(err, keychain.ErrKeyNotFound) {
+		return nil, errGRPCKeyNotFound
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed rotating access key")
+	}
+	echo(Log{"t": "admin_key_rotate", "id": req.Id})
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	return &adminpb.AccessKey{Id: req.Id, Secret: secret}, nil
+}
+
+// runAdminService serves the key management API over gRPC, authenticating callers with admins.
+// Since calls carry admin credentials, it refuses to serve plaintext unless conf.AdminGRPCInsecure is set.
+func runAdminService(conf ServerConf, admins keychain.Authenticator) {
+	s := newAdminService(admins, conf.Keychain)
+	options := []grpc.ServerOption{grpc.UnaryInterceptor(s.intercept)}
+	if conf.CertFile == "" || conf.KeyFile == "" {
+		if !conf.AdminGRPCInsecure {
+			echo(Log{"t": "admin_grpc_tls", "error": "TLS is not configured; pass -admin-grpc-insecure to serve without TLS"})
+			return
+		}
+		echo(Log{"t": "admin_grpc_tls", "warning": "serving without TLS"})
+	} else {
+		creds, err := credentials.NewServerTLSFromFile(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			echo(Log{"t": "admin_grpc_tls", "error": err.Error()})
+			return
+		}
+		options = append(options, grpc.Creds(creds))
+	}
+	server := grpc.NewServer(options...)
+	adminpb.RegisterKeyAdminServer(server, s)
+
+	lis, err := net.Listen("tcp", conf.AdminGRPCListen)
+	if err != nil {
+		echo(Log{"t": "admin_grpc_listen", "error": err.Error()})
+		return
+	}
+	echo(Log{"t": "admin_grpc_listen", "address": conf.AdminGRPCListen})
+	if err := server.Serve(lis); err != nil {
+		echo(Log{"t": "admin_grpc_serve", "error": err.Error()})
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/adminpb"
+	"github.com/h2oai/wave/pkg/assert"
+	"github.com/h2oai/wave/pkg/keychain"
+	"github.com/h2oai/wave/pkg/keychain/keychaintest"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestAuditIsForAdminsOnly(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	_, keys := keychaintest.New(t, 1)
+	admins, admin := keychaintest.New(t, 1)
+	audit := keychain.NewAuditLog(10, nil)
+	audit.Inspect(keychain.Event{Time: time.Now(), ID: keys[0].ID, RemoteAddr: "203.0.113.7", Outcome: keychain.Allowed})
+	h := newAuditHandler(audit, admins)
+
+	get := func(cred keychain.Credential) int {
+		r := httptest.NewRequest(http.MethodGet, "/_audit", nil)
+		r.SetBasicAuth(cred.ID, cred.Secret)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	eq(get(keys[0]), http.StatusUnauthorized)
+	eq(get(admin[0]), http.StatusOK)
+}
+
+func TestAdminKeysWithSlashes(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	kc, _ := keychaintest.New(t, 0)
+	admins, admin := keychaintest.New(t, 1)
+	hash, err := kc.HashSecret("secret")
+	no(err)
+	no(kc.Add("acme/KEY1", hash))
+	s := newAdminServer("/_admin/", admins, kc, nil, 0, 1<<20)
+
+	call := func(method, path string) int {
+		r := httptest.NewRequest(method, path, nil)
+		r.SetBasicAuth(admin[0].ID, admin[0].Secret)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+	eq(call(http.MethodGet, "/_admin/keys/acme%2FKEY1"), http.StatusOK)
+	eq(call(http.MethodGet, "/_admin/keys/acme/KEY1"), http.StatusOK)
+	eq(call(http.MethodGet, "/_admin/keys/acme/KEY1/rotate"), http.StatusMethodNotAllowed)
+	eq(call(http.MethodPost, "/_admin/keys/acme%2FKEY1/rotate"), http.StatusOK)
+	e, found := kc.Get("acme/KEY1")
+	ok(found)
+	ok(string(e.Hash) != string(hash), "rotated")
+	eq(call(http.MethodPost, "/_admin/keys/acme/KEY2/rotate"), http.StatusNotFound)
+	eq(call(http.MethodDelete, "/_admin/keys/acme/KEY1"), http.StatusOK)
+	eq(call(http.MethodGet, "/_admin/keys/acme/KEY1"), http.StatusNotFound)
+}
+
+func TestAdminKeyQuota(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	kc, _ := keychaintest.New(t, 1)
+	admins, admin := keychaintest.New(t, 1)
+	s := newAdminServer("/_admin/", admins, kc, nil, 2, 1<<20)
+
+	call := func(method, path, body string) int {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.SetBasicAuth(admin[0].ID, admin[0].Secret)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+	eq(call(http.MethodPost, "/_admin/keys", `{"metadata": {"team": "a"}}`), http.StatusOK)
+	eq(call(http.MethodPost, "/_admin/keys", `{}`), http.StatusForbidden)
+	eq(kc.Len(), 2)
+	eq(call(http.MethodPatch, "/_admin/keys/MISSING", `{"disabled": true}`), http.StatusNotFound)
+}
+
+// denyAdmins is an authenticator that refuses every request, e.g. as an admin policy requiring step-up would.
+type denyAdmins struct{ *keychain.Keychain }
+
+func (denyAdmins) Allow(r *http.Request) bool { return false }
+
+func TestAdminServiceAuthenticatesWithAdmins(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	kc, _ := keychaintest.New(t, 0)
+	admins, admin := keychaintest.New(t, 1)
+
+	call := func(admins keychain.Authenticator, cred keychain.Credential) error {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.SetBasicAuth(cred.ID, cred.Secret)
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", r.Header.Get("Authorization")))
+		return newAdminService(admins, kc).authenticate(ctx, adminpb.KeyAdmin_ListKeys_FullMethodName)
+	}
+	no(call(admins, admin[0]))
+	eq(call(admins, keychain.Credential{ID: admin[0].ID, Secret: "wrong"}), errGRPCUnauthenticated)
+	eq(call(denyAdmins{admins}, admin[0]), errGRPCUnauthenticated)
+}
+
+func TestAdminServiceRequiresTLS(t *testing.T) {
+	_, ok, _ := assert.Assert(t)
+	admins, _ := keychaintest.New(t, 0)
+	done := make(chan struct{})
+	go func() {
+		runAdminService(ServerConf{AdminGRPCListen: "127.0.0.1:0"}, admins)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		ok(false, "served gRPC without TLS")
+	}
+}
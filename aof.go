@@ -0,0 +1,160 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const aofTimeFormat = "2006/01/02 15:04:05" // as written by the log package, so that -init reads either
+
+// AOF is an append-only file of the changes made to pages, which pages are restored from on startup.
+//
+// Pages streamed to for weeks would take as long to restore, and as much disk, as every change ever made to
+// them, so the file is compacted in the background: rewritten as the pages are, one line each, then appended
+// to again.
+type AOF struct {
+	path       string
+	site       *Site
+	compacting sync.RWMutex // held for reading while a change is recorded and applied, for writing while compacting
+	lock       sync.Mutex   // serializes writes
+	file       *os.File
+	size       int64 // bytes in the file
+	base       int64 // bytes in the file when last compacted
+}
+
+// OpenAOF opens an AOF file, adding to it if it exists.
+func OpenAOF(path string) (*AOF, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &AOF{path: path, file: f, size: info.Size()}, nil
+}
+
+// load restores the pages recorded into site, which is compacted from then on.
+func (a *AOF) load(site *Site) {
+	if a.size > 0 {
+		initSite(site, a.path)
+	}
+	a.site = site
+}
+
+// record appends a change to the page at route to the file. The returned func must be called once the change
+// is applied to the site, so that compacting doesn't miss it.
+func (a *AOF) record(route string, data []byte) func() {
+	a.compacting.RLock()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	n, err := a.file.Write(aofLine(time.Now(), '*', route, data))
+	a.size += int64(n)
+	if err != nil {
+		echo(Log{"t": "aof", "route": route, "error": err.Error()})
+	}
+	return a.compacting.RUnlock
+}
+
+func aofLine(t time.Time, marker byte, route string, data []byte) []byte {
+	b := make([]byte, 0, len(aofTimeFormat)+len(route)+len(data)+5)
+	b = t.AppendFormat(b, aofTimeFormat)
+	b = append(b, ' ', marker, ' ')
+	b = append(b, route...)
+	b = append(b, ' ')
+	b = append(b, data...)
+	return append(b, '\n')
+}
+
+// run compacts the file every interval, if it has doubled in size since last compacted.
+func (a *AOF) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		a.lock.Lock()
+		grown := a.size > 2*a.base
+		a.lock.Unlock()
+		if !grown {
+			continue
+		}
+		if err := a.compact(); err != nil {
+			echo(Log{"t": "aof_compact", "error": err.Error()})
+		}
+	}
+}
+
+// compact rewrites the file as the pages are, replacing it only once written.
+func (a *AOF) compact() error {
+	a.compacting.Lock()
+	defer a.compacting.Unlock()
+
+	start := time.Now()
+	tmp := a.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	var size int64
+	pages := 0
+	for _, url := range a.site.urls() {
+		page := a.site.at(url)
+		if page == nil {
+			continue
+		}
+		page.RLock()
+		empty := len(page.cards) == 0
+		page.RUnlock()
+		if empty {
+			continue
+		}
+		data := page.marshal()
+		if data == nil {
+			continue
+		}
+		n, err := w.Write(aofLine(start, '=', url, data))
+		size += int64(n)
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+		pages++
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, a.path); err != nil { // f is appended to from here on
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.file.Close()
+	echo(Log{"t": "aof_compact", "pages": strconv.Itoa(pages), "before": strconv.FormatInt(a.size, 10), "after": strconv.FormatInt(size, 10), "took": time.Since(start).String()})
+	a.file, a.size, a.base = f, size, size
+	return nil
+}
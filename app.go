@@ -18,6 +18,10 @@ import (
 	"bytes"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // AppMode represents app modes.
@@ -31,15 +35,26 @@ const (
 
 // App represents an app
 type App struct {
-	broker    *Broker
-	client    *http.Client
-	mode      AppMode // mode
-	route     string  // route
-	addr      string  // upstream address http://host:port
-	keyID     string  // access key ID
-	keySecret string  // access key secret
+	broker     *Broker
+	client     *http.Client
+	mode       AppMode // mode
+	route      string  // route
+	addr       string  // upstream address http://host:port
+	keyID      string  // access key ID
+	keySecret  string  // access key secret
+	ack        bool    // number queries, and retry failed deliveries
+	seq        uint64  // sequence number of the latest query; atomic
+	owner      string  // ID of the access key the app registered with
+	health     string  // path probed for the app's health, if any
+	scale      bool    // shares its route with other instances of the app
+	deployment string  // deployment, e.g. version, of the app, run side by side with others; empty if none
+	meta       AppMeta
+	added      time.Time // when registered
 }
 
+// appRetryDelays are the delays before retrying failed deliveries to apps that acknowledge queries.
+var appRetryDelays = []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second}
+
 func toAppMode(mode string) AppMode {
 	switch mode {
 	case "broadcast":
@@ -50,7 +65,17 @@ func toAppMode(mode string) AppMode {
 	return unicastMode
 }
 
-func newApp(broker *Broker, mode, route, addr, keyID, keySecret string) *App {
+func (m AppMode) String() string {
+	switch m {
+	case broadcastMode:
+		return "broadcast"
+	case multicastMode:
+		return "multicast"
+	}
+	return "unicast"
+}
+
+func newApp(broker *Broker, mode, route, addr, keyID, keySecret string, ack bool, owner, health string, scale bool, deployment string, meta AppMeta) *App {
 	return &App{
 		broker,
 		&http.Client{}, // TODO tune keep-alive and idle timeout
@@ -59,6 +84,14 @@ func newApp(broker *Broker, mode, route, addr, keyID, keySecret string) *App {
 		addr,
 		keyID,
 		keySecret,
+		ack,
+		uint64(time.Now().UnixNano()), // keeps numbers increasing across re-registrations and restarts
+		owner,
+		health,
+		scale,
+		deployment,
+		meta,
+		time.Now(),
 	}
 }
 
@@ -86,15 +119,27 @@ func (app *App) disconnect(clientID string) error {
 }
 
 func (app *App) forward(clientID string, session *Session, data []byte) {
-	if err := app.send(clientID, session, data); err != nil {
-		echo(Log{"t": "app", "route": app.route, "host": app.addr, "error": err.Error()})
+	var seq string
+	if app.ack {
+		seq = strconv.FormatUint(atomic.AddUint64(&app.seq, 1), 10)
+	}
+	app.broker.journal.record(app.route, clientID, session, data)
+	err := app.send(clientID, session, data, seq)
+	// Deliver at least once to apps that acknowledge queries, which tell retries apart by sequence number.
+	for i := 0; err != nil && app.ack && i < len(appRetryDelays); i++ {
+		time.Sleep(appRetryDelays[i])
+		err = app.send(clientID, session, data, seq)
+	}
+	if err != nil {
+		echo(Log{"t": "app", "route": app.route, "host": app.addr, "key": app.owner, "error": err.Error()})
 		if !app.broker.keepAppLive {
-			app.broker.dropApp(app.route)
+			app.broker.dropInstance(app, "")
+			app.broker.queue.hold(app.route, clientID, session, data)
 		}
 	}
 }
 
-func (app *App) send(clientID string, session *Session, data []byte) error {
+func (app *App) send(clientID string, session *Session, data []byte, seq string) error {
 	req, err := http.NewRequest("POST", app.addr, bytes.NewReader(data))
 	if err != nil {
 		return fmt.Errorf("failed creating request: %v", err)
@@ -106,8 +151,17 @@ func (app *App) send(clientID string, session *Session, data []byte) error {
 	if len(clientID) > 0 {
 		req.Header.Set("Wave-Client-ID", clientID)
 	}
+	if len(seq) > 0 {
+		req.Header.Set("Wave-Sequence", seq)
+	}
 	req.Header.Set("Wave-Subject-ID", session.subject)
 	req.Header.Set("Wave-Username", session.username)
+	if provider := session.providerName(); provider != "" {
+		req.Header.Set("Wave-Provider", provider)
+	}
+	if len(session.groups) > 0 {
+		req.Header.Set("Wave-Groups", strings.Join(session.groups, ","))
+	}
 	if session.subject != anon {
 		req.Header.Set("Wave-Session-ID", session.id)
 		// TODO: Figure out how can the token be nil.
@@ -0,0 +1,179 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+// RouteDeployments describes the deployments of an app run side by side on a route.
+type RouteDeployments struct {
+	Route       string             `json:"route"`
+	Deployments []DeploymentStatus `json:"deployments"`
+}
+
+// DeploymentStatus describes a deployment of an app.
+type DeploymentStatus struct {
+	Name      string `json:"name"`
+	Instances int    `json:"instances"`
+	Served    int    `json:"served"` // browser tabs, or users, for multicast apps, served
+	Weight    int    `json:"weight"` // as set
+	Share     int    `json:"share"`  // percentage of the tabs or users showing up served
+}
+
+// status describes the deployments of the app on route.
+func (p *AppPool) status(route string) RouteDeployments {
+	deployments := p.deployments()
+	total := 0
+	for _, d := range deployments {
+		total += p.weights[d]
+	}
+	rd := RouteDeployments{route, make([]DeploymentStatus, len(deployments))}
+	for i, d := range deployments {
+		s := DeploymentStatus{Name: d, Weight: p.weights[d]}
+		for _, app := range p.instances {
+			if app.deployment == d {
+				s.Instances++
+				s.Served += p.load[app]
+			}
+		}
+		if total > 0 {
+			s.Share = 100 * s.Weight / total
+		} else if i == 0 {
+			s.Share = 100
+		}
+		rd.Deployments[i] = s
+	}
+	return rd
+}
+
+// listDeployments describes the apps run as several deployments side by side, by route.
+func (b *Broker) listDeployments() []RouteDeployments {
+	b.appsMux.RLock()
+	routes := make([]RouteDeployments, 0)
+	for route, pool := range b.apps {
+		if pool.instances[0].deployment != "" {
+			routes = append(routes, pool.status(route))
+		}
+	}
+	b.appsMux.RUnlock()
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Route < routes[j].Route })
+	return routes
+}
+
+// splitApp sets the shares of the tabs or users showing up served by each deployment of the app on route, and, if
+// reload is set, reloads the tabs served by deployments no longer weighted, moving them to the others at once.
+// Returns false if there's no app on route.
+func (b *Broker) splitApp(route string, weights map[string]int, reload bool) (RouteDeployments, bool) {
+	b.appsMux.Lock()
+	pool := b.apps[route]
+	if pool == nil || pool.instances[0].deployment == "" {
+		b.appsMux.Unlock()
+		return RouteDeployments{}, false
+	}
+	pool.weights = weights
+	var moved []string
+	if reload {
+		moved = pool.unbind()
+	}
+	status := pool.status(route)
+	b.appsMux.Unlock()
+
+	entry := Log{"t": "app_split", "route": route, "reloaded": strconv.Itoa(len(moved))}
+	for _, d := range status.Deployments {
+		entry["weight_"+d.Name] = strconv.Itoa(d.Weight)
+	}
+	echo(entry)
+
+	for _, page := range moved {
+		b.resetSubscribers(page)
+	}
+	return status, true
+}
+
+// DeploymentAdminHandler lets admins see the deployments of apps run side by side, and split the tabs or users
+// showing up among them, e.g. to move users from one version of an app to the next.
+//
+//	GET /_admin/deployments          list deployments, by route
+//	PUT /_admin/deployments/<route>  set weights, e.g. {"weights": {"blue": 90, "green": 10}, "reload": false}
+type DeploymentAdminHandler struct {
+	prefix         string
+	broker         *Broker
+	admins         keychain.Authenticator
+	maxRequestSize int64
+}
+
+func newDeploymentAdminHandler(prefix string, broker *Broker, admins keychain.Authenticator, maxRequestSize int64) http.Handler {
+	return &DeploymentAdminHandler{prefix, broker, admins, maxRequestSize}
+}
+
+type deploymentSplit struct {
+	Weights map[string]int `json:"weights"`
+	Reload  bool           `json:"reload,omitempty"` // reload tabs served by deployments no longer weighted
+}
+
+func (h *DeploymentAdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.admins.Guard(w, r) {
+		return
+	}
+	route := strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(h.prefix, "/"))
+	var res any
+	switch r.Method {
+	case http.MethodGet:
+		if route != "" && route != "/" {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		res = h.broker.listDeployments()
+	case http.MethodPut:
+		b, err := readRequestWithLimit(w, r.Body, h.maxRequestSize)
+		if err != nil {
+			if isRequestTooLarge(err) {
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		var split deploymentSplit
+		if err := json.Unmarshal(b, &split); err != nil {
+			http.Error(w, "malformed split: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		for d, weight := range split.Weights {
+			if weight < 0 {
+				http.Error(w, "weight of "+strconv.Quote(d)+" must not be negative", http.StatusBadRequest)
+				return
+			}
+		}
+		status, ok := h.broker.splitApp(route, split.Weights, split.Reload)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		res = status
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"github.com/h2oai/wave/pkg/keychain/keychaintest"
+)
+
+func TestAppPoolDeploymentWeights(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	blue := &App{addr: "a", mode: unicastMode, deployment: "blue"}
+	green := &App{addr: "b", mode: unicastMode, deployment: "green"}
+	p := newAppPool(blue)
+	p.add(green)
+	eq(p.deployments(), []string{"blue", "green"})
+
+	eq(p.bind("/tab1"), blue) // none weighted: all to the first
+	p.weights = map[string]int{"green": 1}
+	eq(p.bind("/tab2"), green)
+	eq(p.bind("/tab1"), blue) // sticky
+
+	pages := p.unbind()
+	sort.Strings(pages)
+	eq(pages, []string{"/tab1"})
+	eq(p.bind("/tab1"), green)
+	eq(p.load[blue], 0)
+	eq(p.load[green], 2)
+}
+
+func TestSplitApp(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	blue := &App{route: "/demo", addr: "a", mode: unicastMode, deployment: "blue"}
+	green := &App{route: "/demo", addr: "b", mode: unicastMode, deployment: "green"}
+	pool := newAppPool(blue)
+	pool.add(green)
+	pool.bind("/tab1")
+	b := &Broker{apps: map[string]*AppPool{"/demo": pool}, publish: make(chan Pub, 4)}
+	admins, admin := keychaintest.New(t, 1)
+	h := newDeploymentAdminHandler("/_admin/deployments/", b, admins, 1<<10)
+
+	call := func(method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.SetBasicAuth(admin[0].ID, admin[0].Secret)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := call(http.MethodGet, "/_admin/deployments/", "")
+	eq(w.Code, http.StatusOK)
+	var routes []RouteDeployments
+	no(json.NewDecoder(w.Body).Decode(&routes))
+	eq(routes, []RouteDeployments{{"/demo", []DeploymentStatus{
+		{Name: "blue", Instances: 1, Served: 1, Share: 100},
+		{Name: "green", Instances: 1},
+	}}})
+
+	eq(call(http.MethodPut, "/_admin/deployments/other", `{"weights":{"green":1}}`).Code, http.StatusNotFound)
+	eq(call(http.MethodPut, "/_admin/deployments/demo", `{"weights":{"green":-1}}`).Code, http.StatusBadRequest)
+	eq(call(http.MethodPut, "/_admin/deployments/demo", `{"weights":`).Code, http.StatusBadRequest)
+
+	w = call(http.MethodPut, "/_admin/deployments/demo", `{"weights":{"blue":1,"green":3}}`)
+	eq(w.Code, http.StatusOK)
+	var status RouteDeployments
+	no(json.NewDecoder(w.Body).Decode(&status))
+	eq(status.Deployments[0].Share, 25)
+	eq(status.Deployments[1].Share, 75)
+	eq(len(b.publish), 0) // not reloaded
+
+	w = call(http.MethodPut, "/_admin/deployments/demo", `{"weights":{"green":1},"reload":true}`)
+	eq(w.Code, http.StatusOK)
+	eq(len(b.publish), 1)
+	p := <-b.publish
+	eq(p.route, "/tab1")
+	ok(string(p.data) == string(resetMsg))
+	eq(pool.bind("/tab1"), green)
+}
@@ -0,0 +1,241 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AppHealth probes registered apps every interval, unregisters those failing so many probes in a row, so that
+// browsers aren't left waiting on apps gone, and registers them again once they answer probes again.
+//
+// Apps are probed at the path they registered with, if any, which must answer GET with 2xx, else at the
+// server-wide path, if set, else by connecting to their address. Apps unregistered by the server, for failing
+// probes or queries, are probed until they answer, register again, or are forgotten; apps that unregister
+// themselves are forgotten at once.
+type AppHealth struct {
+	interval time.Duration
+	timeout  time.Duration
+	path     string        // probed if apps don't say; connect if empty
+	failures int           // probes failed in a row before an app is unregistered
+	patience time.Duration // how long apps unregistered are probed for
+	client   *http.Client
+
+	lock   sync.Mutex
+	failed map[*App]int        // app => probes failed in a row
+	lost   map[string]*lostApp // route and address => app unregistered by the server
+}
+
+type lostApp struct {
+	app   *App
+	since time.Time
+}
+
+func newAppHealth(interval, timeout time.Duration, path string, failures int, patience time.Duration) *AppHealth {
+	return &AppHealth{
+		interval: interval,
+		timeout:  timeout,
+		path:     path,
+		failures: failures,
+		patience: patience,
+		client:   &http.Client{Timeout: timeout},
+		failed:   make(map[*App]int),
+		lost:     make(map[string]*lostApp),
+	}
+}
+
+// run probes the apps registered with broker, and those it unregistered, every interval.
+func (h *AppHealth) run(broker *Broker) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.check(broker)
+	}
+}
+
+func (h *AppHealth) check(broker *Broker) {
+	apps := broker.getApps()
+	h.lock.Lock()
+	lost := make([]*lostApp, 0, len(h.lost))
+	for k, l := range h.lost {
+		if time.Since(l.since) > h.patience {
+			echo(Log{"t": "app_health", "route": l.app.route, "host": l.app.addr, "forgotten": "true"})
+			delete(h.lost, k)
+			continue
+		}
+		lost = append(lost, l)
+	}
+	h.lock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, app := range apps {
+		wg.Add(1)
+		go func(app *App) {
+			defer wg.Done()
+			h.checkApp(broker, app)
+		}(app)
+	}
+	for _, l := range lost {
+		wg.Add(1)
+		go func(l *lostApp) {
+			defer wg.Done()
+			h.checkLost(broker, l)
+		}(l)
+	}
+	wg.Wait()
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	registered := make(map[*App]bool, len(apps))
+	for _, app := range apps {
+		registered[app] = true
+	}
+	for app := range h.failed {
+		if !registered[app] {
+			delete(h.failed, app)
+		}
+	}
+}
+
+// checkApp probes a registered app, and unregisters it if it has failed too many probes in a row.
+func (h *AppHealth) checkApp(broker *Broker, app *App) {
+	err := h.probe(app)
+	h.lock.Lock()
+	if err == nil {
+		delete(h.failed, app)
+		h.lock.Unlock()
+		return
+	}
+	h.failed[app]++
+	n := h.failed[app]
+	h.lock.Unlock()
+
+	echo(Log{"t": "app_health", "route": app.route, "host": app.addr, "failures": strconv.Itoa(n), "error": err.Error()})
+	if n >= h.failures {
+		broker.dropInstance(app, "")
+	}
+}
+
+// checkLost probes an app unregistered by the server, and registers it again if it answers, and its route is
+// still free, or has other instances it can join.
+func (h *AppHealth) checkLost(broker *Broker, l *lostApp) {
+	if h.probe(l.app) != nil {
+		return
+	}
+	k := lostKey(l.app)
+	h.lock.Lock()
+	current, ok := h.lost[k]
+	if !ok || current != l {
+		h.lock.Unlock()
+		return
+	}
+	delete(h.lost, k)
+	h.lock.Unlock()
+
+	app := l.app
+	if broker.putApp(app, true) {
+		echo(Log{"t": "app_health", "route": app.route, "host": app.addr, "returned": "true", "away": time.Since(l.since).Round(time.Second).String()})
+	}
+}
+
+func lostKey(app *App) string { return app.route + " " + app.addr }
+
+// probe reports whether an app answers, or why not.
+func (h *AppHealth) probe(app *App) error {
+	path := app.health
+	if path == "" {
+		path = h.path
+	}
+	if path == "" {
+		u, err := url.Parse(app.addr)
+		if err != nil {
+			return err
+		}
+		host := u.Host
+		if u.Port() == "" {
+			if u.Scheme == "https" {
+				host = net.JoinHostPort(u.Hostname(), "443")
+			} else {
+				host = net.JoinHostPort(u.Hostname(), "80")
+			}
+		}
+		conn, err := net.DialTimeout("tcp", host, h.timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	req, err := http.NewRequest(http.MethodGet, app.addr+path, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(app.keyID, app.keySecret)
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("probe failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// status describes how an app fared in its latest probe: "ok" or "failing"; empty if apps aren't probed.
+func (h *AppHealth) status(app *App) string {
+	if h == nil {
+		return ""
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.failed[app] > 0 {
+		return "failing"
+	}
+	return "ok"
+}
+
+// dropped remembers an app the server unregistered, to probe it until it returns.
+func (h *AppHealth) dropped(app *App) {
+	if h == nil {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delete(h.failed, app)
+	h.lost[lostKey(app)] = &lostApp{app, time.Now()}
+}
+
+// forget stops probing the apps unregistered by the server at route, at addr, or any if empty, since another has
+// taken their place, or they have unregistered themselves.
+func (h *AppHealth) forget(route, addr string) {
+	if h == nil {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for k, l := range h.lost {
+		if l.app.route == route && (addr == "" || l.app.addr == addr) {
+			delete(h.lost, k)
+		}
+	}
+}
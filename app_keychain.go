@@ -0,0 +1,95 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+// AppKeychains binds app routes to keychains declared by apps during registration, so that an app's keys
+// can only be used against its own routes and pages.
+//
+// A route is bound by the first registration that declares a keychain, provided no app serves the route yet, and
+// stays bound for the lifetime of the server: re-registering or unregistering the route requires a key from the
+// bound keychain.
+type AppKeychains struct {
+	sync.RWMutex
+	dir    string                        // declared keychains are files in this directory
+	broker *Broker                       // to look up the app of unicast (per-client) pages
+	routes map[string]*keychain.Keychain // app route -> keychain
+}
+
+func newAppKeychains(dir string, broker *Broker) *AppKeychains {
+	return &AppKeychains{dir: dir, broker: broker, routes: make(map[string]*keychain.Keychain)}
+}
+
+// load reads a declared keychain. Names must be plain file names within the keychain directory.
+func (a *AppKeychains) load(name string) (*keychain.Keychain, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("invalid keychain name: %q", name)
+	}
+	return keychain.LoadKeychain(filepath.Join(a.dir, name))
+}
+
+// bind binds an app route to a keychain, and reports whether it did: routes bound to another keychain stay bound
+// to it. Binding a route to the keychain it is bound to again picks up the keychain's latest keys.
+func (a *AppKeychains) bind(route string, kc *keychain.Keychain) bool {
+	a.Lock()
+	defer a.Unlock()
+	if bound := a.routes[route]; bound != nil && bound.Name != kc.Name {
+		return false
+	}
+	a.routes[route] = kc
+	return true
+}
+
+// bound returns the keychain bound to an app route, if any.
+func (a *AppKeychains) bound(route string) *keychain.Keychain {
+	a.RLock()
+	defer a.RUnlock()
+	return a.routes[route]
+}
+
+// match returns the keychain responsible for a page URL: that of the app whose route is the longest prefix of
+// the URL, or that of the app a unicast page's client is connected to. Returns nil if no app keychain applies.
+func (a *AppKeychains) match(url string) *keychain.Keychain {
+	a.RLock()
+	var (
+		kc   *keychain.Keychain
+		best int
+	)
+	for route, rkc := range a.routes {
+		if len(route) > best && (url == route || strings.HasPrefix(url, strings.TrimSuffix(route, "/")+"/")) {
+			kc, best = rkc, len(route)
+		}
+	}
+	a.RUnlock()
+	if kc != nil {
+		return kc
+	}
+
+	// Unicast pages are addressed as /{client-id}.
+	if id := strings.TrimPrefix(url, "/"); len(id) > 0 && !strings.Contains(id, "/") {
+		if c := a.broker.getClient(id); c != nil {
+			return a.bound(c.app())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"github.com/h2oai/wave/pkg/keychain"
+	"github.com/h2oai/wave/pkg/keychain/keychaintest"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newAppKeychainFile saves a keychain holding one key to dir, and returns the key.
+func newAppKeychainFile(t *testing.T, dir, name string) keychain.Credential {
+	t.Helper()
+	kc, err := keychain.New(filepath.Join(dir, name), keychain.WithCost(bcrypt.MinCost))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, secret, hash, err := kc.CreateAccessKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kc.Add(id, hash); err != nil {
+		t.Fatal(err)
+	}
+	if err := kc.Save(); err != nil {
+		t.Fatal(err)
+	}
+	return keychain.Credential{ID: id, Secret: secret}
+}
+
+func TestAppKeychainsLoad(t *testing.T) {
+	_, ok, no := assert.Assert(t)
+	dir := t.TempDir()
+	newAppKeychainFile(t, dir, "billing")
+	a := newAppKeychains(dir, &Broker{})
+	kc, err := a.load("billing")
+	no(err)
+	ok(kc.Len() == 1)
+	for _, name := range []string{"", ".", "..", "../billing", `a\b`} {
+		_, err := a.load(name)
+		ok(err != nil, name)
+	}
+}
+
+func TestAppKeychainsMatch(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	dir := t.TempDir()
+	newAppKeychainFile(t, dir, "billing")
+	newAppKeychainFile(t, dir, "reports")
+	b := &Broker{clientsByID: map[string]*Client{"tab1": {lock: &sync.Mutex{}, appPath: "/billing"}}}
+	a := newAppKeychains(dir, b)
+	billing, err := a.load("billing")
+	no(err)
+	reports, err := a.load("reports")
+	no(err)
+
+	ok(a.bind("/billing", billing))
+	ok(a.bind("/billing/reports", reports))
+	ok(!a.bind("/billing", reports), "bound to another keychain")
+	again, err := a.load("billing")
+	no(err)
+	ok(a.bind("/billing", again), "same keychain")
+	eq(a.bound("/billing"), again)
+
+	eq(a.match("/billing"), again)
+	eq(a.match("/billing/invoices"), again)
+	eq(a.match("/billing/reports/q1"), reports) // longest prefix
+	eq(a.match("/billingx"), (*keychain.Keychain)(nil))
+	eq(a.match("/tab1"), again) // unicast page of a client of the app
+	eq(a.match("/tab2"), (*keychain.Keychain)(nil))
+}
+
+func TestAppKeychainsGuardRoutes(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	dir := t.TempDir()
+	billingKey := newAppKeychainFile(t, dir, "billing")
+	reportsKey := newAppKeychainFile(t, dir, "reports")
+	server, serverKeys := keychaintest.New(t, 1)
+	b := &Broker{apps: map[string]*AppPool{"/served": newAppPool(&App{route: "/served", mode: unicastMode})}}
+	s := &WebServer{broker: b, keychain: server, apps: newAppKeychains(dir, b), maxRequestSize: 1 << 10}
+
+	register := func(key keychain.Credential, body string) int {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		r.Header.Set("Content-Type", contentTypeJSON)
+		r.SetBasicAuth(key.ID, key.Secret)
+		w := httptest.NewRecorder()
+		s.post(w, r)
+		return w.Code
+	}
+	guard := func(key keychain.Credential, route, declared string) bool {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.SetBasicAuth(key.ID, key.Secret)
+		_, ok := s.guardApp(httptest.NewRecorder(), r, route, declared)
+		return ok
+	}
+
+	// Routes served by other apps can't be claimed with an app keychain.
+	ok(!guard(billingKey, "/served", "billing"))
+	ok(guard(serverKeys[0], "/served", ""))
+
+	// Keys must come from the keychain declared.
+	ok(!guard(serverKeys[0], "/billing", "billing"))
+	ok(!guard(reportsKey, "/billing", "billing"))
+	ok(!guard(billingKey, "/billing", "../billing"))
+
+	// Failed registrations don't bind the route.
+	eq(register(billingKey, `{"register_app":{"mode":"broadcast","route":"/billing","keychain":"billing","scale":true}}`), http.StatusBadRequest)
+	ok(s.apps.bound("/billing") == nil)
+
+	ok(guard(billingKey, "/billing", "billing"))
+	billing, err := s.apps.load("billing")
+	no(err)
+	ok(s.apps.bind("/billing", billing))
+	ok(guard(billingKey, "/billing", "billing"))
+	ok(guard(billingKey, "/billing", ""))
+	ok(!guard(serverKeys[0], "/billing", ""), "bound routes need keys from their keychain")
+	ok(!guard(reportsKey, "/billing", "reports"), "bound to another keychain")
+}
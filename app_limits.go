@@ -0,0 +1,229 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	errAppPatchRate  = errors.New("app exceeds its patch rate")
+	errAppPages      = errors.New("app exceeds its page count")
+	errAppBufferSize = errors.New("app exceeds its buffer size")
+)
+
+// AppLimits caps what each app, identified by the API access key it uses, may do, so that one runaway app can't
+// exhaust a server shared by many.
+type AppLimits struct {
+	MaxPatchRate  int   // patches per second; 0 for no limit
+	MaxPages      int   // pages created; 0 for no limit
+	MaxBufferSize int   // rows of each data buffer created; 0 for no limit
+	MaxStorage    int64 // bytes of uploaded files stored; 0 for no limit
+	Warn          bool  // log and count what exceeds limits, rather than reject it
+}
+
+func (l AppLimits) enabled() bool {
+	return l.MaxPatchRate > 0 || l.MaxPages > 0 || l.MaxBufferSize > 0 || l.MaxStorage > 0
+}
+
+// AppLimiter enforces AppLimits, and counts what each app does, and the limits it runs into, for metrics.
+//
+// Pages count toward the app whose patch created them, for as long as they are kept; pages of browser tabs, and
+// pages created before the server started, don't count. Buffers are measured by the rows they are created with, or
+// their size, if larger; rows added to map buffers later aren't counted.
+type AppLimiter struct {
+	limits AppLimits
+	site   *Site // to tell which pages are kept
+
+	lock sync.Mutex
+	apps map[string]*appUsage // access key id => usage
+}
+
+type appUsage struct {
+	throttle *throttle
+	pages    map[string]bool  // pages created
+	patches  int64            // accepted
+	exceeded map[string]int64 // limit => times exceeded
+}
+
+func newAppLimiter(limits AppLimits, site *Site) *AppLimiter {
+	return &AppLimiter{limits: limits, site: site, apps: make(map[string]*appUsage)}
+}
+
+func (l *AppLimiter) usage(key string) *appUsage {
+	u, ok := l.apps[key]
+	if !ok {
+		u = &appUsage{
+			throttle: newThrottle(SocketLimits{MaxMessageRate: l.limits.MaxPatchRate}),
+			pages:    make(map[string]bool),
+			exceeded: make(map[string]int64),
+		}
+		l.apps[key] = u
+	}
+	return u
+}
+
+// exceeded counts and logs a limit an app ran into, patching url, if any, and returns err if the limit is enforced.
+func (l *AppLimiter) exceeded(u *appUsage, key, url, limit string, err error) error {
+	u.exceeded[limit]++
+	entry := Log{"t": "app_limit", "app": key, "limit": limit, "error": err.Error(), "warn": strconv.FormatBool(l.limits.Warn)}
+	if url != "" {
+		entry["route"] = url
+	}
+	echo(entry)
+	if l.limits.Warn {
+		return nil
+	}
+	return err
+}
+
+// admit fails if the app using key may not patch the page at url; unicast pages belong to browser tabs.
+func (l *AppLimiter) admit(key, url string, unicast bool, data []byte) error {
+	if l == nil {
+		return nil
+	}
+	var ops OpsD
+	if l.limits.MaxPages > 0 || l.limits.MaxBufferSize > 0 {
+		if err := json.Unmarshal(data, &ops); err != nil {
+			return nil // malformed; rejected by validation, if enabled, or ignored when applied
+		}
+	}
+	created := l.limits.MaxPages > 0 && !unicast && l.site.at(url) == nil
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	u := l.usage(key)
+	var err error
+	check := func(e error) {
+		if err == nil {
+			err = e
+		}
+	}
+	if l.limits.MaxPatchRate > 0 && u.throttle.wait(1) > 0 {
+		check(l.exceeded(u, key, url, "patch_rate", errAppPatchRate))
+	}
+	if created && len(u.pages) >= l.limits.MaxPages && !u.pages[url] {
+		for page := range u.pages { // forget pages deleted since
+			if l.site.at(page) == nil {
+				delete(u.pages, page)
+			}
+		}
+		if len(u.pages) >= l.limits.MaxPages {
+			check(l.exceeded(u, key, url, "pages", errAppPages))
+		}
+	}
+	if l.limits.MaxBufferSize > 0 && largestBuffer(ops) > l.limits.MaxBufferSize {
+		check(l.exceeded(u, key, url, "buffer_size", errAppBufferSize))
+	}
+	if err != nil {
+		if l.limits.MaxPatchRate > 0 {
+			u.throttle.messages++ // rejected patches don't count toward the rate
+		}
+		return err
+	}
+	u.patches++
+	if created {
+		u.pages[url] = true
+	}
+	return nil
+}
+
+// largestBuffer returns the size of the largest data buffer created by changes.
+func largestBuffer(ops OpsD) int {
+	n := 0
+	if ops.P != nil {
+		for _, c := range ops.P.C {
+			for _, b := range c.B {
+				n = max(n, bufSize(b))
+			}
+		}
+	}
+	for _, op := range ops.D {
+		n = max(n, bufSize(BufD{C: op.C, F: op.F, M: op.M, L: op.L}))
+		for _, b := range op.B {
+			n = max(n, bufSize(b))
+		}
+	}
+	return n
+}
+
+func bufSize(b BufD) int {
+	switch {
+	case b.C != nil:
+		return max(b.C.N, len(b.C.D))
+	case b.F != nil:
+		return max(b.F.N, len(b.F.D))
+	case b.M != nil:
+		return len(b.M.D)
+	case b.L != nil:
+		return max(b.L.N, len(b.L.D))
+	}
+	return 0
+}
+
+// storageLeft returns how many more bytes owner may upload, or -1 if there is no limit, or it isn't enforced.
+func (l *AppLimiter) storageLeft(owner string, used int64) int64 {
+	if l == nil || l.limits.MaxStorage <= 0 || l.limits.Warn || !strings.HasPrefix(owner, "key:") {
+		return -1
+	}
+	return max(l.limits.MaxStorage-used, 0)
+}
+
+// store fails if the app uploading as owner may not store total bytes of files.
+func (l *AppLimiter) store(owner string, total int64) error {
+	if l == nil || l.limits.MaxStorage <= 0 || total <= l.limits.MaxStorage || !strings.HasPrefix(owner, "key:") {
+		return nil
+	}
+	key := strings.TrimPrefix(owner, "key:")
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.exceeded(l.usage(key), key, "", "storage", errQuotaExceeded)
+}
+
+// appMetrics describes what an app did, and the limits it ran into.
+type appMetrics struct {
+	app      string
+	patches  int64
+	pages    int
+	exceeded map[string]int64
+}
+
+func (l *AppLimiter) metrics() []appMetrics {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	metrics := make([]appMetrics, 0, len(l.apps))
+	for key, u := range l.apps {
+		for page := range u.pages {
+			if l.site.at(page) == nil {
+				delete(u.pages, page)
+			}
+		}
+		exceeded := make(map[string]int64, len(u.exceeded))
+		for limit, n := range u.exceeded {
+			exceeded[limit] = n
+		}
+		metrics = append(metrics, appMetrics{key, u.patches, len(u.pages), exceeded})
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].app < metrics[j].app })
+	return metrics
+}
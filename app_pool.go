@@ -0,0 +1,210 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import "math/rand"
+
+// AppPool is the instances of an app registered on a route: one, unless the app scales, or several deployments of
+// it, e.g. two versions, run side by side, in which case each browser tab, or each user, for multicast apps, is
+// served by the instance serving the fewest when it first shows up, of the deployment picked by weight, and by the
+// same instance for as long as it stays registered, since apps keep state in memory.
+type AppPool struct {
+	instances []*App
+	bound     map[string]*App // page of a browser tab or user, e.g. /<client id> => instance serving it
+	load      map[*App]int    // instance => tabs or users bound to it
+	order     []string        // deployments, in the order they first registered
+	weights   map[string]int  // deployment => share of the tabs or users showing up; nil for all to the first
+}
+
+func newAppPool(app *App) *AppPool {
+	return &AppPool{[]*App{app}, make(map[string]*App), map[*App]int{app: 0}, []string{app.deployment}, nil}
+}
+
+// joins reports whether an app may join the instances, rather than replace them: apps of named deployments join
+// those of others, and apps that scale join other instances of theirs.
+func (p *AppPool) joins(app *App) bool {
+	if !app.scale && app.deployment == "" {
+		return false
+	}
+	for _, other := range p.instances {
+		if other.mode != app.mode {
+			return false
+		}
+		if (other.deployment == "" || app.deployment == "") && (other.deployment != app.deployment || !other.scale) {
+			return false
+		}
+	}
+	return true
+}
+
+// replaced returns the instances an app joining replaces: those of its deployment at its address, or all of them,
+// unless they scale.
+func (p *AppPool) replaced(app *App) []*App {
+	var apps []*App
+	for _, other := range p.instances {
+		if other.deployment == app.deployment && (other.addr == app.addr || !other.scale || !app.scale) {
+			apps = append(apps, other)
+		}
+	}
+	return apps
+}
+
+// at returns the instance at addr, if any.
+func (p *AppPool) at(addr string) *App {
+	for _, app := range p.instances {
+		if app.addr == addr {
+			return app
+		}
+	}
+	return nil
+}
+
+func (p *AppPool) has(app *App) bool {
+	_, ok := p.load[app]
+	return ok
+}
+
+func (p *AppPool) add(app *App) {
+	p.instances = append(p.instances, app)
+	p.load[app] = 0
+	for _, d := range p.order {
+		if d == app.deployment {
+			return
+		}
+	}
+	p.order = append(p.order, app.deployment)
+}
+
+// remove removes an instance, and returns the pages of the tabs or users it served, which are served by others from
+// then on.
+func (p *AppPool) remove(app *App) []string {
+	for i, other := range p.instances {
+		if other == app {
+			p.instances = append(p.instances[:i:i], p.instances[i+1:]...)
+			break
+		}
+	}
+	delete(p.load, app)
+	var pages []string
+	for page, other := range p.bound {
+		if other == app {
+			delete(p.bound, page)
+			pages = append(pages, page)
+		}
+	}
+	return pages
+}
+
+// page returns the page an instance is picked by for a browser tab: the tab's for unicast apps, the user's for
+// multicast apps.
+func (p *AppPool) page(clientID, subject string) string {
+	if p.instances[0].mode == multicastMode {
+		return "/" + subject
+	}
+	return "/" + clientID
+}
+
+// lookup returns the instance serving page, if any is bound to it.
+func (p *AppPool) lookup(page string) (*App, bool) {
+	if first := p.instances[0]; !first.scale && first.deployment == "" { // the only one
+		return first, true
+	}
+	app, ok := p.bound[page]
+	return app, ok
+}
+
+// bind binds page to the instance serving the fewest, of the deployment picked, and returns it.
+func (p *AppPool) bind(page string) *App {
+	if app, ok := p.lookup(page); ok {
+		return app
+	}
+	deployment := p.pick()
+	var least *App
+	for _, app := range p.instances {
+		if app.deployment != deployment {
+			continue
+		}
+		if least == nil || p.load[app] < p.load[least] {
+			least = app
+		}
+	}
+	p.bound[page] = least
+	p.load[least]++
+	return least
+}
+
+// pick picks a deployment for a tab or user showing up, at random, by weight, or the first to have registered if
+// none of those registered has any.
+func (p *AppPool) pick() string {
+	deployments := p.deployments()
+	total := 0
+	for _, d := range deployments {
+		total += p.weights[d]
+	}
+	if total == 0 {
+		return deployments[0]
+	}
+	n := rand.Intn(total)
+	for _, d := range deployments {
+		if n < p.weights[d] {
+			return d
+		}
+		n -= p.weights[d]
+	}
+	return deployments[0]
+}
+
+// deployments returns the deployments registered, in the order they first were.
+func (p *AppPool) deployments() []string {
+	registered := make(map[string]bool)
+	for _, app := range p.instances {
+		registered[app.deployment] = true
+	}
+	var deployments []string
+	for _, d := range p.order {
+		if registered[d] {
+			deployments = append(deployments, d)
+		}
+	}
+	return deployments
+}
+
+// unbind unbinds the pages served by the deployments no longer weighted, if others are, and returns them, to be
+// served by the others once reloaded.
+func (p *AppPool) unbind() []string {
+	weighted := false
+	for _, d := range p.deployments() {
+		weighted = weighted || p.weights[d] > 0
+	}
+	if !weighted {
+		return nil
+	}
+	var pages []string
+	for page, app := range p.bound {
+		if p.weights[app.deployment] == 0 {
+			p.release(page)
+			pages = append(pages, page)
+		}
+	}
+	return pages
+}
+
+// release unbinds page from the instance serving it, if any.
+func (p *AppPool) release(page string) {
+	if app, ok := p.bound[page]; ok {
+		delete(p.bound, page)
+		p.load[app]--
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestAppPoolJoins(t *testing.T) {
+	_, ok, _ := assert.Assert(t)
+	single := newAppPool(&App{route: "/demo", addr: "a", mode: unicastMode})
+	ok(!single.joins(&App{route: "/demo", addr: "b", mode: unicastMode, scale: true}), "replaces an app that doesn't scale")
+
+	scaled := newAppPool(&App{route: "/demo", addr: "a", mode: unicastMode, scale: true})
+	ok(scaled.joins(&App{route: "/demo", addr: "b", mode: unicastMode, scale: true}))
+	ok(!scaled.joins(&App{route: "/demo", addr: "b", mode: unicastMode}), "doesn't scale")
+	ok(!scaled.joins(&App{route: "/demo", addr: "b", mode: broadcastMode, scale: true}), "other mode")
+	ok(!scaled.joins(&App{route: "/demo", addr: "b", mode: unicastMode, deployment: "green"}), "named deployment")
+
+	blue := newAppPool(&App{route: "/demo", addr: "a", mode: unicastMode, deployment: "blue"})
+	ok(blue.joins(&App{route: "/demo", addr: "b", mode: unicastMode, deployment: "green"}))
+	ok(!blue.joins(&App{route: "/demo", addr: "b", mode: unicastMode}), "unnamed deployment")
+}
+
+func TestAppPoolReplaced(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	a := &App{addr: "a", scale: true, deployment: "blue"}
+	b := &App{addr: "b", scale: true, deployment: "blue"}
+	c := &App{addr: "c", deployment: "green"}
+	p := newAppPool(a)
+	p.add(b)
+	p.add(c)
+	eq(p.replaced(&App{addr: "a", scale: true, deployment: "blue"}), []*App{a}) // restarted
+	eq(p.replaced(&App{addr: "d", scale: true, deployment: "blue"}), []*App(nil))
+	eq(p.replaced(&App{addr: "d", deployment: "blue"}), []*App{a, b}) // no longer scales
+	eq(p.replaced(&App{addr: "d", deployment: "green"}), []*App{c})
+	eq(p.at("b"), b)
+	eq(p.at("d"), (*App)(nil))
+}
+
+func TestAppPoolBindsTabsToInstances(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	a := &App{addr: "a", mode: unicastMode, scale: true}
+	b := &App{addr: "b", mode: unicastMode, scale: true}
+	p := newAppPool(a)
+	p.add(b)
+
+	eq(p.page("tab1", "alice"), "/tab1")
+	first, second := p.bind("/tab1"), p.bind("/tab2")
+	ok(first != second, "least loaded")
+	eq(p.bind("/tab1"), first) // sticky
+	app, bound := p.lookup("/tab3")
+	ok(!bound)
+	ok(app == nil)
+
+	pages := p.remove(first)
+	eq(pages, []string{"/tab1"})
+	ok(!p.has(first))
+	eq(p.bind("/tab1"), second)
+	eq(p.load[second], 2)
+	p.release("/tab1")
+	eq(p.load[second], 1)
+}
+
+func TestAppPoolSingleInstance(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	a := &App{addr: "a", mode: multicastMode}
+	p := newAppPool(a)
+	eq(p.page("tab1", "alice"), "/alice")
+	app, bound := p.lookup("/alice")
+	ok(bound)
+	eq(app, a)
+	eq(p.bind("/bob"), a)
+	eq(len(p.bound), 0)
+}
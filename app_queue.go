@@ -0,0 +1,174 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AppQueue holds the events browsers send to apps gone away, e.g. restarting, and delivers them once the apps
+// register again, instead of dropping them. Browsers showing an app gone away aren't reloaded, unless it hasn't
+// returned within the time allowed, or returns in another mode.
+type AppQueue struct {
+	size int           // events held per route; the oldest are dropped first
+	ttl  time.Duration // how long apps may be away before their events are dropped
+
+	lock   sync.Mutex
+	routes map[string]*awayApp // route => app gone away
+}
+
+type awayApp struct {
+	mode    AppMode
+	since   time.Time
+	events  []heldEvent
+	dropped int // events dropped, the queue being full
+}
+
+type heldEvent struct {
+	clientID string
+	session  *Session
+	data     []byte
+}
+
+func newAppQueue(size int, ttl time.Duration) *AppQueue {
+	return &AppQueue{size: size, ttl: ttl, routes: make(map[string]*awayApp)}
+}
+
+// away starts holding events for app's route, the last instance of the app having gone, and reports whether it
+// does, so that browsers showing the app wait for it to return.
+func (q *AppQueue) away(app *App) bool {
+	if q == nil {
+		return false
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, ok := q.routes[app.route]; !ok {
+		q.routes[app.route] = &awayApp{mode: app.mode, since: time.Now()}
+	}
+	return true
+}
+
+// mode returns the mode of the app gone away from route, if any.
+func (q *AppQueue) mode(route string) (AppMode, bool) {
+	if q == nil {
+		return 0, false
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if a, ok := q.routes[route]; ok {
+		return a.mode, true
+	}
+	return 0, false
+}
+
+// hold holds an event sent by a browser tab to the app gone away from route, and reports whether it does.
+func (q *AppQueue) hold(route, clientID string, session *Session, data []byte) bool {
+	if q == nil || clientID == "" {
+		return false
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	a, ok := q.routes[route]
+	if !ok {
+		return false
+	}
+	if len(a.events) >= q.size {
+		if a.dropped++; a.dropped == 1 {
+			echo(Log{"t": "app_queue", "route": route, "error": "queue full, dropping oldest events"})
+		}
+		a.events = a.events[1:]
+	}
+	a.events = append(a.events, heldEvent{clientID, session, data})
+	return true
+}
+
+// forget drops the events held for the app gone away from route sent by a browser tab since gone too.
+func (q *AppQueue) forget(route, clientID string) {
+	if q == nil {
+		return
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	a, ok := q.routes[route]
+	if !ok {
+		return
+	}
+	events := a.events[:0]
+	for _, e := range a.events {
+		if e.clientID != clientID {
+			events = append(events, e)
+		}
+	}
+	a.events = events
+}
+
+// back stops holding events for app's route, the app having registered again, and returns those held, in the order
+// sent. Reports false if browsers showing the route must be reloaded: the app wasn't away, or is back in another mode.
+func (q *AppQueue) back(app *App) ([]heldEvent, bool) {
+	if q == nil {
+		return nil, false
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	a, ok := q.routes[app.route]
+	if !ok {
+		return nil, false
+	}
+	delete(q.routes, app.route)
+	if a.mode != app.mode {
+		return nil, false
+	}
+	return a.events, true
+}
+
+func (q *AppQueue) run(broker *Broker) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		q.expire(broker)
+	}
+}
+
+// expire drops the events held for apps away for too long, reloading the browsers showing them.
+func (q *AppQueue) expire(broker *Broker) {
+	q.lock.Lock()
+	var routes []string
+	for route, a := range q.routes {
+		if time.Since(a.since) > q.ttl {
+			echo(Log{"t": "app_queue", "route": route, "expired": strconv.Itoa(len(a.events)), "dropped": strconv.Itoa(a.dropped)})
+			delete(q.routes, route)
+			routes = append(routes, route)
+		}
+	}
+	q.lock.Unlock()
+
+	for _, route := range routes {
+		broker.resetSubscribers(route)
+	}
+}
+
+// redeliver delivers events held for the app on route once it is back, holding them again if it goes away meanwhile.
+func (b *Broker) redeliver(route string, events []heldEvent) {
+	echo(Log{"t": "app_queue", "route": route, "delivered": strconv.Itoa(len(events))})
+	for _, e := range events {
+		if app := b.appFor(route, e.clientID, e.session.subject); app != nil {
+			app.forward(e.clientID, e.session, e.data)
+		} else if !b.queue.hold(route, e.clientID, e.session, e.data) {
+			echo(Log{"t": "app_queue", "route": route, "client": e.clientID, "error": "service unavailable"})
+		}
+	}
+}
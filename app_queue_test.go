@@ -0,0 +1,91 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestAppQueueHoldsEventsUntilBack(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	q := newAppQueue(2, time.Minute)
+	app := &App{route: "/demo", mode: unicastMode}
+	s := &Session{}
+
+	ok(!q.hold("/demo", "tab1", s, []byte("0")), "app not away")
+	ok(q.away(app))
+	mode, away := q.mode("/demo")
+	ok(away)
+	eq(mode, unicastMode)
+
+	ok(q.hold("/demo", "tab1", s, []byte("1")))
+	ok(q.hold("/demo", "tab2", s, []byte("2")))
+	ok(q.hold("/demo", "tab1", s, []byte("3"))) // full: drops the oldest
+	ok(!q.hold("/demo", "", s, []byte("4")), "no client")
+	ok(!q.hold("/other", "tab1", s, []byte("5")), "other route")
+
+	q.forget("/demo", "tab2") // tab closed
+
+	events, back := q.back(app)
+	ok(back)
+	eq(len(events), 1)
+	eq(events[0].clientID, "tab1")
+	eq(string(events[0].data), "3")
+
+	_, away = q.mode("/demo")
+	ok(!away)
+	_, back = q.back(app)
+	ok(!back, "not away anymore")
+}
+
+func TestAppQueueResetsOnModeChange(t *testing.T) {
+	_, ok, _ := assert.Assert(t)
+	q := newAppQueue(8, time.Minute)
+	ok(q.away(&App{route: "/demo", mode: unicastMode}))
+	ok(q.hold("/demo", "tab1", &Session{}, []byte("1")))
+	events, back := q.back(&App{route: "/demo", mode: broadcastMode})
+	ok(!back)
+	ok(events == nil)
+}
+
+func TestAppQueueExpires(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	q := newAppQueue(8, time.Minute)
+	b := &Broker{publish: make(chan Pub, 2)}
+	ok(q.away(&App{route: "/old", mode: unicastMode}))
+	ok(q.away(&App{route: "/new", mode: unicastMode}))
+	q.routes["/old"].since = time.Now().Add(-2 * time.Minute)
+
+	q.expire(b)
+	eq(len(b.publish), 1)
+	p := <-b.publish
+	eq(p.route, "/old")
+	_, away := q.mode("/old")
+	ok(!away)
+	_, away = q.mode("/new")
+	ok(away)
+}
+
+func TestAppQueueDisabled(t *testing.T) {
+	_, ok, _ := assert.Assert(t)
+	var q *AppQueue
+	ok(!q.away(&App{route: "/demo"}))
+	ok(!q.hold("/demo", "tab1", &Session{}, nil))
+	_, back := q.back(&App{route: "/demo"})
+	ok(!back)
+}
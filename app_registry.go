@@ -0,0 +1,133 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+// AppInfo describes an app registered with the server, to catalogs and launchers.
+type AppInfo struct {
+	Route      string    `json:"route"`
+	Mode       string    `json:"mode"`
+	Owner      string    `json:"owner,omitempty"`  // ID of the access key the app registered with
+	Instances  int       `json:"instances"`        // processes serving the app; more than one if it scales
+	Health     string    `json:"health,omitempty"` // ok, degraded (some instances failing probes) or failing; empty if apps aren't probed
+	Registered time.Time `json:"registered"`       // when the latest instance registered
+	AppMeta              // as published by the latest instance
+}
+
+// listApps describes the apps registered, by route.
+func (b *Broker) listApps() []AppInfo {
+	b.appsMux.RLock()
+	infos := make([]AppInfo, 0, len(b.apps))
+	for route, pool := range b.apps {
+		latest := pool.instances[0]
+		failing := 0
+		for _, app := range pool.instances {
+			if app.added.After(latest.added) {
+				latest = app
+			}
+			if b.health.status(app) == "failing" {
+				failing++
+			}
+		}
+		health := b.health.status(latest)
+		if health != "" {
+			switch failing {
+			case 0:
+				health = "ok"
+			case len(pool.instances):
+				health = "failing"
+			default:
+				health = "degraded"
+			}
+		}
+		infos = append(infos, AppInfo{route, latest.mode.String(), latest.owner, len(pool.instances), health, latest.added.UTC(), latest.meta})
+	}
+	b.appsMux.RUnlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Route < infos[j].Route })
+	return infos
+}
+
+// AppRegistryHandler lists the apps registered, for API access keys and signed-in users, e.g. to build catalogs and
+// launchers. Each sees only the apps it may open.
+//
+//	GET /_apps
+//	GET /_apps?tag=finance
+type AppRegistryHandler struct {
+	broker   *Broker
+	keychain keychain.Authenticator
+	auth     *Auth
+}
+
+func newAppRegistryHandler(broker *Broker, keychain keychain.Authenticator, auth *Auth) http.Handler {
+	return &AppRegistryHandler{broker, keychain, auth}
+}
+
+func (h *AppRegistryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, ok := h.identify(r)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	tag := r.URL.Query().Get("tag")
+	apps := make([]AppInfo, 0)
+	for _, app := range h.broker.listApps() {
+		if tag != "" && !hasTag(app.Tags, tag) {
+			continue
+		}
+		if !h.broker.authorize(id, RouteSubscribe, app.Route) {
+			continue
+		}
+		apps = append(apps, app)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apps)
+}
+
+// identify returns who is asking: an API access key, a signed-in user, or anyone, if auth is disabled.
+func (h *AppRegistryHandler) identify(r *http.Request) (Identity, bool) {
+	if h.keychain.Allow(r) {
+		key, _, _ := r.BasicAuth()
+		return Identity{Key: key}, true
+	}
+	session := anonymous
+	if h.auth != nil {
+		if session = h.auth.identify(r); session == nil {
+			return Identity{}, false
+		}
+	}
+	return Identity{Subject: session.subject, Username: session.username, Groups: session.groups}, true
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,237 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/h2oai/wave/pkg/keychain"
+	"gopkg.in/yaml.v3"
+)
+
+const secretCommandTimeout = 10 * time.Second
+
+var envNameRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// AppSecretsConf lists the secrets the server passes to apps, so that apps don't each have to fetch their own.
+type AppSecretsConf struct {
+	Apps []AppSecretGrant `yaml:"apps"`
+}
+
+// AppSecretGrant passes secrets, as environment variables, to the apps registering on a route, and to an app
+// process the server runs. Apps registering on the route must use one of the access keys listed, or a key from the
+// app keychain named, if any, or both.
+type AppSecretGrant struct {
+	Route     string                  `yaml:"route"`      // apps registering here are sent the secrets, if set
+	Keys      []string                `yaml:"keys"`       // IDs of the access keys apps must register with, if any
+	Keychain  string                  `yaml:"keychain"`   // app keychain, in -app-keychain-dir, apps must register with, if any
+	Process   string                  `yaml:"process"`    // app process started with the secrets, if set
+	AccessKey bool                    `yaml:"access_key"` // start the process with an access key of its own
+	Secrets   map[string]SecretSource `yaml:"secrets"`    // environment variable => where its value comes from
+}
+
+// SecretSource is where a secret comes from: a value, a file, a variable of the server's environment, or what a
+// command prints, e.g. to read it from a vault. Secrets are read each time they are passed on, so that changes
+// apply once apps register or start again.
+type SecretSource struct {
+	Value   string   `yaml:"value"`
+	File    string   `yaml:"file"`
+	Env     string   `yaml:"env"`
+	Command []string `yaml:"command"` // program and arguments, not run by a shell
+}
+
+// LoadAppSecretsConf reads the secrets to pass to apps from a YAML file:
+//
+//	apps:
+//	  - route: /sales
+//	    keys: [6c6b3b9e]
+//	    process: sales
+//	    access_key: true
+//	    secrets:
+//	      DB_USER: {value: sales}
+//	      DB_PASSWORD: {file: /run/secrets/sales-db}
+//	      STRIPE_KEY: {env: SALES_STRIPE_KEY}
+//	      API_TOKEN: {command: [vault, kv, get, -field=token, secret/sales]}
+func LoadAppSecretsConf(name string) (*AppSecretsConf, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading app secrets file %s: %v", name, err)
+	}
+	var c AppSecretsConf
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("invalid app secrets file %s: %v", name, err)
+	}
+	for i, g := range c.Apps {
+		if g.Route == "" && g.Process == "" {
+			return nil, fmt.Errorf("app secrets file %s: entry %d: route or process is required", name, i+1)
+		}
+		if g.Route != "" && !strings.HasPrefix(g.Route, "/") {
+			return nil, fmt.Errorf("app secrets file %s: entry %d: invalid route %q: want a path, e.g. /sales", name, i+1, g.Route)
+		}
+		if g.Route != "" && len(g.Keys) == 0 && g.Keychain == "" {
+			return nil, fmt.Errorf("app secrets file %s: entry %d: keys or keychain is required with route, else any app could register there for the secrets", name, i+1)
+		}
+		if g.Keychain != "" && (g.Route == "" || g.Keychain == "." || g.Keychain == ".." || strings.ContainsAny(g.Keychain, `/\`)) {
+			return nil, fmt.Errorf("app secrets file %s: entry %d: invalid keychain %q: want the name of a file in -app-keychain-dir, with route", name, i+1, g.Keychain)
+		}
+		if g.AccessKey && g.Process == "" {
+			return nil, fmt.Errorf("app secrets file %s: entry %d: access_key needs a process", name, i+1)
+		}
+		for env, src := range g.Secrets {
+			if !envNameRE.MatchString(env) {
+				return nil, fmt.Errorf("app secrets file %s: entry %d: invalid variable name %q", name, i+1, env)
+			}
+			n := 0
+			for _, set := range []bool{src.Value != "", src.File != "", src.Env != "", len(src.Command) > 0} {
+				if set {
+					n++
+				}
+			}
+			if n != 1 {
+				return nil, fmt.Errorf("app secrets file %s: entry %d: %s: want exactly one of value, file, env or command", name, i+1, env)
+			}
+		}
+	}
+	return &c, nil
+}
+
+// AppSecrets passes secrets to apps, as they register, or as the server starts them.
+type AppSecrets struct {
+	grants []AppSecretGrant
+	keys   map[string][2]string // process => ID and secret of the access key minted for it
+}
+
+// newAppSecrets prepares the secrets to pass to apps, minting access keys, never saved, in kc, for the processes
+// that get their own, with the scope apps must register with, if any.
+func newAppSecrets(conf *AppSecretsConf, kc *keychain.Keychain, scope string) (*AppSecrets, error) {
+	s := &AppSecrets{conf.Apps, make(map[string][2]string)}
+	for _, g := range conf.Apps {
+		if !g.AccessKey {
+			continue
+		}
+		id, secret, hash, err := kc.CreateAccessKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed creating access key for app process %s: %v", g.Process, err)
+		}
+		metadata := map[string]string{"process": g.Process}
+		if scope != "" {
+			metadata["scope"] = scope
+		}
+		kc.AddTransientEntry(keychain.Entry{ID: id, Hash: hash, Metadata: metadata})
+		s.keys[g.Process] = [2]string{id, secret}
+	}
+	return s, nil
+}
+
+// forRoute returns the secrets for an app registering on route with the access key key, from the app keychain
+// named kc, if any.
+func (s *AppSecrets) forRoute(route, key, kc string) (map[string]string, error) {
+	if s == nil {
+		return nil, nil
+	}
+	env := make(map[string]string)
+	for _, g := range s.grants {
+		if g.Route == "" || g.Route != route {
+			continue
+		}
+		if (len(g.Keys) > 0 && !slices.Contains(g.Keys, key)) || (g.Keychain != "" && g.Keychain != kc) {
+			continue
+		}
+		if err := g.read(env); err != nil {
+			return nil, err
+		}
+	}
+	return env, nil
+}
+
+// forProcess returns the secrets for an app process the server starts, as environment variables.
+func (s *AppSecrets) forProcess(name string) ([]string, error) {
+	if s == nil {
+		return nil, nil
+	}
+	env := make(map[string]string)
+	for _, g := range s.grants {
+		if g.Process != name {
+			continue
+		}
+		if err := g.read(env); err != nil {
+			return nil, err
+		}
+	}
+	if key, ok := s.keys[name]; ok {
+		env["H2O_WAVE_ACCESS_KEY_ID"], env["H2O_WAVE_ACCESS_KEY_SECRET"] = key[0], key[1]
+	}
+	vars := make([]string, 0, len(env))
+	for k, v := range env {
+		vars = append(vars, k+"="+v)
+	}
+	sort.Strings(vars)
+	return vars, nil
+}
+
+// read reads the grant's secrets into env.
+func (g AppSecretGrant) read(env map[string]string) error {
+	for name, src := range g.Secrets {
+		v, err := src.read()
+		if err != nil {
+			return fmt.Errorf("failed reading secret %s: %v", name, err)
+		}
+		env[name] = v
+	}
+	return nil
+}
+
+func (src SecretSource) read() (string, error) {
+	switch {
+	case src.File != "":
+		b, err := os.ReadFile(src.File)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	case src.Env != "":
+		v, ok := os.LookupEnv(src.Env)
+		if !ok {
+			return "", fmt.Errorf("%s is not set", src.Env)
+		}
+		return v, nil
+	case len(src.Command) > 0:
+		ctx, cancel := context.WithTimeout(context.Background(), secretCommandTimeout)
+		defer cancel()
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, src.Command[0], src.Command[1:]...)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return "", fmt.Errorf("%s: %v: %s", src.Command[0], err, msg)
+			}
+			return "", fmt.Errorf("%s: %v", src.Command[0], err)
+		}
+		return strings.TrimRight(string(out), "\r\n"), nil
+	}
+	return src.Value, nil
+}
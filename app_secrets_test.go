@@ -0,0 +1,121 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"github.com/h2oai/wave/pkg/keychain/keychaintest"
+)
+
+func loadSecretsConf(t *testing.T, yaml string) (*AppSecretsConf, error) {
+	name := filepath.Join(t.TempDir(), "secrets.yaml")
+	if err := os.WriteFile(name, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadAppSecretsConf(name)
+}
+
+func TestLoadAppSecretsConfRequiresKeysForRoutes(t *testing.T) {
+	_, ok, no := assert.Assert(t)
+	_, err := loadSecretsConf(t, "apps:\n  - route: /sales\n    secrets:\n      TOKEN: {value: x}\n")
+	ok(err != nil && strings.Contains(err.Error(), "keys or keychain is required"), err)
+
+	_, err = loadSecretsConf(t, "apps:\n  - route: /sales\n    keychain: ../sales\n    secrets:\n      TOKEN: {value: x}\n")
+	ok(err != nil && strings.Contains(err.Error(), "invalid keychain"), err)
+
+	_, err = loadSecretsConf(t, "apps:\n  - route: /sales\n    keys: [k1]\n    secrets:\n      TOKEN: {value: x}\n")
+	no(err)
+	_, err = loadSecretsConf(t, "apps:\n  - route: /sales\n    keychain: sales\n    secrets:\n      TOKEN: {value: x}\n")
+	no(err)
+	_, err = loadSecretsConf(t, "apps:\n  - process: ops\n    secrets:\n      TOKEN: {value: x}\n")
+	no(err)
+}
+
+func TestAppSecretsForRoute(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	kc, _ := keychaintest.New(t, 0)
+	t.Setenv("WAVE_TEST_SECRET", "from-env")
+	s, err := newAppSecrets(&AppSecretsConf{[]AppSecretGrant{
+		{Route: "/sales", Keys: []string{"k1"}, Secrets: map[string]SecretSource{"A": {Value: "a"}, "B": {Env: "WAVE_TEST_SECRET"}}},
+		{Route: "/sales", Keychain: "sales", Secrets: map[string]SecretSource{"C": {Value: "c"}}},
+		{Route: "/ops", Keys: []string{"k1"}, Keychain: "ops", Secrets: map[string]SecretSource{"D": {Value: "d"}}},
+	}}, kc, "")
+	no(err)
+
+	env, err := s.forRoute("/sales", "k1", "")
+	no(err)
+	eq(env, map[string]string{"A": "a", "B": "from-env"})
+
+	env, err = s.forRoute("/sales", "k2", "sales")
+	no(err)
+	eq(env, map[string]string{"C": "c"})
+
+	env, err = s.forRoute("/sales", "k2", "")
+	no(err)
+	eq(env, map[string]string{})
+
+	env, err = s.forRoute("/ops", "k1", "")
+	no(err)
+	eq(env, map[string]string{}) // needs both the key and the keychain
+
+	env, err = s.forRoute("/ops", "k1", "ops")
+	no(err)
+	eq(env, map[string]string{"D": "d"})
+
+	env, err = s.forRoute("/hr", "k1", "")
+	no(err)
+	eq(env, map[string]string{})
+
+	t.Setenv("WAVE_TEST_SECRET", "")
+	os.Unsetenv("WAVE_TEST_SECRET")
+	_, err = s.forRoute("/sales", "k1", "")
+	eq(err != nil, true)
+}
+
+func TestAppSecretsForProcess(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	kc, _ := keychaintest.New(t, 0)
+	file := filepath.Join(t.TempDir(), "db")
+	no(os.WriteFile(file, []byte("s3cret\n"), 0600))
+	s, err := newAppSecrets(&AppSecretsConf{[]AppSecretGrant{
+		{Process: "ops", AccessKey: true, Secrets: map[string]SecretSource{"DB_PASSWORD": {File: file}, "DB_USER": {Value: "ops"}}},
+		{Process: "etl", Secrets: map[string]SecretSource{"TOKEN": {Command: []string{"echo", "t0k"}}}},
+	}}, kc, "apps")
+	no(err)
+
+	env, err := s.forProcess("ops")
+	no(err)
+	eq(len(env), 4)
+	eq(env[0], "DB_PASSWORD=s3cret")
+	eq(env[1], "DB_USER=ops")
+	id := strings.TrimPrefix(env[2], "H2O_WAVE_ACCESS_KEY_ID=")
+	secret := strings.TrimPrefix(env[3], "H2O_WAVE_ACCESS_KEY_SECRET=")
+	ok(kc.Verify(id, secret), "minted key doesn't verify")
+	e, found := kc.Get(id)
+	ok(found && e.HasScope("apps"), "minted key isn't scoped")
+
+	env, err = s.forProcess("etl")
+	no(err)
+	eq(env, []string{"TOKEN=t0k"})
+
+	env, err = s.forProcess("web")
+	no(err)
+	eq(env, []string{})
+}
@@ -22,6 +22,8 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -31,47 +33,41 @@ import (
 	"golang.org/x/oauth2"
 )
 
-const authCookieName = "oidcsession"
+const (
+	authCookieName  = "oidcsession"
+	loginCookieName = "oidclogin" // tracks logins in progress, until the identity provider sends the user back
+	loginTimeout    = 10 * time.Minute
+)
 
 var authDefaultScopes = []string{oidc.ScopeOpenID, "profile"}
 
-func connectToProvider(conf *AuthConf) (*oauth2.Config, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	provider, err := oidc.NewProvider(ctx, conf.ProviderURL)
-	if err != nil {
-		return nil, err
-	}
-	scopes := authDefaultScopes
-	if len(conf.Scopes) > 0 && conf.Scopes[0] != "" {
-		scopes = conf.Scopes
-	}
-	return &oauth2.Config{
-		ClientID:     conf.ClientID,
-		ClientSecret: conf.ClientSecret,
-		Endpoint:     provider.Endpoint(),
-		RedirectURL:  conf.RedirectURL,
-		Scopes:       scopes,
-	}, nil
-}
-
 // Session represents an end-user session
 type Session struct {
 	sync.RWMutex
 	id         string
 	state      string
 	nonce      string
+	verifier   string // PKCE code verifier
+	provider   *oidcProvider
+	saml       bool   // authenticated with the SAML identity provider, rather than provider
+	sid        string // the provider's session ID, if any, for logouts initiated by the provider
 	subject    string
 	username   string
+	groups     []string
+	authTime   time.Time // when the user last authenticated with the provider
+	acr        string    // how the user authenticated, as an authentication context class, if known
+	amr        []string  // how the user authenticated, as authentication methods, if known
+	stepUp     bool      // login requested to step up authentication
 	successURL string
 	token      *oauth2.Token
 	expiry     time.Time
+	saved      time.Time // expiry when last saved to the session store
 }
 
 var errInactivityTimeout = errors.New("timed out due to inactivity")
 
 func (s *Session) touch(timeout time.Duration) error {
-	if s == anonymous {
+	if s == anonymous || s == guest {
 		return nil
 	}
 
@@ -92,6 +88,13 @@ func (s *Session) touch(timeout time.Duration) error {
 	return nil
 }
 
+// expire ends the session for clients still holding it.
+func (s *Session) expire() {
+	s.Lock()
+	s.expiry = time.Time{}
+	s.Unlock()
+}
+
 const (
 	anon = "anon"
 )
@@ -106,46 +109,231 @@ var anonymous = &Session{
 // Auth holds authenticated end-user sessions
 type Auth struct {
 	sync.RWMutex
-	conf     *AuthConf
-	oauth    *oauth2.Config
-	sessions map[string]*Session
-	baseURL  string
-	initURL  string
-	loginURL string
+	conf      *AuthConf
+	providers []*oidcProvider
+	saml      *samlProvider
+	sessions  map[string]*Session
+	baseURL   string
+	initURL   string
+	loginURL  string
 }
 
 func newAuth(conf *AuthConf, baseURL, initURL, loginURL string) (*Auth, error) {
-	oauth, err := connectToProvider(conf)
-	if err != nil {
+	if len(conf.Providers) == 0 && conf.SAML == nil {
+		return nil, errors.New("no identity providers configured")
+	}
+	if err := checkOIDCProviders(conf.Providers); err != nil {
+		return nil, err
+	}
+	if err := checkPublicRoutes(conf.Public); err != nil {
+		return nil, err
+	}
+	if err := checkStepUp(conf.StepUp); err != nil {
 		return nil, err
 	}
+	providers := make([]*oidcProvider, len(conf.Providers))
+	for i := range conf.Providers {
+		p, err := connectToProvider(&conf.Providers[i])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", conf.Providers[i].Name, err)
+		}
+		providers[i] = p
+	}
+	var samlProvider *samlProvider
+	if conf.SAML != nil {
+		for _, p := range conf.Providers {
+			if p.Name == samlProviderName {
+				return nil, fmt.Errorf("OIDC provider name %s is reserved for SAML", samlProviderName)
+			}
+		}
+		p, err := connectToSAMLProvider(conf.SAML)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", samlProviderName, err)
+		}
+		samlProvider = p
+	}
 	return &Auth{
-		conf:     conf,
-		oauth:    oauth,
-		sessions: make(map[string]*Session),
-		baseURL:  baseURL,
-		initURL:  initURL,
-		loginURL: loginURL,
+		conf:      conf,
+		providers: providers,
+		saml:      samlProvider,
+		sessions:  make(map[string]*Session),
+		baseURL:   baseURL,
+		initURL:   initURL,
+		loginURL:  loginURL,
 	}, nil
 }
 
+// provider returns the OIDC provider named, or the first provider if name is empty.
+func (auth *Auth) provider(name string) (*oidcProvider, bool) {
+	if name == "" {
+		if len(auth.providers) == 0 {
+			return nil, false
+		}
+		return auth.providers[0], true
+	}
+	for _, p := range auth.providers {
+		if p.conf.Name == name {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
 func (auth *Auth) get(key string) (*Session, bool) {
 	auth.RLock()
-	defer auth.RUnlock()
 	session, ok := auth.sessions[key]
-	return session, ok
+	auth.RUnlock()
+
+	store := auth.conf.Sessions
+	if store == nil {
+		return session, ok
+	}
+
+	// The store is authoritative, since other servers may have created, changed or ended the session.
+	data, err := store.Load(key)
+	if err != nil {
+		echo(Log{"t": "session_store", "error": err.Error()})
+		return session, ok
+	}
+	if data == nil {
+		if ok {
+			auth.Lock()
+			delete(auth.sessions, key)
+			auth.Unlock()
+			session.expire()
+		}
+		return nil, false
+	}
+
+	auth.Lock()
+	if session, ok = auth.sessions[key]; !ok {
+		session = &Session{id: key}
+		auth.sessions[key] = session
+	}
+	auth.Unlock()
+
+	session.Lock()
+	defer session.Unlock()
+	expiry := session.expiry
+	if err := session.unmarshal(auth, data); err != nil {
+		echo(Log{"t": "session_store", "error": err.Error(), "session_id": key})
+		return nil, false
+	}
+	session.saved = session.expiry
+	if expiry.After(session.expiry) { // touched here since last saved
+		session.expiry = expiry
+	}
+	return session, true
 }
 
 func (auth *Auth) set(session *Session) {
 	auth.Lock()
-	defer auth.Unlock()
 	auth.sessions[session.id] = session
+	auth.Unlock()
+	auth.save(session)
+}
+
+// save writes the session to the session store, if any.
+func (auth *Auth) save(session *Session) {
+	store := auth.conf.Sessions
+	if store == nil {
+		return
+	}
+	session.Lock()
+	defer session.Unlock()
+	data, err := session.marshal()
+	if err == nil {
+		err = store.Save(session.id, data, time.Until(session.expiry))
+	}
+	if err != nil {
+		echo(Log{"t": "session_store", "error": err.Error(), "subject": session.subject})
+		return
+	}
+	session.saved = session.expiry
 }
 
 func (auth *Auth) remove(key string) {
 	auth.Lock()
-	defer auth.Unlock()
+	session, ok := auth.sessions[key]
 	delete(auth.sessions, key)
+	auth.Unlock()
+	if ok {
+		session.expire()
+	}
+	if store := auth.conf.Sessions; store != nil {
+		if err := store.Delete(key); err != nil {
+			echo(Log{"t": "session_store", "error": err.Error()})
+		}
+	}
+}
+
+// touch extends the session's inactivity timeout.
+func (auth *Auth) touch(session *Session) error {
+	if err := session.touch(auth.conf.InactivityTimeout); err != nil {
+		return err
+	}
+	if auth.conf.Sessions != nil && session != anonymous && session != guest {
+		// Save at most every tenth of the timeout, rather than on every message.
+		session.RLock()
+		stale := session.expiry.Sub(session.saved) > auth.conf.InactivityTimeout/10
+		session.RUnlock()
+		if stale {
+			auth.save(session)
+		}
+	}
+	return nil
+}
+
+// find returns the sessions that match, including those held by other servers if sessions are stored.
+func (auth *Auth) find(match func(session *Session) bool) []*Session {
+	var found []*Session
+	auth.RLock()
+	held := make(map[string]bool, len(auth.sessions))
+	for id, session := range auth.sessions {
+		held[id] = true
+		if match(session) {
+			found = append(found, session)
+		}
+	}
+	auth.RUnlock()
+
+	store := auth.conf.Sessions
+	if store == nil {
+		return found
+	}
+	ids, err := store.IDs()
+	if err != nil {
+		echo(Log{"t": "session_store", "error": err.Error()})
+		return found
+	}
+	for _, id := range ids {
+		if held[id] {
+			continue
+		}
+		data, err := store.Load(id)
+		if err != nil {
+			echo(Log{"t": "session_store", "error": err.Error()})
+			continue
+		}
+		if data == nil { // expired
+			store.Delete(id)
+			continue
+		}
+		session := &Session{id: id}
+		if err := session.unmarshal(auth, data); err == nil && match(session) {
+			found = append(found, session)
+		}
+	}
+	return found
+}
+
+// end removes the sessions that match, and returns them.
+func (auth *Auth) end(match func(session *Session) bool) []*Session {
+	ended := auth.find(match)
+	for _, session := range ended {
+		auth.remove(session.id)
+	}
+	return ended
 }
 
 func (auth *Auth) identify(r *http.Request) *Session {
@@ -162,20 +350,18 @@ func (auth *Auth) identify(r *http.Request) *Session {
 		return nil
 	}
 
-	if err := session.touch(auth.conf.InactivityTimeout); err != nil {
+	if err := auth.touch(session); err != nil {
 		echo(Log{"t": "inactivity_timeout", "subject": session.subject})
 		return nil
 	}
 
-	token, err := auth.ensureValidOAuth2Token(r.Context(), session.token)
-	if err != nil {
-		echo(Log{"t": "oauth2_token_refresh", "error": err.Error(), "subject": session.subject})
-		return nil
+	if session.saml { // no tokens to refresh
+		return session
 	}
 
-	if session.token != token {
-		session.token = token
-		auth.set(session)
+	if _, err := auth.ensureValidOAuth2Token(r.Context(), session, 0); err != nil {
+		echo(Log{"t": "oauth2_token_refresh", "error": err.Error(), "subject": session.subject})
+		return nil
 	}
 
 	return session
@@ -201,7 +387,7 @@ func (auth *Auth) wrap(h http.Handler) http.Handler {
 			return
 		}
 
-		if !auth.allow(r) {
+		if !auth.allow(r) && !auth.isPublic(resolveURL(r.URL.Path, auth.baseURL)) {
 			auth.redirectToLogin(w, r)
 			return
 		}
@@ -210,15 +396,78 @@ func (auth *Auth) wrap(h http.Handler) http.Handler {
 	})
 }
 
-func (auth *Auth) ensureValidOAuth2Token(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
-	token, err := auth.oauth.TokenSource(ctx, token).Token()
+// ensureValidOAuth2Token returns the session's access token, refreshing it first if it expires within lead.
+func (auth *Auth) ensureValidOAuth2Token(ctx context.Context, session *Session, lead time.Duration) (*oauth2.Token, error) {
+	if session.provider == nil {
+		return nil, errors.New("session has no provider")
+	}
+
+	// Serialize refreshes, since providers may rotate refresh tokens, invalidating the ones in use.
+	session.Lock()
+	current := session.token
+	if current != nil && lead > 0 && !current.Expiry.IsZero() && time.Until(current.Expiry) < lead {
+		expired := *current
+		expired.Expiry = time.Unix(1, 0)
+		current = &expired
+	}
+	token, err := session.provider.oauth.TokenSource(ctx, current).Token()
 	if token == nil {
+		session.Unlock()
 		echo(Log{"t": "ensure_token_refresh", "error": "refresh token is nil"})
 		echo(Log{"t": "ensure_token_refresh", "error": err.Error()})
+		return token, err
+	}
+	refreshed := token != session.token
+	session.token = token
+	session.Unlock()
+
+	if refreshed {
+		auth.save(session)
 	}
 	return token, err
 }
 
+// renew refreshes the access tokens of active sessions in the background before they expire, so that refresh
+// tokens are kept alive while users are idle, and purges inactive sessions.
+func (auth *Auth) renew(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		auth.RLock()
+		sessions := make([]*Session, 0, len(auth.sessions))
+		for _, session := range auth.sessions {
+			sessions = append(sessions, session)
+		}
+		auth.RUnlock()
+
+		now := time.Now()
+		for _, session := range sessions {
+			if auth.conf.Sessions != nil {
+				// Pick up changes made by other servers, e.g. activity or token refreshes.
+				if _, ok := auth.get(session.id); !ok {
+					continue
+				}
+			}
+			session.RLock()
+			expired, token := session.expiry.Before(now), session.token
+			session.RUnlock()
+
+			if expired {
+				auth.remove(session.id)
+				continue
+			}
+			if token == nil || token.RefreshToken == "" {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if _, err := auth.ensureValidOAuth2Token(ctx, session, 2*interval); err != nil {
+				echo(Log{"t": "oauth2_token_renew", "error": err.Error(), "subject": session.subject})
+			}
+			cancel()
+		}
+	}
+}
+
 func (auth *Auth) redirectToLogin(w http.ResponseWriter, r *http.Request) {
 	// X -> /_auth/login?next=X
 	u, _ := url.Parse(auth.loginURL)
@@ -231,13 +480,16 @@ func (auth *Auth) redirectToLogin(w http.ResponseWriter, r *http.Request) {
 func (auth *Auth) redirectToAuth(w http.ResponseWriter, r *http.Request) {
 	// /_auth/login -> /_auth/init
 	// /_auth/login?next=X -> /_auth/init?next=X
+	// /_auth/login?provider=P -> /_auth/init?provider=P
+	// /_auth/login?step_up=1 -> /_auth/init?step_up=1
 	u, _ := url.Parse(auth.initURL)
-	next := r.URL.Query().Get("next")
-	if next != "" {
-		q := u.Query()
-		q.Set("next", next)
-		u.RawQuery = q.Encode()
+	q := u.Query()
+	for _, k := range []string{"next", "provider", "step_up"} {
+		if v := r.URL.Query().Get(k); v != "" {
+			q.Set(k, v)
+		}
 	}
+	u.RawQuery = q.Encode()
 	http.Redirect(w, r, u.String(), http.StatusFound)
 }
 
@@ -260,6 +512,19 @@ func newLoginHandler(auth *Auth) http.Handler {
 }
 
 func (h *LoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("provider")
+	if h.auth.saml != nil && (name == samlProviderName || (name == "" && len(h.auth.providers) == 0)) {
+		h.auth.samlLogin(w, r)
+		return
+	}
+
+	provider, ok := h.auth.provider(name)
+	if !ok {
+		echo(Log{"t": "oidc_provider", "error": "unknown provider", "provider": r.URL.Query().Get("provider")})
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
 	// `state` is to protect from CSRF (OAuth2 part).
 	state, err := generateRandomKey(4)
 	if err != nil {
@@ -284,30 +549,54 @@ func (h *LoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Session ID stored in cookie.
 	sessionID := uuid.New().String()
 
-	h.auth.set(&Session{id: sessionID, state: state, nonce: nonce, successURL: successURL, expiry: time.Now().Add(h.auth.conf.InactivityTimeout)})
-	cookie := http.Cookie{Name: authCookieName, Value: sessionID, Path: h.auth.baseURL, Expires: time.Now().Add(h.auth.conf.SessionExpiry)}
-	http.SetCookie(w, &cookie)
+	var verifier string
+	if provider.conf.PKCE {
+		verifier = oauth2.GenerateVerifier()
+	}
+
+	stepUp := r.URL.Query().Get("step_up") != "" && h.auth.conf.StepUp != nil
+
+	h.auth.set(&Session{id: sessionID, state: state, nonce: nonce, verifier: verifier, provider: provider, stepUp: stepUp, successURL: successURL, expiry: time.Now().Add(h.auth.conf.InactivityTimeout)})
+	h.auth.setLoginCookie(w, h.auth.baseURL+"_auth/callback", sessionID, provider.formPost())
 
 	var options []oauth2.AuthCodeOption
 	options = append(options, oidc.Nonce(nonce))
-	for _, param := range h.auth.conf.URLParameters {
+	if verifier != "" {
+		options = append(options, oauth2.S256ChallengeOption(verifier))
+	}
+	if provider.conf.ResponseMode != "" {
+		options = append(options, oauth2.SetAuthURLParam("response_mode", provider.conf.ResponseMode))
+	}
+	for _, param := range provider.conf.URLParameters {
 		options = append(options, oauth2.SetAuthURLParam(param[0], param[1]))
 	}
-	http.Redirect(w, r, h.auth.oauth.AuthCodeURL(state, options...), http.StatusFound)
+	if stepUp {
+		// Ask the provider to authenticate the user again, as strongly as required.
+		if c := h.auth.conf.StepUp; c.MaxAge > 0 {
+			options = append(options, oauth2.SetAuthURLParam("max_age", strconv.Itoa(int(c.MaxAge.Seconds()))))
+		} else {
+			options = append(options, oauth2.SetAuthURLParam("prompt", "login"))
+		}
+		if c := h.auth.conf.StepUp; len(c.ACR) > 0 {
+			options = append(options, oauth2.SetAuthURLParam("acr_values", strings.Join(c.ACR, " ")))
+		}
+	}
+	http.Redirect(w, r, provider.oauth.AuthCodeURL(state, options...), http.StatusFound)
 }
 
 // AuthHandler handles OAuth2 requests
 type AuthHandler struct {
-	auth *Auth
+	auth   *Auth
+	broker *Broker
 }
 
-func newAuthHandler(auth *Auth) http.Handler {
-	return &AuthHandler{auth}
+func newAuthHandler(auth *Auth, broker *Broker) http.Handler {
+	return &AuthHandler{auth, broker}
 }
 
 func (h *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Retrieve saved session.
-	cookie, err := r.Cookie(authCookieName)
+	cookie, err := r.Cookie(loginCookieName)
 	if err != nil {
 		echo(Log{"t": "oauth2_cookie", "error": err.Error()})
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -323,29 +612,40 @@ func (h *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Handle errors from provider.
-	if err := r.URL.Query().Get("error"); err != "" {
-		errorDescription := r.URL.Query().Get("error_description")
+	// Responses arrive in the query string, or in the body if the response mode is form_post.
+	if err := r.FormValue("error"); err != "" {
+		errorDescription := r.FormValue("error_description")
 		echo(Log{"t": "oauth2_callback", "error": err, "description": errorDescription})
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
 	// Compare to stored state.
-	responseState := r.URL.Query().Get("state")
+	responseState := r.FormValue("state")
 	if session.state != responseState {
 		echo(Log{"t": "oauth2_state", "error": "failed matching state"})
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
-	oAuth2Provider, err := oidc.NewProvider(r.Context(), h.auth.conf.ProviderURL)
+	if session.provider == nil {
+		echo(Log{"t": "oauth2_session", "error": "no provider"})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	oAuth2Provider, err := oidc.NewProvider(r.Context(), session.provider.conf.ProviderURL)
 	if err != nil {
 		echo(Log{"t": "oauth2_oidc_provider", "error": err.Error()})
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
-	oauth2Token, err := h.auth.oauth.Exchange(r.Context(), r.URL.Query().Get("code"))
+	var options []oauth2.AuthCodeOption
+	if session.verifier != "" {
+		options = append(options, oauth2.VerifierOption(session.verifier))
+	}
+	oauth2Token, err := session.provider.oauth.Exchange(r.Context(), r.FormValue("code"), options...)
 	if err != nil {
 		echo(Log{"t": "oauth2_exchange", "error": err.Error()})
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -359,7 +659,7 @@ func (h *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	oidcVerifier := oAuth2Provider.Verifier(&oidc.Config{ClientID: h.auth.oauth.ClientID})
+	oidcVerifier := oAuth2Provider.Verifier(&oidc.Config{ClientID: session.provider.oauth.ClientID})
 	idToken, err := oidcVerifier.Verify(r.Context(), rawIDToken)
 	if err != nil {
 		echo(Log{"t": "oauth2_oidc_verifier", "error": "failed verifying id_token"})
@@ -367,11 +667,7 @@ func (h *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var claims struct {
-		PreferredUsername string `json:"preferred_username"`
-		Nonce             string `json:"nonce"`
-	}
-	err = idToken.Claims(&claims)
+	username, groups, err := session.provider.identity(idToken)
 	if err != nil {
 		echo(Log{"t": "oauth2_claim", "error": "failed parsing token claims"})
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -379,7 +675,7 @@ func (h *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Compare to stored nonce.
-	if session.nonce != claims.Nonce {
+	if session.nonce != idToken.Nonce {
 		if !ok {
 			echo(Log{"t": "oauth2_nonce", "error": "failed matching nonce"})
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -389,15 +685,64 @@ func (h *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	session.token = oauth2Token
 	session.subject = idToken.Subject
-	session.username = claims.PreferredUsername
+	session.username = username
+	session.groups = groups
+	var claims struct {
+		SID      string   `json:"sid"`
+		AuthTime int64    `json:"auth_time"`
+		ACR      string   `json:"acr"`
+		AMR      []string `json:"amr"`
+	}
+	if err := idToken.Claims(&claims); err == nil {
+		session.sid = claims.SID
+		session.acr = claims.ACR
+		session.amr = claims.AMR
+		session.authTime = time.Now() // providers omit auth_time unless asked, e.g. with max_age
+		if claims.AuthTime > 0 {
+			session.authTime = time.Unix(claims.AuthTime, 0)
+		}
+	}
+	if session.stepUp && h.auth.conf.StepUp != nil && !h.auth.conf.StepUp.satisfiedBy(session) {
+		echo(Log{"t": "step_up", "error": "authentication not strong enough", "subject": session.subject, "acr": session.acr})
+	}
+	session.stepUp = false
 
-	echo(Log{"t": "login", "subject": session.subject, "username": session.username})
+	echo(Log{"t": "login", "provider": session.provider.conf.Name, "subject": session.subject, "username": session.username})
 
 	h.auth.set(session)
+	endSessions(h.broker, h.auth.limitSessions(session), "session_limit")
 
+	h.auth.clearLoginCookie(w, h.auth.baseURL+"_auth/callback", session.provider.formPost())
+	h.auth.setSessionCookie(w, session.id)
 	http.Redirect(w, r, session.successURL, http.StatusFound)
 }
 
+// setLoginCookie tracks a login in progress, for a few minutes, and only for path, where the identity provider sends
+// the user back to. Responses posted back are cross-site requests, which carry only cookies that allow it.
+func (auth *Auth) setLoginCookie(w http.ResponseWriter, path, sessionID string, crossSite bool) {
+	cookie := http.Cookie{Name: loginCookieName, Value: sessionID, Path: path, MaxAge: int(loginTimeout.Seconds()), HttpOnly: true, SameSite: http.SameSiteLaxMode}
+	if crossSite {
+		cookie.SameSite = http.SameSiteNoneMode
+		cookie.Secure = true
+	}
+	http.SetCookie(w, &cookie)
+}
+
+func (auth *Auth) clearLoginCookie(w http.ResponseWriter, path string, crossSite bool) {
+	cookie := http.Cookie{Name: loginCookieName, Path: path, MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteLaxMode}
+	if crossSite {
+		cookie.SameSite = http.SameSiteNoneMode
+		cookie.Secure = true
+	}
+	http.SetCookie(w, &cookie)
+}
+
+// setSessionCookie hands a signed-in user's browser its session. Other sites can't have browsers send it along, but
+// with links followed to the server, so that they can't act on the user's behalf, e.g. by posting forms.
+func (auth *Auth) setSessionCookie(w http.ResponseWriter, sessionID string) {
+	http.SetCookie(w, &http.Cookie{Name: authCookieName, Value: sessionID, Path: auth.baseURL, Expires: time.Now().Add(auth.conf.SessionExpiry), SameSite: http.SameSiteLaxMode})
+}
+
 // LogoutHandler handles logout requests
 type LogoutHandler struct {
 	auth   *Auth
@@ -409,13 +754,16 @@ func newLogoutHandler(auth *Auth, broker *Broker) http.Handler {
 }
 
 func (h *LogoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var idToken string
+	var (
+		idToken     string
+		provider, _ = h.auth.provider("")
+	)
 
 	// Retrieve saved session.
 	cookie, err := r.Cookie(authCookieName)
 	if err != nil {
 		echo(Log{"t": "logout_cookie", "error": "not found"})
-		h.redirect(w, r, idToken)
+		h.redirect(w, r, provider, idToken)
 		return
 	}
 
@@ -433,33 +781,40 @@ func (h *LogoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// Reload all of this user's browser tabs
 		h.broker.resetClients(session)
 
+		if session.provider != nil {
+			provider = session.provider
+		} else if session.saml {
+			provider = nil
+		}
+
 		// A token may not be present if the oauth2 workflow failed, so check before access.
 		if session.token != nil {
 			idToken, _ = session.token.Extra("id_token").(string) // raw id_token (required by Okta)
 		}
 	}
 
-	h.redirect(w, r, idToken)
+	h.redirect(w, r, provider, idToken)
 }
 
-func (h *LogoutHandler) redirect(w http.ResponseWriter, r *http.Request, idToken string) {
-	if h.auth.conf.EndSessionURL == "" {
+func (h *LogoutHandler) redirect(w http.ResponseWriter, r *http.Request, provider *oidcProvider, idToken string) {
+	if provider == nil || provider.conf.EndSessionURL == "" {
 		http.Redirect(w, r, h.auth.baseURL, http.StatusFound)
 		return
 	}
 
-	redirectURL, err := url.Parse(h.auth.conf.EndSessionURL)
+	redirectURL, err := url.Parse(provider.conf.EndSessionURL)
 	if err != nil {
 		echo(Log{"t": "logout_redirect_parse", "error": err.Error()})
 		return
 	}
 
-	post_logout_redirect_url := h.auth.conf.PostLogoutRedirectURL
+	post_logout_redirect_url := provider.conf.PostLogoutRedirectURL
 	if post_logout_redirect_url == "" {
 		post_logout_redirect_url = r.Host
 	}
 	query := redirectURL.Query()
 	query.Set("post_logout_redirect_uri", post_logout_redirect_url)
+	query.Set("client_id", provider.conf.ClientID)
 	if len(idToken) > 0 {
 		// required by Okta
 		// https://developer.okta.com/docs/reference/api/oidc/#logout
@@ -473,10 +828,10 @@ func (h *LogoutHandler) redirect(w http.ResponseWriter, r *http.Request, idToken
 // Handles token refreshes.
 type RefreshHandler struct {
 	auth     *Auth
-	keychain *keychain.Keychain
+	keychain keychain.Authenticator
 }
 
-func newRefreshHandler(auth *Auth, keychain *keychain.Keychain) http.Handler {
+func newRefreshHandler(auth *Auth, keychain keychain.Authenticator) http.Handler {
 	return &RefreshHandler{auth, keychain}
 }
 
@@ -494,7 +849,7 @@ func (h *RefreshHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := h.auth.ensureValidOAuth2Token(r.Context(), session.token)
+	token, err := h.auth.ensureValidOAuth2Token(r.Context(), session, 0)
 	if err != nil {
 		// Purge session and reload clients if refresh not successful?
 		echo(Log{"t": "refresh_session", "error": err.Error()})
@@ -502,9 +857,6 @@ func (h *RefreshHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	session.token = token
-	h.auth.set(session)
-
 	w.Header().Set("Wave-Access-Token", token.AccessToken)
 	w.Header().Set("Wave-Refresh-Token", token.RefreshToken)
 	w.WriteHeader(http.StatusOK)
@@ -0,0 +1,56 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func setCookies(f func(w http.ResponseWriter)) []*http.Cookie {
+	w := httptest.NewRecorder()
+	f(w)
+	return w.Result().Cookies()
+}
+
+func TestAuthCookies(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	auth := &Auth{conf: &AuthConf{SessionExpiry: 24 * time.Hour}, baseURL: "/"}
+
+	// Only logins in progress, posted back cross-site, are tracked with a cookie other sites may have sent.
+	c := setCookies(func(w http.ResponseWriter) { auth.setLoginCookie(w, "/_auth/callback", "s1", true) })[0]
+	eq(c.Name, loginCookieName)
+	eq(c.SameSite, http.SameSiteNoneMode)
+	eq(c.Secure, true)
+	eq(c.Path, "/_auth/callback")
+	eq(c.MaxAge, int(loginTimeout.Seconds()))
+
+	c = setCookies(func(w http.ResponseWriter) { auth.setLoginCookie(w, "/_auth/callback", "s1", false) })[0]
+	eq(c.SameSite, http.SameSiteLaxMode)
+
+	c = setCookies(func(w http.ResponseWriter) { auth.clearLoginCookie(w, "/_auth/callback", true) })[0]
+	eq(c.Name, loginCookieName)
+	eq(c.MaxAge, -1)
+
+	c = setCookies(func(w http.ResponseWriter) { auth.setSessionCookie(w, "s1") })[0]
+	eq(c.Name, authCookieName)
+	eq(c.Value, "s1")
+	eq(c.SameSite, http.SameSiteLaxMode)
+	eq(c.Path, "/")
+}
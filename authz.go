@@ -0,0 +1,249 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/h2oai/wave/pkg/keychain"
+	"gopkg.in/yaml.v3"
+)
+
+// AuthPolicy grants signed-in users access to apps and to the admin API, based on their groups.
+// Users not granted access to an app by any rule may not open it.
+type AuthPolicy struct {
+	Rules []AuthRule `yaml:"rules"`
+}
+
+// AuthRule grants the members of any of its groups access to the apps listed.
+type AuthRule struct {
+	Groups []string `yaml:"groups"` // "*" matches every signed-in user
+	Apps   []string `yaml:"apps"`   // route patterns, as in path.Match; a trailing "/*" also matches everything below
+	Admin  bool     `yaml:"admin"`  // also grants access to the admin API
+}
+
+// LoadAuthPolicy reads an access policy from a YAML file:
+//
+//	rules:
+//	  - groups: ["*"]
+//	    apps: [/, /docs/*]
+//	  - groups: [analyst]
+//	    apps: [/reports/*]
+//	  - groups: [admin]
+//	    apps: ["/*"]
+//	    admin: true
+func LoadAuthPolicy(name string) (*AuthPolicy, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading policy %s: %v", name, err)
+	}
+	var p AuthPolicy
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %v", name, err)
+	}
+	for i, rule := range p.Rules {
+		if len(rule.Groups) == 0 {
+			return nil, fmt.Errorf("policy %s: rule %d: groups are required", name, i+1)
+		}
+		for _, pattern := range rule.Apps {
+			if _, err := path.Match(pattern, ""); err != nil || !strings.HasPrefix(pattern, "/") {
+				return nil, fmt.Errorf("policy %s: rule %d: invalid app pattern %q", name, i+1, pattern)
+			}
+		}
+	}
+	return &p, nil
+}
+
+func (rule *AuthRule) applies(groups []string) bool {
+	for _, g := range rule.Groups {
+		if g == "*" {
+			return true
+		}
+		for _, h := range groups {
+			if g == h {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchRoute(pattern, route string) bool {
+	if ok, _ := path.Match(pattern, route); ok {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return route == prefix || strings.HasPrefix(route, prefix+"/")
+	}
+	return false
+}
+
+// canOpen reports whether members of groups may open the app at route. A nil policy allows everything.
+func (p *AuthPolicy) canOpen(groups []string, route string) bool {
+	if p == nil {
+		return true
+	}
+	for _, rule := range p.Rules {
+		if rule.applies(groups) {
+			for _, pattern := range rule.Apps {
+				if matchRoute(pattern, route) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// isAdmin reports whether members of groups may use the admin API.
+func (p *AuthPolicy) isAdmin(groups []string) bool {
+	if p == nil {
+		return false
+	}
+	for _, rule := range p.Rules {
+		if rule.Admin && rule.applies(groups) {
+			return true
+		}
+	}
+	return false
+}
+
+// canOpen reports whether session may open the app at route.
+func (auth *Auth) canOpen(session *Session, route string) bool {
+	if auth == nil || session == nil {
+		return true
+	}
+	if session == guest {
+		return auth.isPublic(route)
+	}
+	return auth.conf.Policy.canOpen(session.groups, route)
+}
+
+// guest is the session of visitors who have not signed in, who may only view public routes.
+var guest = &Session{
+	subject:  "guest",
+	username: "guest",
+	expiry:   time.Now().Add(365 * 24 * time.Hour),
+}
+
+func checkPublicRoutes(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil || !strings.HasPrefix(pattern, "/") {
+			return fmt.Errorf("invalid public route pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// isPublic reports whether guests may view the app or page at route.
+func (auth *Auth) isPublic(route string) bool {
+	for _, pattern := range auth.conf.Public {
+		if matchRoute(pattern, route) {
+			return true
+		}
+	}
+	return false
+}
+
+// policyAdmins admits requests made with admin access keys, or by users the policy makes admins.
+type policyAdmins struct {
+	keys keychain.Authenticator
+	auth *Auth
+}
+
+func (a *policyAdmins) Allow(r *http.Request) bool {
+	allowed, _ := a.admit(r)
+	return allowed
+}
+
+// admit reports whether the request is allowed, and if not, whether it was made by an admin who must step up.
+func (a *policyAdmins) admit(r *http.Request) (allowed, stepUp bool) {
+	if a.keys.Allow(r) {
+		return true, false
+	}
+	if _, err := r.Cookie(authCookieName); err != nil {
+		return false, false
+	}
+	if forged(r) {
+		return false, false
+	}
+	session := a.auth.identify(r)
+	if session == nil || !a.auth.conf.Policy.isAdmin(session.groups) {
+		return false, false
+	}
+	if c := a.auth.conf.StepUp; c.requires(stepUpAdmin) && !c.satisfiedBy(session) {
+		return false, true
+	}
+	return true, false
+}
+
+// challenge responds to an admin who must step up, and reports whether it did.
+func (a *policyAdmins) challenge(w http.ResponseWriter, r *http.Request) bool {
+	if _, stepUp := a.admit(r); stepUp {
+		a.auth.conf.StepUp.challenge(w)
+		return true
+	}
+	return false
+}
+
+func (a *policyAdmins) Guard(w http.ResponseWriter, r *http.Request) bool {
+	allowed, stepUp := a.admit(r)
+	if allowed {
+		return true
+	}
+	if stepUp {
+		a.auth.conf.StepUp.challenge(w)
+		return false
+	}
+	if _, err := r.Cookie(authCookieName); err == nil && forged(r) {
+		http.Error(w, "changes made with a browser session must be same-origin JSON requests", http.StatusForbidden)
+		return false
+	}
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	return false
+}
+
+// forged reports whether r, made with a browser session, could have been sent by another site, e.g. a form posted
+// cross-site, which carries the session cookie too. Browsers don't send JSON cross-origin without a CORS preflight,
+// and tell where requests come from with Sec-Fetch-Site or Origin.
+func forged(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != contentTypeJSON {
+		return true
+	}
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site != "same-origin"
+	}
+	origin, err := url.Parse(r.Header.Get("Origin"))
+	return err != nil || origin.Host == "" || origin.Host != r.Host
+}
+
+func (a *policyAdmins) VerifyContext(ctx context.Context, id, secret string) bool {
+	return a.keys.VerifyContext(ctx, id, secret)
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"github.com/h2oai/wave/pkg/keychain/keychaintest"
+)
+
+var testPolicy = &AuthPolicy{Rules: []AuthRule{
+	{Groups: []string{"ops"}, Apps: []string{"/*"}, Admin: true},
+	{Groups: []string{"finance"}, Apps: []string{"/reports/*", "/sales"}},
+	{Groups: []string{"*"}, Apps: []string{"/home"}},
+}}
+
+func TestAuthPolicy(t *testing.T) {
+	_, ok, _ := assert.Assert(t)
+	ok(testPolicy.canOpen([]string{"finance"}, "/reports/q1"), "finance may open reports")
+	ok(testPolicy.canOpen([]string{"finance"}, "/sales"), "finance may open sales")
+	ok(!testPolicy.canOpen([]string{"finance"}, "/hr"), "finance may not open hr")
+	ok(testPolicy.canOpen([]string{"sales"}, "/home"), "everyone may open home")
+	ok(!testPolicy.canOpen(nil, "/reports/q1"), "users without groups may open only what * may")
+	ok(testPolicy.canOpen([]string{"ops"}, "/hr"), "ops may open everything")
+	ok(testPolicy.isAdmin([]string{"finance", "ops"}), "ops are admins")
+	ok(!testPolicy.isAdmin([]string{"finance"}), "finance aren't admins")
+	var none *AuthPolicy
+	ok(none.canOpen(nil, "/hr") && !none.isAdmin([]string{"ops"}), "no policy allows everything but admin")
+}
+
+// newTestAdmins returns admins with an admin key, and signed-in sessions, by ID, of an admin and of another user.
+func newTestAdmins(t *testing.T) (*policyAdmins, string, string, [2]string) {
+	kc, keys := keychaintest.New(t, 1)
+	auth := &Auth{conf: &AuthConf{Policy: testPolicy, InactivityTimeout: time.Hour}, sessions: make(map[string]*Session)}
+	expiry := time.Now().Add(time.Hour)
+	auth.set(&Session{id: "admin-session", saml: true, subject: "alice", groups: []string{"ops"}, expiry: expiry})
+	auth.set(&Session{id: "user-session", saml: true, subject: "bob", groups: []string{"finance"}, expiry: expiry})
+	return &policyAdmins{kc, auth}, "admin-session", "user-session", [2]string{keys[0].ID, keys[0].Secret}
+}
+
+func adminRequest(method, session, contentType string, headers ...string) *http.Request {
+	r := httptest.NewRequest(method, "http://wave.example.com/_admin/keys", strings.NewReader("{}"))
+	if session != "" {
+		r.AddCookie(&http.Cookie{Name: authCookieName, Value: session})
+	}
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	return r
+}
+
+func guardCode(a *policyAdmins, r *http.Request) int {
+	w := httptest.NewRecorder()
+	if a.Guard(w, r) {
+		return http.StatusOK
+	}
+	return w.Code
+}
+
+func TestPolicyAdminsRejectCrossSiteChanges(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	a, admin, user, key := newTestAdmins(t)
+
+	eq(guardCode(a, adminRequest(http.MethodGet, admin, "")), http.StatusOK)
+	eq(guardCode(a, adminRequest(http.MethodPost, admin, contentTypeJSON, "Sec-Fetch-Site", "same-origin")), http.StatusOK)
+	eq(guardCode(a, adminRequest(http.MethodDelete, admin, "application/json; charset=utf-8", "Origin", "http://wave.example.com")), http.StatusOK)
+
+	// Forms posted from other sites carry the session cookie too.
+	eq(guardCode(a, adminRequest(http.MethodPost, admin, "application/x-www-form-urlencoded", "Sec-Fetch-Site", "cross-site")), http.StatusForbidden)
+	eq(guardCode(a, adminRequest(http.MethodPost, admin, "text/plain", "Origin", "http://wave.example.com")), http.StatusForbidden)
+	eq(guardCode(a, adminRequest(http.MethodPost, admin, "")), http.StatusForbidden)
+	eq(guardCode(a, adminRequest(http.MethodPost, admin, contentTypeJSON, "Sec-Fetch-Site", "same-site")), http.StatusForbidden)
+	eq(guardCode(a, adminRequest(http.MethodPut, admin, contentTypeJSON, "Origin", "http://evil.example.com")), http.StatusForbidden)
+	eq(guardCode(a, adminRequest(http.MethodPut, admin, contentTypeJSON)), http.StatusForbidden)
+
+	// Users who aren't admins, and requests without credentials, are turned away anyway.
+	eq(guardCode(a, adminRequest(http.MethodGet, user, "")), http.StatusUnauthorized)
+	eq(guardCode(a, adminRequest(http.MethodPost, user, contentTypeJSON, "Sec-Fetch-Site", "same-origin")), http.StatusUnauthorized)
+	eq(guardCode(a, adminRequest(http.MethodPost, "", contentTypeJSON)), http.StatusUnauthorized)
+
+	// Admin access keys aren't sent by browsers on their own, so can be used from anywhere.
+	r := adminRequest(http.MethodPost, "", "")
+	r.SetBasicAuth(key[0], key[1])
+	eq(guardCode(a, r), http.StatusOK)
+}
@@ -0,0 +1,226 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/h2oai/wave/pkg/blob"
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+// PageBackup is a copy of a page kept in object storage, at Key.
+type PageBackup struct {
+	Route string    `json:"route"`
+	Key   string    `json:"key"`
+	Time  time.Time `json:"time"`
+	Size  int       `json:"size"`
+}
+
+// PageBackups copies pages to object storage every interval, and deletes copies once past their retention.
+//
+// Each copy is an object of its own, at <route>/<time>.json, holding the page as browsers are sent it. Buckets
+// aren't listed, so the copies made are recorded in a JSON file, to expire them.
+type PageBackups struct {
+	store     blob.Bucket
+	broker    *Broker
+	routes    []string      // patterns of routes to back up, e.g. /ops/*
+	retention time.Duration // how long copies are kept; 0 to keep them forever
+	path      string        // record of copies made
+
+	lock  sync.Mutex // serializes runs
+	taken []PageBackup
+}
+
+// OpenPageBackups loads the record of copies made kept at path, if any.
+func OpenPageBackups(store blob.Bucket, broker *Broker, routes []string, retention time.Duration, path string) (*PageBackups, error) {
+	b := &PageBackups{store: store, broker: broker, routes: routes, retention: retention, path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return b, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &b.taken); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// run backs up pages every interval.
+func (b *PageBackups) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		b.backup()
+	}
+}
+
+// backup copies every page selected to object storage, then deletes expired copies.
+func (b *PageBackups) backup() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now().UTC()
+	copied, failed := 0, 0
+	for _, route := range b.broker.site.urls() {
+		if !b.selects(route) {
+			continue
+		}
+		page := b.broker.site.at(route)
+		if page == nil {
+			continue
+		}
+		page.RLock()
+		empty := len(page.cards) == 0
+		page.RUnlock()
+		if empty {
+			continue
+		}
+		data := page.marshal()
+		if data == nil {
+			continue
+		}
+		doc, err := json.Marshal(struct {
+			Route string          `json:"route"`
+			Time  time.Time       `json:"time"`
+			Page  json.RawMessage `json:"page"`
+		}{route, now, data})
+		if err != nil {
+			continue
+		}
+		name := strings.Trim(route, "/")
+		if name == "" {
+			name = "_"
+		}
+		key := name + "/" + now.Format("20060102T150405.000Z") + ".json"
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err = b.store.Put(ctx, key, "application/json", bytes.NewReader(doc))
+		cancel()
+		if err != nil {
+			echo(Log{"t": "page_backup", "route": route, "error": err.Error()})
+			failed++
+			continue
+		}
+		b.taken = append(b.taken, PageBackup{route, key, now, len(doc)})
+		copied++
+	}
+	expired := b.expire(now)
+	if err := b.save(); err != nil {
+		echo(Log{"t": "page_backup", "error": err.Error()})
+	}
+	echo(Log{"t": "page_backup", "pages": strconv.Itoa(copied), "failed": strconv.Itoa(failed), "expired": strconv.Itoa(expired)})
+}
+
+// selects reports whether the page at route is to be backed up. Pages private to a browser tab never are.
+func (b *PageBackups) selects(route string) bool {
+	if b.broker.isUnicast(route) {
+		return false
+	}
+	for _, pattern := range b.routes {
+		if matchRoute(pattern, route) {
+			return true
+		}
+	}
+	return false
+}
+
+// expire deletes the copies past their retention, and returns how many it deleted.
+func (b *PageBackups) expire(now time.Time) int {
+	if b.retention <= 0 {
+		return 0
+	}
+	n := 0
+	kept := b.taken[:0]
+	for _, c := range b.taken {
+		if now.Sub(c.Time) <= b.retention {
+			kept = append(kept, c)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		_, err := b.store.DeletePrefix(ctx, c.Key)
+		cancel()
+		if err != nil {
+			echo(Log{"t": "page_backup", "route": c.Route, "key": c.Key, "error": err.Error()})
+			kept = append(kept, c) // retry next time
+			continue
+		}
+		n++
+	}
+	b.taken = kept
+	return n
+}
+
+// list returns the copies made, oldest first.
+func (b *PageBackups) list() []PageBackup {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]PageBackup{}, b.taken...)
+}
+
+// save writes the record of copies made, replacing the previous one only once written.
+func (b *PageBackups) save() error {
+	data, err := json.Marshal(b.taken)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(b.path), 0700); err != nil {
+		return err
+	}
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
+
+// PageBackupHandler lets admins list the copies of pages made, and back pages up on demand, e.g. before upgrades.
+//
+//	GET  /_admin/backups  list the copies made, oldest first
+//	POST /_admin/backups  back up pages now
+type PageBackupHandler struct {
+	backups *PageBackups
+	admins  keychain.Authenticator
+}
+
+func newPageBackupHandler(backups *PageBackups, admins keychain.Authenticator) http.Handler {
+	return &PageBackupHandler{backups, admins}
+}
+
+func (h *PageBackupHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.admins.Guard(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		h.backups.backup()
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.backups.list())
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"time"
+
+	"github.com/h2oai/wave/pkg/kafka"
+)
+
+// KafkaBridge mirrors routes to and from Kafka topics, so that pipelines can update pages and follow apps
+// without speaking Wave's protocol.
+//
+// Records consumed from a topic are changes (e.g. {"d":[...]}) applied to a route's page, as if patched over HTTP.
+// Changes to a route's page, and events sent by browsers to the route's app, are produced to a topic, keyed by route,
+// with a wave-type header of patch or query; events also carry the browser's wave-client and, if signed in, wave-user.
+type KafkaBridge struct {
+	brokers []string
+	consume map[string]string // topic => route
+	produce map[string]string // route => topic
+	client  *kafka.Client     // for producing
+	out     chan kafkaRecord
+}
+
+type kafkaRecord struct {
+	topic  string
+	record kafka.Record
+}
+
+const (
+	kafkaTimeout    = 5 * time.Second
+	kafkaMaxWait    = 5 * time.Second // how long fetches wait for new records
+	kafkaRetryDelay = 2 * time.Second
+)
+
+func newKafkaBridge(brokers []string, consume, produce map[string]string) (*KafkaBridge, error) {
+	client, err := kafka.New(brokers, kafkaTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &KafkaBridge{brokers, consume, produce, client, make(chan kafkaRecord, 1024)}, nil // TODO tune
+}
+
+// run produces queued records, and applies records consumed from topics to pages, until the server exits.
+func (k *KafkaBridge) run(broker *Broker) {
+	for topic, route := range k.consume {
+		go k.receive(broker, topic, route)
+	}
+	k.send()
+}
+
+// receive applies the records consumed from a topic to a route's page.
+func (k *KafkaBridge) receive(broker *Broker, topic, route string) {
+	// Fetches wait for records, so use a connection of their own.
+	client, err := kafka.New(k.brokers, kafkaTimeout)
+	if err != nil {
+		return
+	}
+	var consumer *kafka.Consumer
+	for consumer == nil {
+		if consumer, err = client.Consume(topic); err != nil {
+			echo(Log{"t": "kafka_consume", "topic": topic, "error": err.Error()})
+			time.Sleep(kafkaRetryDelay)
+		}
+	}
+	echo(Log{"t": "kafka_consume", "topic": topic, "route": route})
+	for {
+		records, err := consumer.Fetch(kafkaMaxWait)
+		for _, r := range records {
+			broker.apply(route, r.Value, false)
+		}
+		if err != nil {
+			echo(Log{"t": "kafka_fetch", "topic": topic, "error": err.Error()})
+			time.Sleep(kafkaRetryDelay)
+		}
+	}
+}
+
+// send produces queued records, one at a time to keep them in order.
+func (k *KafkaBridge) send() {
+	for r := range k.out {
+		if err := k.client.Produce(r.topic, r.record); err != nil {
+			echo(Log{"t": "kafka_produce", "topic": r.topic, "error": err.Error()})
+		}
+	}
+}
+
+// patched queues changes made to a page, if its route is mirrored to a topic.
+func (k *KafkaBridge) patched(route string, data []byte) {
+	k.queue(route, data, kafka.Header{Key: "wave-type", Value: []byte("patch")})
+}
+
+// queried queues an event sent by a browser to an app, if the app's route is mirrored to a topic.
+func (k *KafkaBridge) queried(route, clientID, username string, data []byte) {
+	headers := []kafka.Header{{Key: "wave-type", Value: []byte("query")}, {Key: "wave-client", Value: []byte(clientID)}}
+	if username != "" {
+		headers = append(headers, kafka.Header{Key: "wave-user", Value: []byte(username)})
+	}
+	k.queue(route, data, headers...)
+}
+
+func (k *KafkaBridge) queue(route string, data []byte, headers ...kafka.Header) {
+	if k == nil {
+		return
+	}
+	topic, ok := k.produce[route]
+	if !ok {
+		return
+	}
+	select {
+	case k.out <- kafkaRecord{topic, kafka.Record{Key: []byte(route), Value: data, Headers: headers}}:
+	default:
+		echo(Log{"t": "kafka_produce", "topic": topic, "error": "queue full"})
+	}
+}
@@ -19,7 +19,9 @@ import (
 	"encoding/json"
 	"log"
 	"sort"
+	"strconv"
 	"sync"
+	"time"
 )
 
 // MsgT represents message types.
@@ -31,6 +33,7 @@ const (
 	patchMsgT
 	queryMsgT
 	watchMsgT
+	ackMsgT
 )
 
 // Msg represents a message.
@@ -52,8 +55,18 @@ var (
 type Pub struct {
 	route string
 	data  []byte
+	ack   bool // retry until clients acknowledge receipt
 }
 
+// Ack acknowledges receipt of a message by a client.
+type Ack struct {
+	client *Client
+	seq    uint64
+}
+
+// ackInterval is how long clients have to acknowledge receipt of a message before it is sent again.
+const ackInterval = 5 * time.Second
+
 // Sub represents a subscription.
 type Sub struct {
 	route  string
@@ -67,37 +80,91 @@ type Broker struct {
 	noStore     bool
 	noLog       bool
 	debug       bool
+	validate    bool                               // reject malformed changes
+	window      time.Duration                      // how long to hold back changes to merge them with the ones that follow; 0 to disable
+	pending     map[string]*pendingPub             // route => changes held back
 	clients     map[string]map[*Client]interface{} // route => client-set
 	publish     chan Pub
 	subscribe   chan Sub
 	unsubscribe chan *Client
 	logout      chan Pub
-	apps        map[string]*App // route => app
-	appsMux     sync.RWMutex    // mutex for tracking apps
-	unicasts    map[string]bool // "/client_id" => true
-	unicastsMux sync.RWMutex    // mutex for tracking unicast routes
+	replay      chan Replay
+	replayLog   *replayLog // recent messages, for reconnecting clients; nil if disabled
+	ack         chan Ack
+	evacuate    chan []byte         // messages asking every client to reconnect elsewhere
+	seq         uint64              // sequence number of the latest numbered message
+	apps        map[string]*AppPool // route => app instances
+	appsMux     sync.RWMutex        // mutex for tracking apps
+	unicasts    map[string]bool     // "/client_id" => true
+	unicastsMux sync.RWMutex        // mutex for tracking unicast routes
 	keepAppLive bool
 	clientsByID map[string]*Client
+	cluster     *Cluster        // other servers to fan out changes to; nil if disabled
+	kafka       *KafkaBridge    // Kafka topics to mirror routes to; nil if disabled
+	journal     *Journal        // events sent to apps; nil if disabled
+	authz       RouteAuthorizer // decides who may watch and change pages; nil to allow everything
+	retired     *routeTotals    // counts of clients gone, for metrics
+	pages       *PageSync       // page store to write changed pages to; nil if disabled
+	aof         *AOF            // file to record changes to, instead of the log; nil if disabled
+	health      *AppHealth      // probes apps, and unregisters those gone; nil if disabled
+	limits      *AppLimiter     // caps what each app may do; nil if apps aren't limited
+	queue       *AppQueue       // events held for apps gone away, until they return; nil if disabled
+}
+
+// brokerConf configures a Broker. Optional features are disabled if nil.
+type brokerConf struct {
+	editable    bool
+	noStore     bool
+	noLog       bool
+	keepAppLive bool
+	debug       bool
+	validate    bool
+	window      time.Duration
+	replayLog   *replayLog
+	cluster     *Cluster
+	kafka       *KafkaBridge
+	journal     *Journal
+	authz       RouteAuthorizer
+	pages       *PageSync
+	aof         *AOF
+	health      *AppHealth
+	limits      *AppLimiter
+	queue       *AppQueue
 }
 
-func newBroker(site *Site, editable, noStore, noLog, keepAppLive, debug bool) *Broker {
+func newBroker(site *Site, conf brokerConf) *Broker {
 	return &Broker{
-		site,
-		editable,
-		noStore,
-		noLog,
-		debug,
-		make(map[string]map[*Client]interface{}),
-		make(chan Pub, 1024),     // TODO tune
-		make(chan Sub, 1024),     // TODO tune
-		make(chan *Client, 1024), // TODO tune
-		make(chan Pub, 1024),     // TODO tune
-		make(map[string]*App),
-		sync.RWMutex{},
-		make(map[string]bool),
-		sync.RWMutex{},
-		keepAppLive,
-		make(map[string]*Client),
+		site:        site,
+		editable:    conf.editable,
+		noStore:     conf.noStore,
+		noLog:       conf.noLog,
+		debug:       conf.debug,
+		validate:    conf.validate,
+		window:      conf.window,
+		pending:     make(map[string]*pendingPub),
+		clients:     make(map[string]map[*Client]interface{}),
+		publish:     make(chan Pub, 1024),     // TODO tune
+		subscribe:   make(chan Sub, 1024),     // TODO tune
+		unsubscribe: make(chan *Client, 1024), // TODO tune
+		logout:      make(chan Pub, 1024),     // TODO tune
+		replay:      make(chan Replay, 1024),  // TODO tune
+		replayLog:   conf.replayLog,
+		ack:         make(chan Ack, 1024), // TODO tune
+		evacuate:    make(chan []byte),
+		apps:        make(map[string]*AppPool),
+		unicasts:    make(map[string]bool),
+		keepAppLive: conf.keepAppLive,
+		clientsByID: make(map[string]*Client),
+		cluster:     conf.cluster,
+		kafka:       conf.kafka,
+		journal:     conf.journal,
+		authz:       conf.authz,
+		retired:     newRouteTotals(),
+		pages:       conf.pages,
+		aof:         conf.aof,
+		health:      conf.health,
+		limits:      conf.limits,
+		queue:       conf.queue,
 	}
 }
 
@@ -107,44 +174,222 @@ func (b *Broker) getClient(id string) *Client {
 	return b.clientsByID[id]
 }
 
-func (b *Broker) addApp(mode, route, addr, keyID, keySecret string) {
-	s := newApp(b, mode, route, addr, keyID, keySecret)
+// addApp registers an app, tagged with the ID of the access key it registered with, for auditing. Apps that scale
+// join the instances registered on the route, if any scale too, replacing only the one at the same address;
+// others replace them.
+func (b *Broker) addApp(mode, route, addr, keyID, keySecret string, ack bool, owner, health string, scale bool, deployment string, meta AppMeta) {
+	app := newApp(b, mode, route, addr, keyID, keySecret, ack, owner, health, scale, deployment, meta)
+	if scale || deployment != "" {
+		b.health.forget(route, addr)
+	} else {
+		b.health.forget(route, "")
+	}
+	b.putApp(app, false)
+}
 
+// putApp registers an app, and reports whether it did. Apps registered again, once back after failing health
+// probes, are only if their route hasn't been taken since.
+func (b *Broker) putApp(app *App, again bool) bool {
 	b.appsMux.Lock()
-	b.apps[route] = s
+	pool := b.apps[app.route]
+	var replaced, moved []string // routes of pages to reload
+	var held []heldEvent
+	if pool != nil && pool.joins(app) {
+		for _, old := range pool.replaced(app) {
+			if again {
+				b.appsMux.Unlock()
+				return false
+			}
+			moved = append(moved, pool.remove(old)...)
+		}
+		pool.add(app)
+	} else {
+		if pool != nil && again {
+			b.appsMux.Unlock()
+			return false
+		}
+		pool = newAppPool(app)
+		b.apps[app.route] = pool
+		var back bool
+		if held, back = b.queue.back(app); !back {
+			replaced = []string{app.route}
+		}
+	}
+	instances := len(pool.instances)
 	b.appsMux.Unlock()
 
-	echo(Log{"t": "app_add", "route": route, "host": addr})
+	entry := Log{"t": "app_add", "route": app.route, "host": app.addr, "key": app.owner}
+	if app.deployment != "" {
+		entry["deployment"] = app.deployment
+	}
+	if app.scale || app.deployment != "" {
+		entry["instances"] = strconv.Itoa(instances)
+	}
+	echo(entry)
 
-	// Force-reload all browsers listening to this app
-	b.resetSubscribers(route)
+	// Force-reload all browsers listening to this app, or those served by the instance replaced
+	for _, route := range append(replaced, moved...) {
+		b.resetSubscribers(route)
+	}
+	if len(held) > 0 {
+		go b.redeliver(app.route, held)
+	}
+	return true
 }
 
+// getApp returns an instance of the app at route, if any, e.g. to tell its mode.
 func (b *Broker) getApp(route string) *App {
 	b.appsMux.RLock()
 	defer b.appsMux.RUnlock()
-	return b.apps[route]
+	if pool := b.apps[route]; pool != nil {
+		return pool.instances[0]
+	}
+	return nil
+}
+
+// serves reports whether an app is registered on route, or has gone away from it and is expected back.
+func (b *Broker) serves(route string) bool {
+	if b.getApp(route) != nil {
+		return true
+	}
+	_, away := b.queue.mode(route)
+	return away
+}
+
+// appFor returns the instance of the app at route serving a browser tab, picking one if none does yet.
+func (b *Broker) appFor(route, clientID, subject string) *App {
+	b.appsMux.RLock()
+	pool := b.apps[route]
+	if pool == nil {
+		b.appsMux.RUnlock()
+		return nil
+	}
+	page := pool.page(clientID, subject)
+	app, ok := pool.lookup(page)
+	b.appsMux.RUnlock()
+	if ok {
+		return app
+	}
+
+	b.appsMux.Lock()
+	defer b.appsMux.Unlock()
+	if pool = b.apps[route]; pool == nil {
+		return nil
+	}
+	return pool.bind(pool.page(clientID, subject))
 }
 
+// releaseApp unbinds a browser tab gone from the instance of the app at route serving it, if any.
+func (b *Broker) releaseApp(route, clientID string) {
+	b.appsMux.Lock()
+	defer b.appsMux.Unlock()
+	if pool := b.apps[route]; pool != nil && pool.instances[0].mode == unicastMode {
+		pool.release("/" + clientID)
+	}
+}
+
+// getApps returns every instance of every app.
 func (b *Broker) getApps() []*App {
 	b.appsMux.RLock()
 	defer b.appsMux.RUnlock()
 	var apps []*App
-	for _, app := range b.apps {
-		apps = append(apps, app)
+	for _, pool := range b.apps {
+		apps = append(apps, pool.instances...)
 	}
 	return apps
 }
 
-func (b *Broker) dropApp(route string) {
+// getInstance returns the instance of the app at route at addr, if any.
+func (b *Broker) getInstance(route, addr string) *App {
+	b.appsMux.RLock()
+	defer b.appsMux.RUnlock()
+	if pool := b.apps[route]; pool != nil {
+		return pool.at(addr)
+	}
+	return nil
+}
+
+// dropApp unregisters an app, every instance of it, at the request of the access key key, or of the server if empty.
+func (b *Broker) dropApp(route, key string) {
 	b.appsMux.Lock()
+	pool := b.apps[route]
 	delete(b.apps, route)
+	away := false
+	if pool != nil {
+		away = b.queue.away(pool.instances[0])
+	} else {
+		_, away = b.queue.mode(route) // gone already
+	}
 	b.appsMux.Unlock()
 
-	echo(Log{"t": "app_drop", "route": route})
+	entry := Log{"t": "app_drop", "route": route}
+	if key != "" {
+		entry["key"] = key
+	}
+	if pool != nil {
+		entry["owner"] = pool.instances[0].owner
+	}
+	echo(entry)
 
-	// Force-reload all browsers listening to this app
-	b.resetSubscribers(route)
+	if key == "" && pool != nil { // probed until they return
+		for _, app := range pool.instances {
+			b.health.dropped(app)
+		}
+	} else {
+		b.health.forget(route, "")
+	}
+
+	// Force-reload all browsers listening to this app, unless they wait for it to return
+	if !away {
+		b.resetSubscribers(route)
+	}
+}
+
+// dropInstance unregisters an instance of an app, at the request of the access key key, or of the server if empty,
+// e.g. for failing health probes. The browsers it served are served by the others from then on.
+func (b *Broker) dropInstance(app *App, key string) {
+	b.appsMux.Lock()
+	pool := b.apps[app.route]
+	if pool == nil || !pool.has(app) {
+		b.appsMux.Unlock()
+		return
+	}
+	moved := pool.remove(app)
+	last := len(pool.instances) == 0
+	away := false
+	if last {
+		delete(b.apps, app.route)
+		away = b.queue.away(app)
+	}
+	b.appsMux.Unlock()
+
+	entry := Log{"t": "app_drop", "route": app.route, "host": app.addr, "owner": app.owner}
+	if key != "" {
+		entry["key"] = key
+	}
+	if app.deployment != "" {
+		entry["deployment"] = app.deployment
+	}
+	if app.scale || app.deployment != "" {
+		entry["instances"] = strconv.Itoa(len(pool.instances))
+	}
+	echo(entry)
+
+	if key == "" { // probed until it returns
+		b.health.dropped(app)
+	} else {
+		b.health.forget(app.route, app.addr)
+	}
+
+	// Force-reload all browsers listening to this app, unless they wait for it to return, or those the instance served
+	if away {
+		moved = nil
+	} else if last {
+		moved = []string{app.route}
+	}
+	for _, route := range moved {
+		b.resetSubscribers(route)
+	}
 }
 
 func parseMsgT(s []byte) MsgT {
@@ -158,6 +403,8 @@ func parseMsgT(s []byte) MsgT {
 			return watchMsgT
 		case '#':
 			return noopMsgT
+		case '!':
+			return ackMsgT
 		}
 	}
 	return badMsgT
@@ -184,14 +431,32 @@ func (b *Broker) isUnicast(route string) bool {
 	return ok
 }
 
-// patch broadcasts changes to clients and patches site data.
-func (b *Broker) patch(route string, data []byte) {
-	b.publish <- Pub{route, data}
+// patch broadcasts changes to clients and patches site data, here and on the other servers in the cluster, if any.
+// If ack is set, changes are sent to clients again until they acknowledge receipt.
+func (b *Broker) patch(route string, data []byte, ack bool) {
+	b.apply(route, data, ack)
+	if !b.isUnicast(route) { // unicast routes belong to clients connected to this server
+		b.cluster.publish(route, data, ack)
+	}
+	b.kafka.patched(route, data)
+}
 
-	if !b.noLog {
+// check describes what's wrong with changes, if validation is enabled and they are malformed.
+func (b *Broker) check(data []byte) error {
+	if !b.validate {
+		return nil
+	}
+	return validateOps(data)
+}
+
+// apply broadcasts changes to clients connected to this server and patches site data.
+func (b *Broker) apply(route string, data []byte, ack bool) {
+	b.publish <- Pub{route, data, ack}
+
+	if b.aof != nil {
+		defer b.aof.record(route, data)() // once applied, below
+	} else if !b.noLog {
 		// Write AOF entry with patch marker "*" as-is to log file.
-		// FIXME bufio.Scanner.Scan() is not reliable if line length > 65536 chars,
-		// so reading back in is unreliable.
 		log.Println("*", route, string(data))
 	}
 
@@ -202,6 +467,10 @@ func (b *Broker) patch(route string, data []byte) {
 
 	if err := b.site.patch(route, data); err != nil {
 		echo(Log{"t": "broker_patch", "error": err.Error()})
+		return
+	}
+	if !b.isUnicast(route) { // unicast pages are transient
+		b.pages.touch(route)
 	}
 }
 
@@ -213,11 +482,11 @@ func init() {
 }
 
 func (b *Broker) resetSubscribers(route string) {
-	b.publish <- Pub{route, resetMsg}
+	b.publish <- Pub{route, resetMsg, false}
 }
 
 func (b *Broker) resetClients(session *Session) {
-	b.logout <- Pub{session.subject, resetMsg}
+	b.logout <- Pub{session.subject, resetMsg, false}
 	apps := b.getApps()
 	for _, app := range apps {
 		go func(app *App) {
@@ -228,6 +497,14 @@ func (b *Broker) resetClients(session *Session) {
 
 // run starts i/o between the broker and clients.
 func (b *Broker) run() {
+	retry := time.NewTicker(ackInterval)
+	defer retry.Stop()
+	var flush <-chan time.Time // nil, and so never ready, unless coalescing
+	if b.window > 0 {
+		t := time.NewTicker(b.window)
+		defer t.Stop()
+		flush = t.C
+	}
 	for {
 		select {
 		case sub := <-b.subscribe:
@@ -236,8 +513,23 @@ func (b *Broker) run() {
 			b.dropClient(client)
 		case pub := <-b.publish:
 			if clients, ok := b.clients[pub.route]; ok {
-				b.sendAll(clients, pub.data)
+				if b.window > 0 && b.coalesce(pub) {
+					continue
+				}
+				b.sendAll(clients, b.number(pub, clients))
 			}
+		case <-flush:
+			b.flushAll()
+		case ack := <-b.ack:
+			delete(ack.client.unacked, ack.seq)
+		case <-retry.C:
+			b.resend()
+		case replay := <-b.replay:
+			b.replayTo(replay.client, replay.seq)
+			close(replay.done)
+		case msg := <-b.evacuate:
+			b.flushAll()
+			b.sendAll(b.everyClient(), msg)
 		case pub := <-b.logout:
 			targets := make(map[*Client]interface{})
 			// TODO speed up using another map?
@@ -253,6 +545,57 @@ func (b *Broker) run() {
 	}
 }
 
+// number numbers a message if it is to be replayed or acknowledged, and logs it for replay.
+func (b *Broker) number(pub Pub, clients map[*Client]interface{}) []byte {
+	if !pub.ack && b.replayLog == nil {
+		return pub.data
+	}
+	b.seq++
+	data := numberMsg(pub.data, b.seq, pub.ack)
+	b.replayLog.append(pub.route, b.seq, data)
+	if pub.ack {
+		now := time.Now()
+		for client := range clients {
+			client.unacked[b.seq] = unackedMsg{data, now}
+		}
+	}
+	return data
+}
+
+// resend sends connected clients the messages they have not acknowledged in time, in order.
+func (b *Broker) resend() {
+	b.unicastsMux.RLock()
+	var clients []*Client
+	for _, client := range b.clientsByID {
+		if len(client.unacked) > 0 {
+			clients = append(clients, client)
+		}
+	}
+	b.unicastsMux.RUnlock()
+
+	now := time.Now()
+	for _, client := range clients {
+		if !client.connected() {
+			continue
+		}
+		seqs := make([]uint64, 0, len(client.unacked))
+		for seq, msg := range client.unacked {
+			if now.Sub(msg.sent) >= ackInterval {
+				seqs = append(seqs, seq)
+			}
+		}
+		sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+		for _, seq := range seqs {
+			msg := client.unacked[seq]
+			if !client.send(msg.data) {
+				b.dropClient(client)
+				break
+			}
+			client.unacked[seq] = unackedMsg{msg.data, now}
+		}
+	}
+}
+
 func (b *Broker) sendAll(clients map[*Client]interface{}, data []byte) {
 	for client := range clients {
 		if !client.send(data) {
@@ -261,7 +604,43 @@ func (b *Broker) sendAll(clients map[*Client]interface{}, data []byte) {
 	}
 }
 
+// catchUp sends a reconnecting client the messages published to its routes after seq,
+// or asks it to reload if they are no longer available.
+func (b *Broker) catchUp(client *Client, seq uint64) {
+	done := make(chan struct{})
+	b.replay <- Replay{client, seq, done}
+	<-done
+}
+
+func (b *Broker) replayTo(client *Client, seq uint64) {
+	if b.getClient(client.id) != client { // dropped
+		return
+	}
+	if seq < client.since {
+		seq = client.since // the client received the page as of then
+	}
+
+	// Discard undelivered messages, which are replayed in order.
+	client.queueLock.Lock()
+	client.drain()
+	client.queueLock.Unlock()
+
+	msgs, ok := b.replayLog.since(client.routes, seq)
+	if !ok || len(msgs) > cap(client.data) {
+		echo(Log{"t": "replay", "client_id": client.id, "seq": strconv.FormatUint(seq, 10), "error": "messages no longer available"})
+		client.send(resetMsg)
+		return
+	}
+	for _, msg := range msgs {
+		client.send(msg)
+	}
+	echo(Log{"t": "replay", "client_id": client.id, "seq": strconv.FormatUint(seq, 10), "messages": strconv.Itoa(len(msgs))})
+}
+
 func (b *Broker) addClient(route string, client *Client) {
+	if client.since == 0 {
+		client.since = b.seq
+	}
 	clients, ok := b.clients[route]
 	if !ok {
 		clients = make(map[*Client]interface{})
@@ -293,12 +672,16 @@ func (b *Broker) dropClient(client *Client) {
 
 	for _, route := range gc {
 		delete(b.clients, route)
+		b.replayLog.drop(route)
 	}
 
 	// FIXME leak: this is not captured in the AOF logging; page will be recreated on hydration
 	b.site.del(client.id) // delete transient page, if any.
 
 	b.unicastsMux.Lock()
+	if b.clientsByID[client.id] == client { // not dropped already
+		b.retired.retire(client)
+	}
 	delete(b.unicasts, "/"+client.id)
 	delete(b.clientsByID, client.id)
 	b.unicastsMux.Unlock()
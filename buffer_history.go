@@ -0,0 +1,512 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+const (
+	maxOpenHistoryFiles = 64
+	maxHistoryRows      = 10000 // rows returned per query
+)
+
+// HistoryRow is a row written to a data buffer, numbered in the order written.
+type HistoryRow struct {
+	Seq  int64           `json:"seq"`
+	Time int64           `json:"time"` // when written, in milliseconds since the epoch
+	Data json.RawMessage `json:"data"` // the row, as written
+}
+
+type historyHeader struct {
+	Route  string   `json:"route"`
+	Card   string   `json:"card"`
+	Buffer string   `json:"buffer"`
+	Fields []string `json:"fields"`
+}
+
+// bufferLog is the file a data buffer's rows are recorded to: a header, then a row per line, [seq, time, data].
+type bufferLog struct {
+	path   string
+	file   *os.File // nil if closed
+	fields []string
+	next   int64 // seq of the next row written
+	rows   int   // rows in the file
+}
+
+// BufferHistory records the rows written to cyclic, fixed and list data buffers to disk, so that the time series
+// charts are drawn from outlive what their buffers hold in memory, and restarts. A limited number of the most recent
+// rows of each buffer are kept; files are trimmed once holding twice as many.
+type BufferHistory struct {
+	dir       string
+	limit     int                     // rows kept per buffer
+	transient func(route string) bool // pages never recorded, e.g. those private to a browser tab
+
+	lock sync.Mutex
+	logs map[string]*bufferLog // file name => log
+	open int                   // files open
+}
+
+func newBufferHistory(dir string, limit int, transient func(route string) bool) *BufferHistory {
+	return &BufferHistory{dir: dir, limit: limit, transient: transient, logs: make(map[string]*bufferLog)}
+}
+
+// record records the rows a change to a page wrote to its data buffers, if any. Must be called with the page
+// locked, once the change is applied.
+func (h *BufferHistory) record(route string, page *Page, op OpD) {
+	if h == nil || h.transient(route) {
+		return
+	}
+	ks := strings.Split(op.K, keySeparator)
+	switch {
+	case op.D != nil: // card made; record the rows its buffers start with
+		for k, v := range op.D {
+			if f, ok := v.(float64); ok && strings.HasPrefix(k, dataPrefix) {
+				if i := int(f); i >= 0 && i < len(op.B) {
+					h.recordBuf(route, op.K, strings.TrimPrefix(k, dataPrefix), op.B[i])
+				}
+			}
+		}
+	case op.C != nil || op.F != nil || op.L != nil: // buffer replaced
+		if len(ks) == 2 {
+			h.recordBuf(route, ks[0], ks[1], BufD{C: op.C, F: op.F, L: op.L})
+		}
+	case len(ks) == 2 || len(ks) == 3: // rows written to a buffer, all of them, or one
+		card, ok := page.cards[ks[0]]
+		if !ok {
+			return
+		}
+		buf, ok := card.data[ks[1]].(Buf)
+		if !ok {
+			return
+		}
+		fields := bufFields(buf)
+		if fields == nil {
+			return
+		}
+		var rows [][]any
+		if len(ks) == 3 {
+			if row, ok := op.V.([]any); ok && len(row) == len(fields) {
+				rows = append(rows, row)
+			}
+		} else if xs, ok := op.V.([]any); ok {
+			for _, x := range xs {
+				if row, ok := x.([]any); ok && len(row) == len(fields) {
+					rows = append(rows, row)
+				}
+			}
+		}
+		h.append(route, ks[0], ks[1], fields, rows)
+	}
+}
+
+// recordBuf records the rows a buffer is made with, oldest first.
+func (h *BufferHistory) recordBuf(route, card, buffer string, b BufD) {
+	var fields []string
+	var rows [][]any
+	switch {
+	case b.C != nil:
+		fields = b.C.F
+		if i := b.C.I; i > 0 && i < len(b.C.D) {
+			rows = append(append(rows, b.C.D[i:]...), b.C.D[:i]...)
+		} else {
+			rows = b.C.D
+		}
+	case b.F != nil:
+		fields, rows = b.F.F, b.F.D
+	case b.L != nil:
+		fields, rows = b.L.F, b.L.D
+	default:
+		return
+	}
+	written := make([][]any, 0, len(rows))
+	for _, row := range rows {
+		if len(row) == len(fields) {
+			written = append(written, row)
+		}
+	}
+	h.append(route, card, buffer, fields, written)
+}
+
+// bufFields returns the fields of a buffer's rows, or nil for map buffers, which aren't recorded.
+func bufFields(b Buf) []string {
+	switch b := b.(type) {
+	case *CycBuf:
+		return b.b.t.f
+	case *FixBuf:
+		return b.t.f
+	case *ListBuf:
+		return b.b.t.f
+	}
+	return nil
+}
+
+func (h *BufferHistory) append(route, card, buffer string, fields []string, rows [][]any) {
+	if len(rows) == 0 {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	l, err := h.openLog(route, card, buffer, fields)
+	if err != nil {
+		echo(Log{"t": "buffer_history", "route": route, "card": card, "buffer": buffer, "error": err.Error()})
+		return
+	}
+	now := time.Now().UnixMilli()
+	var b []byte
+	for _, row := range rows {
+		line, err := json.Marshal([]any{l.next, now, row})
+		if err != nil {
+			continue
+		}
+		b = append(append(b, line...), '\n')
+		l.next++
+		l.rows++
+	}
+	if _, err := l.file.Write(b); err != nil {
+		echo(Log{"t": "buffer_history", "route": route, "card": card, "buffer": buffer, "error": err.Error()})
+		return
+	}
+	if l.rows > 2*h.limit {
+		if err := h.trim(l); err != nil {
+			echo(Log{"t": "buffer_history", "route": route, "card": card, "buffer": buffer, "error": err.Error()})
+		}
+	}
+}
+
+// historyName returns the name of the file a buffer's rows are recorded to.
+func historyName(route, card, buffer string) string {
+	sum := sha256.Sum256([]byte(route + "\x00" + card + "\x00" + buffer))
+	return hex.EncodeToString(sum[:8]) + ".jsonl"
+}
+
+// openLog returns a buffer's log, open for appending. The rows recorded are cleared if the buffer's fields have
+// changed since.
+func (h *BufferHistory) openLog(route, card, buffer string, fields []string) (*bufferLog, error) {
+	name := historyName(route, card, buffer)
+	l, ok := h.logs[name]
+	if !ok {
+		l = &bufferLog{path: filepath.Join(h.dir, name)}
+		header, rows, err := readHistory(l.path, nil)
+		if err != nil && !os.IsNotExist(err) && err != errInvalidHistory { // started over if unreadable
+			return nil, err
+		}
+		if header != nil {
+			l.fields = header.Fields
+		}
+		if len(rows) > 0 {
+			l.next = rows[len(rows)-1].Seq + 1
+		}
+		l.rows = len(rows)
+		h.logs[name] = l
+	}
+	if l.fields != nil && !equalStrings(l.fields, fields) {
+		echo(Log{"t": "buffer_history", "route": route, "card": card, "buffer": buffer, "cleared": strconv.Itoa(l.rows), "reason": "fields changed"})
+		h.close(l)
+		l.fields, l.rows = nil, 0
+	}
+	if l.fields == nil {
+		if err := os.MkdirAll(h.dir, 0700); err != nil {
+			return nil, err
+		}
+		header, err := json.Marshal(historyHeader{route, card, buffer, fields})
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(l.path, append(header, '\n'), 0600); err != nil {
+			return nil, err
+		}
+		l.fields = fields
+	}
+	if l.file == nil {
+		if h.open >= maxOpenHistoryFiles {
+			for _, other := range h.logs {
+				if other.file != nil {
+					h.close(other)
+					break
+				}
+			}
+		}
+		f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		l.file = f
+		h.open++
+	}
+	return l, nil
+}
+
+func (h *BufferHistory) close(l *bufferLog) {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+		h.open--
+	}
+}
+
+// trim rewrites a log with only the most recent rows kept, replacing it only once written.
+func (h *BufferHistory) trim(l *bufferLog) error {
+	b, err := os.ReadFile(l.path)
+	if err != nil {
+		return err
+	}
+	lines := bytes.SplitAfter(b, []byte{'\n'})
+	if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines)-1 <= h.limit {
+		return nil
+	}
+	kept := append([]byte{}, lines[0]...) // header
+	for _, line := range lines[len(lines)-h.limit:] {
+		kept = append(kept, line...)
+	}
+	tmp := l.path + ".tmp"
+	if err := os.WriteFile(tmp, kept, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	h.close(l) // reopened on next write
+	l.rows = h.limit
+	return nil
+}
+
+// historyQuery selects rows: those from a seq on, written in a window of time, the first or last so many.
+type historyQuery struct {
+	since    int64 // seq of the first row
+	from, to int64 // time window, in milliseconds since the epoch; 0 if unbounded
+	limit    int   // rows, from the first selected
+	last     int   // rows, from the last selected, if set
+}
+
+func (q historyQuery) selects(row HistoryRow) bool {
+	return row.Seq >= q.since && (q.from == 0 || row.Time >= q.from) && (q.to == 0 || row.Time < q.to)
+}
+
+// query returns the fields of a buffer's rows, and the rows selected, oldest first.
+func (h *BufferHistory) query(route, card, buffer string, q historyQuery) ([]string, []HistoryRow, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	header, rows, err := readHistory(filepath.Join(h.dir, historyName(route, card, buffer)), &q)
+	if err != nil {
+		return nil, nil, err
+	}
+	return header.Fields, rows, nil
+}
+
+// clear deletes the rows recorded of a buffer, and reports whether there were any.
+func (h *BufferHistory) clear(route, card, buffer string) (bool, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	name := historyName(route, card, buffer)
+	if l, ok := h.logs[name]; ok {
+		h.close(l)
+		delete(h.logs, name)
+	}
+	if err := os.Remove(filepath.Join(h.dir, name)); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+var errInvalidHistory = errors.New("invalid buffer history")
+
+// readHistory reads a buffer's log, and returns its header and the rows selected by q, or all of them if nil.
+func readHistory(path string, q *historyQuery) (*historyHeader, []HistoryRow, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxAOFLine)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, errInvalidHistory
+	}
+	var header historyHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return nil, nil, errInvalidHistory
+	}
+	var rows []HistoryRow
+	for scanner.Scan() {
+		var r [3]json.RawMessage
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			continue // partly written
+		}
+		var row HistoryRow
+		if json.Unmarshal(r[0], &row.Seq) != nil || json.Unmarshal(r[1], &row.Time) != nil {
+			continue
+		}
+		if q != nil {
+			if !q.selects(row) {
+				continue
+			}
+			row.Data = append(json.RawMessage{}, r[2]...)
+			rows = append(rows, row)
+			if q.last > 0 {
+				if len(rows) > q.last {
+					rows = rows[1:]
+				}
+			} else if len(rows) == q.limit {
+				break
+			}
+			continue
+		}
+		rows = append(rows, row) // counted only
+	}
+	return &header, rows, scanner.Err()
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// BufferHistoryHandler lets apps query the rows recorded of data buffers, in windows, e.g. to chart a time series
+// longer than a buffer holds, or page through one.
+//
+//	GET    /_history/<route>?card=stats&buffer=data[&since=seq][&from=ms][&to=ms][&limit=1000][&last=100]
+//	DELETE /_history/<route>?card=stats&buffer=data
+type BufferHistoryHandler struct {
+	prefix   string
+	history  *BufferHistory
+	broker   *Broker
+	keychain keychain.Authenticator
+}
+
+func newBufferHistoryHandler(prefix string, history *BufferHistory, broker *Broker, keychain keychain.Authenticator) http.Handler {
+	return &BufferHistoryHandler{prefix, history, broker, keychain}
+}
+
+func (h *BufferHistoryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.keychain.Guard(w, r) {
+		return
+	}
+	key, _, _ := r.BasicAuth()
+	route := "/" + strings.TrimPrefix(r.URL.Path, h.prefix)
+	q := r.URL.Query()
+	card, buffer := q.Get("card"), q.Get("buffer")
+	if card == "" || buffer == "" {
+		http.Error(w, "want card and buffer, e.g. ?card=stats&buffer=data", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if !h.broker.authorize(Identity{Key: key}, RouteRead, route) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		hq := historyQuery{limit: 1000}
+		for _, p := range []struct {
+			name string
+			v    *int64
+		}{{"since", &hq.since}, {"from", &hq.from}, {"to", &hq.to}} {
+			if s := q.Get(p.name); s != "" {
+				n, err := strconv.ParseInt(s, 10, 64)
+				if err != nil || n < 0 {
+					http.Error(w, "invalid "+p.name, http.StatusBadRequest)
+					return
+				}
+				*p.v = n
+			}
+		}
+		for _, p := range []struct {
+			name string
+			v    *int
+		}{{"limit", &hq.limit}, {"last", &hq.last}} {
+			if s := q.Get(p.name); s != "" {
+				n, err := strconv.Atoi(s)
+				if err != nil || n <= 0 {
+					http.Error(w, "invalid "+p.name, http.StatusBadRequest)
+					return
+				}
+				*p.v = min(n, maxHistoryRows)
+			}
+		}
+		fields, rows, err := h.history.query(route, card, buffer, hq)
+		if err != nil {
+			if os.IsNotExist(err) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			echo(Log{"t": "buffer_history", "route": route, "card": card, "buffer": buffer, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		next := hq.since
+		if len(rows) > 0 {
+			next = rows[len(rows)-1].Seq + 1
+		} else {
+			rows = []HistoryRow{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Fields []string     `json:"fields"`
+			Rows   []HistoryRow `json:"rows"`
+			Next   int64        `json:"next"` // since, to continue from
+		}{fields, rows, next})
+	case http.MethodDelete:
+		if !h.broker.authorize(Identity{Key: key}, RoutePublish, route) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		ok, err := h.history.clear(route, card, buffer)
+		if err != nil {
+			echo(Log{"t": "buffer_history", "route": route, "card": card, "buffer": buffer, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		echo(Log{"t": "buffer_history", "route": route, "card": card, "buffer": buffer, "by": "key:" + key, "cleared": "true"})
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
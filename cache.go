@@ -33,12 +33,12 @@ type Shard struct {
 type Cache struct {
 	sync.RWMutex
 	prefix         string
-	keychain       *keychain.Keychain
+	keychain       keychain.Authenticator
 	shards         map[string]*Shard
 	maxRequestSize int64
 }
 
-func newCache(prefix string, keychain *keychain.Keychain, maxRequestSize int64) *Cache {
+func newCache(prefix string, keychain keychain.Authenticator, maxRequestSize int64) *Cache {
 	return &Cache{
 		prefix:         prefix,
 		keychain:       keychain,
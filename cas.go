@@ -0,0 +1,364 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/h2oai/wave/pkg/blob"
+)
+
+// contentPrefix is the prefix objects are stored under in object storage.
+const contentPrefix = "_c/"
+
+// ContentStore stores uploaded files by the SHA-256 hash of their content, so that files uploaded many times, e.g.
+// by repeated model runs, are stored once. Each upload's files stay at their own paths, e.g. /_f/<id>/<name>, and
+// refer to shared content, which is deleted once no upload refers to it.
+//
+// On disk, files are hard links to content kept in dir. In object storage, content is kept under "_c/", and the
+// store is accessed through bucket, which resolves files to their content.
+type ContentStore struct {
+	path  string      // JSON file references are recorded in
+	dir   string      // content, on disk; spooled uploads, with object storage
+	files string      // file server dir
+	store blob.Bucket // object storage; nil if not used
+
+	objectLock sync.Mutex // serializes storing and deleting content; acquired before lock
+
+	lock    sync.Mutex
+	objects map[string]*contentObject
+	refs    map[string]contentRef // file key => content
+	doomed  []string              // hashes of content no longer referred to, to be deleted
+}
+
+type contentObject struct {
+	Size int64 `json:"size"`
+	Refs int   `json:"refs"`
+}
+
+type contentRef struct {
+	Hash        string `json:"hash"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+type contentLedger struct {
+	Objects map[string]*contentObject `json:"objects"`
+	Files   map[string]contentRef     `json:"files"`
+}
+
+// OpenContentStore loads the references recorded at path, if any.
+func OpenContentStore(path, dir, files string, store blob.Bucket) (*ContentStore, error) {
+	c := &ContentStore{path: path, dir: dir, files: files, store: store, objects: make(map[string]*contentObject), refs: make(map[string]contentRef)}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, err
+	}
+	var l contentLedger
+	if err := json.Unmarshal(b, &l); err != nil {
+		return nil, err
+	}
+	if l.Objects != nil {
+		c.objects = l.Objects
+	}
+	if l.Files != nil {
+		c.refs = l.Files
+	}
+	return c, nil
+}
+
+// bucket returns the object store, storing content once.
+func (c *ContentStore) bucket() blob.Bucket {
+	return &contentBucket{c}
+}
+
+// hash returns the hash of the content of the file at key, or "" if not known.
+func (c *ContentStore) hash(key string) string {
+	if c == nil {
+		return ""
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.refs[key].Hash
+}
+
+// intern replaces stored files with links to content already on disk, if any, or else keeps them as content, and
+// returns their hashes. With object storage, content is stored once as files are stored, and only hashes are returned.
+func (c *ContentStore) intern(stored []storedFile) []string {
+	if c == nil {
+		return nil
+	}
+	hashes := make([]string, len(stored))
+	for i, f := range stored {
+		if c.store != nil {
+			hashes[i] = c.hash(f.key)
+			continue
+		}
+		h, err := c.internFile(f.key)
+		if err != nil {
+			echo(Log{"t": "file_dedupe", "path": f.key, "error": err.Error()})
+			continue
+		}
+		hashes[i] = h
+	}
+	return hashes
+}
+
+func (c *ContentStore) internFile(key string) (string, error) {
+	p := filepath.Join(c.files, filepath.FromSlash(key))
+	h, size, err := hashFile(p)
+	if err != nil {
+		return "", err
+	}
+	obj := c.objectPath(h)
+
+	defer c.purge()
+	c.objectLock.Lock()
+	defer c.objectLock.Unlock()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.unref(key) // stored again
+	if o, ok := c.objects[h]; ok && o.Refs > 0 {
+		// Replace the file with a link to the content, atomically, so that it is never missing.
+		tmp := p + ".dedupe"
+		if err := os.Link(obj, tmp); err != nil {
+			return "", err
+		}
+		if err := os.Rename(tmp, p); err != nil {
+			os.Remove(tmp)
+			return "", err
+		}
+		o.Refs++
+	} else {
+		if err := os.MkdirAll(filepath.Dir(obj), 0700); err != nil {
+			return "", err
+		}
+		os.Remove(obj) // left behind, e.g. by a crash before the references were saved
+		if err := os.Link(p, obj); err != nil {
+			return "", err
+		}
+		c.objects[h] = &contentObject{size, 1}
+	}
+	c.refs[key] = contentRef{Hash: h}
+	c.save()
+	return h, nil
+}
+
+// release drops the references of the files uploaded with an id, once deleted, deleting content no longer referred to.
+func (c *ContentStore) release(id string) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	if c.releasePrefix(id+"/") > 0 {
+		c.save()
+	}
+	c.lock.Unlock()
+	c.purge()
+}
+
+// releasePrefix drops the references of files with keys starting with prefix, and returns how many it dropped.
+// The caller must hold the lock.
+func (c *ContentStore) releasePrefix(prefix string) int {
+	n := 0
+	for key := range c.refs {
+		if strings.HasPrefix(key, prefix) {
+			c.unref(key)
+			n++
+		}
+	}
+	return n
+}
+
+// unref drops the reference of the file at key, if any, dooming its content if no longer referred to.
+// The caller must hold the lock.
+func (c *ContentStore) unref(key string) {
+	ref, ok := c.refs[key]
+	if !ok {
+		return
+	}
+	delete(c.refs, key)
+	o, ok := c.objects[ref.Hash]
+	if !ok {
+		return
+	}
+	if o.Refs--; o.Refs > 0 {
+		return
+	}
+	delete(c.objects, ref.Hash)
+	c.doomed = append(c.doomed, ref.Hash)
+}
+
+// purge deletes doomed content, unless stored again meanwhile.
+func (c *ContentStore) purge() {
+	c.objectLock.Lock()
+	defer c.objectLock.Unlock()
+	c.lock.Lock()
+	var doomed []string
+	for _, h := range c.doomed {
+		if _, ok := c.objects[h]; !ok {
+			doomed = append(doomed, h)
+		}
+	}
+	c.doomed = nil
+	c.lock.Unlock()
+	for _, h := range doomed {
+		var err error
+		if c.store != nil {
+			_, err = c.store.DeletePrefix(context.Background(), contentPrefix+h)
+		} else {
+			err = os.Remove(c.objectPath(h))
+		}
+		if err != nil && !os.IsNotExist(err) {
+			echo(Log{"t": "file_dedupe", "hash": h, "error": err.Error()})
+		}
+	}
+}
+
+func (c *ContentStore) objectPath(h string) string {
+	return filepath.Join(c.dir, h[:2], h)
+}
+
+// save records the references on disk. The caller must hold the lock.
+func (c *ContentStore) save() {
+	b, err := json.Marshal(contentLedger{c.objects, c.refs})
+	if err != nil {
+		echo(Log{"t": "file_dedupe", "error": err.Error()})
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		echo(Log{"t": "file_dedupe", "error": err.Error()})
+		return
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		echo(Log{"t": "file_dedupe", "error": err.Error()})
+		return
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		echo(Log{"t": "file_dedupe", "error": err.Error()})
+	}
+}
+
+func hashFile(p string) (string, int64, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// contentBucket stores files in object storage by the hash of their content, spooling each to disk to hash it
+// before storing its content, unless already stored.
+type contentBucket struct {
+	c *ContentStore
+}
+
+func (b *contentBucket) Put(ctx context.Context, key, contentType string, r io.Reader) error {
+	c := b.c
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+	spool, err := os.CreateTemp(c.dir, "spool-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	sum := sha256.New()
+	size, err := io.Copy(io.MultiWriter(spool, sum), r)
+	if err != nil {
+		return err
+	}
+	h := hex.EncodeToString(sum.Sum(nil))
+
+	defer c.purge()
+	// Store new content under the object lock, so that it is not deleted while stored, without holding up
+	// downloads, which only need the lock.
+	c.objectLock.Lock()
+	defer c.objectLock.Unlock()
+	c.lock.Lock()
+	o, ok := c.objects[h]
+	c.lock.Unlock()
+	if !ok {
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := c.store.Put(ctx, contentPrefix+h, "application/octet-stream", spool); err != nil {
+			return err
+		}
+		o = &contentObject{Size: size}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.unref(key) // stored again
+	o.Refs++
+	c.objects[h] = o
+	c.refs[key] = contentRef{h, contentType}
+	c.save()
+	return nil
+}
+
+// resolve returns the key of the content of the file at key, and the file's content type, if known.
+func (b *contentBucket) resolve(key string) (string, string) {
+	b.c.lock.Lock()
+	defer b.c.lock.Unlock()
+	if ref, ok := b.c.refs[key]; ok {
+		return contentPrefix + ref.Hash, ref.ContentType
+	}
+	return key, "" // stored before content was hashed
+}
+
+func (b *contentBucket) Get(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	key, _ = b.resolve(key)
+	return b.c.store.Get(ctx, key, offset)
+}
+
+func (b *contentBucket) Stat(ctx context.Context, key string) (blob.Info, error) {
+	key, contentType := b.resolve(key)
+	info, err := b.c.store.Stat(ctx, key)
+	if err == nil && contentType != "" {
+		info.ContentType = contentType
+	}
+	return info, err
+}
+
+func (b *contentBucket) DeletePrefix(ctx context.Context, prefix string) (int, error) {
+	b.c.lock.Lock()
+	n := b.c.releasePrefix(prefix)
+	if n > 0 {
+		b.c.save()
+	}
+	b.c.lock.Unlock()
+	b.c.purge()
+	m, err := b.c.store.DeletePrefix(ctx, prefix) // stored before content was hashed
+	return n + m, err
+}
@@ -0,0 +1,160 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"github.com/h2oai/wave/pkg/blob"
+)
+
+func TestContentStoreRefcountsFiles(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	dir := t.TempDir()
+	files := filepath.Join(dir, "files")
+	ledger := filepath.Join(dir, "cas.json")
+	c, err := OpenContentStore(ledger, filepath.Join(dir, "content"), files, nil)
+	no(err)
+
+	write := func(key, content string) storedFile {
+		p := filepath.Join(files, filepath.FromSlash(key))
+		no(os.MkdirAll(filepath.Dir(p), 0700))
+		no(os.WriteFile(p, []byte(content), 0600))
+		return storedFile{key: key, size: int64(len(content))}
+	}
+	hashes := c.intern([]storedFile{write("id1/a.txt", "same"), write("id2/b.txt", "same"), write("id3/c.txt", "other")})
+	eq(hashes[0], hashes[1])
+	ok(hashes[0] != hashes[2])
+	eq(c.objects[hashes[0]].Refs, 2)
+	obj := c.objectPath(hashes[0])
+	a, err := os.Stat(filepath.Join(files, "id1", "a.txt"))
+	no(err)
+	o, err := os.Stat(obj)
+	no(err)
+	ok(os.SameFile(a, o), "file links to content")
+
+	// Storing a file again doesn't count twice.
+	c.intern([]storedFile{write("id2/b.txt", "same")})
+	eq(c.objects[hashes[0]].Refs, 2)
+
+	c.release("id1")
+	eq(c.objects[hashes[0]].Refs, 1)
+	_, err = os.Stat(obj)
+	no(err)
+
+	// References survive restarts.
+	c, err = OpenContentStore(ledger, filepath.Join(dir, "content"), files, nil)
+	no(err)
+	eq(c.hash("id2/b.txt"), hashes[0])
+	eq(c.hash("id1/a.txt"), "")
+
+	c.release("id2")
+	_, found := c.objects[hashes[0]]
+	ok(!found, "content no longer referred to")
+	_, err = os.Stat(obj)
+	ok(os.IsNotExist(err), "content deleted")
+	eq(c.objects[hashes[2]].Refs, 1)
+}
+
+// memBucket is an in-memory blob.Bucket.
+type memBucket struct {
+	sync.Mutex
+	objects map[string][]byte
+}
+
+func (b *memBucket) Put(ctx context.Context, key, contentType string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.objects[key] = data
+	return nil
+}
+
+func (b *memBucket) Get(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	b.Lock()
+	defer b.Unlock()
+	data, ok := b.objects[key]
+	if !ok {
+		return nil, blob.ErrNotFound
+	}
+	return io.NopCloser(bytes.NewReader(data[offset:])), nil
+}
+
+func (b *memBucket) Stat(ctx context.Context, key string) (blob.Info, error) {
+	b.Lock()
+	defer b.Unlock()
+	data, ok := b.objects[key]
+	if !ok {
+		return blob.Info{}, blob.ErrNotFound
+	}
+	return blob.Info{Size: int64(len(data))}, nil
+}
+
+func (b *memBucket) DeletePrefix(ctx context.Context, prefix string) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	n := 0
+	for key := range b.objects {
+		if strings.HasPrefix(key, prefix) {
+			delete(b.objects, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func TestContentStoreRefcountsObjects(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	dir := t.TempDir()
+	store := &memBucket{objects: make(map[string][]byte)}
+	c, err := OpenContentStore(filepath.Join(dir, "cas.json"), dir, "", store)
+	no(err)
+	b := c.bucket()
+	ctx := context.Background()
+
+	no(b.Put(ctx, "id1/a.txt", "text/plain", strings.NewReader("same")))
+	no(b.Put(ctx, "id2/b.csv", "text/csv", strings.NewReader("same")))
+	eq(len(store.objects), 1) // stored once
+	info, err := b.Stat(ctx, "id2/b.csv")
+	no(err)
+	eq(info.ContentType, "text/csv")
+	eq(info.Size, int64(4))
+
+	n, err := b.DeletePrefix(ctx, "id1/")
+	no(err)
+	eq(n, 1)
+	r, err := b.Get(ctx, "id2/b.csv", 0)
+	no(err)
+	data, err := io.ReadAll(r)
+	no(err)
+	eq(string(data), "same")
+
+	_, err = b.DeletePrefix(ctx, "id2/")
+	no(err)
+	eq(len(store.objects), 0)
+	_, err = b.Stat(ctx, "id2/b.csv")
+	ok(err == blob.ErrNotFound)
+}
@@ -17,9 +17,12 @@ package wave
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -27,8 +30,7 @@ import (
 )
 
 const (
-	writeWait      = 10 * time.Second // Time allowed to write a message to the peer.
-	maxMessageSize = 1 * 1024 * 1024  // bytes Maximum message size allowed from peer.
+	writeWait = 10 * time.Second // Time allowed to write a message to the peer.
 	// TODO: Refactor into iota.
 	STATE_CREATED    = "CREATED"
 	STATE_TIMEOUT    = "TIMEOUT"
@@ -43,8 +45,12 @@ var (
 	notFoundMsg   = []byte(`{"e":"not_found"}`)
 	disconnectMsg = []byte(`{"data": {"":{"@system":{"client_disconnect":true}}}}`)
 	clearStateMsg = []byte(`{"c":1}`)
+	idleMsg       = []byte(`{"x":1}`)
 )
 
+// invalidPatchErr prefixes the descriptions of malformed changes sent back to editors.
+const invalidPatchErr = "invalid_patch: "
+
 // BootMsg represents the initial message sent to an app when a client first connects to it.
 type BootMsg struct {
 	Data struct {
@@ -56,30 +62,86 @@ type BootMsg struct {
 
 // Client represent a websocket (UI) client.
 type Client struct {
-	id               string          // unique id
-	auth             *Auth           // auth provider, might be nil
-	addr             string          // remote IP:port, used for logging only
-	session          *Session        // end-user session
-	broker           *Broker         // broker
-	conn             *websocket.Conn // connection
-	routes           []string        // watched routes
-	data             chan []byte     // send data
-	editable         bool            // allow editing? // TODO move to user; tie to role
-	baseURL          string          // URL prefix of the Wave server
-	header           *http.Header    // forwarded headers from the WS connection
-	appPath          string          // path of the app this client is connected to, doesn't change throughout WS lifetime
+	id               string             // unique id
+	auth             *Auth              // auth provider, might be nil
+	addr             string             // remote IP:port, used for logging only
+	session          *Session           // end-user session
+	broker           *Broker            // broker
+	conn             transport          // connection
+	routes           []string           // watched routes
+	data             chan []byte        // send data
+	queueLock        sync.Mutex         // serializes senders, so that overflows are handled in order
+	overflow         OverflowPolicy     // what to do when data is full
+	overflows        int                // number of times data was full
+	filter           subscriptionFilter // cards and changes the client wants, if not all
+	limits           SocketLimits       // caps on what the client may send
+	throttled        int                // number of messages delayed to stay within limits
+	editable         bool               // allow editing? // TODO move to user; tie to role
+	baseURL          string             // URL prefix of the Wave server
+	header           *http.Header       // forwarded headers from the WS connection
+	appPath          string             // path of the app this client is connected to, doesn't change throughout WS lifetime
 	pingInterval     time.Duration
 	reconnectTimeout time.Duration
+	idleTimeout      time.Duration // close the connection if the user sends nothing for this long; 0 to never
+	lastActive       atomic.Int64  // when the user last sent a message, in Unix nanoseconds
 	lock             *sync.Mutex
 	state            string
+	since            uint64                // sequence number of the latest message published before the client subscribed
+	unacked          map[uint64]unackedMsg // messages sent but not yet acknowledged, by sequence number; broker only
+	route            string                // route of the page watched, if any yet
+	connectedAt      time.Time             // when the client first connected
+	stats            clientStats           // what was sent to the client, for metrics
+	slow             bool                  // queue has been mostly full since last logged; queue lock only
+}
+
+// unackedMsg is a message sent to a client, to be sent again unless acknowledged.
+type unackedMsg struct {
+	data []byte
+	sent time.Time
+}
+
+// clientConf configures the clients connected to a server.
+type clientConf struct {
+	editable         bool
+	baseURL          string
+	pingInterval     time.Duration
+	reconnectTimeout time.Duration
+	idleTimeout      time.Duration
+	queueSize        int
+	overflow         OverflowPolicy
+	limits           SocketLimits
+}
+
+func newClient(addr string, auth *Auth, session *Session, broker *Broker, conn transport, header *http.Header, filter subscriptionFilter, conf clientConf) *Client {
+	c := &Client{
+		id:               uuid.New().String(),
+		auth:             auth,
+		addr:             addr,
+		session:          session,
+		broker:           broker,
+		conn:             conn,
+		data:             make(chan []byte, conf.queueSize),
+		overflow:         conf.overflow,
+		filter:           filter,
+		limits:           conf.limits,
+		editable:         conf.editable,
+		baseURL:          conf.baseURL,
+		header:           header,
+		pingInterval:     conf.pingInterval,
+		reconnectTimeout: conf.reconnectTimeout,
+		idleTimeout:      conf.idleTimeout,
+		lock:             &sync.Mutex{},
+		state:            STATE_CREATED,
+		unacked:          make(map[uint64]unackedMsg),
+		connectedAt:      time.Now(),
+	}
+	c.lastActive.Store(c.connectedAt.UnixNano())
+	return c
 }
 
-// TODO: Refactor some of the params into a Config struct.
-func newClient(addr string, auth *Auth, session *Session, broker *Broker, conn *websocket.Conn, editable bool,
-	baseURL string, header *http.Header, pingInterval time.Duration, reconnectTimeout time.Duration) *Client {
-	id := uuid.New().String()
-	return &Client{id, auth, addr, session, broker, conn, nil, make(chan []byte, 256),
-		editable, baseURL, header, "", pingInterval, reconnectTimeout, &sync.Mutex{}, STATE_CREATED}
+// idle reports whether the user has sent nothing for longer than the idle timeout, if any.
+func (c *Client) idle() bool {
+	return c.idleTimeout > 0 && time.Since(time.Unix(0, c.lastActive.Load())) > c.idleTimeout
 }
 
 func (c *Client) refreshToken() error {
@@ -88,11 +150,8 @@ func (c *Client) refreshToken() error {
 		ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
 		defer cancel()
 
-		token, err := c.auth.ensureValidOAuth2Token(ctx, c.session.token)
-		if err != nil {
-			return err
-		}
-		c.session.token = token
+		_, err := c.auth.ensureValidOAuth2Token(ctx, c.session, 0)
+		return err
 	}
 	return nil
 }
@@ -103,6 +162,20 @@ func (c *Client) setState(newState string) {
 	c.lock.Unlock()
 }
 
+// connected reports whether the client is connected, rather than waiting to reconnect.
+func (c *Client) connected() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.state == STATE_CREATED || c.state == STATE_LISTEN || c.state == STATE_RECONNECT
+}
+
+// app returns the path of the app this client is connected to, if any.
+func (c *Client) app() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.appPath
+}
+
 func (c *Client) listen() {
 	defer func() {
 		c.lock.Lock()
@@ -123,12 +196,15 @@ func (c *Client) listen() {
 			if c.state != timeoutID {
 				return
 			}
-			app := c.broker.getApp(c.appPath)
+			app := c.broker.appFor(c.appPath, c.id, c.session.subject)
 			if app != nil {
 				app.forward(c.id, c.session, disconnectMsg)
 				if err := app.disconnect(c.id); err != nil {
 					echo(Log{"t": "disconnect", "client": c.addr, "route": c.appPath, "err": err.Error()})
 				}
+				c.broker.releaseApp(c.appPath, c.id)
+			} else if c.appPath != "" {
+				c.broker.queue.forget(c.appPath, c.id)
 			}
 
 			echo(Log{"t": "client_unsubscribe", "client": c.id})
@@ -137,24 +213,40 @@ func (c *Client) listen() {
 			return
 		}
 	}()
-	// Time allowed to read the next pong message from the peer. Must be greater than ping interval.
-	pongWait := 10 * c.pingInterval / 9
-	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(pongWait))
-		return nil
-	})
+	throttle := newThrottle(c.limits)
 	for {
-		_, msg, err := c.conn.ReadMessage()
+		c.lock.Lock()
+		conn := c.conn
+		c.lock.Unlock()
+		msg, err := conn.read()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			if errors.Is(err, websocket.ErrReadLimit) {
+				// The client has been sent a close message, with status 1009 (message too big).
+				socketStats.oversized.Add(1)
+				echo(Log{"t": "socket_limit", "client": c.id, "limit": "size", "max": strconv.FormatInt(c.limits.MaxMessageSize, 10)})
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				echo(Log{"t": "socket_read", "client": c.addr, "err": err.Error()})
 			}
-			c.setState(STATE_DISCONNECT)
+			c.lock.Lock()
+			if c.conn == conn { // else replaced by a reconnect
+				conn.close() // free dead connections promptly
+			}
+			c.state = STATE_DISCONNECT
+			c.lock.Unlock()
 			break
 		}
 
+		socketStats.messages.Add(1)
+		socketStats.bytes.Add(int64(len(msg)))
+		if d := throttle.wait(len(msg)); d > 0 {
+			// Slow down, rather than drop messages; the client's sends back up meanwhile.
+			socketStats.throttled.Add(1)
+			if c.throttled++; c.throttled == 1 {
+				echo(Log{"t": "socket_limit", "client": c.id, "limit": "rate"})
+			}
+			time.Sleep(d)
+		}
+
 		if err := c.refreshToken(); err != nil {
 			// token refresh failed, this is not fatal err, try next time
 			// TODO kick user out?
@@ -162,7 +254,7 @@ func (c *Client) listen() {
 		}
 
 		if c.session != nil && c.auth != nil {
-			if err := c.session.touch(c.auth.conf.InactivityTimeout); err != nil {
+			if err := c.auth.touch(c.session); err != nil {
 				if msg, err := json.Marshal(OpsD{U: c.baseURL + "_auth/logout"}); err == nil {
 					c.send(msg)
 				}
@@ -172,19 +264,45 @@ func (c *Client) listen() {
 
 		m := parseMsg(msg)
 		m.addr = resolveURL(m.addr, c.baseURL)
+		if m.t != ackMsgT { // acks are sent automatically, and so don't mean the user is there
+			c.lastActive.Store(time.Now().UnixNano())
+		}
 		switch m.t {
 		case patchMsgT:
-			if c.editable { // allow only if editing is enabled
-				c.broker.patch(m.addr, m.data)
+			if c.editable && c.session != guest { // allow only if editing is enabled
+				if !c.broker.authorize(c.identity(), RoutePublish, m.addr) {
+					continue
+				}
+				if err := c.broker.check(m.data); err != nil {
+					echo(Log{"t": "invalid_patch", "client": c.id, "route": m.addr, "error": err.Error()})
+					if msg, err := json.Marshal(OpsD{E: invalidPatchErr + err.Error()}); err == nil {
+						c.send(msg)
+					}
+					continue
+				}
+				c.broker.patch(m.addr, m.data, false)
+			}
+		case ackMsgT:
+			if seq, err := strconv.ParseUint(string(m.data), 10, 64); err == nil {
+				c.broker.ack <- Ack{c, seq}
 			}
 		case queryMsgT:
-			app := c.broker.getApp(m.addr)
+			app := c.broker.appFor(m.addr, c.id, c.session.subject)
 			if app == nil {
+				// Hold on to what users do while the app is away, e.g. restarting, to deliver it once it is back.
+				if c.session != guest && c.auth.canOpen(c.session, m.addr) && c.broker.queue.hold(m.addr, c.id, c.session, []byte("{\"data\":"+string(m.data)+"}")) {
+					continue
+				}
 				echo(Log{"t": "query", "client": c.addr, "route": m.addr, "error": "service unavailable"})
 				continue
 			}
+			if c.session == guest || !c.auth.canOpen(c.session, app.route) { // guests are read-only
+				echo(Log{"t": "query", "client": c.addr, "route": m.addr, "subject": c.session.subject, "error": "forbidden"})
+				continue
+			}
 
 			app.forward(c.id, c.session, []byte("{\"data\":"+string(m.data)+"}"))
+			c.broker.kafka.queried(app.route, c.id, c.session.username, m.data)
 
 			// Remove any dirty UI state if broadcast or multicast.
 			if app.mode == multicastMode {
@@ -203,10 +321,40 @@ func (c *Client) listen() {
 				c.lock.Unlock()
 				continue
 			}
-			c.subscribe(m.addr)                             // subscribe even if page is currently NA
-			if app := c.broker.getApp(m.addr); app != nil { // do we have an app handling this route?
+			if c.session == guest && !c.auth.isPublic(m.addr) {
+				// Ask guests to sign in.
+				if msg, err := json.Marshal(OpsD{U: c.baseURL + "_auth/login"}); err == nil {
+					c.send(msg)
+				}
+				continue
+			}
+			if app := c.broker.getApp(m.addr); app != nil && !c.auth.canOpen(c.session, app.route) {
+				echo(Log{"t": "watch", "client": c.addr, "route": m.addr, "subject": c.session.subject, "error": "forbidden"})
+				c.send(notFoundMsg)
+				continue
+			}
+			if !c.broker.authorize(c.identity(), RouteSubscribe, m.addr) {
+				c.send(notFoundMsg)
+				continue
+			}
+			c.lock.Lock()
+			c.route = m.addr
+			c.lock.Unlock()
+			c.stats.watch(m.addr)
+			c.subscribe(m.addr) // subscribe even if page is currently NA
+			app := c.broker.appFor(m.addr, c.id, c.session.subject)
+			var mode AppMode
+			away := false
+			if app != nil {
+				mode = app.mode
+			} else if c.auth.canOpen(c.session, m.addr) {
+				mode, away = c.broker.queue.mode(m.addr)
+			}
+			if app != nil || away { // do we have an app handling this route, or one to return to it?
+				c.lock.Lock()
 				c.appPath = m.addr
-				switch app.mode {
+				c.lock.Unlock()
+				switch mode {
 				case unicastMode:
 					c.subscribe("/" + c.id) // client-level
 				case multicastMode:
@@ -226,7 +374,11 @@ func (c *Client) listen() {
 					continue
 				}
 
-				app.forward(c.id, c.session, body)
+				if app != nil {
+					app.forward(c.id, c.session, body)
+				} else if !c.broker.queue.hold(m.addr, c.id, c.session, body) { // back already, or gone for good
+					c.send(resetMsg)
+				}
 				continue
 			}
 
@@ -246,25 +398,21 @@ func (c *Client) listen() {
 	}
 }
 
+// identity returns who the client's user is, for route authorizers.
+func (c *Client) identity() Identity {
+	return Identity{Subject: c.session.subject, Username: c.session.username, Groups: c.session.groups}
+}
+
 func (c *Client) subscribe(route string) {
 	c.routes = append(c.routes, route)
 	c.broker.subscribe <- Sub{route, c}
 }
 
-func (c *Client) send(data []byte) bool {
-	select {
-	case c.data <- data:
-		return true
-	default:
-		return false
-	}
-}
-
 func (c *Client) flush() {
 	ticker := time.NewTicker(c.pingInterval)
 	defer func() {
 		ticker.Stop()
-		c.conn.Close()
+		c.conn.close()
 		c.lock.Unlock()
 	}()
 	for {
@@ -272,34 +420,31 @@ func (c *Client) flush() {
 		case data, ok := <-c.data:
 			// An alternative to the mutex here would be a new channel for closing the connection so it does not race with reconnect.
 			c.lock.Lock()
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				// broker closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
 				return
 			}
-			w.Write(data)
 
 			// push queued messages, if any
-			n := len(c.data)
-			for i := 0; i < n; i++ {
-				w.Write(newline)
-				w.Write(<-c.data)
+			msgs, size := [][]byte{data}, len(data)
+			for n := len(c.data); n > 0; n-- {
+				msg := <-c.data
+				msgs = append(msgs, msg)
+				size += len(newline) + len(msg)
 			}
-
-			if err := w.Close(); err != nil {
+			if err := c.conn.write(msgs, size); err != nil {
 				return
 			}
 			c.lock.Unlock()
 		case <-ticker.C:
 			c.lock.Lock()
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			if err := c.conn.ping(); err != nil {
+				return
+			}
+			if c.idle() {
+				// Disconnect, so that the app can clean up after the client, and tell the client to reconnect later.
+				echo(Log{"t": "client_idle", "client": c.id, "timeout": c.idleTimeout.String()})
+				c.conn.write([][]byte{idleMsg}, len(idleMsg))
 				return
 			}
 			c.lock.Unlock()
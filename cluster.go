@@ -0,0 +1,111 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/h2oai/wave/pkg/redis"
+)
+
+// Cluster fans out changes to pages between Wave servers sharing a Redis channel, so that clients connected to
+// any of them see the same pages.
+//
+// Each server posts the changes made through it to the channel, and applies the changes posted by the others.
+// Changes from one server are applied by the others in the order they were made.
+type Cluster struct {
+	node    string // identifies this server, to skip its own changes
+	channel string
+	client  *redis.Client
+	out     chan Pub
+}
+
+// clusterMsg is a change posted to the cluster's channel.
+type clusterMsg struct {
+	Node  string `json:"n"`
+	Route string `json:"r"`
+	Data  string `json:"d"`
+	Ack   bool   `json:"a,omitempty"`
+}
+
+// clusterRetryDelay is how long to wait before subscribing to the cluster's channel again after losing it.
+const clusterRetryDelay = 2 * time.Second
+
+func newCluster(rawURL, channel string) (*Cluster, error) {
+	client, err := redis.New(rawURL, 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &Cluster{uuid.New().String(), channel, client, make(chan Pub, 1024)}, nil // TODO tune
+}
+
+// publish queues a change made through this server, to be posted to the other servers.
+func (c *Cluster) publish(route string, data []byte, ack bool) {
+	if c == nil {
+		return
+	}
+	select {
+	case c.out <- Pub{route, data, ack}:
+	default:
+		echo(Log{"t": "cluster_publish", "route": route, "error": "queue full"})
+	}
+}
+
+// run posts changes made through this server, and applies changes made through the others, until the server exits.
+func (c *Cluster) run(broker *Broker) {
+	go c.send()
+	for {
+		sub, err := c.client.Subscribe(c.channel)
+		if err != nil {
+			echo(Log{"t": "cluster_subscribe", "channel": c.channel, "error": err.Error()})
+			time.Sleep(clusterRetryDelay)
+			continue
+		}
+		echo(Log{"t": "cluster_join", "channel": c.channel, "node": c.node})
+		for {
+			_, message, err := sub.Receive()
+			if err != nil {
+				echo(Log{"t": "cluster_receive", "channel": c.channel, "error": err.Error()})
+				break
+			}
+			var m clusterMsg
+			if err := json.Unmarshal([]byte(message), &m); err != nil {
+				echo(Log{"t": "cluster_receive", "channel": c.channel, "error": err.Error()})
+				continue
+			}
+			if m.Node == c.node {
+				continue
+			}
+			broker.apply(m.Route, []byte(m.Data), m.Ack)
+		}
+		sub.Close()
+		time.Sleep(clusterRetryDelay)
+	}
+}
+
+// send posts queued changes to the cluster's channel, one at a time to keep them in order.
+func (c *Cluster) send() {
+	for pub := range c.out {
+		b, err := json.Marshal(clusterMsg{c.node, pub.route, string(pub.data), pub.ack})
+		if err != nil {
+			continue
+		}
+		if _, err := c.client.Publish(c.channel, string(b)); err != nil {
+			echo(Log{"t": "cluster_publish", "route": pub.route, "error": err.Error()})
+		}
+	}
+}
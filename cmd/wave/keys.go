@@ -0,0 +1,494 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+const keysUsage = `Usage: waved keys <command> [options] [arguments]
+
+Commands:
+  add                 create a new access key
+  list                list access keys
+  remove ID...        remove access keys
+  rotate ID           replace the secret of an access key
+  expire ID WHEN      expire an access key at WHEN (a duration from now, a RFC3339 timestamp, "now" or "never")
+  import FILE         add access keys from a keychain, CSV or JSONL file
+  export FILE         write access keys to a keychain, CSV or JSONL file
+  apply POLICY        reconcile the keychain with a YAML policy file
+  diff OTHER          list keys added, removed or changed in another keychain
+  merge OTHER         copy keys from another keychain
+  validate [FILE]     check a keychain file for problems without loading it
+  loadtest            measure authentication latency for a mix of cached, uncached and bad secrets
+  prompt              manage keys on a running server from an interactive prompt (requires -admin-keychain on the server)
+
+Run "waved keys <command> -h" for command options.
+`
+
+func fail(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "error: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+func defaultKeychainFile() string {
+	if v, ok := os.LookupEnv("H2O_WAVE_ACCESS_KEYCHAIN"); ok {
+		return v
+	}
+	return ".wave-keychain"
+}
+
+// keysCommand holds the flags common to all keys subcommands.
+type keysCommand struct {
+	flags    *flag.FlagSet
+	keychain string
+}
+
+func newKeysCommand(name string) *keysCommand {
+	c := &keysCommand{flags: flag.NewFlagSet("keys "+name, flag.ExitOnError)}
+	c.flags.StringVar(&c.keychain, "access-keychain", defaultKeychainFile(), "path to file containing API access keys")
+	return c
+}
+
+func (c *keysCommand) parse(args []string, nargs int, usage string) []string {
+	c.flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: waved keys %s [options] %s\n", strings.TrimPrefix(c.flags.Name(), "keys "), usage)
+		c.flags.PrintDefaults()
+	}
+	c.flags.Parse(args)
+	rest := c.flags.Args()
+	if (nargs >= 0 && len(rest) != nargs) || (nargs < 0 && len(rest) == 0) {
+		c.flags.Usage()
+		os.Exit(2)
+	}
+	return rest
+}
+
+func (c *keysCommand) open() *keychain.Keychain {
+	kc, err := keychain.LoadKeychain(c.keychain)
+	if err != nil {
+		fail("failed loading keychain: %v", err)
+	}
+	return kc
+}
+
+func save(kc *keychain.Keychain) {
+	if err := kc.Save(); err != nil {
+		fail("failed writing keychain: %v", err)
+	}
+}
+
+func parseMetadata(s string) map[string]string {
+	if len(s) == 0 {
+		return nil
+	}
+	m := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || len(k) == 0 {
+			fail("bad metadata: want key=value, got %q", kv)
+		}
+		m[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return m
+}
+
+// parseExpiry parses a duration from now, a RFC3339 timestamp, "now" or "never" (nil).
+func parseExpiry(s string) *time.Time {
+	switch s {
+	case "never":
+		return nil
+	case "now":
+		t := time.Now()
+		return &t
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		t := time.Now().Add(d)
+		return &t
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		fail("bad expiry: want duration, RFC3339 timestamp, now or never, got %q", s)
+	}
+	return &t
+}
+
+func formatMetadata(m map[string]string) string {
+	kvs := make([]string, 0, len(m))
+	for k, v := range m {
+		kvs = append(kvs, k+"="+v)
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
+
+func status(e keychain.Entry) string {
+	if e.Disabled {
+		return "disabled"
+	}
+	if e.Expires != nil && !time.Now().Before(*e.Expires) {
+		return "expired"
+	}
+	return "active"
+}
+
+// printDiff prints keys added, removed or changed, one per line, like the apply command.
+func printDiff(d keychain.Diff) {
+	for _, c := range []struct {
+		action string
+		ids    []string
+	}{{"add", d.Added}, {"remove", d.Removed}, {"update", d.Changed}} {
+		for _, id := range c.ids {
+			fmt.Printf("%-8s %s\n", c.action, id)
+		}
+	}
+}
+
+func runKeys(args []string) {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, keysUsage)
+		os.Exit(2)
+	}
+
+	cmd, args := args[0], args[1:]
+	if cmd == "prompt" {
+		runPrompt(args)
+		return
+	}
+	c := newKeysCommand(cmd)
+
+	switch cmd {
+	case "add":
+		metadata := c.flags.String("metadata", "", "comma-separated key=value pairs to attach to the key, e.g. \"owner=ops,env=prod\"")
+		expires := c.flags.String("expires", "never", "expire the key after a duration (e.g. 720h), at a RFC3339 timestamp, or never")
+		c.parse(args, 0, "")
+		kc := c.open()
+		id, secret, hash, err := kc.CreateAccessKey()
+		if err != nil {
+			fail("failed generating access key: %v", err)
+		}
+		if err := kc.Add(id, hash); err != nil {
+			fail("failed adding access key to keychain %s: %v", kc.Name, err)
+		}
+		if err := kc.SetMetadata(id, parseMetadata(*metadata)); err != nil {
+			fail("failed setting metadata of access key %s in keychain %s: %v", id, kc.Name, err)
+		}
+		if err := kc.SetExpiry(id, parseExpiry(*expires)); err != nil {
+			fail("failed setting expiry of access key %s in keychain %s: %v", id, kc.Name, err)
+		}
+		save(kc)
+		fmt.Printf(createAccessKeyMessage, id, secret, kc.Name)
+
+	case "list":
+		c.parse(args, 0, "")
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tSTATUS\tEXPIRES\tMETADATA")
+		for _, e := range c.open().Entries() {
+			expires := "never"
+			if e.Expires != nil {
+				expires = e.Expires.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", e.ID, status(e), expires, formatMetadata(e.Metadata))
+		}
+		tw.Flush()
+
+	case "remove":
+		ids := c.parse(args, -1, "ID...")
+		kc := c.open()
+		for _, id := range ids {
+			if err := kc.Remove(id); err != nil {
+				fail("failed removing access key ID %s from keychain %s: %v", id, kc.Name, err)
+			}
+		}
+		save(kc)
+		fmt.Printf("Success! Removed %d key(s) from keychain %s\n", len(ids), kc.Name)
+
+	case "rotate":
+		id := c.parse(args, 1, "ID")[0]
+		kc := c.open()
+		secret, err := kc.Rotate(id)
+		if err != nil {
+			fail("failed rotating access key %s: %v", id, err)
+		}
+		save(kc)
+		fmt.Printf(createAccessKeyMessage, id, secret, kc.Name)
+
+	case "expire":
+		rest := c.parse(args, 2, "ID WHEN")
+		kc := c.open()
+		if err := kc.SetExpiry(rest[0], parseExpiry(rest[1])); err != nil {
+			fail("failed updating expiry of access key %s in keychain %s: %v", rest[0], kc.Name, err)
+		}
+		save(kc)
+		fmt.Printf("Success! Updated expiry of key %s in keychain %s\n", rest[0], kc.Name)
+
+	case "import":
+		replace := c.flags.Bool("replace", false, "replace keys that already exist in the keychain")
+		format := c.flags.String("format", "", "format of FILE: keychain, csv or jsonl (default: inferred from the file extension)")
+		skipInvalid := c.flags.Bool("skip-invalid", false, "import valid rows even if some rows are invalid")
+		file := c.parse(args, 1, "FILE")[0]
+		kc := c.open()
+		entries := readEntries(file, *format, *skipInvalid)
+		added, skipped := 0, 0
+		for _, e := range entries {
+			if _, ok := kc.Get(e.ID); ok && !*replace {
+				skipped++
+				continue
+			}
+			if err := kc.Put(e); err != nil {
+				fail("failed importing access key %s into keychain %s: %v", e.ID, kc.Name, err)
+			}
+			added++
+		}
+		save(kc)
+		fmt.Printf("Success! Imported %d key(s) into keychain %s (%d existing key(s) skipped)\n", added, kc.Name, skipped)
+
+	case "export":
+		force := c.flags.Bool("force", false, "overwrite FILE if it exists")
+		format := c.flags.String("format", "", "format of FILE: keychain, csv or jsonl (default: inferred from the file extension)")
+		file := c.parse(args, 1, "FILE")[0]
+		if _, err := os.Stat(file); err == nil && !*force {
+			fail("%s already exists; use -force to overwrite", file)
+		}
+		kc := c.open()
+		writeEntries(file, *format, kc.Entries())
+		fmt.Printf("Success! Exported %d key(s) to %s\n", kc.Len(), file)
+
+	case "apply":
+		dryRun := c.flags.Bool("dry-run", false, "print the changes that would be made, without making them")
+		file := c.parse(args, 1, "POLICY")[0]
+		policy, err := keychain.LoadPolicy(file)
+		if err != nil {
+			fail("%v", err)
+		}
+		kc := c.open()
+		var changes []keychain.Change
+		if *dryRun {
+			changes = kc.Plan(policy)
+		} else {
+			if changes, err = kc.Apply(policy); err != nil {
+				fail("failed applying policy: %v", err)
+			}
+			save(kc)
+		}
+		for _, ch := range changes {
+			if ch.Secret != "" {
+				fmt.Printf("%-8s %s  H2O_WAVE_ACCESS_KEY_SECRET=%s\n", ch.Action, ch.ID, ch.Secret)
+			} else {
+				fmt.Printf("%-8s %s\n", ch.Action, ch.ID)
+			}
+		}
+		if *dryRun {
+			fmt.Printf("%d change(s) would be made to keychain %s\n", len(changes), kc.Name)
+		} else {
+			fmt.Printf("Success! Made %d change(s) to keychain %s\n", len(changes), kc.Name)
+		}
+
+	case "diff":
+		file := c.parse(args, 1, "OTHER")[0]
+		other, err := keychain.LoadKeychain(file)
+		if err != nil {
+			fail("failed loading keychain: %v", err)
+		}
+		d := c.open().Diff(other)
+		printDiff(d)
+		if !d.Empty() {
+			os.Exit(1)
+		}
+
+	case "merge":
+		strategy := c.flags.String("strategy", "keep", "how to resolve keys in both keychains: keep (ours), overwrite (theirs), or mirror (theirs, removing keys missing from OTHER)")
+		dryRun := c.flags.Bool("dry-run", false, "print the changes that would be made, without making them")
+		file := c.parse(args, 1, "OTHER")[0]
+		var s keychain.MergeStrategy
+		switch *strategy {
+		case "keep":
+			s = keychain.MergeKeep
+		case "overwrite":
+			s = keychain.MergeOverwrite
+		case "mirror":
+			s = keychain.MergeMirror
+		default:
+			fail("unknown strategy: want keep, overwrite or mirror, got %s", *strategy)
+		}
+		other, err := keychain.LoadKeychain(file)
+		if err != nil {
+			fail("failed loading keychain: %v", err)
+		}
+		kc := c.open()
+		target := kc
+		if *dryRun {
+			if target, err = kc.Clone(); err != nil {
+				fail("failed copying keychain: %v", err)
+			}
+		}
+		d, err := target.Merge(other, s)
+		if err != nil {
+			fail("failed merging keychain: %v", err)
+		}
+		printDiff(d)
+		n := len(d.Added) + len(d.Removed) + len(d.Changed)
+		if *dryRun {
+			fmt.Printf("%d change(s) would be made to keychain %s\n", n, kc.Name)
+		} else {
+			save(kc)
+			fmt.Printf("Success! Made %d change(s) to keychain %s\n", n, kc.Name)
+		}
+
+	case "validate":
+		c.flags.Usage = func() {
+			fmt.Fprintln(os.Stderr, "Usage: waved keys validate [options] [FILE]")
+			c.flags.PrintDefaults()
+		}
+		c.flags.Parse(args)
+		file := c.keychain
+		switch c.flags.NArg() {
+		case 0:
+		case 1:
+			file = c.flags.Arg(0)
+		default:
+			c.flags.Usage()
+			os.Exit(2)
+		}
+		problems, err := keychain.Validate(file)
+		if err != nil {
+			fail("failed reading %s: %v", file, err)
+		}
+		for _, p := range problems {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file, p)
+		}
+		if len(problems) > 0 {
+			fail("%d problem(s) found in %s", len(problems), file)
+		}
+		fmt.Printf("OK: %s is valid\n", file)
+
+	case "loadtest":
+		var lt keychain.LoadTest
+		c.flags.IntVar(&lt.Keys, "keys", 100, "number of keys to create")
+		c.flags.IntVar(&lt.Cost, "cost", 0, "bcrypt cost of the keys (default 10)")
+		c.flags.DurationVar(&lt.CacheTTL, "cache-ttl", keychain.DefaultCacheTTL, "how long verifications are cached; 0 to disable caching")
+		c.flags.DurationVar(&lt.Duration, "duration", 10*time.Second, "how long to run")
+		c.flags.IntVar(&lt.Concurrency, "concurrency", runtime.GOMAXPROCS(0), "number of concurrent clients")
+		c.flags.Float64Var(&lt.Cached, "cached", 0.9, "share of authentications with a cached, valid secret")
+		c.flags.Float64Var(&lt.Uncached, "uncached", 0.09, "share of authentications with an uncached, valid secret")
+		c.flags.Float64Var(&lt.Bad, "bad", 0.01, "share of authentications with a wrong secret")
+		c.parse(args, 0, "")
+		stats, err := lt.Run()
+		if err != nil {
+			fail("load test failed: %v", err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "KIND\tCOUNT\tPER SEC\tP50\tP90\tP99\tMAX")
+		for _, s := range stats {
+			fmt.Fprintf(tw, "%s\t%d\t%.0f\t%v\t%v\t%v\t%v\n", s.Kind, s.Count, float64(s.Count)/lt.Duration.Seconds(), s.P50, s.P90, s.P99, s.Max)
+		}
+		tw.Flush()
+
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n%s", cmd, keysUsage)
+		os.Exit(2)
+	}
+}
+
+func formatOf(file, format string) string {
+	if len(format) == 0 {
+		switch strings.ToLower(filepath.Ext(file)) {
+		case ".csv":
+			return "csv"
+		case ".jsonl", ".ndjson":
+			return "jsonl"
+		}
+		return "keychain"
+	}
+	switch format {
+	case "keychain", "csv", "jsonl":
+		return format
+	}
+	fail("unknown format %q: want keychain, csv or jsonl", format)
+	return ""
+}
+
+func readEntries(file, format string, skipInvalid bool) []keychain.Entry {
+	format = formatOf(file, format)
+	if format == "keychain" {
+		entries, err := (&keychain.FileStore{Name: file}).Load()
+		if err != nil {
+			fail("failed loading %s: %v", file, err)
+		}
+		return entries
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		fail("failed opening %s: %v", file, err)
+	}
+	defer f.Close()
+
+	var entries []keychain.Entry
+	if format == "csv" {
+		entries, err = keychain.ImportCSV(f)
+	} else {
+		entries, err = keychain.ImportJSONL(f)
+	}
+	if err != nil {
+		var ie keychain.ImportError
+		if !errors.As(err, &ie) {
+			fail("failed reading %s: %v", file, err)
+		}
+		for _, le := range ie {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file, le)
+		}
+		if !skipInvalid {
+			fail("%d invalid row(s) in %s; nothing imported (use -skip-invalid to import the valid rows)", len(ie), file)
+		}
+	}
+	return entries
+}
+
+func writeEntries(file, format string, entries []keychain.Entry) {
+	format = formatOf(file, format)
+	if format == "keychain" {
+		if err := (&keychain.FileStore{Name: file}).Save(entries); err != nil {
+			fail("failed writing %s: %v", file, err)
+		}
+		return
+	}
+
+	var b bytes.Buffer
+	var err error
+	if format == "csv" {
+		err = keychain.ExportCSV(&b, entries)
+	} else {
+		err = keychain.ExportJSONL(&b, entries)
+	}
+	if err != nil {
+		fail("failed exporting keys: %v", err)
+	}
+	if err := os.WriteFile(file, b.Bytes(), 0600); err != nil {
+		fail("failed writing %s: %v", file, err)
+	}
+}
@@ -39,7 +39,9 @@ import (
 	"github.com/h2oai/goconfig"
 	_ "github.com/h2oai/goconfig/env"
 	"github.com/h2oai/wave"
+	"github.com/h2oai/wave/pkg/blob"
 	"github.com/h2oai/wave/pkg/keychain"
+	"github.com/h2oai/wave/pkg/scan"
 )
 
 var (
@@ -67,6 +69,15 @@ Your key was also added to the keychain located at
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		runKeys(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		runReplay(os.Args[2:])
+		return
+	}
+
 	conf := wave.Conf{}
 	serverConf := wave.ServerConf{}
 	authConf := wave.AuthConf{}
@@ -113,10 +124,68 @@ func main() {
 		return
 	}
 
-	kc, err := keychain.LoadKeychain(conf.AccessKeyFile)
+	var mirror *keychain.MirrorStore
+	if len(conf.AccessKeyMirror) > 0 {
+		mirror = &keychain.MirrorStore{
+			Primary:   keychain.OpenStore(conf.AccessKeyFile),
+			Secondary: keychain.OpenStore(conf.AccessKeyMirror),
+			OnError:   func(err error) { log.Println("#", "warning:", err) },
+		}
+	}
+
+	if conf.CheckAccessKeyMirror {
+		if mirror == nil {
+			panic("-check-access-keychain-mirror requires -access-keychain-mirror")
+		}
+		diff, err := keychain.Parity(mirror.Primary, mirror.Secondary)
+		if err != nil {
+			panic(err)
+		}
+		for _, id := range diff {
+			fmt.Println(id)
+		}
+		if len(diff) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	var kc *keychain.Keychain
+	if conf.AccessKeyIndex {
+		if mirror != nil {
+			panic("-access-keychain-index cannot be combined with -access-keychain-mirror")
+		}
+		kc, err = keychain.OpenIndexed(conf.AccessKeyFile)
+	} else if mirror != nil {
+		if err := mirror.Sync(); err != nil {
+			panic(fmt.Errorf("failed mirroring keychain: %v", err))
+		}
+		kc, err = keychain.Open(mirror)
+	} else {
+		kc, err = keychain.LoadKeychain(conf.AccessKeyFile)
+	}
 	if err != nil {
 		panic(fmt.Errorf("failed loading keychain: %v", err))
 	}
+	kc.SetReadOnly(conf.AccessKeyReadOnly)
+
+	saveDelay, err := time.ParseDuration(conf.AccessKeySaveDelay)
+	if err != nil {
+		panic(fmt.Errorf("invalid access keychain save delay: %v", err))
+	}
+
+	cacheTTL, err := time.ParseDuration(conf.AccessKeyCacheTTL)
+	if err != nil {
+		panic(fmt.Errorf("invalid access key cache TTL: %v", err))
+	}
+	kc.SetCacheTTL(cacheTTL)
+	if conf.AccessKeyCacheMinSize < 1 || conf.AccessKeyCacheMaxSize < conf.AccessKeyCacheMinSize {
+		panic("access key cache sizes must be positive, with the minimum no more than the maximum")
+	}
+	kc.SetCacheSize(conf.AccessKeyCacheMinSize, conf.AccessKeyCacheMaxSize)
+	if len(conf.SigningKey) > 0 {
+		kc.SetSigningKey([]byte(conf.SigningKey))
+	}
 
 	if conf.ListAccessKeys {
 		keys := kc.IDs()
@@ -128,8 +197,8 @@ func main() {
 	}
 
 	if len(conf.RemoveAccessKeyID) > 0 {
-		if ok := kc.Remove(conf.RemoveAccessKeyID); !ok {
-			fmt.Printf("error: access key ID %s not found in keychain %s\n", conf.RemoveAccessKeyID, kc.Name)
+		if err := kc.Remove(conf.RemoveAccessKeyID); err != nil {
+			fmt.Printf("error: failed removing access key ID %s from keychain %s: %v\n", conf.RemoveAccessKeyID, kc.Name, err)
 			os.Exit(1)
 		}
 
@@ -141,11 +210,13 @@ func main() {
 	}
 
 	if conf.CreateAccessKey {
-		id, secret, hash, err := keychain.CreateAccessKey()
+		id, secret, hash, err := kc.CreateAccessKey()
 		if err != nil {
 			panic(fmt.Errorf("failed generating access key: %v", err))
 		}
-		kc.Add(id, hash)
+		if err := kc.Add(id, hash); err != nil {
+			panic(fmt.Errorf("failed adding access key: %v", err))
+		}
 		if err := kc.Save(); err != nil {
 			panic(fmt.Errorf("failed writing keychain: %v", err))
 		}
@@ -161,7 +232,178 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
-		kc.Add(conf.AccessKeyID, hash)
+		kc.AddTransient(conf.AccessKeyID, hash)
+	}
+
+	if len(conf.AdminKeychain) > 0 {
+		if serverConf.AdminKeychain, err = keychain.LoadKeychain(conf.AdminKeychain); err != nil {
+			panic(fmt.Errorf("failed loading admin keychain: %v", err))
+		}
+		if serverConf.AdminKeychain.Len() == 0 {
+			log.Println("#", "warning: admin keychain is empty; create admin keys with -create-access-key -access-keychain", conf.AdminKeychain)
+		}
+	}
+	if conf.AdminKeyQuota < 0 {
+		panic(fmt.Errorf("admin key quota must not be negative, got %d", conf.AdminKeyQuota))
+	}
+	serverConf.AdminKeyQuota = conf.AdminKeyQuota
+
+	if len(conf.FederationKeychain) > 0 {
+		if serverConf.FederationKeychain, err = keychain.LoadKeychain(conf.FederationKeychain); err != nil {
+			panic(fmt.Errorf("failed loading federation keychain: %v", err))
+		}
+	}
+
+	if len(conf.FederationURL) > 0 {
+		ttl, err := time.ParseDuration(conf.FederationCacheTTL)
+		if err != nil {
+			panic(err)
+		}
+		grace, err := time.ParseDuration(conf.FederationGrace)
+		if err != nil {
+			panic(err)
+		}
+		f, err := keychain.NewFederation(conf.FederationURL, conf.FederationAccessKeyID, conf.FederationAccessKeySecret, ttl, grace)
+		if err != nil {
+			panic(err)
+		}
+		kc.Federate(f)
+	}
+
+	if len(conf.LeaderLease) > 0 {
+		if conf.AccessKeyReadOnly {
+			panic("-leader-lease cannot be combined with -access-keychain-read-only")
+		}
+		if serverConf.LeaderLeaseTTL, err = time.ParseDuration(conf.LeaderLeaseTTL); err != nil {
+			panic(err)
+		}
+		lease, err := keychain.NewFileLease(conf.LeaderLease, serverConf.LeaderLeaseTTL)
+		if err != nil {
+			panic(err)
+		}
+		serverConf.Elector = keychain.NewElector(kc, lease)
+	}
+
+	if len(conf.ReplicaPeers) > 0 {
+		if serverConf.AdminKeychain == nil {
+			panic("replication requires -admin-keychain")
+		}
+		if serverConf.ReplicaSyncInterval, err = time.ParseDuration(conf.ReplicaSyncInterval); err != nil {
+			panic(err)
+		}
+		peers := strings.Split(conf.ReplicaPeers, ",")
+		for i, peer := range peers {
+			peers[i] = strings.TrimSpace(peer)
+		}
+		if serverConf.Replicator, err = keychain.NewReplicator(kc, peers, conf.ReplicaAccessKeyID, conf.ReplicaAccessKeySecret); err != nil {
+			panic(err)
+		}
+	}
+
+	if len(conf.TenantsFile) > 0 {
+		if serverConf.Tenants, err = keychain.LoadTenants(conf.TenantsFile); err != nil {
+			panic(fmt.Errorf("failed loading tenants: %v", err))
+		}
+		for _, t := range serverConf.Tenants {
+			t.Keychain.SetCacheTTL(cacheTTL)
+			t.Keychain.SetCacheSize(conf.AccessKeyCacheMinSize, conf.AccessKeyCacheMaxSize)
+			kc.Mount(t)
+		}
+	}
+
+	if len(conf.VerifyCacheRedisURL) > 0 {
+		ttl, err := time.ParseDuration(conf.VerifyCacheTTL)
+		if err != nil {
+			panic(err)
+		}
+		rc, err := keychain.NewRedisCache(conf.VerifyCacheRedisURL, ttl)
+		if err != nil {
+			panic(err)
+		}
+		kc.SetSharedCache(rc)
+	}
+
+	if len(conf.AccessKeyTrustedProxies) > 0 {
+		proxies, err := keychain.ParseProxies(conf.AccessKeyTrustedProxies)
+		if err != nil {
+			panic(err)
+		}
+		kc.SetTrustedProxies(proxies)
+	}
+
+	if len(conf.AccessKeyHookURL) > 0 {
+		kc.AddHook(keychain.NewWebhook(conf.AccessKeyHookURL, time.Second))
+	}
+
+	if conf.AuditLogSize > 0 {
+		serverConf.AuditLog = keychain.NewAuditLog(conf.AuditLogSize, kc)
+		kc.AddHook(serverConf.AuditLog)
+	}
+
+	if len(conf.RouteAuthzURL) > 0 {
+		ttl, err := time.ParseDuration(conf.RouteAuthzTTL)
+		if err != nil {
+			panic(fmt.Errorf("invalid route authorization TTL: %v", err))
+		}
+		if serverConf.RouteAuthorizer, err = wave.NewRouteWebhook(conf.RouteAuthzURL, 5*time.Second, ttl); err != nil {
+			panic(err)
+		}
+	}
+
+	if len(conf.FileStore) > 0 {
+		if serverConf.FileStore, err = blob.Open(conf.FileStore); err != nil {
+			panic(fmt.Errorf("failed opening file store: %v", err))
+		}
+	}
+
+	if len(conf.UploadScanner) > 0 {
+		if serverConf.UploadScanner, err = scan.Open(conf.UploadScanner, 30*time.Second); err != nil {
+			panic(err)
+		}
+	}
+
+	if serverConf.MaxUploadSize, err = parseReadSize("max upload size", conf.MaxUploadSize); err != nil {
+		panic(err)
+	}
+
+	if serverConf.UploadQuota, err = parseReadSize("upload quota", conf.UploadQuota); err != nil {
+		panic(err)
+	}
+	serverConf.DedupeUploads = conf.DedupeUploads
+	if serverConf.ContentPolicy, err = wave.ParseContentPolicy(conf.UploadAllowTypes, conf.UploadDenyTypes, conf.DownloadCSP, conf.DownloadAttachments); err != nil {
+		panic(err)
+	}
+	serverConf.ImageTransforms = conf.ImageTransforms
+	if serverConf.ImageCacheSize, err = parseReadSize("image cache size", conf.ImageCacheSize); err != nil {
+		panic(err)
+	}
+
+	if serverConf.MaxSignedURLTTL, err = time.ParseDuration(conf.MaxSignedURLTTL); err != nil {
+		panic(fmt.Errorf("invalid max signed URL TTL: %v", err))
+	}
+
+	orphanTTL, err := time.ParseDuration(conf.FileOrphanTTL)
+	if err != nil {
+		panic(fmt.Errorf("invalid file orphan TTL: %v", err))
+	}
+	if serverConf.FileRetention, err = wave.ParseRetentionPolicy(conf.FileRetention, orphanTTL); err != nil {
+		panic(err)
+	}
+	if serverConf.FileGCInterval, err = time.ParseDuration(conf.FileGCInterval); err != nil || serverConf.FileGCInterval <= 0 {
+		panic(fmt.Errorf("invalid file GC interval: %s", conf.FileGCInterval))
+	}
+	serverConf.FileGCDryRun = conf.FileGCDryRun
+
+	if len(conf.FileAuditLog) > 0 {
+		if serverConf.FileAudit, err = wave.OpenFileAudit(conf.FileAuditLog); err != nil {
+			panic(fmt.Errorf("failed opening file audit log: %v", err))
+		}
+	}
+
+	if len(conf.EventJournal) > 0 {
+		if serverConf.Journal, err = wave.OpenJournal(conf.EventJournal); err != nil {
+			panic(fmt.Errorf("failed opening event journal: %v", err))
+		}
 	}
 
 	if len(conf.HttpHeadersFile) > 0 {
@@ -201,6 +443,81 @@ func main() {
 		panic(err)
 	}
 
+	if serverConf.ReplayLogSize, err = parseReadSize("replay log size", conf.ReplayLogSize); err != nil {
+		panic(err)
+	}
+
+	if serverConf.ReplayLogAge, err = time.ParseDuration(conf.ReplayLogAge); err != nil {
+		panic(err)
+	}
+
+	if conf.ClientQueueSize < 1 {
+		panic(fmt.Errorf("client queue size must be at least 1, got %d", conf.ClientQueueSize))
+	}
+	serverConf.ClientQueueSize = conf.ClientQueueSize
+	if serverConf.ClientQueueOverflow, err = wave.ParseOverflowPolicy(conf.ClientQueueOverflow); err != nil {
+		panic(err)
+	}
+
+	if serverConf.SocketLimits.MaxMessageSize, err = parseReadSize("max socket message size", conf.MaxSocketMessageSize); err != nil {
+		panic(err)
+	}
+	if conf.MaxSocketMessageRate < 0 {
+		panic(fmt.Errorf("max socket message rate must not be negative, got %d", conf.MaxSocketMessageRate))
+	}
+	serverConf.SocketLimits.MaxMessageRate = conf.MaxSocketMessageRate
+	if serverConf.SocketLimits.MaxBandwidth, err = parseReadSize("max socket bandwidth", conf.MaxSocketBandwidth); err != nil {
+		panic(err)
+	}
+
+	if conf.AppMaxPatchRate < 0 || conf.AppMaxPages < 0 || conf.AppMaxBufferSize < 0 {
+		panic(fmt.Errorf("app limits must not be negative, got patch rate %d, pages %d, buffer size %d", conf.AppMaxPatchRate, conf.AppMaxPages, conf.AppMaxBufferSize))
+	}
+	serverConf.AppLimits.MaxPatchRate = conf.AppMaxPatchRate
+	serverConf.AppLimits.MaxPages = conf.AppMaxPages
+	serverConf.AppLimits.MaxBufferSize = conf.AppMaxBufferSize
+	if serverConf.AppLimits.MaxStorage, err = parseReadSize("app max storage", conf.AppMaxStorage); err != nil {
+		panic(err)
+	}
+	switch conf.AppLimitMode {
+	case "reject":
+	case "warn":
+		serverConf.AppLimits.Warn = true
+	default:
+		panic(fmt.Errorf("invalid app limit mode %q: want reject or warn", conf.AppLimitMode))
+	}
+
+	if conf.SocketCompression < 0 || conf.SocketCompression > 9 {
+		panic(fmt.Errorf("socket compression level must be from 0 to 9, got %d", conf.SocketCompression))
+	}
+	serverConf.SocketCompression = conf.SocketCompression
+	serverConf.SocketMsgpack = conf.SocketMsgpack
+	if serverConf.CompressThreshold, err = parseReadSize("compress threshold", conf.CompressThreshold); err != nil {
+		panic(err)
+	}
+
+	serverConf.Cluster = conf.Cluster
+	serverConf.ClusterChannel = conf.ClusterChannel
+
+	if len(conf.KafkaBrokers) > 0 {
+		for _, broker := range strings.Split(conf.KafkaBrokers, ",") {
+			serverConf.KafkaBrokers = append(serverConf.KafkaBrokers, strings.TrimSpace(broker))
+		}
+		if serverConf.KafkaConsume, err = parsePairs("Kafka consume", conf.KafkaConsume); err != nil {
+			panic(err)
+		}
+		if serverConf.KafkaProduce, err = parsePairs("Kafka produce", conf.KafkaProduce); err != nil {
+			panic(err)
+		}
+	} else if len(conf.KafkaConsume) > 0 || len(conf.KafkaProduce) > 0 {
+		panic("mirroring routes to Kafka requires -kafka-brokers")
+	}
+
+	serverConf.MQTTListen = conf.MQTTListen
+	if serverConf.MQTTRoutes, err = parsePairs("MQTT route", conf.MQTTRoutes); err != nil {
+		panic(err)
+	}
+
 	if conf.AllowedOrigins != "" {
 		origins := strings.Split(conf.AllowedOrigins, ",")
 		allowedOrigins := make(map[string]bool, len(origins))
@@ -219,18 +536,131 @@ func main() {
 	serverConf.PublicDirs = splitDirs(conf.PublicDirs)
 	serverConf.PrivateDirs = splitDirs(conf.PrivateDirs)
 	serverConf.Init = conf.Init
+	if len(conf.AOF) > 0 {
+		if conf.NoStore {
+			panic("-aof requires storage, but -no-store is set")
+		}
+		if serverConf.AOF, err = wave.OpenAOF(conf.AOF); err != nil {
+			panic(fmt.Errorf("failed opening AOF file: %v", err))
+		}
+		if serverConf.AOFCompactInterval, err = time.ParseDuration(conf.AOFCompactInterval); err != nil || serverConf.AOFCompactInterval <= 0 {
+			panic(fmt.Errorf("invalid AOF compact interval %q: want a positive duration, e.g. 1h", conf.AOFCompactInterval))
+		}
+	}
+	if conf.SnapshotLimit < 0 {
+		panic(fmt.Errorf("snapshot limit must not be negative, got %d", conf.SnapshotLimit))
+	}
+	serverConf.SnapshotLimit = conf.SnapshotLimit
+	if conf.BufferHistory < 0 {
+		panic(fmt.Errorf("buffer history must not be negative, got %d", conf.BufferHistory))
+	}
+	serverConf.BufferHistory = conf.BufferHistory
+	serverConf.ExportChrome = conf.ExportChrome
+	if serverConf.ExportTimeout, err = time.ParseDuration(conf.ExportTimeout); err != nil || serverConf.ExportTimeout <= 0 {
+		panic(fmt.Errorf("invalid export timeout %q: want a positive duration, e.g. 30s", conf.ExportTimeout))
+	}
+	if len(conf.BackupStore) > 0 {
+		if serverConf.BackupStore, err = blob.Open(conf.BackupStore); err != nil {
+			panic(fmt.Errorf("failed opening backup store: %v", err))
+		}
+		for _, route := range strings.Split(conf.BackupRoutes, ",") {
+			if route = strings.TrimSpace(route); route != "" {
+				serverConf.BackupRoutes = append(serverConf.BackupRoutes, route)
+			}
+		}
+		if serverConf.BackupInterval, err = time.ParseDuration(conf.BackupInterval); err != nil || serverConf.BackupInterval <= 0 {
+			panic(fmt.Errorf("invalid backup interval %q: want a positive duration, e.g. 1h", conf.BackupInterval))
+		}
+		if serverConf.BackupRetention, err = time.ParseDuration(conf.BackupRetention); err != nil || serverConf.BackupRetention < 0 {
+			panic(fmt.Errorf("invalid backup retention %q: want a duration, e.g. 720h, or 0", conf.BackupRetention))
+		}
+		if serverConf.BackupRetention > 0 && serverConf.BackupRetention <= serverConf.BackupInterval {
+			panic(fmt.Errorf("backup retention %s must be longer than the backup interval %s", conf.BackupRetention, conf.BackupInterval))
+		}
+	}
+	if len(conf.PageStore) > 0 {
+		if conf.NoStore {
+			panic("-page-store requires storage, but -no-store is set")
+		}
+		if serverConf.PageStore, err = wave.OpenPageStore(conf.PageStore); err != nil {
+			panic(fmt.Errorf("failed opening page store: %v", err))
+		}
+		if serverConf.PageSyncInterval, err = time.ParseDuration(conf.PageSyncInterval); err != nil || serverConf.PageSyncInterval <= 0 {
+			panic(fmt.Errorf("invalid page sync interval %q: want a positive duration, e.g. 1s", conf.PageSyncInterval))
+		}
+	}
 	serverConf.CertFile = conf.CertFile
 	serverConf.KeyFile = conf.KeyFile
 	serverConf.SkipCertVerification = conf.SkipCertVerification
 	serverConf.Debug = conf.Debug
 	serverConf.Editable = conf.Editable
+	serverConf.ValidatePatches = conf.ValidatePatches
 	serverConf.Proxy = conf.Proxy
 	serverConf.NoStore = conf.NoStore
 	serverConf.NoLog = conf.NoLog
 	serverConf.Keychain = kc
 	serverConf.KeepAppLive = conf.KeepAppLive
+	if len(conf.Supervise) > 0 {
+		if serverConf.Supervisor, err = wave.LoadSupervisorConf(conf.Supervise); err != nil {
+			panic(err)
+		}
+	}
+	if len(conf.AppSecrets) > 0 {
+		if serverConf.AppSecrets, err = wave.LoadAppSecretsConf(conf.AppSecrets); err != nil {
+			panic(err)
+		}
+		for _, g := range serverConf.AppSecrets.Apps {
+			if g.Process != "" && !supervises(serverConf.Supervisor, g.Process) {
+				panic(fmt.Errorf("app secrets file %s: process %q is not run by the server; see -supervise", conf.AppSecrets, g.Process))
+			}
+			if g.Keychain != "" && conf.AppKeychainDir == "" {
+				panic(fmt.Errorf("app secrets file %s: keychain %q needs app keychains; see -app-keychain-dir", conf.AppSecrets, g.Keychain))
+			}
+		}
+	}
+	if serverConf.AppHealthInterval, err = time.ParseDuration(conf.AppHealthInterval); err != nil || serverConf.AppHealthInterval < 0 {
+		panic(fmt.Errorf("invalid app health interval %q: want a duration, e.g. 10s, or 0s", conf.AppHealthInterval))
+	}
+	if serverConf.AppHealthInterval > 0 {
+		if conf.KeepAppLive {
+			panic("-app-health-interval unregisters unresponsive apps, but -keep-app-live is set")
+		}
+		if serverConf.AppHealthTimeout, err = time.ParseDuration(conf.AppHealthTimeout); err != nil || serverConf.AppHealthTimeout <= 0 {
+			panic(fmt.Errorf("invalid app health timeout %q: want a positive duration, e.g. 5s", conf.AppHealthTimeout))
+		}
+		if conf.AppHealthPath != "" && !strings.HasPrefix(conf.AppHealthPath, "/") {
+			panic(fmt.Errorf("invalid app health path %q: want a path, e.g. /healthz", conf.AppHealthPath))
+		}
+		serverConf.AppHealthPath = conf.AppHealthPath
+		if conf.AppHealthFailures <= 0 {
+			panic(fmt.Errorf("app health failures must be positive, got %d", conf.AppHealthFailures))
+		}
+		serverConf.AppHealthFailures = conf.AppHealthFailures
+		if serverConf.AppHealthForget, err = time.ParseDuration(conf.AppHealthForget); err != nil || serverConf.AppHealthForget < 0 {
+			panic(fmt.Errorf("invalid app health forget %q: want a duration, e.g. 24h, or 0s", conf.AppHealthForget))
+		}
+	}
+	if conf.AppEventQueue < 0 {
+		panic(fmt.Errorf("app event queue must not be negative, got %d", conf.AppEventQueue))
+	}
+	serverConf.AppEventQueue = conf.AppEventQueue
+	if serverConf.AppEventQueue > 0 {
+		if serverConf.AppEventTTL, err = time.ParseDuration(conf.AppEventTTL); err != nil || serverConf.AppEventTTL <= 0 {
+			panic(fmt.Errorf("invalid app event TTL %q: want a positive duration, e.g. 1m", conf.AppEventTTL))
+		}
+	}
+	serverConf.AdminGRPCListen = conf.AdminGRPCListen
+	serverConf.AdminGRPCInsecure = conf.AdminGRPCInsecure
+	if conf.AdminGRPCListen != "" && (conf.CertFile == "" || conf.KeyFile == "") && !conf.AdminGRPCInsecure {
+		panic(fmt.Errorf("gRPC key management requires TLS: set -tls-cert-file and -tls-key-file, or pass -admin-grpc-insecure"))
+	}
+	if len(conf.AppKeychainDir) > 0 {
+		serverConf.AppKeychainDir, _ = filepath.Abs(conf.AppKeychainDir)
+	}
+	serverConf.AppScope = conf.AppScope
 
-	authConf.Scopes = strings.Split(conf.RawAuthScopes, ",")
+	var oidcConf wave.OIDCProviderConf
+	oidcConf.Scopes = strings.Split(conf.RawAuthScopes, ",")
 	if len(conf.RawAuthURLParams) > 0 {
 		rawAuthURLPairs := strings.Split(conf.RawAuthURLParams, ",")
 		for _, rawPair := range rawAuthURLPairs {
@@ -245,7 +675,7 @@ func main() {
 			if len(v) == 0 {
 				panic(fmt.Errorf("empty OIDC authorization url parameter value: %v", rawPair))
 			}
-			authConf.URLParameters = append(authConf.URLParameters, kv)
+			oidcConf.URLParameters = append(oidcConf.URLParameters, kv)
 		}
 	}
 
@@ -259,30 +689,140 @@ func main() {
 	if serverConf.PingInterval, err = time.ParseDuration(conf.PingInterval); err != nil {
 		panic(err)
 	}
+	if serverConf.PongTimeout, err = time.ParseDuration(conf.PongTimeout); err != nil {
+		panic(err)
+	}
+	if serverConf.IdleTimeout, err = time.ParseDuration(conf.IdleTimeout); err != nil {
+		panic(err)
+	}
+	if serverConf.CoalesceWindow, err = time.ParseDuration(conf.CoalesceWindow); err != nil {
+		panic(err)
+	}
+	if serverConf.DrainTimeout, err = time.ParseDuration(conf.DrainTimeout); err != nil {
+		panic(err)
+	}
+	if authConf.SelfServiceKeyTTL, err = time.ParseDuration(conf.SelfServiceKeyTTL); err != nil {
+		panic(err)
+	}
+	if authConf.RefreshInterval, err = time.ParseDuration(conf.TokenRefreshInterval); err != nil {
+		panic(err)
+	}
+	authConf.SelfServiceKeyLimit = conf.SelfServiceKeyLimit
+	for _, s := range strings.Split(conf.SelfServiceKeyScopes, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			authConf.SelfServiceScopes = append(authConf.SelfServiceScopes, s)
+		}
+	}
 
 	requiredEnvOIDC := map[string]string{
-		"oidc-client-id":     conf.ClientID,
-		"oidc-client-secret": conf.ClientSecret,
-		"oidc-provider-url":  conf.ProviderUrl,
-		"oidc-redirect-url":  conf.RedirectUrl,
+		"oidc-client-id":    conf.ClientID,
+		"oidc-provider-url": conf.ProviderUrl,
+		"oidc-redirect-url": conf.RedirectUrl,
+	}
+	if !conf.PKCE {
+		requiredEnvOIDC["oidc-client-secret"] = conf.ClientSecret
 	}
 	emptyRequiredOIDCParams := getEmptyOIDCValues(requiredEnvOIDC)
 	emptyRequiredOIDCParamsCount := len(emptyRequiredOIDCParams)
 	if emptyRequiredOIDCParamsCount == 0 {
-		authConf.ClientID = conf.ClientID
-		authConf.ClientSecret = conf.ClientSecret
-		authConf.ProviderURL = conf.ProviderUrl
-		authConf.RedirectURL = conf.RedirectUrl
-		authConf.EndSessionURL = conf.EndSessionUrl
-		authConf.PostLogoutRedirectURL = conf.PostLogoutRedirectUrl
-		authConf.SkipLogin = conf.SkipLogin
-		serverConf.Auth = &authConf
+		oidcConf.Name = "oidc"
+		oidcConf.Label = "OpenID Connect"
+		oidcConf.ClientID = conf.ClientID
+		oidcConf.ClientSecret = conf.ClientSecret
+		oidcConf.ProviderURL = conf.ProviderUrl
+		oidcConf.RedirectURL = conf.RedirectUrl
+		oidcConf.EndSessionURL = conf.EndSessionUrl
+		oidcConf.PostLogoutRedirectURL = conf.PostLogoutRedirectUrl
+		oidcConf.PKCE = conf.PKCE
+		oidcConf.ResponseMode = conf.ResponseMode
+		authConf.Providers = append(authConf.Providers, oidcConf)
 	}
 	if emptyRequiredOIDCParamsCount > 0 && emptyRequiredOIDCParamsCount != len(requiredEnvOIDC) {
 		log.Println("#", "warning: the following OIDC required params were not set: ", emptyRequiredOIDCParams)
 	}
+	if len(conf.OIDCProvidersFile) > 0 {
+		providers, err := wave.LoadOIDCProviders(conf.OIDCProvidersFile)
+		if err != nil {
+			panic(fmt.Errorf("failed loading OIDC providers: %v", err))
+		}
+		authConf.Providers = append(authConf.Providers, providers...)
+	}
+	if len(conf.SAMLIdPMetadata) > 0 {
+		if len(conf.SAMLACSURL) == 0 {
+			panic("-saml-acs-url is required with -saml-idp-metadata")
+		}
+		authConf.SAML = &wave.SAMLConf{
+			IdPMetadata:       conf.SAMLIdPMetadata,
+			ACSURL:            conf.SAMLACSURL,
+			EntityID:          conf.SAMLEntityID,
+			UsernameAttribute: conf.SAMLUsernameAttribute,
+			GroupsAttribute:   conf.SAMLGroupsAttribute,
+		}
+	}
+	if len(authConf.Providers) > 0 || authConf.SAML != nil {
+		if len(conf.OIDCPolicyFile) > 0 {
+			if authConf.Policy, err = wave.LoadAuthPolicy(conf.OIDCPolicyFile); err != nil {
+				panic(fmt.Errorf("failed loading OIDC policy: %v", err))
+			}
+		}
+		if len(conf.SessionStore) > 0 {
+			if authConf.Sessions, err = wave.OpenSessionStore(conf.SessionStore); err != nil {
+				panic(fmt.Errorf("failed opening session store: %v", err))
+			}
+		}
+		if len(conf.PublicRoutes) > 0 {
+			authConf.Public = strings.Split(conf.PublicRoutes, ",")
+		}
+		authConf.MaxSessions = conf.MaxSessionsPerUser
+		if len(conf.StepUpOperations) > 0 {
+			stepUp := wave.StepUpConf{Operations: strings.Split(conf.StepUpOperations, ",")}
+			if stepUp.MaxAge, err = time.ParseDuration(conf.StepUpMaxAge); err != nil {
+				panic(fmt.Errorf("failed parsing step-up max age: %v", err))
+			}
+			if len(conf.StepUpACR) > 0 {
+				stepUp.ACR = strings.Split(conf.StepUpACR, ",")
+			}
+			if len(conf.StepUpAMR) > 0 {
+				stepUp.AMR = strings.Split(conf.StepUpAMR, ",")
+			}
+			authConf.StepUp = &stepUp
+		}
+		authConf.SkipLogin = conf.SkipLogin
+		serverConf.Auth = &authConf
+	}
+
+	switch conf.AccessKeyCheckHashes {
+	case "load":
+		checkHashes(kc)
+	case "background":
+		go checkHashes(kc)
+	case "off":
+	default:
+		panic(fmt.Errorf("invalid -access-keychain-check-hashes: want load, background or off, got %q", conf.AccessKeyCheckHashes))
+	}
 
-	wave.Run(serverConf)
+	if saveDelay > 0 {
+		kc.CoalesceSaves(saveDelay, func(err error) { log.Println("#", "warning: failed saving keychain:", err) })
+	}
+
+	wave.Run(serverConf) // returns on SIGINT or SIGTERM, once drained
+
+	if saveDelay > 0 {
+		if err := kc.Flush(); err != nil {
+			log.Println("#", "warning: failed saving keychain:", err)
+		}
+	}
+}
+
+// checkHashes logs keys with malformed hashes, which never verify.
+func checkHashes(kc *keychain.Keychain) {
+	problems := kc.CheckHashes()
+	for _, p := range problems {
+		log.Println("#", "warning:", p)
+	}
+	if len(problems) > 0 {
+		log.Println("#", "warning:", len(problems), "access key(s) in keychain", kc.Name, "will never verify; rotate or remove them")
+	}
 }
 
 func getEmptyOIDCValues(requiredEnvOIDC map[string]string) []string {
@@ -295,6 +835,19 @@ func getEmptyOIDCValues(requiredEnvOIDC map[string]string) []string {
 	return emptyRequiredOIDCParams
 }
 
+// supervises reports whether the server runs the app process named name.
+func supervises(conf *wave.SupervisorConf, name string) bool {
+	if conf == nil {
+		return false
+	}
+	for _, app := range conf.Apps {
+		if app.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 func splitDirs(dirs string) []string {
 	if len(dirs) == 0 {
 		return nil
@@ -302,6 +855,22 @@ func splitDirs(dirs string) []string {
 	return strings.Split(dirs, string(os.PathListSeparator))
 }
 
+// parsePairs parses comma-separated key=value pairs, e.g. "a=1,b=2".
+func parsePairs(label, value string) (map[string]string, error) {
+	pairs := make(map[string]string)
+	if len(value) == 0 {
+		return pairs, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || len(k) == 0 || len(v) == 0 {
+			return nil, fmt.Errorf("bad %s pair: want key=value, got %q", label, pair)
+		}
+		pairs[k] = v
+	}
+	return pairs, nil
+}
+
 func parseReadSize(label, value string) (int64, error) {
 	n, err := wave.ParseBytes(value)
 
@@ -0,0 +1,322 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/h2oai/wave"
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+const promptHelp = `Commands:
+  /TEXT, search TEXT  show keys whose ID or metadata contain TEXT ("/" alone clears the filter)
+  show KEY            inspect a key
+  rotate KEY          replace the secret of a key
+  revoke KEY          disable a key
+  enable KEY          re-enable a key
+  delete KEY          remove a key
+  refresh             reload keys from the server
+  help                show this help
+  quit                exit
+
+KEY is either an ID, or # followed by a row number from the list, e.g. #3.
+`
+
+// adminClient talks to the key management API served at _admin/.
+type adminClient struct {
+	url    string
+	id     string
+	secret string
+	client *http.Client
+}
+
+func (c *adminClient) do(method, path string, body, v any) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.url+path, r)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.id, c.secret)
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", method, path, res.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (c *adminClient) list() ([]keychain.Entry, error) {
+	var entries []keychain.Entry
+	err := c.do(http.MethodGet, "keys", nil, &entries)
+	return entries, err
+}
+
+func (c *adminClient) disable(id string, disabled bool) error {
+	return c.do(http.MethodPatch, "keys/"+id, wave.AccessKeyRequest{Disabled: &disabled}, nil)
+}
+
+func (c *adminClient) rotate(id string) (wave.AccessKeyResponse, error) {
+	var key wave.AccessKeyResponse
+	err := c.do(http.MethodPost, "keys/"+id+"/rotate", nil, &key)
+	return key, err
+}
+
+func (c *adminClient) remove(id string) error {
+	return c.do(http.MethodDelete, "keys/"+id, nil, nil)
+}
+
+// keyPrompt is a line-oriented prompt over the key management API, usable over plain SSH sessions.
+// It lists keys, and reads one command per line.
+type keyPrompt struct {
+	client  *adminClient
+	in      *bufio.Scanner
+	out     io.Writer
+	clear   bool // clear the screen before redrawing?
+	entries []keychain.Entry
+	visible []keychain.Entry
+	filter  string
+	status  string
+}
+
+func runPrompt(args []string) {
+	flags := flag.NewFlagSet("keys prompt", flag.ExitOnError)
+	address := flags.String("address", "http://localhost:10101", "Wave server address")
+	baseURL := flags.String("base-url", "/", "the base URL (path prefix) of the Wave server")
+	id := flags.String("access-key-id", os.Getenv("H2O_WAVE_ADMIN_ACCESS_KEY_ID"), "admin access key ID (default $H2O_WAVE_ADMIN_ACCESS_KEY_ID)")
+	secret := flags.String("access-key-secret", "", "admin access key secret (default $H2O_WAVE_ADMIN_ACCESS_KEY_SECRET)")
+	flags.Parse(args)
+
+	if len(*secret) == 0 {
+		*secret = os.Getenv("H2O_WAVE_ADMIN_ACCESS_KEY_SECRET")
+	}
+	if len(*id) == 0 || len(*secret) == 0 {
+		fail("admin access key ID and secret are required")
+	}
+
+	prefix := "/" + strings.Trim(*baseURL, "/")
+	if prefix != "/" {
+		prefix += "/"
+	}
+
+	fi, _ := os.Stdout.Stat()
+	t := &keyPrompt{
+		client: &adminClient{
+			url:    strings.TrimSuffix(*address, "/") + prefix + "_admin/",
+			id:     *id,
+			secret: *secret,
+			client: &http.Client{Timeout: 30 * time.Second},
+		},
+		in:    bufio.NewScanner(os.Stdin),
+		out:   os.Stdout,
+		clear: fi != nil && fi.Mode()&os.ModeCharDevice != 0,
+	}
+	if err := t.refresh(); err != nil {
+		fail("failed listing keys: %v", err)
+	}
+	t.run()
+}
+
+func (t *keyPrompt) refresh() error {
+	entries, err := t.client.list()
+	if err != nil {
+		return err
+	}
+	t.entries = entries
+	t.apply()
+	return nil
+}
+
+func (t *keyPrompt) apply() {
+	t.visible = t.visible[:0]
+	for _, e := range t.entries {
+		if matches(e, t.filter) {
+			t.visible = append(t.visible, e)
+		}
+	}
+}
+
+func matches(e keychain.Entry, filter string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	filter = strings.ToLower(filter)
+	if strings.Contains(strings.ToLower(e.ID), filter) {
+		return true
+	}
+	for k, v := range e.Metadata {
+		if strings.Contains(strings.ToLower(k+"="+v), filter) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve looks up a key by row number, e.g. #3, or ID. Row numbers are marked, since IDs may be numeric.
+func (t *keyPrompt) resolve(key string) (keychain.Entry, bool) {
+	if row, ok := strings.CutPrefix(key, "#"); ok {
+		if i, err := strconv.Atoi(row); err == nil && i >= 1 && i <= len(t.visible) {
+			return t.visible[i-1], true
+		}
+		return keychain.Entry{}, false
+	}
+	for _, e := range t.entries {
+		if e.ID == key {
+			return e, true
+		}
+	}
+	return keychain.Entry{}, false
+}
+
+func (t *keyPrompt) draw() {
+	if t.clear {
+		fmt.Fprint(t.out, "\033[H\033[2J")
+	}
+	header := fmt.Sprintf("Wave keys: %d of %d", len(t.visible), len(t.entries))
+	if len(t.filter) > 0 {
+		header += fmt.Sprintf(" matching %q", t.filter)
+	}
+	fmt.Fprintf(t.out, "%s\n\n", header)
+
+	tw := tabwriter.NewWriter(t.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tID\tSTATUS\tEXPIRES\tMETADATA")
+	for i, e := range t.visible {
+		expires := "never"
+		if e.Expires != nil {
+			expires = e.Expires.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", i+1, e.ID, status(e), expires, formatMetadata(e.Metadata))
+	}
+	tw.Flush()
+
+	if len(t.status) > 0 {
+		fmt.Fprintf(t.out, "\n%s\n", t.status)
+		t.status = ""
+	}
+	fmt.Fprint(t.out, "\n(help for commands) > ")
+}
+
+func (t *keyPrompt) confirm(prompt string) bool {
+	fmt.Fprintf(t.out, "%s [y/N] ", prompt)
+	if !t.in.Scan() {
+		return false
+	}
+	answer := strings.ToLower(strings.TrimSpace(t.in.Text()))
+	return answer == "y" || answer == "yes"
+}
+
+func (t *keyPrompt) run() {
+	for {
+		t.draw()
+		if !t.in.Scan() {
+			fmt.Fprintln(t.out)
+			return
+		}
+		line := strings.TrimSpace(t.in.Text())
+		if strings.HasPrefix(line, "/") {
+			line = "search " + line[1:]
+		}
+		cmd, arg, _ := strings.Cut(line, " ")
+		arg = strings.TrimSpace(arg)
+
+		switch cmd {
+		case "":
+		case "q", "quit", "exit":
+			return
+		case "help", "?":
+			t.status = promptHelp
+		case "refresh":
+			if err := t.refresh(); err != nil {
+				t.status = "error: " + err.Error()
+			}
+		case "search":
+			t.filter = arg
+			t.apply()
+		case "show", "rotate", "revoke", "enable", "delete":
+			e, ok := t.resolve(arg)
+			if !ok {
+				t.status = fmt.Sprintf("error: no such key: %q", arg)
+				continue
+			}
+			t.act(cmd, e)
+		default:
+			t.status = fmt.Sprintf("error: unknown command: %q", cmd)
+		}
+	}
+}
+
+func (t *keyPrompt) act(cmd string, e keychain.Entry) {
+	var err error
+	switch cmd {
+	case "show":
+		b, _ := json.MarshalIndent(e, "", "  ")
+		t.status = fmt.Sprintf("%s (%s)\n%s", e.ID, status(e), b)
+		return
+	case "rotate":
+		if !t.confirm("Rotate " + e.ID + "? Apps using the current secret will be locked out.") {
+			return
+		}
+		var key wave.AccessKeyResponse
+		if key, err = t.client.rotate(e.ID); err == nil {
+			t.status = fmt.Sprintf("Rotated! Copy the new secret now, it won't be shown again:\n\nH2O_WAVE_ACCESS_KEY_ID=%s\nH2O_WAVE_ACCESS_KEY_SECRET=%s", key.ID, key.Secret)
+		}
+	case "revoke":
+		if err = t.client.disable(e.ID, true); err == nil {
+			t.status = "Revoked " + e.ID
+		}
+	case "enable":
+		if err = t.client.disable(e.ID, false); err == nil {
+			t.status = "Enabled " + e.ID
+		}
+	case "delete":
+		if !t.confirm("Delete " + e.ID + "? This cannot be undone.") {
+			return
+		}
+		if err = t.client.remove(e.ID); err == nil {
+			t.status = "Deleted " + e.ID
+		}
+	}
+	if err != nil {
+		t.status = "error: " + err.Error()
+		return
+	}
+	if err := t.refresh(); err != nil {
+		t.status += "\nerror: " + err.Error()
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/h2oai/wave"
+)
+
+const replayUsage = `Usage: waved replay [options] JOURNAL
+
+Send the events recorded in an event journal (see -event-journal) to an app, in order, to reproduce what users did.
+
+Apps only accept events carrying the access key they registered with, so start the app with
+H2O_WAVE_APP_ACCESS_KEY_ID and H2O_WAVE_APP_ACCESS_KEY_SECRET set, and pass the same values here.
+
+Options:
+`
+
+func runReplay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	addr := flags.String("app", "http://127.0.0.1:8000", "address of the app to send events to")
+	keyID := flags.String("app-key-id", os.Getenv("H2O_WAVE_APP_ACCESS_KEY_ID"), "access key ID the app expects")
+	keySecret := flags.String("app-key-secret", os.Getenv("H2O_WAVE_APP_ACCESS_KEY_SECRET"), "access key secret the app expects")
+	route := flags.String("route", "", "only replay events sent to the app at this route, e.g. /demo")
+	client := flags.String("client", "", "only replay events from this client ID")
+	speed := flags.Float64("speed", 0, "replay at this multiple of the recorded pace, e.g. 1 for real time; 0 to send each event as soon as the app has handled the previous one")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, replayUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fail("failed opening journal: %v", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var prev time.Time
+	for line, n := 1, 0; ; line++ {
+		b, err := r.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			fail("failed reading journal: %v", err)
+		}
+		if b = bytes.TrimSpace(b); len(b) > 0 {
+			var e wave.JournalEntry
+			if err := json.Unmarshal(b, &e); err != nil {
+				fail("line %d: %v", line, err)
+			}
+			if (*route == "" || e.Route == *route) && (*client == "" || e.Client == *client) {
+				if *speed > 0 && !prev.IsZero() && e.Time.After(prev) {
+					time.Sleep(time.Duration(float64(e.Time.Sub(prev)) / *speed))
+				}
+				prev = e.Time
+				if err := replay(*addr, *keyID, *keySecret, e); err != nil {
+					fail("line %d: %v", line, err)
+				}
+				n++
+				fmt.Printf("%s %s %s %s\n", e.Time.Format(time.RFC3339Nano), e.Route, e.Client, e.Data)
+			}
+		}
+		if err != nil { // EOF
+			fmt.Fprintf(os.Stderr, "replayed %d events\n", n)
+			return
+		}
+	}
+}
+
+// replay sends a recorded event to an app, the way the Wave server sent it.
+func replay(addr, keyID, keySecret string, e wave.JournalEntry) error {
+	req, err := http.NewRequest("POST", addr, bytes.NewReader(e.Data))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(keyID, keySecret)
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if len(e.Client) > 0 {
+		req.Header.Set("Wave-Client-ID", e.Client)
+	}
+	req.Header.Set("Wave-Subject-ID", e.Subject)
+	req.Header.Set("Wave-Username", e.Username)
+	if len(e.Provider) > 0 {
+		req.Header.Set("Wave-Provider", e.Provider)
+	}
+	if len(e.Groups) > 0 {
+		req.Header.Set("Wave-Groups", strings.Join(e.Groups, ","))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("app answered %s", resp.Status)
+	}
+	return nil
+}
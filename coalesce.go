@@ -0,0 +1,88 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import "encoding/json"
+
+// pendingPub represents changes to a route held back to be merged with the ones that follow.
+type pendingPub struct {
+	ops []json.RawMessage
+	ack bool // retry until clients acknowledge receipt, if any of the merged messages asked for it
+}
+
+// deltasMsg represents a message that only carries changes.
+type deltasMsg struct {
+	D []json.RawMessage `json:"d"`
+}
+
+// deltas returns the changes carried by data, if that's all it carries, so that they can be merged with others.
+func deltas(data []byte) ([]json.RawMessage, bool) {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(data, &m); err != nil || len(m) != 1 {
+		return nil, false
+	}
+	d, ok := m["d"]
+	if !ok {
+		return nil, false
+	}
+	var ops []json.RawMessage
+	if err := json.Unmarshal(d, &ops); err != nil {
+		return nil, false
+	}
+	return ops, true
+}
+
+// coalesce holds back changes to a route, to be sent with the ones that follow within the coalescing window.
+// Anything else flushes the route first, so that clients see messages in order.
+func (b *Broker) coalesce(pub Pub) bool {
+	if ops, ok := deltas(pub.data); ok {
+		p, ok := b.pending[pub.route]
+		if !ok {
+			p = &pendingPub{}
+			b.pending[pub.route] = p
+		}
+		p.ops = append(p.ops, ops...)
+		p.ack = p.ack || pub.ack
+		return true
+	}
+	b.flush(pub.route)
+	return false
+}
+
+// flush sends the changes held back for a route, if any, as one message.
+func (b *Broker) flush(route string) {
+	p, ok := b.pending[route]
+	if !ok {
+		return
+	}
+	delete(b.pending, route)
+	clients, ok := b.clients[route]
+	if !ok {
+		return
+	}
+	data, err := json.Marshal(deltasMsg{p.ops})
+	if err != nil {
+		echo(Log{"t": "coalesce", "route": route, "error": err.Error()})
+		return
+	}
+	b.sendAll(clients, b.number(Pub{route, data, p.ack}, clients))
+}
+
+// flushAll sends the changes held back for all routes.
+func (b *Broker) flushAll() {
+	for route := range b.pending {
+		b.flush(route)
+	}
+}
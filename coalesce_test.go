@@ -0,0 +1,55 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestDeltas(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	ops, only := deltas([]byte(`{"d":[{"k":"a"},{"k":"b"}]}`))
+	ok(only)
+	eq(len(ops), 2)
+	for _, msg := range []string{`{"d":[],"u":"x"}`, `{"p":{"c":{}}}`, `{"d":{}}`, `not json`} {
+		_, only = deltas([]byte(msg))
+		ok(!only, msg)
+	}
+}
+
+func TestBrokerCoalesces(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	c := newQueueTestClient(8, overflowDisconnect)
+	b := &Broker{
+		pending: make(map[string]*pendingPub),
+		clients: map[string]map[*Client]interface{}{"/demo": {c: nil}},
+	}
+
+	ok(b.coalesce(Pub{"/demo", []byte(`{"d":[{"k":"a"}]}`), false}))
+	ok(b.coalesce(Pub{"/demo", []byte(`{"d":[{"k":"b"}]}`), false}))
+	ok(b.coalesce(Pub{"/other", []byte(`{"d":[{"k":"x"}]}`), false}))
+	eq(len(queued(c)), 0) // held back
+
+	// Anything else flushes the route first, so that clients see messages in order.
+	ok(!b.coalesce(Pub{"/demo", []byte(`{"p":{"c":{}}}`), false}))
+	eq(queued(c), []string{`{"d":[{"k":"a"},{"k":"b"}]}`})
+
+	ok(b.coalesce(Pub{"/demo", []byte(`{"d":[{"k":"c"}]}`), false}))
+	b.flushAll()
+	eq(queued(c), []string{`{"d":[{"k":"c"}]}`})
+	eq(len(b.pending), 0)
+}
@@ -0,0 +1,213 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/h2oai/wave/pkg/blob"
+)
+
+// sniffLen is how many bytes of a file its type is sniffed from.
+const sniffLen = 512
+
+var errContentType = errors.New("file type not allowed")
+
+// activeTypes are types browsers run scripts in, when rendered.
+var activeTypes = map[string]bool{
+	"text/html":             true,
+	"application/xhtml+xml": true,
+	"image/svg+xml":         true,
+	"text/xml":              true,
+	"application/xml":       true,
+}
+
+// ContentPolicy decides which types of files may be uploaded, going by their names, declared types and content, and
+// how active content, e.g. HTML or SVG, is downloaded, so that uploads can't run scripts against other users.
+type ContentPolicy struct {
+	Allow      []string // types, or patterns, e.g. image/*, that may be uploaded; every type if empty
+	Deny       []string // types, or patterns, that may not be uploaded
+	CSP        string   // Content-Security-Policy active content is downloaded with; "" for none
+	Attachment bool     // download active content as attachments, never rendered
+}
+
+// ParseContentPolicy parses comma-separated lists of types, or patterns, e.g. "image/*,application/pdf".
+func ParseContentPolicy(allow, deny, csp string, attachment bool) (*ContentPolicy, error) {
+	p := &ContentPolicy{CSP: csp, Attachment: attachment}
+	var err error
+	if p.Allow, err = parseTypePatterns(allow); err != nil {
+		return nil, err
+	}
+	if p.Deny, err = parseTypePatterns(deny); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func parseTypePatterns(s string) ([]string, error) {
+	var patterns []string
+	for _, t := range strings.Split(s, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		if major, minor, ok := strings.Cut(t, "/"); !ok || major == "" || minor == "" {
+			return nil, fmt.Errorf("invalid file type %q: want type/subtype or type/*", t)
+		}
+		patterns = append(patterns, t)
+	}
+	return patterns, nil
+}
+
+func matchType(patterns []string, t string) bool {
+	for _, p := range patterns {
+		if p == t || (strings.HasSuffix(p, "/*") && strings.HasPrefix(t, strings.TrimSuffix(p, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// mediaType returns t without parameters, e.g. "text/html" for "text/html; charset=utf-8".
+func mediaType(t string) string {
+	t, _, _ = strings.Cut(t, ";")
+	return strings.ToLower(strings.TrimSpace(t))
+}
+
+// sniffType returns the type of content, going by its first bytes, recognizing SVG, which is sniffed as XML or text.
+func sniffType(head []byte) string {
+	t := mediaType(http.DetectContentType(head))
+	if t == "text/xml" || t == "text/plain" {
+		if bytes.Contains(bytes.ToLower(head), []byte("<svg")) {
+			return "image/svg+xml"
+		}
+	}
+	return t
+}
+
+// check returns errContentType if a file may not be uploaded, going by its name, its declared type, if any, and its
+// first bytes, if known: if any of its types is denied, or the type of its name, else its declared type, is not allowed.
+func (p *ContentPolicy) check(name, declared string, head []byte) error {
+	if p == nil {
+		return nil
+	}
+	named := mediaType(mime.TypeByExtension(path.Ext(name)))
+	declared = mediaType(declared)
+	types := []string{named, declared}
+	if len(head) > 0 {
+		types = append(types, sniffType(head))
+	}
+	for _, t := range types {
+		if t != "" && matchType(p.Deny, t) {
+			return fmt.Errorf("%w: %s", errContentType, t)
+		}
+	}
+	if len(p.Allow) == 0 {
+		return nil
+	}
+	t := named
+	if t == "" {
+		t = declared
+	}
+	if t == "" {
+		t = "application/octet-stream"
+	}
+	if !matchType(p.Allow, t) {
+		return fmt.Errorf("%w: %s", errContentType, t)
+	}
+	return nil
+}
+
+// checkStored checks files once stored, sniffing their content.
+func (p *ContentPolicy) checkStored(ctx context.Context, dir string, store blob.Bucket, files []storedFile) error {
+	if p == nil {
+		return nil
+	}
+	for _, f := range files {
+		var r io.ReadCloser
+		var info blob.Info
+		var err error
+		if store != nil {
+			if info, err = store.Stat(ctx, f.key); err != nil {
+				return err
+			}
+			r, err = store.Get(ctx, f.key, 0)
+		} else {
+			r, err = os.Open(filepath.Join(dir, filepath.FromSlash(f.key)))
+		}
+		if err != nil {
+			return err
+		}
+		head, err := readHead(r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		if err := p.check(f.key, info.ContentType, head); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readHead(r io.Reader) ([]byte, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return head[:n], err
+}
+
+// servedType returns the type a file is served as, like http.ServeContent does: by its name's extension, else by its
+// content, which is rewound.
+func servedType(name string, content io.ReadSeeker) string {
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		return t
+	}
+	head, err := readHead(content)
+	if _, serr := content.Seek(0, io.SeekStart); err != nil || serr != nil {
+		return ""
+	}
+	return sniffType(head)
+}
+
+// secure sets headers on the download of a file served as contentType, keeping browsers from sniffing other types,
+// and running scripts in active content, other than as the policy allows.
+func (p *ContentPolicy) secure(w http.ResponseWriter, name, contentType string) {
+	if p == nil {
+		return
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if !activeTypes[mediaType(contentType)] {
+		return
+	}
+	if p.CSP != "" {
+		w.Header().Set("Content-Security-Policy", p.CSP)
+	}
+	if p.Attachment {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"github.com/h2oai/wave/pkg/keychain/keychaintest"
+)
+
+func TestParseContentPolicy(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	p, err := ParseContentPolicy(" image/*, application/PDF ,", "image/svg+xml", "sandbox", true)
+	no(err)
+	eq(p.Allow, []string{"image/*", "application/pdf"})
+	eq(p.Deny, []string{"image/svg+xml"})
+	eq(p.CSP, "sandbox")
+	eq(p.Attachment, true)
+
+	for _, s := range []string{"image", "/png", "image/", "*"} {
+		if _, err := ParseContentPolicy(s, "", "", false); err == nil {
+			t.Errorf("%q: want error", s)
+		}
+		if _, err := ParseContentPolicy("", s, "", false); err == nil {
+			t.Errorf("%q: want error", s)
+		}
+	}
+}
+
+func TestContentPolicyCheck(t *testing.T) {
+	svg := []byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`)
+	html := []byte(`<!DOCTYPE html><html><script>alert(1)</script></html>`)
+	pdf := []byte("%PDF-1.4\n")
+	tests := []struct {
+		allow, deny string
+		name        string
+		declared    string
+		head        []byte
+		allowed     bool
+	}{
+		{"", "", "page.html", "", html, true},
+		{"image/*", "", "photo.png", "", nil, true},
+		{"image/*", "", "photo.PNG", "", nil, true},
+		{"image/*", "", "doc.pdf", "", pdf, false},
+		{"image/*", "", "photo", "image/jpeg", nil, true},
+		{"image/*", "", "photo", "", nil, false},             // application/octet-stream
+		{"image/*", "", "photo.png", "text/html", nil, true}, // allowed by name
+		{"", "text/html", "page.html", "", nil, false},
+		{"", "text/html", "page.txt", "text/html; charset=utf-8", nil, false},
+		{"", "text/html", "page.txt", "", html, false},    // sniffed
+		{"", "image/svg+xml", "logo.png", "", svg, false}, // SVG named as PNG
+		{"", "image/svg+xml", "logo.xml", "", svg, false},
+		{"", "image/svg+xml", "notes.txt", "", []byte("no images here"), true},
+		{"application/pdf", "", "doc.pdf", "", pdf, true},
+	}
+	for _, tc := range tests {
+		p, err := ParseContentPolicy(tc.allow, tc.deny, "", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.check(tc.name, tc.declared, tc.head)
+		if tc.allowed && err != nil {
+			t.Errorf("allow %q deny %q: %s %q: unexpected error: %v", tc.allow, tc.deny, tc.name, tc.declared, err)
+		}
+		if !tc.allowed && !errors.Is(err, errContentType) {
+			t.Errorf("allow %q deny %q: %s %q: want %v, got %v", tc.allow, tc.deny, tc.name, tc.declared, errContentType, err)
+		}
+	}
+
+	var p *ContentPolicy
+	if err := p.check("page.html", "text/html", html); err != nil {
+		t.Errorf("nil policy: unexpected error: %v", err)
+	}
+}
+
+func TestContentPolicySecure(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	p := &ContentPolicy{CSP: "sandbox", Attachment: true}
+
+	w := httptest.NewRecorder()
+	p.secure(w, "page.html", "text/html; charset=utf-8")
+	eq(w.Header().Get("X-Content-Type-Options"), "nosniff")
+	eq(w.Header().Get("Content-Security-Policy"), "sandbox")
+	eq(w.Header().Get("Content-Disposition"), `attachment; filename=page.html`)
+
+	w = httptest.NewRecorder()
+	p.secure(w, "photo.png", "image/png")
+	eq(w.Header().Get("X-Content-Type-Options"), "nosniff")
+	eq(w.Header().Get("Content-Security-Policy"), "")
+	eq(w.Header().Get("Content-Disposition"), "")
+
+	w = httptest.NewRecorder()
+	(&ContentPolicy{}).secure(w, "logo.svg", "image/svg+xml")
+	eq(w.Header().Get("X-Content-Type-Options"), "nosniff")
+	eq(w.Header().Get("Content-Security-Policy"), "")
+	eq(w.Header().Get("Content-Disposition"), "")
+
+	w = httptest.NewRecorder()
+	(*ContentPolicy)(nil).secure(w, "page.html", "text/html")
+	eq(len(w.Header()), 0)
+}
+
+func TestContentPolicyAppliesToDownloads(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	kc, keys := keychaintest.New(t, 1)
+	dir := t.TempDir()
+	no(os.MkdirAll(filepath.Join(dir, "f1"), 0o700))
+	var b bytes.Buffer
+	no(png.Encode(&b, image.NewRGBA(image.Rect(0, 0, 4, 4))))
+	no(os.WriteFile(filepath.Join(dir, "f1", "photo.png"), b.Bytes(), 0o600))
+	no(os.WriteFile(filepath.Join(dir, "f1", "page"), []byte(`<!DOCTYPE html><html><script>alert(1)</script></html>`), 0o600))
+
+	fs := newFileServer(dir, nil, kc, nil, "/_f/", fileServerConf{
+		images: newImageTransformer(t.TempDir(), 0),
+		types:  &ContentPolicy{CSP: "sandbox", Attachment: true},
+	})
+	get := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.SetBasicAuth(keys[0].ID, keys[0].Secret)
+		w := httptest.NewRecorder()
+		fs.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/_f/f1/page")
+	eq(w.Code, http.StatusOK)
+	eq(w.Header().Get("X-Content-Type-Options"), "nosniff")
+	eq(w.Header().Get("Content-Security-Policy"), "sandbox")
+	eq(w.Header().Get("Content-Disposition"), `attachment; filename=page`)
+
+	w = get("/_f/f1/photo.png")
+	eq(w.Code, http.StatusOK)
+	eq(w.Header().Get("X-Content-Type-Options"), "nosniff")
+
+	w = get("/_f/f1/photo.png?w=2")
+	eq(w.Code, http.StatusOK)
+	eq(w.Header().Get("Content-Type"), "image/png")
+	eq(w.Header().Get("X-Content-Type-Options"), "nosniff")
+	ok(w.Body.Len() > 0)
+}
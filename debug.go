@@ -31,6 +31,10 @@ const siteTemplate = `
 		{{range .Apps}}<div><a href="{{ . }}">{{ . }}</a></div>{{else}}<div>No apps.</div>{{end}}
 	  <div><strong>Pages</strong><div>
 		{{range .Pages}}<div><a href="{{ . }}">{{ . }}</a></div>{{else}}<div>No pages.</div>{{end}}
+	  <div><strong>Sockets</strong><div>
+		<div>Messages received: {{ .Messages }} ({{ .Bytes }} bytes)</div>
+		<div>Messages delayed by rate limits: {{ .Throttled }}</div>
+		<div>Messages too large: {{ .Oversized }}</div>
 	</body>
 </html>`
 
@@ -49,11 +53,19 @@ func newDebugHandler(broker *Broker) *DebugHandler {
 
 func (h *DebugHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	data := struct {
-		Apps  []string
-		Pages []string
+		Apps      []string
+		Pages     []string
+		Messages  int64
+		Bytes     int64
+		Throttled int64
+		Oversized int64
 	}{
-		Apps:  h.broker.routes(),
-		Pages: h.broker.site.urls(),
+		Apps:      h.broker.routes(),
+		Pages:     h.broker.site.urls(),
+		Messages:  socketStats.messages.Load(),
+		Bytes:     socketStats.bytes.Load(),
+		Throttled: socketStats.throttled.Load(),
+		Oversized: socketStats.oversized.Load(),
 	}
 	h.siteTemplate.Execute(w, data)
 }
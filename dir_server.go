@@ -22,16 +22,18 @@ import (
 
 // DirServer represents a file server for arbitrary directories.
 type DirServer struct {
-	keychain *keychain.Keychain
+	keychain keychain.Authenticator
 	auth     *Auth
 	handler  http.Handler
+	signer   *URLSigner
 }
 
-func newDirServer(dir string, keychain *keychain.Keychain, auth *Auth) http.Handler {
+func newDirServer(dir string, keychain keychain.Authenticator, auth *Auth, signer *URLSigner) http.Handler {
 	return &DirServer{
 		keychain,
 		auth,
 		http.FileServer(http.Dir(dir)),
+		signer,
 	}
 }
 
@@ -39,7 +41,8 @@ func (ds *DirServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Disallow if:
 	// - unauthorized api call
 	// - auth enabled and unauthorized
-	if !ds.keychain.Allow(r) && (ds.auth != nil && !ds.auth.allow(r)) { // API or UI
+	// - unless the URL is signed
+	if !ds.keychain.Allow(r) && (ds.auth != nil && !ds.auth.allow(r)) && !ds.signer.allow(r) { // API or UI
 		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
 	}
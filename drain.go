@@ -0,0 +1,81 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// drainSpread is how long clients asked to reconnect elsewhere spread their reconnects over,
+// so that the servers taking them over are not all hit at once.
+const drainSpread = 2 * time.Second
+
+// shutdown stops the server gracefully: it stops accepting connections, asks connected clients to reconnect,
+// which, behind a load balancer, moves them to other servers, and waits for them to go, for up to timeout.
+func shutdown(srv *http.Server, broker *Broker, timeout time.Duration) {
+	echo(Log{"t": "shutdown", "timeout": timeout.String()})
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go srv.Shutdown(ctx) // closes listeners right away; clients' connections are closed as they go
+	if timeout > 0 {
+		broker.migrate(ctx)
+	}
+	broker.pages.flush() // changes made since last written
+}
+
+// migrate asks every client to reconnect, after the changes held back for it, if any, have been sent,
+// and waits for all clients to disconnect, or for ctx to be done.
+func (b *Broker) migrate(ctx context.Context) {
+	msg, err := json.Marshal(OpsD{G: &MoveD{int(drainSpread / time.Millisecond), b.routes()}})
+	if err != nil {
+		return
+	}
+	b.evacuate <- msg
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		n := 0
+		for c := range b.everyClient() {
+			if c.connected() {
+				n++
+			}
+		}
+		if n == 0 {
+			echo(Log{"t": "shutdown", "clients": "0"})
+			return
+		}
+		select {
+		case <-ctx.Done():
+			echo(Log{"t": "shutdown", "clients": strconv.Itoa(n), "error": "timed out waiting for clients to reconnect elsewhere"})
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// everyClient returns every client, connected or waiting to reconnect.
+func (b *Broker) everyClient() map[*Client]interface{} {
+	b.unicastsMux.RLock()
+	defer b.unicastsMux.RUnlock()
+	clients := make(map[*Client]interface{}, len(b.clientsByID))
+	for _, c := range b.clientsByID {
+		clients[c] = nil
+	}
+	return clients
+}
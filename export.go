@@ -0,0 +1,266 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+var (
+	scriptTagRE = regexp.MustCompile(`<script\b([^>]*)\bsrc="([^"]+)"([^>]*)>\s*</script>`)
+	styleTagRE  = regexp.MustCompile(`<link\b[^>]*\brel="stylesheet"[^>]*>`)
+	hrefRE      = regexp.MustCompile(`\bhref="([^"]+)"`)
+	crossOrigRE = regexp.MustCompile(`\s*\bcrossorigin(="[^"]*")?`)
+)
+
+// Exporter renders pages, as they are, to standalone HTML documents, which show the page without a server to connect
+// to, e.g. to archive or email reports, and, if a headless browser is available, to PDF.
+//
+//	GET /_export/<route>             download the page as HTML
+//	GET /_export/<route>?format=pdf  download the page as PDF
+type Exporter struct {
+	prefix   string
+	baseURL  string
+	webDir   string
+	broker   *Broker
+	keychain keychain.Authenticator
+	chrome   string        // headless Chrome or Chromium to print PDFs with; "" to disable PDF export
+	timeout  time.Duration // how long printing a PDF may take
+}
+
+func newExporter(prefix, baseURL, webDir string, broker *Broker, keychain keychain.Authenticator, chrome string, timeout time.Duration) *Exporter {
+	return &Exporter{prefix, baseURL, webDir, broker, keychain, chrome, timeout}
+}
+
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !e.keychain.Guard(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	route := "/" + strings.TrimPrefix(r.URL.Path, e.prefix)
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", "html":
+		format = "html"
+	case "pdf":
+		if e.chrome == "" {
+			http.Error(w, "PDF export is disabled: set -export-chrome", http.StatusNotImplemented)
+			return
+		}
+	default:
+		http.Error(w, "invalid format: want html or pdf", http.StatusBadRequest)
+		return
+	}
+	if key, _, _ := r.BasicAuth(); !e.broker.authorize(Identity{Key: key}, RouteRead, route) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	page := e.broker.site.at(route)
+	if page == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	data := page.marshal()
+	if data == nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	doc, err := e.html(data)
+	if err != nil {
+		echo(Log{"t": "page_export", "route": route, "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	name := strings.Trim(strings.ReplaceAll(route, "/", "_"), "_")
+	if name == "" {
+		name = "index"
+	}
+	contentType := "text/html; charset=utf-8"
+	if format == "pdf" {
+		if doc, err = e.pdf(r.Context(), doc); err != nil {
+			echo(Log{"t": "page_export", "route": route, "format": format, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+		contentType = "application/pdf"
+	}
+	echo(Log{"t": "page_export", "route": route, "format": format})
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + "." + format}))
+	w.Write(doc)
+}
+
+// html returns the web app's index page, with its scripts and stylesheets inlined, and the page's content embedded.
+func (e *Exporter) html(data []byte) ([]byte, error) {
+	index, err := os.ReadFile(filepath.Join(e.webDir, "index.html"))
+	if err != nil {
+		return nil, err
+	}
+	var failed error
+	doc := scriptTagRE.ReplaceAllStringFunc(string(index), func(tag string) string {
+		m := scriptTagRE.FindStringSubmatch(tag)
+		js, err := e.asset(m[2])
+		if err != nil {
+			failed = err
+			return tag
+		}
+		attrs := strings.TrimRight(crossOrigRE.ReplaceAllString(m[1]+m[3], ""), " ")
+		return "<script" + attrs + ">" + strings.ReplaceAll(string(js), "</script", `<\/script`) + "</script>"
+	})
+	doc = styleTagRE.ReplaceAllStringFunc(doc, func(tag string) string {
+		m := hrefRE.FindStringSubmatch(tag)
+		if m == nil {
+			return tag
+		}
+		css, err := e.asset(m[1])
+		if err != nil {
+			failed = err
+			return tag
+		}
+		return "<style>" + strings.ReplaceAll(string(css), "</style", `<\/style`) + "</style>"
+	})
+	if failed != nil {
+		return nil, failed
+	}
+
+	// The page's content is JSON, with <, > and & escaped, so it can't end the script early.
+	content := "<script>window.__wave_export=" + string(data) + "</script>"
+	if i := strings.Index(doc, "<script"); i >= 0 {
+		doc = doc[:i] + content + doc[i:]
+	} else if i := strings.Index(doc, "</head>"); i >= 0 {
+		doc = doc[:i] + content + doc[i:]
+	} else {
+		doc = content + doc
+	}
+	return []byte(doc), nil
+}
+
+// asset reads a file referred to by the index page from the web directory.
+func (e *Exporter) asset(ref string) ([]byte, error) {
+	if strings.Contains(ref, "://") || strings.HasPrefix(ref, "//") {
+		return nil, fmt.Errorf("can't inline remote asset %s", ref)
+	}
+	ref, _, _ = strings.Cut(ref, "?")
+	p := strings.TrimPrefix(path.Clean("/"+ref), "/")
+	p = strings.TrimPrefix(p, strings.Trim(e.baseURL, "/")+"/")
+	return os.ReadFile(filepath.Join(e.webDir, filepath.FromSlash(p)))
+}
+
+// pdf prints an HTML document to PDF with a headless browser.
+func (e *Exporter) pdf(ctx context.Context, doc []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "wave-export-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	dst := filepath.Join(dir, "page.pdf")
+
+	// Chrome loads the document from loopback, through a proxy that turns down everything else, so that pages can't
+	// have files or internal hosts rendered into PDFs, e.g. with frames.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	proxy := newExportProxy(ln.Addr().String(), doc)
+	srv := &http.Server{Handler: proxy}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, e.chrome,
+		"--headless",
+		"--disable-gpu",
+		"--disable-background-networking",
+		"--no-pdf-header-footer",
+		"--run-all-compositor-stages-before-draw",
+		"--virtual-time-budget=10000", // let the page render, e.g. charts, before printing
+		"--proxy-server=http://"+proxy.host,
+		"--proxy-bypass-list=<-loopback>", // send loopback requests through the proxy too
+		"--user-data-dir="+filepath.Join(dir, "profile"),
+		"--print-to-pdf="+dst,
+		proxy.origin(),
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("timed out printing PDF after %s", e.timeout)
+		}
+		return nil, fmt.Errorf("failed printing PDF: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if n := proxy.blocked(); n > 0 {
+		echo(Log{"t": "page_export", "blocked": strconv.Itoa(n)})
+	}
+	return os.ReadFile(dst)
+}
+
+// exportProxy is the only thing headless Chrome may reach while printing a PDF: it serves the document to print, at
+// its own address, and turns down every other request.
+type exportProxy struct {
+	host string // address listened at
+	doc  []byte
+
+	lock   sync.Mutex
+	denied int
+}
+
+func newExportProxy(host string, doc []byte) *exportProxy {
+	return &exportProxy{host: host, doc: doc}
+}
+
+// origin returns the URL the document is served at.
+func (p *exportProxy) origin() string {
+	return "http://" + p.host + "/"
+}
+
+func (p *exportProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || r.Host != p.host || (r.URL.Scheme != "" && r.URL.Scheme != "http") || r.URL.Path != "/" {
+		p.lock.Lock()
+		p.denied++
+		p.lock.Unlock()
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(p.doc)
+}
+
+func (p *exportProxy) blocked() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.denied
+}
@@ -0,0 +1,82 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestExportProxyServesOnlyTheDocument(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	doc := []byte(`<iframe src="file:///etc/passwd"></iframe><iframe src="http://10.0.0.1/"></iframe>`)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	no(err)
+	proxy := newExportProxy(ln.Addr().String(), doc)
+	srv := &http.Server{Handler: proxy}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	// Requests as sent by Chrome, through the proxy.
+	proxyURL, err := url.Parse("http://" + proxy.host)
+	no(err)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	res, err := client.Get(proxy.origin())
+	no(err)
+	b, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	no(err)
+	eq(res.StatusCode, http.StatusOK)
+	eq(string(b), string(doc))
+
+	for _, u := range []string{
+		"http://10.0.0.1/",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://localhost:10101/_admin/keys",
+		proxy.origin() + "favicon.ico",
+	} {
+		res, err := client.Get(u)
+		no(err)
+		res.Body.Close()
+		eq(res.StatusCode, http.StatusForbidden)
+	}
+	eq(proxy.blocked(), 4)
+}
+
+func TestExportProxyDeniesFiles(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	proxy := newExportProxy("127.0.0.1:1234", []byte("doc"))
+	for _, r := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "file:///etc/passwd", nil),
+		httptest.NewRequest(http.MethodGet, "file://127.0.0.1:1234/", nil),
+		httptest.NewRequest(http.MethodConnect, "http://127.0.0.1:1234/", nil),
+		httptest.NewRequest(http.MethodPost, "http://127.0.0.1:1234/", nil),
+	} {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		eq(w.Code, http.StatusForbidden)
+	}
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://127.0.0.1:1234/", nil))
+	eq(w.Code, http.StatusOK)
+	eq(w.Body.String(), "doc")
+}
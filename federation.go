@@ -0,0 +1,69 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+// FederationHandler verifies access keys on behalf of federated servers, e.g. edge deployments.
+// Federated servers authenticate with keys from a dedicated keychain.
+type FederationHandler struct {
+	servers        *keychain.Keychain
+	keychain       *keychain.Keychain
+	maxRequestSize int64
+}
+
+func newFederationHandler(servers, keychain *keychain.Keychain, maxRequestSize int64) *FederationHandler {
+	return &FederationHandler{servers, keychain, maxRequestSize}
+}
+
+func (h *FederationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.servers.Guard(w, r) {
+		return
+	}
+	b, err := readRequestWithLimit(w, r.Body, h.maxRequestSize)
+	if err != nil {
+		echo(Log{"t": "read federation request body", "error": err.Error()})
+		if isRequestTooLarge(err) {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	var req keychain.VerifyRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		echo(Log{"t": "json_unmarshal", "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	resp, err := json.Marshal(keychain.VerifyResponse{Valid: h.keychain.Verify(req.ID, req.Secret)})
+	if err != nil {
+		echo(Log{"t": "json_marshal", "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(resp)
+}
@@ -0,0 +1,192 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+// File actions recorded by the file audit trail.
+const (
+	fileUpload   = "upload"
+	fileDownload = "download"
+	fileDelete   = "delete"
+)
+
+// defaultFileAuditLimit is how many events are returned by queries that don't set a limit.
+const defaultFileAuditLimit = 1000
+
+// FileEvent records an attempt to upload, download or delete a file.
+type FileEvent struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`             // upload, download or delete
+	Path       string    `json:"path"`               // e.g. /_f/<id>/report.pdf
+	Identity   string    `json:"identity,omitempty"` // key:<id>, user:<subject>, signed:<key id> or anonymous; empty if denied
+	RemoteAddr string    `json:"remote_addr"`        // X-Forwarded-For, if proxied
+	UserAgent  string    `json:"user_agent,omitempty"`
+	Bytes      int64     `json:"bytes,omitempty"` // uploaded
+	Outcome    string    `json:"outcome"`         // allowed or denied
+}
+
+// FileAudit records who uploads, downloads and deletes which files, when, and from where, to a file of JSON lines,
+// one event per line, for data governance.
+type FileAudit struct {
+	path string
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+// OpenFileAudit opens the audit trail at path, appending to it.
+func OpenFileAudit(path string) (*FileAudit, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileAudit{path: path, enc: json.NewEncoder(f)}, nil
+}
+
+// record records an action on the file at p by identity, or, if identity is empty, a denied attempt.
+func (a *FileAudit) record(r *http.Request, action, p, identity string, size int64) {
+	if a == nil {
+		return
+	}
+	outcome := keychain.Allowed
+	if identity == "" {
+		outcome = keychain.Denied
+	}
+	e := FileEvent{time.Now().UTC(), action, p, identity, getRemoteAddr(r), r.UserAgent(), size, outcome.String()}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if err := a.enc.Encode(e); err != nil {
+		echo(Log{"t": "file_audit", "action": action, "path": p, "error": err.Error()})
+	}
+}
+
+// FileAuditQuery represents a filter over file events. Zero-valued fields match all events.
+type FileAuditQuery struct {
+	keychain.AuditQuery        // ID matches events by or signed by an access key
+	Action              string // upload, download or delete
+	Path                string // prefix, e.g. /_f/<id>/ for every file uploaded together
+	Identity            string
+}
+
+func (q FileAuditQuery) match(e FileEvent) bool {
+	if q.ID != "" && e.Identity != "key:"+q.ID && e.Identity != "signed:"+q.ID {
+		return false
+	}
+	if q.Action != "" && q.Action != e.Action {
+		return false
+	}
+	if q.Identity != "" && q.Identity != e.Identity {
+		return false
+	}
+	if !strings.HasPrefix(e.Path, q.Path) {
+		return false
+	}
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !e.Time.Before(q.Until) {
+		return false
+	}
+	if q.Outcome != nil && q.Outcome.String() != e.Outcome {
+		return false
+	}
+	return true
+}
+
+// query returns the most recent events matching q, oldest first.
+func (a *FileAudit) query(q FileAuditQuery) ([]FileEvent, error) {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultFileAuditLimit
+	}
+	events := []FileEvent{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e FileEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue // being written, or cut short by a crash
+		}
+		if q.match(e) {
+			if len(events) == 2*limit { // keep the most recent, without shifting every event
+				events = append(events[:0], events[limit:]...)
+			}
+			events = append(events, e)
+		}
+	}
+	if len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	return events, scanner.Err()
+}
+
+// FileAuditHandler serves the file audit trail to admins.
+//
+//	GET /_admin/file-audit?action=download&path=/_f/<id>/&identity=user:<subject>&id=<access key id>&since=24h&until=<RFC3339>&outcome=denied&limit=100
+type FileAuditHandler struct {
+	audit  *FileAudit
+	admins keychain.Authenticator
+}
+
+func newFileAuditHandler(audit *FileAudit, admins keychain.Authenticator) http.Handler {
+	return &FileAuditHandler{audit, admins}
+}
+
+func (h *FileAuditHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.admins.Guard(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	v := r.URL.Query()
+	aq, err := keychain.ParseAuditQuery(v, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := FileAuditQuery{aq, v.Get("action"), v.Get("path"), v.Get("identity")}
+	switch q.Action {
+	case "", fileUpload, fileDownload, fileDelete:
+	default:
+		http.Error(w, "invalid action: want upload, download or delete", http.StatusBadRequest)
+		return
+	}
+	events, err := h.audit.query(q)
+	if err != nil {
+		echo(Log{"t": "file_audit", "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
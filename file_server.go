@@ -15,6 +15,7 @@
 package wave
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -28,25 +29,53 @@ import (
 	"strings"
 
 	"github.com/google/uuid"
+	"github.com/h2oai/wave/pkg/blob"
 	"github.com/h2oai/wave/pkg/keychain"
 )
 
 // FileServer represents a file server.
 type FileServer struct {
 	dir      string
-	keychain *keychain.Keychain
+	store    blob.Bucket // object storage, in place of dir; nil if not used
+	keychain keychain.Authenticator
 	auth     *Auth
 	handler  http.Handler
 	baseURL  string
+	quotas   *UploadQuotas
+	held     *Quarantine // nil if uploads are not scanned
+	signer   *URLSigner
+	cas      *ContentStore     // nil if uploads are not deduplicated
+	images   *ImageTransformer // nil if images are not transformed
+	audit    *FileAudit        // nil if not audited
+	types    *ContentPolicy    // nil if any file may be uploaded, and downloaded as is
 }
 
-func newFileServer(dir string, keychain *keychain.Keychain, auth *Auth, baseURL string) http.Handler {
+// fileServerConf configures the optional features of a FileServer, which are disabled if nil.
+type fileServerConf struct {
+	quotas *UploadQuotas
+	held   *Quarantine
+	signer *URLSigner
+	cas    *ContentStore
+	images *ImageTransformer
+	audit  *FileAudit
+	types  *ContentPolicy
+}
+
+func newFileServer(dir string, store blob.Bucket, keychain keychain.Authenticator, auth *Auth, baseURL string, conf fileServerConf) *FileServer {
 	return &FileServer{
-		dir,
-		keychain,
-		auth,
-		http.FileServer(http.Dir(dir)),
-		baseURL,
+		dir:      dir,
+		store:    store,
+		keychain: keychain,
+		auth:     auth,
+		handler:  http.FileServer(http.Dir(dir)),
+		baseURL:  baseURL,
+		quotas:   conf.quotas,
+		held:     conf.held,
+		signer:   conf.signer,
+		cas:      conf.cas,
+		images:   conf.images,
+		audit:    conf.audit,
+		types:    conf.types,
 	}
 }
 
@@ -56,7 +85,8 @@ var (
 
 // UploadResponse represents a response to a file upload operation.
 type UploadResponse struct {
-	Files []string `json:"files"`
+	Files  []string `json:"files"`
+	Hashes []string `json:"hashes,omitempty"` // SHA-256 of each file's content, if deduplicated
 }
 
 func (fs *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -65,21 +95,50 @@ func (fs *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// Disallow if:
 		// - unauthorized api call
 		// - auth enabled and unauthorized
-		if !fs.keychain.Allow(r) && (fs.auth != nil && !fs.auth.allow(r)) { // API or UI
+		// - unless the URL is signed
+		who, ok := fs.identify(r) // API, signed URL or UI
+		if !ok {
+			fs.audit.record(r, fileDownload, r.URL.Path, "", 0)
 			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 			return
 		}
 
 		trimmedPrefix := strings.TrimPrefix(r.URL.Path, fs.baseURL)
+		id, _, _ := strings.Cut(strings.TrimPrefix(path.Clean(trimmedPrefix), "/"), "/")
+		if !fs.held.wait(r.Context(), id) {
+			echo(Log{"t": "file_download", "path": r.URL.Path, "error": "not scanned yet"})
+			w.Header().Set("Retry-After", "10")
+			http.Error(w, http.StatusText(http.StatusLocked), http.StatusLocked)
+			return
+		}
+		if h := fs.cas.hash(strings.TrimPrefix(path.Clean(trimmedPrefix), "/")); h != "" {
+			w.Header().Set("ETag", `"`+h+`"`)
+		}
+		if fs.store != nil {
+			fs.download(w, r, strings.TrimPrefix(path.Clean(trimmedPrefix), "/"), who)
+			return
+		}
 		fsDirPath := path.Join(fs.dir, trimmedPrefix)
 		// Ignore requests for directories and non-existent / unaccessible files.
-		if fileInfo, err := os.Stat(filepath.FromSlash(fsDirPath)); err != nil || fileInfo.IsDir() {
+		fileInfo, err := os.Stat(filepath.FromSlash(fsDirPath))
+		if err != nil || fileInfo.IsDir() {
 			echo(Log{"t": "file_download", "path": r.URL.Path, "error": "not found"})
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			return
 		}
 
 		echo(Log{"t": "file_download", "path": r.URL.Path})
+		fs.audit.record(r, fileDownload, r.URL.Path, who, 0)
+		open := func() (io.ReadSeekCloser, error) { return os.Open(filepath.FromSlash(fsDirPath)) }
+		if fs.images.serve(w, r, fs.types, fsDirPath, fileInfo.Size(), fileInfo.ModTime(), open) {
+			return
+		}
+		if fs.types != nil {
+			if f, err := open(); err == nil {
+				fs.types.secure(w, path.Base(fsDirPath), servedType(fsDirPath, f))
+				f.Close()
+			}
+		}
 		r.URL.Path = trimmedPrefix // public
 		fs.handler.ServeHTTP(w, r)
 
@@ -87,19 +146,70 @@ func (fs *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// Disallow if:
 		// - unauthorized api call
 		// - auth enabled and unauthorized
-		if !fs.keychain.Allow(r) && (fs.auth != nil && !fs.auth.allow(r)) { // API or UI
+		owner, ok := identifyUploader(fs.keychain, fs.auth, r) // API or UI
+		if !ok {
+			fs.audit.record(r, fileUpload, r.URL.Path, "", 0)
 			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 			return
 		}
 
-		files, err := fs.acceptFiles(r)
+		// Reject what is known to be too large upfront, and cut off the rest once it gets there.
+		if err := fs.quotas.check(owner, r.ContentLength); err != nil {
+			echo(Log{"t": "file_upload", "owner": owner, "error": err.Error()})
+			rejectUpload(w, err)
+			return
+		}
+		limit := fs.quotas.allowance(owner)
+		if limit >= 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+
+		var files []string
+		var stored []storedFile
+		var err error
+		if fs.store != nil {
+			files, stored, err = fs.streamFiles(r)
+		} else {
+			files, stored, err = fs.acceptFiles(r)
+		}
 		if err != nil {
-			echo(Log{"t": "file_upload", "error": err.Error()})
+			echo(Log{"t": "file_upload", "owner": owner, "error": err.Error()})
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				rejectUpload(w, fs.quotas.check(owner, limit+1))
+				return
+			}
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
+		if err := fs.types.checkStored(r.Context(), fs.dir, fs.store, stored); err != nil {
+			echo(Log{"t": "file_upload", "owner": owner, "error": err.Error()})
+			deleted := make(map[string]bool)
+			for _, f := range stored {
+				if id := f.id(); !deleted[id] {
+					deleted[id] = true
+					deleteUpload(fs.dir, fs.store, fs.cas, id)
+				}
+			}
+			if errors.Is(err, errContentType) {
+				http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		hashes := fs.cas.intern(stored)
+		if r.Header.Get("Wave-Directory-Upload") == "True" {
+			hashes = nil // one path for all files
+		}
+		fs.quotas.add(owner, stored)
+		for _, f := range stored {
+			fs.audit.record(r, fileUpload, fs.baseURL+"/"+f.key, owner, f.size)
+		}
+		fs.held.hold(stored)
+		fs.held.check(stored)
 
-		res, err := json.Marshal(UploadResponse{Files: files})
+		res, err := json.Marshal(UploadResponse{Files: files, Hashes: hashes})
 		if err != nil {
 			echo(Log{"t": "file_upload", "error": err.Error()})
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -109,18 +219,29 @@ func (fs *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.Write(res)
 
 	case http.MethodDelete:
-		// TODO garbage collection
-
 		if !fs.keychain.Guard(w, r) { // Allow APIs only
+			fs.audit.record(r, fileDelete, r.URL.Path, "", 0)
 			return
 		}
 
+		// The app deletes on behalf of the user, identified by their session.
+		if fs.auth != nil && fs.auth.conf.StepUp.requires(stepUpFileDelete) {
+			session, ok := fs.auth.get(r.Header.Get("Wave-Session-ID"))
+			if !ok || !session.signedIn() || !fs.auth.conf.StepUp.satisfiedBy(session) {
+				echo(Log{"t": "file_unload", "path": r.URL.Path, "error": "step-up authentication required"})
+				fs.auth.conf.StepUp.challenge(w)
+				return
+			}
+		}
+
 		if err := fs.deleteFile(r.URL.Path, fs.baseURL); err != nil {
 			echo(Log{"t": "file_unload", "path": r.URL.Path, "error": err.Error()})
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			return
 		}
 		echo(Log{"t": "file_unload", "path": r.URL.Path})
+		id, _, _ := r.BasicAuth()
+		fs.audit.record(r, fileDelete, r.URL.Path, "key:"+id, 0)
 
 	default:
 		echo(Log{"t": "file_download", "method": r.Method, "path": r.URL.Path, "error": "method not allowed"})
@@ -128,15 +249,29 @@ func (fs *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (fs *FileServer) acceptFiles(r *http.Request) ([]string, error) {
+// storedFile is an uploaded file, stored at key, e.g. "7a0e.../report.pdf", relative to the file server's
+// directory or object store.
+type storedFile struct {
+	key  string
+	size int64
+}
+
+// id returns the id of the upload the file is part of: the first component of its key.
+func (f storedFile) id() string {
+	id, _, _ := strings.Cut(f.key, "/")
+	return id
+}
+
+// acceptFiles stores uploaded files in the file server's directory, and returns their paths, and what was stored.
+func (fs *FileServer) acceptFiles(r *http.Request) ([]string, []storedFile, error) {
 	if err := r.ParseMultipartForm(32 << 20); err != nil { // 32 MB
-		return nil, fmt.Errorf("failed parsing upload form from request: %v", err)
+		return nil, nil, fmt.Errorf("failed parsing upload form from request: %w", err)
 	}
 
 	form := r.MultipartForm
 	files, ok := form.File["files"]
 	if !ok {
-		return nil, errors.New("want 'files' field in upload form, got none")
+		return nil, nil, errors.New("want 'files' field in upload form, got none")
 	}
 
 	isDirectoryUpload := r.Header.Get("Wave-Directory-Upload")
@@ -158,28 +293,46 @@ func (fs *FileServer) deleteFile(url, baseURL string) error {
 		return errInvalidUnloadPath
 	}
 
-	dirpath := filepath.Join(fs.dir, tokens[2])
-	return os.RemoveAll(dirpath)
+	if err := deleteUpload(fs.dir, fs.store, fs.cas, tokens[2]); err != nil {
+		return err
+	}
+	fs.quotas.remove(tokens[2])
+	fs.held.release(tokens[2])
+	return nil
+}
+
+// deleteUpload deletes the files uploaded with an id, from object storage, if used, or else from dir.
+func deleteUpload(dir string, store blob.Bucket, cas *ContentStore, id string) error {
+	if store != nil {
+		_, err := store.DeletePrefix(context.Background(), id+"/") // releases content, if deduplicated
+		return err
+	}
+	if err := os.RemoveAll(filepath.Join(dir, id)); err != nil {
+		return err
+	}
+	cas.release(id)
+	return nil
 }
 
-func (fs *FileServer) storeFilesInSingleDir(files []*multipart.FileHeader) ([]string, error) {
+func (fs *FileServer) storeFilesInSingleDir(files []*multipart.FileHeader) ([]string, []storedFile, error) {
 
 	id, err := uuid.NewRandom()
 	if err != nil {
-		return nil, fmt.Errorf("failed generating file id: %v", err)
+		return nil, nil, fmt.Errorf("failed generating file id: %v", err)
 	}
 
 	dirID := id.String()
 	uploadDir := filepath.Join(fs.dir, dirID)
+	var stored []storedFile
 
 	if err := os.MkdirAll(uploadDir, 0700); err != nil {
-		return nil, fmt.Errorf("failed creating upload dir %s: %v", uploadDir, err)
+		return nil, nil, fmt.Errorf("failed creating upload dir %s: %v", uploadDir, err)
 	}
 
 	for _, file := range files {
 		src, err := file.Open()
 		if err != nil {
-			return nil, fmt.Errorf("failed opening uploaded file: %v", err)
+			return nil, nil, fmt.Errorf("failed opening uploaded file: %v", err)
 		}
 		defer src.Close()
 
@@ -195,36 +348,40 @@ func (fs *FileServer) storeFilesInSingleDir(files []*multipart.FileHeader) ([]st
 		uploadPath := filepath.Join(uploadDir, dir)
 
 		if err := os.MkdirAll(uploadPath, 0700); err != nil {
-			return nil, fmt.Errorf("failed creating dir structure %s: %v", uploadDir, err)
+			return nil, nil, fmt.Errorf("failed creating dir structure %s: %v", uploadDir, err)
 		}
 
 		uploadPath = filepath.Join(uploadPath, file)
 		dst, err := os.Create(uploadPath)
 		if err != nil {
-			return nil, fmt.Errorf("failed writing uploaded file %s: %v", uploadPath, err)
+			return nil, nil, fmt.Errorf("failed writing uploaded file %s: %v", uploadPath, err)
 		}
 		defer dst.Close()
 
-		if _, err = io.Copy(dst, src); err != nil {
-			return nil, fmt.Errorf("failed copying uploaded file %s: %v", uploadPath, err)
+		n, err := io.Copy(dst, src)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed copying uploaded file %s: %v", uploadPath, err)
 		}
+		key, _ := filepath.Rel(fs.dir, uploadPath)
+		stored = append(stored, storedFile{filepath.ToSlash(key), n})
 	}
 
-	return []string{path.Join(fs.baseURL, dirID)}, nil
+	return []string{path.Join(fs.baseURL, dirID)}, stored, nil
 }
 
-func (fs *FileServer) storeFilesInSeparateDirs(files []*multipart.FileHeader) ([]string, error) {
+func (fs *FileServer) storeFilesInSeparateDirs(files []*multipart.FileHeader) ([]string, []storedFile, error) {
 	uploadPaths := make([]string, len(files))
+	stored := make([]storedFile, len(files))
 	for i, file := range files {
 
 		id, err := uuid.NewRandom()
 		if err != nil {
-			return nil, fmt.Errorf("failed generating file id: %v", err)
+			return nil, nil, fmt.Errorf("failed generating file id: %v", err)
 		}
 
 		src, err := file.Open()
 		if err != nil {
-			return nil, fmt.Errorf("failed opening uploaded file: %v", err)
+			return nil, nil, fmt.Errorf("failed opening uploaded file: %v", err)
 		}
 		defer src.Close()
 
@@ -232,7 +389,7 @@ func (fs *FileServer) storeFilesInSeparateDirs(files []*multipart.FileHeader) ([
 		uploadDir := filepath.Join(fs.dir, fileID)
 
 		if err := os.MkdirAll(uploadDir, 0700); err != nil {
-			return nil, fmt.Errorf("failed creating upload dir %s: %v", uploadDir, err)
+			return nil, nil, fmt.Errorf("failed creating upload dir %s: %v", uploadDir, err)
 		}
 
 		basename := filepath.Base(file.Filename)
@@ -240,15 +397,209 @@ func (fs *FileServer) storeFilesInSeparateDirs(files []*multipart.FileHeader) ([
 
 		dst, err := os.Create(uploadPath)
 		if err != nil {
-			return nil, fmt.Errorf("failed writing uploaded file %s: %v", uploadPath, err)
+			return nil, nil, fmt.Errorf("failed writing uploaded file %s: %v", uploadPath, err)
 		}
 		defer dst.Close()
 
 		if _, err = io.Copy(dst, src); err != nil {
-			return nil, fmt.Errorf("failed copying uploaded file %s: %v", uploadPath, err)
+			return nil, nil, fmt.Errorf("failed copying uploaded file %s: %v", uploadPath, err)
 		}
 
 		uploadPaths[i] = path.Join(fs.baseURL, fileID, basename)
+		stored[i] = storedFile{fileID + "/" + basename, file.Size}
+	}
+	return uploadPaths, stored, nil
+}
+
+// identify returns who is downloading a file: an API access key, the key that signed the URL, a signed-in user, or
+// anyone, if auth is disabled.
+func (fs *FileServer) identify(r *http.Request) (string, bool) {
+	if fs.keychain.Allow(r) {
+		id, _, _ := r.BasicAuth()
+		return "key:" + id, true
+	}
+	if fs.signer.allow(r) {
+		return "signed:" + r.URL.Query().Get("key"), true
+	}
+	if fs.auth == nil {
+		return anonymousUploader, true
+	}
+	if session := fs.auth.identify(r); session != nil {
+		return "user:" + session.subject, true
+	}
+	return "", false
+}
+
+// download serves the file at key from object storage, honoring range requests, to who.
+func (fs *FileServer) download(w http.ResponseWriter, r *http.Request, key, who string) {
+	info, err := fs.store.Stat(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, blob.ErrNotFound) {
+			echo(Log{"t": "file_download", "path": r.URL.Path, "error": "not found"})
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		echo(Log{"t": "file_download", "path": r.URL.Path, "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	echo(Log{"t": "file_download", "path": r.URL.Path})
+	fs.audit.record(r, fileDownload, r.URL.Path, who, 0)
+	open := func() (io.ReadSeekCloser, error) { return blob.NewReader(r.Context(), fs.store, key, info.Size), nil }
+	if fs.images.serve(w, r, fs.types, key, info.Size, info.ModTime, open) {
+		return
 	}
-	return uploadPaths, nil
+	content := blob.NewReader(r.Context(), fs.store, key, info.Size)
+	defer content.Close()
+	if info.ContentType != "" {
+		w.Header().Set("Content-Type", info.ContentType)
+		fs.types.secure(w, path.Base(key), info.ContentType)
+	} else if fs.types != nil {
+		fs.types.secure(w, path.Base(key), servedType(key, content))
+	}
+	http.ServeContent(w, r, path.Base(key), info.ModTime, content)
+}
+
+// streamFiles copies uploaded files to object storage as they are read from the request,
+// rather than buffering them in memory or on disk first.
+func (fs *FileServer) streamFiles(r *http.Request) ([]string, []storedFile, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed reading upload form from request: %v", err)
+	}
+
+	var dirID string
+	isDirectoryUpload := r.Header.Get("Wave-Directory-Upload") == "True"
+	if isDirectoryUpload {
+		id, err := uuid.NewRandom()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed generating file id: %v", err)
+		}
+		dirID = id.String()
+	}
+
+	var uploadPaths []string
+	var stored []storedFile
+	n := 0
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed reading upload form from request: %w", err)
+		}
+		if part.FormName() != "files" {
+			continue
+		}
+
+		// See storeFilesInSingleDir for why the filename is parsed from the Content-Disposition header.
+		_, params, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		filename := filepath.ToSlash(params["filename"])
+
+		fileID := dirID
+		name := strings.TrimPrefix(path.Clean("/"+filename), "/") // keep the directory structure, within the upload
+		if !isDirectoryUpload {
+			id, err := uuid.NewRandom()
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed generating file id: %v", err)
+			}
+			fileID, name = id.String(), path.Base(filename)
+		}
+		if name == "" || name == "." || name == "/" {
+			return nil, nil, errors.New("want file name in upload form, got none")
+		}
+
+		contentType := mime.TypeByExtension(path.Ext(name))
+		if contentType == "" {
+			contentType = part.Header.Get("Content-Type")
+		}
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		counted := &countingReader{r: part}
+		if err := fs.store.Put(r.Context(), fileID+"/"+name, contentType, counted); err != nil {
+			return nil, nil, fmt.Errorf("failed storing uploaded file %s: %w", name, err)
+		}
+		stored = append(stored, storedFile{fileID + "/" + name, counted.n})
+		n++
+		if !isDirectoryUpload {
+			uploadPaths = append(uploadPaths, path.Join(fs.baseURL, fileID, name))
+		}
+	}
+
+	if n == 0 {
+		return nil, nil, errors.New("want 'files' field in upload form, got none")
+	}
+	if isDirectoryUpload {
+		return []string{path.Join(fs.baseURL, dirID)}, stored, nil
+	}
+	return uploadPaths, stored, nil
+}
+
+// storeFile stores a file at key, e.g. "7a0e.../report.pdf", in object storage, if used, or else in the file
+// server's directory.
+func (fs *FileServer) storeFile(ctx context.Context, key string, r io.Reader) (storedFile, error) {
+	if fs.store != nil {
+		contentType := mime.TypeByExtension(path.Ext(key))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		counted := &countingReader{r: r}
+		if err := fs.store.Put(ctx, key, contentType, counted); err != nil {
+			return storedFile{}, fmt.Errorf("failed storing file %s: %w", key, err)
+		}
+		return storedFile{key, counted.n}, nil
+	}
+	p := filepath.Join(fs.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return storedFile{}, fmt.Errorf("failed creating upload dir for %s: %v", key, err)
+	}
+	dst, err := os.Create(p)
+	if err != nil {
+		return storedFile{}, fmt.Errorf("failed writing file %s: %v", key, err)
+	}
+	n, err := io.Copy(dst, r)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return storedFile{}, fmt.Errorf("failed writing file %s: %w", key, err)
+	}
+	return storedFile{key, n}, nil
+}
+
+// openFile opens the file stored at key, and returns its size.
+func (fs *FileServer) openFile(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	if fs.store != nil {
+		info, err := fs.store.Stat(ctx, key)
+		if err != nil {
+			return nil, 0, err
+		}
+		r, err := fs.store.Get(ctx, key, 0)
+		return r, info.Size, err
+	}
+	f, err := os.Open(filepath.Join(fs.dir, filepath.FromSlash(key)))
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		f.Close()
+		return nil, 0, os.ErrNotExist
+	}
+	return f, info.Size(), nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
 }
@@ -0,0 +1,125 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// subscriptionFilter limits the cards, and changes to cards, sent to a client to those matching any of its patterns.
+// Patterns are card names or keys within cards, e.g. "stats" or "stats items 0", and match a prefix if they end
+// with *, e.g. "chart*". Changes to a matching key's parents or children match too.
+type subscriptionFilter []string
+
+// parseSubscriptionFilter parses comma-separated patterns, e.g. "chart*,stats items".
+func parseSubscriptionFilter(s string) subscriptionFilter {
+	var f subscriptionFilter
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			f = append(f, p)
+		}
+	}
+	return f
+}
+
+// match reports whether a change to a key concerns the client.
+func (f subscriptionFilter) match(k string) bool {
+	if k == "" { // drop page
+		return true
+	}
+	for _, p := range f {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(k, prefix) || strings.HasPrefix(prefix, k+keySeparator) {
+				return true
+			}
+			continue
+		}
+		if k == p || strings.HasPrefix(k, p+keySeparator) || strings.HasPrefix(p, k+keySeparator) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply removes the cards and changes that don't concern the client from a message,
+// and returns nil if nothing is left to send.
+func (f subscriptionFilter) apply(data []byte) []byte {
+	if f == nil {
+		return data
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return data
+	}
+	var err error
+	changed := false
+	if raw, ok := m["d"]; ok {
+		var ops []json.RawMessage
+		if err = json.Unmarshal(raw, &ops); err != nil {
+			return data
+		}
+		var kept []json.RawMessage
+		for _, op := range ops {
+			var o struct {
+				K string `json:"k"`
+			}
+			if err := json.Unmarshal(op, &o); err != nil || f.match(o.K) {
+				kept = append(kept, op)
+			}
+		}
+		if len(kept) < len(ops) {
+			changed = true
+			if len(kept) == 0 {
+				delete(m, "d")
+				if len(m) == 0 {
+					return nil
+				}
+			} else if m["d"], err = json.Marshal(kept); err != nil {
+				return data
+			}
+		}
+	}
+	if raw, ok := m["p"]; ok {
+		var p map[string]json.RawMessage
+		if err = json.Unmarshal(raw, &p); err != nil {
+			return data
+		}
+		var cards map[string]json.RawMessage
+		if err = json.Unmarshal(p["c"], &cards); err != nil {
+			return data
+		}
+		for name := range cards {
+			if !f.match(name) {
+				delete(cards, name)
+				changed = true
+			}
+		}
+		if p["c"], err = json.Marshal(cards); err != nil {
+			return data
+		}
+		if m["p"], err = json.Marshal(p); err != nil {
+			return data
+		}
+	}
+	if !changed {
+		return data
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return data
+	}
+	return b
+}
@@ -0,0 +1,60 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestSubscriptionFilterMatch(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	eq(parseSubscriptionFilter(" chart*, ,stats items "), subscriptionFilter{"chart*", "stats items"})
+	ok(parseSubscriptionFilter("") == nil)
+
+	f := parseSubscriptionFilter("chart*,stats items")
+	for k, want := range map[string]bool{
+		"":              true, // drop page
+		"chart":         true,
+		"chart2 data":   true,
+		"stats":         true, // parent
+		"stats items":   true,
+		"stats items 0": true, // child
+		"stats value":   false,
+		"statsboard":    false,
+		"stats itemsx":  false,
+		"header":        false,
+		"header chart":  false,
+	} {
+		ok(f.match(k) == want, k)
+	}
+}
+
+func TestSubscriptionFilterApply(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	f := parseSubscriptionFilter("stats")
+
+	msg := []byte(`{"d":[{"k":"stats value","v":1}]}`)
+	eq(string(f.apply(msg)), string(msg)) // unchanged
+	ok(f.apply([]byte(`{"d":[{"k":"header title","v":"x"}]}`)) == nil, "nothing left to send")
+	eq(string(f.apply([]byte(`{"d":[{"k":"header title","v":"x"},{"k":"stats value","v":1}]}`))), `{"d":[{"k":"stats value","v":1}]}`)
+	eq(string(f.apply([]byte(`{"p":{"c":{"header":{},"stats":{}}}}`))), `{"p":{"c":{"stats":{}}}}`)
+
+	var none subscriptionFilter
+	msg = []byte(`{"d":[{"k":"header title","v":"x"}]}`)
+	eq(string(none.apply(msg)), string(msg))
+	eq(string(f.apply([]byte("not json"))), "not json")
+}
@@ -0,0 +1,293 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/h2oai/wave/pkg/blob"
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+// RetentionPolicy decides how long uploaded files are kept after they are uploaded.
+type RetentionPolicy struct {
+	TTL     time.Duration   // for every file; 0 to keep forever
+	Routes  []RetentionRule // for files referenced by pages at or under routes, in place of TTL
+	Orphans time.Duration   // for files referenced by no page, if sooner than TTL; 0 to apply TTL
+}
+
+// RetentionRule keeps files referenced by the pages at or under a route for a TTL.
+type RetentionRule struct {
+	Route string
+	TTL   time.Duration // 0 to keep forever
+}
+
+// ParseRetentionPolicy parses a comma-separated list of TTLs, e.g. "720h,/reports=24h,/archive=0": how long to
+// keep every uploaded file, and how long to keep files referenced by the pages at or under routes, or 0 to keep them
+// forever. Files referenced by no page are kept for orphans, if non-zero and sooner. Returns nil if no files expire.
+func ParseRetentionPolicy(spec string, orphans time.Duration) (*RetentionPolicy, error) {
+	p := &RetentionPolicy{Orphans: orphans}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		route, s, scoped := strings.Cut(entry, "=")
+		ttl, err := time.ParseDuration(strings.TrimSpace(s))
+		if !scoped {
+			ttl, err = time.ParseDuration(entry)
+		}
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("invalid file retention %q: want [route=]duration, e.g. /reports=24h", entry)
+		}
+		if !scoped {
+			p.TTL = ttl
+			continue
+		}
+		route = strings.TrimSpace(route)
+		if !strings.HasPrefix(route, "/") {
+			return nil, fmt.Errorf("invalid file retention %q: want route starting with /", entry)
+		}
+		p.Routes = append(p.Routes, RetentionRule{route, ttl})
+	}
+	if p.TTL == 0 && p.Orphans == 0 && len(p.Routes) == 0 {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// ttl returns how long to keep a file referenced by the pages at routes, and why it is deleted after that.
+func (p *RetentionPolicy) ttl(routes []string) (time.Duration, string) {
+	if len(routes) == 0 {
+		if p.Orphans > 0 && (p.TTL == 0 || p.Orphans < p.TTL) {
+			return p.Orphans, "orphaned"
+		}
+		return p.TTL, "expired"
+	}
+	// Keep files for as long as any page referencing them needs them.
+	var longest time.Duration
+	for _, route := range routes {
+		ttl := p.TTL
+		if rule, ok := p.rule(route); ok {
+			ttl = rule.TTL
+		}
+		if ttl == 0 {
+			return 0, ""
+		}
+		longest = max(longest, ttl)
+	}
+	return longest, "expired"
+}
+
+// rule returns the rule for the most specific route matching route.
+func (p *RetentionPolicy) rule(route string) (RetentionRule, bool) {
+	var match RetentionRule
+	found := false
+	for _, rule := range p.Routes {
+		prefix := strings.TrimSuffix(rule.Route, "/")
+		if route != rule.Route && !strings.HasPrefix(route, prefix+"/") {
+			continue
+		}
+		if !found || len(rule.Route) > len(match.Route) {
+			match, found = rule, true
+		}
+	}
+	return match, found
+}
+
+// GCReport describes a garbage collection of uploaded files.
+type GCReport struct {
+	Time    time.Time `json:"time"`
+	DryRun  bool      `json:"dry_run"`
+	Files   int       `json:"files"`   // uploads examined
+	Bytes   int64     `json:"bytes"`   // deleted, or to be deleted, where known
+	Deleted []GCFile  `json:"deleted"` // or to be deleted, if a dry run
+}
+
+// GCFile describes an upload deleted by garbage collection.
+type GCFile struct {
+	Path     string    `json:"path"`
+	Reason   string    `json:"reason"` // expired or orphaned
+	Uploaded time.Time `json:"uploaded"`
+	Routes   []string  `json:"routes,omitempty"` // pages referencing it
+	Bytes    int64     `json:"bytes,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// FileGC deletes uploaded files once the retention policy no longer keeps them, periodically, in the background.
+// Files are found in the upload records kept for quotas, and, without object storage, in the file server's directory.
+// Files in object storage uploaded before upload times were recorded are never deleted.
+type FileGC struct {
+	policy  *RetentionPolicy
+	site    *Site
+	dir     string      // file server dir
+	store   blob.Bucket // file server object store; nil if not used
+	staging string      // resumable upload staging dir
+	quotas  *UploadQuotas
+	held    *Quarantine
+	cas     *ContentStore
+	baseURL string // file server's, e.g. /_f
+	dryRun  bool   // report, but never delete
+	refs    *regexp.Regexp
+
+	lock sync.Mutex // serializes collections
+}
+
+func newFileGC(policy *RetentionPolicy, site *Site, dir string, store blob.Bucket, staging string, quotas *UploadQuotas, held *Quarantine, cas *ContentStore, baseURL string, dryRun bool) *FileGC {
+	refs := regexp.MustCompile(regexp.QuoteMeta(baseURL+"/") + `([^/"'?#&\\\s)]+)`)
+	return &FileGC{policy, site, dir, store, staging, quotas, held, cas, baseURL, dryRun, refs, sync.Mutex{}}
+}
+
+// run collects garbage every interval.
+func (gc *FileGC) run(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		gc.collect(gc.dryRun)
+	}
+}
+
+// references returns the routes of the pages referencing each upload, by id.
+func (gc *FileGC) references() map[string][]string {
+	refs := make(map[string][]string)
+	for _, url := range gc.site.urls() {
+		page := gc.site.at(url)
+		if page == nil { // deleted meanwhile
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, m := range gc.refs.FindAllSubmatch(page.marshal(), -1) {
+			if id := string(m[1]); !seen[id] {
+				seen[id] = true
+				refs[id] = append(refs[id], url)
+			}
+		}
+	}
+	return refs
+}
+
+// uploads returns when each upload was uploaded, by id.
+func (gc *FileGC) uploads() (map[string]time.Time, map[string]int64) {
+	times := make(map[string]time.Time)
+	sizes := make(map[string]int64)
+	for id, f := range gc.quotas.uploads() {
+		sizes[id] = f.Size
+		if f.Time != nil {
+			times[id] = *f.Time
+		}
+	}
+	if gc.store == nil {
+		entries, err := os.ReadDir(gc.dir)
+		if err != nil && !os.IsNotExist(err) {
+			echo(Log{"t": "file_gc", "error": err.Error()})
+		}
+		for _, e := range entries {
+			if _, ok := times[e.Name()]; ok {
+				continue
+			}
+			if info, err := e.Info(); err == nil {
+				times[e.Name()] = info.ModTime()
+			}
+		}
+	}
+	return times, sizes
+}
+
+// collect deletes the uploads the retention policy no longer keeps, or, if dryRun, only reports them.
+func (gc *FileGC) collect(dryRun bool) GCReport {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+
+	now := time.Now()
+	times, sizes := gc.uploads()
+	refs := gc.references()
+	report := GCReport{Time: now.UTC(), DryRun: dryRun, Files: len(times), Deleted: []GCFile{}}
+	for id, uploaded := range times {
+		routes := refs[id]
+		ttl, reason := gc.policy.ttl(routes)
+		if ttl == 0 || now.Sub(uploaded) < ttl {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(gc.staging, id+".json")); err == nil { // resumable upload in progress
+			continue
+		}
+		f := GCFile{gc.baseURL + "/" + id, reason, uploaded.UTC(), routes, sizes[id], ""}
+		if !dryRun {
+			if err := deleteUpload(gc.dir, gc.store, gc.cas, id); err != nil {
+				f.Error = err.Error()
+			} else {
+				gc.quotas.remove(id)
+				gc.held.release(id)
+			}
+		}
+		l := Log{"t": "file_gc", "path": f.Path, "reason": reason, "uploaded": f.Uploaded.Format(time.RFC3339)}
+		if dryRun {
+			l["dry_run"] = "true"
+		}
+		if f.Error != "" {
+			l["error"] = f.Error
+		} else {
+			report.Bytes += f.Bytes
+		}
+		echo(l)
+		report.Deleted = append(report.Deleted, f)
+	}
+	sort.Slice(report.Deleted, func(i, j int) bool { return report.Deleted[i].Uploaded.Before(report.Deleted[j].Uploaded) })
+	if len(report.Deleted) > 0 {
+		echo(Log{"t": "file_gc", "files": strconv.Itoa(report.Files), "deleted": strconv.Itoa(len(report.Deleted)), "bytes": strconv.FormatInt(report.Bytes, 10), "dry_run": strconv.FormatBool(dryRun)})
+	}
+	return report
+}
+
+// GCHandler reports which uploaded files garbage collection would delete, or collects garbage right away, for admins.
+//
+//	GET /_admin/gc
+//	POST /_admin/gc
+type GCHandler struct {
+	gc     *FileGC
+	admins keychain.Authenticator
+}
+
+func newGCHandler(gc *FileGC, admins keychain.Authenticator) http.Handler {
+	return &GCHandler{gc, admins}
+}
+
+func (h *GCHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.admins.Guard(w, r) {
+		return
+	}
+	var report GCReport
+	switch r.Method {
+	case http.MethodGet:
+		report = h.gc.collect(true)
+	case http.MethodPost:
+		report = h.gc.collect(h.gc.dryRun)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
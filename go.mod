@@ -1,6 +1,6 @@
 module github.com/h2oai/wave
 
-go 1.22
+go 1.23
 
 require (
 	github.com/coreos/go-oidc v2.2.1+incompatible
@@ -11,6 +11,9 @@ require (
 	github.com/lo5/sqlite3 v0.1.0
 	golang.org/x/crypto v0.24.0
 	golang.org/x/oauth2 v0.18.0
+	google.golang.org/grpc v1.64.0
+	google.golang.org/protobuf v1.33.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -20,7 +23,8 @@ require (
 	github.com/pquerna/cachecontrol v0.2.0 // indirect
 	golang.org/x/net v0.26.0 // indirect
 	golang.org/x/sys v0.21.0 // indirect
+	golang.org/x/text v0.16.0 // indirect
 	google.golang.org/appengine v1.6.8 // indirect
-	google.golang.org/protobuf v1.33.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240318140521-94a12d6c2237 // indirect
 	gopkg.in/square/go-jose.v2 v2.6.0 // indirect
 )
@@ -0,0 +1,207 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/h2oai/wave/pkg/imaging"
+)
+
+// maxImagePixels is the most pixels an image may have to be transformed, bounding the memory decoding takes.
+const maxImagePixels = 25_000_000
+
+// ImageTransformer serves resized, cropped or converted versions of uploaded images, e.g. thumbnails, as asked for
+// by query parameters, e.g. /_f/<id>/photo.jpg?w=200&h=200&fit=cover. Transformed images are cached on disk, keyed
+// by the image's path, size and modification time, and the oldest are evicted once the cache grows past its size.
+type ImageTransformer struct {
+	dir      string // cache
+	maxBytes int64  // cache size; 0 for no limit
+	sem      chan struct{}
+
+	lock  sync.Mutex
+	bytes int64 // cached
+}
+
+func newImageTransformer(dir string, maxBytes int64) *ImageTransformer {
+	t := &ImageTransformer{dir: dir, maxBytes: maxBytes, sem: make(chan struct{}, runtime.NumCPU())}
+	t.bytes, _ = t.usage()
+	return t
+}
+
+// serve serves a transformed version of the image at key, if asked for, with the headers types sets on downloads,
+// and reports whether it did.
+func (t *ImageTransformer) serve(w http.ResponseWriter, r *http.Request, types *ContentPolicy, key string, size int64, modTime time.Time, open func() (io.ReadSeekCloser, error)) bool {
+	if t == nil {
+		return false
+	}
+	o, asked, err := imaging.ParseOptions(r.URL.Query())
+	if !asked {
+		return false
+	}
+	if err != nil {
+		echo(Log{"t": "image_transform", "path": r.URL.Path, "error": err.Error()})
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d\x00%s", key, size, modTime.UnixNano(), o.Key())))
+	h := hex.EncodeToString(sum[:])
+	p, format, err := t.cached(h)
+	if err != nil {
+		if p, format, err = t.transform(h, o, open); err != nil {
+			echo(Log{"t": "image_transform", "path": r.URL.Path, "options": o.Key(), "error": err.Error()})
+			switch {
+			case errors.Is(err, imaging.ErrUnsupported):
+				http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			case errors.Is(err, imaging.ErrTooLarge):
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			default:
+				http.Error(w, http.StatusText(http.StatusUnprocessableEntity), http.StatusUnprocessableEntity)
+			}
+			return true
+		}
+		echo(Log{"t": "image_transform", "path": r.URL.Path, "options": o.Key()})
+	}
+
+	f, err := os.Open(p)
+	if err != nil { // evicted meanwhile
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return true
+	}
+	defer f.Close()
+	now := time.Now()
+	os.Chtimes(p, now, now) // recently used
+	w.Header().Set("Content-Type", "image/"+format)
+	w.Header().Set("ETag", `"`+h+`"`)
+	types.secure(w, path.Base(key), "image/"+format)
+	http.ServeContent(w, r, "", modTime, f)
+	return true
+}
+
+// cached returns the path and format of a cached image, if any.
+func (t *ImageTransformer) cached(h string) (string, string, error) {
+	for _, format := range []string{"png", "jpeg", "gif"} {
+		p := filepath.Join(t.dir, h[:2], h+"."+format)
+		if _, err := os.Stat(p); err == nil {
+			return p, format, nil
+		}
+	}
+	return "", "", os.ErrNotExist
+}
+
+// transform transforms an image and caches the result.
+func (t *ImageTransformer) transform(h string, o imaging.Options, open func() (io.ReadSeekCloser, error)) (string, string, error) {
+	t.sem <- struct{}{}
+	defer func() { <-t.sem }()
+
+	src, err := open()
+	if err != nil {
+		return "", "", err
+	}
+	defer src.Close()
+
+	dir := filepath.Join(t.dir, h[:2])
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", err
+	}
+	tmp, err := os.CreateTemp(dir, h+".tmp-")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(tmp.Name())
+	format, err := imaging.Transform(tmp, src, o, maxImagePixels)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", "", err
+	}
+	info, err := os.Stat(tmp.Name())
+	if err != nil {
+		return "", "", err
+	}
+	p := filepath.Join(dir, h+"."+format)
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return "", "", err
+	}
+
+	t.lock.Lock()
+	t.bytes += info.Size()
+	full := t.maxBytes > 0 && t.bytes > t.maxBytes
+	t.lock.Unlock()
+	if full {
+		t.evict()
+	}
+	return p, format, nil
+}
+
+// usage returns the size of the cache, in bytes.
+func (t *ImageTransformer) usage() (int64, []cachedImage) {
+	var n int64
+	var images []cachedImage
+	filepath.WalkDir(t.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.Contains(d.Name(), ".tmp-") {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			n += info.Size()
+			images = append(images, cachedImage{p, info.Size(), info.ModTime()})
+		}
+		return nil
+	})
+	return n, images
+}
+
+type cachedImage struct {
+	path    string
+	size    int64
+	modTime time.Time // last used
+}
+
+// evict deletes the least recently used images, until the cache is back to nine tenths of its size.
+func (t *ImageTransformer) evict() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	n, images := t.usage()
+	sort.Slice(images, func(i, j int) bool { return images[i].modTime.Before(images[j].modTime) })
+	evicted := 0
+	for _, img := range images {
+		if n <= t.maxBytes/10*9 {
+			break
+		}
+		if err := os.Remove(img.path); err == nil {
+			n -= img.size
+			evicted++
+		}
+	}
+	t.bytes = n
+	echo(Log{"t": "image_cache", "evicted": strconv.Itoa(evicted), "bytes": strconv.FormatInt(n, 10)})
+}
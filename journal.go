@@ -0,0 +1,67 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// JournalEntry represents an event sent to an app, as recorded in the event journal, one JSON object per line.
+// Sessions' tokens are left out.
+type JournalEntry struct {
+	Time     time.Time       `json:"time"`
+	Route    string          `json:"route"`
+	Client   string          `json:"client,omitempty"`
+	Subject  string          `json:"subject"`
+	Username string          `json:"username"`
+	Provider string          `json:"provider,omitempty"`
+	Groups   []string        `json:"groups,omitempty"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// Journal records the events sent to apps, in order, so that sessions can be replayed to reproduce bugs.
+type Journal struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+// OpenJournal opens a journal file, adding to it if it exists.
+func OpenJournal(path string) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600) // events carry user data
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{enc: json.NewEncoder(f)}, nil
+}
+
+// record adds an event sent to the app at route to the journal.
+func (j *Journal) record(route, clientID string, session *Session, data []byte) {
+	if j == nil {
+		return
+	}
+	if !json.Valid(data) {
+		echo(Log{"t": "journal", "route": route, "client": clientID, "error": "event is not JSON"})
+		return
+	}
+	e := JournalEntry{time.Now().UTC(), route, clientID, session.subject, session.username, session.providerName(), session.groups, data}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if err := j.enc.Encode(e); err != nil {
+		echo(Log{"t": "journal", "route": route, "client": clientID, "error": err.Error()})
+	}
+}
@@ -0,0 +1,28 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+func runElector(conf ServerConf) {
+	// Renew well within the TTL, so that brief storage hiccups don't cost leadership.
+	conf.Elector.Run(conf.LeaderLeaseTTL/3, nil, func(leader bool) {
+		if leader {
+			echo(Log{"t": "leader_elected"})
+		} else {
+			echo(Log{"t": "leader_lost"})
+		}
+	}, func(err error) {
+		echo(Log{"t": "leader_lease", "error": err.Error()})
+	})
+}
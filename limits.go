@@ -0,0 +1,70 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SocketLimits caps what each client may send over its websocket, to protect the server from malformed or
+// abusive clients.
+type SocketLimits struct {
+	MaxMessageSize int64 // bytes; larger messages close the connection
+	MaxMessageRate int   // messages per second; 0 for no limit
+	MaxBandwidth   int64 // bytes per second; 0 for no limit
+}
+
+// socketStats counts the messages received from clients, and the limits they ran into, across all clients.
+var socketStats struct {
+	messages  atomic.Int64
+	bytes     atomic.Int64
+	throttled atomic.Int64 // messages delayed to stay within the message rate or bandwidth
+	oversized atomic.Int64 // messages larger than the maximum size
+}
+
+// throttle paces the messages read from a client to stay within its limits, using a token bucket for each limit
+// that holds up to a second's worth of tokens, and so allows short bursts.
+type throttle struct {
+	limits   SocketLimits
+	messages float64 // tokens available; negative if owed
+	bytes    float64
+	last     time.Time
+}
+
+func newThrottle(limits SocketLimits) *throttle {
+	return &throttle{limits, float64(limits.MaxMessageRate), float64(limits.MaxBandwidth), time.Now()}
+}
+
+// wait takes the tokens for a message of n bytes, and returns how long to wait before handling it.
+func (t *throttle) wait(n int) time.Duration {
+	now := time.Now()
+	elapsed := now.Sub(t.last).Seconds()
+	t.last = now
+
+	var d time.Duration
+	take := func(tokens *float64, rate, cost float64) {
+		if rate <= 0 {
+			return
+		}
+		*tokens = min(*tokens+elapsed*rate, rate) - cost
+		if *tokens < 0 {
+			d = max(d, time.Duration(-*tokens/rate*float64(time.Second)))
+		}
+	}
+	take(&t.messages, float64(t.limits.MaxMessageRate), 1)
+	take(&t.bytes, float64(t.limits.MaxBandwidth), float64(n))
+	return d
+}
@@ -0,0 +1,133 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/coreos/go-oidc"
+)
+
+// Logouts initiated by identity providers, when users sign out there.
+// See https://openid.net/specs/openid-connect-backchannel-1_0.html
+// and https://openid.net/specs/openid-connect-frontchannel-1_0.html
+
+const backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// endSessions terminates sessions, reloading their users' browser tabs, which closes their websockets.
+func endSessions(broker *Broker, sessions []*Session, via string) {
+	for _, session := range sessions {
+		echo(Log{"t": "logout", "via": via, "subject": session.subject, "username": session.username})
+		broker.resetClients(session)
+	}
+}
+
+// BackchannelLogoutHandler handles logout tokens posted by identity providers.
+type BackchannelLogoutHandler struct {
+	auth   *Auth
+	broker *Broker
+}
+
+func newBackchannelLogoutHandler(auth *Auth, broker *Broker) http.Handler {
+	return &BackchannelLogoutHandler{auth, broker}
+}
+
+func (h *BackchannelLogoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	rawToken := r.PostFormValue("logout_token")
+	if rawToken == "" {
+		echo(Log{"t": "backchannel_logout", "error": "missing logout_token"})
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// The token is signed by the provider that issued it.
+	var (
+		provider *oidcProvider
+		token    *oidc.IDToken
+	)
+	for _, p := range h.auth.providers {
+		if t, err := p.verifier.Verify(r.Context(), rawToken); err == nil {
+			provider, token = p, t
+			break
+		}
+	}
+	if token == nil {
+		echo(Log{"t": "backchannel_logout", "error": "failed verifying logout_token"})
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	var claims struct {
+		SID    string                     `json:"sid"`
+		Events map[string]json.RawMessage `json:"events"`
+	}
+	if err := token.Claims(&claims); err != nil {
+		echo(Log{"t": "backchannel_logout", "error": "failed parsing token claims"})
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if _, ok := claims.Events[backchannelLogoutEvent]; !ok || token.Nonce != "" || (claims.SID == "" && token.Subject == "") {
+		echo(Log{"t": "backchannel_logout", "error": "invalid logout_token"})
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	endSessions(h.broker, h.auth.end(func(session *Session) bool {
+		return session.provider == provider &&
+			(claims.SID == "" || session.sid == claims.SID) &&
+			(token.Subject == "" || session.subject == token.Subject)
+	}), "backchannel")
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// FrontchannelLogoutHandler handles logout requests rendered by identity providers in the user's browser.
+type FrontchannelLogoutHandler struct {
+	auth   *Auth
+	broker *Broker
+}
+
+func newFrontchannelLogoutHandler(auth *Auth, broker *Broker) http.Handler {
+	return &FrontchannelLogoutHandler{auth, broker}
+}
+
+func (h *FrontchannelLogoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	// Identify sessions by the provider's session ID if given; browsers may not send cookies to iframes.
+	// Session IDs are unique only per provider, so the issuer is required too.
+	if sid := r.URL.Query().Get("sid"); sid != "" {
+		iss := r.URL.Query().Get("iss")
+		if iss == "" {
+			echo(Log{"t": "frontchannel_logout", "error": "missing iss"})
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		endSessions(h.broker, h.auth.end(func(session *Session) bool {
+			return session.provider != nil && session.provider.issuer == iss && session.sid == sid
+		}), "frontchannel")
+	} else if cookie, err := r.Cookie(authCookieName); err == nil {
+		endSessions(h.broker, h.auth.end(func(session *Session) bool { return session.id == cookie.Value }), "frontchannel")
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
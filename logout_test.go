@@ -0,0 +1,147 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"github.com/h2oai/wave/pkg/assert"
+	"golang.org/x/oauth2"
+)
+
+// testSignature marks tokens as signed by a testKeySet.
+const testSignature = "c2lnbmVk"
+
+// testKeySet accepts tokens carrying testSignature, in place of a provider's signing keys.
+type testKeySet struct{}
+
+func (testKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 || parts[2] != testSignature {
+		return nil, errors.New("bad signature")
+	}
+	return base64.RawURLEncoding.DecodeString(parts[1])
+}
+
+func newTestProvider(name, issuer string) *oidcProvider {
+	return &oidcProvider{
+		&OIDCProviderConf{Name: name},
+		&oauth2.Config{ClientID: "wave"},
+		issuer,
+		oidc.NewVerifier(issuer, testKeySet{}, &oidc.Config{ClientID: "wave"}),
+	}
+}
+
+func testToken(claims map[string]any, signature string) string {
+	b, _ := json.Marshal(claims)
+	enc := base64.RawURLEncoding.EncodeToString
+	return enc([]byte(`{"alg":"RS256"}`)) + "." + enc(b) + "." + signature
+}
+
+func newLogoutTest() (*Auth, *Broker) {
+	p1, p2 := newTestProvider("one", "https://one.example.com"), newTestProvider("two", "https://two.example.com")
+	expiry := time.Now().Add(time.Hour)
+	auth := &Auth{
+		conf:      &AuthConf{},
+		providers: []*oidcProvider{p1, p2},
+		sessions: map[string]*Session{
+			"s1": {id: "s1", provider: p1, sid: "abc", subject: "alice", expiry: expiry},
+			"s2": {id: "s2", provider: p2, sid: "abc", subject: "bob", expiry: expiry},
+		},
+	}
+	return auth, &Broker{logout: make(chan Pub, 10)}
+}
+
+func hasSession(auth *Auth, id string) bool {
+	auth.RLock()
+	defer auth.RUnlock()
+	_, ok := auth.sessions[id]
+	return ok
+}
+
+func TestFrontchannelLogout(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	auth, broker := newLogoutTest()
+	h := newFrontchannelLogoutHandler(auth, broker)
+
+	logout := func(query string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_auth/frontchannel-logout?"+query, nil))
+		return w.Code
+	}
+	// Session IDs are unique only per provider.
+	eq(logout("sid=abc"), http.StatusBadRequest)
+	ok(hasSession(auth, "s1") && hasSession(auth, "s2"), "ended sessions without iss")
+	eq(logout("sid=abc&iss="+url.QueryEscape("https://three.example.com")), http.StatusOK)
+	ok(hasSession(auth, "s1") && hasSession(auth, "s2"), "ended sessions of another issuer")
+	eq(logout("sid=abc&iss="+url.QueryEscape("https://one.example.com")), http.StatusOK)
+	ok(!hasSession(auth, "s1"), "kept session")
+	ok(hasSession(auth, "s2"), "ended session of another provider")
+	eq(len(broker.logout), 1)
+}
+
+func TestBackchannelLogout(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	auth, broker := newLogoutTest()
+	h := newBackchannelLogoutHandler(auth, broker)
+
+	logout := func(token string) int {
+		r := httptest.NewRequest(http.MethodPost, "/_auth/backchannel-logout", strings.NewReader(url.Values{"logout_token": {token}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	claims := func(iss string) map[string]any {
+		return map[string]any{
+			"iss":    iss,
+			"aud":    "wave",
+			"iat":    time.Now().Unix(),
+			"exp":    time.Now().Add(time.Minute).Unix(),
+			"sid":    "abc",
+			"events": map[string]any{backchannelLogoutEvent: map[string]any{}},
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_auth/backchannel-logout", nil))
+	eq(w.Code, http.StatusMethodNotAllowed)
+	eq(logout(""), http.StatusBadRequest)
+	eq(logout(testToken(claims("https://two.example.com"), "Zm9yZ2Vk")), http.StatusBadRequest)
+	eq(logout(testToken(claims("https://three.example.com"), testSignature)), http.StatusBadRequest)
+
+	c := claims("https://two.example.com")
+	c["nonce"] = "n"
+	eq(logout(testToken(c, testSignature)), http.StatusBadRequest)
+	c = claims("https://two.example.com")
+	delete(c, "events")
+	eq(logout(testToken(c, testSignature)), http.StatusBadRequest)
+	ok(hasSession(auth, "s1") && hasSession(auth, "s2"), "ended sessions with an invalid token")
+
+	eq(logout(testToken(claims("https://two.example.com"), testSignature)), http.StatusOK)
+	ok(hasSession(auth, "s1"), "ended session of another provider")
+	ok(!hasSession(auth, "s2"), "kept session")
+	eq(len(broker.logout), 1)
+}
@@ -0,0 +1,233 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+// routeCounts counts the messages sent to the clients watching a route.
+type routeCounts struct {
+	messages int64 // messages queued for clients
+	bytes    int64
+	dropped  int64 // messages dropped because clients' queues were full, queued or not
+}
+
+func (c *routeCounts) add(o routeCounts) {
+	c.messages += o.messages
+	c.bytes += o.bytes
+	c.dropped += o.dropped
+}
+
+// clientStats counts the messages sent to a client, by the route it watches. It has its own lock, rather than
+// the client's, which is held while writing to the client's connection.
+type clientStats struct {
+	lock   sync.Mutex
+	route  string // page watched, if any yet
+	counts routeCounts
+}
+
+func (s *clientStats) watch(route string) {
+	s.lock.Lock()
+	s.route = route
+	s.lock.Unlock()
+}
+
+func (s *clientStats) sent(size int) {
+	s.lock.Lock()
+	s.counts.messages++
+	s.counts.bytes += int64(size)
+	s.lock.Unlock()
+}
+
+func (s *clientStats) drop(n int) {
+	s.lock.Lock()
+	s.counts.dropped += int64(n)
+	s.lock.Unlock()
+}
+
+func (s *clientStats) snapshot() (string, routeCounts) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.route, s.counts
+}
+
+// routeTotals keeps the counts of clients that have gone, so that routes' counters never go down.
+type routeTotals struct {
+	lock   sync.Mutex
+	routes map[string]routeCounts
+}
+
+func newRouteTotals() *routeTotals {
+	return &routeTotals{routes: make(map[string]routeCounts)}
+}
+
+func (t *routeTotals) retire(c *Client) {
+	route, counts := c.stats.snapshot()
+	if route == "" {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	total := t.routes[route]
+	total.add(counts)
+	t.routes[route] = total
+}
+
+// watchQueue logs the client as a slow consumer once its queue is three quarters full, and again once it catches up.
+// Must be called with the client's queue lock held.
+func (c *Client) watchQueue() {
+	n, max := len(c.data), cap(c.data)
+	switch {
+	case !c.slow && n > 0 && n >= max*3/4:
+		c.slow = true
+		route, counts := c.stats.snapshot()
+		echo(Log{"t": "client_slow", "client": c.id, "subject": c.session.subject, "username": c.session.username, "route": route,
+			"queued": strconv.Itoa(n), "max": strconv.Itoa(max), "dropped": strconv.FormatInt(counts.dropped, 10)})
+	case c.slow && n <= max/4:
+		c.slow = false
+		echo(Log{"t": "client_caught_up", "client": c.id, "subject": c.session.subject, "username": c.session.username})
+	}
+}
+
+// routeMetrics describes the clients watching a route, and what was sent to them.
+type routeMetrics struct {
+	clients int // connected, rather than waiting to reconnect
+	queued  int // messages waiting to be sent
+	routeCounts
+}
+
+// metrics describes the clients watching each route, including the ones gone.
+func (b *Broker) metrics() map[string]*routeMetrics {
+	routes := make(map[string]*routeMetrics)
+	at := func(route string) *routeMetrics {
+		m, ok := routes[route]
+		if !ok {
+			m = &routeMetrics{}
+			routes[route] = m
+		}
+		return m
+	}
+	// Clients are retired and removed at once, under the same locks, so that none is counted twice, or not at all.
+	b.unicastsMux.RLock()
+	b.retired.lock.Lock()
+	for route, counts := range b.retired.routes {
+		at(route).add(counts)
+	}
+	b.retired.lock.Unlock()
+	watching := make(map[*Client]*routeMetrics, len(b.clientsByID))
+	for _, c := range b.clientsByID {
+		route, counts := c.stats.snapshot()
+		if route == "" {
+			continue
+		}
+		m := at(route)
+		m.add(counts)
+		m.queued += len(c.data)
+		watching[c] = m
+	}
+	b.unicastsMux.RUnlock()
+
+	for c, m := range watching {
+		if c.connected() {
+			m.clients++
+		}
+	}
+	return routes
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// MetricsHandler exports metrics in the Prometheus text format, for admins.
+//
+//	GET /_admin/metrics
+type MetricsHandler struct {
+	admins keychain.Authenticator
+	broker *Broker
+}
+
+func newMetricsHandler(admins keychain.Authenticator, broker *Broker) http.Handler {
+	return &MetricsHandler{admins, broker}
+}
+
+func (h *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.admins.Guard(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	routes := h.broker.metrics()
+	names := make([]string, 0, len(routes))
+	for route := range routes {
+		names = append(names, route)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	perRoute := func(name, kind, help string, value func(m *routeMetrics) int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, route := range names {
+			fmt.Fprintf(w, "%s{route=\"%s\"} %d\n", name, promLabelEscaper.Replace(route), value(routes[route]))
+		}
+	}
+	perRoute("wave_route_clients", "gauge", "Browsers connected, by page or app watched.",
+		func(m *routeMetrics) int64 { return int64(m.clients) })
+	perRoute("wave_route_queued_messages", "gauge", "Messages waiting to be sent to browsers, by page or app watched.",
+		func(m *routeMetrics) int64 { return int64(m.queued) })
+	perRoute("wave_route_messages_total", "counter", "Messages queued for browsers, by page or app watched.",
+		func(m *routeMetrics) int64 { return m.messages })
+	perRoute("wave_route_bytes_total", "counter", "Bytes queued for browsers, by page or app watched, before compression.",
+		func(m *routeMetrics) int64 { return m.bytes })
+	perRoute("wave_route_dropped_messages_total", "counter", "Messages dropped because browsers' queues were full, by page or app watched.",
+		func(m *routeMetrics) int64 { return m.dropped })
+
+	server := func(name, help string, value int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+	server("wave_received_messages_total", "Messages received from browsers.", socketStats.messages.Load())
+	server("wave_received_bytes_total", "Bytes received from browsers.", socketStats.bytes.Load())
+	server("wave_throttled_messages_total", "Messages from browsers delayed to stay within rate limits.", socketStats.throttled.Load())
+	server("wave_oversized_messages_total", "Messages from browsers larger than the maximum size.", socketStats.oversized.Load())
+
+	if apps := h.broker.limits.metrics(); len(apps) > 0 {
+		perApp := func(name, kind, help string, value func(m appMetrics) int64) {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+			for _, m := range apps {
+				fmt.Fprintf(w, "%s{app=\"%s\"} %d\n", name, promLabelEscaper.Replace(m.app), value(m))
+			}
+		}
+		perApp("wave_app_patches_total", "counter", "Patches accepted from apps, by API access key.",
+			func(m appMetrics) int64 { return m.patches })
+		perApp("wave_app_pages", "gauge", "Pages created by apps and kept, by API access key.",
+			func(m appMetrics) int64 { return int64(m.pages) })
+		name := "wave_app_limit_exceeded_total"
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, "Times apps exceeded their limits, by API access key and limit.", name)
+		for _, m := range apps {
+			for _, limit := range []string{"patch_rate", "pages", "buffer_size", "storage"} {
+				fmt.Fprintf(w, "%s{app=\"%s\",limit=\"%s\"} %d\n", name, promLabelEscaper.Replace(m.app), limit, m.exceeded[limit])
+			}
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"strings"
+
+	"github.com/h2oai/wave/pkg/keychain"
+	"github.com/h2oai/wave/pkg/mqtt"
+)
+
+// mqttRoute maps messages published to topics matching a filter to changes to a page.
+type mqttRoute struct {
+	filter string
+	route  string
+	key    string // if set, messages are values to set at this key, else changes, e.g. {"d":[...]}
+}
+
+// parseMQTTRoutes parses topic filters mapped to targets of the form "route" or "route key", e.g. "/dashboard + value".
+func parseMQTTRoutes(routes map[string]string) []mqttRoute {
+	var rs []mqttRoute
+	for filter, target := range routes {
+		route, key, _ := strings.Cut(target, " ")
+		rs = append(rs, mqttRoute{filter, route, strings.TrimSpace(key)})
+	}
+	return rs
+}
+
+// change returns the change to make to a page for a message published to a topic, or nil if the topic doesn't match.
+func (r mqttRoute) change(topic string, payload []byte) []byte {
+	levels, ok := mqtt.Wildcards(r.filter, topic)
+	if !ok {
+		return nil
+	}
+	if r.key == "" {
+		return payload
+	}
+	// Each + in the key stands for the topic level matched by the corresponding + in the filter.
+	key := r.key
+	for _, level := range levels {
+		key = strings.Replace(key, "+", level, 1)
+	}
+	var v any = string(payload)
+	if json.Valid(payload) {
+		v = json.RawMessage(payload)
+	}
+	b, err := json.Marshal(OpsD{D: []OpD{{K: key, V: v}}})
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// handleMQTT returns a handler that applies messages published by clients to the pages their topics are routed to.
+// Changes are authorized, validated and limited as if the client's access key had made them through the HTTP API.
+func handleMQTT(routes []mqttRoute, broker *Broker) func(username, topic string, payload []byte) {
+	return func(username, topic string, payload []byte) {
+		matched := false
+		for _, r := range routes {
+			data := r.change(topic, payload)
+			if data == nil {
+				continue
+			}
+			matched = true
+			if !broker.authorize(Identity{Key: username}, RoutePublish, r.route) {
+				echo(Log{"t": "mqtt_publish", "topic": topic, "route": r.route, "key": username, "error": "forbidden"})
+				continue
+			}
+			if err := broker.check(data); err != nil {
+				echo(Log{"t": "mqtt_publish", "topic": topic, "route": r.route, "error": err.Error()})
+				continue
+			}
+			if err := broker.limits.admit(username, r.route, broker.isUnicast(r.route), data); err != nil {
+				echo(Log{"t": "mqtt_publish", "topic": topic, "route": r.route, "key": username, "error": err.Error()})
+				continue
+			}
+			broker.patch(r.route, data, false)
+		}
+		if !matched {
+			echo(Log{"t": "mqtt_publish", "topic": topic, "error": "no route"})
+		}
+	}
+}
+
+// runMQTTServer accepts messages from MQTT clients, e.g. IoT devices, and applies them to pages.
+// Clients authenticate with an API access key ID and secret as their username and password.
+func runMQTTServer(conf ServerConf, broker *Broker, authn keychain.Authenticator) {
+	routes := parseMQTTRoutes(conf.MQTTRoutes)
+	s := &mqtt.Server{
+		Authenticate: func(username, password string) bool {
+			if !authn.VerifyContext(context.Background(), username, password) {
+				echo(Log{"t": "mqtt_connect", "key": username, "error": "unauthorized"})
+				return false
+			}
+			return true
+		},
+		Handle:  handleMQTT(routes, broker),
+		MaxSize: int(conf.MaxRequestSize),
+	}
+
+	lis, err := net.Listen("tcp", conf.MQTTListen)
+	if err != nil {
+		echo(Log{"t": "mqtt_listen", "error": err.Error()})
+		return
+	}
+	if conf.CertFile != "" && conf.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			echo(Log{"t": "mqtt_tls", "error": err.Error()})
+			return
+		}
+		lis = tls.NewListener(lis, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+	echo(Log{"t": "mqtt_listen", "address": conf.MQTTListen})
+	if err := s.Serve(lis); err != nil {
+		echo(Log{"t": "mqtt_serve", "error": err.Error()})
+	}
+}
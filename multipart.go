@@ -44,13 +44,13 @@ type MultipartFrame struct {
 type MultipartServer struct {
 	sync.RWMutex
 	prefix         string
-	keychain       *keychain.Keychain
+	keychain       keychain.Authenticator
 	auth           *Auth
 	maxRequestSize int64
 	sources        map[string]*MultipartSource
 }
 
-func newMultipartServer(prefix string, keychain *keychain.Keychain, auth *Auth, maxRequestSize int64) *MultipartServer {
+func newMultipartServer(prefix string, keychain keychain.Authenticator, auth *Auth, maxRequestSize int64) *MultipartServer {
 	return &MultipartServer{
 		prefix:         prefix,
 		keychain:       keychain,
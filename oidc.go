@@ -0,0 +1,225 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+	"gopkg.in/yaml.v3"
+)
+
+var oidcProviderNameRE = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// LoadOIDCProviders reads OIDC provider definitions from a YAML file:
+//
+//	providers:
+//	  - name: corp
+//	    label: Corporate SSO
+//	    client_id: wave
+//	    client_secret: s3cr3t
+//	    provider_url: https://sso.example.com/realms/corp
+//	    redirect_url: https://wave.example.com/_auth/callback
+//	    groups_claim: groups
+//	    groups:
+//	      wave-admins: admin
+//	  - name: google
+//	    label: Google
+//	    ...
+func LoadOIDCProviders(name string) ([]OIDCProviderConf, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading OIDC providers %s: %v", name, err)
+	}
+	var conf struct {
+		Providers []OIDCProviderConf `yaml:"providers"`
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&conf); err != nil {
+		return nil, fmt.Errorf("invalid OIDC providers %s: %v", name, err)
+	}
+	for _, p := range conf.Providers {
+		if p.ClientID == "" || p.ProviderURL == "" || p.RedirectURL == "" {
+			return nil, fmt.Errorf("OIDC provider %s: client_id, provider_url and redirect_url are required", p.Name)
+		}
+		if p.ClientSecret == "" && !p.PKCE {
+			return nil, fmt.Errorf("OIDC provider %s: client_secret is required unless pkce is enabled", p.Name)
+		}
+	}
+	return conf.Providers, checkOIDCProviders(conf.Providers)
+}
+
+func checkOIDCProviders(providers []OIDCProviderConf) error {
+	seen := make(map[string]bool)
+	for _, p := range providers {
+		if !oidcProviderNameRE.MatchString(p.Name) {
+			return fmt.Errorf("invalid OIDC provider name %q", p.Name)
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("duplicate OIDC provider %s", p.Name)
+		}
+		seen[p.Name] = true
+		for _, kv := range p.URLParameters {
+			if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+				return fmt.Errorf("OIDC provider %s: bad authorization url parameter: %v", p.Name, kv)
+			}
+		}
+		switch p.ResponseMode {
+		case "", "query", "form_post":
+		default:
+			return fmt.Errorf("OIDC provider %s: unsupported response mode %q; want query or form_post", p.Name, p.ResponseMode)
+		}
+	}
+	return nil
+}
+
+// oidcProvider is a connected identity provider.
+type oidcProvider struct {
+	conf     *OIDCProviderConf
+	oauth    *oauth2.Config
+	issuer   string                // issuer identifier, from discovery
+	verifier *oidc.IDTokenVerifier // verifies tokens signed by the provider, e.g. logout tokens
+}
+
+func connectToProvider(conf *OIDCProviderConf) (*oidcProvider, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	provider, err := oidc.NewProvider(ctx, conf.ProviderURL)
+	if err != nil {
+		return nil, err
+	}
+	scopes := authDefaultScopes
+	if len(conf.Scopes) > 0 && conf.Scopes[0] != "" {
+		scopes = conf.Scopes
+	}
+	var meta struct {
+		Issuer  string `json:"issuer"`
+		JWKSURL string `json:"jwks_uri"`
+	}
+	if err := provider.Claims(&meta); err != nil {
+		return nil, err
+	}
+	// Signing keys are fetched as tokens are verified, long after discovery, so they mustn't be bound to ctx.
+	verifier := oidc.NewVerifier(meta.Issuer, oidc.NewRemoteKeySet(context.Background(), meta.JWKSURL), &oidc.Config{ClientID: conf.ClientID})
+	endpoint := provider.Endpoint()
+	if conf.ClientSecret == "" {
+		// Public clients identify themselves in the request body, without credentials.
+		endpoint.AuthStyle = oauth2.AuthStyleInParams
+	}
+	return &oidcProvider{conf, &oauth2.Config{
+		ClientID:     conf.ClientID,
+		ClientSecret: conf.ClientSecret,
+		Endpoint:     endpoint,
+		RedirectURL:  conf.RedirectURL,
+		Scopes:       scopes,
+	}, meta.Issuer, verifier}, nil
+}
+
+// formPost reports whether the provider posts authorization responses from the browser, cross-site.
+func (p *oidcProvider) formPost() bool {
+	return p.conf.ResponseMode == "form_post"
+}
+
+func (p *oidcProvider) label() string {
+	if p.conf.Label != "" {
+		return p.conf.Label
+	}
+	return p.conf.Name
+}
+
+// identity reads the username and groups from the claims of an ID token.
+func (p *oidcProvider) identity(idToken *oidc.IDToken) (string, []string, error) {
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		return "", nil, err
+	}
+	usernameClaim := p.conf.UsernameClaim
+	if usernameClaim == "" {
+		usernameClaim = "preferred_username"
+	}
+	username, _ := claims[usernameClaim].(string)
+	if p.conf.GroupsClaim == "" {
+		return username, nil, nil
+	}
+	var groups []string
+	addGroup := func(g string) {
+		if len(p.conf.Groups) == 0 {
+			groups = append(groups, g)
+		} else if mapped, ok := p.conf.Groups[g]; ok {
+			groups = append(groups, mapped)
+		}
+	}
+	switch v := claim(claims, p.conf.GroupsClaim).(type) {
+	case string:
+		addGroup(v)
+	case []any:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				addGroup(s)
+			}
+		}
+	}
+	return username, groups, nil
+}
+
+// claim returns the value of a claim, which may be nested, e.g. "realm_access.roles".
+func claim(claims map[string]any, name string) any {
+	for {
+		k, rest, nested := strings.Cut(name, ".")
+		v, ok := claims[k]
+		if !ok || !nested {
+			return v
+		}
+		if claims, ok = v.(map[string]any); !ok {
+			return nil
+		}
+		name = rest
+	}
+}
+
+// ProvidersHandler lists the configured identity providers, for the login page.
+type ProvidersHandler struct {
+	auth *Auth
+}
+
+func newProvidersHandler(auth *Auth) http.Handler {
+	return &ProvidersHandler{auth}
+}
+
+func (h *ProvidersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	type provider struct {
+		Name  string `json:"name"`
+		Label string `json:"label"`
+	}
+	providers := make([]provider, len(h.auth.providers))
+	for i, p := range h.auth.providers {
+		providers[i] = provider{p.conf.Name, p.label()}
+	}
+	if h.auth.saml != nil {
+		providers = append(providers, provider{samlProviderName, "SAML"})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(providers)
+}
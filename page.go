@@ -23,8 +23,9 @@ import (
 // Page represents a web page.
 type Page struct {
 	sync.RWMutex
-	cards map[string]*Card
-	cache []byte
+	cards   map[string]*Card
+	cache   []byte
+	changes uint64 // changes made, for indexing
 }
 
 func newPage() *Page {
@@ -81,3 +82,13 @@ func loadPage(ns *Namespace, d *PageD) *Page {
 	}
 	return &Page{cards: cards}
 }
+
+// replacement returns a change that replaces a page's content with d's.
+func replacement(d *PageD) ([]byte, error) {
+	// Drop the page, then add back every card.
+	ops := []OpD{{}}
+	for k, c := range d.C {
+		ops = append(ops, OpD{K: k, D: c.D, B: c.B})
+	}
+	return json.Marshal(OpsD{D: ops})
+}
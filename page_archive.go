@@ -0,0 +1,347 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+const pageArchiveVersion = 1
+
+var errInvalidArchive = errors.New("invalid archive")
+
+// PageArchive describes a page archive, as recorded in its wave.json. The page itself, cards and data buffers,
+// is kept in page.json, in the same form browsers are sent pages, and the files it refers to in files/<key>.
+type PageArchive struct {
+	Version  int       `json:"version"`
+	Route    string    `json:"route"`
+	Time     time.Time `json:"time"`
+	FilesURL string    `json:"files_url"`       // the page refers to files at, e.g. /_f
+	Files    []string  `json:"files,omitempty"` // keys, e.g. <upload id>/report.pdf
+}
+
+// PageArchiver exports pages, with the files they refer to, to portable zip archives, and imports them, so that
+// pages curated on one server, e.g. dashboards in development, can be promoted to another.
+//
+//	GET  /_archive/<route>  download the page as an archive
+//	POST /_archive/<route>  replace the page with the one in an archive, uploading its files anew
+type PageArchiver struct {
+	prefix   string
+	broker   *Broker
+	files    *FileServer
+	keychain keychain.Authenticator
+	refs     *regexp.Regexp // references to files, capturing their keys
+}
+
+func newPageArchiver(prefix string, broker *Broker, files *FileServer, keychain keychain.Authenticator) *PageArchiver {
+	refs := regexp.MustCompile(regexp.QuoteMeta(files.baseURL+"/") + `([^/"'?#&\\\s)]+/[^"'?#&\\\s)]+)`)
+	return &PageArchiver{prefix, broker, files, keychain, refs}
+}
+
+func (a *PageArchiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.keychain.Guard(w, r) {
+		return
+	}
+	route := "/" + strings.TrimPrefix(r.URL.Path, a.prefix)
+	key, _, _ := r.BasicAuth()
+	switch r.Method {
+	case http.MethodGet:
+		if !a.broker.authorize(Identity{Key: key}, RouteRead, route) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		a.export(w, r, route)
+	case http.MethodPost:
+		if !a.broker.authorize(Identity{Key: key}, RoutePublish, route) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		a.load(w, r, route, "key:"+key)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// export writes the page at route, and the files it refers to, to a zip archive.
+func (a *PageArchiver) export(w http.ResponseWriter, r *http.Request, route string) {
+	page := a.broker.site.at(route)
+	if page == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	data := page.marshal()
+	if data == nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Leave out files that are gone, rather than fail half-way through.
+	var keys []string
+	seen := make(map[string]bool)
+	for _, m := range a.refs.FindAllSubmatch(data, -1) {
+		key := string(m[1])
+		if seen[key] || path.Clean(key) != key || strings.HasPrefix(key, "../") {
+			continue
+		}
+		seen[key] = true
+		f, _, err := a.files.openFile(r.Context(), key)
+		if err != nil {
+			echo(Log{"t": "page_archive", "route": route, "file": key, "error": err.Error()})
+			continue
+		}
+		f.Close()
+		keys = append(keys, key)
+	}
+	manifest, err := json.Marshal(PageArchive{pageArchiveVersion, route, time.Now().UTC(), a.files.baseURL, keys})
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	name := strings.Trim(strings.ReplaceAll(route, "/", "_"), "_")
+	if name == "" {
+		name = "index"
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".zip"}))
+	z := zip.NewWriter(w)
+	if err := a.write(r, z, time.Now(), manifest, data, keys); err != nil {
+		echo(Log{"t": "page_archive", "route": route, "error": err.Error()}) // too late to tell the client
+		return
+	}
+	if err := z.Close(); err != nil {
+		echo(Log{"t": "page_archive", "route": route, "error": err.Error()})
+		return
+	}
+	echo(Log{"t": "page_archive", "route": route, "files": strconv.Itoa(len(keys))})
+}
+
+func (a *PageArchiver) write(r *http.Request, z *zip.Writer, now time.Time, manifest, data []byte, keys []string) error {
+	for _, e := range []struct {
+		name string
+		data []byte
+	}{{"wave.json", manifest}, {"page.json", data}} {
+		f, err := z.CreateHeader(&zip.FileHeader{Name: e.name, Method: zip.Deflate, Modified: now})
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(e.data); err != nil {
+			return err
+		}
+	}
+	for _, key := range keys {
+		f, err := z.CreateHeader(&zip.FileHeader{Name: "files/" + key, Method: zip.Deflate, Modified: now})
+		if err != nil {
+			return err
+		}
+		src, _, err := a.files.openFile(r.Context(), key)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, src)
+		src.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// load replaces the page at route with the one in the zip archive in the request, uploading the files it refers to
+// on behalf of owner, as if uploaded anew, and pointing the page to them.
+func (a *PageArchiver) load(w http.ResponseWriter, r *http.Request, route, owner string) {
+	fs := a.files
+	if err := fs.quotas.check(owner, r.ContentLength); err != nil {
+		echo(Log{"t": "page_archive", "route": route, "error": err.Error()})
+		rejectUpload(w, err)
+		return
+	}
+	limit := fs.quotas.allowance(owner)
+	if limit >= 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+
+	// Archives are read from the end, so are spooled to disk first.
+	tmp, err := os.CreateTemp("", "wave-archive-")
+	if err != nil {
+		echo(Log{"t": "page_archive", "route": route, "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, r.Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			rejectUpload(w, fs.quotas.check(owner, limit+1))
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	z, err := zip.NewReader(tmp, size)
+	if err != nil {
+		http.Error(w, "invalid archive: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries := make(map[string]*zip.File)
+	var unpacked uint64
+	for _, f := range z.File {
+		entries[f.Name] = f
+		unpacked += f.UncompressedSize64
+	}
+	if err := fs.quotas.check(owner, int64(unpacked)); err != nil { // what's stored, not what's sent
+		rejectUpload(w, err)
+		return
+	}
+
+	var manifest PageArchive
+	if err := readArchived(entries, "wave.json", &manifest); err != nil {
+		http.Error(w, "invalid archive: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if manifest.Version != pageArchiveVersion {
+		http.Error(w, fmt.Sprintf("invalid archive: want version %d, got %d", pageArchiveVersion, manifest.Version), http.StatusBadRequest)
+		return
+	}
+	var data json.RawMessage
+	if err := readArchived(entries, "page.json", &data); err != nil {
+		http.Error(w, "invalid archive: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Upload the files anew, under ids of their own, in case they were archived here.
+	ids := make(map[string]string) // archived upload id => new upload id
+	var stored []storedFile
+	for _, key := range manifest.Files {
+		id, name, ok := strings.Cut(key, "/")
+		f := entries["files/"+key]
+		if !ok || path.Clean(key) != key || strings.HasPrefix(key, "../") || f == nil {
+			err = fmt.Errorf("%w: file %s missing", errInvalidArchive, key)
+			break
+		}
+		if _, ok := ids[id]; !ok {
+			newID, uerr := uuid.NewRandom()
+			if uerr != nil {
+				err = fmt.Errorf("failed generating file id: %v", uerr)
+				break
+			}
+			ids[id] = newID.String()
+		}
+		var src io.ReadCloser
+		if src, err = f.Open(); err != nil {
+			err = fmt.Errorf("%w: %v", errInvalidArchive, err)
+			break
+		}
+		var sf storedFile
+		sf, err = fs.storeFile(r.Context(), ids[id]+"/"+name, src)
+		src.Close()
+		if err != nil {
+			break
+		}
+		stored = append(stored, sf)
+	}
+	if err == nil {
+		err = fs.types.checkStored(r.Context(), fs.dir, fs.store, stored)
+	}
+	if err != nil {
+		echo(Log{"t": "page_archive", "route": route, "owner": owner, "error": err.Error()})
+		for _, id := range ids {
+			deleteUpload(fs.dir, fs.store, fs.cas, id)
+		}
+		switch {
+		case errors.Is(err, errContentType):
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		case errors.Is(err, errInvalidArchive):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Point the page to the files uploaded.
+	for id, newID := range ids {
+		data = bytes.ReplaceAll(data, []byte(manifest.FilesURL+"/"+id+"/"), []byte(fs.baseURL+"/"+newID+"/"))
+	}
+	var ops OpsD
+	if err := json.Unmarshal(data, &ops); err != nil || ops.P == nil {
+		for _, id := range ids {
+			deleteUpload(fs.dir, fs.store, fs.cas, id)
+		}
+		http.Error(w, "invalid archive: page.json has no page", http.StatusBadRequest)
+		return
+	}
+	msg, err := replacement(ops.P)
+	if err != nil {
+		echo(Log{"t": "page_archive", "route": route, "owner": owner, "error": err.Error()})
+		for _, id := range ids {
+			deleteUpload(fs.dir, fs.store, fs.cas, id)
+		}
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	fs.cas.intern(stored)
+	fs.quotas.add(owner, stored)
+	for _, f := range stored {
+		fs.audit.record(r, fileUpload, fs.baseURL+"/"+f.key, owner, f.size)
+	}
+	fs.held.hold(stored)
+	fs.held.check(stored)
+
+	a.broker.patch(route, msg, false)
+	echo(Log{"t": "page_archive", "route": route, "from": manifest.Route, "owner": owner, "cards": strconv.Itoa(len(ops.P.C)), "files": strconv.Itoa(len(stored))})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Route string `json:"route"`
+		Cards int    `json:"cards"`
+		Files int    `json:"files"`
+	}{route, len(ops.P.C), len(stored)})
+}
+
+// readArchived decodes a JSON entry of an archive.
+func readArchived(entries map[string]*zip.File, name string, v any) error {
+	f, ok := entries[name]
+	if !ok {
+		return fmt.Errorf("%s missing", name)
+	}
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := json.NewDecoder(r).Decode(v); err != nil {
+		return fmt.Errorf("failed reading %s: %v", name, err)
+	}
+	return nil
+}
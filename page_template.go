@@ -0,0 +1,338 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+var (
+	templateNameRE  = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+	templateParamRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	templateRefRE   = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+)
+
+// PageTemplate is a page layout, with placeholders, e.g. {{region}}, in its text, filled in when pages are made
+// from it.
+type PageTemplate struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Params      []TemplateParam `json:"params,omitempty"`
+	Page        *PageD          `json:"page,omitempty"`  // omitted when listed
+	Owner       string          `json:"owner,omitempty"` // key:<id> of the app that registered it
+	Updated     time.Time       `json:"updated"`
+}
+
+// TemplateParam is a placeholder in a page template.
+type TemplateParam struct {
+	Name    string  `json:"name"`
+	Default *string `json:"default,omitempty"` // required if none
+}
+
+func (t *PageTemplate) validate() error {
+	if !templateNameRE.MatchString(t.Name) {
+		return fmt.Errorf("invalid template name %q: want letters, digits, _, . or -", t.Name)
+	}
+	if t.Page == nil || len(t.Page.C) == 0 {
+		return errors.New("invalid template: want cards, got none")
+	}
+	declared := make(map[string]bool)
+	for _, p := range t.Params {
+		if !templateParamRE.MatchString(p.Name) {
+			return fmt.Errorf("invalid parameter name %q: want letters, digits or _", p.Name)
+		}
+		if declared[p.Name] {
+			return fmt.Errorf("parameter %q declared twice", p.Name)
+		}
+		declared[p.Name] = true
+	}
+	page, err := json.Marshal(t.Page)
+	if err != nil {
+		return err
+	}
+	for _, m := range templateRefRE.FindAllSubmatch(page, -1) {
+		if name := string(m[1]); !declared[name] {
+			return fmt.Errorf("placeholder {{%s}} is not a declared parameter", name)
+		}
+	}
+	return nil
+}
+
+// instantiate returns the template's page, with placeholders replaced by args, or their defaults.
+func (t *PageTemplate) instantiate(args map[string]string) (*PageD, error) {
+	values := make(map[string]string)
+	for _, p := range t.Params {
+		if v, ok := args[p.Name]; ok {
+			values[p.Name] = v
+		} else if p.Default != nil {
+			values[p.Name] = *p.Default
+		} else {
+			return nil, fmt.Errorf("missing parameter %q", p.Name)
+		}
+	}
+	for name := range args {
+		if _, ok := values[name]; !ok {
+			return nil, fmt.Errorf("unknown parameter %q", name)
+		}
+	}
+	page, err := json.Marshal(t.Page)
+	if err != nil {
+		return nil, err
+	}
+	// Placeholders are only ever inside JSON strings, so values are escaped as such.
+	page = templateRefRE.ReplaceAllFunc(page, func(ref []byte) []byte {
+		v, _ := json.Marshal(values[string(templateRefRE.FindSubmatch(ref)[1])])
+		return v[1 : len(v)-1]
+	})
+	var d PageD
+	if err := json.Unmarshal(page, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// PageTemplates keeps page templates in a JSON file, replaced only once written.
+type PageTemplates struct {
+	lock      sync.RWMutex
+	path      string
+	templates map[string]PageTemplate
+}
+
+// OpenPageTemplates loads the templates kept at path, if any.
+func OpenPageTemplates(path string) (*PageTemplates, error) {
+	t := &PageTemplates{path: path, templates: make(map[string]PageTemplate)}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return t, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &t.templates); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *PageTemplates) get(name string) (PageTemplate, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	tmpl, ok := t.templates[name]
+	return tmpl, ok
+}
+
+func (t *PageTemplates) all() []PageTemplate {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	templates := make([]PageTemplate, 0, len(t.templates))
+	for _, tmpl := range t.templates {
+		tmpl.Page = nil
+		templates = append(templates, tmpl)
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	return templates
+}
+
+func (t *PageTemplates) set(tmpl PageTemplate) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.templates[tmpl.Name] = tmpl
+	return t.save()
+}
+
+func (t *PageTemplates) remove(name string) (bool, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.templates[name]; !ok {
+		return false, nil
+	}
+	delete(t.templates, name)
+	return true, t.save()
+}
+
+// save writes the templates to disk, replacing the previous copy only once written.
+func (t *PageTemplates) save() error {
+	b, err := json.Marshal(t.templates)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0700); err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.path)
+}
+
+// PageTemplateHandler lets apps register page templates, and make pages from them.
+//
+//	GET    /_templates/                          list templates
+//	GET    /_templates/<name>                    get a template
+//	PUT    /_templates/<name>                    register a template: {"params": [{"name": "region"}], "cards": {...}}
+//	PUT    /_templates/<name>?from=/route        register the page at a route as a template: {"params": [...]}
+//	DELETE /_templates/<name>                    remove a template
+//	POST   /_templates/<name>?route=/sales/emea  make, or replace, a page from a template: {"region": "EMEA"}
+type PageTemplateHandler struct {
+	prefix         string
+	templates      *PageTemplates
+	broker         *Broker
+	keychain       keychain.Authenticator
+	maxRequestSize int64
+}
+
+func newPageTemplateHandler(prefix string, templates *PageTemplates, broker *Broker, keychain keychain.Authenticator, maxRequestSize int64) http.Handler {
+	return &PageTemplateHandler{prefix, templates, broker, keychain, maxRequestSize}
+}
+
+func (h *PageTemplateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.keychain.Guard(w, r) {
+		return
+	}
+	key, _, _ := r.BasicAuth()
+	name := strings.TrimPrefix(r.URL.Path, h.prefix)
+	if name == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.templates.all())
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		tmpl, ok := h.templates.get(name)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tmpl)
+	case http.MethodPut:
+		b, err := readRequestWithLimit(w, r.Body, h.maxRequestSize)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		var req struct {
+			Description string                    `json:"description"`
+			Params      []TemplateParam           `json:"params"`
+			Cards       map[string]map[string]any `json:"cards"` // key => card, as apps make them
+		}
+		if err := json.Unmarshal(b, &req); err != nil {
+			http.Error(w, "invalid template: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		tmpl := PageTemplate{name, req.Description, req.Params, &PageD{C: make(map[string]CardD)}, "key:" + key, time.Now().UTC()}
+		if from := r.URL.Query().Get("from"); from != "" {
+			if !h.broker.authorize(Identity{Key: key}, RouteRead, from) {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			page := h.broker.site.at(from)
+			if page == nil {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			page.RLock()
+			tmpl.Page = page.dump()
+			page.RUnlock()
+		} else {
+			for k, c := range req.Cards {
+				tmpl.Page.C[k] = CardD{D: c}
+			}
+		}
+		if err := tmpl.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.templates.set(tmpl); err != nil {
+			echo(Log{"t": "page_template", "name": name, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		echo(Log{"t": "page_template", "name": name, "by": tmpl.Owner, "cards": strconv.Itoa(len(tmpl.Page.C))})
+	case http.MethodDelete:
+		ok, err := h.templates.remove(name)
+		if err != nil {
+			echo(Log{"t": "page_template", "name": name, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		echo(Log{"t": "page_template", "name": name, "by": "key:" + key, "removed": "true"})
+	case http.MethodPost:
+		route := r.URL.Query().Get("route")
+		if !strings.HasPrefix(route, "/") {
+			http.Error(w, "want route, e.g. ?route=/sales/emea", http.StatusBadRequest)
+			return
+		}
+		if !h.broker.authorize(Identity{Key: key}, RoutePublish, route) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		tmpl, ok := h.templates.get(name)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		b, err := readRequestWithLimit(w, r.Body, h.maxRequestSize)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		args := make(map[string]string)
+		if len(bytes.TrimSpace(b)) > 0 {
+			if err := json.Unmarshal(b, &args); err != nil {
+				http.Error(w, "invalid parameters: want an object of strings: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		page, err := tmpl.instantiate(args)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, err := replacement(page)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		h.broker.patch(route, data, false)
+		echo(Log{"t": "page_template", "name": name, "route": route, "by": "key:" + key})
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const azureVersion = "2020-10-02"
+
+// Azure is a container in Azure Blob Storage.
+type Azure struct {
+	account   string
+	container string
+	endpoint  string // scheme://host[/path] of the account
+	key       []byte // shared key; nil if using a SAS token
+	sas       string // shared access signature, as a query string
+}
+
+// NewAzure creates a client for a container in Azure Blob Storage, authorized with the storage account's shared key
+// in AZURE_STORAGE_KEY, or else with the shared access signature (SAS) in AZURE_STORAGE_SAS_TOKEN.
+// Set endpoint to use another endpoint than the account's default, e.g. an emulator.
+func NewAzure(account, container, endpoint string) (*Azure, error) {
+	if account == "" || container == "" {
+		return nil, errors.New("azure: want account and container names")
+	}
+	if endpoint == "" {
+		endpoint = "https://" + account + ".blob.core.windows.net"
+	}
+	a := &Azure{account: account, container: container, endpoint: strings.TrimSuffix(endpoint, "/")}
+	if key := os.Getenv("AZURE_STORAGE_KEY"); key != "" {
+		b, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("azure: invalid AZURE_STORAGE_KEY: %v", err)
+		}
+		a.key = b
+	} else if sas := os.Getenv("AZURE_STORAGE_SAS_TOKEN"); sas != "" {
+		a.sas = strings.TrimPrefix(sas, "?")
+	} else {
+		return nil, errors.New("azure: want AZURE_STORAGE_KEY or AZURE_STORAGE_SAS_TOKEN, got none")
+	}
+	return a, nil
+}
+
+// do signs and sends a request to the container, or one of its blobs, and fails unless the response status is want.
+func (a *Azure) do(ctx context.Context, method, key, query string, header http.Header, body []byte, want int) (*http.Response, error) {
+	u := a.endpoint + "/" + a.container
+	if key != "" {
+		u += "/" + uriEncode(key, false)
+	}
+	if a.sas != "" {
+		if query != "" {
+			query += "&"
+		}
+		query += a.sas
+	}
+	if query != "" {
+		u += "?" + query
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("X-Ms-Version", azureVersion)
+	if a.key != nil {
+		a.sign(req)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != want {
+		defer resp.Body.Close()
+		return nil, statusError("azure", method, key, resp)
+	}
+	return resp, nil
+}
+
+// sign signs a request with the account's shared key.
+func (a *Azure) sign(req *http.Request) {
+	length := ""
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+	h := req.Header
+	var b strings.Builder
+	for _, s := range []string{req.Method, h.Get("Content-Encoding"), h.Get("Content-Language"), length, h.Get("Content-Md5"),
+		h.Get("Content-Type"), "", h.Get("If-Modified-Since"), h.Get("If-Match"), h.Get("If-None-Match"), h.Get("If-Unmodified-Since"),
+		h.Get("Range")} {
+		b.WriteString(s + "\n")
+	}
+
+	var names []string
+	for k := range h {
+		if k := strings.ToLower(k); strings.HasPrefix(k, "x-ms-") {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		b.WriteString(k + ":" + strings.TrimSpace(h.Get(k)) + "\n")
+	}
+
+	b.WriteString("/" + a.account + req.URL.EscapedPath())
+	q := req.URL.Query()
+	params := make([]string, 0, len(q))
+	for k := range q {
+		params = append(params, k)
+	}
+	sort.Strings(params)
+	for _, k := range params {
+		vs := q[k]
+		sort.Strings(vs)
+		b.WriteString("\n" + strings.ToLower(k) + ":" + strings.Join(vs, ","))
+	}
+
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(b.String()))
+	h.Set("Authorization", "SharedKey "+a.account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+func (a *Azure) Put(ctx context.Context, key, contentType string, r io.Reader) error {
+	p := newParts(r, partSize)
+	part, last, err := p.next()
+	if err != nil {
+		return err
+	}
+	if last {
+		header := http.Header{"Content-Type": {contentType}, "X-Ms-Blob-Type": {"BlockBlob"}}
+		resp, err := a.do(ctx, http.MethodPut, key, "", header, part, http.StatusCreated)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	// Upload blocks, then commit them. Uncommitted blocks are garbage-collected by the service.
+	var ids []string
+	for n := 0; ; n++ {
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", n))) // all IDs must be the same length
+		resp, err := a.do(ctx, http.MethodPut, key, "comp=block&blockid="+uriEncode(id, true), nil, part, http.StatusCreated)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		ids = append(ids, id)
+		if last {
+			break
+		}
+		if part, last, err = p.next(); err != nil {
+			return err
+		}
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string `xml:"Latest"`
+	}{Latest: ids})
+	if err != nil {
+		return err
+	}
+	header := http.Header{"X-Ms-Blob-Content-Type": {contentType}}
+	resp, err := a.do(ctx, http.MethodPut, key, "comp=blocklist", header, append([]byte(xml.Header), body...), http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (a *Azure) Get(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	want := http.StatusOK
+	if r := rangeHeader(offset); r != "" {
+		header.Set("Range", r)
+		want = http.StatusPartialContent
+	}
+	resp, err := a.do(ctx, http.MethodGet, key, "", header, nil, want)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (a *Azure) Stat(ctx context.Context, key string) (Info, error) {
+	resp, err := a.do(ctx, http.MethodHead, key, "", nil, nil, http.StatusOK)
+	if err != nil {
+		return Info{}, err
+	}
+	resp.Body.Close()
+	return parseInfo(resp.Header, resp.ContentLength), nil
+}
+
+func (a *Azure) DeletePrefix(ctx context.Context, prefix string) (int, error) {
+	n := 0
+	marker := ""
+	for {
+		query := "restype=container&comp=list&prefix=" + uriEncode(prefix, true)
+		if marker != "" {
+			query += "&marker=" + uriEncode(marker, true)
+		}
+		resp, err := a.do(ctx, http.MethodGet, "", query, nil, nil, http.StatusOK)
+		if err != nil {
+			return n, err
+		}
+		var list struct {
+			Blobs []struct {
+				Name string
+			} `xml:"Blobs>Blob"`
+			NextMarker string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return n, fmt.Errorf("azure: GET %s: %v", prefix, err)
+		}
+		for _, b := range list.Blobs {
+			resp, err := a.do(ctx, http.MethodDelete, b.Name, "", nil, nil, http.StatusAccepted)
+			if err != nil {
+				return n, err
+			}
+			resp.Body.Close()
+			n++
+		}
+		if list.NextMarker == "" {
+			return n, nil
+		}
+		marker = list.NextMarker
+	}
+}
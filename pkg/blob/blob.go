@@ -0,0 +1,243 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package blob is a minimal object storage client for Amazon S3 (and S3-compatible services, e.g. MinIO),
+// Google Cloud Storage and Azure Blob Storage, speaking their REST APIs directly.
+//
+// Objects are uploaded in parts, so that large files are streamed rather than held in memory,
+// and read from any offset, for range requests.
+package blob
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned for objects that do not exist.
+var ErrNotFound = errors.New("object not found")
+
+// Info describes an object.
+type Info struct {
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+// Bucket stores objects by key, e.g. "7a0e.../report.pdf".
+type Bucket interface {
+	// Put stores what r reads, to the end, at key.
+	Put(ctx context.Context, key, contentType string, r io.Reader) error
+	// Get reads the object at key, starting offset bytes in.
+	Get(ctx context.Context, key string, offset int64) (io.ReadCloser, error)
+	// Stat describes the object at key.
+	Stat(ctx context.Context, key string) (Info, error)
+	// DeletePrefix deletes every object whose key starts with prefix, and returns how many it deleted.
+	DeletePrefix(ctx context.Context, prefix string) (int, error)
+}
+
+// partSize is the size of the parts objects are uploaded in; objects smaller than this are uploaded at once.
+// It is a multiple of 256KiB, as Cloud Storage requires, and at least 5MiB, as S3 requires.
+const partSize = 8 << 20
+
+var httpClient = &http.Client{Timeout: 5 * time.Minute}
+
+// Open returns the bucket at a URL of the form:
+//
+//	s3://bucket[/prefix][?region=us-east-1][&endpoint=http://localhost:9000]
+//	gs://bucket[/prefix][?endpoint=http://localhost:4443]
+//	azblob://account/container[/prefix][?endpoint=http://localhost:10000/account]
+//
+// Credentials are read from the environment, as described by NewS3, NewGCS and NewAzure.
+// Objects are stored under prefix, if any.
+func Open(rawURL string) (Bucket, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bucket URL: %v", err)
+	}
+	q := u.Query()
+	prefix := strings.Trim(u.Path, "/")
+	var b Bucket
+	switch u.Scheme {
+	case "s3":
+		b, err = NewS3(u.Host, q.Get("region"), q.Get("endpoint"))
+	case "gs":
+		b, err = NewGCS(u.Host, q.Get("endpoint"))
+	case "azblob":
+		container, rest, _ := strings.Cut(prefix, "/")
+		prefix = rest
+		b, err = NewAzure(u.Host, container, q.Get("endpoint"))
+	default:
+		return nil, fmt.Errorf("invalid bucket URL: want s3://, gs:// or azblob://, got %s://", u.Scheme)
+	}
+	if err != nil || prefix == "" {
+		return b, err
+	}
+	return &prefixed{b, prefix + "/"}, nil
+}
+
+// prefixed stores objects under a prefix.
+type prefixed struct {
+	b      Bucket
+	prefix string
+}
+
+func (p *prefixed) Put(ctx context.Context, key, contentType string, r io.Reader) error {
+	return p.b.Put(ctx, p.prefix+key, contentType, r)
+}
+
+func (p *prefixed) Get(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	return p.b.Get(ctx, p.prefix+key, offset)
+}
+
+func (p *prefixed) Stat(ctx context.Context, key string) (Info, error) {
+	return p.b.Stat(ctx, p.prefix+key)
+}
+
+func (p *prefixed) DeletePrefix(ctx context.Context, prefix string) (int, error) {
+	return p.b.DeletePrefix(ctx, p.prefix+prefix)
+}
+
+// parts splits a stream into parts of up to partSize bytes, telling the last one, which is never empty
+// unless the stream is.
+type parts struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func newParts(r io.Reader, size int) *parts {
+	return &parts{bufio.NewReader(r), make([]byte, size)}
+}
+
+// next returns the next part, valid until the next call, and whether it is the last.
+func (p *parts) next() ([]byte, bool, error) {
+	n, err := io.ReadFull(p.r, p.buf)
+	switch err {
+	case nil:
+		if _, err := p.r.Peek(1); err == io.EOF {
+			return p.buf[:n], true, nil
+		} else if err != nil {
+			return nil, false, err
+		}
+		return p.buf[:n], false, nil
+	case io.EOF, io.ErrUnexpectedEOF:
+		return p.buf[:n], true, nil
+	}
+	return nil, false, err
+}
+
+// Reader reads an object, seeking by reading again from the new offset, e.g. for http.ServeContent.
+type Reader struct {
+	ctx    context.Context
+	b      Bucket
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser // nil until read, or after seeking
+}
+
+// NewReader creates a reader for the object at key, of the given size.
+func NewReader(ctx context.Context, b Bucket, key string, size int64) *Reader {
+	return &Reader{ctx: ctx, b: b, key: key, size: size}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		body, err := r.b.Get(r.ctx, r.key, r.offset)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if offset != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// Close closes the object being read, if any.
+func (r *Reader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+// rangeHeader returns the value of a Range header to read from offset to the end, or "" to read everything.
+func rangeHeader(offset int64) string {
+	if offset <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("bytes=%d-", offset)
+}
+
+// statusError describes an unexpected response, reading the service's error message from its body.
+func statusError(service, op, key string, resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if len(msg) > 0 {
+		return fmt.Errorf("%s: %s %s: %s: %s", service, op, key, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return fmt.Errorf("%s: %s %s: %s", service, op, key, resp.Status)
+}
+
+// uriEncode percent-encodes s, leaving only unreserved characters, and slashes unless escapeSlash.
+func uriEncode(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !escapeSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// parseInfo describes an object from the headers of a response to a GET or HEAD request.
+func parseInfo(h http.Header, size int64) Info {
+	t, _ := http.ParseTime(h.Get("Last-Modified"))
+	return Info{size, h.Get("Content-Type"), t}
+}
@@ -0,0 +1,264 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blob
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metadataTokenURL is where VMs and pods in Google Cloud get access tokens for their service account.
+const metadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// GCS is a bucket in Google Cloud Storage.
+type GCS struct {
+	bucket   string
+	endpoint string // scheme://host
+	static   string // access token from the environment, if any
+	auth     bool   // false for emulators
+
+	lock    sync.Mutex
+	token   string // from the metadata server
+	expires time.Time
+}
+
+// NewGCS creates a client for a Cloud Storage bucket, authorized with the access token in GOOGLE_OAUTH_ACCESS_TOKEN,
+// or else with the tokens of the service account of the VM or pod the server runs on, from the metadata server.
+// Set endpoint, or STORAGE_EMULATOR_HOST, to use an emulator, without authorization.
+func NewGCS(bucket, endpoint string) (*GCS, error) {
+	if bucket == "" {
+		return nil, errors.New("gcs: want bucket name, got none")
+	}
+	auth := true
+	if endpoint == "" {
+		if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+			endpoint = host
+			if !strings.Contains(host, "://") {
+				endpoint = "http://" + host
+			}
+		}
+	}
+	if endpoint != "" {
+		auth = false
+	} else {
+		endpoint = "https://storage.googleapis.com"
+	}
+	return &GCS{bucket: bucket, endpoint: strings.TrimSuffix(endpoint, "/"), static: os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"), auth: auth}, nil
+}
+
+// accessToken returns a token to authorize requests with, fetching a new one from the metadata server if need be.
+func (g *GCS) accessToken(ctx context.Context) (string, error) {
+	if g.static != "" {
+		return g.static, nil
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.token != "" && time.Now().Before(g.expires) {
+		return g.token, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("gcs: failed getting access token: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("gcs: failed getting access token: %s", resp.Status)
+	}
+	var t struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", fmt.Errorf("gcs: failed getting access token: %v", err)
+	}
+	g.token, g.expires = t.AccessToken, time.Now().Add(time.Duration(t.ExpiresIn)*time.Second-time.Minute)
+	return g.token, nil
+}
+
+func (g *GCS) objectURL(key string) string {
+	return g.endpoint + "/storage/v1/b/" + uriEncode(g.bucket, true) + "/o/" + uriEncode(key, true)
+}
+
+func (g *GCS) uploadURL(uploadType, key string) string {
+	return g.endpoint + "/upload/storage/v1/b/" + uriEncode(g.bucket, true) + "/o?uploadType=" + uploadType + "&name=" + uriEncode(key, true)
+}
+
+// do authorizes and sends a request, and fails unless the response status is one of want.
+func (g *GCS) do(ctx context.Context, method, url, key string, header http.Header, body []byte, want ...int) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if g.auth {
+		token, err := g.accessToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range want {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	return nil, statusError("gcs", method, key, resp)
+}
+
+func (g *GCS) Put(ctx context.Context, key, contentType string, r io.Reader) error {
+	p := newParts(r, partSize)
+	part, last, err := p.next()
+	if err != nil {
+		return err
+	}
+	if last {
+		resp, err := g.do(ctx, http.MethodPost, g.uploadURL("media", key), key, http.Header{"Content-Type": {contentType}}, part, http.StatusOK)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	// Start a resumable upload, then send each part to the session's URL.
+	resp, err := g.do(ctx, http.MethodPost, g.uploadURL("resumable", key), key, http.Header{"X-Upload-Content-Type": {contentType}}, nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return fmt.Errorf("gcs: POST %s: no upload session", key)
+	}
+	var offset int64
+	for {
+		end := offset + int64(len(part)) - 1
+		total := "*"
+		if last {
+			total = strconv.FormatInt(end+1, 10)
+		}
+		header := http.Header{"Content-Range": {fmt.Sprintf("bytes %d-%d/%s", offset, end, total)}}
+		resp, err := g.do(ctx, http.MethodPut, session, key, header, part, http.StatusOK, http.StatusCreated, http.StatusPermanentRedirect)
+		if err != nil {
+			if resp, err := g.do(ctx, http.MethodDelete, session, key, nil, nil, 499); err == nil { // cancel
+				resp.Body.Close()
+			}
+			return err
+		}
+		resp.Body.Close()
+		if last {
+			return nil
+		}
+		offset = end + 1
+		if part, last, err = p.next(); err != nil {
+			return err
+		}
+	}
+}
+
+func (g *GCS) Get(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	want := http.StatusOK
+	if r := rangeHeader(offset); r != "" {
+		header.Set("Range", r)
+		want = http.StatusPartialContent
+	}
+	resp, err := g.do(ctx, http.MethodGet, g.objectURL(key)+"?alt=media", key, header, nil, want)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (g *GCS) Stat(ctx context.Context, key string) (Info, error) {
+	resp, err := g.do(ctx, http.MethodGet, g.objectURL(key), key, nil, nil, http.StatusOK)
+	if err != nil {
+		return Info{}, err
+	}
+	defer resp.Body.Close()
+	var o struct {
+		Size        string    `json:"size"` // int64 as string
+		ContentType string    `json:"contentType"`
+		Updated     time.Time `json:"updated"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&o); err != nil {
+		return Info{}, fmt.Errorf("gcs: GET %s: %v", key, err)
+	}
+	size, err := strconv.ParseInt(o.Size, 10, 64)
+	if err != nil {
+		return Info{}, fmt.Errorf("gcs: GET %s: invalid size %q", key, o.Size)
+	}
+	return Info{size, o.ContentType, o.Updated}, nil
+}
+
+func (g *GCS) DeletePrefix(ctx context.Context, prefix string) (int, error) {
+	n := 0
+	page := ""
+	for {
+		url := g.endpoint + "/storage/v1/b/" + uriEncode(g.bucket, true) + "/o?fields=items(name),nextPageToken&prefix=" + uriEncode(prefix, true)
+		if page != "" {
+			url += "&pageToken=" + uriEncode(page, true)
+		}
+		resp, err := g.do(ctx, http.MethodGet, url, prefix, nil, nil, http.StatusOK)
+		if err != nil {
+			return n, err
+		}
+		var list struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return n, fmt.Errorf("gcs: GET %s: %v", prefix, err)
+		}
+		for _, o := range list.Items {
+			resp, err := g.do(ctx, http.MethodDelete, g.objectURL(o.Name), o.Name, nil, nil, http.StatusNoContent)
+			if err != nil {
+				return n, err
+			}
+			resp.Body.Close()
+			n++
+		}
+		if list.NextPageToken == "" {
+			return n, nil
+		}
+		page = list.NextPageToken
+	}
+}
@@ -0,0 +1,317 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// emptySHA256 is the SHA-256 hash of an empty payload.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3 is a bucket in Amazon S3, or an S3-compatible service.
+type S3 struct {
+	bucket   string
+	region   string
+	endpoint string // scheme://host, for path-style requests; empty for AWS, which gets virtual-hosted-style requests
+	keyID    string
+	secret   string
+	token    string // session token, for temporary credentials
+}
+
+// NewS3 creates a client for an S3 bucket, with the credentials in AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and,
+// for temporary credentials, AWS_SESSION_TOKEN. The region defaults to AWS_REGION, or else us-east-1.
+// Set endpoint to use an S3-compatible service instead of AWS.
+func NewS3(bucket, region, endpoint string) (*S3, error) {
+	if bucket == "" {
+		return nil, errors.New("s3: want bucket name, got none")
+	}
+	if region == "" {
+		if region = os.Getenv("AWS_REGION"); region == "" {
+			region = "us-east-1"
+		}
+	}
+	keyID, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if keyID == "" || secret == "" {
+		return nil, errors.New("s3: want AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, got none")
+	}
+	return &S3{bucket, region, strings.TrimSuffix(endpoint, "/"), keyID, secret, os.Getenv("AWS_SESSION_TOKEN")}, nil
+}
+
+func (s *S3) url(key, query string) string {
+	u := "https://" + s.bucket + ".s3." + s.region + ".amazonaws.com/" + uriEncode(key, false)
+	if s.endpoint != "" {
+		u = s.endpoint + "/" + s.bucket + "/" + uriEncode(key, false)
+	}
+	if query != "" {
+		u += "?" + query
+	}
+	return u
+}
+
+// do signs and sends a request, and fails unless the response status is want.
+func (s *S3) do(ctx context.Context, method, key, query string, header http.Header, body []byte, want int) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.url(key, query), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	hash := emptySHA256
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		hash = hex.EncodeToString(sum[:])
+	}
+	s.sign(req, hash, time.Now())
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != want {
+		defer resp.Body.Close()
+		return nil, statusError("s3", method, key, resp)
+	}
+	return resp, nil
+}
+
+// sign signs a request with AWS Signature Version 4.
+func (s *S3) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.token != "" {
+		req.Header.Set("X-Amz-Security-Token", s.token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		if k := strings.ToLower(k); strings.HasPrefix(k, "x-amz-") || k == "range" || k == "content-type" {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	q := req.URL.Query()
+	params := make([]string, 0, len(q))
+	for k, vs := range q {
+		for _, v := range vs {
+			params = append(params, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(params)
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secret), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.keyID+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func (s *S3) Put(ctx context.Context, key, contentType string, r io.Reader) error {
+	header := http.Header{"Content-Type": {contentType}}
+	p := newParts(r, partSize)
+	part, last, err := p.next()
+	if err != nil {
+		return err
+	}
+	if last {
+		resp, err := s.do(ctx, http.MethodPut, key, "", header, part, http.StatusOK)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	resp, err := s.do(ctx, http.MethodPost, key, "uploads=", header, nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	var upload struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&upload)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("s3: POST %s: %v", key, err)
+	}
+	uploadID := "uploadId=" + uriEncode(upload.UploadID, true)
+
+	if err := s.putParts(ctx, key, uploadID, p, part, last); err != nil {
+		if resp, err := s.do(ctx, http.MethodDelete, key, uploadID, nil, nil, http.StatusNoContent); err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+// putParts uploads the parts of a multipart upload, starting with part, and completes the upload.
+func (s *S3) putParts(ctx context.Context, key, uploadID string, p *parts, part []byte, last bool) error {
+	var done []s3Part
+	for n := 1; ; n++ {
+		resp, err := s.do(ctx, http.MethodPut, key, "partNumber="+strconv.Itoa(n)+"&"+uploadID, nil, part, http.StatusOK)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		done = append(done, s3Part{n, resp.Header.Get("ETag")})
+		if last {
+			break
+		}
+		if part, last, err = p.next(); err != nil {
+			return err
+		}
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: done})
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodPost, key, uploadID, nil, body, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Completing may fail after the response status has been sent.
+	var result struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("s3: POST %s: %v", key, err)
+	}
+	if result.XMLName.Local == "Error" {
+		return fmt.Errorf("s3: POST %s: %s: %s", key, result.Code, result.Message)
+	}
+	return nil
+}
+
+func (s *S3) Get(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	want := http.StatusOK
+	if r := rangeHeader(offset); r != "" {
+		header.Set("Range", r)
+		want = http.StatusPartialContent
+	}
+	resp, err := s.do(ctx, http.MethodGet, key, "", header, nil, want)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (Info, error) {
+	resp, err := s.do(ctx, http.MethodHead, key, "", nil, nil, http.StatusOK)
+	if err != nil {
+		return Info{}, err
+	}
+	resp.Body.Close()
+	return parseInfo(resp.Header, resp.ContentLength), nil
+}
+
+func (s *S3) DeletePrefix(ctx context.Context, prefix string) (int, error) {
+	n := 0
+	token := ""
+	for {
+		query := "list-type=2&prefix=" + uriEncode(prefix, true)
+		if token != "" {
+			query += "&continuation-token=" + uriEncode(token, true)
+		}
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, nil, http.StatusOK)
+		if err != nil {
+			return n, err
+		}
+		var list struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return n, fmt.Errorf("s3: GET %s: %v", prefix, err)
+		}
+		for _, c := range list.Contents {
+			resp, err := s.do(ctx, http.MethodDelete, c.Key, "", nil, nil, http.StatusNoContent)
+			if err != nil {
+				return n, err
+			}
+			resp.Body.Close()
+			n++
+		}
+		if !list.IsTruncated {
+			return n, nil
+		}
+		token = list.NextContinuationToken
+	}
+}
@@ -0,0 +1,321 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package imaging resizes, crops and converts images, e.g. to make thumbnails, using only the standard library's
+// codecs: PNG, JPEG and GIF.
+package imaging
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrUnsupported is returned for images in formats that can't be decoded.
+	ErrUnsupported = errors.New("unsupported image format")
+	// ErrTooLarge is returned for images with more pixels than allowed.
+	ErrTooLarge = errors.New("image too large")
+)
+
+// Fit modes, deciding how images are resized to both a width and a height.
+const (
+	FitContain = "contain" // scale to fit within the box, keeping the aspect ratio
+	FitCover   = "cover"   // scale to cover the box, keeping the aspect ratio, and crop the rest
+	FitFill    = "fill"    // stretch to fill the box
+)
+
+// MaxSize is the largest width or height images can be resized to.
+const MaxSize = 8192
+
+// Options describe a transformation.
+type Options struct {
+	Width   int             // 0 to scale with the height
+	Height  int             // 0 to scale with the width
+	Fit     string          // FitContain, FitCover or FitFill
+	Crop    image.Rectangle // applied before resizing; empty for none
+	Format  string          // png, jpeg or gif; "" to keep the image's
+	Quality int             // for jpeg, 1-100
+}
+
+// ParseOptions parses options from URL query parameters:
+//
+//	w=200&h=100        resize to fit within 200x100
+//	fit=cover          ... or to cover 200x100, cropping the rest, or fit=fill, to stretch to 200x100
+//	crop=x,y,w,h       crop before resizing
+//	format=jpeg        convert to png, jpeg or gif
+//	q=80               jpeg quality
+//
+// and reports whether any transformation was asked for.
+func ParseOptions(q url.Values) (Options, bool, error) {
+	o := Options{Fit: FitContain, Quality: 85}
+	asked := false
+	dim := func(k string) (int, error) {
+		s := q.Get(k)
+		if s == "" {
+			return 0, nil
+		}
+		asked = true
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > MaxSize {
+			return 0, fmt.Errorf("invalid %s: want 1-%d, got %q", k, MaxSize, s)
+		}
+		return n, nil
+	}
+	var err error
+	if o.Width, err = dim("w"); err != nil {
+		return o, true, err
+	}
+	if o.Height, err = dim("h"); err != nil {
+		return o, true, err
+	}
+	if s := q.Get("fit"); s != "" {
+		asked = true
+		if s != FitContain && s != FitCover && s != FitFill {
+			return o, true, fmt.Errorf("invalid fit: want contain, cover or fill, got %q", s)
+		}
+		o.Fit = s
+	}
+	if s := q.Get("crop"); s != "" {
+		asked = true
+		xs := strings.Split(s, ",")
+		var v [4]int
+		if len(xs) != 4 {
+			return o, true, fmt.Errorf("invalid crop: want x,y,w,h, got %q", s)
+		}
+		for i, x := range xs {
+			if v[i], err = strconv.Atoi(strings.TrimSpace(x)); err != nil || v[i] < 0 || (i >= 2 && v[i] == 0) {
+				return o, true, fmt.Errorf("invalid crop: want x,y,w,h, got %q", s)
+			}
+		}
+		o.Crop = image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3])
+	}
+	if s := q.Get("format"); s != "" {
+		asked = true
+		switch s {
+		case "png", "jpeg", "gif":
+			o.Format = s
+		case "jpg":
+			o.Format = "jpeg"
+		default:
+			return o, true, fmt.Errorf("invalid format: want png, jpeg or gif, got %q", s)
+		}
+	}
+	if s := q.Get("q"); s != "" {
+		asked = true
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 100 {
+			return o, true, fmt.Errorf("invalid q: want 1-100, got %q", s)
+		}
+		o.Quality = n
+	}
+	return o, asked, nil
+}
+
+// Key returns a canonical description of the options, e.g. to cache transformed images by.
+func (o Options) Key() string {
+	return fmt.Sprintf("w=%d,h=%d,fit=%s,crop=%d,%d,%d,%d,format=%s,q=%d", o.Width, o.Height, o.Fit,
+		o.Crop.Min.X, o.Crop.Min.Y, o.Crop.Dx(), o.Crop.Dy(), o.Format, o.Quality)
+}
+
+// Transform decodes an image, transforms it, and encodes it to w, returning the format it was encoded in.
+// Images with more than maxPixels pixels are not decoded.
+func Transform(w io.Writer, r io.ReadSeeker, o Options, maxPixels int) (string, error) {
+	config, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return "", ErrUnsupported
+	}
+	if config.Width*config.Height > maxPixels {
+		return "", ErrTooLarge
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return "", fmt.Errorf("failed decoding image: %v", err)
+	}
+
+	if !o.Crop.Empty() {
+		bounds := o.Crop.Add(img.Bounds().Min).Intersect(img.Bounds())
+		if bounds.Empty() {
+			return "", errors.New("crop outside image")
+		}
+		img = crop(img, bounds)
+	}
+	if o.Width > 0 || o.Height > 0 {
+		img = fit(img, o.Width, o.Height, o.Fit)
+	}
+
+	if o.Format != "" {
+		format = o.Format
+	}
+	switch format {
+	case "png":
+		return format, png.Encode(w, img)
+	case "jpeg":
+		return format, jpeg.Encode(w, img, &jpeg.Options{Quality: o.Quality})
+	case "gif":
+		return format, gif.Encode(w, img, nil)
+	}
+	return "", ErrUnsupported
+}
+
+// fit resizes img to a width and height, either of which may be 0, to scale with the other.
+func fit(img image.Image, w, h int, mode string) image.Image {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	switch {
+	case w == 0:
+		w = max(1, int(math.Round(float64(sw)*float64(h)/float64(sh))))
+	case h == 0:
+		h = max(1, int(math.Round(float64(sh)*float64(w)/float64(sw))))
+	case mode == FitContain:
+		scale := math.Min(float64(w)/float64(sw), float64(h)/float64(sh))
+		w, h = max(1, int(math.Round(float64(sw)*scale))), max(1, int(math.Round(float64(sh)*scale)))
+	case mode == FitCover:
+		// Crop the source to the box's aspect ratio, around its center, then resize.
+		scale := math.Max(float64(w)/float64(sw), float64(h)/float64(sh))
+		cw, ch := min(sw, int(math.Round(float64(w)/scale))), min(sh, int(math.Round(float64(h)/scale)))
+		x, y := b.Min.X+(sw-cw)/2, b.Min.Y+(sh-ch)/2
+		img = crop(img, image.Rect(x, y, x+cw, y+ch))
+	}
+	return Resize(img, w, h)
+}
+
+func crop(img image.Image, r image.Rectangle) image.Image {
+	if s, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return s.SubImage(r)
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, r.Min, draw.Src)
+	return dst
+}
+
+// Resize resamples img to w by h pixels with a triangle filter, widened when shrinking, so that every source
+// pixel contributes to the result, without aliasing.
+func Resize(img image.Image, w, h int) *image.NRGBA {
+	src := toNRGBA(img)
+	b := src.Bounds()
+	if b.Dx() == w && b.Dy() == h {
+		return src
+	}
+	tmp := resample(src, w, b.Dy(), true)
+	return resample(tmp, w, h, false)
+}
+
+func toNRGBA(img image.Image) *image.NRGBA {
+	if n, ok := img.(*image.NRGBA); ok && n.Bounds().Min == (image.Point{}) {
+		return n
+	}
+	b := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	return dst
+}
+
+// weights are the contributions of source pixels to a destination pixel.
+type weights struct {
+	first int
+	w     []float64
+}
+
+func filterWeights(dst, src int) []weights {
+	scale := float64(src) / float64(dst)
+	support := math.Max(scale, 1) // triangle filter of radius 1, widened when shrinking
+	ws := make([]weights, dst)
+	for i := range ws {
+		center := (float64(i)+0.5)*scale - 0.5
+		first := max(0, int(math.Ceil(center-support)))
+		last := min(src-1, int(math.Floor(center+support)))
+		w := make([]float64, 0, last-first+1)
+		var sum float64
+		for j := first; j <= last; j++ {
+			x := 1 - math.Abs(float64(j)-center)/support
+			if x < 0 {
+				x = 0
+			}
+			w = append(w, x)
+			sum += x
+		}
+		if sum == 0 { // exactly between pixels; take the nearest
+			first, w, sum = max(0, min(src-1, int(math.Round(center)))), []float64{1}, 1
+		}
+		for k := range w {
+			w[k] /= sum
+		}
+		ws[i] = weights{first, w}
+	}
+	return ws
+}
+
+// resample resizes src along one axis to w by h pixels, weighting colors by alpha, so that transparent pixels
+// don't bleed their color.
+func resample(src *image.NRGBA, w, h int, horizontal bool) *image.NRGBA {
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	var ws []weights
+	if horizontal {
+		ws = filterWeights(w, src.Bounds().Dx())
+	} else {
+		ws = filterWeights(h, src.Bounds().Dy())
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var r, g, b, a float64
+			var wt weights
+			if horizontal {
+				wt = ws[x]
+			} else {
+				wt = ws[y]
+			}
+			for k, f := range wt.w {
+				var i int
+				if horizontal {
+					i = src.PixOffset(wt.first+k, y)
+				} else {
+					i = src.PixOffset(x, wt.first+k)
+				}
+				p := src.Pix[i : i+4 : i+4]
+				pa := float64(p[3]) * f
+				r += float64(p[0]) * pa
+				g += float64(p[1]) * pa
+				b += float64(p[2]) * pa
+				a += pa
+			}
+			i := dst.PixOffset(x, y)
+			if a > 0 {
+				dst.Pix[i+0] = clamp(r / a)
+				dst.Pix[i+1] = clamp(g / a)
+				dst.Pix[i+2] = clamp(b / a)
+			}
+			dst.Pix[i+3] = clamp(a)
+		}
+	}
+	return dst
+}
+
+func clamp(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(255, math.Round(v))))
+}
@@ -0,0 +1,165 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/url"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+// halves returns a w by h PNG, black on the left half, white on the right.
+func halves(t *testing.T, w, h int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8(0)
+			if x >= w/2 {
+				v = 255
+			}
+			img.SetNRGBA(x, y, color.NRGBA{v, v, v, 255})
+		}
+	}
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func transform(t *testing.T, src []byte, query string) (image.Image, string, error) {
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, _, err := ParseOptions(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	format, err := Transform(&b, bytes.NewReader(src), o, 1_000_000)
+	if err != nil {
+		return nil, format, err
+	}
+	img, decoded, err := image.Decode(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != format {
+		t.Fatalf("encoded %s, decoded %s", format, decoded)
+	}
+	return img, format, nil
+}
+
+func TestParseOptions(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	parse := func(s string) (Options, bool, error) {
+		q, err := url.ParseQuery(s)
+		no(err)
+		return ParseOptions(q)
+	}
+
+	_, asked, err := parse("key=A&sig=B&expires=1")
+	no(err)
+	ok(!asked)
+
+	o, asked, err := parse("w=200&h=100&fit=cover&crop=10,20,30,40&format=jpg&q=70")
+	no(err)
+	ok(asked)
+	eq(Options{200, 100, FitCover, image.Rect(10, 20, 40, 60), "jpeg", 70}, o)
+
+	for _, s := range []string{"w=0", "h=-1", "w=99999", "fit=stretch", "crop=1,2,3", "crop=0,0,0,10", "format=webp", "q=101"} {
+		_, asked, err := parse(s)
+		ok(asked, s)
+		ok(err != nil, s)
+	}
+}
+
+func TestTransform(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	src := halves(t, 400, 200)
+
+	// Contain, keeping the aspect ratio.
+	img, format, err := transform(t, src, "w=100&h=100")
+	no(err)
+	eq("png", format)
+	eq(image.Rect(0, 0, 100, 50), img.Bounds())
+
+	// Scale with the width.
+	img, _, err = transform(t, src, "h=50")
+	no(err)
+	eq(image.Rect(0, 0, 100, 50), img.Bounds())
+
+	// Cover, cropping around the center.
+	img, _, err = transform(t, src, "w=50&h=50&fit=cover")
+	no(err)
+	eq(image.Rect(0, 0, 50, 50), img.Bounds())
+	r, _, _, _ := img.At(0, 25).RGBA()
+	eq(uint32(0), r)
+	r, _, _, _ = img.At(49, 25).RGBA()
+	eq(uint32(0xffff), r)
+
+	// Fill, stretching.
+	img, _, err = transform(t, src, "w=30&h=60&fit=fill")
+	no(err)
+	eq(image.Rect(0, 0, 30, 60), img.Bounds())
+
+	// Crop, then convert.
+	img, format, err = transform(t, src, "crop=0,0,100,100&format=jpeg")
+	no(err)
+	eq("jpeg", format)
+	eq(image.Rect(0, 0, 100, 100), img.Bounds())
+	r, _, _, _ = img.At(99, 50).RGBA()
+	eq(true, r < 0x0800) // black, give or take compression
+
+	_, _, err = transform(t, src, "crop=500,500,10,10")
+	eq(true, err != nil)
+
+	_, _, err = transform(t, halves(t, 2000, 1000), "w=10")
+	eq(ErrTooLarge, err)
+
+	_, _, err = transform(t, []byte("not an image"), "w=10")
+	eq(ErrUnsupported, err)
+}
+
+func TestResize(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+
+	// Shrinking averages, rather than samples, source pixels.
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 1))
+	for x := 0; x < 4; x++ {
+		v := uint8(0)
+		if x%2 == 1 {
+			v = 255
+		}
+		img.SetNRGBA(x, 0, color.NRGBA{v, v, v, 255})
+	}
+	dst := Resize(img, 1, 1)
+	c := dst.NRGBAAt(0, 0)
+	eq(true, c.R > 100 && c.R < 155)
+	eq(uint8(255), c.A)
+
+	// Transparent pixels don't bleed their color.
+	img = image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{255, 0, 0, 255})
+	img.SetNRGBA(1, 0, color.NRGBA{0, 255, 0, 0})
+	c = Resize(img, 1, 1).NRGBAAt(0, 0)
+	eq(color.NRGBA{255, 0, 0, 128}, c)
+}
@@ -0,0 +1,656 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kafka is a minimal Kafka client, speaking the Kafka protocol directly.
+//
+// It produces and fetches uncompressed record batches (Kafka 0.11 and later), without consumer groups:
+// consumers read every partition of a topic, starting from its end.
+package kafka
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	apiProduce     = 0
+	apiFetch       = 1
+	apiListOffsets = 2
+	apiMetadata    = 3
+
+	clientID      = "wave"
+	maxFetchBytes = 1 << 20
+)
+
+// Error is an error code returned by a broker.
+type Error int16
+
+const (
+	errOffsetOutOfRange Error = 1
+	errUnknownTopic     Error = 3
+	errLeaderNotAvail   Error = 5
+	errNotLeader        Error = 6
+)
+
+func (e Error) Error() string { return "kafka: error code " + strconv.Itoa(int(e)) }
+
+// stale reports whether the error means that the cached leaders of a topic's partitions are out of date.
+func (e Error) stale() bool {
+	return e == errUnknownTopic || e == errLeaderNotAvail || e == errNotLeader
+}
+
+var errProtocol = errors.New("kafka: protocol error")
+
+// Record is a message produced to, or fetched from, a topic.
+type Record struct {
+	Key       []byte
+	Value     []byte
+	Headers   []Header
+	Partition int32     // set when fetched
+	Offset    int64     // set when fetched
+	Time      time.Time // set when fetched
+}
+
+// Header is a key-value pair attached to a record.
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// Client produces and fetches records, over one connection per broker.
+type Client struct {
+	addrs   []string // bootstrap brokers
+	timeout time.Duration
+	mu      sync.Mutex
+	conns   map[string]*conn       // broker address => connection
+	topics  map[string][]partition // topic => partitions, from the latest metadata
+	next    map[string]uint32      // topic => round-robin counter, for records without keys
+}
+
+type partition struct {
+	id     int32
+	leader string // broker address; empty if unavailable
+}
+
+// New creates a client for the Kafka cluster reachable at any of addrs (host:port). Requests time out after timeout.
+func New(addrs []string, timeout time.Duration) (*Client, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("kafka: no brokers")
+	}
+	return &Client{
+		addrs:   addrs,
+		timeout: timeout,
+		conns:   make(map[string]*conn),
+		topics:  make(map[string][]partition),
+		next:    make(map[string]uint32),
+	}, nil
+}
+
+// Produce appends a record to a topic, once the partition's leader has written it.
+// Records with the same key go to the same partition, and so are fetched in the order they were produced.
+func (c *Client) Produce(topic string, r Record) error {
+	err := c.produce(topic, r)
+	var ke Error
+	if errors.As(err, &ke) && ke.stale() {
+		c.forget(topic)
+		err = c.produce(topic, r)
+	}
+	return err
+}
+
+func (c *Client) produce(topic string, r Record) error {
+	parts, err := c.partitions(topic)
+	if err != nil {
+		return err
+	}
+	var i uint32
+	if r.Key != nil {
+		i = crc32.ChecksumIEEE(r.Key)
+	} else {
+		c.mu.Lock()
+		i = c.next[topic]
+		c.next[topic]++
+		c.mu.Unlock()
+	}
+	p := parts[i%uint32(len(parts))]
+	if p.leader == "" {
+		return errLeaderNotAvail
+	}
+
+	var e encoder
+	e.int16(-1) // no transactional ID
+	e.int16(1)  // acks: leader only
+	e.int32(int32(c.timeout / time.Millisecond))
+	e.int32(1)
+	e.string(topic)
+	e.int32(1)
+	e.int32(p.id)
+	e.bytes(encodeBatch([]Record{r}, time.Now()))
+
+	d, err := c.do(p.leader, apiProduce, 3, e.b, 0)
+	if err != nil {
+		return err
+	}
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		d.string()
+		for m := d.int32(); m > 0 && d.err == nil; m-- {
+			d.int32()         // partition
+			code := d.int16() // error
+			d.int64()         // base offset
+			d.int64()         // log append time
+			if code != 0 {
+				return Error(code)
+			}
+		}
+	}
+	return d.err
+}
+
+// Consumer fetches the records produced to a topic, in order within each partition.
+type Consumer struct {
+	client  *Client
+	topic   string
+	offsets map[int32]int64 // partition => offset of the next record to fetch
+}
+
+// Consume starts consuming a topic's records, from the end of each of its partitions.
+func (c *Client) Consume(topic string) (*Consumer, error) {
+	cs := &Consumer{c, topic, make(map[int32]int64)}
+	parts, err := c.partitions(topic)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range parts {
+		if err := cs.seekEnd(p); err != nil {
+			return nil, err
+		}
+	}
+	return cs, nil
+}
+
+// seekEnd moves to the end of a partition, i.e. to the next record to be produced.
+func (cs *Consumer) seekEnd(p partition) error {
+	if p.leader == "" {
+		return errLeaderNotAvail
+	}
+	var e encoder
+	e.int32(-1) // replica ID
+	e.int32(1)
+	e.string(cs.topic)
+	e.int32(1)
+	e.int32(p.id)
+	e.int64(-1) // latest
+
+	d, err := cs.client.do(p.leader, apiListOffsets, 1, e.b, 0)
+	if err != nil {
+		return err
+	}
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		d.string()
+		for m := d.int32(); m > 0 && d.err == nil; m-- {
+			id := d.int32()
+			code := d.int16()
+			d.int64() // timestamp
+			offset := d.int64()
+			if code != 0 {
+				return Error(code)
+			}
+			cs.offsets[id] = offset
+		}
+	}
+	return d.err
+}
+
+// Fetch returns the records produced since the last fetch, waiting up to maxWait for any.
+func (cs *Consumer) Fetch(maxWait time.Duration) ([]Record, error) {
+	parts, err := cs.client.partitions(cs.topic)
+	if err != nil {
+		return nil, err
+	}
+	byLeader := make(map[string][]partition)
+	for _, p := range parts {
+		if _, ok := cs.offsets[p.id]; !ok { // created after the consumer started
+			if err := cs.seekEnd(p); err != nil {
+				return nil, err
+			}
+		}
+		byLeader[p.leader] = append(byLeader[p.leader], p)
+	}
+	var records []Record
+	for leader, parts := range byLeader {
+		if leader == "" {
+			continue
+		}
+		rs, err := cs.fetch(leader, parts, maxWait/time.Duration(len(byLeader)))
+		records = append(records, rs...)
+		if err != nil {
+			var ke Error
+			if errors.As(err, &ke) && ke.stale() {
+				cs.client.forget(cs.topic)
+			}
+			return records, err
+		}
+	}
+	return records, nil
+}
+
+func (cs *Consumer) fetch(leader string, parts []partition, maxWait time.Duration) ([]Record, error) {
+	var e encoder
+	e.int32(-1) // replica ID
+	e.int32(int32(maxWait / time.Millisecond))
+	e.int32(1) // min bytes
+	e.int32(maxFetchBytes)
+	e.int8(0) // read uncommitted
+	e.int32(1)
+	e.string(cs.topic)
+	e.int32(int32(len(parts)))
+	for _, p := range parts {
+		e.int32(p.id)
+		e.int64(cs.offsets[p.id])
+		e.int32(maxFetchBytes)
+	}
+
+	d, err := cs.client.do(leader, apiFetch, 4, e.b, maxWait)
+	if err != nil {
+		return nil, err
+	}
+	var records []Record
+	d.int32() // throttle time
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		d.string()
+		for m := d.int32(); m > 0 && d.err == nil; m-- {
+			id := d.int32()
+			code := Error(d.int16())
+			d.int64() // high watermark
+			d.int64() // last stable offset
+			for a := d.int32(); a > 0 && d.err == nil; a-- {
+				d.int64() // aborted transaction's producer ID
+				d.int64() // and first offset
+			}
+			b := d.bytes()
+			switch code {
+			case 0:
+			case errOffsetOutOfRange: // e.g. deleted by retention; start over from the end
+				delete(cs.offsets, id)
+				continue
+			default:
+				return records, code
+			}
+			rs, next := decodeBatches(b, id, cs.offsets[id])
+			records = append(records, rs...)
+			cs.offsets[id] = next
+		}
+	}
+	return records, d.err
+}
+
+// partitions returns a topic's partitions, from the cached metadata if any.
+func (c *Client) partitions(topic string) ([]partition, error) {
+	c.mu.Lock()
+	parts, ok := c.topics[topic]
+	c.mu.Unlock()
+	if ok {
+		return parts, nil
+	}
+
+	var e encoder
+	e.int32(1)
+	e.string(topic)
+
+	var err error
+	for _, addr := range c.addrs {
+		var d *decoder
+		if d, err = c.do(addr, apiMetadata, 1, e.b, 0); err != nil {
+			continue
+		}
+		brokers := make(map[int32]string)
+		for n := d.int32(); n > 0 && d.err == nil; n-- {
+			id := d.int32()
+			host := d.string()
+			port := d.int32()
+			d.string() // rack
+			brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+		}
+		d.int32() // controller ID
+		parts = nil
+		for n := d.int32(); n > 0 && d.err == nil; n-- {
+			code := Error(d.int16())
+			d.string() // name
+			d.int8()   // internal?
+			if code != 0 {
+				return nil, code
+			}
+			for m := d.int32(); m > 0 && d.err == nil; m-- {
+				d.int16() // error
+				id := d.int32()
+				leader := d.int32()
+				for range 2 { // replicas, then in-sync replicas
+					for k := d.int32(); k > 0 && d.err == nil; k-- {
+						d.int32()
+					}
+				}
+				parts = append(parts, partition{id, brokers[leader]})
+			}
+		}
+		if err = d.err; err != nil {
+			continue
+		}
+		if len(parts) == 0 {
+			return nil, errUnknownTopic
+		}
+		c.mu.Lock()
+		c.topics[topic] = parts
+		c.mu.Unlock()
+		return parts, nil
+	}
+	return nil, err
+}
+
+// forget drops the cached metadata of a topic, e.g. after its partitions moved to other brokers.
+func (c *Client) forget(topic string) {
+	c.mu.Lock()
+	delete(c.topics, topic)
+	c.mu.Unlock()
+}
+
+// do sends a request to a broker, and returns a decoder for its response. The broker may take up to wait
+// on top of the usual timeout to respond, e.g. for fetch requests.
+func (c *Client) do(addr string, api, version int16, body []byte, wait time.Duration) (*decoder, error) {
+	conn, err := c.conn(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	b, err := conn.do(api, version, body, c.timeout+wait)
+	if err != nil {
+		conn.Close()
+		c.mu.Lock()
+		if c.conns[addr] == conn {
+			delete(c.conns, addr)
+		}
+		c.mu.Unlock()
+		return nil, err
+	}
+	return &decoder{b: b}, nil
+}
+
+func (c *Client) conn(addr string) (*conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if conn, ok := c.conns[addr]; ok {
+		return conn, nil
+	}
+	nc, err := net.DialTimeout("tcp", addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &conn{Conn: nc}
+	c.conns[addr] = conn
+	return conn, nil
+}
+
+type conn struct {
+	net.Conn
+	mu sync.Mutex // one request at a time
+	id int32      // correlation ID of the latest request
+}
+
+func (c *conn) do(api, version int16, body []byte, timeout time.Duration) ([]byte, error) {
+	c.id++
+	var e encoder
+	e.int32(0) // size, set below
+	e.int16(api)
+	e.int16(version)
+	e.int32(c.id)
+	e.string(clientID)
+	e.b = append(e.b, body...)
+	binary.BigEndian.PutUint32(e.b, uint32(len(e.b)-4))
+
+	c.SetDeadline(time.Now().Add(timeout))
+	if _, err := c.Write(e.b); err != nil {
+		return nil, err
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(c, size[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(c, b); err != nil {
+		return nil, err
+	}
+	if len(b) < 4 || int32(binary.BigEndian.Uint32(b)) != c.id {
+		return nil, errProtocol
+	}
+	return b[4:], nil
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// encodeBatch encodes records as an uncompressed record batch (magic 2).
+func encodeBatch(records []Record, now time.Time) []byte {
+	var rs encoder
+	for i, r := range records {
+		var e encoder
+		e.int8(0)   // attributes
+		e.varint(0) // timestamp delta
+		e.varint(int64(i))
+		e.varbytes(r.Key)
+		e.varbytes(r.Value)
+		e.varint(int64(len(r.Headers)))
+		for _, h := range r.Headers {
+			e.varbytes([]byte(h.Key))
+			e.varbytes(h.Value)
+		}
+		rs.varint(int64(len(e.b)))
+		rs.b = append(rs.b, e.b...)
+	}
+
+	ts := now.UnixMilli()
+	var e encoder
+	e.int64(0)  // base offset, assigned by the broker
+	e.int32(0)  // length, set below
+	e.int32(-1) // partition leader epoch
+	e.int8(2)   // magic
+	e.int32(0)  // CRC, set below
+	e.int16(0)  // attributes: uncompressed, create time, not transactional
+	e.int32(int32(len(records) - 1))
+	e.int64(ts)
+	e.int64(ts)
+	e.int64(-1) // producer ID
+	e.int16(-1) // producer epoch
+	e.int32(-1) // base sequence
+	e.int32(int32(len(records)))
+	e.b = append(e.b, rs.b...)
+	binary.BigEndian.PutUint32(e.b[8:], uint32(len(e.b)-12))
+	binary.BigEndian.PutUint32(e.b[17:], crc32.Checksum(e.b[21:], castagnoli))
+	return e.b
+}
+
+// decodeBatches decodes the records in a partition's record batches from offset on, and returns the offset of
+// the record after the last batch. Compressed, control, legacy and corrupt batches are skipped.
+func decodeBatches(b []byte, partition int32, offset int64) ([]Record, int64) {
+	var records []Record
+	for len(b) >= 12 {
+		base := int64(binary.BigEndian.Uint64(b))
+		length := int(int32(binary.BigEndian.Uint32(b[8:])))
+		if length < 0 || len(b)-12 < length { // a fetch may end with part of a batch
+			break
+		}
+		batch := b[12 : 12+length]
+		b = b[12+length:]
+
+		d := &decoder{b: batch}
+		d.int32() // partition leader epoch
+		if magic := d.int8(); magic != 2 {
+			offset = max(offset, base+1)
+			continue
+		}
+		crc := uint32(d.int32())
+		valid := d.err == nil && crc32.Checksum(d.b, castagnoli) == crc
+		attrs := d.int16()
+		next := base + int64(d.int32()) + 1
+		first := d.int64()
+		d.int64() // max timestamp
+		d.int64() // producer ID
+		d.int16() // producer epoch
+		d.int32() // base sequence
+		n := d.int32()
+		if d.err != nil {
+			break
+		}
+		if !valid || attrs&0x07 != 0 || attrs&0x20 != 0 { // corrupt, compressed, or control
+			offset = max(offset, next)
+			continue
+		}
+		for ; n > 0 && d.err == nil; n-- {
+			rd := &decoder{b: d.take(int(d.varint()))}
+			rd.int8() // attributes
+			ts := first + rd.varint()
+			r := Record{Partition: partition, Offset: base + rd.varint(), Time: time.UnixMilli(ts)}
+			r.Key = rd.varbytes()
+			r.Value = rd.varbytes()
+			for h := rd.varint(); h > 0 && rd.err == nil; h-- {
+				r.Headers = append(r.Headers, Header{string(rd.varbytes()), rd.varbytes()})
+			}
+			if rd.err == nil && r.Offset >= offset {
+				records = append(records, r)
+			}
+		}
+		offset = max(offset, next)
+	}
+	return records, offset
+}
+
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) int8(v int8)   { e.b = append(e.b, byte(v)) }
+func (e *encoder) int16(v int16) { e.b = binary.BigEndian.AppendUint16(e.b, uint16(v)) }
+func (e *encoder) int32(v int32) { e.b = binary.BigEndian.AppendUint32(e.b, uint32(v)) }
+func (e *encoder) int64(v int64) { e.b = binary.BigEndian.AppendUint64(e.b, uint64(v)) }
+func (e *encoder) varint(v int64) {
+	e.b = binary.AppendVarint(e.b, v) // zigzag, like Kafka's
+}
+
+func (e *encoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.b = append(e.b, b...)
+}
+
+func (e *encoder) varbytes(b []byte) {
+	if b == nil {
+		e.varint(-1)
+		return
+	}
+	e.varint(int64(len(b)))
+	e.b = append(e.b, b...)
+}
+
+// decoder reads a response; after the first error, reads return zero values and err is set.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil || n < 0 || n > len(d.b) {
+		if d.err == nil {
+			d.err = errProtocol
+		}
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) int8() int8 {
+	if b := d.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *decoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = errProtocol
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+// string reads a nullable string; null reads as empty.
+func (d *decoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+// bytes reads nullable bytes.
+func (d *decoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return d.take(int(n))
+}
+
+func (d *decoder) varbytes() []byte {
+	n := d.varint()
+	if n < 0 {
+		return nil
+	}
+	return d.take(int(n))
+}
@@ -0,0 +1,212 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kafka
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+// serve is a broker with one topic of one partition, answering Metadata, ListOffsets, Produce and Fetch.
+func serve(t *testing.T, topic string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	var (
+		mu      sync.Mutex
+		batches [][]byte // with base offsets assigned
+		next    int64
+	)
+	handle := func(c net.Conn) {
+		defer c.Close()
+		for {
+			var size [4]byte
+			if _, err := io.ReadFull(c, size[:]); err != nil {
+				return
+			}
+			b := make([]byte, binary.BigEndian.Uint32(size[:]))
+			if _, err := io.ReadFull(c, b); err != nil {
+				return
+			}
+			d := &decoder{b: b}
+			api, _, id := d.int16(), d.int16(), d.int32()
+			d.string() // client ID
+
+			var e encoder
+			e.int32(0)
+			e.int32(id)
+			mu.Lock()
+			switch api {
+			case apiMetadata:
+				e.int32(1)
+				e.int32(0)
+				e.string(host)
+				e.int32(int32(portNum))
+				e.int16(-1)
+				e.int32(0)
+				e.int32(1)
+				e.int16(0)
+				e.string(topic)
+				e.int8(0)
+				e.int32(1)
+				e.int16(0)
+				e.int32(0)
+				e.int32(0)
+				e.int32(1)
+				e.int32(0)
+				e.int32(1)
+				e.int32(0)
+			case apiListOffsets:
+				e.int32(1)
+				e.string(topic)
+				e.int32(1)
+				e.int32(0)
+				e.int16(0)
+				e.int64(-1)
+				e.int64(next)
+			case apiProduce:
+				d.string()
+				d.int16()
+				d.int32()
+				d.int32()
+				d.string()
+				d.int32()
+				d.int32()
+				batch := append([]byte(nil), d.bytes()...)
+				binary.BigEndian.PutUint64(batch, uint64(next))
+				batches = append(batches, batch)
+				base := next
+				next += int64(binary.BigEndian.Uint32(batch[57:]))
+				e.int32(1)
+				e.string(topic)
+				e.int32(1)
+				e.int32(0)
+				e.int16(0)
+				e.int64(base)
+				e.int64(-1)
+				e.int32(0)
+			case apiFetch:
+				d.int32()
+				d.int32()
+				d.int32()
+				d.int32()
+				d.int8()
+				d.int32()
+				d.string()
+				d.int32()
+				d.int32()
+				offset := d.int64()
+				var records []byte
+				for _, batch := range batches {
+					if int64(binary.BigEndian.Uint64(batch)) >= offset {
+						records = append(records, batch...)
+					}
+				}
+				e.int32(0)
+				e.int32(1)
+				e.string(topic)
+				e.int32(1)
+				e.int32(0)
+				e.int16(0)
+				e.int64(next)
+				e.int64(next)
+				e.int32(-1)
+				e.bytes(records)
+			}
+			mu.Unlock()
+			binary.BigEndian.PutUint32(e.b, uint32(len(e.b)-4))
+			c.Write(e.b)
+		}
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handle(c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestProduceConsume(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	addr := serve(t, "updates")
+	c, err := New([]string{addr}, time.Second)
+	no(err)
+
+	no(c.Produce("updates", Record{Key: []byte("before")}))
+
+	cs, err := c.Consume("updates")
+	no(err)
+	records, err := cs.Fetch(100 * time.Millisecond)
+	no(err)
+	eq(0, len(records)) // consumers start from the end
+
+	no(c.Produce("updates", Record{Key: []byte("/demo"), Value: []byte(`{"d":[]}`), Headers: []Header{{"type", []byte("patch")}}}))
+	no(c.Produce("updates", Record{Value: []byte("two")}))
+
+	records, err = cs.Fetch(100 * time.Millisecond)
+	no(err)
+	eq(2, len(records))
+	eq("/demo", string(records[0].Key))
+	eq(`{"d":[]}`, string(records[0].Value))
+	eq([]Header{{"type", []byte("patch")}}, records[0].Headers)
+	eq(int64(1), records[0].Offset)
+	ok(records[1].Key == nil)
+	eq("two", string(records[1].Value))
+	eq(int64(2), records[1].Offset)
+
+	records, err = cs.Fetch(100 * time.Millisecond)
+	no(err)
+	eq(0, len(records))
+
+	_, err = New(nil, time.Second)
+	ok(err != nil)
+}
+
+func TestDecodeBatches(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	b := encodeBatch([]Record{{Value: []byte("a")}, {Value: []byte("b")}}, time.Now())
+
+	records, next := decodeBatches(b, 0, 1)
+	eq(1, len(records))
+	eq("b", string(records[0].Value))
+	eq(int64(2), next)
+
+	// Corrupt batches are skipped.
+	b[len(b)-1] ^= 0xff
+	records, next = decodeBatches(b, 0, 0)
+	eq(0, len(records))
+	eq(int64(2), next)
+
+	// So are partial batches, at the end of a fetch, until fetched in full.
+	records, next = decodeBatches(b[:len(b)-1], 0, 0)
+	eq(0, len(records))
+	eq(int64(0), next)
+}
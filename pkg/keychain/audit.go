@@ -0,0 +1,217 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AuditQuery represents a filter over audit events. Zero-valued fields match all events.
+type AuditQuery struct {
+	ID      string    // access key ID
+	Since   time.Time // inclusive
+	Until   time.Time // exclusive
+	Outcome *Outcome
+	Limit   int // max number of (most recent) events to return
+}
+
+func (q AuditQuery) match(e Event) bool {
+	if q.ID != "" && q.ID != e.ID {
+		return false
+	}
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !e.Time.Before(q.Until) {
+		return false
+	}
+	if q.Outcome != nil && *q.Outcome != e.Outcome {
+		return false
+	}
+	return true
+}
+
+// AuditLog is a Hook that records recent authentication events in a fixed-size ring buffer.
+type AuditLog struct {
+	sync.RWMutex
+	events []Event
+	next   int  // index of the next write
+	full   bool // has the buffer wrapped around?
+	clock  Clock
+}
+
+// NewAuditLog creates an audit log that retains the most recent size events. Usage and relative times in
+// queries are measured against clock, which should be the clock of the keychains the log is hooked to;
+// the system clock if nil.
+func NewAuditLog(size int, clock Clock) *AuditLog {
+	if size < 1 {
+		size = 1
+	}
+	if clock == nil {
+		clock = systemClock{}
+	}
+	return &AuditLog{events: make([]Event, size), clock: clock}
+}
+
+// Inspect records e. It never denies an attempt.
+func (a *AuditLog) Inspect(e Event) Verdict {
+	a.Lock()
+	a.events[a.next] = e
+	a.next++
+	if a.next == len(a.events) {
+		a.next = 0
+		a.full = true
+	}
+	a.Unlock()
+	return Pass
+}
+
+// Query returns the recorded events matching q, oldest first.
+func (a *AuditLog) Query(q AuditQuery) []Event {
+	a.RLock()
+	defer a.RUnlock()
+
+	n := a.next
+	if a.full {
+		n = len(a.events)
+	}
+
+	var matches []Event
+	for i := 0; i < n; i++ { // newest first
+		j := a.next - 1 - i
+		if j < 0 {
+			j += len(a.events)
+		}
+		if e := a.events[j]; q.match(e) {
+			matches = append(matches, e)
+			if q.Limit > 0 && len(matches) == q.Limit {
+				break
+			}
+		}
+	}
+
+	for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+		matches[i], matches[j] = matches[j], matches[i]
+	}
+	return matches
+}
+
+// Usage counts allowed events per access key ID over the last n intervals of length step,
+// oldest interval first.
+func (a *AuditLog) Usage(n int, step time.Duration) map[string][]int {
+	now := a.clock.Now()
+	since := now.Add(-time.Duration(n) * step)
+	allowed := Allowed
+	usage := make(map[string][]int)
+	for _, e := range a.Query(AuditQuery{Since: since, Until: now, Outcome: &allowed}) {
+		counts, ok := usage[e.ID]
+		if !ok {
+			counts = make([]int, n)
+			usage[e.ID] = counts
+		}
+		if i := int(e.Time.Sub(since) / step); i >= 0 && i < n {
+			counts[i]++
+		}
+	}
+	return usage
+}
+
+// ParseOutcome parses "allowed", "denied" or "throttled".
+func ParseOutcome(s string) (Outcome, error) {
+	switch s {
+	case "allowed":
+		return Allowed, nil
+	case "denied":
+		return Denied, nil
+	case "throttled":
+		return Throttled, nil
+	}
+	return Denied, fmt.Errorf("invalid outcome: want allowed, denied or throttled, got %q", s)
+}
+
+// parseTime parses either a RFC3339 timestamp or a duration relative to now, e.g. "168h" for "a week ago".
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("invalid time: want RFC3339 timestamp or duration, got %q", s)
+	}
+	return t, nil
+}
+
+// ParseAuditQuery reads a query from URL parameters: id, since, until, outcome and limit. Durations given for
+// since and until are relative to now.
+func ParseAuditQuery(v url.Values, now time.Time) (AuditQuery, error) {
+	var (
+		q   AuditQuery
+		err error
+	)
+	q.ID = v.Get("id")
+	if s := v.Get("since"); s != "" {
+		if q.Since, err = parseTime(s, now); err != nil {
+			return q, err
+		}
+	}
+	if s := v.Get("until"); s != "" {
+		if q.Until, err = parseTime(s, now); err != nil {
+			return q, err
+		}
+	}
+	if s := v.Get("outcome"); s != "" {
+		o, err := ParseOutcome(s)
+		if err != nil {
+			return q, err
+		}
+		q.Outcome = &o
+	}
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil {
+			return q, fmt.Errorf("invalid limit: %v", err)
+		}
+	}
+	return q, nil
+}
+
+// ServeHTTP responds with the events matching the query in the request URL, as JSON.
+func (a *AuditLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := ParseAuditQuery(r.URL.Query(), a.clock.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	events := a.Query(q)
+	if events == nil {
+		events = []Event{}
+	}
+	b, err := json.Marshal(events)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
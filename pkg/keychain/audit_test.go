@@ -0,0 +1,106 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestAuditLog(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	a := NewAuditLog(4, nil)
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, id := range []string{"a", "b", "a", "c", "a", "b"} {
+		outcome := Allowed
+		if i%2 == 1 {
+			outcome = Denied
+		}
+		a.Inspect(Event{ID: id, Time: t0.Add(time.Duration(i) * time.Hour), Outcome: outcome})
+	}
+
+	// oldest two evicted
+	all := a.Query(AuditQuery{})
+	eq(4, len(all))
+	eq("a", all[0].ID)
+	eq("b", all[3].ID)
+
+	eq(2, len(a.Query(AuditQuery{ID: "a"})))
+
+	denied := Denied
+	eq(2, len(a.Query(AuditQuery{Outcome: &denied})))
+
+	q, err := ParseAuditQuery(url.Values{"since": {t0.Add(3 * time.Hour).Format(time.RFC3339)}, "outcome": {"denied"}}, time.Now())
+	no(err)
+	r := a.Query(q)
+	eq(2, len(r))
+	eq("c", r[0].ID)
+
+	r = a.Query(AuditQuery{Limit: 1})
+	eq(1, len(r))
+	eq("b", r[0].ID)
+}
+
+func TestAuditLogUsage(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	a := NewAuditLog(16, &fakeClock{now})
+	for _, e := range []Event{
+		{ID: "a", Time: now.Add(-150 * time.Minute), Outcome: Allowed},
+		{ID: "a", Time: now.Add(-30 * time.Minute), Outcome: Allowed},
+		{ID: "a", Time: now.Add(-20 * time.Minute), Outcome: Allowed},
+		{ID: "a", Time: now.Add(-10 * time.Minute), Outcome: Denied},
+		{ID: "b", Time: now.Add(-5 * time.Hour), Outcome: Allowed},
+	} {
+		a.Inspect(e)
+	}
+	usage := a.Usage(3, time.Hour)
+	eq(1, len(usage))
+	eq([]int{1, 0, 2}, usage["a"])
+}
+
+func TestAuditLogClock(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	clock := &fakeClock{time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	a := NewAuditLog(16, clock)
+	a.Inspect(Event{ID: "a", Time: clock.t.Add(-90 * time.Minute), Outcome: Allowed})
+	a.Inspect(Event{ID: "b", Time: clock.t.Add(-30 * time.Minute), Outcome: Allowed})
+
+	q, err := ParseAuditQuery(url.Values{"since": {"1h"}}, clock.Now())
+	no(err)
+	eq(clock.t.Add(-time.Hour), q.Since)
+
+	query := func() []struct{ ID string } {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_audit?since=1h", nil))
+		var events []struct{ ID string }
+		no(json.NewDecoder(w.Body).Decode(&events))
+		return events
+	}
+	events := query()
+	eq(1, len(events))
+	eq("b", events[0].ID)
+	eq(map[string][]int{"a": {1, 0}, "b": {0, 1}}, a.Usage(2, time.Hour))
+
+	clock.t = clock.t.Add(time.Hour)
+	eq(0, len(query()))
+	eq(map[string][]int{"b": {1, 0}}, a.Usage(2, time.Hour))
+}
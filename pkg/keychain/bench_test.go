@@ -0,0 +1,104 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newBenchKeychain(b *testing.B) (kc *Keychain, id, secret string) {
+	id, secret, hash, err := CreateAccessKey()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if kc, err = LoadKeychain(filepath.Join(b.TempDir(), "keychain")); err != nil {
+		b.Fatal(err)
+	}
+	if err := kc.Add(id, hash); err != nil {
+		b.Fatal(err)
+	}
+	if !kc.verify(id, secret) { // warm the cache
+		b.Fatal("verify failed")
+	}
+	return kc, id, secret
+}
+
+func BenchmarkVerifyCached(b *testing.B) {
+	kc, id, secret := newBenchKeychain(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if !kc.verify(id, secret) {
+				b.Fatal("verify failed")
+			}
+		}
+	})
+}
+
+func BenchmarkVerifyUnknown(b *testing.B) {
+	kc, _, secret := newBenchKeychain(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if kc.verify("UNKNOWN", secret) {
+			b.Fatal("verify succeeded")
+		}
+	}
+}
+
+func BenchmarkAllow(b *testing.B) {
+	kc, id, secret := newBenchKeychain(b)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth(id, secret)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !kc.Allow(r) {
+			b.Fatal("allow failed")
+		}
+	}
+}
+
+func TestLoadTest(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	stats, err := LoadTest{
+		Keys:        4,
+		Cost:        bcrypt.MinCost,
+		CacheTTL:    DefaultCacheTTL,
+		Duration:    200 * time.Millisecond,
+		Concurrency: 2,
+		Cached:      0.5,
+		Uncached:    0.3,
+		Bad:         0.2,
+	}.Run()
+	no(err)
+	eq(4, len(stats))
+	for _, s := range stats {
+		ok(s.Count > 0, s.Kind)
+		ok(s.P50 <= s.P90 && s.P90 <= s.P99 && s.P99 <= s.Max, s.Kind)
+	}
+	eq(stats[0].Count+stats[1].Count+stats[2].Count, stats[3].Count)
+	ok(stats[0].P50 < stats[1].P50, "cached authentications are faster")
+
+	_, err = LoadTest{Keys: 1, Concurrency: 1, Duration: time.Second}.Run()
+	ok(err != nil, "empty mix")
+}
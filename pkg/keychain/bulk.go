@@ -0,0 +1,320 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Bulk import/export formats.
+//
+// CSV files must have a header row. Recognized columns are id, hash, secret, ref, disabled and expires;
+// columns named "metadata.NAME" become metadata attribute NAME. Each row must hold either a bcrypt
+// hash or a plaintext secret, which is hashed on import.
+//
+// JSONL files hold one JSON object per line, with the same fields as the CSV columns, and metadata
+// as a nested object.
+
+const metadataPrefix = "metadata."
+
+// LineError describes an invalid line in imported data.
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+// ImportError lists every invalid line in imported data.
+type ImportError []*LineError
+
+func (e ImportError) Error() string {
+	lines := make([]string, len(e))
+	for i, le := range e {
+		lines[i] = le.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// record is the exchange representation of an entry.
+type record struct {
+	ID       string            `json:"id"`
+	Hash     string            `json:"hash,omitempty"`
+	Secret   string            `json:"secret,omitempty"`
+	Ref      string            `json:"ref,omitempty"`
+	Disabled bool              `json:"disabled,omitempty"`
+	Expires  *time.Time        `json:"expires,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+func (r *record) entry() (Entry, error) {
+	if len(r.ID) == 0 {
+		return Entry{}, errors.New("missing id")
+	}
+	if strings.ContainsAny(r.ID, ":\r\n") {
+		return Entry{}, fmt.Errorf("invalid id %q", r.ID)
+	}
+	var hash []byte
+	switch {
+	case len(r.Hash) > 0 && len(r.Secret) > 0:
+		return Entry{}, errors.New("want either hash or secret, got both")
+	case len(r.Hash) > 0:
+		hash = []byte(r.Hash)
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return Entry{}, fmt.Errorf("invalid hash: %v", err)
+		}
+	case len(r.Secret) > 0:
+		// Hashed by the importer, in parallel with other secrets.
+	default:
+		return Entry{}, errors.New("missing hash or secret")
+	}
+	return Entry{ID: r.ID, Hash: hash, Ref: r.Ref, Disabled: r.Disabled, Expires: r.Expires, Metadata: r.Metadata}, nil
+}
+
+// importer collects valid entries and per-line errors.
+type importer struct {
+	entries []Entry
+	seen    map[string]int // id -> line
+	errs    ImportError
+	secrets []pendingSecret // to hash
+}
+
+// pendingSecret is a secret to hash for an imported entry.
+type pendingSecret struct {
+	entry, line int
+	secret      string
+}
+
+func (im *importer) add(line int, r *record, err error) {
+	if err == nil {
+		var e Entry
+		if e, err = r.entry(); err == nil {
+			if prev, ok := im.seen[e.ID]; ok {
+				err = fmt.Errorf("duplicate id %s, first seen on line %d", e.ID, prev)
+			} else {
+				im.seen[e.ID] = line
+				if len(r.Secret) > 0 {
+					im.secrets = append(im.secrets, pendingSecret{len(im.entries), line, r.Secret})
+				}
+				im.entries = append(im.entries, e)
+				return
+			}
+		}
+	}
+	im.errs = append(im.errs, &LineError{line, err})
+}
+
+func (im *importer) result() ([]Entry, error) {
+	if len(im.secrets) > 0 {
+		secrets := make([]string, len(im.secrets))
+		for i, s := range im.secrets {
+			secrets[i] = s.secret
+		}
+		hashes, errs := HashSecrets(secrets)
+		for i, s := range im.secrets {
+			im.entries[s.entry].Hash = hashes[i]
+			if errs != nil && errs[i] != nil {
+				im.errs = append(im.errs, &LineError{s.line, errs[i]})
+			}
+		}
+		if errs != nil {
+			entries := im.entries[:0]
+			for _, e := range im.entries {
+				if e.Hash != nil {
+					entries = append(entries, e)
+				}
+			}
+			im.entries = entries
+			sort.Slice(im.errs, func(i, j int) bool { return im.errs[i].Line < im.errs[j].Line })
+		}
+	}
+	if len(im.errs) > 0 {
+		return im.entries, im.errs
+	}
+	return im.entries, nil
+}
+
+// ImportCSV reads entries from CSV data. Valid entries are always returned; if any row is invalid,
+// the error is an ImportError describing each invalid row.
+func ImportCSV(r io.Reader) ([]Entry, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed reading CSV header: %v", err)
+	}
+	for i, col := range header {
+		col = strings.TrimSpace(col)
+		switch col {
+		case "id", "hash", "secret", "ref", "disabled", "expires":
+		default:
+			if !strings.HasPrefix(col, metadataPrefix) || len(col) == len(metadataPrefix) {
+				return nil, &LineError{1, fmt.Errorf("unknown column %q", col)}
+			}
+		}
+		header[i] = col
+	}
+
+	im := &importer{seen: make(map[string]int)}
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		line, _ := cr.FieldPos(0)
+		if err != nil {
+			var pe *csv.ParseError
+			if !errors.As(err, &pe) {
+				return nil, fmt.Errorf("failed reading CSV: %v", err)
+			}
+			im.add(pe.Line, nil, pe.Err)
+			continue
+		}
+		if len(row) != len(header) {
+			im.add(line, nil, fmt.Errorf("want %d fields, got %d", len(header), len(row)))
+			continue
+		}
+		rec, err := parseRow(header, row)
+		im.add(line, rec, err)
+	}
+	return im.result()
+}
+
+func parseRow(header, row []string) (*record, error) {
+	r := &record{}
+	for i, col := range header {
+		v := strings.TrimSpace(row[i])
+		switch col {
+		case "id":
+			r.ID = v
+		case "hash":
+			r.Hash = v
+		case "secret":
+			r.Secret = v
+		case "ref":
+			r.Ref = v
+		case "disabled":
+			if len(v) > 0 {
+				b, err := strconv.ParseBool(v)
+				if err != nil {
+					return nil, fmt.Errorf("invalid disabled %q: want true or false", v)
+				}
+				r.Disabled = b
+			}
+		case "expires":
+			if len(v) > 0 {
+				t, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					return nil, fmt.Errorf("invalid expires %q: want RFC3339 timestamp", v)
+				}
+				r.Expires = &t
+			}
+		default:
+			if len(v) > 0 {
+				if r.Metadata == nil {
+					r.Metadata = make(map[string]string)
+				}
+				r.Metadata[strings.TrimPrefix(col, metadataPrefix)] = v
+			}
+		}
+	}
+	return r, nil
+}
+
+// ImportJSONL reads entries from JSON Lines data. Valid entries are always returned; if any line is
+// invalid, the error is an ImportError describing each invalid line.
+func ImportJSONL(r io.Reader) ([]Entry, error) {
+	im := &importer{seen: make(map[string]int)}
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		b := bytes.TrimSpace(s.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+		var rec record
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		im.add(line, &rec, dec.Decode(&rec))
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("failed reading JSONL: %v", err)
+	}
+	return im.result()
+}
+
+// ExportCSV writes entries as CSV, with one "metadata.NAME" column per metadata attribute in use.
+func ExportCSV(w io.Writer, entries []Entry) error {
+	names := make(map[string]bool)
+	for _, e := range entries {
+		for k := range e.Metadata {
+			names[k] = true
+		}
+	}
+	keys := make([]string, 0, len(names))
+	for k := range names {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	header := []string{"id", "hash", "ref", "disabled", "expires"}
+	for _, k := range keys {
+		header = append(header, metadataPrefix+k)
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write(header)
+	for _, e := range entries {
+		expires := ""
+		if e.Expires != nil {
+			expires = e.Expires.Format(time.RFC3339)
+		}
+		row := []string{e.ID, string(e.Hash), e.Ref, strconv.FormatBool(e.Disabled), expires}
+		for _, k := range keys {
+			row = append(row, e.Metadata[k])
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ExportJSONL writes entries as JSON Lines.
+func ExportJSONL(w io.Writer, entries []Entry) error {
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(record{ID: e.ID, Hash: string(e.Hash), Ref: e.Ref, Disabled: e.Disabled, Expires: e.Expires, Metadata: e.Metadata}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
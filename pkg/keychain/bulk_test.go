@@ -0,0 +1,115 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestImportCSV(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	data := `id,secret,disabled,expires,metadata.owner
+A,s3cret,,,ops
+B,,,,dev
+C,s3cret,maybe,,
+A,s3cret,true,2030-01-01T00:00:00Z,
+D,s3cret,true,2030-01-01T00:00:00Z,qa
+`
+	entries, err := ImportCSV(strings.NewReader(data))
+	var ie ImportError
+	ok(errors.As(err, &ie))
+	eq(3, len(ie))
+	eq(3, ie[0].Line)
+	eq(4, ie[1].Line)
+	eq(5, ie[2].Line)
+
+	eq(2, len(entries))
+	eq("ops", entries[0].Metadata["owner"])
+	ok(entries[1].Disabled)
+	ok(entries[1].Expires != nil)
+
+	_, err = ImportCSV(strings.NewReader("id,hash,color\n"))
+	ok(err != nil)
+}
+
+func TestBulkRoundtrip(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	_, secret, hash, err := CreateAccessKey()
+	no(err)
+	entries := []Entry{
+		{ID: "A", Hash: hash, Metadata: map[string]string{"owner": "ops"}},
+		{ID: "B", Hash: hash, Disabled: true},
+	}
+
+	var b bytes.Buffer
+	no(ExportCSV(&b, entries))
+	fromCSV, err := ImportCSV(&b)
+	no(err)
+
+	b.Reset()
+	no(ExportJSONL(&b, entries))
+	fromJSONL, err := ImportJSONL(&b)
+	no(err)
+
+	for _, imported := range [][]Entry{fromCSV, fromJSONL} {
+		eq(2, len(imported))
+		eq("ops", imported[0].Metadata["owner"])
+		ok(imported[1].Disabled)
+		kc, err := Open(&FileStore{filepath.Join(t.TempDir(), ".wave-keychain")})
+		no(err)
+		kc.Put(imported[0])
+		ok(kc.verify("A", secret))
+	}
+
+	_, err = ImportJSONL(strings.NewReader("{\"id\":\"A\",\"hash\":\"nope\"}\n\n{\"id\":\"B\",\"color\":\"red\"}\n"))
+	var ie ImportError
+	ok(errors.As(err, &ie))
+	eq(2, len(ie))
+	eq(3, ie[1].Line)
+}
+
+func TestImportSecrets(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	var b strings.Builder
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&b, "{\"id\":\"K%02d\",\"secret\":\"secret%d\"}\n", i, i)
+	}
+	fmt.Fprintf(&b, "{\"id\":\"LONG\",\"secret\":%q}\n", strings.Repeat("x", 100)) // too long for bcrypt
+	b.WriteString("{\"id\":\"BAD\"}\n")
+
+	entries, err := ImportJSONL(strings.NewReader(b.String()))
+	var ie ImportError
+	ok(errors.As(err, &ie))
+	eq(2, len(ie))
+	eq(21, ie[0].Line)
+	eq(22, ie[1].Line)
+
+	eq(20, len(entries))
+	kc, err := Open(&FileStore{filepath.Join(t.TempDir(), ".wave-keychain")})
+	no(err)
+	for _, e := range entries {
+		kc.Put(e)
+	}
+	ok(kc.verify("K00", "secret0"))
+	ok(kc.verify("K19", "secret19"))
+	ok(!kc.verify("K19", "secret0"))
+}
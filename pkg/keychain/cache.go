@@ -0,0 +1,220 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"hash"
+	"sync"
+)
+
+type token [sha256.Size]byte
+
+// verifyCache is an LRU cache of verifications. Unlike lru.Cache, keys and values are not boxed
+// in interfaces, and evicted items are reused, so that lookups and steady-state inserts do not allocate.
+//
+// The cache is resized within bounds, if any, every adaptWindow misses: it doubles if it is full and
+// either the hit rate was low or there are more keys than cached items, and halves if mostly empty.
+type verifyCache struct {
+	sync.Mutex
+	size         int
+	items        map[token]*cacheItem
+	root         cacheItem // sentinel; root.next is the most recently used item
+	min, max     int       // size bounds; equal if not adaptive
+	keys         func() int
+	hits, misses int    // since the last resize
+	gen          uint64 // incremented on every purge
+}
+
+const (
+	adaptWindow  = 1024 // misses between resizes
+	adaptHitRate = 0.9  // grow if the hit rate is lower than this
+)
+
+type cacheItem struct {
+	key        token
+	v          verification
+	prev, next *cacheItem
+}
+
+func newVerifyCache(size int) *verifyCache {
+	if size < 8 {
+		size = 8
+	}
+	if size > maxCacheSize {
+		size = maxCacheSize
+	}
+	c := &verifyCache{size: size, items: make(map[token]*cacheItem, size), min: size, max: size}
+	c.root.prev, c.root.next = &c.root, &c.root
+	return c
+}
+
+// adapt lets the cache resize itself between min and max items, growing if there are more than keys() keys.
+func (c *verifyCache) adapt(min, max int, keys func() int) {
+	c.Lock()
+	defer c.Unlock()
+	c.min, c.max, c.keys = min, max, keys
+	c.resize(c.size)
+}
+
+func (c *verifyCache) resize(size int) {
+	c.size = size
+	if c.size < c.min {
+		c.size = c.min
+	}
+	if c.size > c.max {
+		c.size = c.max
+	}
+	for len(c.items) > c.size {
+		it := c.root.prev
+		c.unlink(it)
+		delete(c.items, it.key)
+	}
+	c.hits, c.misses = 0, 0
+}
+
+// grow resizes the cache based on the hit rate since the last resize; must be called with the lock held.
+func (c *verifyCache) grow() {
+	if c.min == c.max || c.misses < adaptWindow {
+		return
+	}
+	hitRate := float64(c.hits) / float64(c.hits+c.misses)
+	switch {
+	case len(c.items) >= c.size && (hitRate < adaptHitRate || (c.keys != nil && c.keys() > c.size)):
+		c.resize(c.size * 2)
+	case len(c.items) < c.size/4:
+		c.resize(c.size / 2)
+	default:
+		c.hits, c.misses = 0, 0
+	}
+}
+
+func (c *verifyCache) unlink(it *cacheItem) {
+	it.prev.next, it.next.prev = it.next, it.prev
+}
+
+func (c *verifyCache) pushFront(it *cacheItem) {
+	it.prev, it.next = &c.root, c.root.next
+	c.root.next.prev = it
+	c.root.next = it
+}
+
+func (c *verifyCache) Get(key token) (verification, bool) {
+	c.Lock()
+	defer c.Unlock()
+	it, ok := c.items[key]
+	if !ok {
+		c.misses++
+		c.grow()
+		return verification{}, false
+	}
+	c.hits++
+	c.unlink(it)
+	c.pushFront(it)
+	return it.v, true
+}
+
+func (c *verifyCache) Add(key token, v verification) {
+	c.Lock()
+	defer c.Unlock()
+	c.add(key, v)
+}
+
+// generation returns the number of purges so far, to be passed to addUnlessPurged.
+func (c *verifyCache) generation() uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.gen
+}
+
+// addUnlessPurged adds a verification made against a hash read after generation returned gen, unless the cache
+// has been purged since, e.g. because the hash was replaced while the secret was being compared against it.
+func (c *verifyCache) addUnlessPurged(key token, v verification, gen uint64) {
+	c.Lock()
+	defer c.Unlock()
+	if c.gen == gen {
+		c.add(key, v)
+	}
+}
+
+func (c *verifyCache) add(key token, v verification) {
+	if it, ok := c.items[key]; ok {
+		it.v = v
+		c.unlink(it)
+		c.pushFront(it)
+		return
+	}
+	var it *cacheItem
+	if len(c.items) >= c.size {
+		it = c.root.prev // least recently used
+		c.unlink(it)
+		delete(c.items, it.key)
+	} else {
+		it = &cacheItem{}
+	}
+	it.key, it.v = key, v
+	c.items[key] = it
+	c.pushFront(it)
+}
+
+func (c *verifyCache) Remove(key token) {
+	c.Lock()
+	defer c.Unlock()
+	if it, ok := c.items[key]; ok {
+		c.unlink(it)
+		delete(c.items, key)
+	}
+}
+
+func (c *verifyCache) Purge() {
+	c.Lock()
+	defer c.Unlock()
+	clear(c.items)
+	c.gen++
+	c.root.prev, c.root.next = &c.root, &c.root
+}
+
+func (c *verifyCache) Size() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.size
+}
+
+// bounds returns the size bounds of the cache.
+func (c *verifyCache) bounds() (min, max int) {
+	c.Lock()
+	defer c.Unlock()
+	return c.min, c.max
+}
+
+func (c *verifyCache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.items)
+}
+
+// tokenizer holds reusable state for deriving tokens.
+type tokenizer struct {
+	mac hash.Hash
+	buf []byte
+	sum []byte
+}
+
+func newTokenizerPool(key []byte) *sync.Pool {
+	return &sync.Pool{New: func() any {
+		return &tokenizer{mac: hmac.New(sha256.New, key), buf: make([]byte, 0, 128), sum: make([]byte, 0, sha256.Size)}
+	}}
+}
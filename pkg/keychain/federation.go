@@ -0,0 +1,129 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// VerifyRequest represents a request to verify an access key against a remote keychain.
+type VerifyRequest struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+}
+
+// VerifyResponse represents the result of verifying an access key against a remote keychain.
+type VerifyResponse struct {
+	Valid bool `json:"valid"`
+}
+
+type verification struct {
+	valid bool
+	at    time.Time
+}
+
+// Federation verifies access keys against a keychain on a remote server, e.g. a central control plane.
+// Results are cached for a TTL. While the remote server is unreachable, keys that verified successfully
+// keep verifying for a grace period beyond the TTL.
+type Federation struct {
+	url    string
+	id     string
+	secret string
+	ttl    time.Duration
+	grace  time.Duration
+	client *http.Client
+	cache  *lru.Cache
+}
+
+// NewFederation creates a federation with the remote server at baseURL, authenticating with the given access key.
+func NewFederation(baseURL, id, secret string, ttl, grace time.Duration) (*Federation, error) {
+	cache, err := newLruCache(maxCacheSize)
+	if err != nil {
+		return nil, err
+	}
+	return &Federation{
+		url:    strings.TrimSuffix(baseURL, "/") + "/_federation/verify",
+		id:     id,
+		secret: secret,
+		ttl:    ttl,
+		grace:  grace,
+		client: &http.Client{Timeout: 5 * time.Second},
+		cache:  cache,
+	}, nil
+}
+
+// Federate verifies keys not found in this keychain against a remote keychain.
+func (kc *Keychain) Federate(f *Federation) {
+	kc.Lock()
+	kc.remote = f
+	kc.Unlock()
+}
+
+func (f *Federation) verify(ctx context.Context, now time.Time, id, secret string) bool {
+	key := sha512.Sum512([]byte(strings.Join([]string{id, secret}, "\x00")))
+	var last *verification
+	if v, ok := f.cache.Get(key); ok {
+		last = v.(*verification)
+		if now.Sub(last.at) < f.ttl {
+			return last.valid
+		}
+	}
+
+	valid, err := f.request(ctx, id, secret)
+	if err != nil {
+		if ctx.Err() != nil {
+			return false
+		}
+		// Offline: honor recent successes only.
+		return last != nil && last.valid && now.Sub(last.at) < f.ttl+f.grace
+	}
+	f.cache.Add(key, &verification{valid, now})
+	return valid
+}
+
+func (f *Federation) request(ctx context.Context, id, secret string) (bool, error) {
+	b, err := json.Marshal(VerifyRequest{id, secret})
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.url, bytes.NewReader(b))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(f.id, f.secret)
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("request failed: %s", resp.Status)
+	}
+	var r VerifyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return false, err
+	}
+	return r.Valid, nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestFederation(t *testing.T) {
+	_, ok, _ := assert.Assert(t)
+
+	central, err := LoadKeychain(filepath.Join(t.TempDir(), "central"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, secret, hash, err := CreateAccessKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	central.Add(id, hash)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, _ := r.BasicAuth(); u != "edge" || p != "edge-secret" {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		var req VerifyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(VerifyResponse{Valid: central.Verify(req.ID, req.Secret)})
+	}))
+
+	clock := &fakeClock{time.Now()}
+	edge, err := New(filepath.Join(t.TempDir(), "edge"), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFederation(srv.URL+"/", "edge", "edge-secret", 10*time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edge.Federate(f)
+
+	ok(edge.Verify(id, secret), "verified by central")
+	ok(!edge.Verify(id, "wrong"), "rejected by central")
+
+	// Central is unreachable: recent successes are honored for the grace period.
+	srv.Close()
+	clock.t = clock.t.Add(20 * time.Millisecond)
+	ok(edge.Verify(id, secret), "verified within grace")
+	ok(!edge.Verify(id, "wrong"), "rejected within grace")
+	clock.t = clock.t.Add(time.Second)
+	ok(!edge.Verify(id, secret), "rejected after grace")
+}
@@ -0,0 +1,63 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+// FSStore is a read-only Keystore backed by a keychain file in a file system, e.g. an embed.FS,
+// a zip archive opened with zip.NewReader, or a fstest.MapFS in tests.
+type FSStore struct {
+	FS   fs.FS
+	Name string // path of the keychain file in FS, e.g. "keys/.wave-keychain"
+}
+
+// LoadFS loads a read-only keychain from the keychain file name in fsys.
+func LoadFS(fsys fs.FS, name string) (*Keychain, error) {
+	return New(name, WithStore(&FSStore{fsys, name}), WithReadOnly())
+}
+
+func (s *FSStore) String() string {
+	return s.Name
+}
+
+func (s *FSStore) Load() ([]Entry, error) {
+	file, err := s.FS.Open(s.Name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed opening %s: %v", s.Name, err)
+	}
+	defer file.Close()
+
+	entries, err := readEntries(file)
+	if err != nil {
+		var le *LineError
+		if errors.As(err, &le) {
+			return nil, fmt.Errorf("%s: %w", s.Name, err)
+		}
+		return nil, fmt.Errorf("failed reading %s: %v", s.Name, err)
+	}
+	return entries, nil
+}
+
+// Save fails with ErrReadOnly; file systems can't be written to.
+func (s *FSStore) Save(entries []Entry) error {
+	return ErrReadOnly
+}
@@ -0,0 +1,49 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"errors"
+	"testing"
+	"testing/fstest"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestLoadFS(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	id, secret, hash, err := CreateAccessKey()
+	no(err)
+	fsys := fstest.MapFS{
+		"keys/.wave-keychain": {Data: []byte(id + ":" + string(hash) + "\n")},
+		"bad":                 {Data: []byte("\n\nnope\n")},
+	}
+
+	kc, err := LoadFS(fsys, "keys/.wave-keychain")
+	no(err)
+	eq(1, kc.Len())
+	ok(kc.verify(id, secret))
+	ok(kc.ReadOnly())
+	eq(ErrReadOnly, kc.Save())
+
+	kc, err = LoadFS(fsys, "missing")
+	no(err)
+	eq(0, kc.Len())
+
+	_, err = LoadFS(fsys, "bad")
+	var le *LineError
+	ok(errors.As(err, &le))
+	eq(3, le.Line)
+}
@@ -0,0 +1,289 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Outcome represents the result of verifying an access key.
+type Outcome int
+
+const (
+	// Denied indicates an unknown access key ID or a bad secret.
+	Denied Outcome = iota
+	// Allowed indicates valid credentials.
+	Allowed
+	// Throttled indicates valid credentials, but a request over its tenant's limits.
+	Throttled
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case Allowed:
+		return "allowed"
+	case Throttled:
+		return "throttled"
+	}
+	return "denied"
+}
+
+func (o Outcome) MarshalJSON() ([]byte, error) {
+	return json.Marshal(o.String())
+}
+
+// Event represents an authentication attempt against a keychain.
+type Event struct {
+	ID         string    `json:"id"`          // access key ID presented by the caller
+	RemoteAddr string    `json:"remote_addr"` // caller address, X-Forwarded-For if proxied by a trusted proxy
+	UserAgent  string    `json:"user_agent"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Time       time.Time `json:"time"`
+	Outcome    Outcome   `json:"outcome"` // result of credential verification
+}
+
+func newEvent(r *http.Request, id string, outcome Outcome, now time.Time, proxies []*net.IPNet) Event {
+	return Event{
+		ID:         id,
+		RemoteAddr: remoteAddr(r, proxies),
+		UserAgent:  r.UserAgent(),
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Time:       now,
+		Outcome:    outcome,
+	}
+}
+
+// remoteAddr returns the address of the caller: the peer, unless the peer is one of proxies, in which case the
+// right-most X-Forwarded-For entry not itself a trusted proxy. Entries to the left of it are set by the caller,
+// and can't be trusted.
+func remoteAddr(r *http.Request, proxies []*net.IPNet) string {
+	if !trusted(r.RemoteAddr, proxies) {
+		return r.RemoteAddr
+	}
+	var hops []string
+	for _, fwd := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(fwd, ",")...)
+	}
+	addr := r.RemoteAddr
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			break
+		}
+		addr = hop
+		if !trusted(hop, proxies) {
+			break
+		}
+	}
+	return addr
+}
+
+// trusted reports whether addr, an IP address with or without a port, is within one of proxies.
+func trusted(addr string, proxies []*net.IPNet) bool {
+	if len(proxies) == 0 {
+		return false
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range proxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseProxies parses a comma-separated list of IP addresses and CIDR ranges, e.g. "10.0.0.0/8, 192.168.1.1".
+func ParseProxies(s string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy address: %q", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy range: %v", err)
+		}
+		proxies = append(proxies, n)
+	}
+	return proxies, nil
+}
+
+// Verdict represents a hook's opinion on an authentication attempt.
+type Verdict int
+
+const (
+	// Pass leaves the outcome of the attempt unchanged.
+	Pass Verdict = iota
+	// Deny rejects the attempt, even if the credentials are valid.
+	Deny
+)
+
+// Hook is invoked on every authentication attempt, after credentials have been verified.
+// Hooks see both allowed and denied attempts, but can only ever turn an allowed attempt into a denied one.
+// Hooks are called synchronously on the request path and must be safe for concurrent use.
+type Hook interface {
+	Inspect(e Event) Verdict
+}
+
+// ContextHook is a Hook that is passed the context of the request being authenticated, so that it can give up
+// once the request is cancelled.
+type ContextHook interface {
+	Hook
+	InspectContext(ctx context.Context, e Event) Verdict
+}
+
+// HookFunc adapts an ordinary function to a Hook.
+type HookFunc func(e Event) Verdict
+
+// Inspect calls f(e).
+func (f HookFunc) Inspect(e Event) Verdict {
+	return f(e)
+}
+
+// webhookQueueSize is the number of events a Webhook holds for reporting in the background.
+const webhookQueueSize = 1024
+
+// Webhook is a Hook that delegates to an external anomaly detector over HTTP.
+// Each event is POSTed as JSON; a 403 Forbidden response denies the attempt.
+// Any other response, or a failure to reach the detector, leaves the attempt unchanged.
+//
+// Only allowed attempts wait for the detector's response, since it cannot change the outcome of the others.
+// Those are reported in the background instead, through a bounded queue: if the detector falls behind,
+// e.g. while the server is flooded with bad credentials, further events are dropped until it catches up.
+type Webhook struct {
+	url     string
+	client  *http.Client
+	events  chan Event   // attempts reported in the background
+	dropped atomic.Int64 // events dropped since the queue was last found full
+}
+
+// NewWebhook creates a Webhook that posts events to url, giving up on each after timeout.
+func NewWebhook(url string, timeout time.Duration) *Webhook {
+	h := &Webhook{url: url, client: &http.Client{Timeout: timeout}, events: make(chan Event, webhookQueueSize)}
+	go h.run()
+	return h
+}
+
+func (h *Webhook) Inspect(e Event) Verdict {
+	return h.InspectContext(context.Background(), e)
+}
+
+func (h *Webhook) InspectContext(ctx context.Context, e Event) Verdict {
+	if e.Outcome != Allowed {
+		select {
+		case h.events <- e:
+		default:
+			h.dropped.Add(1)
+		}
+		return Pass
+	}
+	return h.post(ctx, e)
+}
+
+func (h *Webhook) run() {
+	for e := range h.events {
+		h.post(context.Background(), e)
+		if n := h.dropped.Swap(0); n > 0 {
+			log.Println("#", "keychain webhook fell behind, dropped", n, "events")
+		}
+	}
+}
+
+func (h *Webhook) post(ctx context.Context, e Event) Verdict {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return Pass
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(b))
+	if err != nil {
+		return Pass
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		log.Println("#", "keychain webhook failed:", err)
+		return Pass
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusForbidden {
+		return Deny
+	}
+	return Pass
+}
+
+// SetTrustedProxies sets the proxies trusted to report the address of callers in X-Forwarded-For, in the
+// events passed to hooks. By default, no proxy is trusted, and events carry the address of the peer.
+func (kc *Keychain) SetTrustedProxies(proxies []*net.IPNet) {
+	kc.Lock()
+	kc.proxies = proxies
+	kc.Unlock()
+}
+
+// AddHook registers a hook to be invoked on authentication attempts.
+func (kc *Keychain) AddHook(h Hook) {
+	kc.Lock()
+	kc.hooks = append(kc.hooks, h)
+	kc.Unlock()
+}
+
+func (kc *Keychain) inspect(ctx context.Context, e Event) bool {
+	kc.RLock()
+	hooks := kc.hooks
+	kc.RUnlock()
+
+	verdict := Pass
+	for _, h := range hooks {
+		var v Verdict
+		if ch, ok := h.(ContextHook); ok {
+			v = ch.InspectContext(ctx, e)
+		} else {
+			v = h.Inspect(e)
+		}
+		if v == Deny {
+			verdict = Deny
+		}
+	}
+	return e.Outcome == Allowed && verdict == Pass
+}
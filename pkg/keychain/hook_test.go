@@ -0,0 +1,203 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func newTestRequest(id, secret string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.SetBasicAuth(id, secret)
+	r.RemoteAddr = "10.0.0.1:1234"
+	return r
+}
+
+func TestKeychainHooks(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	kc, err := LoadKeychain(filepath.Join(t.TempDir(), ".wave-keychain"))
+	no(err)
+
+	id, secret, hash, err := CreateAccessKey()
+	no(err)
+	kc.Add(id, hash)
+
+	var events []Event
+	kc.AddHook(HookFunc(func(e Event) Verdict {
+		events = append(events, e)
+		if e.RemoteAddr == "10.0.0.1:1234" && e.Outcome == Allowed {
+			return Deny
+		}
+		return Pass
+	}))
+
+	ok(!kc.Allow(newTestRequest(id, secret)), "hook should deny valid key")
+	ok(!kc.Allow(newTestRequest(id, "bad")), "bad secret")
+
+	r := newTestRequest(id, secret)
+	r.RemoteAddr = "10.0.0.2:1234"
+	ok(kc.Allow(r), "hook should pass")
+
+	eq(3, len(events))
+	eq(Allowed, events[0].Outcome)
+	eq(Denied, events[1].Outcome)
+	eq(id, events[1].ID)
+}
+
+func TestKeychainHooksTrustProxies(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	kc, err := LoadKeychain(filepath.Join(t.TempDir(), ".wave-keychain"))
+	no(err)
+
+	var addr string
+	kc.AddHook(HookFunc(func(e Event) Verdict {
+		addr = e.RemoteAddr
+		return Pass
+	}))
+	forwarded := func(peer, fwd string) string {
+		r := newTestRequest("id", "secret")
+		r.RemoteAddr = peer
+		r.Header.Set("X-Forwarded-For", fwd)
+		kc.Allow(r)
+		return addr
+	}
+
+	eq(forwarded("10.0.0.1:1234", "1.2.3.4"), "10.0.0.1:1234") // spoofed, no proxies trusted
+
+	proxies, err := ParseProxies("10.0.0.0/24, 192.168.1.1")
+	no(err)
+	kc.SetTrustedProxies(proxies)
+
+	eq(forwarded("10.0.0.1:1234", "1.2.3.4"), "1.2.3.4")
+	eq(forwarded("10.0.0.1:1234", "6.6.6.6, 1.2.3.4"), "1.2.3.4")              // left-most set by the caller
+	eq(forwarded("10.0.0.1:1234", "6.6.6.6, 1.2.3.4, 192.168.1.1"), "1.2.3.4") // chained proxies
+	eq(forwarded("10.0.1.1:1234", "1.2.3.4"), "10.0.1.1:1234")                 // untrusted peer
+	eq(forwarded("10.0.0.1:1234", ""), "10.0.0.1:1234")
+
+	_, err = ParseProxies("10.0.0.0/33")
+	ok(err != nil)
+	_, err = ParseProxies("proxy")
+	ok(err != nil)
+}
+
+func TestWebhook(t *testing.T) {
+	_, ok, no := assert.Assert(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	kc, err := LoadKeychain(filepath.Join(t.TempDir(), ".wave-keychain"))
+	no(err)
+	id, secret, hash, err := CreateAccessKey()
+	no(err)
+	kc.Add(id, hash)
+	ok(kc.Allow(newTestRequest(id, secret)))
+
+	kc.AddHook(NewWebhook(srv.URL, 0))
+	ok(!kc.Allow(newTestRequest(id, secret)))
+}
+
+func TestWebhookReportsOthersInBackground(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	release := make(chan struct{})
+	received := make(chan string, webhookQueueSize+10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		var e struct{ Outcome string }
+		json.NewDecoder(r.Body).Decode(&e)
+		received <- e.Outcome
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+	h := NewWebhook(srv.URL, 0)
+
+	// Denied attempts don't wait for the detector, and overflow is dropped.
+	for i := 0; i < webhookQueueSize+10; i++ {
+		eq(h.InspectContext(context.Background(), Event{ID: "key", Outcome: Denied}), Pass)
+	}
+	close(release)
+	eq(<-received, "denied")
+	for n := 1; n < webhookQueueSize+10; n++ {
+		select {
+		case <-received:
+		case <-time.After(500 * time.Millisecond):
+			ok(n <= webhookQueueSize+1, "too few events reported:", n)
+			return
+		}
+	}
+	ok(false, "overflow was not dropped")
+}
+
+func TestWebhookGivesUpWithRequest(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+	defer close(release)
+	h := NewWebhook(srv.URL, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	eq(h.InspectContext(ctx, Event{ID: "key", Outcome: Allowed}), Pass)
+}
+
+func TestHookLockout(t *testing.T) {
+	_, ok, no := assert.Assert(t)
+	clock := &fakeClock{time.Now()}
+	kc, err := New(filepath.Join(t.TempDir(), ".wave-keychain"), WithClock(clock))
+	no(err)
+	id, secret, hash, err := CreateAccessKey()
+	no(err)
+	no(kc.Add(id, hash))
+
+	// Lock a key out for a minute after 3 failures.
+	var (
+		failures int
+		until    time.Time
+	)
+	kc.AddHook(HookFunc(func(e Event) Verdict {
+		if e.Time.Before(until) {
+			return Deny
+		}
+		if e.Outcome == Denied {
+			if failures++; failures == 3 {
+				failures, until = 0, e.Time.Add(time.Minute)
+			}
+		}
+		return Pass
+	}))
+
+	for i := 0; i < 3; i++ {
+		ok(!kc.Allow(newTestRequest(id, "bad")))
+	}
+	ok(!kc.Allow(newTestRequest(id, secret)), "key must be locked out")
+	clock.t = clock.t.Add(2 * time.Minute)
+	ok(kc.Allow(newTestRequest(id, secret)), "lockout must lapse by the keychain's clock")
+}
@@ -0,0 +1,401 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// indexStride is the number of entries between consecutive index marks.
+// Each lookup reads at most this many lines from disk.
+const indexStride = 64
+
+var errUnsorted = errors.New("entries not sorted by ID")
+
+type indexMark struct {
+	id  string
+	off int64
+}
+
+// diskTable is a table that leaves entries in a keychain file sorted by ID, holding only every
+// indexStride-th ID in memory, plus any entries changed since the file was last written.
+// Entries that cannot be read back from disk are treated as missing, so verification fails closed.
+type diskTable struct {
+	sync.RWMutex
+	name    string
+	file    *os.File // nil if the keychain file does not exist yet
+	size    int64
+	marks   []indexMark
+	count   int               // entries on disk
+	overlay map[string]*Entry // entries added or changed since the last flush
+	removed map[string]bool   // entries on disk removed since the last flush
+	n       int               // live entries
+}
+
+// OpenIndexed loads a keychain file without holding all of its entries in memory.
+// Entries are looked up on disk through a sparse in-memory index, which suits keychains
+// holding millions of keys. A file that is not sorted by ID is rewritten in sorted order first.
+func OpenIndexed(name string) (*Keychain, error) {
+	return New(name, WithIndex())
+}
+
+func openIndex(name string) (*diskTable, error) {
+	t := &diskTable{name: name, overlay: make(map[string]*Entry), removed: make(map[string]bool)}
+	if err := t.reindex(); err != nil {
+		if !errors.Is(err, errUnsorted) {
+			return nil, err
+		}
+		if err := sortKeychainFile(name); err != nil {
+			return nil, err
+		}
+		if err := t.reindex(); err != nil {
+			return nil, err
+		}
+	}
+	t.n = t.count
+	return t, nil
+}
+
+// sortKeychainFile rewrites a keychain file in ID order. Later duplicates win, as when loading.
+func sortKeychainFile(name string) error {
+	fs := &FileStore{name}
+	entries, err := fs.Load()
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	unique := entries[:0]
+	for _, e := range entries {
+		if n := len(unique); n > 0 && unique[n-1].ID == e.ID {
+			unique[n-1] = e
+			continue
+		}
+		unique = append(unique, e)
+	}
+	return fs.Save(unique)
+}
+
+// lines calls fn for each non-empty line of the keychain file, with its ID, until fn returns false.
+func (t *diskTable) lines(fn func(id, line []byte, off int64) (bool, error)) error {
+	if t.file == nil {
+		return nil
+	}
+	r := bufio.NewReader(io.NewSectionReader(t.file, 0, t.size))
+	var off int64
+	for i := 1; ; i++ {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			start := off
+			off += int64(len(line))
+			line = bytes.TrimSuffix(line, newline)
+			if len(line) > 0 {
+				id, _, ok := bytes.Cut(line, colon)
+				if !ok || len(id) == 0 {
+					return fmt.Errorf("%s: %w", t.name, &LineError{i, &ErrInvalidEntry{i, "want id:hash"}})
+				}
+				more, err := fn(id, line, start)
+				if err != nil {
+					return fmt.Errorf("%s: %w", t.name, &LineError{i, err})
+				}
+				if !more {
+					return nil
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed reading %s: %v", t.name, err)
+		}
+	}
+}
+
+// reindex opens the keychain file and rebuilds the sparse index.
+func (t *diskTable) reindex() error {
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+	t.marks, t.count, t.size = nil, 0, 0
+
+	file, err := os.Open(t.name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed opening %s: %v", t.name, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed reading %s: %v", t.name, err)
+	}
+	t.file, t.size = file, info.Size()
+
+	var prev []byte
+	err = t.lines(func(id, _ []byte, off int64) (bool, error) {
+		if prev != nil && bytes.Compare(id, prev) <= 0 {
+			return false, errUnsorted
+		}
+		if t.count%indexStride == 0 {
+			t.marks = append(t.marks, indexMark{string(id), off})
+		}
+		prev = append(prev[:0], id...)
+		t.count++
+		return true, nil
+	})
+	if err != nil {
+		t.file.Close()
+		t.file = nil
+	}
+	return err
+}
+
+// lookup reads the entry for id from disk.
+func (t *diskTable) lookup(id string) *Entry {
+	i := sort.Search(len(t.marks), func(i int) bool { return t.marks[i].id > id }) - 1
+	if i < 0 {
+		return nil
+	}
+	end := t.size
+	if i+1 < len(t.marks) {
+		end = t.marks[i+1].off
+	}
+	block := make([]byte, end-t.marks[i].off)
+	if _, err := t.file.ReadAt(block, t.marks[i].off); err != nil && err != io.EOF {
+		return nil
+	}
+	for len(block) > 0 {
+		var line []byte
+		line, block, _ = bytes.Cut(block, newline)
+		if len(line) > len(id) && line[len(id)] == ':' && string(line[:len(id)]) == id {
+			e, err := parseEntry(line)
+			if err != nil {
+				return nil
+			}
+			return e
+		}
+	}
+	return nil
+}
+
+// get returns the live entry for id; must be called with the lock held.
+func (t *diskTable) get(id string) *Entry {
+	if e, ok := t.overlay[id]; ok {
+		return e
+	}
+	if t.removed[id] {
+		return nil
+	}
+	return t.lookup(id)
+}
+
+func (t *diskTable) view(id string, fn func(e *Entry)) bool {
+	t.RLock()
+	defer t.RUnlock()
+	if e := t.get(id); e != nil {
+		fn(e)
+		return true
+	}
+	return false
+}
+
+func (t *diskTable) credential(id string, now time.Time) ([]byte, bool, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	if e := t.get(id); e != nil {
+		return e.Hash, e.Active(now), true
+	}
+	return nil, false, false
+}
+
+func (t *diskTable) update(id string, fn func(e *Entry)) bool {
+	t.Lock()
+	defer t.Unlock()
+	if e := t.get(id); e != nil {
+		fn(e)
+		t.overlay[id] = e
+		return true
+	}
+	return false
+}
+
+func (t *diskTable) upsert(id string, fn func(e *Entry)) bool {
+	t.Lock()
+	defer t.Unlock()
+	e := t.get(id)
+	ok := e != nil
+	if !ok {
+		e = &Entry{ID: id}
+		t.n++
+	}
+	fn(e)
+	t.overlay[id] = e
+	return ok
+}
+
+func (t *diskTable) remove(id string) bool {
+	t.Lock()
+	defer t.Unlock()
+	if t.get(id) == nil {
+		return false
+	}
+	delete(t.overlay, id)
+	if t.lookup(id) != nil {
+		t.removed[id] = true
+	}
+	t.n--
+	return true
+}
+
+func (t *diskTable) each(fn func(e *Entry) bool) {
+	t.RLock()
+	defer t.RUnlock()
+	more := true
+	t.lines(func(id, line []byte, _ int64) (bool, error) {
+		if _, ok := t.overlay[string(id)]; ok || t.removed[string(id)] {
+			return true, nil
+		}
+		e, err := parseEntry(line)
+		if err != nil {
+			return true, nil // skip; the file was valid when indexed
+		}
+		more = fn(e)
+		return more, nil
+	})
+	if !more {
+		return
+	}
+	for _, e := range t.overlay {
+		if !fn(e) {
+			return
+		}
+	}
+}
+
+// reset discards changes since the last flush, except for transient entries, and rebuilds the index.
+func (t *diskTable) reset() error {
+	t.Lock()
+	defer t.Unlock()
+	for id, e := range t.overlay {
+		if !e.transient {
+			delete(t.overlay, id)
+		}
+	}
+	t.removed = make(map[string]bool)
+	err := t.reindex()
+	t.n = t.count + len(t.overlay)
+	return err
+}
+
+func (t *diskTable) len() int {
+	t.RLock()
+	defer t.RUnlock()
+	return t.n
+}
+
+// flush writes the keychain file, merging changes into the entries on disk, and rebuilds the index.
+// Transient entries are never written, and remain in memory.
+func (t *diskTable) flush() error {
+	t.Lock()
+	defer t.Unlock()
+
+	changed := make([]*Entry, 0, len(t.overlay))
+	for _, e := range t.overlay {
+		if !e.transient {
+			changed = append(changed, e)
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool { return changed[i].ID < changed[j].ID })
+
+	tmp := t.name + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed writing %s: %v", t.name, err)
+	}
+	w := bufio.NewWriter(file)
+	var sb bytes.Buffer
+	put := func(e *Entry) error {
+		sb.Reset()
+		if err := writeEntry(&sb, *e); err != nil {
+			return err
+		}
+		_, err := w.Write(sb.Bytes())
+		return err
+	}
+	err = t.lines(func(id, line []byte, _ int64) (bool, error) {
+		for len(changed) > 0 && changed[0].ID < string(id) {
+			if err := put(changed[0]); err != nil {
+				return false, err
+			}
+			changed = changed[1:]
+		}
+		if e, ok := t.overlay[string(id)]; ok || t.removed[string(id)] {
+			if ok && !e.transient {
+				if err := put(e); err != nil {
+					return false, err
+				}
+				changed = changed[1:] // e is changed[0]
+			}
+			return true, nil
+		}
+		w.Write(line)
+		_, err := w.Write(newline)
+		return true, err
+	})
+	for _, e := range changed {
+		if err == nil {
+			err = put(e)
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		if t.file != nil {
+			t.file.Close() // can't replace open files on some platforms
+		}
+		if err = os.Rename(tmp, t.name); err == nil {
+			for id, e := range t.overlay {
+				if !e.transient {
+					delete(t.overlay, id)
+				}
+			}
+			t.removed = make(map[string]bool)
+		}
+		t.file = nil
+		if rerr := t.reindex(); err == nil {
+			err = rerr
+		}
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed writing %s: %v", t.name, err)
+	}
+	t.n = t.count + len(t.overlay)
+	return nil
+}
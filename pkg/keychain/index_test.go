@@ -0,0 +1,84 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestOpenIndexed(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	name := filepath.Join(t.TempDir(), ".wave-keychain")
+
+	// Written out of order, to be sorted on open.
+	var lines []byte
+	for i := 999; i >= 0; i-- {
+		lines = fmt.Appendf(lines, "K%04d:hash%d\n", i, i)
+	}
+	no(os.WriteFile(name, lines, 0600))
+
+	kc, err := OpenIndexed(name)
+	no(err)
+	eq(1000, kc.Len())
+	e, found := kc.Get("K0500")
+	ok(found)
+	eq("hash500", string(e.Hash))
+	_, found = kc.Get("K1000")
+	ok(!found)
+
+	id, secret, hash, err := CreateAccessKey()
+	no(err)
+	kc.Add(id, hash)
+	ok(kc.verify(id, secret))
+	no(kc.Remove("K0000"))
+	ok(kc.Remove("K0000") != nil)
+	no(kc.Disable("K0999", true))
+	kc.AddTransient("T", []byte("transient"))
+	eq(1001, kc.Len())
+
+	entries := kc.Entries()
+	eq(1001, len(entries))
+	ok(sort.SliceIsSorted(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID }))
+
+	no(kc.Save())
+	eq(1001, kc.Len())
+	_, found = kc.Get("T")
+	ok(found)
+
+	kc, err = OpenIndexed(name)
+	no(err)
+	eq(1000, kc.Len())
+	_, found = kc.Get("K0000")
+	ok(!found)
+	e, _ = kc.Get("K0999")
+	ok(e.Disabled)
+	ok(kc.verify(id, secret))
+
+	// Indexed and in-memory keychains read the same file.
+	mem, err := LoadKeychain(name)
+	no(err)
+	eq(mem.Len(), kc.Len())
+	for _, e := range mem.Entries() {
+		e2, found := kc.Get(e.ID)
+		ok(found, e.ID)
+		eq(string(e.Hash), string(e2.Hash))
+	}
+}
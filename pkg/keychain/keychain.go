@@ -15,29 +15,67 @@
 package keychain
 
 import (
-	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha512"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"iter"
+	"net"
 	"net/http"
-	"os"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	lru "github.com/hashicorp/golang-lru"
 	"golang.org/x/crypto/bcrypt"
 )
 
 var (
-	idChars                 = []byte("ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
-	secretChars             = []byte("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789")
-	colon                   = []byte(":")
-	newline                 = []byte{'\n'}
-	errInvalidKeychainEntry = errors.New("invalid entry found in keychain")
+	idChars     = []byte("ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
+	secretChars = []byte("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789")
+	colon       = []byte(":")
+	newline     = []byte{'\n'}
+
+	// ErrReadOnly is returned when attempting to change a read-only keychain.
+	ErrReadOnly = errors.New("keychain is read-only")
+	// ErrKeyNotFound is returned when an access key does not exist.
+	ErrKeyNotFound = errors.New("access key not found")
+	// ErrKeyDisabled is returned when authenticating with a disabled access key.
+	ErrKeyDisabled = errors.New("access key disabled")
+	// ErrKeyExpired is returned when authenticating with an expired access key.
+	ErrKeyExpired = errors.New("access key expired")
+	// ErrInvalidSecret is returned when authenticating with the wrong secret for an access key.
+	ErrInvalidSecret = errors.New("invalid secret")
 )
 
-func generateRandString(chars []byte, n int) (string, error) {
+// ErrInvalidEntry is returned when a keychain holds a malformed entry.
+type ErrInvalidEntry struct {
+	Line   int // 1-based line number in the keychain file; 0 if the keychain is not a file
+	Reason string
+}
+
+func (e *ErrInvalidEntry) Error() string {
+	return "invalid keychain entry: " + e.Reason
+}
+
+// DefaultCacheTTL is how long verifications are cached in memory by default.
+const DefaultCacheTTL = 5 * time.Minute
+
+// maxCacheSize bounds the number of verifications cached in memory by default, regardless of keychain size.
+// Each cached verification takes about 150 bytes, bounding the cache at roughly 10 MB.
+const maxCacheSize = 1 << 16
+
+// minCacheSize is the number of verifications the cache holds at least by default.
+const minCacheSize = 128
+
+// generateRandString returns a string of n characters picked uniformly from chars, using entropy from r.
+func generateRandString(r io.Reader, chars []byte, n int) (string, error) {
 	secret := make([]byte, n)
 	rb := make([]byte, n+(n/4))
 
@@ -46,7 +84,7 @@ func generateRandString(chars []byte, n int) (string, error) {
 
 	i := 0
 	for {
-		if _, err := rand.Read(rb); err != nil {
+		if _, err := io.ReadFull(r, rb); err != nil {
 			return "", fmt.Errorf("failed generating random bytes: %v", err)
 		}
 		for _, b := range rb {
@@ -63,80 +101,502 @@ func generateRandString(chars []byte, n int) (string, error) {
 	}
 }
 
+// HashSecret hashes secret using bcrypt with the default cost.
 func HashSecret(secret string) ([]byte, error) {
-	h, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
-	if err != nil {
-		return nil, fmt.Errorf("failed hashing secret: %v", err)
+	return defaultHasher.Hash(secret)
+}
+
+var defaultHasher Hasher = Bcrypt{bcrypt.DefaultCost}
+
+// HashSecret hashes secret using the keychain's hasher, e.g. for keys to add with Add.
+func (kc *Keychain) HashSecret(secret string) ([]byte, error) {
+	return kc.hasher.Hash(secret)
+}
+
+// HashSecrets hashes secrets in parallel, across a worker per CPU. Hashes and errors are returned in the
+// order of secrets; errs is nil if all secrets were hashed.
+func HashSecrets(secrets []string) (hashes [][]byte, errs []error) {
+	return hashSecrets(defaultHasher, secrets)
+}
+
+func hashSecrets(h Hasher, secrets []string) (hashes [][]byte, errs []error) {
+	hashes = make([][]byte, len(secrets))
+	results := make([]error, len(secrets))
+	var failed atomic.Bool
+	parallel(len(secrets), func(i int) {
+		if hashes[i], results[i] = h.Hash(secrets[i]); results[i] != nil {
+			failed.Store(true)
+		}
+	})
+	if failed.Load() {
+		errs = results
+	}
+	return
+}
+
+// parallel calls fn for 0 <= i < n, across a worker per CPU.
+func parallel(n int, fn func(i int)) {
+	var (
+		wg   sync.WaitGroup
+		next = make(chan int)
+	)
+	for w := min(runtime.GOMAXPROCS(0), n); w > 0; w-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fn(i)
+			}
+		}()
 	}
-	return h, nil
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
 }
 
 // Keychain represents a collection of access keys that are allowed to use the API
 type Keychain struct {
-	Name  string
-	keys  map[string][]byte
-	cache *lru.Cache
+	sync.RWMutex
+	Name    string
+	keys    table
+	refs    sync.Mutex // serializes reference-keyed operations
+	cache   *verifyCache
+	tokens  *sync.Pool // of *tokenizer, keyed with a random key private to this keychain
+	signer  *sync.Pool // of *tokenizer, keyed with the signing key
+	hooks   []Hook
+	proxies []*net.IPNet // trusted to set X-Forwarded-For
+	store   Keystore
+	tenants map[string]*Tenant // tenants mounted at "tenant/" ID prefixes
+	shared  SharedCache        // optional
+	remote  *Federation        // optional; verifies keys not found locally
+	watch   []func(id string)
+	ro      bool
+	ttl     time.Duration // how long verifications are cached
+	saver   *saver        // optional; coalesces saves
+	hasher  Hasher
+	clock   Clock
+	entropy io.Reader // source of random IDs and secrets
 }
 
+// Entry represents an access key in a keychain.
+type Entry struct {
+	ID       string            `json:"id,omitempty"`
+	Hash     []byte            `json:"-"`
+	Ref      string            `json:"ref,omitempty"` // reference ID assigned by external tooling, if any
+	Disabled bool              `json:"disabled,omitempty"`
+	Expires  *time.Time        `json:"expires,omitempty"` // never, if nil
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	transient bool // never saved
+}
+
+func (e *Entry) clone() Entry {
+	c := *e
+	if e.Metadata != nil {
+		c.Metadata = make(map[string]string, len(e.Metadata))
+		for k, v := range e.Metadata {
+			c.Metadata[k] = v
+		}
+	}
+	return c
+}
+
+// Active returns true if the entry can be used to authenticate at time t.
+func (e *Entry) Active(t time.Time) bool {
+	return !e.Disabled && (e.Expires == nil || t.Before(*e.Expires))
+}
+
+// HasScope reports whether the entry's scope metadata, a comma-separated list as recorded by key policies,
+// includes scope.
+func (e *Entry) HasScope(scope string) bool {
+	if scope == "" {
+		return false
+	}
+	for _, s := range strings.Split(e.Metadata["scope"], ",") {
+		if strings.TrimSpace(s) == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateAccessKey generates a new access key ID and secret, and hashes the secret using bcrypt with the default cost.
 func CreateAccessKey() (id, secret string, hash []byte, err error) {
-	if id, err = generateRandString(idChars, 20); err != nil {
+	return createAccessKey(rand.Reader, defaultHasher)
+}
+
+// CreateAccessKey generates a new access key ID and secret using the keychain's entropy source, and hashes
+// the secret using the keychain's hasher. The key is not added to the keychain.
+func (kc *Keychain) CreateAccessKey() (id, secret string, hash []byte, err error) {
+	return createAccessKey(kc.entropy, kc.hasher)
+}
+
+func createAccessKey(r io.Reader, h Hasher) (id, secret string, hash []byte, err error) {
+	if id, err = generateRandString(r, idChars, 20); err != nil {
 		return
 	}
-	if secret, err = generateRandString(secretChars, 40); err != nil {
+	if secret, err = generateRandString(r, secretChars, 40); err != nil {
 		return
 	}
-	hash, err = HashSecret(secret)
+	hash, err = h.Hash(secret)
 	return
 }
 
-func (kc *Keychain) Add(id string, hash []byte) {
-	kc.keys[id] = hash
+// SetReadOnly makes the keychain read-only, e.g. for replicas or keychains mounted from secrets.
+// Changes to a read-only keychain fail with ErrReadOnly, except for transient keys, which are never saved anyway.
+func (kc *Keychain) SetReadOnly(readOnly bool) {
+	kc.Lock()
+	kc.ro = readOnly
+	kc.Unlock()
+}
+
+// SetCacheTTL sets how long verifications are cached in memory, so that a compromised secret stops verifying
+// soon after its key is rotated on another server. A non-positive TTL disables the cache.
+func (kc *Keychain) SetCacheTTL(ttl time.Duration) {
+	kc.Lock()
+	kc.ttl = ttl
+	kc.Unlock()
+	kc.cache.Purge()
+}
+
+// SetCacheSize bounds the number of verifications cached in memory. Within these bounds, the cache grows
+// when its hit rate is low or the keychain holds more keys than it can cache, and shrinks when mostly unused.
+// By default, between 128 and 65536 verifications are cached.
+func (kc *Keychain) SetCacheSize(min, max int) {
+	kc.cache.adapt(min, max, kc.keys.len)
+}
+
+// Now returns the current time according to the keychain's clock, against which keys expire.
+func (kc *Keychain) Now() time.Time {
+	return kc.clock.Now()
+}
+
+// ReadOnly returns true if the keychain is read-only.
+func (kc *Keychain) ReadOnly() bool {
+	kc.RLock()
+	defer kc.RUnlock()
+	return kc.ro
+}
+
+func (kc *Keychain) Add(id string, hash []byte) error {
+	if kc.ReadOnly() {
+		return ErrReadOnly
+	}
+	if kc.keys.upsert(id, func(e *Entry) { e.Hash = hash }) {
+		kc.cache.Purge() // secrets cached for the old hash must not verify
+	}
+	kc.changed(id)
+	return nil
+}
+
+// Watch registers fn to be called with the ID of each access key added, changed or removed.
+// Transient keys are not reported.
+func (kc *Keychain) Watch(fn func(id string)) {
+	kc.Lock()
+	kc.watch = append(kc.watch, fn)
+	kc.Unlock()
+}
+
+func (kc *Keychain) changed(id string) {
+	kc.RLock()
+	watch := kc.watch
+	kc.RUnlock()
+	for _, fn := range watch {
+		fn(id)
+	}
+}
+
+// token derives the key under which a verification of secret for id is cached: an HMAC with a key
+// private to this keychain, so that repeat verifications cost one HMAC instead of a bcrypt comparison,
+// and cached tokens are useless outside this process.
+func (kc *Keychain) token(id, secret string) (t token) {
+	tz := kc.tokens.Get().(*tokenizer)
+	tz.buf = append(append(append(tz.buf[:0], id...), 0), secret...)
+	tz.mac.Reset()
+	tz.mac.Write(tz.buf)
+	tz.sum = tz.mac.Sum(tz.sum[:0])
+	copy(t[:], tz.sum)
+	kc.tokens.Put(tz)
+	return
+}
+
+// verifier holds the settings used to verify keys, read from the keychain with a single lock acquisition.
+type verifier struct {
+	shared SharedCache
+	remote *Federation
+	ttl    time.Duration
+}
+
+func (kc *Keychain) verifier() verifier {
+	kc.RLock()
+	defer kc.RUnlock()
+	return verifier{kc.shared, kc.remote, kc.ttl}
 }
 
 func (kc *Keychain) verify(id, secret string) bool {
-	hash, ok := kc.keys[id]
-	if !ok {
+	return kc.verifyWith(context.Background(), kc.verifier(), id, secret)
+}
+
+// Credential is an access key ID and secret, e.g. from a request's basic authentication header.
+type Credential struct {
+	ID     string
+	Secret string
+}
+
+// VerifyBatch reports whether each secret is valid for its access key ID, like Verify, e.g. to re-authenticate
+// many clients reconnecting at once after a restart. Credentials missing from the cache are verified in parallel,
+// across a worker per CPU.
+func (kc *Keychain) VerifyBatch(creds []Credential) []bool {
+	v := kc.verifier()
+	valid := make([]bool, len(creds))
+	parallel(len(creds), func(i int) {
+		valid[i] = kc.verifyWith(context.Background(), v, creds[i].ID, creds[i].Secret)
+	})
+	return valid
+}
+
+func (kc *Keychain) verifyWith(ctx context.Context, v verifier, id, secret string) bool {
+	now := kc.clock.Now()
+	if tenant, tid, scoped := strings.Cut(id, "/"); scoped {
+		kc.RLock()
+		child, remote := kc.tenants[tenant], kc.remote
+		kc.RUnlock()
+		if child == nil && remote != nil {
+			return remote.verify(ctx, now, id, secret)
+		}
+		return child != nil && child.Keychain.VerifyContext(ctx, tid, secret)
+	}
+
+	// Hashes replaced from now on purge the cache; verifications made against the old hash mustn't be cached.
+	gen := kc.cache.generation()
+	hash, active, found := kc.keys.credential(id, now)
+	shared, remote, ttl := v.shared, v.remote, v.ttl
+	if !found && remote != nil {
+		return remote.verify(ctx, now, id, secret)
+	}
+	if !active {
 		return false
 	}
 
-	key := sha512.Sum512([]byte(strings.Join([]string{id, secret}, "\x00")))
+	key := kc.token(id, secret)
 
-	if result, hit := kc.cache.Get(key); hit {
-		return result.(bool)
+	if c, hit := kc.cache.Get(key); hit {
+		if now.Sub(c.at) < ttl {
+			return c.valid
+		}
+		kc.cache.Remove(key)
 	}
 
-	ok = bcrypt.CompareHashAndPassword(hash, []byte(secret)) == nil
-	kc.cache.Add(key, ok)
+	// Shared keys cover the hash too, so that other servers' entries for rotated keys never match.
+	var sharedKey string
+	if shared != nil {
+		h := sha512.Sum512([]byte(strings.Join([]string{id, secret, string(hash)}, "\x00")))
+		sharedKey = hex.EncodeToString(h[:])
+		if shared.Verified(sharedKey) {
+			if ttl > 0 {
+				kc.cache.addUnlessPurged(key, verification{true, now}, gen)
+			}
+			return true
+		}
+	}
+
+	if ctx.Err() != nil {
+		return false // don't spend a hash on a request that has gone away
+	}
+	ok := kc.hasher.Compare(hash, secret) == nil
+	if ttl > 0 {
+		kc.cache.addUnlessPurged(key, verification{ok, now}, gen)
+	}
+	if ok && shared != nil {
+		shared.SetVerified(sharedKey)
+	}
 
 	return ok
 }
 
-func (kc *Keychain) Remove(id string) bool {
-	if _, ok := kc.keys[id]; ok {
-		delete(kc.keys, id)
+func (kc *Keychain) Remove(id string) error {
+	if kc.ReadOnly() {
+		return ErrReadOnly
+	}
+	if !kc.keys.remove(id) {
+		return ErrKeyNotFound
+	}
+	kc.changed(id)
+	return nil
+}
+
+// Put adds an entry, replacing any existing entry with the same ID.
+func (kc *Keychain) Put(e Entry) error {
+	if kc.ReadOnly() {
+		return ErrReadOnly
+	}
+	c := e.clone()
+	if kc.keys.upsert(e.ID, func(e *Entry) { *e = c }) {
+		kc.cache.Purge()
+	}
+	kc.changed(e.ID)
+	return nil
+}
+
+// AddTransient adds an access key that is never saved, e.g. a default key supplied via configuration.
+func (kc *Keychain) AddTransient(id string, hash []byte) {
+	if kc.keys.upsert(id, func(e *Entry) { e.Hash, e.transient = hash, true }) {
+		kc.cache.Purge()
+	}
+}
+
+// AddTransientEntry adds an access key that is never saved, with its metadata, e.g. one minted for an app the
+// server runs.
+func (kc *Keychain) AddTransientEntry(e Entry) {
+	c := e.clone()
+	c.transient = true
+	if kc.keys.upsert(e.ID, func(e *Entry) { *e = c }) {
+		kc.cache.Purge()
+	}
+}
+
+// Get returns a copy of the entry for the given access key ID.
+func (kc *Keychain) Get(id string) (Entry, bool) {
+	var c Entry
+	ok := kc.keys.view(id, func(e *Entry) { c = e.clone() })
+	return c, ok
+}
+
+// Entries returns a copy of all entries, sorted by ID.
+func (kc *Keychain) Entries() []Entry {
+	entries := make([]Entry, 0, kc.keys.len())
+	kc.keys.each(func(e *Entry) bool {
+		entries = append(entries, e.clone())
 		return true
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries
+}
+
+// rangeChunk is the number of entries Range copies at a time.
+const rangeChunk = 256
+
+// Range calls fn with a copy of each entry, in no particular order, until fn returns false. Unlike Entries,
+// Range does not hold all entries in memory at once, which suits exports and audits of large keychains.
+// Range takes a snapshot of the IDs of the entries, then copies the entries a chunk at a time, without holding
+// the keychain locked while calling fn, so fn may change the keychain. Entries removed before their chunk is copied are skipped.
+func (kc *Keychain) Range(fn func(e Entry) bool) {
+	var ids []string
+	kc.keys.each(func(e *Entry) bool {
+		ids = append(ids, e.ID)
+		return true
+	})
+	chunk := make([]Entry, 0, min(rangeChunk, len(ids)))
+	for len(ids) > 0 {
+		n := min(rangeChunk, len(ids))
+		chunk = chunk[:0]
+		for _, id := range ids[:n] {
+			kc.keys.view(id, func(e *Entry) { chunk = append(chunk, e.clone()) })
+		}
+		ids = ids[n:]
+		for _, e := range chunk {
+			if !fn(e) {
+				return
+			}
+		}
 	}
-	return false
 }
 
-func (kc *Keychain) IDs() []string {
-	ids := make([]string, len(kc.keys))
-	i := 0
-	for id := range kc.keys {
-		ids[i] = id
-		i++
+// All returns an iterator over copies of the entries in the keychain, in no particular order; see Range.
+func (kc *Keychain) All() iter.Seq[Entry] {
+	return kc.Range
+}
+
+// Disable disables or re-enables an access key. Disabled keys are retained, but never verify.
+// Returns ErrKeyNotFound if the key does not exist, or ErrReadOnly if the keychain is read-only.
+func (kc *Keychain) Disable(id string, disabled bool) error {
+	if kc.ReadOnly() {
+		return ErrReadOnly
+	}
+	if !kc.keys.update(id, func(e *Entry) { e.Disabled = disabled }) {
+		return ErrKeyNotFound
 	}
+	kc.changed(id)
+	return nil
+}
+
+// SetMetadata replaces the metadata of an access key.
+// Returns ErrKeyNotFound if the key does not exist, or ErrReadOnly if the keychain is read-only.
+func (kc *Keychain) SetMetadata(id string, metadata map[string]string) error {
+	if kc.ReadOnly() {
+		return ErrReadOnly
+	}
+	if len(metadata) == 0 {
+		metadata = nil
+	}
+	if !kc.keys.update(id, func(e *Entry) { e.Metadata = metadata }) {
+		return ErrKeyNotFound
+	}
+	kc.changed(id)
+	return nil
+}
+
+// SetExpiry sets the time after which an access key can no longer be used. A nil expiry never expires.
+// Returns ErrKeyNotFound if the key does not exist, or ErrReadOnly if the keychain is read-only.
+func (kc *Keychain) SetExpiry(id string, expires *time.Time) error {
+	if kc.ReadOnly() {
+		return ErrReadOnly
+	}
+	if !kc.keys.update(id, func(e *Entry) { e.Expires = expires }) {
+		return ErrKeyNotFound
+	}
+	kc.changed(id)
+	return nil
+}
+
+// Rotate replaces the secret of an access key, returning the new secret.
+// The old secret stops verifying immediately.
+func (kc *Keychain) Rotate(id string) (string, error) {
+	if kc.ReadOnly() {
+		return "", ErrReadOnly
+	}
+	if _, ok := kc.Get(id); !ok {
+		return "", ErrKeyNotFound
+	}
+	secret, err := generateRandString(kc.entropy, secretChars, 40)
+	if err != nil {
+		return "", err
+	}
+	hash, err := kc.hasher.Hash(secret)
+	if err != nil {
+		return "", err
+	}
+
+	if !kc.keys.update(id, func(e *Entry) { e.Hash = hash }) { // removed while hashing
+		return "", ErrKeyNotFound
+	}
+	kc.cache.Purge()
+	kc.changed(id)
+	return secret, nil
+}
+
+func (kc *Keychain) IDs() []string {
+	ids := make([]string, 0, kc.keys.len())
+	kc.keys.each(func(e *Entry) bool {
+		ids = append(ids, e.ID)
+		return true
+	})
 	return ids
 }
 
 func (kc *Keychain) Len() int {
-	return len(kc.keys)
+	return kc.keys.len()
 }
 
 func newLruCache(size int) (*lru.Cache, error) {
 	if size < 8 {
 		size = 8
 	}
+	if size > maxCacheSize {
+		size = maxCacheSize
+	}
 	cache, err := lru.New(size)
 	if err != nil {
 		return nil, fmt.Errorf("failed creating keychain LRU cache: %s", err)
@@ -144,76 +604,193 @@ func newLruCache(size int) (*lru.Cache, error) {
 	return cache, nil
 }
 
+// LoadKeychain loads a keychain from a file, or from a SQLite database if name is of the form "sqlite:path".
 func LoadKeychain(name string) (*Keychain, error) {
-	keys := make(map[string][]byte)
+	return New(name)
+}
+
+// Open loads a keychain from the given store.
+func Open(store Keystore) (*Keychain, error) {
+	return New(store.String(), WithStore(store))
+}
 
-	if _, err := os.Stat(name); os.IsNotExist(err) {
-		cache, err := newLruCache(128)
+// Reload replaces the keys in the keychain with those in its store, e.g. after another server has
+// changed the store. Transient keys are kept. Watchers are not notified.
+func (kc *Keychain) Reload() error {
+	switch t := kc.keys.(type) {
+	case *diskTable:
+		if err := t.reset(); err != nil {
+			return err
+		}
+	case *shardMap:
+		entries, err := kc.store.Load()
 		if err != nil {
-			return nil, err
+			return err
 		}
-		return &Keychain{name, keys, cache}, nil
+		t.reset(entries)
 	}
+	kc.cache.Purge()
+	return nil
+}
 
-	file, err := os.Open(name)
-	if err != nil {
-		return nil, fmt.Errorf("failed opening %s: %v", name, err)
+// ReadFrom replaces the keys in the keychain with those read from r in the keychain file format, e.g. to
+// load keys from an embedded asset, an HTTP response or stdin. Transient keys are kept. Watchers are not notified.
+// Indexed keychains, which hold their keys on disk, can't be read into.
+func (kc *Keychain) ReadFrom(r io.Reader) (int64, error) {
+	t, ok := kc.keys.(*shardMap)
+	if !ok {
+		return 0, errors.New("indexed keychains can only be loaded from their file")
 	}
-	defer file.Close()
-
-	all, err := io.ReadAll(file)
+	cr := &countingReader{r: r}
+	entries, err := readEntries(cr)
 	if err != nil {
-		return nil, fmt.Errorf("failed reading %s: %v", name, err)
+		var le *LineError
+		if errors.As(err, &le) {
+			return cr.n, err
+		}
+		return cr.n, fmt.Errorf("failed reading keychain: %v", err)
 	}
+	t.reset(entries)
+	kc.cache.Purge()
+	return cr.n, nil
+}
 
-	for _, line := range bytes.Split(all, newline) {
-		if len(line) == 0 {
-			continue
-		}
-		tokens := bytes.SplitN(line, colon, 2)
-		if len(tokens) != 2 {
-			return nil, errInvalidKeychainEntry
-		}
-		id, hash := tokens[0], tokens[1]
-		if len(id) == 0 || len(hash) == 0 {
-			return nil, errInvalidKeychainEntry
+// WriteTo writes the keys in the keychain, except for transient keys, to w in the keychain file format,
+// e.g. to save keys to stdout or an HTTP response.
+func (kc *Keychain) WriteTo(w io.Writer) (int64, error) {
+	return writeEntries(w, kc.persistent())
+}
+
+// persistent returns the entries in the keychain that are saved, sorted by ID.
+func (kc *Keychain) persistent() []Entry {
+	entries := kc.Entries()
+	persistent := entries[:0]
+	for _, e := range entries {
+		if !e.transient {
+			persistent = append(persistent, e)
 		}
-		keys[string(id)] = hash
 	}
+	return persistent
+}
 
-	cache, err := newLruCache(len(keys))
-	if err != nil {
-		return nil, err
-	}
+type countingReader struct {
+	r io.Reader
+	n int64
+}
 
-	return &Keychain{name, keys, cache}, nil
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
 }
 
 func (kc *Keychain) Save() error {
-	var sb bytes.Buffer
-	for id, hash := range kc.keys {
-		sb.WriteString(id)
-		sb.Write(colon)
-		sb.Write(hash)
-		sb.Write(newline)
+	if kc.ReadOnly() {
+		return ErrReadOnly
 	}
+	kc.RLock()
+	s := kc.saver
+	kc.RUnlock()
+	if s != nil {
+		s.schedule()
+		return nil
+	}
+	return kc.write(nil)
+}
 
-	if err := os.WriteFile(kc.Name, sb.Bytes(), 0600); err != nil {
-		return fmt.Errorf("failed writing %s: %v", kc.Name, err)
+// Authenticate is like VerifyContext, but reports why verification failed: ErrKeyNotFound, ErrKeyDisabled,
+// ErrKeyExpired, ErrInvalidSecret, or ctx's error. Keys verified by a federated server fail with ErrInvalidSecret,
+// since the server does not report why.
+func (kc *Keychain) Authenticate(ctx context.Context, id, secret string) error {
+	if kc.VerifyContext(ctx, id, secret) {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	kc.RLock()
+	remote := kc.remote
+	kc.RUnlock()
+	if tenant, tid, scoped := strings.Cut(id, "/"); scoped {
+		kc.RLock()
+		child := kc.tenants[tenant]
+		kc.RUnlock()
+		if child != nil {
+			return child.Keychain.Authenticate(ctx, tid, secret)
+		}
+		if remote != nil {
+			return ErrInvalidSecret
+		}
+		return ErrKeyNotFound
 	}
+	e, ok := kc.Get(id)
+	switch {
+	case !ok && remote != nil:
+		return ErrInvalidSecret
+	case !ok:
+		return ErrKeyNotFound
+	case e.Disabled:
+		return ErrKeyDisabled
+	case !e.Active(kc.clock.Now()):
+		return ErrKeyExpired
+	}
+	return ErrInvalidSecret
+}
 
-	return nil
+// Authenticator authenticates API requests. Keychain is an Authenticator; servers can be given other
+// implementations, e.g. to authenticate against another system, or to stub out authentication in tests.
+type Authenticator interface {
+	// Allow reports whether r carries valid credentials.
+	Allow(r *http.Request) bool
+	// Guard is like Allow, but also responds with an error if r is not allowed.
+	Guard(w http.ResponseWriter, r *http.Request) bool
+	// VerifyContext reports whether secret is valid for the access key id.
+	VerifyContext(ctx context.Context, id, secret string) bool
 }
 
-func (kc *Keychain) Allow(r *http.Request) bool {
+// Verify reports whether secret is valid for the access key id, without consulting hooks or limits.
+func (kc *Keychain) Verify(id, secret string) bool {
+	return kc.verify(id, secret)
+}
+
+// VerifyContext is like Verify, but fails if ctx is done before secret is hashed or a federated
+// server is consulted.
+func (kc *Keychain) VerifyContext(ctx context.Context, id, secret string) bool {
+	return kc.verifyWith(ctx, kc.verifier(), id, secret)
+}
+
+// authorize verifies a request's credentials, checks them against tenant limits, and consults hooks.
+func (kc *Keychain) authorize(r *http.Request) Outcome {
 	id, secret, ok := r.BasicAuth()
-	return ok && kc.verify(id, secret)
+	outcome := Denied
+	if ok && kc.VerifyContext(r.Context(), id, secret) {
+		outcome = Allowed
+		if !kc.admit(r, id) {
+			outcome = Throttled
+		}
+	}
+	kc.RLock()
+	proxies := kc.proxies
+	kc.RUnlock()
+	if !kc.inspect(r.Context(), newEvent(r, id, outcome, kc.clock.Now(), proxies)) && outcome == Allowed {
+		return Denied
+	}
+	return outcome
+}
+
+func (kc *Keychain) Allow(r *http.Request) bool {
+	return kc.authorize(r) == Allowed
 }
 
 func (kc *Keychain) Guard(w http.ResponseWriter, r *http.Request) bool {
-	if !kc.Allow(r) {
+	switch kc.authorize(r) {
+	case Allowed:
+		return true
+	case Throttled:
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+	default:
 		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-		return false
 	}
-	return true
+	return false
 }
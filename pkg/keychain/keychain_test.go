@@ -16,14 +16,25 @@ package keychain
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/h2oai/wave/pkg/assert"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestGenerateRandString(t *testing.T) {
 	eq, _, no := assert.Assert(t)
-	s, err := generateRandString(idChars, 20)
+	s, err := generateRandString(rand.Reader, idChars, 20)
 	no(err)
 	eq(len(s), 20)
 }
@@ -50,13 +61,23 @@ func TestKeychainSerialization(t *testing.T) {
 	no(err)
 	kc2, err := LoadKeychain(".wave-keychain")
 	no(err)
-	eq(len(kc1.keys), len(kc2.keys))
-	for k, v1 := range kc1.keys {
-		v2 := kc2.keys[k]
-		eq(bytes.Compare(v1, v2), 0)
+	eq(kc1.Len(), kc2.Len())
+	for _, v1 := range kc1.Entries() {
+		v2, _ := kc2.Get(v1.ID)
+		eq(bytes.Compare(v1.Hash, v2.Hash), 0)
 	}
 }
 
+func TestEntryHasScope(t *testing.T) {
+	_, ok, _ := assert.Assert(t)
+	e := Entry{Metadata: map[string]string{"scope": "reports, app"}}
+	ok(e.HasScope("app"))
+	ok(e.HasScope("reports"))
+	ok(!e.HasScope("uploads"))
+	ok(!e.HasScope(""))
+	ok(!(&Entry{}).HasScope("app"))
+}
+
 func TestKeychainVerify(t *testing.T) {
 	_, ok, no := assert.Assert(t)
 	kc, err := LoadKeychain(".wave-keychain")
@@ -70,7 +91,7 @@ func TestKeychainVerify(t *testing.T) {
 }
 
 func TestKeychainManagement(t *testing.T) {
-	eq, ok, no := assert.Assert(t)
+	eq, _, no := assert.Assert(t)
 
 	// drain
 	kc, err := LoadKeychain(".wave-keychain")
@@ -98,9 +119,551 @@ func TestKeychainManagement(t *testing.T) {
 	ids := kc.IDs()
 	eq(5, len(ids))
 	for _, id := range ids {
-		ok(kc.Remove(id))
+		no(kc.Remove(id))
 	}
 
 	// should be empty now
 	eq(0, kc.Len())
 }
+
+func TestKeychainEntries(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	name := filepath.Join(t.TempDir(), ".wave-keychain")
+	kc, err := LoadKeychain(name)
+	no(err)
+
+	id, secret, hash, err := CreateAccessKey()
+	no(err)
+	kc.Add(id, hash)
+	kc.AddTransient("default", hash)
+	no(kc.SetMetadata(id, map[string]string{"owner": "ops"}))
+	no(kc.Disable(id, true))
+	ok(!kc.verify(id, secret), "disabled key must not verify")
+	no(kc.Save())
+
+	kc, err = LoadKeychain(name)
+	no(err)
+	eq(1, kc.Len())
+	e, found := kc.Get(id)
+	ok(found)
+	ok(e.Disabled)
+	eq("ops", e.Metadata["owner"])
+
+	no(kc.Disable(id, false))
+	ok(kc.verify(id, secret))
+	secret2, err := kc.Rotate(id)
+	no(err)
+	ok(!kc.verify(id, secret), "old secret must not verify after rotation")
+	ok(kc.verify(id, secret2))
+
+	_, err = kc.Rotate("missing")
+	ok(err != nil)
+}
+
+func TestKeychainTransientEntry(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	name := filepath.Join(t.TempDir(), ".wave-keychain")
+	kc, err := LoadKeychain(name)
+	no(err)
+
+	id, secret, hash, err := CreateAccessKey()
+	no(err)
+	kc.SetReadOnly(true)
+	kc.AddTransientEntry(Entry{ID: id, Hash: hash, Metadata: map[string]string{"scope": "app"}})
+	ok(kc.verify(id, secret))
+	e, found := kc.Get(id)
+	ok(found)
+	ok(e.HasScope("app"))
+
+	kc.SetReadOnly(false)
+	no(kc.Save())
+	kc, err = LoadKeychain(name)
+	no(err)
+	eq(0, kc.Len())
+}
+
+func TestKeychainExpiry(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	name := filepath.Join(t.TempDir(), ".wave-keychain")
+	kc, err := LoadKeychain(name)
+	no(err)
+
+	id, secret, hash, err := CreateAccessKey()
+	no(err)
+	kc.Add(id, hash)
+
+	past := time.Now().Add(-time.Minute)
+	no(kc.SetExpiry(id, &past))
+	ok(!kc.verify(id, secret), "expired key must not verify")
+	no(kc.Save())
+
+	kc, err = LoadKeychain(name)
+	no(err)
+	e, _ := kc.Get(id)
+	ok(e.Expires != nil)
+	eq(past.Unix(), e.Expires.Unix())
+
+	no(kc.SetExpiry(id, nil))
+	ok(kc.verify(id, secret))
+	eq(kc.SetExpiry("missing", nil), ErrKeyNotFound)
+}
+
+func TestLoadKeychainStreaming(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	_, _, hash, err := CreateAccessKey()
+	no(err)
+	name := filepath.Join(t.TempDir(), "keychain")
+	var sb strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&sb, "K%04d:%s\n", i, hash)
+	}
+	no(os.WriteFile(name, []byte(sb.String()), 0600))
+	kc, err := LoadKeychain(name)
+	no(err)
+	eq(1000, kc.Len())
+	e, found := kc.Get("K0999")
+	ok(found)
+	eq(string(hash), string(e.Hash)) // not clobbered by the scanner's buffer
+
+	no(os.WriteFile(name, []byte(sb.String()+"bad\n"), 0600))
+	_, err = LoadKeychain(name)
+	var le *LineError
+	ok(errors.As(err, &le))
+	eq(1001, le.Line)
+
+	no(os.WriteFile(name, []byte("K:"+strings.Repeat("x", maxLineSize)+"\n"), 0600))
+	_, err = LoadKeychain(name)
+	ok(err != nil, "line too long")
+}
+
+func TestVerifyCacheTTL(t *testing.T) {
+	_, ok, no := assert.Assert(t)
+	id, secret, hash, err := CreateAccessKey()
+	no(err)
+	_, _, other, err := CreateAccessKey()
+	no(err)
+	kc, err := LoadKeychain(filepath.Join(t.TempDir(), "keychain"))
+	no(err)
+	no(kc.Add(id, hash))
+	kc.SetCacheTTL(time.Second)
+
+	ok(kc.verify(id, secret))
+	kc.keys.update(id, func(e *Entry) { e.Hash = other }) // changed without purging the cache
+	ok(kc.verify(id, secret), "cached")
+	time.Sleep(time.Second)
+	ok(!kc.verify(id, secret), "expired")
+
+	kc.SetCacheTTL(0)
+	kc.keys.update(id, func(e *Entry) { e.Hash = hash })
+	ok(kc.verify(id, secret))
+	kc.keys.update(id, func(e *Entry) { e.Hash = other })
+	ok(!kc.verify(id, secret), "not cached")
+}
+
+func TestVerifyToken(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	id, secret, hash, err := CreateAccessKey()
+	no(err)
+	a, err := LoadKeychain(filepath.Join(t.TempDir(), "a"))
+	no(err)
+	b, err := LoadKeychain(filepath.Join(t.TempDir(), "b"))
+	no(err)
+
+	eq(a.token("ab", "c"), a.token("ab", "c"))
+	ok(a.token("ab", "c") != a.token("a", "bc"))
+	ok(a.token("ab", "c") != b.token("ab", "c"), "tokens are private to a keychain")
+
+	no(a.Add(id, hash))
+	ok(a.verify(id, secret))
+	ok(a.verify(id, secret))
+	eq(1, a.cache.Len())
+	_, found := a.cache.Get(a.token(id, secret))
+	ok(found)
+}
+
+func TestVerifyCacheEviction(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	c := newVerifyCache(8)
+	for i := 0; i < 8; i++ {
+		c.Add(token{byte(i)}, verification{valid: true})
+	}
+	_, hit := c.Get(token{0}) // now most recently used
+	ok(hit)
+	c.Add(token{8}, verification{valid: true})
+	eq(8, c.Len())
+	_, hit = c.Get(token{1})
+	ok(!hit, "least recently used item evicted")
+	_, hit = c.Get(token{0})
+	ok(hit)
+
+	c.Remove(token{0})
+	_, hit = c.Get(token{0})
+	ok(!hit)
+	c.Purge()
+	eq(0, c.Len())
+	c.Add(token{9}, verification{valid: true})
+	v, hit := c.Get(token{9})
+	ok(hit && v.valid)
+}
+
+func TestAdaptiveCache(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	c := newVerifyCache(8)
+	c.adapt(8, 64, func() int { return 0 })
+
+	// Grows while the hit rate is low.
+	for i := 0; i < 20*adaptWindow; i++ {
+		key := token{byte(i % 100)}
+		if _, hit := c.Get(key); !hit {
+			c.Add(key, verification{valid: true})
+		}
+	}
+	eq(64, c.Size())
+
+	// Shrinks when mostly empty.
+	c.Purge()
+	for i := 0; i < 10*adaptWindow; i++ {
+		c.Get(token{byte(i)})
+	}
+	eq(8, c.Size())
+
+	// Grows if there are more keys than cached items, even if the hit rate is high.
+	keys := 0
+	c.adapt(8, 64, func() int { return keys })
+	for i := 0; i < 8; i++ {
+		c.Add(token{byte(i)}, verification{valid: true})
+	}
+	lookup := func() {
+		for i := 0; i < 20*adaptWindow; i++ {
+			if i%20 == 0 {
+				c.Get(token{255}) // miss
+			} else {
+				c.Get(token{byte(i % 8)})
+			}
+		}
+	}
+	lookup()
+	eq(8, c.Size())
+	keys = 100
+	lookup()
+	eq(16, c.Size())
+}
+
+func TestCheckHashes(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	_, _, hash, err := CreateAccessKey()
+	no(err)
+	kc, err := LoadKeychain(filepath.Join(t.TempDir(), "keychain"))
+	no(err)
+	no(kc.Add("OK", hash))
+	no(kc.Add("TRUNCATED", hash[:len(hash)-10]))
+	no(kc.Add("CORRUPT", []byte("$9z$"+string(hash[4:]))))
+	problems := kc.CheckHashes()
+	eq(2, len(problems))
+	eq("CORRUPT", problems[0].ID)
+	eq("TRUNCATED", problems[1].ID)
+}
+
+func TestVerifyBatch(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	kc, err := LoadKeychain(filepath.Join(t.TempDir(), "keychain"))
+	no(err)
+	var creds []Credential
+	for i := 0; i < 8; i++ {
+		id, secret, hash, err := CreateAccessKey()
+		no(err)
+		no(kc.Add(id, hash))
+		creds = append(creds, Credential{id, secret})
+	}
+	ok(kc.verify(creds[0].ID, creds[0].Secret)) // cached
+	creds = append(creds, Credential{creds[1].ID, "wrong"}, Credential{"UNKNOWN", "secret"})
+
+	valid := kc.VerifyBatch(creds)
+	eq(len(creds), len(valid))
+	for i := 0; i < 8; i++ {
+		ok(valid[i], creds[i].ID)
+	}
+	ok(!valid[8], "wrong secret")
+	ok(!valid[9], "unknown key")
+	eq(0, len(kc.VerifyBatch(nil)))
+}
+
+func TestValidate(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	_, _, hash, err := CreateAccessKey()
+	no(err)
+	h := string(hash)
+	data := "A:" + h + "\n" +
+		"\n" +
+		"B\n" +
+		"A:" + h + "\n" +
+		"C:notahash\n" +
+		"D:" + h + ":{bad\n" +
+		"E:" + h + "\r\n" +
+		"F:" + h + `:{"disabled":true}` + "\n"
+	problems, err := validate(strings.NewReader(data))
+	no(err)
+	eq(5, len(problems))
+	eq(3, problems[0].Line)
+	eq(4, problems[1].Line)
+	eq(5, problems[2].Line)
+	eq(6, problems[3].Line)
+	eq(7, problems[4].Line)
+}
+
+func TestKeychainReadOnly(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	kc, err := LoadKeychain(filepath.Join(t.TempDir(), ".wave-keychain"))
+	no(err)
+	id, secret, hash, err := CreateAccessKey()
+	no(err)
+	no(kc.Add(id, hash))
+
+	kc.SetReadOnly(true)
+	ok(kc.ReadOnly())
+	eq(ErrReadOnly, kc.Add("X", hash))
+	eq(ErrReadOnly, kc.Put(Entry{ID: "X", Hash: hash}))
+	eq(ErrReadOnly, kc.Remove(id))
+	eq(ErrReadOnly, kc.Save())
+	_, err = kc.Rotate(id)
+	eq(ErrReadOnly, err)
+	_, _, err = kc.Ensure("ref", KeySpec{})
+	eq(ErrReadOnly, err)
+	eq(ErrReadOnly, kc.Disable(id, true))
+	eq(1, kc.Len())
+	ok(kc.verify(id, secret))
+
+	// Transient keys are never saved, so they can still be added.
+	kc.AddTransient("T", hash)
+	eq(2, kc.Len())
+
+	kc.SetReadOnly(false)
+	no(kc.Remove(id))
+	no(kc.Save())
+}
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) Now() time.Time { return c.t }
+
+// blockingHasher blocks the first comparison until proceed is closed.
+type blockingHasher struct {
+	Bcrypt
+	once      sync.Once
+	comparing chan struct{}
+	proceed   chan struct{}
+}
+
+func (h *blockingHasher) Compare(hash []byte, secret string) error {
+	h.once.Do(func() {
+		close(h.comparing)
+		<-h.proceed
+	})
+	return h.Bcrypt.Compare(hash, secret)
+}
+
+func TestRotateWhileVerifying(t *testing.T) {
+	_, ok, no := assert.Assert(t)
+	h := &blockingHasher{Bcrypt: Bcrypt{bcrypt.MinCost}, comparing: make(chan struct{}), proceed: make(chan struct{})}
+	kc, err := New(filepath.Join(t.TempDir(), ".wave-keychain"), WithHasher(h))
+	no(err)
+	id, secret, hash, err := kc.CreateAccessKey()
+	no(err)
+	no(kc.Add(id, hash))
+
+	verified := make(chan bool)
+	go func() { verified <- kc.Verify(id, secret) }()
+	<-h.comparing
+	secret2, err := kc.Rotate(id)
+	no(err)
+	close(h.proceed)
+	ok(<-verified, "verified against the old hash")
+
+	ok(!kc.Verify(id, secret), "old secret must not be cached once rotated")
+	ok(kc.Verify(id, secret2))
+}
+
+func TestNewOptions(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	name := filepath.Join(t.TempDir(), ".wave-keychain")
+	clock := &fakeClock{time.Now()}
+	kc, err := New(name, WithCost(bcrypt.MinCost), WithClock(clock), WithCacheTTL(0), WithCacheSize(1, 8))
+	no(err)
+	eq(8, kc.cache.Size())
+
+	hash, err := kc.HashSecret("s3cret")
+	no(err)
+	cost, err := bcrypt.Cost(hash)
+	no(err)
+	eq(bcrypt.MinCost, cost)
+
+	no(kc.Add("A", hash))
+	expires := clock.t.Add(time.Hour)
+	no(kc.SetExpiry("A", &expires))
+	ok(kc.verify("A", "s3cret"))
+	clock.t = clock.t.Add(2 * time.Hour)
+	ok(!kc.verify("A", "s3cret"), "key must expire by the injected clock")
+	no(kc.Save())
+
+	kc, err = New(name, WithReadOnly(), WithIndex())
+	no(err)
+	ok(kc.ReadOnly())
+	eq(1, kc.Len())
+	eq(ErrReadOnly, kc.Save())
+
+	kc, err = New("ignored", WithStore(&FileStore{name}))
+	no(err)
+	eq(1, kc.Len())
+
+	_, err = New(name, WithStore(&FileStore{name}), WithIndex())
+	ok(err != nil)
+	_, err = New(name, WithCacheSize(8, 1))
+	ok(err != nil)
+}
+
+func TestVerifyContext(t *testing.T) {
+	_, ok, no := assert.Assert(t)
+	kc, err := LoadKeychain(filepath.Join(t.TempDir(), ".wave-keychain"))
+	no(err)
+	id, secret, hash, err := CreateAccessKey()
+	no(err)
+	no(kc.Add(id, hash))
+
+	var a Authenticator = kc
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ok(!a.VerifyContext(ctx, id, secret), "must not verify after the context is done")
+	ok(a.VerifyContext(context.Background(), id, secret))
+	ok(a.VerifyContext(ctx, id, secret), "cached verifications need no hashing")
+}
+
+func TestReadFromWriteTo(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	src, err := LoadKeychain(filepath.Join(t.TempDir(), ".wave-keychain"))
+	no(err)
+	id, secret, hash, err := CreateAccessKey()
+	no(err)
+	no(src.Put(Entry{ID: id, Hash: hash, Metadata: map[string]string{"owner": "ops"}}))
+	src.AddTransient("T", hash)
+
+	var b bytes.Buffer
+	n, err := src.WriteTo(&b)
+	no(err)
+	eq(int64(b.Len()), n)
+	ok(!strings.Contains(b.String(), "T:"), "transient keys must not be written")
+
+	dst, err := LoadKeychain(filepath.Join(t.TempDir(), ".wave-keychain"))
+	no(err)
+	dst.AddTransient("U", hash)
+	size := int64(b.Len())
+	n, err = dst.ReadFrom(&b)
+	no(err)
+	eq(size, n)
+	eq(2, dst.Len())
+	ok(dst.verify(id, secret))
+	e, _ := dst.Get(id)
+	eq("ops", e.Metadata["owner"])
+
+	_, err = dst.ReadFrom(strings.NewReader("A:hash\nbad\n"))
+	var le *LineError
+	ok(errors.As(err, &le))
+	eq(2, le.Line)
+	eq(2, dst.Len())
+}
+
+func TestTypedErrors(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	clock := &fakeClock{time.Now()}
+	kc, err := New(filepath.Join(t.TempDir(), ".wave-keychain"), WithClock(clock))
+	no(err)
+	id, secret, hash, err := CreateAccessKey()
+	no(err)
+	no(kc.Add(id, hash))
+
+	ctx := context.Background()
+	no(kc.Authenticate(ctx, id, secret))
+	ok(errors.Is(kc.Authenticate(ctx, id, "wrong"), ErrInvalidSecret))
+	ok(errors.Is(kc.Authenticate(ctx, "missing", secret), ErrKeyNotFound))
+	ok(errors.Is(kc.Remove("missing"), ErrKeyNotFound))
+	_, err = kc.Rotate("missing")
+	ok(errors.Is(err, ErrKeyNotFound))
+
+	expires := clock.t.Add(time.Minute)
+	no(kc.SetExpiry(id, &expires))
+	clock.t = clock.t.Add(time.Hour)
+	ok(errors.Is(kc.Authenticate(ctx, id, secret), ErrKeyExpired))
+	no(kc.Disable(id, true))
+	ok(errors.Is(kc.Authenticate(ctx, id, secret), ErrKeyDisabled))
+
+	_, err = kc.ReadFrom(strings.NewReader(id + ":" + string(hash) + "\n\nnope\n"))
+	var ie *ErrInvalidEntry
+	ok(errors.As(err, &ie))
+	eq(3, ie.Line)
+	eq("want id:hash", ie.Reason)
+}
+
+func TestRange(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	kc, err := LoadKeychain(filepath.Join(t.TempDir(), ".wave-keychain"))
+	no(err)
+	_, _, hash, err := CreateAccessKey()
+	no(err)
+	for i := 0; i < 10; i++ {
+		no(kc.Put(Entry{ID: fmt.Sprintf("K%d", i), Hash: hash, Metadata: map[string]string{"n": fmt.Sprint(i)}}))
+	}
+
+	seen := make(map[string]bool)
+	for e := range kc.All() {
+		ok(e.Metadata["n"] == strings.TrimPrefix(e.ID, "K"), "metadata must be copied")
+		e.Metadata["n"] = "changed"
+		seen[e.ID] = true
+	}
+	eq(10, len(seen))
+	e, _ := kc.Get("K0")
+	eq("0", e.Metadata["n"])
+
+	n := 0
+	kc.Range(func(e Entry) bool {
+		n++
+		return n < 3
+	})
+	eq(3, n)
+
+	// The keychain isn't locked while ranging.
+	n = 0
+	for e := range kc.All() {
+		no(kc.Disable(e.ID, true))
+		no(kc.Remove(e.ID))
+		n++
+	}
+	eq(10, n)
+	eq(0, kc.Len())
+}
+
+func TestEntropy(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	seeded := func() *Keychain {
+		kc, err := New(filepath.Join(t.TempDir(), ".wave-keychain"), WithCost(bcrypt.MinCost), WithEntropy(mrand.New(mrand.NewSource(42))))
+		no(err)
+		return kc
+	}
+	a, b := seeded(), seeded()
+	id1, secret1, hash, err := a.CreateAccessKey()
+	no(err)
+	id2, secret2, _, err := b.CreateAccessKey()
+	no(err)
+	eq(id1, id2)
+	eq(secret1, secret2)
+	ok(bcrypt.CompareHashAndPassword(hash, []byte(secret1)) == nil)
+
+	no(a.Add(id1, hash))
+	no(b.Add(id2, hash))
+	s1, err := a.Rotate(id1)
+	no(err)
+	s2, err := b.Rotate(id2)
+	no(err)
+	eq(s1, s2)
+
+	_, err = generateRandString(strings.NewReader("short"), idChars, 20)
+	ok(err != nil)
+}
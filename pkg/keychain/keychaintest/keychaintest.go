@@ -0,0 +1,141 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package keychaintest provides utilities for testing code that authenticates requests with a keychain.
+//
+//	kc, keys := keychaintest.New(t, 2)
+//	srv := keychaintest.NewServer(t, kc, myHandler)
+//	keychaintest.AssertAllowed(t, srv.URL, keys[0])
+//	keychaintest.AssertDenied(t, srv.URL, keychain.Credential{ID: keys[0].ID, Secret: "wrong"})
+package keychaintest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/keychain"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Store is a keychain.Keystore that holds entries in memory.
+type Store struct {
+	mu      sync.Mutex
+	entries []keychain.Entry
+}
+
+func (s *Store) String() string {
+	return "memory"
+}
+
+func (s *Store) Load() ([]keychain.Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]keychain.Entry(nil), s.entries...), nil
+}
+
+func (s *Store) Save(entries []keychain.Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries[:0], entries...)
+	return nil
+}
+
+// New returns a keychain held in memory, with n access keys whose IDs and secrets are returned.
+// Secrets are hashed with bcrypt's minimum cost to keep tests fast. Options are applied after the
+// defaults, so they can change the store or hasher.
+func New(t testing.TB, n int, opts ...keychain.Option) (*keychain.Keychain, []keychain.Credential) {
+	t.Helper()
+	opts = append([]keychain.Option{keychain.WithStore(&Store{}), keychain.WithCost(bcrypt.MinCost)}, opts...)
+	kc, err := keychain.New("memory", opts...)
+	if err != nil {
+		t.Fatalf("keychaintest: failed creating keychain: %v", err)
+	}
+	keys := make([]keychain.Credential, n)
+	for i := range keys {
+		b := make([]byte, 20)
+		if _, err := rand.Read(b); err != nil {
+			t.Fatalf("keychaintest: failed generating secret: %v", err)
+		}
+		keys[i] = keychain.Credential{ID: fmt.Sprintf("TESTKEY%04d", i+1), Secret: hex.EncodeToString(b)}
+		hash, err := kc.HashSecret(keys[i].Secret)
+		if err != nil {
+			t.Fatalf("keychaintest: failed hashing secret: %v", err)
+		}
+		if err := kc.Add(keys[i].ID, hash); err != nil {
+			t.Fatalf("keychaintest: failed adding key: %v", err)
+		}
+	}
+	return kc, keys
+}
+
+// NewServer starts a server that serves h to requests allowed by a, and responds 401 or 429 to the rest,
+// as a.Guard does. If h is nil, allowed requests get an empty 200 response. The server is closed when
+// the test finishes.
+func NewServer(t testing.TB, a keychain.Authenticator, h http.Handler) *httptest.Server {
+	t.Helper()
+	if h == nil {
+		h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.Guard(w, r) {
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// Get sends a GET request to url, authenticated with c, and returns the response status code.
+func Get(t testing.TB, url string, c keychain.Credential) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("keychaintest: bad request: %v", err)
+	}
+	req.SetBasicAuth(c.ID, c.Secret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("keychaintest: request failed: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// AssertStatus fails the test unless a GET request to url, authenticated with c, responds with status.
+func AssertStatus(t testing.TB, url string, c keychain.Credential, status int) {
+	t.Helper()
+	if got := Get(t, url, c); got != status {
+		t.Errorf("GET %s as %s: want status %d, got %d", url, c.ID, status, got)
+	}
+}
+
+// AssertAllowed fails the test unless a GET request to url, authenticated with c, responds 200 OK.
+func AssertAllowed(t testing.TB, url string, c keychain.Credential) {
+	t.Helper()
+	AssertStatus(t, url, c, http.StatusOK)
+}
+
+// AssertDenied fails the test unless a GET request to url, authenticated with c, responds 401 Unauthorized.
+func AssertDenied(t testing.TB, url string, c keychain.Credential) {
+	t.Helper()
+	AssertStatus(t, url, c, http.StatusUnauthorized)
+}
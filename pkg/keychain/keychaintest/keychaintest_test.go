@@ -0,0 +1,45 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychaintest
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+func TestKeychainTest(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	kc, keys := New(t, 3)
+	eq(3, len(keys))
+	eq(3, kc.Len())
+	ok(kc.Verify(keys[2].ID, keys[2].Secret))
+
+	srv := NewServer(t, kc, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	AssertStatus(t, srv.URL, keys[0], http.StatusTeapot)
+	AssertDenied(t, srv.URL, keychain.Credential{ID: keys[0].ID, Secret: keys[1].Secret})
+
+	srv = NewServer(t, kc, nil)
+	AssertAllowed(t, srv.URL, keys[1])
+	AssertDenied(t, srv.URL, keychain.Credential{ID: "missing", Secret: "secret"})
+
+	no(kc.Save())
+	kc, _ = New(t, 0)
+	eq(0, kc.Len())
+}
@@ -0,0 +1,168 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Lease represents a time-limited claim to leadership, shared by several servers.
+type Lease interface {
+	// Acquire acquires or renews the lease, reporting whether this server holds it.
+	Acquire() (bool, error)
+}
+
+type leaseState struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// FileLease is a Lease backed by a file on storage shared by all servers, e.g. a network volume.
+// Servers must have roughly synchronized clocks; the TTL should be well above the expected clock skew.
+type FileLease struct {
+	name   string
+	holder string
+	ttl    time.Duration
+}
+
+// NewFileLease creates a lease backed by the given file, held for ttl after each renewal.
+func NewFileLease(name string, ttl time.Duration) (*FileLease, error) {
+	holder, err := generateRandString(rand.Reader, idChars, 12)
+	if err != nil {
+		return nil, err
+	}
+	if host, err := os.Hostname(); err == nil {
+		holder = host + "/" + holder
+	}
+	return &FileLease{name, holder, ttl}, nil
+}
+
+func (l *FileLease) read() (*leaseState, error) {
+	b, err := os.ReadFile(l.name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed reading lease %s: %v", l.name, err)
+	}
+	var s leaseState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, nil // partially written or corrupt; up for grabs
+	}
+	return &s, nil
+}
+
+func (l *FileLease) Acquire() (bool, error) {
+	s, err := l.read()
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	if s != nil && s.Holder != l.holder && now.Before(s.Expires) {
+		return false, nil
+	}
+
+	b, err := json.Marshal(leaseState{l.holder, now.Add(l.ttl)})
+	if err != nil {
+		return false, err
+	}
+	tmp := fmt.Sprintf("%s.%s.tmp", l.name, l.holder[len(l.holder)-12:])
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return false, fmt.Errorf("failed writing lease %s: %v", l.name, err)
+	}
+	if err := os.Rename(tmp, l.name); err != nil {
+		os.Remove(tmp)
+		return false, fmt.Errorf("failed writing lease %s: %v", l.name, err)
+	}
+
+	// Servers racing for an expired lease all write it; the last writer wins.
+	if s, err = l.read(); err != nil || s == nil {
+		return false, err
+	}
+	return s.Holder == l.holder, nil
+}
+
+// Elector makes a keychain writable only while this server holds a lease. While another server holds
+// the lease, the keychain is read-only, and follows the leader's changes by reloading its store.
+type Elector struct {
+	lease    Lease
+	keychain *Keychain
+	leader   bool
+	modTime  time.Time
+	size     int64
+}
+
+func NewElector(kc *Keychain, lease Lease) *Elector {
+	kc.SetReadOnly(true)
+	return &Elector{lease: lease, keychain: kc}
+}
+
+// follow reloads the keychain if its file has changed since the last reload.
+func (e *Elector) follow() error {
+	if info, err := os.Stat(e.keychain.Name); err == nil {
+		if info.ModTime().Equal(e.modTime) && info.Size() == e.size {
+			return nil
+		}
+		e.modTime, e.size = info.ModTime(), info.Size()
+	}
+	return e.keychain.Reload()
+}
+
+// step attempts to acquire the lease, and reports whether leadership changed.
+// Failing to acquire the lease, e.g. because shared storage is unavailable, relinquishes leadership.
+func (e *Elector) step() (bool, error) {
+	leader, err := e.lease.Acquire()
+	if leader == e.leader {
+		if !leader {
+			if ferr := e.follow(); err == nil {
+				err = ferr
+			}
+		}
+		return false, err
+	}
+	if leader {
+		if err := e.follow(); err != nil { // catch up before accepting writes
+			return false, err
+		}
+	}
+	e.keychain.SetReadOnly(!leader)
+	e.leader = leader
+	return true, err
+}
+
+// Run attempts to acquire or renew the lease at the given interval until stop is closed, which should be
+// well within the lease TTL. Leadership changes are reported to onChange, and failures to onError.
+func (e *Elector) Run(interval time.Duration, stop <-chan struct{}, onChange func(leader bool), onError func(err error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		changed, err := e.step()
+		if err != nil {
+			onError(err)
+		}
+		if changed {
+			onChange(e.leader)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestElector(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	dir := t.TempDir()
+	name, lease := filepath.Join(dir, ".wave-keychain"), filepath.Join(dir, ".wave-lease")
+	ttl := 200 * time.Millisecond
+
+	newElector := func() (*Keychain, *Elector) {
+		kc, err := LoadKeychain(name)
+		no(err)
+		l, err := NewFileLease(lease, ttl)
+		no(err)
+		return kc, NewElector(kc, l)
+	}
+	kc1, e1 := newElector()
+	kc2, e2 := newElector()
+	ok(kc1.ReadOnly())
+
+	changed, err := e1.step()
+	no(err)
+	ok(changed)
+	ok(e1.leader)
+	ok(!kc1.ReadOnly())
+
+	changed, err = e2.step()
+	no(err)
+	ok(!changed)
+	ok(kc2.ReadOnly())
+	eq(ErrReadOnly, kc2.Put(Entry{ID: "B", Hash: []byte("b")}))
+
+	// Followers pick up the leader's writes.
+	no(kc1.Put(Entry{ID: "A", Hash: []byte("a")}))
+	no(kc1.Save())
+	_, err = e2.step()
+	no(err)
+	_, found := kc2.Get("A")
+	ok(found)
+
+	// Leadership moves once the leader stops renewing.
+	time.Sleep(ttl)
+	changed, err = e2.step()
+	no(err)
+	ok(changed)
+	ok(!kc2.ReadOnly())
+	changed, err = e1.step()
+	no(err)
+	ok(changed)
+	ok(kc1.ReadOnly())
+}
@@ -0,0 +1,70 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter limits the rate of requests (token bucket) and the number of requests in flight.
+type Limiter struct {
+	sync.Mutex
+	rate   float64 // requests per second; 0 for no limit
+	burst  float64
+	tokens float64
+	last   time.Time
+	max    int // requests in flight; 0 for no limit
+	active int
+}
+
+// NewLimiter creates a limiter allowing rate requests per second, with bursts of up to burst requests,
+// and up to maxConcurrent requests in flight. A burst below 1 defaults to the rate, rounded up.
+func NewLimiter(rate float64, burst, maxConcurrent int) *Limiter {
+	if burst < 1 {
+		burst = max(1, int(math.Ceil(rate)))
+	}
+	return &Limiter{rate: rate, burst: float64(burst), tokens: float64(burst), max: maxConcurrent}
+}
+
+// acquire admits a request at time now, if within limits. The returned func, if any,
+// must be called once the request completes.
+func (l *Limiter) acquire(now time.Time) (release func(), ok bool) {
+	l.Lock()
+	defer l.Unlock()
+	if l.max > 0 && l.active >= l.max {
+		return nil, false
+	}
+	if l.rate > 0 {
+		if !l.last.IsZero() {
+			l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+		}
+		l.last = now
+		if l.tokens < 1 {
+			return nil, false
+		}
+		l.tokens--
+	}
+	if l.max > 0 {
+		l.active++
+		release = sync.OnceFunc(func() {
+			l.Lock()
+			l.active--
+			l.Unlock()
+		})
+	}
+	return release, true
+}
@@ -0,0 +1,152 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// LoadTest simulates a mix of authentications against a throwaway keychain, to help size the bcrypt cost
+// and verification cache before going to production.
+type LoadTest struct {
+	Keys        int           // number of keys in the keychain
+	Cost        int           // bcrypt cost; 0 for the default
+	CacheTTL    time.Duration // how long verifications are cached; 0 to disable caching
+	Duration    time.Duration // how long to run
+	Concurrency int           // number of concurrent clients
+	Cached      float64       // share of valid authentications that hit the cache
+	Uncached    float64       // share of valid authentications that miss the cache
+	Bad         float64       // share of authentications with a wrong secret
+}
+
+// LoadTestStats summarizes the latencies of one kind of authentication.
+type LoadTestStats struct {
+	Kind               string
+	Count              int
+	P50, P90, P99, Max time.Duration
+}
+
+// Run runs the load test, returning stats for cached, uncached and bad authentications, and for all of them.
+func (lt LoadTest) Run() ([]LoadTestStats, error) {
+	if lt.Keys < 1 || lt.Concurrency < 1 || lt.Duration <= 0 {
+		return nil, errors.New("want at least 1 key, 1 client and a positive duration")
+	}
+	total := lt.Cached + lt.Uncached + lt.Bad
+	if lt.Cached < 0 || lt.Uncached < 0 || lt.Bad < 0 || total <= 0 {
+		return nil, errors.New("want a non-negative mix of cached, uncached and bad authentications")
+	}
+	cost := lt.Cost
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+
+	dir, err := os.MkdirTemp("", "wave-loadtest")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	kc, err := LoadKeychain(filepath.Join(dir, "keychain"))
+	if err != nil {
+		return nil, err
+	}
+	kc.SetCacheTTL(lt.CacheTTL)
+
+	ids, secrets := make([]string, lt.Keys), make([]string, lt.Keys)
+	for i := range ids {
+		if ids[i], err = generateRandString(crand.Reader, idChars, 20); err != nil {
+			return nil, err
+		}
+		if secrets[i], err = generateRandString(crand.Reader, secretChars, 40); err != nil {
+			return nil, err
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(secrets[i]), cost)
+		if err != nil {
+			return nil, fmt.Errorf("failed hashing secret: %v", err)
+		}
+		if err := kc.Add(ids[i], hash); err != nil {
+			return nil, err
+		}
+		kc.verify(ids[i], secrets[i]) // warm the cache
+	}
+
+	kinds := []string{"cached", "uncached", "bad"}
+	var (
+		mu        sync.Mutex
+		latencies = make([][]time.Duration, len(kinds))
+		wg        sync.WaitGroup
+		deadline  = time.Now().Add(lt.Duration)
+	)
+	for c := 0; c < lt.Concurrency; c++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			local := make([][]time.Duration, len(kinds))
+			for time.Now().Before(deadline) {
+				i := rnd.Intn(len(ids))
+				id, secret := ids[i], secrets[i]
+				kind := 0
+				switch x := rnd.Float64() * total; {
+				case x < lt.Cached:
+				case x < lt.Cached+lt.Uncached:
+					kind = 1
+					kc.cache.Remove(kc.token(id, secret))
+				default:
+					kind = 2
+					secret = secret[1:] + secret[:1]
+					kc.cache.Remove(kc.token(id, secret))
+				}
+				start := time.Now()
+				kc.verify(id, secret)
+				local[kind] = append(local[kind], time.Since(start))
+			}
+			mu.Lock()
+			for k := range kinds {
+				latencies[k] = append(latencies[k], local[k]...)
+			}
+			mu.Unlock()
+		}(time.Now().UnixNano() + int64(c))
+	}
+	wg.Wait()
+
+	var all []time.Duration
+	stats := make([]LoadTestStats, 0, len(kinds)+1)
+	for k, kind := range kinds {
+		stats = append(stats, summarize(kind, latencies[k]))
+		all = append(all, latencies[k]...)
+	}
+	return append(stats, summarize("all", all)), nil
+}
+
+func summarize(kind string, ds []time.Duration) LoadTestStats {
+	s := LoadTestStats{Kind: kind, Count: len(ds)}
+	if len(ds) == 0 {
+		return s
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	at := func(p float64) time.Duration { return ds[int(p*float64(len(ds)-1))] }
+	s.P50, s.P90, s.P99, s.Max = at(.5), at(.9), at(.99), ds[len(ds)-1]
+	return s
+}
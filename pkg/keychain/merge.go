@@ -0,0 +1,134 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"errors"
+	"sort"
+)
+
+// Diff lists the IDs of keys that differ between two keychains, sorted by ID.
+type Diff struct {
+	Added   []string `json:"added,omitempty"`   // keys only in the other keychain
+	Removed []string `json:"removed,omitempty"` // keys only in this keychain
+	Changed []string `json:"changed,omitempty"` // keys in both keychains, in different states
+}
+
+// Empty reports whether the keychains hold the same keys in the same states.
+func (d Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// MergeStrategy decides how Merge resolves keys that differ between keychains.
+type MergeStrategy int
+
+const (
+	// MergeKeep adds keys missing from this keychain, keeping its own state of keys in both keychains.
+	MergeKeep MergeStrategy = iota
+	// MergeOverwrite adds keys missing from this keychain, and replaces keys in both keychains with the other's.
+	MergeOverwrite
+	// MergeMirror makes this keychain hold exactly the keys in the other keychain, removing the rest.
+	MergeMirror
+)
+
+// Clone returns a copy of the keychain, holding copies of its keys, including transient keys, in memory.
+// The copy shares the keychain's store, hasher and clock, and is read-only if the keychain is, but has its
+// own verification cache, and no hooks, watchers, tenants or federation. Changes to either keychain do not
+// affect the other until saved.
+func (kc *Keychain) Clone() (*Keychain, error) {
+	var entries []Entry
+	kc.keys.each(func(e *Entry) bool {
+		entries = append(entries, e.clone())
+		return true
+	})
+	m := newShardMap(entries)
+	min, max := kc.cache.bounds()
+	kc.RLock()
+	o := options{
+		store:    kc.store,
+		minCache: min,
+		maxCache: max,
+		ttl:      kc.ttl,
+		hasher:   kc.hasher,
+		readOnly: kc.ro,
+		clock:    kc.clock,
+		entropy:  kc.entropy,
+	}
+	kc.RUnlock()
+	return newKeychain(kc.Name, m, m.len(), o)
+}
+
+// Diff reports the keys that differ between the keychain and other, excluding transient keys:
+// keys only in other are added, keys only in the keychain are removed.
+func (kc *Keychain) Diff(other *Keychain) Diff {
+	fps := make(map[string]string, kc.keys.len())
+	kc.keys.each(func(e *Entry) bool {
+		if !e.transient {
+			fps[e.ID] = e.Fingerprint()
+		}
+		return true
+	})
+	var d Diff
+	other.keys.each(func(e *Entry) bool {
+		if e.transient {
+			return true
+		}
+		if fp, ok := fps[e.ID]; !ok {
+			d.Added = append(d.Added, e.ID)
+		} else if fp != e.Fingerprint() {
+			d.Changed = append(d.Changed, e.ID)
+		}
+		delete(fps, e.ID)
+		return true
+	})
+	for id := range fps {
+		d.Removed = append(d.Removed, id)
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	sort.Strings(d.Changed)
+	return d
+}
+
+// Merge copies keys from other into the keychain, resolving keys that differ according to strategy,
+// and returns the changes made, e.g. to reconcile keychains across environments. Transient keys are
+// neither copied nor removed. The keychain is not saved.
+func (kc *Keychain) Merge(other *Keychain, strategy MergeStrategy) (Diff, error) {
+	if kc.ReadOnly() {
+		return Diff{}, ErrReadOnly
+	}
+	d := kc.Diff(other)
+	if strategy == MergeKeep {
+		d.Changed = nil
+	}
+	if strategy != MergeMirror {
+		d.Removed = nil
+	}
+	for _, ids := range [][]string{d.Added, d.Changed} {
+		for _, id := range ids {
+			if e, ok := other.Get(id); ok {
+				if err := kc.Put(e); err != nil {
+					return d, err
+				}
+			}
+		}
+	}
+	for _, id := range d.Removed {
+		if err := kc.Remove(id); err != nil && !errors.Is(err, ErrKeyNotFound) {
+			return d, err
+		}
+	}
+	return d, nil
+}
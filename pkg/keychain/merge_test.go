@@ -0,0 +1,75 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestCloneMergeDiff(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	_, secret, hash, err := CreateAccessKey()
+	no(err)
+	_, _, other, err := CreateAccessKey()
+	no(err)
+
+	a, err := LoadKeychain(filepath.Join(t.TempDir(), ".wave-keychain"))
+	no(err)
+	no(a.Add("A", hash))
+	no(a.Add("B", hash))
+	no(a.Add("C", hash))
+	a.AddTransient("T", hash)
+
+	b, err := a.Clone()
+	no(err)
+	eq(4, b.Len())
+	ok(b.Diff(a).Empty())
+	ok(b.verify("A", secret))
+	no(b.Remove("A"))
+	no(b.Add("C", other))
+	no(b.Add("D", hash))
+	eq(4, a.Len()) // clones must not share entries
+
+	eq(Diff{Added: []string{"D"}, Removed: []string{"A"}, Changed: []string{"C"}}, a.Diff(b))
+
+	for _, tc := range []struct {
+		strategy MergeStrategy
+		ids      []string
+		changed  bool
+	}{
+		{MergeKeep, []string{"A", "B", "C", "D", "T"}, false},
+		{MergeOverwrite, []string{"A", "B", "C", "D", "T"}, true},
+		{MergeMirror, []string{"B", "C", "D", "T"}, true},
+	} {
+		c, err := a.Clone()
+		no(err)
+		_, err = c.Merge(b, tc.strategy)
+		no(err)
+		var ids []string
+		for _, e := range c.Entries() {
+			ids = append(ids, e.ID)
+		}
+		eq(tc.ids, ids)
+		e, _ := c.Get("C")
+		eq(tc.changed, string(e.Hash) == string(other))
+	}
+
+	a.SetReadOnly(true)
+	_, err = a.Merge(b, MergeKeep)
+	eq(ErrReadOnly, err)
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"fmt"
+	"sort"
+)
+
+// MirrorStore is a Keystore that reads from a primary store and writes to both the primary and a
+// secondary store, e.g. while migrating from one backend to another. The primary remains the
+// source of truth: failing to write the secondary does not fail a save.
+type MirrorStore struct {
+	Primary   Keystore
+	Secondary Keystore
+	OnError   func(err error) // called if writing the secondary fails; optional
+}
+
+func (m *MirrorStore) String() string {
+	return m.Primary.String()
+}
+
+func (m *MirrorStore) Load() ([]Entry, error) {
+	return m.Primary.Load()
+}
+
+func (m *MirrorStore) Save(entries []Entry) error {
+	if err := m.Primary.Save(entries); err != nil {
+		return err
+	}
+	if err := m.Secondary.Save(entries); err != nil && m.OnError != nil {
+		m.OnError(fmt.Errorf("failed mirroring to %s: %v", m.Secondary, err))
+	}
+	return nil
+}
+
+// Sync copies all entries from the primary to the secondary.
+func (m *MirrorStore) Sync() error {
+	entries, err := m.Primary.Load()
+	if err != nil {
+		return err
+	}
+	return m.Secondary.Save(entries)
+}
+
+// Parity compares the entries in two stores, returning the IDs of keys that are missing from
+// either store or differ between them, in sorted order.
+func Parity(a, b Keystore) ([]string, error) {
+	as, err := a.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed loading %s: %v", a, err)
+	}
+	bs, err := b.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed loading %s: %v", b, err)
+	}
+	fps := make(map[string]string, len(as))
+	for _, e := range as {
+		fps[e.ID] = e.Fingerprint()
+	}
+	var diff []string
+	for _, e := range bs {
+		if fp, ok := fps[e.ID]; !ok || fp != e.Fingerprint() {
+			diff = append(diff, e.ID)
+		}
+		delete(fps, e.ID)
+	}
+	for id := range fps {
+		diff = append(diff, id)
+	}
+	sort.Strings(diff)
+	return diff, nil
+}
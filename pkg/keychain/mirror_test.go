@@ -0,0 +1,65 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestMirrorToSQLite(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+
+	dir := t.TempDir()
+	old := &FileStore{filepath.Join(dir, "keychain")}
+	id, secret, hash, err := CreateAccessKey()
+	no(err)
+	no(old.Save([]Entry{{ID: id, Hash: hash, Metadata: map[string]string{"owner": "ops"}}}))
+
+	// Mirror.
+	m := &MirrorStore{Primary: old, Secondary: OpenStore("sqlite:" + filepath.Join(dir, "keys.db"))}
+	no(m.Sync())
+	kc, err := Open(m)
+	no(err)
+	_, _, hash2, err := CreateAccessKey()
+	no(err)
+	no(kc.Add("K2", hash2))
+	no(kc.Disable(id, true))
+	no(kc.Save())
+
+	// Verify parity.
+	diff, err := Parity(m.Primary, m.Secondary)
+	no(err)
+	eq(0, len(diff))
+
+	// Cut over.
+	kc, err = LoadKeychain("sqlite:" + filepath.Join(dir, "keys.db"))
+	no(err)
+	eq(2, kc.Len())
+	e, found := kc.Get(id)
+	ok(found)
+	ok(e.Disabled)
+	eq("ops", e.Metadata["owner"])
+	no(kc.Disable(id, false))
+	ok(kc.Verify(id, secret))
+
+	// Detect drift.
+	no(old.Save(nil))
+	diff, err = Parity(m.Primary, m.Secondary)
+	no(err)
+	eq(2, len(diff))
+}
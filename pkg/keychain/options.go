@@ -0,0 +1,213 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Hasher hashes secrets and verifies secrets against hashes.
+type Hasher interface {
+	// Hash returns the hash of secret.
+	Hash(secret string) ([]byte, error)
+	// Compare returns nil if secret matches hash.
+	Compare(hash []byte, secret string) error
+	// Check returns nil if hash is well-formed.
+	Check(hash []byte) error
+}
+
+// Bcrypt is a Hasher using bcrypt with the given cost.
+type Bcrypt struct {
+	Cost int
+}
+
+func (b Bcrypt) Hash(secret string) ([]byte, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(secret), b.Cost)
+	if err != nil {
+		return nil, fmt.Errorf("failed hashing secret: %v", err)
+	}
+	return h, nil
+}
+
+func (b Bcrypt) Compare(hash []byte, secret string) error {
+	return bcrypt.CompareHashAndPassword(hash, []byte(secret))
+}
+
+func (b Bcrypt) Check(hash []byte) error {
+	_, err := bcrypt.Cost(hash)
+	return err
+}
+
+// Clock tells the time. A keychain's clock decides when keys expire, when federated verifications go stale,
+// how fast tenant rate limits refill, and the time of events passed to hooks, e.g. to lock out keys after
+// repeated failures.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+type options struct {
+	store              Keystore
+	indexed            bool
+	minCache, maxCache int
+	ttl                time.Duration
+	hasher             Hasher
+	readOnly           bool
+	clock              Clock
+	entropy            io.Reader
+}
+
+// Option configures a keychain created with New.
+type Option func(o *options)
+
+// WithStore loads and saves the keychain using store, instead of the file or SQLite database named.
+func WithStore(store Keystore) Option {
+	return func(o *options) { o.store = store }
+}
+
+// WithIndex looks up keys on disk through a sparse in-memory index instead of loading them; see OpenIndexed.
+func WithIndex() Option {
+	return func(o *options) { o.indexed = true }
+}
+
+// WithCacheSize bounds the number of verifications cached in memory; see SetCacheSize.
+func WithCacheSize(min, max int) Option {
+	return func(o *options) { o.minCache, o.maxCache = min, max }
+}
+
+// WithCacheTTL sets how long verifications are cached in memory; see SetCacheTTL.
+func WithCacheTTL(ttl time.Duration) Option {
+	return func(o *options) { o.ttl = ttl }
+}
+
+// WithCost hashes new secrets using bcrypt with the given cost, instead of bcrypt.DefaultCost.
+func WithCost(cost int) Option {
+	return WithHasher(Bcrypt{cost})
+}
+
+// WithHasher hashes and verifies secrets using h, instead of bcrypt.
+func WithHasher(h Hasher) Option {
+	return func(o *options) { o.hasher = h }
+}
+
+// WithReadOnly makes the keychain read-only; see SetReadOnly.
+func WithReadOnly() Option {
+	return func(o *options) { o.readOnly = true }
+}
+
+// WithClock tells the time using c instead of the system clock, e.g. to test expiry, rate limits or hooks
+// without sleeping, or to align the keychain with an embedding application's own clock.
+func WithClock(c Clock) Option {
+	return func(o *options) { o.clock = c }
+}
+
+// WithEntropy generates IDs and secrets for new keys from r, instead of crypto/rand, e.g. to create reproducible
+// fixtures from a seeded generator in tests. Never use a predictable source in production.
+func WithEntropy(r io.Reader) Option {
+	return func(o *options) { o.entropy = &lockedReader{r: r} }
+}
+
+// lockedReader serializes reads, since keys may be generated concurrently.
+type lockedReader struct {
+	sync.Mutex
+	r io.Reader
+}
+
+func (l *lockedReader) Read(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.r.Read(p)
+}
+
+// New loads the keychain named, which is a file, or a SQLite database if name is of the form "sqlite:path".
+func New(name string, opts ...Option) (*Keychain, error) {
+	o := options{
+		minCache: minCacheSize,
+		maxCache: maxCacheSize,
+		ttl:      DefaultCacheTTL,
+		hasher:   Bcrypt{bcrypt.DefaultCost},
+		clock:    systemClock{},
+		entropy:  rand.Reader,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.minCache < 1 || o.maxCache < o.minCache {
+		return nil, errors.New("cache sizes must be positive, with the minimum no more than the maximum")
+	}
+
+	var (
+		keys table
+		size int
+	)
+	if o.indexed {
+		if o.store != nil {
+			return nil, errors.New("indexed keychains must be files")
+		}
+		t, err := openIndex(name)
+		if err != nil {
+			return nil, err
+		}
+		o.store = &FileStore{name}
+		keys, size = t, t.count
+	} else {
+		if o.store == nil {
+			o.store = OpenStore(name)
+		}
+		entries, err := o.store.Load()
+		if err != nil {
+			return nil, err
+		}
+		m := newShardMap(entries)
+		keys, size = m, m.len()
+	}
+	return newKeychain(name, keys, size, o)
+}
+
+// newKeychain returns a keychain holding keys, with a verification cache sized for n keys.
+func newKeychain(name string, keys table, n int, o options) (*Keychain, error) {
+	if n == 0 {
+		n = minCacheSize
+	}
+	key := make([]byte, 64)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed generating keychain cache key: %v", err)
+	}
+	kc := &Keychain{
+		Name:    name,
+		keys:    keys,
+		cache:   newVerifyCache(n),
+		tokens:  newTokenizerPool(key[:32]),
+		signer:  newTokenizerPool(key[32:]),
+		store:   o.store,
+		ttl:     o.ttl,
+		ro:      o.readOnly,
+		hasher:  o.hasher,
+		clock:   o.clock,
+		entropy: o.entropy,
+	}
+	kc.cache.adapt(o.minCache, o.maxCache, keys.len)
+	return kc, nil
+}
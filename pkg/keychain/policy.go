@@ -0,0 +1,230 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Policy describes the desired state of a keychain, typically kept in version control.
+//
+//	keys:
+//	  - id: BILLING
+//	    owner: billing-team
+//	    scopes: [reports, uploads]
+//	    expires: 2025-01-01T00:00:00Z
+//	    metadata:
+//	      env: prod
+type Policy struct {
+	Keys []KeyPolicy `yaml:"keys"`
+}
+
+// KeyPolicy describes a desired access key. Owner and scopes are stored as the "owner" and "scope"
+// (comma-separated) metadata attributes.
+type KeyPolicy struct {
+	ID       string            `yaml:"id"`
+	Owner    string            `yaml:"owner,omitempty"`
+	Scopes   []string          `yaml:"scopes,omitempty"`
+	Disabled bool              `yaml:"disabled,omitempty"`
+	Expires  *time.Time        `yaml:"expires,omitempty"`
+	Metadata map[string]string `yaml:"metadata,omitempty"`
+}
+
+func (kp *KeyPolicy) metadata() map[string]string {
+	m := make(map[string]string, len(kp.Metadata)+2)
+	for k, v := range kp.Metadata {
+		m[k] = v
+	}
+	if kp.Owner != "" {
+		m["owner"] = kp.Owner
+	}
+	if len(kp.Scopes) > 0 {
+		m["scope"] = strings.Join(kp.Scopes, ",")
+	}
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
+
+// LoadPolicy reads a YAML policy file.
+func LoadPolicy(name string) (*Policy, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading policy %s: %v", name, err)
+	}
+	p, err := ParsePolicy(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return p, nil
+}
+
+// ParsePolicy parses and validates a YAML policy.
+func ParsePolicy(b []byte) (*Policy, error) {
+	var p Policy
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("invalid policy: %v", err)
+	}
+	seen := make(map[string]bool, len(p.Keys))
+	for i, kp := range p.Keys {
+		if kp.ID == "" {
+			return nil, fmt.Errorf("invalid policy: key %d: missing id", i+1)
+		}
+		if strings.ContainsAny(kp.ID, ":\r\n") {
+			return nil, fmt.Errorf("invalid policy: key %d: invalid id %q", i+1, kp.ID)
+		}
+		if seen[kp.ID] {
+			return nil, fmt.Errorf("invalid policy: duplicate id %s", kp.ID)
+		}
+		seen[kp.ID] = true
+	}
+	return &p, nil
+}
+
+// Action represents a change made to reconcile a keychain with a policy.
+type Action int
+
+const (
+	// Create adds a missing key, with a new secret.
+	Create Action = iota
+	// Update changes a key's metadata, expiry or disabled state.
+	Update
+	// Revoke disables a key absent from the policy.
+	Revoke
+)
+
+func (a Action) String() string {
+	switch a {
+	case Create:
+		return "create"
+	case Update:
+		return "update"
+	}
+	return "revoke"
+}
+
+// Change represents a change made (or to be made) to a single key.
+type Change struct {
+	ID     string
+	Action Action
+	Secret string // new secret, for created keys only
+}
+
+// Plan returns the changes Apply would make, without making them.
+func (kc *Keychain) Plan(p *Policy) []Change {
+	var changes []Change
+	entries := make(map[string]Entry)
+	for _, e := range kc.Entries() {
+		entries[e.ID] = e
+	}
+
+	for _, kp := range p.Keys {
+		e, ok := entries[kp.ID]
+		if !ok {
+			changes = append(changes, Change{ID: kp.ID, Action: Create})
+			continue
+		}
+		delete(entries, kp.ID)
+		if e.Disabled != kp.Disabled || !sameTime(e.Expires, kp.Expires) || !reflect.DeepEqual(e.Metadata, kp.metadata()) {
+			changes = append(changes, Change{ID: kp.ID, Action: Update})
+		}
+	}
+
+	for _, e := range kc.Entries() { // sorted
+		if _, ok := entries[e.ID]; ok && !e.transient && !e.Disabled {
+			changes = append(changes, Change{ID: e.ID, Action: Revoke})
+		}
+	}
+	return changes
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// Apply reconciles the keychain with a policy: missing keys are created, existing keys are updated to
+// match, and keys absent from the policy are revoked (disabled). Transient keys are left untouched.
+// Applying the same policy twice makes no further changes. The keychain is not saved.
+func (kc *Keychain) Apply(p *Policy) ([]Change, error) {
+	if kc.ReadOnly() {
+		return nil, ErrReadOnly
+	}
+	desired := make(map[string]*KeyPolicy, len(p.Keys))
+	for i := range p.Keys {
+		desired[p.Keys[i].ID] = &p.Keys[i]
+	}
+
+	changes := kc.Plan(p)
+
+	// Generate secrets for new keys up front, to hash them in parallel.
+	var secrets []string
+	for i, c := range changes {
+		if c.Action == Create {
+			secret, err := generateRandString(kc.entropy, secretChars, 40)
+			if err != nil {
+				return nil, err
+			}
+			changes[i].Secret = secret
+			secrets = append(secrets, secret)
+		}
+	}
+	hashes, errs := hashSecrets(kc.hasher, secrets)
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i, c := range changes {
+		switch c.Action {
+		case Create:
+			hash := hashes[0]
+			hashes = hashes[1:]
+			if err := kc.Add(c.ID, hash); err != nil {
+				return changes[:i], err
+			}
+			fallthrough
+		case Update:
+			kp := desired[c.ID]
+			if err := kc.Disable(c.ID, kp.Disabled); err != nil {
+				return changes[:i], err
+			}
+			if err := kc.SetExpiry(c.ID, kp.Expires); err != nil {
+				return changes[:i], err
+			}
+			if err := kc.SetMetadata(c.ID, kp.metadata()); err != nil {
+				return changes[:i], err
+			}
+		case Revoke:
+			if err := kc.Disable(c.ID, true); err != nil {
+				return changes[:i], err
+			}
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestPolicyApply(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	kc, err := LoadKeychain(filepath.Join(t.TempDir(), ".wave-keychain"))
+	no(err)
+
+	_, _, hash, err := CreateAccessKey()
+	no(err)
+	kc.Add("KEEP", hash)
+	kc.Add("EXTRA", hash)
+	kc.AddTransient("DEFAULT", hash)
+
+	p, err := ParsePolicy([]byte(`
+keys:
+  - id: KEEP
+    owner: ops
+    scopes: [reports, uploads]
+  - id: NEW
+    expires: 2030-01-01T00:00:00Z
+    metadata:
+      env: prod
+`))
+	no(err)
+
+	changes, err := kc.Apply(p)
+	no(err)
+	eq(3, len(changes))
+	eq(Change{ID: "KEEP", Action: Update}, changes[0])
+	eq("NEW", changes[1].ID)
+	eq(Create, changes[1].Action)
+	ok(changes[1].Secret != "")
+	ok(kc.verify("NEW", changes[1].Secret))
+	eq(Change{ID: "EXTRA", Action: Revoke}, changes[2])
+
+	e, _ := kc.Get("KEEP")
+	eq("reports,uploads", e.Metadata["scope"])
+	eq("ops", e.Metadata["owner"])
+	e, _ = kc.Get("EXTRA")
+	ok(e.Disabled)
+	e, _ = kc.Get("DEFAULT")
+	ok(!e.Disabled, "transient keys must be left alone")
+
+	ok(len(kc.Plan(p)) == 0, "apply must be idempotent")
+
+	_, err = ParsePolicy([]byte("keys:\n  - id: A\n  - id: A\n"))
+	ok(err != nil)
+	_, err = ParsePolicy([]byte("keys:\n  - id: A\n    colour: red\n"))
+	ok(err != nil)
+}
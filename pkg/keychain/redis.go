@@ -0,0 +1,65 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/h2oai/wave/pkg/redis"
+)
+
+// SharedCache is a verification cache shared by several servers, consulted when the local cache misses.
+// Only successful verifications are shared.
+type SharedCache interface {
+	// Verified returns true if key is known to have been verified successfully.
+	Verified(key string) bool
+	// SetVerified records that key was verified successfully.
+	SetVerified(key string)
+}
+
+// SetSharedCache sets a verification cache shared with other servers.
+func (kc *Keychain) SetSharedCache(c SharedCache) {
+	kc.Lock()
+	kc.shared = c
+	kc.Unlock()
+}
+
+// RedisCache is a SharedCache backed by Redis.
+// Redis errors are treated as cache misses, so that authentication never depends on Redis availability.
+type RedisCache struct {
+	client *redis.Client
+	ttl    time.Duration
+	prefix string
+}
+
+// NewRedisCache creates a cache for the Redis server at a URL of the form redis://[:password@]host[:port][/db]
+// (or rediss:// for TLS). Entries expire after ttl.
+func NewRedisCache(rawURL string, ttl time.Duration) (*RedisCache, error) {
+	client, err := redis.New(rawURL, 500*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisCache{client, ttl, "wave:verified:"}, nil
+}
+
+func (c *RedisCache) Verified(key string) bool {
+	v, err := c.client.Do("GET", c.prefix+key)
+	return err == nil && v == "1"
+}
+
+func (c *RedisCache) SetVerified(key string) {
+	c.client.Do("SET", c.prefix+key, "1", "PX", strconv.FormatInt(c.ttl.Milliseconds(), 10))
+}
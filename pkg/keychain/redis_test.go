@@ -0,0 +1,130 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+// fakeRedis serves GET, SET and AUTH from memory.
+type fakeRedis struct {
+	sync.Mutex
+	data map[string]string
+}
+
+func (f *fakeRedis) serve(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.handle(c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func (f *fakeRedis) handle(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+		for i := range args {
+			r.ReadString('\n') // $len
+			arg, _ := r.ReadString('\n')
+			args[i] = strings.TrimSuffix(arg, "\r\n")
+		}
+		f.Lock()
+		switch args[0] {
+		case "AUTH":
+			if args[1] == "pw" {
+				c.Write([]byte("+OK\r\n"))
+			} else {
+				c.Write([]byte("-WRONGPASS invalid password\r\n"))
+			}
+		case "SET":
+			f.data[args[1]] = args[2]
+			c.Write([]byte("+OK\r\n"))
+		case "GET":
+			if v, ok := f.data[args[1]]; ok {
+				c.Write([]byte("$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n"))
+			} else {
+				c.Write([]byte("$-1\r\n"))
+			}
+		}
+		f.Unlock()
+	}
+}
+
+func TestRedisCache(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	f := &fakeRedis{data: make(map[string]string)}
+	addr := f.serve(t)
+
+	rc, err := NewRedisCache("redis://:pw@"+addr+"/0", time.Minute)
+	no(err)
+	ok(!rc.Verified("k"))
+	rc.SetVerified("k")
+	ok(rc.Verified("k"))
+
+	bad, err := NewRedisCache("redis://:nope@"+addr, time.Minute)
+	no(err)
+	ok(!bad.Verified("k"), "auth failure must be a miss")
+
+	// A second server trusts verifications shared by the first.
+	name := filepath.Join(t.TempDir(), ".wave-keychain")
+	kc1, err := LoadKeychain(name)
+	no(err)
+	id, secret, hash, err := CreateAccessKey()
+	no(err)
+	kc1.Add(id, hash)
+	kc1.SetSharedCache(rc)
+	ok(kc1.verify(id, secret))
+	eq(2, len(f.data))
+
+	kc2, err := LoadKeychain(name)
+	no(err)
+	kc2.Add(id, []byte("not a bcrypt hash, so only the shared cache can verify"))
+	kc2.SetSharedCache(rc)
+	ok(!kc2.verify(id, secret), "shared keys must cover the hash")
+
+	kc2.Add(id, hash)
+	ok(kc2.verify(id, secret))
+	ok(!kc2.verify(id, "wrong"))
+	eq(2, len(f.data)) // failed verifications are not shared
+
+	_, err = NewRedisCache("http://"+addr, time.Minute)
+	ok(err != nil)
+}
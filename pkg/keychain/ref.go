@@ -0,0 +1,188 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Idempotent operations for infrastructure-as-code tooling (e.g. a Terraform provider), which
+// identifies keys by a reference ID of its own choosing rather than by the generated access key ID.
+
+var errMissingRef = errors.New("missing reference ID")
+
+// KeySpec describes the desired attributes of an access key.
+type KeySpec struct {
+	Disabled bool              `json:"disabled,omitempty"`
+	Expires  *time.Time        `json:"expires,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+func (s *KeySpec) apply(e *Entry) {
+	e.Disabled = s.Disabled
+	e.Expires = s.Expires
+	e.Metadata = nil
+	if len(s.Metadata) > 0 {
+		e.Metadata = make(map[string]string, len(s.Metadata))
+		for k, v := range s.Metadata {
+			e.Metadata[k] = v
+		}
+	}
+}
+
+func (kc *Keychain) findRef(ref string) (id string, ok bool) {
+	kc.keys.each(func(e *Entry) bool {
+		if e.Ref == ref {
+			id, ok = e.ID, true
+			return false
+		}
+		return true
+	})
+	return
+}
+
+// GetByRef returns the key with the given reference ID.
+func (kc *Keychain) GetByRef(ref string) (Entry, bool) {
+	if id, ok := kc.findRef(ref); ok {
+		return kc.Get(id)
+	}
+	return Entry{}, false
+}
+
+// Ensure creates or updates the key with the given reference ID so that it matches spec.
+// If the key had to be created, its new secret is returned; otherwise the secret is empty and
+// the key's existing secret remains valid. Calling Ensure repeatedly with the same arguments
+// has the same effect as calling it once.
+func (kc *Keychain) Ensure(ref string, spec KeySpec) (Entry, string, error) {
+	if ref == "" {
+		return Entry{}, "", errMissingRef
+	}
+	if kc.ReadOnly() {
+		return Entry{}, "", ErrReadOnly
+	}
+	if e, ok := kc.update(ref, spec); ok {
+		return e, "", nil
+	}
+
+	// Hash outside the lock; bcrypt is slow.
+	id, secret, hash, err := kc.CreateAccessKey()
+	if err != nil {
+		return Entry{}, "", err
+	}
+
+	kc.refs.Lock()
+	defer kc.refs.Unlock()
+	if e, ok := kc.applyRef(ref, spec); ok { // lost a race with a concurrent Ensure
+		kc.changed(e.ID)
+		return e, "", nil
+	}
+	var c Entry
+	kc.keys.upsert(id, func(e *Entry) {
+		e.Hash, e.Ref = hash, ref
+		spec.apply(e)
+		c = e.clone()
+	})
+	kc.changed(id)
+	return c, secret, nil
+}
+
+func (kc *Keychain) update(ref string, spec KeySpec) (Entry, bool) {
+	kc.refs.Lock()
+	e, ok := kc.applyRef(ref, spec)
+	kc.refs.Unlock()
+	if ok {
+		kc.changed(e.ID)
+	}
+	return e, ok
+}
+
+func (kc *Keychain) applyRef(ref string, spec KeySpec) (Entry, bool) {
+	var c Entry
+	id, ok := kc.findRef(ref)
+	if ok {
+		ok = kc.keys.update(id, func(e *Entry) {
+			spec.apply(e)
+			c = e.clone()
+		})
+	}
+	return c, ok
+}
+
+// RemoveByRef removes the key with the given reference ID, if any.
+func (kc *Keychain) RemoveByRef(ref string) bool {
+	if kc.ReadOnly() {
+		return false
+	}
+	kc.refs.Lock()
+	defer kc.refs.Unlock()
+	if id, ok := kc.findRef(ref); ok && kc.keys.remove(id) {
+		kc.cache.Purge()
+		kc.changed(id)
+		return true
+	}
+	return false
+}
+
+// Drift returns the attributes of e that differ from spec, in a stable order: "disabled", "expires",
+// then "metadata.NAME" for each differing metadata attribute, sorted by name.
+func (e Entry) Drift(spec KeySpec) []string {
+	var drift []string
+	if e.Disabled != spec.Disabled {
+		drift = append(drift, "disabled")
+	}
+	if !sameTime(e.Expires, spec.Expires) {
+		drift = append(drift, "expires")
+	}
+	var names []string
+	for k, v := range e.Metadata {
+		if w, ok := spec.Metadata[k]; !ok || w != v {
+			names = append(names, k)
+		}
+	}
+	for k := range spec.Metadata {
+		if _, ok := e.Metadata[k]; !ok {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		drift = append(drift, "metadata."+k)
+	}
+	return drift
+}
+
+// Fingerprint returns a digest of the key's state, including its hash, which changes whenever the key is
+// modified or rotated. Equal states always produce equal fingerprints.
+func (e Entry) Fingerprint() string {
+	var expires string
+	if e.Expires != nil {
+		expires = e.Expires.UTC().Format(time.RFC3339Nano)
+	}
+	b, _ := json.Marshal(struct { // map keys are marshaled in sorted order
+		ID       string            `json:"id"`
+		Hash     []byte            `json:"hash"`
+		Ref      string            `json:"ref"`
+		Disabled bool              `json:"disabled"`
+		Expires  string            `json:"expires"`
+		Metadata map[string]string `json:"metadata"`
+	}{e.ID, e.Hash, e.Ref, e.Disabled, expires, e.Metadata})
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestEnsure(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	name := filepath.Join(t.TempDir(), ".wave-keychain")
+	kc, err := LoadKeychain(name)
+	no(err)
+
+	spec := KeySpec{Metadata: map[string]string{"env": "prod"}}
+	e, secret, err := kc.Ensure("tf-1", spec)
+	no(err)
+	ok(secret != "")
+	ok(kc.verify(e.ID, secret))
+	fp := e.Fingerprint()
+
+	e2, secret2, err := kc.Ensure("tf-1", spec)
+	no(err)
+	eq("", secret2)
+	eq(e.ID, e2.ID)
+	eq(fp, e2.Fingerprint())
+	eq(1, kc.Len())
+
+	eq(0, len(e2.Drift(spec)))
+	eq([]string{"disabled", "metadata.env", "metadata.team"}, e2.Drift(KeySpec{Disabled: true, Metadata: map[string]string{"team": "a"}}))
+
+	no(kc.Save())
+	kc, err = LoadKeychain(name)
+	no(err)
+	e3, found := kc.GetByRef("tf-1")
+	ok(found)
+	eq(fp, e3.Fingerprint())
+
+	_, err = kc.Rotate(e3.ID)
+	no(err)
+	e4, _ := kc.GetByRef("tf-1")
+	ok(fp != e4.Fingerprint(), "rotation must change the fingerprint")
+
+	ok(kc.RemoveByRef("tf-1"))
+	ok(!kc.RemoveByRef("tf-1"))
+
+	_, _, err = kc.Ensure("", spec)
+	ok(err != nil)
+}
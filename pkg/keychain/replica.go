@@ -0,0 +1,282 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	replicaBatchSize = 1000               // mutations per request
+	tombstoneTTL     = 7 * 24 * time.Hour // how long removals are remembered
+)
+
+// Stamp orders changes to a key across replicas. Later stamps win; ties are broken by node.
+type Stamp struct {
+	Time int64  `json:"t"` // Unix nanoseconds
+	Node string `json:"n"`
+}
+
+func (s Stamp) after(t Stamp) bool {
+	return s.Time > t.Time || (s.Time == t.Time && s.Node > t.Node)
+}
+
+// Mutation represents the state of a key at a point in time, as exchanged between replicas.
+type Mutation struct {
+	Entry   Entry  `json:"entry"`
+	Hash    string `json:"hash,omitempty"`
+	Removed bool   `json:"removed,omitempty"`
+	Stamp   Stamp  `json:"stamp"`
+}
+
+func (m *Mutation) fingerprint() string {
+	if m.Removed {
+		return ""
+	}
+	e := m.Entry
+	e.Hash = []byte(m.Hash)
+	return e.Fingerprint()
+}
+
+type version struct {
+	stamp Stamp
+	fp    string // fingerprint of the key's state; empty if removed
+}
+
+// Replicator keeps keychains on several servers consistent by exchanging changes with peers.
+// Conflicting changes are resolved in favor of the last writer. Changes are pushed to all peers as they
+// happen, and the full keychain is periodically pushed to a random peer to repair missed changes.
+type Replicator struct {
+	sync.Mutex
+	keychain *Keychain
+	node     string
+	peers    []string
+	id       string
+	secret   string
+	client   *http.Client
+	versions map[string]version // last known change per key; keys loaded from disk have none
+	clock    int64
+	queue    chan Mutation
+}
+
+// NewReplicator creates a replicator that exchanges changes to kc with peers, identified by their
+// base URLs, authenticating with the given access key.
+func NewReplicator(kc *Keychain, peers []string, id, secret string) (*Replicator, error) {
+	node, err := generateRandString(crand.Reader, idChars, 12)
+	if err != nil {
+		return nil, err
+	}
+	r := &Replicator{
+		keychain: kc,
+		node:     node,
+		peers:    peers,
+		id:       id,
+		secret:   secret,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		versions: make(map[string]version),
+		queue:    make(chan Mutation, replicaBatchSize),
+	}
+	kc.Watch(r.changed)
+	return r, nil
+}
+
+func (r *Replicator) tick() Stamp {
+	t := time.Now().UnixNano()
+	if t <= r.clock {
+		t = r.clock + 1
+	}
+	r.clock = t
+	return Stamp{t, r.node}
+}
+
+func (r *Replicator) mutation(id string, stamp Stamp) (Mutation, string) {
+	e, ok := r.keychain.Get(id)
+	if !ok {
+		return Mutation{Entry: Entry{ID: id}, Removed: true, Stamp: stamp}, ""
+	}
+	m := Mutation{Entry: e, Hash: string(e.Hash), Stamp: stamp}
+	return m, e.Fingerprint()
+}
+
+// changed stamps and queues a local change.
+func (r *Replicator) changed(id string) {
+	m, fp := r.mutation(id, Stamp{})
+	if m.Entry.transient {
+		return
+	}
+	r.Lock()
+	if v, ok := r.versions[id]; ok && v.fp == fp { // no-op, or a change received from a peer
+		r.Unlock()
+		return
+	}
+	m.Stamp = r.tick()
+	r.versions[id] = version{m.Stamp, fp}
+	r.Unlock()
+
+	select {
+	case r.queue <- m:
+	default: // peers catch up on the next full push
+	}
+}
+
+// Merge applies changes received from a peer, keeping the latest change to each key, and saves the keychain.
+func (r *Replicator) Merge(ms []Mutation) error {
+	applied := false
+	for i := range ms {
+		m := &ms[i]
+		if m.Entry.ID == "" {
+			continue
+		}
+		fp := m.fingerprint()
+		local, present := r.keychain.Get(m.Entry.ID)
+		if present && local.transient {
+			continue
+		}
+
+		r.Lock()
+		v, known := r.versions[m.Entry.ID]
+		if !known {
+			if !present {
+				v.fp = "\x00" // never seen; anything wins
+			} else {
+				v.fp = local.Fingerprint()
+			}
+		}
+		if m.Stamp.Time > r.clock {
+			r.clock = m.Stamp.Time
+		}
+		newer := m.Stamp.after(v.stamp) || (m.Stamp == v.stamp && fp > v.fp)
+		if newer {
+			r.versions[m.Entry.ID] = version{m.Stamp, fp}
+		}
+		r.Unlock()
+		if !newer || fp == v.fp {
+			continue
+		}
+
+		var err error
+		if m.Removed {
+			if err = r.keychain.Remove(m.Entry.ID); errors.Is(err, ErrKeyNotFound) {
+				err = nil
+			}
+		} else {
+			e := m.Entry
+			e.Hash = []byte(m.Hash)
+			err = r.keychain.Put(e)
+		}
+		if err != nil {
+			return err
+		}
+		applied = true
+	}
+	if applied {
+		return r.keychain.Save()
+	}
+	return nil
+}
+
+// state returns the latest known change to every key, including removals.
+func (r *Replicator) state() []Mutation {
+	entries := r.keychain.Entries()
+	r.Lock()
+	defer r.Unlock()
+	ms := make([]Mutation, 0, len(entries))
+	present := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		if e.transient {
+			continue
+		}
+		present[e.ID] = true
+		ms = append(ms, Mutation{Entry: e, Hash: string(e.Hash), Stamp: r.versions[e.ID].stamp})
+	}
+	horizon := time.Now().Add(-tombstoneTTL).UnixNano()
+	for id, v := range r.versions {
+		if v.fp != "" || present[id] {
+			continue
+		}
+		if v.stamp.Time < horizon {
+			delete(r.versions, id)
+			continue
+		}
+		ms = append(ms, Mutation{Entry: Entry{ID: id}, Removed: true, Stamp: v.stamp})
+	}
+	return ms
+}
+
+func (r *Replicator) push(peer string, ms []Mutation) error {
+	for len(ms) > 0 {
+		n := min(len(ms), replicaBatchSize)
+		b, err := json.Marshal(ms[:n])
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(peer, "/")+"/_replica", bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.SetBasicAuth(r.id, r.secret)
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("request failed: %s", resp.Status)
+		}
+		ms = ms[n:]
+	}
+	return nil
+}
+
+// Run pushes changes to peers until stop is closed, and pushes the full keychain to a random peer
+// at the given interval. Failures are reported to onError.
+func (r *Replicator) Run(interval time.Duration, stop <-chan struct{}, onError func(peer string, err error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case m := <-r.queue:
+			ms := []Mutation{m}
+			for len(ms) < replicaBatchSize && len(r.queue) > 0 {
+				ms = append(ms, <-r.queue)
+			}
+			for _, peer := range r.peers {
+				if err := r.push(peer, ms); err != nil {
+					onError(peer, err)
+				}
+			}
+		case <-ticker.C:
+			if len(r.peers) == 0 {
+				continue
+			}
+			peer := r.peers[rand.Intn(len(r.peers))]
+			if err := r.push(peer, r.state()); err != nil {
+				onError(peer, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+type replica struct {
+	kc *Keychain
+	r  *Replicator
+}
+
+func newReplica(t *testing.T, name string, peers ...string) (*replica, *httptest.Server) {
+	kc, err := LoadKeychain(filepath.Join(t.TempDir(), name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReplicator(kc, peers, "id", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var ms []Mutation
+		if err := json.NewDecoder(req.Body).Decode(&ms); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := r.Merge(ms); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return &replica{kc, r}, srv
+}
+
+func eventually(cond func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
+
+func TestReplicator(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+
+	b, srvB := newReplica(t, "b")
+	a, srvA := newReplica(t, "a", srvB.URL)
+	b.r.peers = []string{srvA.URL}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	fail := func(peer string, err error) { t.Error(peer, err) }
+	go a.r.Run(time.Hour, stop, fail)
+	go b.r.Run(time.Hour, stop, fail)
+
+	// Changes propagate both ways.
+	a.kc.Put(Entry{ID: "K1", Hash: []byte("h1"), Metadata: map[string]string{"owner": "a"}})
+	ok(eventually(func() bool { _, found := b.kc.Get("K1"); return found }))
+	e, _ := b.kc.Get("K1")
+	eq("h1", string(e.Hash))
+	eq("a", e.Metadata["owner"])
+
+	b.kc.Disable("K1", true)
+	ok(eventually(func() bool { e, _ := a.kc.Get("K1"); return e.Disabled }))
+
+	b.kc.Remove("K1")
+	ok(eventually(func() bool { _, found := a.kc.Get("K1"); return !found }))
+
+	// Changes received from peers are saved.
+	a.kc.Put(Entry{ID: "K2", Hash: []byte("h2")})
+	ok(eventually(func() bool { _, found := b.kc.Get("K2"); return found }))
+	saved, err := LoadKeychain(b.kc.Name)
+	ok(err == nil)
+	_, found := saved.Get("K2")
+	ok(found)
+
+	// Last writer wins, regardless of arrival order.
+	newer := Mutation{Entry: Entry{ID: "K3"}, Hash: "new", Stamp: Stamp{Time: 2, Node: "x"}}
+	older := Mutation{Entry: Entry{ID: "K3"}, Hash: "old", Stamp: Stamp{Time: 1, Node: "y"}}
+	ok(a.r.Merge([]Mutation{newer, older}) == nil)
+	ok(b.r.Merge([]Mutation{older, newer}) == nil)
+	ea, _ := a.kc.Get("K3")
+	eb, _ := b.kc.Get("K3")
+	eq("new", string(ea.Hash))
+	eq("new", string(eb.Hash))
+
+	// Removals win over older changes.
+	gone := Mutation{Entry: Entry{ID: "K3"}, Removed: true, Stamp: Stamp{Time: 3, Node: "x"}}
+	ok(a.r.Merge([]Mutation{gone, older}) == nil)
+	_, found = a.kc.Get("K3")
+	ok(!found)
+
+	// Full pushes repair missed changes.
+	b.kc.AddTransient("T", []byte("t")) // never replicated
+	a.r.Lock()
+	a.r.versions["K4"] = version{a.r.tick(), "x"}
+	a.r.Unlock()
+	a.kc.keys.upsert("K4", func(e *Entry) { e.Hash = []byte("h4") }) // bypasses watchers
+	ok(a.r.push(srvB.URL, a.r.state()) == nil)
+	e, found = b.kc.Get("K4")
+	ok(found)
+	eq("h4", string(e.Hash))
+	ok(b.r.push(srvA.URL, b.r.state()) == nil)
+	_, found = a.kc.Get("T")
+	ok(!found)
+}
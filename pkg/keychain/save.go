@@ -0,0 +1,125 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"sync"
+	"time"
+)
+
+// saver coalesces bursts of saves into a single write.
+type saver struct {
+	sync.Mutex
+	kc      *Keychain
+	delay   time.Duration
+	onError func(err error)
+	timer   *time.Timer
+	dirty   map[string]bool // IDs changed since the last write
+	writing sync.Mutex      // serializes writes
+}
+
+// CoalesceSaves makes Save return immediately, and write the keychain once no further saves have been
+// requested for delay, so that bursts of changes cost a single write. If the store is an IncrementalStore,
+// only changed entries are written. Errors are reported to onError. Call Flush before exiting to write
+// pending changes.
+func (kc *Keychain) CoalesceSaves(delay time.Duration, onError func(err error)) {
+	s := &saver{kc: kc, delay: delay, onError: onError, dirty: make(map[string]bool)}
+	kc.Watch(s.touch)
+	kc.Lock()
+	kc.saver = s
+	kc.Unlock()
+}
+
+// Flush writes pending changes, if saves are being coalesced.
+func (kc *Keychain) Flush() error {
+	kc.RLock()
+	s := kc.saver
+	kc.RUnlock()
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.Unlock()
+	return s.flush()
+}
+
+func (s *saver) touch(id string) {
+	s.Lock()
+	s.dirty[id] = true
+	s.Unlock()
+}
+
+func (s *saver) schedule() {
+	s.Lock()
+	defer s.Unlock()
+	if s.timer != nil {
+		s.timer.Reset(s.delay)
+		return
+	}
+	s.timer = time.AfterFunc(s.delay, func() {
+		s.Lock()
+		s.timer = nil
+		s.Unlock()
+		if err := s.flush(); err != nil && s.onError != nil {
+			s.onError(err)
+		}
+	})
+}
+
+func (s *saver) flush() error {
+	s.writing.Lock()
+	defer s.writing.Unlock()
+
+	s.Lock()
+	dirty := s.dirty
+	s.dirty = make(map[string]bool)
+	s.Unlock()
+
+	err := s.kc.write(dirty)
+	if err != nil { // retry with the next write
+		s.Lock()
+		for id := range dirty {
+			s.dirty[id] = true
+		}
+		s.Unlock()
+	}
+	return err
+}
+
+// write persists the keychain, writing only the entries for changed IDs if the store supports it.
+func (kc *Keychain) write(changed map[string]bool) error {
+	if t, ok := kc.keys.(*diskTable); ok {
+		return t.flush()
+	}
+	if store, ok := kc.store.(IncrementalStore); ok && len(changed) > 0 {
+		var (
+			entries []Entry
+			removed []string
+		)
+		for id := range changed {
+			if e, ok := kc.Get(id); !ok {
+				removed = append(removed, id)
+			} else if !e.transient {
+				entries = append(entries, e)
+			}
+		}
+		return store.Update(entries, removed)
+	}
+	return kc.store.Save(kc.persistent())
+}
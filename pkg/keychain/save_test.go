@@ -0,0 +1,81 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+// countingStore counts full and incremental writes.
+type countingStore struct {
+	*SQLiteStore
+	saves, updates atomic.Int32
+}
+
+func (s *countingStore) Save(entries []Entry) error {
+	s.saves.Add(1)
+	return s.SQLiteStore.Save(entries)
+}
+
+func (s *countingStore) Update(entries []Entry, removed []string) error {
+	s.updates.Add(1)
+	return s.SQLiteStore.Update(entries, removed)
+}
+
+func TestCoalesceSaves(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	_, _, hash, err := CreateAccessKey()
+	no(err)
+
+	store := &countingStore{SQLiteStore: &SQLiteStore{filepath.Join(t.TempDir(), "keys.db")}}
+	no(store.SQLiteStore.Save([]Entry{{ID: "A", Hash: hash}, {ID: "B", Hash: hash}}))
+	kc, err := Open(store)
+	no(err)
+	kc.CoalesceSaves(50*time.Millisecond, func(err error) { t.Error(err) })
+
+	// A burst of changes is written once, incrementally.
+	for _, id := range []string{"C", "D", "E"} {
+		no(kc.Add(id, hash))
+		no(kc.Save())
+	}
+	no(kc.Remove("A"))
+	kc.AddTransient("T", hash)
+	no(kc.Save())
+	eq(int32(0), store.updates.Load())
+	ok(eventually(func() bool { return store.updates.Load() == 1 }))
+	time.Sleep(100 * time.Millisecond)
+	eq(int32(1), store.updates.Load())
+	eq(int32(0), store.saves.Load())
+
+	entries, err := store.Load()
+	no(err)
+	eq(4, len(entries)) // B, C, D, E
+
+	// Flush writes pending changes immediately.
+	kc.SetMetadata("B", map[string]string{"owner": "ops"})
+	no(kc.Save())
+	no(kc.Flush())
+	eq(int32(2), store.updates.Load())
+	reloaded, err := Open(store.SQLiteStore)
+	no(err)
+	e, found := reloaded.Get("B")
+	ok(found)
+	eq("ops", e.Metadata["owner"])
+}
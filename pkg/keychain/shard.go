@@ -0,0 +1,168 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"sync"
+	"time"
+)
+
+// table holds the entries of a keychain.
+// Callbacks receive entries owned by the table, and must neither retain them nor call back into the table.
+type table interface {
+	// view calls fn with the entry for id, if any.
+	view(id string, fn func(e *Entry)) bool
+	// credential returns the hash of the entry for id, if any, and whether it is active at t, without allocating.
+	credential(id string, t time.Time) (hash []byte, active, found bool)
+	// update calls fn to modify the entry for id, if any.
+	update(id string, fn func(e *Entry)) bool
+	// upsert calls fn to modify the entry for id, creating it first if necessary. It reports whether the entry existed.
+	upsert(id string, fn func(e *Entry)) bool
+	// remove removes the entry for id, if any.
+	remove(id string) bool
+	// each calls fn for every entry, in no particular order, until fn returns false.
+	each(fn func(e *Entry) bool)
+	// len returns the number of entries.
+	len() int
+}
+
+const shardCount = 64
+
+type shard struct {
+	sync.RWMutex
+	m map[string]*Entry
+}
+
+// shardMap is an in-memory table split into shards, each with its own lock, so that lookups
+// don't contend with writes to other shards and maps grow in small increments as keys are added.
+type shardMap [shardCount]shard
+
+func newShardMap(entries []Entry) *shardMap {
+	s := &shardMap{}
+	for i := range s {
+		s[i].m = make(map[string]*Entry, len(entries)/shardCount)
+	}
+	for i := range entries {
+		e := &entries[i]
+		s.shard(e.ID).m[e.ID] = e
+	}
+	return s
+}
+
+func (s *shardMap) shard(id string) *shard {
+	h := uint32(2166136261) // FNV-1a
+	for i := 0; i < len(id); i++ {
+		h ^= uint32(id[i])
+		h *= 16777619
+	}
+	return &s[h%shardCount]
+}
+
+func (s *shardMap) view(id string, fn func(e *Entry)) bool {
+	sh := s.shard(id)
+	sh.RLock()
+	defer sh.RUnlock()
+	if e, ok := sh.m[id]; ok {
+		fn(e)
+		return true
+	}
+	return false
+}
+
+func (s *shardMap) credential(id string, t time.Time) ([]byte, bool, bool) {
+	sh := s.shard(id)
+	sh.RLock()
+	defer sh.RUnlock()
+	if e, ok := sh.m[id]; ok {
+		return e.Hash, e.Active(t), true
+	}
+	return nil, false, false
+}
+
+func (s *shardMap) update(id string, fn func(e *Entry)) bool {
+	sh := s.shard(id)
+	sh.Lock()
+	defer sh.Unlock()
+	if e, ok := sh.m[id]; ok {
+		fn(e)
+		return true
+	}
+	return false
+}
+
+func (s *shardMap) upsert(id string, fn func(e *Entry)) bool {
+	sh := s.shard(id)
+	sh.Lock()
+	defer sh.Unlock()
+	e, ok := sh.m[id]
+	if !ok {
+		e = &Entry{ID: id}
+		sh.m[id] = e
+	}
+	fn(e)
+	return ok
+}
+
+func (s *shardMap) remove(id string) bool {
+	sh := s.shard(id)
+	sh.Lock()
+	defer sh.Unlock()
+	if _, ok := sh.m[id]; ok {
+		delete(sh.m, id)
+		return true
+	}
+	return false
+}
+
+func (s *shardMap) each(fn func(e *Entry) bool) {
+	for i := range s {
+		sh := &s[i]
+		sh.RLock()
+		for _, e := range sh.m {
+			if !fn(e) {
+				sh.RUnlock()
+				return
+			}
+		}
+		sh.RUnlock()
+	}
+}
+
+// reset replaces all entries, keeping transient entries.
+func (s *shardMap) reset(entries []Entry) {
+	fresh := newShardMap(entries)
+	for i := range s {
+		sh := &s[i]
+		sh.Lock()
+		for id, e := range sh.m {
+			if e.transient {
+				fresh[i].m[id] = e
+			}
+		}
+		sh.m = fresh[i].m
+		sh.Unlock()
+	}
+}
+
+func (s *shardMap) len() int {
+	n := 0
+	for i := range s {
+		sh := &s[i]
+		sh.RLock()
+		n += len(sh.m)
+		sh.RUnlock()
+	}
+	return n
+}
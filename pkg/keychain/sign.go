@@ -0,0 +1,92 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrInvalidSignature is returned when verifying a signature that was not made by the keychain for the data.
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrSignatureExpired is returned when verifying a signature past its expiry.
+	ErrSignatureExpired = errors.New("signature expired")
+)
+
+// SetSigningKey sets the key signatures are made with. By default, each keychain signs with a random key, so that
+// its signatures verify only in the process that made them; servers sharing keys must share a signing key, too.
+func (kc *Keychain) SetSigningKey(key []byte) {
+	kc.Lock()
+	kc.signer = newTokenizerPool(key)
+	kc.Unlock()
+}
+
+// Sign signs data on behalf of an access key, until expires, e.g. to grant access to a URL without handing out the
+// key's secret. Signatures verify only while the key is active, so that disabling, expiring or removing a key
+// revokes everything signed on its behalf.
+func (kc *Keychain) Sign(id, data string, expires time.Time) (string, error) {
+	if err := kc.checkSigner(id); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(kc.sign(id, data, expires)), nil
+}
+
+// VerifySignature checks that sig was made by Sign for id, data and expires, and has not expired.
+func (kc *Keychain) VerifySignature(id, data string, expires time.Time, sig string) error {
+	if !kc.clock.Now().Before(expires) {
+		return ErrSignatureExpired
+	}
+	if err := kc.checkSigner(id); err != nil {
+		return err
+	}
+	b, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(b, kc.sign(id, data, expires)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// checkSigner fails unless id is an active key.
+func (kc *Keychain) checkSigner(id string) error {
+	e, ok := kc.Get(id)
+	switch {
+	case !ok:
+		return ErrKeyNotFound
+	case e.Disabled:
+		return ErrKeyDisabled
+	case !e.Active(kc.clock.Now()):
+		return ErrKeyExpired
+	}
+	return nil
+}
+
+func (kc *Keychain) sign(id, data string, expires time.Time) []byte {
+	kc.RLock()
+	signer := kc.signer
+	kc.RUnlock()
+	tz := signer.Get().(*tokenizer)
+	tz.buf = append(append(tz.buf[:0], id...), 0)
+	tz.buf = append(strconv.AppendInt(tz.buf, expires.Unix(), 10), 0)
+	tz.buf = append(tz.buf, data...)
+	tz.mac.Reset()
+	tz.mac.Write(tz.buf)
+	sum := tz.mac.Sum(nil)
+	signer.Put(tz)
+	return sum
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSign(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	clock := &fakeClock{time.Now()}
+	kc, err := New(filepath.Join(t.TempDir(), ".wave-keychain"), WithCost(bcrypt.MinCost), WithClock(clock))
+	no(err)
+	hash, err := kc.HashSecret("s3cret")
+	no(err)
+	no(kc.Add("A", hash))
+	no(kc.Add("B", hash))
+
+	expires := clock.t.Add(time.Hour)
+	sig, err := kc.Sign("A", "/_f/1/a.txt", expires)
+	no(err)
+	no(kc.VerifySignature("A", "/_f/1/a.txt", expires, sig))
+
+	eq(ErrInvalidSignature, kc.VerifySignature("A", "/_f/1/b.txt", expires, sig))
+	eq(ErrInvalidSignature, kc.VerifySignature("B", "/_f/1/a.txt", expires, sig))
+	eq(ErrInvalidSignature, kc.VerifySignature("A", "/_f/1/a.txt", expires.Add(time.Hour), sig))
+	eq(ErrInvalidSignature, kc.VerifySignature("A", "/_f/1/a.txt", expires, "not base64!"))
+
+	_, err = kc.Sign("C", "/_f/1/a.txt", expires)
+	eq(ErrKeyNotFound, err)
+
+	// Disabling the key revokes its signatures.
+	no(kc.Disable("A", true))
+	eq(ErrKeyDisabled, kc.VerifySignature("A", "/_f/1/a.txt", expires, sig))
+	_, err = kc.Sign("A", "/_f/1/a.txt", expires)
+	eq(ErrKeyDisabled, err)
+	no(kc.Disable("A", false))
+	no(kc.VerifySignature("A", "/_f/1/a.txt", expires, sig))
+
+	clock.t = expires
+	eq(ErrSignatureExpired, kc.VerifySignature("A", "/_f/1/a.txt", expires, sig))
+}
+
+func TestSigningKey(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	no(err)
+	newKeychain := func() *Keychain {
+		kc, err := New(filepath.Join(t.TempDir(), ".wave-keychain"))
+		no(err)
+		no(kc.Add("A", hash))
+		return kc
+	}
+	kc1, kc2 := newKeychain(), newKeychain()
+	expires := time.Now().Add(time.Hour)
+	sig, err := kc1.Sign("A", "data", expires)
+	no(err)
+
+	// Keychains sign with random keys unless given a shared one.
+	eq(ErrInvalidSignature, kc2.VerifySignature("A", "data", expires, sig))
+
+	kc1.SetSigningKey([]byte("shared"))
+	kc2.SetSigningKey([]byte("shared"))
+	sig, err = kc1.Sign("A", "data", expires)
+	no(err)
+	no(kc2.VerifySignature("A", "data", expires, sig))
+}
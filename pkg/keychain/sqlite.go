@@ -0,0 +1,176 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lo5/sqlite3"
+)
+
+const sqlitePrefix = "sqlite:"
+
+// SQLiteStore is a Keystore backed by a SQLite database, with one row per entry.
+type SQLiteStore struct {
+	Name string
+}
+
+// OpenStore returns the store for a keychain name: a SQLiteStore if the name is of the form
+// "sqlite:path", otherwise a FileStore.
+func OpenStore(name string) Keystore {
+	if path, ok := strings.CutPrefix(name, sqlitePrefix); ok {
+		return &SQLiteStore{path}
+	}
+	return &FileStore{name}
+}
+
+func (s *SQLiteStore) String() string {
+	return sqlitePrefix + s.Name
+}
+
+func (s *SQLiteStore) open() (*sqlite3.Conn, error) {
+	conn, err := sqlite3.Open(s.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening %s: %v", s.Name, err)
+	}
+	if err := conn.Exec(`create table if not exists keys (id text primary key, hash blob not null, attrs text not null)`); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed creating keys table in %s: %v", s.Name, err)
+	}
+	return conn, nil
+}
+
+func (s *SQLiteStore) Load() ([]Entry, error) {
+	if _, err := os.Stat(s.Name); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	conn, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	stmt, err := conn.Prepare(`select id, hash, attrs from keys`)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading %s: %v", s.Name, err)
+	}
+	defer stmt.Close()
+
+	var entries []Entry
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, fmt.Errorf("failed reading %s: %v", s.Name, err)
+		}
+		if !hasRow {
+			break
+		}
+		var (
+			id, attrs string
+			hash      []byte
+		)
+		if err := stmt.Scan(&id, &hash, &attrs); err != nil {
+			return nil, fmt.Errorf("failed reading %s: %v", s.Name, err)
+		}
+		e := Entry{}
+		if len(attrs) > 0 {
+			if err := json.Unmarshal([]byte(attrs), &e); err != nil {
+				return nil, fmt.Errorf("%s: %w", s.Name, &ErrInvalidEntry{Reason: fmt.Sprintf("bad attributes of %s: %v", id, err)})
+			}
+		}
+		e.ID, e.Hash = id, hash
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (s *SQLiteStore) Save(entries []Entry) error {
+	conn, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.Begin(); err != nil {
+		return fmt.Errorf("failed writing %s: %v", s.Name, err)
+	}
+	if err := saveRows(conn, entries); err != nil {
+		if err2 := conn.Rollback(); err2 != nil {
+			return fmt.Errorf("failed writing %s: %v; additionally, rolling back failed: %v", s.Name, err, err2)
+		}
+		return fmt.Errorf("failed writing %s: %v", s.Name, err)
+	}
+	if err := conn.Commit(); err != nil {
+		return fmt.Errorf("failed writing %s: %v", s.Name, err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) Update(entries []Entry, removed []string) error {
+	conn, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.Begin(); err != nil {
+		return fmt.Errorf("failed writing %s: %v", s.Name, err)
+	}
+	if err := updateRows(conn, entries, removed); err != nil {
+		if err2 := conn.Rollback(); err2 != nil {
+			return fmt.Errorf("failed writing %s: %v; additionally, rolling back failed: %v", s.Name, err, err2)
+		}
+		return fmt.Errorf("failed writing %s: %v", s.Name, err)
+	}
+	if err := conn.Commit(); err != nil {
+		return fmt.Errorf("failed writing %s: %v", s.Name, err)
+	}
+	return nil
+}
+
+func saveRows(conn *sqlite3.Conn, entries []Entry) error {
+	if err := conn.Exec(`delete from keys`); err != nil {
+		return err
+	}
+	return updateRows(conn, entries, nil)
+}
+
+func updateRows(conn *sqlite3.Conn, entries []Entry, removed []string) error {
+	for _, id := range removed {
+		if err := conn.Exec(`delete from keys where id = ?`, id); err != nil {
+			return err
+		}
+	}
+	for _, e := range entries {
+		var attrs string
+		if e.Ref != "" || e.Disabled || e.Expires != nil || len(e.Metadata) > 0 {
+			id := e.ID
+			e.ID = ""
+			b, err := json.Marshal(e)
+			if err != nil {
+				return fmt.Errorf("failed marshaling attributes of %s: %v", id, err)
+			}
+			e.ID, attrs = id, string(b)
+		}
+		if err := conn.Exec(`insert or replace into keys (id, hash, attrs) values (?, ?, ?)`, e.ID, e.Hash, attrs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
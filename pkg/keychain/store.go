@@ -0,0 +1,199 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Keystore represents a backend that persists keychain entries.
+type Keystore interface {
+	// Load returns all stored entries. A store that does not exist yet holds no entries.
+	Load() ([]Entry, error)
+	// Save replaces all stored entries.
+	Save(entries []Entry) error
+	// String returns a human-readable description of the store, e.g. its file path.
+	String() string
+}
+
+// IncrementalStore is a Keystore that can write changed entries without rewriting all entries.
+type IncrementalStore interface {
+	Keystore
+	// Update adds or replaces entries, and removes the entries for removed IDs.
+	Update(entries []Entry, removed []string) error
+}
+
+// FileStore is a Keystore backed by a flat file, with one "id:hash" or "id:hash:{attrs}" line per entry.
+type FileStore struct {
+	Name string
+}
+
+func (fs *FileStore) String() string {
+	return fs.Name
+}
+
+func (fs *FileStore) Load() ([]Entry, error) {
+	if _, err := os.Stat(fs.Name); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	file, err := os.Open(fs.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening %s: %v", fs.Name, err)
+	}
+	defer file.Close()
+
+	entries, err := readEntries(file)
+	if err != nil {
+		var le *LineError
+		if errors.As(err, &le) {
+			return nil, fmt.Errorf("%s: %w", fs.Name, err)
+		}
+		return nil, fmt.Errorf("failed reading %s: %v", fs.Name, err)
+	}
+	return entries, nil
+}
+
+// readEntries reads entries in the keychain file format from r.
+func readEntries(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	err := scanLines(r, func(n int, line []byte) error {
+		if len(line) == 0 {
+			return nil
+		}
+		e, err := parseEntry(line)
+		if err != nil {
+			return lineError(n, err)
+		}
+		entries = append(entries, *e)
+		return nil
+	})
+	return entries, err
+}
+
+// lineError reports err, from parsing line n of a keychain file, at that line.
+func lineError(n int, err error) *LineError {
+	var ie *ErrInvalidEntry
+	if errors.As(err, &ie) {
+		ie.Line = n
+	}
+	return &LineError{n, err}
+}
+
+// maxLineSize is the maximum length of a line in a keychain file.
+const maxLineSize = 1 << 20
+
+// scanLines calls f with each line read from r, and its 1-based line number, without reading r
+// into memory. Unlike bufio.ScanLines, carriage returns are kept. The line is only valid until f returns.
+func scanLines(r io.Reader, f func(n int, line []byte) error) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	s.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+	for n := 1; s.Scan(); n++ {
+		if err := f(n, s.Bytes()); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+func (fs *FileStore) Save(entries []Entry) error {
+	var sb bytes.Buffer
+	if _, err := writeEntries(&sb, entries); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(fs.Name, sb.Bytes(), 0600); err != nil {
+		return fmt.Errorf("failed writing %s: %v", fs.Name, err)
+	}
+
+	return nil
+}
+
+// parseEntry parses a keychain line in the format "id:hash" or "id:hash:{attrs}",
+// where attrs is a JSON object holding optional entry attributes.
+func parseEntry(line []byte) (*Entry, error) {
+	tokens := bytes.SplitN(line, colon, 3)
+	if len(tokens) < 2 {
+		return nil, &ErrInvalidEntry{Reason: "want id:hash"}
+	}
+	id, hash := tokens[0], tokens[1]
+	if len(id) == 0 {
+		return nil, &ErrInvalidEntry{Reason: "missing id"}
+	}
+	if len(hash) == 0 {
+		return nil, &ErrInvalidEntry{Reason: "missing hash"}
+	}
+	e := &Entry{}
+	if len(tokens) == 3 {
+		if err := json.Unmarshal(tokens[2], e); err != nil {
+			return nil, &ErrInvalidEntry{Reason: fmt.Sprintf("bad attributes: %v", err)}
+		}
+	}
+	e.ID, e.Hash = string(id), bytes.Clone(hash)
+	return e, nil
+}
+
+// writeEntries writes entries to w in the keychain file format.
+func writeEntries(w io.Writer, entries []Entry) (int64, error) {
+	var (
+		sb bytes.Buffer
+		n  int64
+	)
+	for _, e := range entries {
+		sb.Reset()
+		if err := writeEntry(&sb, e); err != nil {
+			return n, err
+		}
+		m, err := w.Write(sb.Bytes())
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func writeEntry(sb *bytes.Buffer, e Entry) error {
+	sb.WriteString(e.ID)
+	sb.Write(colon)
+	sb.Write(e.Hash)
+	if e.Ref != "" || e.Disabled || e.Expires != nil || len(e.Metadata) > 0 {
+		id := e.ID
+		e.ID = ""
+		attrs, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("failed marshaling attributes of %s: %v", id, err)
+		}
+		sb.Write(colon)
+		sb.Write(attrs)
+	}
+	sb.Write(newline)
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Tenant represents an isolated namespace of access keys, with its own administrators.
+type Tenant struct {
+	Name     string
+	Keychain *Keychain // keys of this tenant, with unscoped IDs
+	Admins   *Keychain // keys allowed to manage this tenant's keys
+	Quota    int       // maximum number of keys; 0 for no limit
+	Limiter  *Limiter  // limits requests made with this tenant's keys; nil for no limits
+}
+
+type tenantConf struct {
+	Name          string  `yaml:"name"`
+	Keychain      string  `yaml:"keychain"`
+	AdminKeychain string  `yaml:"admin_keychain"`
+	Quota         int     `yaml:"quota"`
+	RateLimit     float64 `yaml:"rate_limit"`
+	Burst         int     `yaml:"burst"`
+	MaxConcurrent int     `yaml:"max_concurrent"`
+}
+
+// LoadTenants reads tenant definitions from a YAML file, and loads each tenant's keychains:
+//
+//	tenants:
+//	  - name: acme
+//	    keychain: /var/lib/wave/acme.keychain
+//	    admin_keychain: /var/lib/wave/acme-admin.keychain
+//	    quota: 100
+//	    rate_limit: 50 # requests per second
+//	    burst: 100
+//	    max_concurrent: 20
+func LoadTenants(name string) ([]*Tenant, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading tenants %s: %v", name, err)
+	}
+	var conf struct {
+		Tenants []tenantConf `yaml:"tenants"`
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&conf); err != nil {
+		return nil, fmt.Errorf("invalid tenants %s: %v", name, err)
+	}
+
+	tenants := make([]*Tenant, 0, len(conf.Tenants))
+	seen := make(map[string]bool)
+	for _, tc := range conf.Tenants {
+		if tc.Name == "" || strings.ContainsAny(tc.Name, "/:") {
+			return nil, fmt.Errorf("invalid tenant name %q in %s", tc.Name, name)
+		}
+		if seen[tc.Name] {
+			return nil, fmt.Errorf("duplicate tenant %s in %s", tc.Name, name)
+		}
+		seen[tc.Name] = true
+		if tc.Keychain == "" || tc.AdminKeychain == "" {
+			return nil, fmt.Errorf("tenant %s: keychain and admin_keychain are required", tc.Name)
+		}
+		if tc.Quota < 0 {
+			return nil, fmt.Errorf("tenant %s: invalid quota %d", tc.Name, tc.Quota)
+		}
+		if tc.RateLimit < 0 || tc.Burst < 0 || tc.MaxConcurrent < 0 {
+			return nil, fmt.Errorf("tenant %s: rate_limit, burst and max_concurrent must not be negative", tc.Name)
+		}
+		var limiter *Limiter
+		if tc.RateLimit > 0 || tc.MaxConcurrent > 0 {
+			limiter = NewLimiter(tc.RateLimit, tc.Burst, tc.MaxConcurrent)
+		}
+		kc, err := LoadKeychain(tc.Keychain)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %v", tc.Name, err)
+		}
+		admins, err := LoadKeychain(tc.AdminKeychain)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %v", tc.Name, err)
+		}
+		tenants = append(tenants, &Tenant{tc.Name, kc, admins, tc.Quota, limiter})
+	}
+	return tenants, nil
+}
+
+// Mount makes the keys of a tenant usable through this keychain, with IDs scoped as "tenant/id".
+// Authentication attempts are inspected by this keychain's hooks, with their scoped IDs, and
+// requests are subject to the tenant's limits.
+func (kc *Keychain) Mount(t *Tenant) {
+	kc.Lock()
+	defer kc.Unlock()
+	if kc.tenants == nil {
+		kc.tenants = make(map[string]*Tenant)
+	}
+	kc.tenants[t.Name] = t
+}
+
+// admit checks a request made with a valid key against the limits of the key's tenant, if any.
+// Requests in flight are counted until the request's context is done.
+func (kc *Keychain) admit(r *http.Request, id string) bool {
+	name, _, scoped := strings.Cut(id, "/")
+	if !scoped {
+		return true
+	}
+	kc.RLock()
+	t := kc.tenants[name]
+	kc.RUnlock()
+	if t == nil || t.Limiter == nil {
+		return true
+	}
+	release, ok := t.Limiter.acquire(kc.clock.Now())
+	if release != nil {
+		context.AfterFunc(r.Context(), release)
+	}
+	return ok
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestTenants(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "tenants.yaml")
+	no(os.WriteFile(conf, []byte(`
+tenants:
+  - name: acme
+    keychain: `+filepath.Join(dir, "acme.keychain")+`
+    admin_keychain: `+filepath.Join(dir, "acme-admin.keychain")+`
+    quota: 2
+`), 0600))
+
+	tenants, err := LoadTenants(conf)
+	no(err)
+	eq(1, len(tenants))
+	acme := tenants[0]
+	eq(2, acme.Quota)
+
+	id, secret, hash, err := CreateAccessKey()
+	no(err)
+	acme.Keychain.Add(id, hash)
+
+	kc, err := LoadKeychain(filepath.Join(dir, ".wave-keychain"))
+	no(err)
+	ok(!kc.verify("acme/"+id, secret), "tenant not mounted yet")
+	kc.Mount(acme)
+	ok(kc.verify("acme/"+id, secret))
+	ok(!kc.verify(id, secret), "tenant keys must be scoped")
+	ok(!kc.verify("other/"+id, secret))
+
+	kc.Add(id, hash)
+	ok(!acme.Keychain.verify("acme/"+id, secret), "tenants must not see other keychains")
+
+	no(os.WriteFile(conf, []byte("tenants:\n  - name: a/b\n"), 0600))
+	_, err = LoadTenants(conf)
+	ok(err != nil)
+}
+
+func TestTenantLimits(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+
+	// Rate
+	l := NewLimiter(2, 0, 0)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		_, admitted := l.acquire(now)
+		ok(admitted)
+	}
+	_, admitted := l.acquire(now)
+	ok(!admitted)
+	_, admitted = l.acquire(now.Add(500 * time.Millisecond))
+	ok(admitted)
+
+	// Concurrency, through the guard path
+	dir := t.TempDir()
+	acme := &Tenant{Name: "acme", Limiter: NewLimiter(0, 0, 1)}
+	var err error
+	acme.Keychain, err = LoadKeychain(filepath.Join(dir, "acme.keychain"))
+	no(err)
+	id, secret, hash, err := CreateAccessKey()
+	no(err)
+	no(acme.Keychain.Add(id, hash))
+	kc, err := LoadKeychain(filepath.Join(dir, ".wave-keychain"))
+	no(err)
+	kc.Mount(acme)
+
+	guard := func(ctx context.Context) int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+		r.SetBasicAuth("acme/"+id, secret)
+		w := httptest.NewRecorder()
+		kc.Guard(w, r)
+		return w.Code
+	}
+	ctx, done := context.WithCancel(context.Background())
+	eq(http.StatusOK, guard(ctx))
+	eq(http.StatusTooManyRequests, guard(context.Background()))
+	done() // request completes
+	ok(eventually(func() bool { return guard(context.Background()) == http.StatusOK }))
+}
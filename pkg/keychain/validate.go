@@ -0,0 +1,92 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Validate parses the keychain file name without loading it, and reports every problem found:
+// malformed lines, duplicate IDs and hashes that are not bcrypt hashes.
+// The error is non-nil only if the file could not be read, e.g. if a line exceeds 1 MiB.
+func Validate(name string) ([]*LineError, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return validate(file)
+}
+
+func validate(r io.Reader) ([]*LineError, error) {
+	var (
+		problems []*LineError
+		seen     = make(map[string]int) // id -> line
+	)
+	err := scanLines(r, func(n int, line []byte) error {
+		if len(line) == 0 {
+			return nil
+		}
+		if line[len(line)-1] == '\r' {
+			problems = append(problems, &LineError{n, errors.New("line ends with a carriage return (CRLF line endings?)")})
+			return nil
+		}
+		e, err := parseEntry(line)
+		if err != nil {
+			problems = append(problems, lineError(n, err))
+			return nil
+		}
+		if prev, ok := seen[e.ID]; ok {
+			problems = append(problems, &LineError{n, fmt.Errorf("duplicate id %s, first seen on line %d", e.ID, prev)})
+		} else {
+			seen[e.ID] = n
+		}
+		if _, err := bcrypt.Cost(e.Hash); err != nil {
+			problems = append(problems, &LineError{n, fmt.Errorf("invalid hash for %s: %v", e.ID, err)})
+		}
+		return nil
+	})
+	return problems, err
+}
+
+// HashError describes a key with a malformed hash, e.g. a truncated or corrupted bcrypt string.
+// Such keys never verify.
+type HashError struct {
+	ID  string
+	Err error
+}
+
+func (e *HashError) Error() string {
+	return fmt.Sprintf("invalid hash for %s: %v", e.ID, e.Err)
+}
+
+// CheckHashes reports every key in the keychain whose hash is malformed, e.g. not a well-formed bcrypt hash.
+func (kc *Keychain) CheckHashes() []*HashError {
+	var problems []*HashError
+	kc.keys.each(func(e *Entry) bool {
+		if err := kc.hasher.Check(e.Hash); err != nil {
+			problems = append(problems, &HashError{e.ID, err})
+		}
+		return true
+	})
+	sort.Slice(problems, func(i, j int) bool { return problems[i].ID < problems[j].ID })
+	return problems
+}
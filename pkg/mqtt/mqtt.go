@@ -0,0 +1,293 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mqtt is a minimal MQTT 3.1.1 server, which accepts messages published by clients, e.g. IoT devices.
+//
+// Messages are handed to the server's handler rather than routed to subscribers: clients may publish, at any QoS,
+// but not subscribe. Sessions are not persisted, and retained messages and wills are ignored.
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Packet types.
+const (
+	connect     = 1
+	connack     = 2
+	publish     = 3
+	puback      = 4
+	pubrec      = 5
+	pubrel      = 6
+	pubcomp     = 7
+	subscribe   = 8
+	suback      = 9
+	unsubscribe = 10
+	unsuback    = 11
+	pingreq     = 12
+	pingresp    = 13
+	disconnect  = 14
+)
+
+// CONNACK return codes.
+const (
+	accepted           = 0
+	badProtocolVersion = 1
+	badCredentials     = 4
+)
+
+// connectTimeout is how long clients have to send CONNECT after connecting.
+const connectTimeout = 10 * time.Second
+
+var errProtocol = errors.New("mqtt: protocol error")
+
+// Server accepts connections from MQTT clients, and hands the messages they publish to Handle.
+type Server struct {
+	// Authenticate reports whether a client may connect with a username and password.
+	Authenticate func(username, password string) bool
+	// Handle handles a message published to a topic by a client connected with a username.
+	// QoS 1 and 2 messages are acknowledged once it returns.
+	Handle func(username, topic string, payload []byte)
+	// MaxSize is the maximum size of packets, in bytes; larger packets close the connection.
+	MaxSize int
+}
+
+// Serve accepts connections on a listener until it is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serve(c)
+	}
+}
+
+func (s *Server) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+
+	c.SetReadDeadline(time.Now().Add(connectTimeout))
+	t, _, body, err := s.read(r)
+	if err != nil || t != connect {
+		return
+	}
+	username, keepAlive, code := s.accept(body)
+	if _, err := c.Write([]byte{connack << 4, 2, 0, code}); err != nil || code != accepted {
+		return
+	}
+
+	pending := make(map[uint16]bool) // QoS 2 messages handled, but not yet released by the client
+	for {
+		if keepAlive > 0 {
+			c.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		} else {
+			c.SetReadDeadline(time.Time{})
+		}
+		t, flags, body, err := s.read(r)
+		if err != nil {
+			return
+		}
+		var reply []byte
+		switch t {
+		case publish:
+			qos := flags >> 1 & 3
+			d := decoder{b: body}
+			topic := d.string()
+			var id uint16
+			if qos > 0 {
+				id = d.uint16()
+			}
+			if d.err != nil || qos == 3 || strings.ContainsAny(topic, "+#") {
+				return
+			}
+			switch qos {
+			case 0:
+				s.Handle(username, topic, d.b)
+			case 1:
+				s.Handle(username, topic, d.b)
+				reply = ack(puback, id)
+			case 2:
+				if !pending[id] { // else redelivered
+					s.Handle(username, topic, d.b)
+					pending[id] = true
+				}
+				reply = ack(pubrec, id)
+			}
+		case pubrel:
+			d := decoder{b: body}
+			id := d.uint16()
+			delete(pending, id)
+			reply = ack(pubcomp, id)
+		case subscribe:
+			d := decoder{b: body}
+			id := d.uint16()
+			reply = []byte{suback << 4, 2, byte(id >> 8), byte(id)}
+			for len(d.b) > 0 && d.err == nil {
+				d.string()                  // filter
+				d.byte()                    // QoS
+				reply = append(reply, 0x80) // failure: clients can't subscribe
+			}
+			if d.err != nil || len(reply) > 127 {
+				return
+			}
+			reply[1] = byte(len(reply) - 2)
+		case unsubscribe:
+			d := decoder{b: body}
+			reply = ack(unsuback, d.uint16())
+		case pingreq:
+			reply = []byte{pingresp << 4, 0}
+		case disconnect:
+			return
+		default:
+			return
+		}
+		if reply != nil {
+			if _, err := c.Write(reply); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// accept reads a CONNECT packet, and returns the client's username, keep-alive interval and the CONNACK return code.
+func (s *Server) accept(body []byte) (string, time.Duration, byte) {
+	d := decoder{b: body}
+	d.string() // protocol name: MQTT, or MQIsdp for 3.1
+	level := d.byte()
+	flags := d.byte()
+	keepAlive := time.Duration(d.uint16()) * time.Second
+	d.string()           // client ID
+	if flags&0x04 != 0 { // will
+		d.string()
+		d.string()
+	}
+	var username, password string
+	if flags&0x80 != 0 {
+		username = d.string()
+	}
+	if flags&0x40 != 0 {
+		password = d.string()
+	}
+	if d.err != nil || (level != 3 && level != 4) {
+		return "", 0, badProtocolVersion
+	}
+	if s.Authenticate != nil && !s.Authenticate(username, password) {
+		return "", 0, badCredentials
+	}
+	return username, keepAlive, accepted
+}
+
+// read reads a packet, and returns its type, flags and body.
+func (s *Server) read(r *bufio.Reader) (byte, byte, []byte, error) {
+	h, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	// Remaining length: up to 4 bytes, 7 bits at a time, least significant first.
+	n, shift := 0, 0
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		if shift += 7; i == 3 {
+			return 0, 0, nil, errProtocol
+		}
+	}
+	if s.MaxSize > 0 && n > s.MaxSize {
+		return 0, 0, nil, errProtocol
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return h >> 4, h & 0x0f, body, nil
+}
+
+func ack(t byte, id uint16) []byte {
+	return []byte{t << 4, 2, byte(id >> 8), byte(id)}
+}
+
+// Match reports whether a topic matches a filter, in which + matches one level and a trailing # any number of levels,
+// e.g. "sensors/+/temperature" matches "sensors/kitchen/temperature", and "sensors/#" matches both.
+func Match(filter, topic string) bool {
+	_, ok := Wildcards(filter, topic)
+	return ok
+}
+
+// Wildcards returns the topic levels matched by a filter's + wildcards, in order, or false if the topic doesn't match.
+func Wildcards(filter, topic string) ([]string, bool) {
+	fs, ts := strings.Split(filter, "/"), strings.Split(topic, "/")
+	var matched []string
+	for i, f := range fs {
+		if f == "#" && i == len(fs)-1 {
+			return matched, true
+		}
+		if i >= len(ts) {
+			return nil, false
+		}
+		switch f {
+		case "+":
+			matched = append(matched, ts[i])
+		case ts[i]:
+		default:
+			return nil, false
+		}
+	}
+	return matched, len(fs) == len(ts)
+}
+
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil || n > len(d.b) {
+		d.err = errProtocol
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) byte() byte {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint16() uint16 {
+	if b := d.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) string() string {
+	return string(d.take(int(d.uint16())))
+}
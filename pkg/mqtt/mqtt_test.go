@@ -0,0 +1,138 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func str(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+func packet(t byte, body ...[]byte) []byte {
+	var b []byte
+	for _, part := range body {
+		b = append(b, part...)
+	}
+	return append([]byte{t, byte(len(b))}, b...)
+}
+
+func connectPacket(username, password string) []byte {
+	return packet(connect<<4, str("MQTT"), []byte{4, 0xc0, 0, 60}, str("device1"), str(username), str(password))
+}
+
+type message struct {
+	topic, payload string
+}
+
+func serve(t *testing.T) (string, func() []message) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var (
+		mu       sync.Mutex
+		messages []message
+	)
+	s := &Server{
+		Authenticate: func(username, password string) bool { return username == "id" && password == "secret" },
+		Handle: func(username, topic string, payload []byte) {
+			mu.Lock()
+			messages = append(messages, message{topic, string(payload)})
+			mu.Unlock()
+		},
+		MaxSize: 1024,
+	}
+	go s.Serve(l)
+	return l.Addr().String(), func() []message {
+		mu.Lock()
+		defer mu.Unlock()
+		return messages
+	}
+}
+
+func exchange(t *testing.T, c net.Conn, req []byte, n int) []byte {
+	c.SetDeadline(time.Now().Add(time.Second))
+	if _, err := c.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestServer(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	addr, messages := serve(t)
+
+	c, err := net.Dial("tcp", addr)
+	no(err)
+	defer c.Close()
+
+	eq([]byte{connack << 4, 2, 0, accepted}, exchange(t, c, connectPacket("id", "secret"), 4))
+
+	c.Write(packet(publish<<4, str("sensors/a"), []byte("1")))
+	eq([]byte{puback << 4, 2, 0, 7}, exchange(t, c, packet(publish<<4|2, str("sensors/b"), []byte{0, 7}, []byte("2")), 4))
+	eq([]byte{pubrec << 4, 2, 0, 8}, exchange(t, c, packet(publish<<4|4, str("sensors/c"), []byte{0, 8}, []byte("3")), 4))
+	// Redelivered before release, and so not handled again.
+	eq([]byte{pubrec << 4, 2, 0, 8}, exchange(t, c, packet(publish<<4|4|8, str("sensors/c"), []byte{0, 8}, []byte("3")), 4))
+	eq([]byte{pubcomp << 4, 2, 0, 8}, exchange(t, c, packet(pubrel<<4|2, []byte{0, 8}), 4))
+
+	eq([]byte{suback << 4, 4, 0, 9, 0x80, 0x80}, exchange(t, c, packet(subscribe<<4|2, []byte{0, 9}, str("a"), []byte{0}, str("b"), []byte{1}), 6))
+	eq([]byte{pingresp << 4, 0}, exchange(t, c, packet(pingreq<<4), 2))
+
+	eq([]message{{"sensors/a", "1"}, {"sensors/b", "2"}, {"sensors/c", "3"}}, messages())
+
+	bad, err := net.Dial("tcp", addr)
+	no(err)
+	defer bad.Close()
+	eq([]byte{connack << 4, 2, 0, badCredentials}, exchange(t, bad, connectPacket("id", "nope"), 4))
+}
+
+func TestWildcards(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	for _, tc := range []struct {
+		filter, topic string
+		matched       []string
+		ok            bool
+	}{
+		{"a/b", "a/b", nil, true},
+		{"a/b", "a/c", nil, false},
+		{"a/+/c", "a/x/c", []string{"x"}, true},
+		{"+/+", "a/b", []string{"a", "b"}, true},
+		{"a/+", "a/b/c", nil, false},
+		{"a/#", "a/b/c", nil, true},
+		{"a/#", "a", nil, true},
+		{"+/#", "a/b", []string{"a"}, true},
+		{"a/b/c", "a/b", nil, false},
+	} {
+		matched, ok := Wildcards(tc.filter, tc.topic)
+		eq(tc.ok, ok)
+		if ok {
+			eq(tc.matched, matched)
+		}
+		eq(tc.ok, Match(tc.filter, tc.topic))
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package msgpack converts JSON to MessagePack and back, for clients that would rather not parse JSON.
+// Only the types JSON has are supported: nil, booleans, numbers, strings, arrays and maps with string keys.
+package msgpack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// FromJSON appends the MessagePack encoding of a JSON document to dst.
+func FromJSON(dst, src []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(src))
+	d.UseNumber()
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return dst, err
+	}
+	return Append(dst, v)
+}
+
+// Append appends the MessagePack encoding of v, as decoded by encoding/json, to dst.
+func Append(dst []byte, v any) ([]byte, error) {
+	switch x := v.(type) {
+	case nil:
+		return append(dst, 0xc0), nil
+	case bool:
+		if x {
+			return append(dst, 0xc3), nil
+		}
+		return append(dst, 0xc2), nil
+	case json.Number:
+		if i, err := strconv.ParseInt(string(x), 10, 64); err == nil {
+			return appendInt(dst, i), nil
+		}
+		if u, err := strconv.ParseUint(string(x), 10, 64); err == nil {
+			return binary.BigEndian.AppendUint64(append(dst, 0xcf), u), nil
+		}
+		f, err := x.Float64()
+		if err != nil {
+			return dst, err
+		}
+		return appendFloat(dst, f), nil
+	case float64:
+		if x == math.Trunc(x) && math.Abs(x) < 1<<53 {
+			return appendInt(dst, int64(x)), nil
+		}
+		return appendFloat(dst, x), nil
+	case string:
+		return append(appendHeader(dst, len(x), 0xa0, 31, 0xd9, 0xda, 0xdb), x...), nil
+	case []any:
+		dst = appendHeader(dst, len(x), 0x90, 15, 0, 0xdc, 0xdd)
+		var err error
+		for _, e := range x {
+			if dst, err = Append(dst, e); err != nil {
+				return dst, err
+			}
+		}
+		return dst, nil
+	case map[string]any:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys) // so that equal maps encode the same way
+		dst = appendHeader(dst, len(x), 0x80, 15, 0, 0xde, 0xdf)
+		var err error
+		for _, k := range keys {
+			dst = append(appendHeader(dst, len(k), 0xa0, 31, 0xd9, 0xda, 0xdb), k...)
+			if dst, err = Append(dst, x[k]); err != nil {
+				return dst, err
+			}
+		}
+		return dst, nil
+	}
+	return dst, fmt.Errorf("msgpack: unsupported type %T", v)
+}
+
+func appendInt(dst []byte, i int64) []byte {
+	switch {
+	case i >= 0 && i <= 127:
+		return append(dst, byte(i))
+	case i < 0 && i >= -32:
+		return append(dst, byte(i))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		return append(dst, 0xd0, byte(i))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		return binary.BigEndian.AppendUint16(append(dst, 0xd1), uint16(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		return binary.BigEndian.AppendUint32(append(dst, 0xd2), uint32(i))
+	}
+	return binary.BigEndian.AppendUint64(append(dst, 0xd3), uint64(i))
+}
+
+func appendFloat(dst []byte, f float64) []byte {
+	return binary.BigEndian.AppendUint64(append(dst, 0xcb), math.Float64bits(f))
+}
+
+// appendHeader appends the type and length of a string, array or map: fixed if the length fits in its low bits,
+// else with an 8-bit (if available), 16-bit or 32-bit length.
+func appendHeader(dst []byte, n int, fixed byte, fixedMax int, t8, t16, t32 byte) []byte {
+	switch {
+	case n <= fixedMax:
+		return append(dst, fixed|byte(n))
+	case t8 != 0 && n <= math.MaxUint8:
+		return append(dst, t8, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, t16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(dst, t32), uint32(n))
+}
+
+var errShort = errors.New("msgpack: unexpected end of data")
+
+// Unmarshal decodes one MessagePack value, as encoding/json would decode the equivalent JSON, and returns the
+// bytes that follow it.
+func Unmarshal(b []byte) (any, []byte, error) {
+	if len(b) == 0 {
+		return nil, b, errShort
+	}
+	t, b := b[0], b[1:]
+	switch {
+	case t <= 0x7f:
+		return float64(t), b, nil
+	case t >= 0xe0:
+		return float64(int8(t)), b, nil
+	case t&0xf0 == 0x80:
+		return unmarshalMap(b, int(t&0x0f))
+	case t&0xf0 == 0x90:
+		return unmarshalArray(b, int(t&0x0f))
+	case t&0xe0 == 0xa0:
+		return unmarshalString(b, int(t&0x1f))
+	}
+	switch t {
+	case 0xc0:
+		return nil, b, nil
+	case 0xc2:
+		return false, b, nil
+	case 0xc3:
+		return true, b, nil
+	case 0xca:
+		u, b, err := uintN(b, 4)
+		return float64(math.Float32frombits(uint32(u))), b, err
+	case 0xcb:
+		u, b, err := uintN(b, 8)
+		return math.Float64frombits(u), b, err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, b, err := uintN(b, 1<<(t-0xcc))
+		return float64(u), b, err
+	case 0xd0:
+		u, b, err := uintN(b, 1)
+		return float64(int8(u)), b, err
+	case 0xd1:
+		u, b, err := uintN(b, 2)
+		return float64(int16(u)), b, err
+	case 0xd2:
+		u, b, err := uintN(b, 4)
+		return float64(int32(u)), b, err
+	case 0xd3:
+		u, b, err := uintN(b, 8)
+		return float64(int64(u)), b, err
+	case 0xd9, 0xda, 0xdb:
+		n, b, err := uintN(b, 1<<(t-0xd9))
+		if err != nil {
+			return nil, b, err
+		}
+		return unmarshalString(b, int(n))
+	case 0xdc, 0xdd:
+		n, b, err := uintN(b, 2<<(t-0xdc))
+		if err != nil {
+			return nil, b, err
+		}
+		return unmarshalArray(b, int(n))
+	case 0xde, 0xdf:
+		n, b, err := uintN(b, 2<<(t-0xde))
+		if err != nil {
+			return nil, b, err
+		}
+		return unmarshalMap(b, int(n))
+	}
+	return nil, b, fmt.Errorf("msgpack: unsupported type 0x%02x", t)
+}
+
+func uintN(b []byte, n int) (uint64, []byte, error) {
+	if len(b) < n {
+		return 0, b, errShort
+	}
+	var u uint64
+	for _, c := range b[:n] {
+		u = u<<8 | uint64(c)
+	}
+	return u, b[n:], nil
+}
+
+func unmarshalString(b []byte, n int) (any, []byte, error) {
+	if len(b) < n {
+		return nil, b, errShort
+	}
+	return string(b[:n]), b[n:], nil
+}
+
+func unmarshalArray(b []byte, n int) (any, []byte, error) {
+	if n > len(b) { // each element takes at least a byte
+		return nil, b, errShort
+	}
+	xs := make([]any, n)
+	var err error
+	for i := range xs {
+		if xs[i], b, err = Unmarshal(b); err != nil {
+			return nil, b, err
+		}
+	}
+	return xs, b, nil
+}
+
+func unmarshalMap(b []byte, n int) (any, []byte, error) {
+	if 2*n > len(b) { // each key and value takes at least a byte
+		return nil, b, errShort
+	}
+	m := make(map[string]any, n)
+	for i := 0; i < n; i++ {
+		k, rest, err := Unmarshal(b)
+		if err != nil {
+			return nil, rest, err
+		}
+		s, ok := k.(string)
+		if !ok {
+			return nil, rest, fmt.Errorf("msgpack: unsupported map key %v", k)
+		}
+		if m[s], b, err = Unmarshal(rest); err != nil {
+			return nil, b, err
+		}
+	}
+	return m, b, nil
+}
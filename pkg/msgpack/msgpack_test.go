@@ -0,0 +1,91 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package msgpack
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestFromJSON(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	for src, want := range map[string][]byte{
+		`null`:                 {0xc0},
+		`true`:                 {0xc3},
+		`5`:                    {0x05},
+		`-3`:                   {0xfd},
+		`200`:                  {0xd1, 0x00, 0xc8},
+		`-200`:                 {0xd1, 0xff, 0x38},
+		`1.5`:                  {0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0},
+		`"hi"`:                 {0xa2, 'h', 'i'},
+		`[1,"a"]`:              {0x92, 0x01, 0xa1, 'a'},
+		`{"b":[],"a":{}}`:      {0x82, 0xa1, 'a', 0x80, 0xa1, 'b', 0x90},
+		`18446744073709551615`: {0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	} {
+		got, err := FromJSON(nil, []byte(src))
+		no(err)
+		eq(want, got)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	docs := []string{
+		`{"d":[{"k":"c1 data","c":{"f":["a","b"],"d":[[1,-2.5],[null,true]],"n":2,"i":1}}]}`,
+		`{"p":{"c":{"c1":{"d":{"view":"markdown","content":"` + strings.Repeat("x", 70000) + `"}}}}}`,
+		`[` + strings.Repeat(`{"x":-40000,"y":3000000000},`, 20) + `false]`,
+	}
+	for _, doc := range docs {
+		b, err := FromJSON(nil, []byte(doc))
+		no(err)
+		got, rest, err := Unmarshal(b)
+		no(err)
+		eq(0, len(rest))
+		var want any
+		no(json.Unmarshal([]byte(doc), &want))
+		ok(reflect.DeepEqual(want, got), doc[:20])
+	}
+
+	// Values can be concatenated, and read back one at a time.
+	b, _ := FromJSON(nil, []byte(`{"a":1}`))
+	b, _ = FromJSON(b, []byte(`"z"`))
+	v, rest, err := Unmarshal(b)
+	no(err)
+	eq(map[string]any{"a": 1.0}, v)
+	v, rest, err = Unmarshal(rest)
+	no(err)
+	eq("z", v)
+	eq(0, len(rest))
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	_, ok, _ := assert.Assert(t)
+	for _, b := range [][]byte{
+		{},
+		{0xa3, 'a'},                    // short string
+		{0x92, 0x01},                   // short array
+		{0xdd, 0xff, 0xff, 0xff, 0xff}, // huge array
+		{0x81, 0x01, 0x01},             // non-string key
+		{0xc1},                         // never used
+	} {
+		_, _, err := Unmarshal(b)
+		ok(err != nil, fmt.Sprintf("% x", b))
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+// serve authenticates with a cleartext password and keeps a table of key-value pairs: statements starting with
+// "insert" set the pair bound, "select" returns every pair, sorted, and "fail" fails, rolling back the transaction.
+func serve(t *testing.T, password string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var mu sync.Mutex
+	table := make(map[string]string)
+	send := func(w io.Writer, typ byte, body []byte) {
+		b := append([]byte{typ, 0, 0, 0, 0}, body...)
+		binary.BigEndian.PutUint32(b[1:], uint32(len(body)+4))
+		w.Write(b)
+	}
+	read := func(r *bufio.Reader) (byte, []byte, error) {
+		var h [5]byte
+		if _, err := io.ReadFull(r, h[:]); err != nil {
+			return 0, nil, err
+		}
+		body := make([]byte, binary.BigEndian.Uint32(h[1:])-4)
+		_, err := io.ReadFull(r, body)
+		return h[0], body, err
+	}
+	cstr := func(b []byte) (string, []byte) {
+		s, rest, _ := strings.Cut(string(b), "\x00")
+		return s, []byte(rest)
+	}
+	handle := func(c net.Conn) {
+		defer c.Close()
+		r := bufio.NewReader(c)
+		var n [4]byte
+		io.ReadFull(r, n[:])
+		io.ReadFull(r, make([]byte, binary.BigEndian.Uint32(n[:])-4)) // startup
+		send(c, 'R', []byte{0, 0, 0, authCleartext})
+		if _, body, err := read(r); err != nil {
+			return
+		} else if p, _ := cstr(body); p != password {
+			send(c, 'E', []byte("SFATAL\x00C28P01\x00Mpassword authentication failed\x00\x00"))
+			return
+		}
+		send(c, 'R', []byte{0, 0, 0, authOK})
+		send(c, 'S', []byte("server_version\x0016\x00"))
+		send(c, 'Z', []byte{'I'})
+
+		var query string
+		var failed bool
+		pending := make(map[string]string)
+		for {
+			typ, body, err := read(r)
+			if err != nil {
+				return
+			}
+			if failed && typ != 'S' {
+				continue
+			}
+			switch typ {
+			case 'P':
+				_, body = cstr(body)
+				query, _ = cstr(body)
+				send(c, '1', nil)
+			case 'B':
+				_, body = cstr(body)
+				_, body = cstr(body)
+				nf := int(binary.BigEndian.Uint16(body))
+				body = body[2+2*nf:]
+				args := make([]string, binary.BigEndian.Uint16(body))
+				body = body[2:]
+				for i := range args {
+					size := binary.BigEndian.Uint32(body)
+					args[i], body = string(body[4:4+size]), body[4+size:]
+				}
+				send(c, '2', nil)
+				mu.Lock()
+				switch {
+				case strings.HasPrefix(query, "insert"):
+					pending[args[0]] = args[1]
+				case strings.HasPrefix(query, "select"):
+					var keys []string
+					for k := range table {
+						keys = append(keys, k)
+					}
+					sort.Strings(keys)
+					for _, k := range keys {
+						row := []byte{0, 2}
+						for _, v := range []string{k, table[k]} {
+							row = binary.BigEndian.AppendUint32(row, uint32(len(v)))
+							row = append(row, v...)
+						}
+						send(c, 'D', row)
+					}
+				case strings.HasPrefix(query, "fail"):
+					failed = true
+					send(c, 'E', []byte("SERROR\x00C42601\x00Msyntax error\x00\x00"))
+				}
+				mu.Unlock()
+			case 'E':
+				if !failed {
+					send(c, 'C', []byte("OK\x00"))
+				}
+			case 'S':
+				mu.Lock()
+				if !failed {
+					for k, v := range pending {
+						table[k] = v
+					}
+				}
+				mu.Unlock()
+				pending, failed = make(map[string]string), false
+				send(c, 'Z', []byte{'I'})
+			}
+		}
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handle(c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestClient(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	addr := serve(t, "secret")
+	c, err := New("postgres://wave:secret@"+addr+"/wave", time.Second)
+	no(err)
+
+	rows, err := c.Query("select k, v from kv")
+	no(err)
+	eq(0, len(rows))
+
+	no(c.Exec(Stmt{"insert into kv values ($1, $2)", []any{"b", []byte("2")}}, Stmt{"insert into kv values ($1, $2)", []any{"a", "1"}}))
+	rows, err = c.Query("select k, v from kv")
+	no(err)
+	eq([][][]byte{{[]byte("a"), []byte("1")}, {[]byte("b"), []byte("2")}}, rows)
+
+	// Statements run in a single transaction, and errors leave the connection usable.
+	err = c.Exec(Stmt{"insert into kv values ($1, $2)", []any{"c", "3"}}, Stmt{"fail", nil})
+	var pe *Error
+	ok(errors.As(err, &pe))
+	eq("42601", pe.Code)
+	rows, err = c.Query("select k, v from kv")
+	no(err)
+	eq(2, len(rows))
+
+	c, err = New("postgres://wave:nope@"+addr+"/wave", time.Second)
+	no(err)
+	_, err = c.Query("select k, v from kv")
+	ok(errors.As(err, &pe))
+	eq("28P01", pe.Code)
+
+	for _, u := range []string{"mysql://wave@localhost/wave", "postgres://localhost/wave", "postgres://wave@localhost/wave?sslmode=prefer"} {
+		_, err = New(u, time.Second)
+		ok(err != nil, u)
+	}
+}
+
+func TestSCRAM(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+
+	// From RFC 7677.
+	s := &scram{user: "user", password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+	eq("n,,n=user,r=rOprNGfwEbeRWgbNEkqO", s.first())
+	final, err := s.final("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	no(err)
+	eq("c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", final)
+	no(s.verify("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="))
+	eq(true, s.verify("v=AAAA") != nil)
+
+	_, err = s.final("r=somebodyelse,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	eq(true, err != nil)
+}
+
+func TestMD5Password(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	// "md5" + md5(md5(password + user) + salt), hex-encoded.
+	eq("md5e5e6ecd1994858cb49c7fb525fc85975", md5Password("wave", "secret", []byte{1, 2, 3, 4}))
+}
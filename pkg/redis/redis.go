@@ -0,0 +1,306 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package redis is a minimal Redis client, speaking the Redis protocol (RESP) directly.
+package redis
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client runs commands on a Redis server, over a small pool of connections.
+type Client struct {
+	addr     string
+	password string
+	db       int
+	tls      bool
+	timeout  time.Duration
+	conns    chan *conn // idle connections
+}
+
+const poolSize = 8
+
+// New creates a client for the Redis server at a URL of the form redis://[:password@]host[:port][/db]
+// (or rediss:// for TLS). Commands time out after timeout.
+func New(rawURL string, timeout time.Duration) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %v", err)
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("invalid Redis URL: want redis:// or rediss://, got %s://", u.Scheme)
+	}
+	c := &Client{
+		addr:    u.Host,
+		tls:     u.Scheme == "rediss",
+		timeout: timeout,
+		conns:   make(chan *conn, poolSize),
+	}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid Redis database %q", db)
+		}
+	}
+	return c, nil
+}
+
+// Do runs a command and returns its reply, if a simple or bulk string; integers are returned as strings.
+// Nil replies and arrays are returned as empty strings.
+func (c *Client) Do(args ...string) (string, error) {
+	v, err := c.run(args)
+	s, _ := v.(string)
+	return s, err
+}
+
+// Strings runs a command whose reply is an array of strings, e.g. SMEMBERS.
+func (c *Client) Strings(args ...string) ([]string, error) {
+	v, err := c.run(args)
+	if err != nil {
+		return nil, err
+	}
+	a, _ := v.([]any)
+	ss := make([]string, 0, len(a))
+	for _, e := range a {
+		if s, ok := e.(string); ok {
+			ss = append(ss, s)
+		}
+	}
+	return ss, nil
+}
+
+func (c *Client) run(args []string) (any, error) {
+	conn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	v, err := conn.do(args...)
+	if err != nil {
+		var re Error
+		if !errors.As(err, &re) { // connection is in an unknown state
+			conn.Close()
+			return nil, err
+		}
+	}
+	c.put(conn)
+	return v, err
+}
+
+func (c *Client) get() (*conn, error) {
+	select {
+	case conn := <-c.conns:
+		return conn, nil
+	default:
+	}
+	return c.dial()
+}
+
+func (c *Client) dial() (*conn, error) {
+	var (
+		nc  net.Conn
+		err error
+	)
+	d := &net.Dialer{Timeout: c.timeout}
+	if c.tls {
+		nc, err = tls.DialWithDialer(d, "tcp", c.addr, &tls.Config{})
+	} else {
+		nc, err = d.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn := &conn{nc, bufio.NewReader(nc)}
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	if c.password != "" {
+		if _, err := conn.do("AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.do("SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *Client) put(conn *conn) {
+	select {
+	case c.conns <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// Publish posts a message to a channel, and returns the number of subscribers that received it.
+func (c *Client) Publish(channel, message string) (int, error) {
+	v, err := c.Do("PUBLISH", channel, message)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := strconv.Atoi(v)
+	return n, nil
+}
+
+// Subscription receives messages posted to channels, over a connection of its own.
+type Subscription struct {
+	conn *conn
+}
+
+// Subscribe subscribes to channels. The subscription must be closed when no longer needed.
+func (c *Client) Subscribe(channels ...string) (*Subscription, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	if err := conn.write(append([]string{"SUBSCRIBE"}, channels...)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The server confirms each channel in turn.
+	for range channels {
+		if _, err := conn.read(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	conn.SetDeadline(time.Time{}) // messages can be far apart
+	return &Subscription{conn}, nil
+}
+
+// Receive waits for the next message, and returns the channel it was posted to and the message.
+func (s *Subscription) Receive() (string, string, error) {
+	for {
+		v, err := s.conn.read()
+		if err != nil {
+			return "", "", err
+		}
+		// Messages are pushed as ["message", channel, message]; skip anything else, e.g. confirmations.
+		if a, ok := v.([]any); ok && len(a) == 3 && a[0] == "message" {
+			channel, _ := a[1].(string)
+			message, _ := a[2].(string)
+			return channel, message, nil
+		}
+	}
+}
+
+// Close unsubscribes, and closes the subscription's connection; Receive returns an error from then on.
+func (s *Subscription) Close() error {
+	return s.conn.Close()
+}
+
+// Error is an error reply from the server.
+type Error string
+
+func (e Error) Error() string { return "redis: " + string(e) }
+
+var errProtocol = errors.New("redis: protocol error")
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *conn) do(args ...string) (any, error) {
+	if err := c.write(args); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+func (c *conn) write(args []string) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(a), a)
+	}
+	_, err := io.WriteString(c.Conn, sb.String())
+	return err
+}
+
+func (c *conn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(line, "\r\n") || len(line) < 3 {
+		return "", errProtocol
+	}
+	return line[:len(line)-2], nil
+}
+
+// read reads a reply: a string, nil, or an array of replies. Integers are returned as strings.
+func (c *conn) read() (any, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errProtocol
+		}
+		if n < 0 { // nil
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errProtocol
+		}
+		if n < 0 { // nil
+			return nil, nil
+		}
+		a := make([]any, n)
+		for i := range a {
+			// Keep reading after error replies within the array, so that the connection stays in sync.
+			if a[i], err = c.read(); err != nil {
+				var re Error
+				if !errors.As(err, &re) {
+					return nil, err
+				}
+			}
+		}
+		return a, nil
+	}
+	return nil, errProtocol
+}
@@ -0,0 +1,168 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+// serve answers GET, SET, SADD, SMEMBERS, PUBLISH and SUBSCRIBE from memory, and errors on anything else.
+func serve(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var mu sync.Mutex
+	data, sets := make(map[string]string), make(map[string]map[string]bool)
+	subs := make(map[string][]net.Conn)
+	bulk := func(s string) string { return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n" }
+	handle := func(c net.Conn) {
+		defer c.Close()
+		r := bufio.NewReader(c)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			args := make([]string, n)
+			for i := range args {
+				r.ReadString('\n') // $len
+				arg, _ := r.ReadString('\n')
+				args[i] = strings.TrimSuffix(arg, "\r\n")
+			}
+			mu.Lock()
+			switch args[0] {
+			case "SET":
+				data[args[1]] = args[2]
+				c.Write([]byte("+OK\r\n"))
+			case "GET":
+				if v, ok := data[args[1]]; ok {
+					c.Write([]byte(bulk(v)))
+				} else {
+					c.Write([]byte("$-1\r\n"))
+				}
+			case "SADD":
+				if sets[args[1]] == nil {
+					sets[args[1]] = make(map[string]bool)
+				}
+				sets[args[1]][args[2]] = true
+				c.Write([]byte(":1\r\n"))
+			case "SMEMBERS":
+				reply := "*" + strconv.Itoa(len(sets[args[1]])) + "\r\n"
+				for m := range sets[args[1]] {
+					reply += bulk(m)
+				}
+				c.Write([]byte(reply))
+			case "PUBLISH":
+				for _, sub := range subs[args[1]] {
+					sub.Write([]byte("*3\r\n" + bulk("message") + bulk(args[1]) + bulk(args[2])))
+				}
+				c.Write([]byte(":" + strconv.Itoa(len(subs[args[1]])) + "\r\n"))
+			case "SUBSCRIBE":
+				for i, channel := range args[1:] {
+					subs[channel] = append(subs[channel], c)
+					c.Write([]byte("*3\r\n" + bulk("subscribe") + bulk(channel) + ":" + strconv.Itoa(i+1) + "\r\n"))
+				}
+			default:
+				c.Write([]byte("-ERR unknown command\r\n"))
+			}
+			mu.Unlock()
+		}
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handle(c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestClient(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	c, err := New("redis://"+serve(t), time.Second)
+	no(err)
+
+	v, err := c.Do("GET", "k")
+	no(err)
+	eq("", v)
+	_, err = c.Do("SET", "k", "v")
+	no(err)
+	v, err = c.Do("GET", "k")
+	no(err)
+	eq("v", v)
+
+	v, err = c.Do("SADD", "s", "a")
+	no(err)
+	eq("1", v)
+	c.Do("SADD", "s", "b")
+	members, err := c.Strings("SMEMBERS", "s")
+	no(err)
+	sort.Strings(members)
+	eq([]string{"a", "b"}, members)
+
+	// Error replies leave the connection usable.
+	_, err = c.Do("NOPE")
+	var re Error
+	ok(errors.As(err, &re))
+	v, err = c.Do("GET", "k")
+	no(err)
+	eq("v", v)
+
+	_, err = New("http://localhost", time.Second)
+	ok(err != nil)
+}
+
+func TestPubSub(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	c, err := New("redis://"+serve(t), time.Second)
+	no(err)
+
+	sub, err := c.Subscribe("a", "b")
+	no(err)
+	defer sub.Close()
+
+	n, err := c.Publish("b", "hello")
+	no(err)
+	eq(1, n)
+	n, err = c.Publish("c", "nobody")
+	no(err)
+	eq(0, n)
+	c.Publish("a", "world")
+
+	channel, message, err := sub.Receive()
+	no(err)
+	eq("b", channel)
+	eq("hello", message)
+	channel, message, err = sub.Receive()
+	no(err)
+	eq("a", channel)
+	eq("world", message)
+}
@@ -0,0 +1,371 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package saml implements a SAML 2.0 service provider (SP), for single sign-on with identity providers (IdPs)
+// that do not speak OpenID Connect. Authentication requests are sent with the HTTP-Redirect binding, and
+// responses are received with the HTTP-POST binding. Encrypted assertions are not supported.
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	protocolNS      = "urn:oasis:names:tc:SAML:2.0:protocol"
+	assertionNS     = "urn:oasis:names:tc:SAML:2.0:assertion"
+	metadataNS      = "urn:oasis:names:tc:SAML:2.0:metadata"
+	redirectBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	postBinding     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	statusSuccess   = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	bearer          = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+)
+
+// clockSkew is the difference tolerated between the clocks of the identity provider and this server.
+const clockSkew = 2 * time.Minute
+
+// IdentityProvider is a SAML identity provider, as described by its metadata.
+type IdentityProvider struct {
+	EntityID     string
+	SSOURL       string              // accepts authentication requests with the HTTP-Redirect binding
+	Certificates []*x509.Certificate // sign responses or assertions
+}
+
+// ParseMetadata reads an identity provider's metadata: an EntityDescriptor, or an EntitiesDescriptor
+// whose first identity provider is used.
+func ParseMetadata(b []byte) (*IdentityProvider, error) {
+	root, err := parseXML(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %v", err)
+	}
+	entities := []*element{root}
+	if root.is(metadataNS, "EntitiesDescriptor") {
+		entities = root.all(metadataNS, "EntityDescriptor")
+	} else if !root.is(metadataNS, "EntityDescriptor") {
+		return nil, errors.New("invalid metadata: want EntityDescriptor or EntitiesDescriptor")
+	}
+	for _, entity := range entities {
+		sso := entity.child(metadataNS, "IDPSSODescriptor")
+		if sso == nil {
+			continue
+		}
+		idp := &IdentityProvider{EntityID: entity.attr("entityID")}
+		for _, s := range sso.all(metadataNS, "SingleSignOnService") {
+			if s.attr("Binding") == redirectBinding {
+				idp.SSOURL = s.attr("Location")
+				break
+			}
+		}
+		if idp.SSOURL == "" {
+			return nil, errors.New("invalid metadata: identity provider has no HTTP-Redirect SingleSignOnService")
+		}
+		for _, kd := range sso.all(metadataNS, "KeyDescriptor") {
+			if use := kd.attr("use"); use != "" && use != "signing" {
+				continue
+			}
+			ki := kd.child(dsigNS, "KeyInfo")
+			if ki == nil {
+				continue
+			}
+			for _, x := range ki.all(dsigNS, "X509Data") {
+				for _, c := range x.all(dsigNS, "X509Certificate") {
+					der, err := decodeBase64(c.text())
+					if err != nil {
+						return nil, errors.New("invalid metadata: bad X509Certificate")
+					}
+					cert, err := x509.ParseCertificate(der)
+					if err != nil {
+						return nil, fmt.Errorf("invalid metadata: %v", err)
+					}
+					idp.Certificates = append(idp.Certificates, cert)
+				}
+			}
+		}
+		if len(idp.Certificates) == 0 {
+			return nil, errors.New("invalid metadata: identity provider has no signing certificate")
+		}
+		return idp, nil
+	}
+	return nil, errors.New("invalid metadata: no identity provider found")
+}
+
+// ServiceProvider is this server, as known to an identity provider.
+type ServiceProvider struct {
+	EntityID string // identifies the service provider; conventionally the URL of its metadata
+	ACSURL   string // the assertion consumer service, where the identity provider posts responses
+	IdP      *IdentityProvider
+}
+
+// Metadata returns the service provider's metadata, for registration with the identity provider.
+func (sp *ServiceProvider) Metadata() []byte {
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	b.WriteString(`<md:EntityDescriptor xmlns:md="` + metadataNS + `" entityID="` + escape(sp.EntityID) + `">`)
+	b.WriteString(`<md:SPSSODescriptor AuthnRequestsSigned="false" WantAssertionsSigned="true" protocolSupportEnumeration="` + protocolNS + `">`)
+	b.WriteString(`<md:NameIDFormat>urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified</md:NameIDFormat>`)
+	b.WriteString(`<md:AssertionConsumerService Binding="` + postBinding + `" Location="` + escape(sp.ACSURL) + `" index="0" isDefault="true"/>`)
+	b.WriteString(`</md:SPSSODescriptor></md:EntityDescriptor>`)
+	return b.Bytes()
+}
+
+// AuthnOptions are optional requirements on how users authenticate.
+type AuthnOptions struct {
+	ForceAuthn    bool     // authenticate again, even if the user has a session with the identity provider
+	AuthnContexts []string // acceptable authentication context classes, e.g. for multi-factor authentication
+}
+
+// AuthnRequestURL returns the URL that sends the user to the identity provider to authenticate, and the ID
+// of the request, which the response must be in response to. The identity provider returns relayState as is.
+func (sp *ServiceProvider) AuthnRequestURL(relayState string, opts AuthnOptions) (string, string, error) {
+	id, err := newID()
+	if err != nil {
+		return "", "", err
+	}
+	var sb strings.Builder
+	sb.WriteString(`<samlp:AuthnRequest xmlns:samlp="` + protocolNS + `" xmlns:saml="` + assertionNS + `"` +
+		` ID="` + id + `" Version="2.0" IssueInstant="` + time.Now().UTC().Format(time.RFC3339) + `"` +
+		` Destination="` + escape(sp.IdP.SSOURL) + `" AssertionConsumerServiceURL="` + escape(sp.ACSURL) + `"` +
+		` ProtocolBinding="` + postBinding + `"`)
+	if opts.ForceAuthn {
+		sb.WriteString(` ForceAuthn="true"`)
+	}
+	sb.WriteString(`><saml:Issuer>` + escape(sp.EntityID) + `</saml:Issuer>` +
+		`<samlp:NameIDPolicy AllowCreate="true"/>`)
+	if len(opts.AuthnContexts) > 0 {
+		sb.WriteString(`<samlp:RequestedAuthnContext Comparison="exact">`)
+		for _, c := range opts.AuthnContexts {
+			sb.WriteString(`<saml:AuthnContextClassRef>` + escape(c) + `</saml:AuthnContextClassRef>`)
+		}
+		sb.WriteString(`</samlp:RequestedAuthnContext>`)
+	}
+	sb.WriteString(`</samlp:AuthnRequest>`)
+	req := sb.String()
+
+	// HTTP-Redirect binding: deflated, then base64-encoded.
+	var b bytes.Buffer
+	w, _ := flate.NewWriter(&b, flate.DefaultCompression)
+	w.Write([]byte(req))
+	w.Close()
+
+	u, err := url.Parse(sp.IdP.SSOURL)
+	if err != nil {
+		return "", "", err
+	}
+	q := u.Query()
+	q.Set("SAMLRequest", base64.StdEncoding.EncodeToString(b.Bytes()))
+	if relayState != "" {
+		q.Set("RelayState", relayState)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), id, nil
+}
+
+// Assertion is what the identity provider asserts about an authenticated user.
+type Assertion struct {
+	Subject      string              // the NameID
+	SessionIndex string              // the identity provider's session, if any
+	AuthnInstant time.Time           // when the user authenticated
+	AuthnContext string              // how the user authenticated, as an authentication context class, if known
+	Attributes   map[string][]string // by Name, and by FriendlyName if any
+}
+
+// ParseResponse validates a base64-encoded SAMLResponse posted to the assertion consumer service, in response
+// to the request with the given ID, and returns its assertion.
+// Either the response or the assertion must be signed by the identity provider.
+func (sp *ServiceProvider) ParseResponse(encoded, requestID string) (*Assertion, error) {
+	b, err := decodeBase64(encoded)
+	if err != nil {
+		return nil, errors.New("invalid SAMLResponse encoding")
+	}
+	resp, err := parseXML(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SAMLResponse: %v", err)
+	}
+	if !resp.is(protocolNS, "Response") {
+		return nil, errors.New("not a SAML response")
+	}
+	if d := resp.attr("Destination"); d != "" && d != sp.ACSURL {
+		return nil, fmt.Errorf("response destined for %s", d)
+	}
+	if requestID == "" || resp.attr("InResponseTo") != requestID {
+		return nil, errors.New("response not in response to request")
+	}
+	var code *element
+	if status := resp.child(protocolNS, "Status"); status != nil {
+		code = status.child(protocolNS, "StatusCode")
+	}
+	if code == nil {
+		return nil, errors.New("missing status")
+	}
+	if v := code.attr("Value"); v != statusSuccess {
+		return nil, fmt.Errorf("authentication failed: %s", v)
+	}
+	if resp.child(assertionNS, "EncryptedAssertion") != nil {
+		return nil, errors.New("encrypted assertions are not supported")
+	}
+	assertions := resp.all(assertionNS, "Assertion")
+	if len(assertions) != 1 {
+		return nil, errors.New("want exactly one assertion")
+	}
+	a := assertions[0]
+
+	// Only the response and assertion as parsed here are trusted, so that signed content cannot be moved.
+	signed := false
+	for _, e := range []*element{resp, a} {
+		if err := verify(e, sp.IdP.Certificates); err == nil {
+			signed = true
+		} else if err != errUnsigned {
+			return nil, fmt.Errorf("invalid signature on %s: %v", e.local, err)
+		}
+	}
+	if !signed {
+		return nil, errors.New("neither response nor assertion is signed")
+	}
+
+	if issuer := a.child(assertionNS, "Issuer"); sp.IdP.EntityID != "" && (issuer == nil || issuer.text() != sp.IdP.EntityID) {
+		return nil, errors.New("assertion issued by another identity provider")
+	}
+
+	now := time.Now()
+	conditions := a.child(assertionNS, "Conditions")
+	if conditions == nil {
+		return nil, errors.New("missing conditions")
+	}
+	if err := checkValidity(conditions, now); err != nil {
+		return nil, err
+	}
+	restrictions := conditions.all(assertionNS, "AudienceRestriction")
+	if len(restrictions) == 0 {
+		return nil, errors.New("missing audience restriction")
+	}
+	for _, r := range restrictions {
+		ok := false
+		for _, audience := range r.all(assertionNS, "Audience") {
+			ok = ok || audience.text() == sp.EntityID
+		}
+		if !ok {
+			return nil, errors.New("assertion intended for another audience")
+		}
+	}
+
+	subject := a.child(assertionNS, "Subject")
+	if subject == nil || subject.child(assertionNS, "NameID") == nil {
+		return nil, errors.New("missing subject")
+	}
+	confirmed := false
+	for _, c := range subject.all(assertionNS, "SubjectConfirmation") {
+		data := c.child(assertionNS, "SubjectConfirmationData")
+		if c.attr("Method") != bearer || data == nil {
+			continue
+		}
+		if data.attr("Recipient") != sp.ACSURL || data.attr("NotOnOrAfter") == "" || checkValidity(data, now) != nil {
+			continue
+		}
+		if irt := data.attr("InResponseTo"); irt != "" && irt != requestID {
+			continue
+		}
+		confirmed = true
+	}
+	if !confirmed {
+		return nil, errors.New("subject not confirmed")
+	}
+
+	assertion := &Assertion{
+		Subject:    subject.child(assertionNS, "NameID").text(),
+		Attributes: make(map[string][]string),
+	}
+	if assertion.Subject == "" {
+		return nil, errors.New("missing subject")
+	}
+	if s := a.child(assertionNS, "AuthnStatement"); s != nil {
+		assertion.SessionIndex = s.attr("SessionIndex")
+		assertion.AuthnInstant, _ = time.Parse(time.RFC3339Nano, s.attr("AuthnInstant"))
+		if ac := s.child(assertionNS, "AuthnContext"); ac != nil {
+			if ref := ac.child(assertionNS, "AuthnContextClassRef"); ref != nil {
+				assertion.AuthnContext = ref.text()
+			}
+		}
+		if t := s.attr("SessionNotOnOrAfter"); t != "" {
+			if expiry, err := time.Parse(time.RFC3339Nano, t); err != nil || !now.Before(expiry.Add(clockSkew)) {
+				return nil, errors.New("identity provider session expired")
+			}
+		}
+	}
+	for _, s := range a.all(assertionNS, "AttributeStatement") {
+		for _, attr := range s.all(assertionNS, "Attribute") {
+			var values []string
+			for _, v := range attr.all(assertionNS, "AttributeValue") {
+				values = append(values, v.text())
+			}
+			for _, name := range []string{attr.attr("Name"), attr.attr("FriendlyName")} {
+				if name != "" {
+					assertion.Attributes[name] = append(assertion.Attributes[name], values...)
+				}
+			}
+		}
+	}
+	return assertion, nil
+}
+
+// checkValidity checks an element's NotBefore and NotOnOrAfter attributes, if any.
+func checkValidity(e *element, now time.Time) error {
+	if v := e.attr("NotBefore"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return fmt.Errorf("invalid NotBefore on %s", e.local)
+		}
+		if now.Add(clockSkew).Before(t) {
+			return fmt.Errorf("%s not yet valid", e.local)
+		}
+	}
+	if v := e.attr("NotOnOrAfter"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return fmt.Errorf("invalid NotOnOrAfter on %s", e.local)
+		}
+		if !now.Before(t.Add(clockSkew)) {
+			return fmt.Errorf("%s expired", e.local)
+		}
+	}
+	return nil
+}
+
+// newID returns a random message ID; IDs must not start with a digit.
+func newID() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "_" + hex.EncodeToString(b), nil
+}
+
+func decodeBase64(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
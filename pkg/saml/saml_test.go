@@ -0,0 +1,227 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io"
+	"math/big"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+const (
+	idpEntityID = "https://idp.example.com"
+	spEntityID  = "https://wave.example.com/_auth/saml/metadata"
+	acsURL      = "https://wave.example.com/_auth/saml/acs"
+)
+
+func TestCanonicalize(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	root, err := parseXML([]byte(`<a:r xmlns:a="urn:a" xmlns:b="urn:b" xmlns="urn:d"><a:c z="1" b:y="2" a:x="3"/><e xmlns="">t&amp;&lt;&gt;</e></a:r>`))
+	no(err)
+	c14n := func(e *element, inclusive ...string) string {
+		var b bytes.Buffer
+		canonicalize(&b, e, nil, inclusive)
+		return b.String()
+	}
+	eq(`<a:c xmlns:a="urn:a" xmlns:b="urn:b" z="1" a:x="3" b:y="2"></a:c>`, c14n(root.children[0].(*element)))
+	eq(`<a:r xmlns:a="urn:a"><a:c xmlns:b="urn:b" z="1" a:x="3" b:y="2"></a:c><e>t&amp;&lt;&gt;</e></a:r>`, c14n(root))
+	eq(`<a:r xmlns="urn:d" xmlns:a="urn:a"><a:c xmlns:b="urn:b" z="1" a:x="3" b:y="2"></a:c><e xmlns="">t&amp;&lt;&gt;</e></a:r>`, c14n(root, "#default"))
+}
+
+type testIdP struct {
+	key  *rsa.PrivateKey
+	cert *x509.Certificate
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idp"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testIdP{key, cert}
+}
+
+func (idp *testIdP) metadata() []byte {
+	return []byte(`<md:EntityDescriptor xmlns:md="` + metadataNS + `" entityID="` + idpEntityID + `"><md:IDPSSODescriptor>` +
+		`<md:KeyDescriptor use="signing"><ds:KeyInfo xmlns:ds="` + dsigNS + `"><ds:X509Data><ds:X509Certificate>` +
+		base64.StdEncoding.EncodeToString(idp.cert.Raw) +
+		`</ds:X509Certificate></ds:X509Data></ds:KeyInfo></md:KeyDescriptor>` +
+		`<md:SingleSignOnService Binding="` + postBinding + `" Location="https://idp.example.com/post"/>` +
+		`<md:SingleSignOnService Binding="` + redirectBinding + `" Location="https://idp.example.com/sso?tenant=1"/>` +
+		`</md:IDPSSODescriptor></md:EntityDescriptor>`)
+}
+
+// sign inserts an enveloped signature into the element with the given ID in doc, after the element's Issuer.
+func (idp *testIdP) sign(t *testing.T, doc, id string) string {
+	root, err := parseXML([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := root
+	if e.attr("ID") != id {
+		e = root.child(assertionNS, "Assertion")
+	}
+	var b bytes.Buffer
+	canonicalize(&b, e, nil, nil)
+	digest := sha256.Sum256(b.Bytes())
+
+	signedInfo := `<ds:SignedInfo xmlns:ds="` + dsigNS + `">` +
+		`<ds:CanonicalizationMethod Algorithm="` + excC14N + `"/>` +
+		`<ds:SignatureMethod Algorithm="` + sigRSASHA256 + `"/>` +
+		`<ds:Reference URI="#` + id + `"><ds:Transforms>` +
+		`<ds:Transform Algorithm="` + envelopedSig + `"/><ds:Transform Algorithm="` + excC14N + `"/>` +
+		`</ds:Transforms><ds:DigestMethod Algorithm="` + digestSHA256 + `"/>` +
+		`<ds:DigestValue>` + base64.StdEncoding.EncodeToString(digest[:]) + `</ds:DigestValue>` +
+		`</ds:Reference></ds:SignedInfo>`
+	si, err := parseXML([]byte(signedInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Reset()
+	canonicalize(&b, si, nil, nil)
+	hashed := sha256.Sum256(b.Bytes())
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := `<ds:Signature xmlns:ds="` + dsigNS + `">` + signedInfo +
+		`<ds:SignatureValue>` + base64.StdEncoding.EncodeToString(sig) + `</ds:SignatureValue></ds:Signature>`
+
+	anchor := `ID="` + id + `"`
+	i := strings.Index(doc, anchor)
+	j := i + strings.Index(doc[i:], "</saml:Issuer>") + len("</saml:Issuer>")
+	return doc[:j] + signature + doc[j:]
+}
+
+func response(requestID, audience string, attrs string) string {
+	now := time.Now().UTC()
+	ts := func(d time.Duration) string { return now.Add(d).Format(time.RFC3339) }
+	return `<samlp:Response xmlns:samlp="` + protocolNS + `" xmlns:saml="` + assertionNS + `" ID="_r1" Version="2.0"` +
+		` IssueInstant="` + ts(0) + `" Destination="` + acsURL + `" InResponseTo="` + requestID + `">` +
+		`<saml:Issuer>` + idpEntityID + `</saml:Issuer>` +
+		`<samlp:Status><samlp:StatusCode Value="` + statusSuccess + `"/></samlp:Status>` +
+		`<saml:Assertion ID="_a1" Version="2.0" IssueInstant="` + ts(0) + `">` +
+		`<saml:Issuer>` + idpEntityID + `</saml:Issuer>` +
+		`<saml:Subject><saml:NameID>jdoe@example.com</saml:NameID>` +
+		`<saml:SubjectConfirmation Method="` + bearer + `"><saml:SubjectConfirmationData InResponseTo="` + requestID + `"` +
+		` NotOnOrAfter="` + ts(5*time.Minute) + `" Recipient="` + acsURL + `"/></saml:SubjectConfirmation></saml:Subject>` +
+		`<saml:Conditions NotBefore="` + ts(-time.Minute) + `" NotOnOrAfter="` + ts(5*time.Minute) + `">` +
+		`<saml:AudienceRestriction><saml:Audience>` + audience + `</saml:Audience></saml:AudienceRestriction></saml:Conditions>` +
+		`<saml:AuthnStatement AuthnInstant="` + ts(-time.Minute) + `" SessionIndex="s1">` +
+		`<saml:AuthnContext><saml:AuthnContextClassRef>urn:mfa</saml:AuthnContextClassRef></saml:AuthnContext></saml:AuthnStatement>` +
+		`<saml:AttributeStatement>` + attrs + `</saml:AttributeStatement>` +
+		`</saml:Assertion></samlp:Response>`
+}
+
+const attrs = `<saml:Attribute Name="urn:oid:0.9.2342.19200300.100.1.1" FriendlyName="uid"><saml:AttributeValue>jdoe</saml:AttributeValue></saml:Attribute>` +
+	`<saml:Attribute Name="groups"><saml:AttributeValue>eng</saml:AttributeValue><saml:AttributeValue>ops</saml:AttributeValue></saml:Attribute>`
+
+func TestServiceProvider(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	idp := newTestIdP(t)
+	md, err := ParseMetadata(idp.metadata())
+	no(err)
+	eq(idpEntityID, md.EntityID)
+	eq("https://idp.example.com/sso?tenant=1", md.SSOURL)
+	eq(1, len(md.Certificates))
+
+	sp := &ServiceProvider{EntityID: spEntityID, ACSURL: acsURL, IdP: md}
+	ok(bytes.Contains(sp.Metadata(), []byte(`Location="`+acsURL+`"`)))
+
+	u, id, err := sp.AuthnRequestURL("state", AuthnOptions{ForceAuthn: true, AuthnContexts: []string{"urn:mfa"}})
+	no(err)
+	parsed, err := url.Parse(u)
+	no(err)
+	eq("1", parsed.Query().Get("tenant"))
+	eq("state", parsed.Query().Get("RelayState"))
+	deflated, err := base64.StdEncoding.DecodeString(parsed.Query().Get("SAMLRequest"))
+	no(err)
+	req, err := io.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+	no(err)
+	ok(strings.Contains(string(req), `ID="`+id+`"`))
+	ok(strings.Contains(string(req), `ForceAuthn="true"`))
+	ok(strings.Contains(string(req), `<saml:AuthnContextClassRef>urn:mfa</saml:AuthnContextClassRef>`))
+
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	// Signed assertion.
+	a, err := sp.ParseResponse(encode(idp.sign(t, response(id, spEntityID, attrs), "_a1")), id)
+	no(err)
+	eq("jdoe@example.com", a.Subject)
+	eq("s1", a.SessionIndex)
+	eq("urn:mfa", a.AuthnContext)
+	ok(time.Since(a.AuthnInstant) > 50*time.Second)
+	eq([]string{"jdoe"}, a.Attributes["uid"])
+	eq([]string{"jdoe"}, a.Attributes["urn:oid:0.9.2342.19200300.100.1.1"])
+	eq([]string{"eng", "ops"}, a.Attributes["groups"])
+
+	// Signed response.
+	_, err = sp.ParseResponse(encode(idp.sign(t, response(id, spEntityID, attrs), "_r1")), id)
+	no(err)
+
+	// Unsigned.
+	_, err = sp.ParseResponse(encode(response(id, spEntityID, attrs)), id)
+	ok(err != nil)
+
+	// Tampered after signing.
+	signed := idp.sign(t, response(id, spEntityID, attrs), "_a1")
+	_, err = sp.ParseResponse(encode(strings.Replace(signed, "<saml:AttributeValue>ops", "<saml:AttributeValue>admin", 1)), id)
+	ok(err != nil)
+
+	// Signed by someone else.
+	_, err = sp.ParseResponse(encode(newTestIdP(t).sign(t, response(id, spEntityID, attrs), "_a1")), id)
+	ok(err != nil)
+
+	// Another request.
+	_, err = sp.ParseResponse(encode(idp.sign(t, response("_other", spEntityID, attrs), "_a1")), id)
+	ok(err != nil)
+
+	// Another audience.
+	_, err = sp.ParseResponse(encode(idp.sign(t, response(id, "https://other.example.com", attrs), "_a1")), id)
+	ok(err != nil)
+
+	// A second, unsigned assertion smuggled in alongside the signed one.
+	smuggled := strings.Replace(signed, "</samlp:Response>", `<saml:Assertion ID="_a2"><saml:Issuer>`+idpEntityID+`</saml:Issuer></saml:Assertion></samlp:Response>`, 1)
+	_, err = sp.ParseResponse(encode(smuggled), id)
+	ok(err != nil)
+}
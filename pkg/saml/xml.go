@@ -0,0 +1,292 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const xmlNS = "http://www.w3.org/XML/1998/namespace"
+
+// element is an XML element that keeps namespace prefixes and declarations as written, which signature
+// verification needs, and encoding/xml's unmarshaling discards.
+type element struct {
+	parent   *element
+	prefix   string
+	local    string
+	ns       map[string]string // namespaces declared here, by prefix; "" is the default namespace
+	attrs    []xml.Attr        // excluding namespace declarations; Name.Space is the prefix
+	children []any             // *element or string
+}
+
+// parseXML parses a document, returning its root element.
+func parseXML(b []byte) (*element, error) {
+	d := xml.NewDecoder(bytes.NewReader(b))
+	var root, current *element
+	for {
+		t, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			if root != nil && current == nil {
+				return nil, errors.New("more than one root element")
+			}
+			e := &element{parent: current, prefix: t.Name.Space, local: t.Name.Local, ns: make(map[string]string)}
+			for _, a := range t.Attr {
+				switch {
+				case a.Name.Space == "xmlns":
+					e.ns[a.Name.Local] = a.Value
+				case a.Name.Space == "" && a.Name.Local == "xmlns":
+					e.ns[""] = a.Value
+				default:
+					e.attrs = append(e.attrs, a)
+				}
+			}
+			if current == nil {
+				root = e
+			} else {
+				current.children = append(current.children, e)
+			}
+			current = e
+		case xml.EndElement:
+			if current == nil || t.Name.Space != current.prefix || t.Name.Local != current.local {
+				return nil, fmt.Errorf("unexpected end element %s", t.Name.Local)
+			}
+			current = current.parent
+		case xml.CharData:
+			if current != nil {
+				current.children = append(current.children, string(t))
+			}
+		case xml.Directive:
+			return nil, errors.New("unexpected directive") // no DTDs, and so no entity expansion
+		}
+	}
+	if root == nil || current != nil {
+		return nil, errors.New("incomplete document")
+	}
+	return root, nil
+}
+
+// lookup returns the namespace bound to a prefix where the element is.
+func (e *element) lookup(prefix string) (string, bool) {
+	if prefix == "xml" {
+		return xmlNS, true
+	}
+	for ; e != nil; e = e.parent {
+		if uri, ok := e.ns[prefix]; ok {
+			return uri, true
+		}
+	}
+	return "", false
+}
+
+func (e *element) space() string {
+	uri, _ := e.lookup(e.prefix)
+	return uri
+}
+
+func (e *element) is(space, local string) bool {
+	return e.local == local && e.space() == space
+}
+
+// attr returns the value of an unqualified attribute.
+func (e *element) attr(name string) string {
+	for _, a := range e.attrs {
+		if a.Name.Space == "" && a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// child returns the first child element with the given name.
+func (e *element) child(space, local string) *element {
+	for _, c := range e.children {
+		if c, ok := c.(*element); ok && c.is(space, local) {
+			return c
+		}
+	}
+	return nil
+}
+
+// all returns the child elements with the given name.
+func (e *element) all(space, local string) []*element {
+	var es []*element
+	for _, c := range e.children {
+		if c, ok := c.(*element); ok && c.is(space, local) {
+			es = append(es, c)
+		}
+	}
+	return es
+}
+
+// text returns the element's character data.
+func (e *element) text() string {
+	var sb strings.Builder
+	for _, c := range e.children {
+		if s, ok := c.(string); ok {
+			sb.WriteString(s)
+		}
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// canonicalize writes the element as Exclusive XML Canonicalization 1.0 (without comments) prescribes,
+// leaving out skip. Namespaces with prefixes in inclusive are treated as in inclusive canonicalization.
+// See https://www.w3.org/TR/xml-exc-c14n/
+func canonicalize(w *bytes.Buffer, e, skip *element, inclusive []string) {
+	c14n(w, e, skip, inclusive, map[string]string{"": ""})
+}
+
+func c14n(w *bytes.Buffer, e, skip *element, inclusive []string, rendered map[string]string) {
+	// Declare the namespaces used visibly here, unless an ancestor in the output already has.
+	used := map[string]bool{e.prefix: true}
+	for _, a := range e.attrs {
+		if a.Name.Space != "" && a.Name.Space != "xml" {
+			used[a.Name.Space] = true
+		}
+	}
+	for _, p := range inclusive {
+		if p == "#default" {
+			p = ""
+		}
+		if _, ok := e.lookup(p); ok {
+			used[p] = true
+		}
+	}
+	var prefixes []string
+	scope := rendered
+	for p := range used {
+		uri, _ := e.lookup(p)
+		if have, ok := rendered[p]; ok && have == uri {
+			continue
+		}
+		if len(prefixes) == 0 {
+			scope = make(map[string]string, len(rendered)+1)
+			for k, v := range rendered {
+				scope[k] = v
+			}
+		}
+		scope[p] = uri
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+
+	type attr struct{ space, name, value string }
+	attrs := make([]attr, len(e.attrs))
+	for i, a := range e.attrs {
+		name := a.Name.Local
+		var space string
+		if a.Name.Space != "" {
+			space, _ = e.lookup(a.Name.Space)
+			name = a.Name.Space + ":" + name
+		}
+		attrs[i] = attr{space, name, a.Value}
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		if attrs[i].space != attrs[j].space {
+			return attrs[i].space < attrs[j].space
+		}
+		return localName(attrs[i].name) < localName(attrs[j].name)
+	})
+
+	name := e.local
+	if e.prefix != "" {
+		name = e.prefix + ":" + name
+	}
+	w.WriteString("<" + name)
+	for _, p := range prefixes {
+		if p == "" {
+			w.WriteString(` xmlns="`)
+		} else {
+			w.WriteString(` xmlns:` + p + `="`)
+		}
+		escapeAttr(w, scope[p])
+		w.WriteString(`"`)
+	}
+	for _, a := range attrs {
+		w.WriteString(" " + a.name + `="`)
+		escapeAttr(w, a.value)
+		w.WriteString(`"`)
+	}
+	w.WriteString(">")
+	for _, c := range e.children {
+		switch c := c.(type) {
+		case *element:
+			if c != skip {
+				c14n(w, c, skip, inclusive, scope)
+			}
+		case string:
+			escapeText(w, c)
+		}
+	}
+	w.WriteString("</" + name + ">")
+}
+
+func localName(name string) string {
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+func escapeText(w *bytes.Buffer, s string) {
+	for _, r := range s {
+		switch r {
+		case '&':
+			w.WriteString("&amp;")
+		case '<':
+			w.WriteString("&lt;")
+		case '>':
+			w.WriteString("&gt;")
+		case '\r':
+			w.WriteString("&#xD;")
+		default:
+			w.WriteRune(r)
+		}
+	}
+}
+
+func escapeAttr(w *bytes.Buffer, s string) {
+	for _, r := range s {
+		switch r {
+		case '&':
+			w.WriteString("&amp;")
+		case '<':
+			w.WriteString("&lt;")
+		case '"':
+			w.WriteString("&quot;")
+		case '\t':
+			w.WriteString("&#x9;")
+		case '\n':
+			w.WriteString("&#xA;")
+		case '\r':
+			w.WriteString("&#xD;")
+		default:
+			w.WriteRune(r)
+		}
+	}
+}
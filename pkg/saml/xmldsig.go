@@ -0,0 +1,166 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saml
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	_ "crypto/sha256" // digest and signature hashes
+	_ "crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// XML signatures, as used by SAML: enveloped, over exclusively canonicalized XML.
+// See https://www.w3.org/TR/xmldsig-core1/
+
+const (
+	dsigNS         = "http://www.w3.org/2000/09/xmldsig#"
+	excC14N        = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	envelopedSig   = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	digestSHA256   = "http://www.w3.org/2001/04/xmlenc#sha256"
+	digestSHA512   = "http://www.w3.org/2001/04/xmlenc#sha512"
+	sigRSASHA256   = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	sigRSASHA512   = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"
+	sigECDSASHA256 = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+)
+
+var errUnsigned = errors.New("not signed")
+
+var digests = map[string]crypto.Hash{
+	digestSHA256: crypto.SHA256,
+	digestSHA512: crypto.SHA512,
+}
+
+var signatureHashes = map[string]crypto.Hash{
+	sigRSASHA256:   crypto.SHA256,
+	sigRSASHA512:   crypto.SHA512,
+	sigECDSASHA256: crypto.SHA256,
+}
+
+// verify checks that e carries an enveloped signature over itself, by one of certs.
+// Signatures over anything but the whole element are rejected, so that the caller can trust e in full.
+func verify(e *element, certs []*x509.Certificate) error {
+	sig := e.child(dsigNS, "Signature")
+	if sig == nil {
+		return errUnsigned
+	}
+	signedInfo := sig.child(dsigNS, "SignedInfo")
+	if signedInfo == nil {
+		return errors.New("missing SignedInfo")
+	}
+	if m := signedInfo.child(dsigNS, "CanonicalizationMethod"); m == nil || m.attr("Algorithm") != excC14N {
+		return errors.New("unsupported canonicalization method")
+	}
+	sm := signedInfo.child(dsigNS, "SignatureMethod")
+	if sm == nil {
+		return errors.New("missing SignatureMethod")
+	}
+	hash, ok := signatureHashes[sm.attr("Algorithm")]
+	if !ok {
+		return fmt.Errorf("unsupported signature method %s", sm.attr("Algorithm"))
+	}
+
+	refs := signedInfo.all(dsigNS, "Reference")
+	if len(refs) != 1 {
+		return errors.New("want exactly one signature reference")
+	}
+	ref := refs[0]
+	if id := e.attr("ID"); id == "" || ref.attr("URI") != "#"+id {
+		return errors.New("signature does not reference the signed element")
+	}
+	var inclusive []string
+	if transforms := ref.child(dsigNS, "Transforms"); transforms != nil {
+		for _, t := range transforms.all(dsigNS, "Transform") {
+			switch t.attr("Algorithm") {
+			case envelopedSig:
+			case excC14N:
+				for _, c := range t.children {
+					if c, ok := c.(*element); ok && c.local == "InclusiveNamespaces" && c.space() == excC14N {
+						inclusive = strings.Fields(c.attr("PrefixList"))
+					}
+				}
+			default:
+				return fmt.Errorf("unsupported transform %s", t.attr("Algorithm"))
+			}
+		}
+	}
+	dm := ref.child(dsigNS, "DigestMethod")
+	if dm == nil {
+		return errors.New("missing DigestMethod")
+	}
+	digest, ok := digests[dm.attr("Algorithm")]
+	if !ok {
+		return fmt.Errorf("unsupported digest method %s", dm.attr("Algorithm"))
+	}
+	dv := ref.child(dsigNS, "DigestValue")
+	if dv == nil {
+		return errors.New("missing DigestValue")
+	}
+	want, err := decodeBase64(dv.text())
+	if err != nil {
+		return errors.New("invalid DigestValue")
+	}
+	var b bytes.Buffer
+	canonicalize(&b, e, sig, inclusive)
+	h := digest.New()
+	h.Write(b.Bytes())
+	if subtle.ConstantTimeCompare(h.Sum(nil), want) != 1 {
+		return errors.New("digest mismatch")
+	}
+
+	sv := sig.child(dsigNS, "SignatureValue")
+	if sv == nil {
+		return errors.New("missing SignatureValue")
+	}
+	signature, err := decodeBase64(sv.text())
+	if err != nil {
+		return errors.New("invalid SignatureValue")
+	}
+	b.Reset()
+	canonicalize(&b, signedInfo, nil, nil)
+	h = hash.New()
+	h.Write(b.Bytes())
+	hashed := h.Sum(nil)
+	for _, cert := range certs {
+		switch key := cert.PublicKey.(type) {
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(key, hash, hashed, signature) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			if verifyECDSA(key, hashed, signature) {
+				return nil
+			}
+		}
+	}
+	return errors.New("invalid signature")
+}
+
+// verifyECDSA checks an XML signature, which is the concatenation of r and s, rather than ASN.1.
+func verifyECDSA(key *ecdsa.PublicKey, hashed, signature []byte) bool {
+	n := (key.Curve.Params().BitSize + 7) / 8
+	if len(signature) != 2*n {
+		return false
+	}
+	r, s := new(big.Int).SetBytes(signature[:n]), new(big.Int).SetBytes(signature[n:])
+	return ecdsa.Verify(key, hashed, r, s)
+}
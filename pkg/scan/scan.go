@@ -0,0 +1,264 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package scan is a minimal client for malware scanners: ClamAV's daemon, clamd, and ICAP servers,
+// e.g. those of commercial antivirus gateways, speaking their protocols directly.
+package scan
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scanner scans content for malware.
+type Scanner interface {
+	// Scan reads r to the end, and returns the name of the threat found in it, or "" if it is clean.
+	Scan(ctx context.Context, r io.Reader) (string, error)
+}
+
+// chunkSize is the size of the chunks content is streamed to scanners in.
+const chunkSize = 64 << 10
+
+// Open returns the scanner at a URL of the form:
+//
+//	clamd://host[:3310]
+//	clamd:///var/run/clamav/clamd.ctl
+//	icap://host[:1344]/service
+//
+// Connections time out after timeout without progress.
+func Open(rawURL string, timeout time.Duration) (Scanner, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid scanner URL: %v", err)
+	}
+	switch u.Scheme {
+	case "clamd":
+		if u.Host == "" {
+			if u.Path == "" {
+				return nil, errors.New("invalid scanner URL: want clamd host or socket path, got none")
+			}
+			return &Clamd{"unix", u.Path, timeout}, nil
+		}
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "3310")
+		}
+		return &Clamd{"tcp", addr, timeout}, nil
+	case "icap":
+		if u.Host == "" {
+			return nil, errors.New("invalid scanner URL: want ICAP host, got none")
+		}
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "1344")
+		}
+		return &ICAP{u, timeout}, nil
+	}
+	return nil, fmt.Errorf("invalid scanner URL: want clamd:// or icap://, got %s://", u.Scheme)
+}
+
+// conn is a connection that extends its deadline on each read and write, so that large content can be streamed
+// for as long as it takes, while stalled scanners still time out.
+type conn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func dial(ctx context.Context, network, addr string, timeout time.Duration) (*conn, error) {
+	d := net.Dialer{Timeout: timeout}
+	c, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+		timeout = 0
+	}
+	return &conn{c, timeout}, nil
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	if c.timeout > 0 {
+		c.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	if c.timeout > 0 {
+		c.SetWriteDeadline(time.Now().Add(c.timeout))
+	}
+	return c.Conn.Write(p)
+}
+
+// Clamd scans with ClamAV's daemon, streaming content with the INSTREAM command.
+type Clamd struct {
+	network string
+	addr    string
+	timeout time.Duration
+}
+
+func (s *Clamd) Scan(ctx context.Context, r io.Reader) (string, error) {
+	c, err := dial(ctx, s.network, s.addr, s.timeout)
+	if err != nil {
+		return "", fmt.Errorf("clamd: %v", err)
+	}
+	defer c.Close()
+
+	w := bufio.NewWriterSize(c, chunkSize+4)
+	if _, err := w.WriteString("zINSTREAM\x00"); err != nil {
+		return "", fmt.Errorf("clamd: %v", err)
+	}
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			binary.Write(w, binary.BigEndian, uint32(n))
+			if _, err := w.Write(buf[:n]); err != nil {
+				return "", s.reply(c, err)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	binary.Write(w, binary.BigEndian, uint32(0))
+	if err := w.Flush(); err != nil {
+		return "", s.reply(c, err)
+	}
+	return s.verdict(c)
+}
+
+// reply explains a failed write: clamd stops reading, and replies with an error, e.g. once content exceeds its
+// StreamMaxLength.
+func (s *Clamd) reply(c *conn, err error) error {
+	if _, rerr := s.verdict(c); rerr != nil {
+		return rerr
+	}
+	return fmt.Errorf("clamd: %v", err)
+}
+
+// verdict reads clamd's reply, e.g. "stream: OK" or "stream: Eicar-Signature FOUND".
+func (s *Clamd) verdict(c *conn) (string, error) {
+	line, err := bufio.NewReader(c).ReadString(0)
+	if err != nil && line == "" {
+		return "", fmt.Errorf("clamd: %v", err)
+	}
+	line = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(line, "stream:"), "\x00"))
+	switch {
+	case line == "OK":
+		return "", nil
+	case strings.HasSuffix(line, " FOUND"):
+		return strings.TrimSuffix(line, " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd: %s", line)
+}
+
+// ICAP scans with an ICAP server (RFC 3507), sending content as the body of an HTTP response to modify (RESPMOD).
+// The server answers 204 No Content for clean content, and blocks or replaces anything else.
+type ICAP struct {
+	url     *url.URL
+	timeout time.Duration
+}
+
+// icapResHeader is the HTTP response encapsulated in RESPMOD requests.
+const icapResHeader = "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nTransfer-Encoding: chunked\r\n\r\n"
+
+func (s *ICAP) Scan(ctx context.Context, r io.Reader) (string, error) {
+	c, err := dial(ctx, "tcp", s.url.Host, s.timeout)
+	if err != nil {
+		return "", fmt.Errorf("icap: %v", err)
+	}
+	defer c.Close()
+
+	w := bufio.NewWriterSize(c, chunkSize+16)
+	fmt.Fprintf(w, "RESPMOD icap://%s%s ICAP/1.0\r\n", s.url.Host, s.url.EscapedPath())
+	fmt.Fprintf(w, "Host: %s\r\nAllow: 204\r\nConnection: close\r\n", s.url.Host)
+	fmt.Fprintf(w, "Encapsulated: res-hdr=0, res-body=%d\r\n\r\n", len(icapResHeader))
+	w.WriteString(icapResHeader)
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			fmt.Fprintf(w, "%x\r\n", n)
+			w.Write(buf[:n])
+			if _, err := w.WriteString("\r\n"); err != nil {
+				return "", fmt.Errorf("icap: %v", err)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	w.WriteString("0\r\n\r\n")
+	if err := w.Flush(); err != nil {
+		return "", fmt.Errorf("icap: %v", err)
+	}
+
+	tp := textproto.NewReader(bufio.NewReader(c))
+	line, err := tp.ReadLine()
+	if err != nil {
+		return "", fmt.Errorf("icap: %v", err)
+	}
+	proto, status, _ := strings.Cut(line, " ")
+	if !strings.HasPrefix(proto, "ICAP/") {
+		return "", fmt.Errorf("icap: invalid response %q", line)
+	}
+	code, _, _ := strings.Cut(status, " ")
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return "", fmt.Errorf("icap: %v", err)
+	}
+	switch code {
+	case "204":
+		return "", nil
+	case "200":
+		return icapThreat(header), nil
+	}
+	return "", fmt.Errorf("icap: %s", status)
+}
+
+// icapThreat names the threat an ICAP server reported, in the headers servers commonly use for it.
+func icapThreat(h textproto.MIMEHeader) string {
+	// X-Infection-Found: Type=0; Resolution=2; Threat=Eicar-Signature;
+	for _, field := range strings.Split(h.Get("X-Infection-Found"), ";") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(field), "="); ok && strings.EqualFold(k, "Threat") && v != "" {
+			return v
+		}
+	}
+	for _, k := range []string{"X-Virus-Id", "X-Violations-Found", "X-Blocked-Reason"} {
+		if v := strings.TrimSpace(h.Get(k)); v != "" {
+			if _, err := strconv.Atoi(v); err == nil { // X-Violations-Found starts with a count
+				continue
+			}
+			return v
+		}
+	}
+	return "blocked"
+}
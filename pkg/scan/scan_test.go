@@ -0,0 +1,210 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+// eicar is the EICAR antivirus test file, which scanners detect as malware.
+var eicar = []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+
+// listen serves each connection with handle, and returns the address it listens on.
+func listen(t *testing.T, handle func(c net.Conn)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				handle(c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// clamd detects the EICAR test file in streams of up to max bytes.
+func clamd(t *testing.T, max int) string {
+	return listen(t, func(c net.Conn) {
+		r := bufio.NewReader(c)
+		cmd, err := r.ReadString(0)
+		if err != nil || cmd != "zINSTREAM\x00" {
+			c.Write([]byte("UNKNOWN COMMAND\x00"))
+			return
+		}
+		var content []byte
+		for {
+			var size uint32
+			if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+				return
+			}
+			if size == 0 {
+				break
+			}
+			if len(content)+int(size) > max {
+				c.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+				return
+			}
+			chunk := make([]byte, size)
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return
+			}
+			content = append(content, chunk...)
+		}
+		if bytes.Contains(content, eicar) {
+			c.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+			return
+		}
+		c.Write([]byte("stream: OK\x00"))
+	})
+}
+
+// icap detects the EICAR test file in RESPMOD requests to /avscan.
+func icap(t *testing.T) string {
+	return listen(t, func(c net.Conn) {
+		r := bufio.NewReader(c)
+		tp := textproto.NewReader(r)
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		header, err := tp.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		if !strings.HasPrefix(line, "RESPMOD icap://") || !strings.HasSuffix(line, "/avscan ICAP/1.0") {
+			c.Write([]byte("ICAP/1.0 404 Service Not Found\r\n\r\n"))
+			return
+		}
+		if header.Get("Allow") != "204" || !strings.HasPrefix(header.Get("Encapsulated"), "res-hdr=0, res-body=") {
+			c.Write([]byte("ICAP/1.0 400 Bad Request\r\n\r\n"))
+			return
+		}
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			return
+		}
+		content, err := io.ReadAll(resp.Body) // chunked
+		if err != nil {
+			return
+		}
+		if bytes.Contains(content, eicar) {
+			c.Write([]byte("ICAP/1.0 200 OK\r\nX-Infection-Found: Type=0; Resolution=2; Threat=EICAR-Test-File;\r\nEncapsulated: null-body=0\r\n\r\n"))
+			return
+		}
+		c.Write([]byte("ICAP/1.0 204 No Content\r\nEncapsulated: null-body=0\r\n\r\n"))
+	})
+}
+
+func testScanner(t *testing.T, s Scanner, threat string) {
+	eq, ok, _ := assert.Assert(t)
+	ctx := context.Background()
+
+	found, err := s.Scan(ctx, strings.NewReader("hello"))
+	ok(err == nil)
+	eq("", found)
+
+	found, err = s.Scan(ctx, bytes.NewReader(nil))
+	ok(err == nil)
+	eq("", found)
+
+	// Larger than a chunk, with the test file in the second.
+	content := append(bytes.Repeat([]byte{'x'}, chunkSize+10), eicar...)
+	found, err = s.Scan(ctx, bytes.NewReader(content))
+	ok(err == nil)
+	eq(threat, found)
+}
+
+func TestClamd(t *testing.T) {
+	s, err := Open("clamd://"+clamd(t, 1<<20), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testScanner(t, s, "Eicar-Test-Signature")
+}
+
+func TestClamdLimit(t *testing.T) {
+	_, ok, _ := assert.Assert(t)
+	s, err := Open("clamd://"+clamd(t, 100), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Scan(context.Background(), bytes.NewReader(bytes.Repeat([]byte{'x'}, 4*chunkSize)))
+	ok(err != nil)
+	ok(strings.Contains(err.Error(), "size limit exceeded"))
+}
+
+func TestICAP(t *testing.T) {
+	s, err := Open("icap://"+icap(t)+"/avscan", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testScanner(t, s, "EICAR-Test-File")
+
+	_, ok, _ := assert.Assert(t)
+	s, _ = Open("icap://"+icap(t)+"/missing", time.Second)
+	_, err = s.Scan(context.Background(), strings.NewReader("hello"))
+	ok(err != nil)
+}
+
+func TestTimeout(t *testing.T) {
+	_, ok, _ := assert.Assert(t)
+	addr := listen(t, func(c net.Conn) { io.Copy(io.Discard, c) }) // never replies
+	s, _ := Open("clamd://"+addr, 100*time.Millisecond)
+	_, err := s.Scan(context.Background(), strings.NewReader("hello"))
+	ok(err != nil)
+}
+
+func TestOpen(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+
+	s, err := Open("clamd://localhost", time.Second)
+	ok(err == nil)
+	eq("localhost:3310", s.(*Clamd).addr)
+
+	s, err = Open("clamd:///var/run/clamav/clamd.ctl", time.Second)
+	ok(err == nil)
+	eq("unix", s.(*Clamd).network)
+	eq("/var/run/clamav/clamd.ctl", s.(*Clamd).addr)
+
+	s, err = Open("icap://av.example.com/srv_clamav", time.Second)
+	ok(err == nil)
+	eq("av.example.com:1344", s.(*ICAP).url.Host)
+
+	_, err = Open("http://localhost", time.Second)
+	ok(err != nil)
+	_, err = Open("clamd://", time.Second)
+	ok(err != nil)
+}
@@ -0,0 +1,164 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+// ClientInfo describes a browser connected to the server.
+type ClientInfo struct {
+	ID        string    `json:"id"`
+	Route     string    `json:"route"` // page watched, if any yet
+	Subject   string    `json:"subject"`
+	Username  string    `json:"username"`
+	Since     time.Time `json:"since"`           // when the client first connected
+	Transport string    `json:"transport"`       // websocket or sse
+	Addr      string    `json:"addr,omitempty"`  // remote address; for admins only
+	State     string    `json:"state,omitempty"` // for admins only
+}
+
+// presence describes the clients watching a route, or all clients if route is empty, in the order they connected.
+func (b *Broker) presence(route string) []ClientInfo {
+	b.unicastsMux.RLock()
+	clients := make([]*Client, 0, len(b.clientsByID))
+	for _, c := range b.clientsByID {
+		clients = append(clients, c)
+	}
+	b.unicastsMux.RUnlock()
+
+	infos := []ClientInfo{}
+	for _, c := range clients {
+		c.lock.Lock()
+		info := ClientInfo{c.id, c.route, c.session.subject, c.session.username, c.connectedAt, transportName(c.conn), c.addr, c.state}
+		c.lock.Unlock()
+		if route != "" && info.Route != route {
+			continue
+		}
+		if strings.HasPrefix(info.State, STATE_TIMEOUT) { // suffixed with a timeout ID
+			info.State = STATE_TIMEOUT
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Since.Before(infos[j].Since) })
+	return infos
+}
+
+func transportName(t transport) string {
+	switch t.(type) {
+	case *sseTransport:
+		return "sse"
+	default:
+		return "websocket"
+	}
+}
+
+// PresenceHandler lists the browsers watching a page, e.g. to show who else is viewing it, for apps.
+//
+//	GET /_presence?route=/demo
+type PresenceHandler struct {
+	authn  keychain.Authenticator
+	broker *Broker
+}
+
+func newPresenceHandler(authn keychain.Authenticator, broker *Broker) http.Handler {
+	return &PresenceHandler{authn, broker}
+}
+
+func (h *PresenceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authn.Guard(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	route := r.URL.Query().Get("route")
+	if route == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	infos := h.broker.presence(route)
+	for i := range infos { // not the apps' business
+		infos[i].Addr, infos[i].State = "", ""
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+const clientsTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>Wave Clients</title>
+  <style>
+    body { font: 14px/1.4 -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif; margin: 2em; color: #222; }
+    h1 { font-size: 20px; font-weight: 600; }
+    table { border-collapse: collapse; width: 100%; }
+    th, td { text-align: left; padding: 6px 10px; border-bottom: 1px solid #eee; }
+    th { font-weight: 600; color: #555; }
+  </style>
+</head>
+<body>
+  <h1>Wave Clients ({{ len . }})</h1>
+  <table>
+    <thead><tr><th>ID</th><th>Route</th><th>User</th><th>Since</th><th>Transport</th><th>Address</th><th>State</th></tr></thead>
+    <tbody>
+    {{- range . }}
+      <tr><td><code>{{ .ID }}</code></td><td>{{ .Route }}</td><td>{{ .Username }}</td><td>{{ .Since.Format "2006-01-02 15:04:05" }}</td><td>{{ .Transport }}</td><td>{{ .Addr }}</td><td>{{ .State }}</td></tr>
+    {{- end }}
+    </tbody>
+  </table>
+</body>
+</html>`
+
+// ClientAdminHandler lists connected browsers, to help debug stuck clients, for admins.
+// Browsers are shown a table; other clients get JSON.
+//
+//	GET /_admin/clients[?route=/demo]
+type ClientAdminHandler struct {
+	admins   keychain.Authenticator
+	broker   *Broker
+	template *template.Template
+}
+
+func newClientAdminHandler(admins keychain.Authenticator, broker *Broker) http.Handler {
+	return &ClientAdminHandler{admins, broker, template.Must(template.New("clients").Parse(clientsTemplate))}
+}
+
+func (h *ClientAdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.admins.Guard(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	infos := h.broker.presence(r.URL.Query().Get("route"))
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		h.template.Execute(w, infos)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
@@ -24,6 +24,14 @@ type OpsD struct {
 	M *Meta  `json:"m,omitempty"` // metadata
 	C int    `json:"c,omitempty"` // clear UI state
 	I string `json:"i,omitempty"` // client id
+	X int    `json:"x,omitempty"` // closed for inactivity; reconnect once the user is back
+	G *MoveD `json:"g,omitempty"` // server shutting down; reconnect, likely to another server
+}
+
+// MoveD represents a request to reconnect, made by a server that is shutting down.
+type MoveD struct {
+	Spread int      `json:"r"`           // reconnect within this many milliseconds, picked at random
+	Apps   []string `json:"a,omitempty"` // routes of apps served here, which may take a moment to be served again
 }
 
 // Meta represents metadata unrelated to commands
@@ -99,14 +107,36 @@ type AppRequest struct {
 
 // RegisterApp represents a request to register an app.
 type RegisterApp struct {
-	Mode      string `json:"mode"`
-	Route     string `json:"route"`
-	Address   string `json:"address"`
-	KeyID     string `json:"key_id"`
-	KeySecret string `json:"key_secret"`
+	Mode       string   `json:"mode"`
+	Route      string   `json:"route"`
+	Address    string   `json:"address"`
+	KeyID      string   `json:"key_id"`
+	KeySecret  string   `json:"key_secret"`
+	Keychain   string   `json:"keychain,omitempty"`   // name of the keychain guarding this app's route and pages, if any
+	Ack        bool     `json:"ack,omitempty"`        // number queries, and retry them until the app acknowledges receipt
+	Health     string   `json:"health,omitempty"`     // path to probe the app's health at, e.g. /healthz, if any
+	Scale      bool     `json:"scale,omitempty"`      // share the route with other instances of the app, rather than replace them
+	Deployment string   `json:"deployment,omitempty"` // deployment, e.g. version, to run side by side with the others on the route
+	Meta       *AppMeta `json:"meta,omitempty"`       // describes the app to catalogs and launchers, if set
+}
+
+// AppMeta describes an app to catalogs and launchers built on the Wave server.
+type AppMeta struct {
+	Title       string            `json:"title,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Version     string            `json:"version,omitempty"`
+	Icon        string            `json:"icon,omitempty"` // URL of an image, or name of an icon
+	Tags        []string          `json:"tags,omitempty"`
+	Extra       map[string]string `json:"extra,omitempty"` // anything else
+}
+
+// AppRegistered represents the server's answer to an app registering, if it has anything to tell.
+type AppRegistered struct {
+	Secrets map[string]string `json:"secrets,omitempty"` // environment variables to set, e.g. credentials
 }
 
 // UnregisterApp represents a request to unregister an app.
 type UnregisterApp struct {
-	Route string `json:"route"`
+	Route   string `json:"route"`
+	Address string `json:"address,omitempty"` // of the instance to unregister; every instance if empty
 }
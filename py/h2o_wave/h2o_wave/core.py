@@ -60,6 +60,7 @@ class _Config:
         self.hub_access_key_secret: str = _get_env('ACCESS_KEY_SECRET', 'access_key_secret')
         self.app_access_key_id: str = _get_env('APP_ACCESS_KEY_ID', None) or secrets.token_urlsafe(16)
         self.app_access_key_secret: str = _get_env('APP_ACCESS_KEY_SECRET', None) or secrets.token_urlsafe(16)
+        self.app_keychain: Optional[str] = _get_env('APP_KEYCHAIN', None)
 
 
 _config = _Config()
@@ -591,14 +592,18 @@ class Page(PageBase):
         """
         return self.site.load(self.url)
 
-    def save(self):
+    def save(self, ack: bool = False):
         """
         Save the page. Sends all local changes made to this page to the remote site.
+
+        Args:
+            ack: If True, the Wave server keeps sending the changes to browsers until they acknowledge receipt.
+                Use for critical updates that must not be lost to network blips.
         """
         p = self._diff()
         if p:
             logger.debug(data)
-            self.site._save(self.url, p)
+            self.site._save(self.url, p, ack)
 
 
 class AsyncPage(PageBase):
@@ -624,14 +629,18 @@ class AsyncPage(PageBase):
         """
         return await self.site.load(self.url)
 
-    async def save(self):
+    async def save(self, ack: bool = False):
         """
         Save the page. Sends all local changes made to this page to the remote site.
+
+        Args:
+            ack: If True, the Wave server keeps sending the changes to browsers until they acknowledge receipt.
+                Use for critical updates that must not be lost to network blips.
         """
         p = self._diff()
         if p:
             logger.debug(p)
-            await self.site._save(self.url, p)
+            await self.site._save(self.url, p, ack)
 
 
 class Site:
@@ -653,8 +662,9 @@ class Site:
         page = self[key]
         page.drop()
 
-    def _save(self, url: str, patch: str):
-        res = self._http.patch(_rebase(_config.hub_address, url), content=patch)
+    def _save(self, url: str, patch: str, ack: bool = False):
+        headers = {'Wave-Ack': '1'} if ack else None
+        res = self._http.patch(_rebase(_config.hub_address, url), content=patch, headers=headers)
         if res.status_code != 200:
             raise ServiceError(f'Request failed (code={res.status_code}): {res.text}')
 
@@ -673,6 +683,22 @@ class Site:
             raise ServiceError(f'Request failed (code={res.status_code}): {res.text}')
         return res.json()
 
+    def presence(self, url: str) -> List[dict]:
+        """
+        List the browsers currently viewing a page, e.g. to show who else is viewing it.
+
+        Args:
+            url: The URL of the page.
+
+        Returns:
+            A list of clients, each with `id`, `route`, `subject`, `username`, `since` and `transport` keys,
+            in the order they connected.
+        """
+        res = self._http.get(f'{_config.hub_address}_presence', params=dict(route=url))
+        if res.status_code != 200:
+            raise ServiceError(f'Request failed (code={res.status_code}): {res.text}')
+        return res.json()
+
     def upload(self, files: List[str]) -> List[str]:
         """
         Upload local files to the site.
@@ -805,14 +831,34 @@ class Site:
 
         return filepath
 
-    def unload(self, url: str):
+    def sign(self, path: str, ttl: int = 3600) -> str:
+        """
+        Sign the path of an uploaded file, or of a file in a private directory, so that it can be downloaded without
+        credentials until it expires, e.g. from an email or another site.
+
+        Args:
+            path: The path of the file, e.g. as returned by `upload()`.
+            ttl: How many seconds the signed path is valid for; at most the server's `-max-signed-url-ttl`.
+
+        Returns:
+            The signed path.
+        """
+        res = self._http.post(f'{_config.hub_address}_sign', params=dict(path=path, ttl=ttl))
+        if res.status_code != 200:
+            raise ServiceError(f'Sign failed (code={res.status_code}): {res.text}')
+        return res.json()['url']
+
+    def unload(self, url: str, auth: Optional[Any] = None):
         """
         Delete an uploaded file from the site.
 
         Args:
             url: The URL of the file to delete.
+            auth: The user's authentication info, `q.auth`, if the server requires step-up authentication for file
+             deletion, in which case the file is deleted only if the user authenticated recently or strongly enough.
         """
-        res = self._http.delete(f'{_config.hub_host_address}{url}')
+        headers = {'Wave-Session-ID': auth._session_id} if auth else None
+        res = self._http.delete(f'{_config.hub_host_address}{url}', headers=headers)
         if res.status_code == 200:
             return
         raise ServiceError(f'Unload failed (code={res.status_code}): {res.text}')
@@ -883,8 +929,9 @@ class AsyncSite:
         page = self[key]
         page.drop()
 
-    async def _save(self, url: str, patch: str):
-        res = await self._http.patch(_rebase(_config.hub_address, url), content=patch)
+    async def _save(self, url: str, patch: str, ack: bool = False):
+        headers = {'Wave-Ack': '1'} if ack else None
+        res = await self._http.patch(_rebase(_config.hub_address, url), content=patch, headers=headers)
         if res.status_code != 200:
             raise ServiceError(f'Request failed (code={res.status_code}): {res.text}')
 
@@ -903,6 +950,22 @@ class AsyncSite:
             raise ServiceError(f'Request failed (code={res.status_code}): {res.text}')
         return res.json()
 
+    async def presence(self, url: str) -> List[dict]:
+        """
+        List the browsers currently viewing a page, e.g. to show who else is viewing it.
+
+        Args:
+            url: The URL of the page.
+
+        Returns:
+            A list of clients, each with `id`, `route`, `subject`, `username`, `since` and `transport` keys,
+            in the order they connected.
+        """
+        res = await self._http.get(f'{_config.hub_address}_presence', params=dict(route=url))
+        if res.status_code != 200:
+            raise ServiceError(f'Request failed (code={res.status_code}): {res.text}')
+        return res.json()
+
     async def upload_dir(self, directory: str) -> str:
         """
         WARNING: Experimental and subject to change.
@@ -1029,14 +1092,34 @@ class AsyncSite:
 
         return filepath
 
-    async def unload(self, url: str):
+    async def sign(self, path: str, ttl: int = 3600) -> str:
+        """
+        Sign the path of an uploaded file, or of a file in a private directory, so that it can be downloaded without
+        credentials until it expires, e.g. from an email or another site.
+
+        Args:
+            path: The path of the file, e.g. as returned by `upload()`.
+            ttl: How many seconds the signed path is valid for; at most the server's `-max-signed-url-ttl`.
+
+        Returns:
+            The signed path.
+        """
+        res = await self._http.post(f'{_config.hub_address}_sign', params=dict(path=path, ttl=ttl))
+        if res.status_code != 200:
+            raise ServiceError(f'Sign failed (code={res.status_code}): {res.text}')
+        return res.json()['url']
+
+    async def unload(self, url: str, auth: Optional[Any] = None):
         """
         Delete an uploaded file from the site.
 
         Args:
             url: The URL of the file to delete.
+            auth: The user's authentication info, `q.auth`, if the server requires step-up authentication for file
+             deletion, in which case the file is deleted only if the user authenticated recently or strongly enough.
         """
-        res = await self._http.delete(f'{_config.hub_host_address}{url}')
+        headers = {'Wave-Session-ID': auth._session_id} if auth else None
+        res = await self._http.delete(f'{_config.hub_host_address}{url}', headers=headers)
         if res.status_code == 200:
             return
         raise ServiceError(f'Unload failed (code={res.status_code}): {res.text}')
@@ -58,11 +58,16 @@ class Auth:
     Represents authentication information for a given query context. Carries valid information only if single sign on is enabled.
     """
 
-    def __init__(self, username: str, subject: str, access_token: str, refresh_token: str, session_id: str):
+    def __init__(self, username: str, subject: str, access_token: str, refresh_token: str, session_id: str,
+                 provider: Optional[str] = None, groups: Optional[List[str]] = None):
         self.username = username
         """The username of the user."""
         self.subject = subject
         """A unique identifier for the user."""
+        self.provider = provider
+        """The name of the identity provider the user signed in with."""
+        self.groups = groups or []
+        """The groups the user belongs to, as mapped from the identity provider's groups claim."""
         self.access_token = access_token
         """The access token of the user."""
         self.refresh_token = refresh_token
@@ -125,7 +130,8 @@ class Query:
             client_state: Expando,
             args: Expando,
             events: Expando,
-            headers: Dict[str, List[str]]
+            headers: Dict[str, List[str]],
+            seq: Optional[int] = None,
     ):
         self.mode = mode
         """The server mode. One of `'unicast'` (default),`'multicast'` or `'broadcast'`."""
@@ -149,6 +155,8 @@ class Query:
         """The authentication / authorization details of the user who initiated this query."""
         self.headers = headers
         """Original Websocket HTTP connection headers forwarded from the Wave server to this application."""
+        self.seq = seq
+        """Sequence number of this query, if the app acknowledges queries (`ack=True`). A query delivered more than once has the same sequence number."""
 
     async def sleep(self, delay: float, result=None) -> Any:
         """
@@ -230,8 +238,13 @@ class _Wave:
 
 class _App:
     def __init__(self, route: str, handle: HandleAsync, mode=None, on_startup: Optional[Callable] = None,
-                 on_shutdown: Optional[Callable] = None):
+                 on_shutdown: Optional[Callable] = None, ack=False, scale=False, meta: Optional[Dict[str, Any]] = None,
+                 deployment: Optional[str] = None):
         self._mode = mode or _config.app_mode
+        self._ack = ack
+        self._scale = scale
+        self._meta = meta
+        self._deployment = deployment or _get_env('APP_DEPLOYMENT', '')
         self._route = route
         self._handle = handle
         self._wave: _Wave = _Wave()
@@ -251,6 +264,7 @@ class _App:
             routes=[
                 Route('/', endpoint=self._receive, methods=['POST']),
                 Route('/disconnect', endpoint=self._disconnect, methods=['POST']),
+                Route('/healthz', endpoint=self._health, methods=['GET']),
             ],
             on_startup=[
                 self._register,
@@ -270,14 +284,23 @@ class _App:
         logger.debug(f'Registering app at {app_address} ...')
         while True:
             try:
-                await self._wave.call(
+                res = await self._wave.call(
                     'register_app',
                     mode=self._mode,
                     route=self._route,
                     address=app_address,
                     key_id=_config.app_access_key_id,
                     key_secret=_config.app_access_key_secret,
+                    keychain=_config.app_keychain,
+                    ack=self._ack,
+                    health='/healthz',
+                    scale=self._scale,
+                    meta=self._meta,
+                    deployment=self._deployment,
                 )
+                if res.headers.get('content-type', '').startswith('application/json'):
+                    # Secrets the server passes on, e.g. credentials, for on_startup and handlers to read from os.environ.
+                    os.environ.update(res.json().get('secrets') or {})
                 logger.debug('Register: success!')
                 break
             except httpx.ConnectError as exception:
@@ -293,12 +316,16 @@ class _App:
     async def _unregister(self):
         logger.debug('Unregistering app...')
         try:
-            await self._wave.call('unregister_app', route=self._route)
+            await self._wave.call('unregister_app', route=self._route,
+                                  address=_get_env('APP_ADDRESS', _config.app_address))
             logger.debug('Unregister: success!')
         # Happens during killing reloader process (dev mode) - server process killed before starlette on_shutdown hook.
         except httpx.ConnectError:
             logger.debug('Could not unregister app due to unreachable server.')
 
+    async def _health(self, req: Request):
+        return PlainTextResponse(content='')
+
     async def _disconnect(self, req: Request):
         if not _is_req_authorized(req):
             return PlainTextResponse(content='Unauthorized', status_code=401)
@@ -324,17 +351,22 @@ class _App:
         access_token = req.headers.get('Wave-Access-Token')
         refresh_token = req.headers.get('Wave-Refresh-Token')
         session_id = req.headers.get('Wave-Session-ID')
+        provider = req.headers.get('Wave-Provider')
+        groups = req.headers.get('Wave-Groups')
+        seq = req.headers.get('Wave-Sequence')
 
         body = await req.json()
         forwarded_headers = body.get('headers', None)
         if forwarded_headers:
             self._headers[client_id] = forwarded_headers
 
-        auth = Auth(username, subject, access_token, refresh_token, session_id)
+        auth = Auth(username, subject, access_token, refresh_token, session_id, provider,
+                    groups.split(',') if groups else None)
 
-        return PlainTextResponse('', background=BackgroundTask(self._process, client_id, auth, body.get('data', {})))
+        return PlainTextResponse('', background=BackgroundTask(self._process, client_id, auth, body.get('data', {}),
+                                                               int(seq) if seq else None))
 
-    async def _process(self, client_id: str, auth: Auth, args: dict):
+    async def _process(self, client_id: str, auth: Auth, args: dict, seq: Optional[int] = None):
         logger.debug(f'user: {auth.username}, client: {client_id}')
         logger.debug(args)
         app_state, user_state, client_state = self._state
@@ -354,6 +386,7 @@ class _App:
             args=Expando(args),
             events=Expando(events_state),
             headers=self._headers.get(client_id, {}),
+            seq=seq,
         )
         # noinspection PyBroadException,PyPep8
         try:
@@ -471,7 +504,8 @@ main = _Main()
 
 
 def app(route: str, mode=None, on_startup: Optional[Callable] = None,
-        on_shutdown: Optional[Callable] = None):
+        on_shutdown: Optional[Callable] = None, ack=False, scale=False, meta: Optional[Dict[str, Any]] = None,
+        deployment: Optional[str] = None):
     """
     Indicate that a function is a query handler.
 
@@ -483,10 +517,14 @@ def app(route: str, mode=None, on_startup: Optional[Callable] = None,
         mode: The server mode. One of `'unicast'` (default),`'multicast'` or `'broadcast'`.
         on_startup: A callback to invoke on app startup. Callbacks do not take any arguments, and may be be either standard functions, or async functions.
         on_shutdown: A callback to invoke on app shutdown. Callbacks do not take any arguments, and may be be either standard functions, or async functions.
+        ack: If True, the Wave server retries delivering queries that fail, so queries are handled at least once. Use `q.seq` to tell retries apart.
+        scale: If True, several instances of the app, at different addresses, may serve the route, each browser tab (or user, for multicast apps) served by the same instance. Not supported by broadcast apps.
+        meta: Describes the app to catalogs and launchers, listed at `/_apps`, e.g. `dict(title='Sales', version='1.2.0', tags=['finance'])`. Recognized keys are `title`, `description`, `version`, `icon`, `tags` and `extra`, a dictionary of strings.
+        deployment: Name of the deployment of the app, e.g. `'blue'` or `'green'`, to run side by side with other deployments on the route, the Wave server splitting users among them as admins decide. Defaults to `$H2O_WAVE_APP_DEPLOYMENT`. Not supported by broadcast apps.
     """
 
     def wrap(handle: HandleAsync):
-        main._app = _App(route, handle, mode, on_startup, on_shutdown)
+        main._app = _App(route, handle, mode, on_startup, on_shutdown, ack, scale, meta, deployment)
         return handle
 
     return wrap
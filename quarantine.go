@@ -0,0 +1,229 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/h2oai/wave/pkg/blob"
+	"github.com/h2oai/wave/pkg/scan"
+)
+
+const (
+	scanWait        = 30 * time.Second // how long downloads wait for a held file to be scanned
+	scanRetry       = 30 * time.Second // how long to wait before scanning again after the scanner failed
+	scanConcurrency = 4
+)
+
+// Quarantine holds uploaded files until a malware scanner has cleared them. Downloads of held files wait for the
+// verdict, infected files are deleted, and files stay held, and are scanned again, for as long as the scanner fails.
+// Held files are recorded on disk, so that they stay held across restarts.
+type Quarantine struct {
+	scanner scan.Scanner
+	path    string      // JSON file the held files are recorded in
+	dir     string      // file server dir
+	store   blob.Bucket // file server object store; nil if not used
+	quotas  *UploadQuotas
+	cas     *ContentStore
+	sem     chan struct{} // limits concurrent scans
+
+	lock sync.Mutex
+	held map[string]*heldUpload // upload id => files
+}
+
+type heldUpload struct {
+	keys []string
+	done chan struct{} // closed once scanned, or deleted
+}
+
+// newQuarantine holds the files recorded at path, if any, and scans them.
+func newQuarantine(scanner scan.Scanner, path, dir string, store blob.Bucket, quotas *UploadQuotas, cas *ContentStore) (*Quarantine, error) {
+	q := &Quarantine{scanner, path, dir, store, quotas, cas, make(chan struct{}, scanConcurrency), sync.Mutex{}, make(map[string]*heldUpload)}
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(b) > 0 {
+		var held map[string][]string
+		if err := json.Unmarshal(b, &held); err != nil {
+			return nil, err
+		}
+		for id, keys := range held {
+			q.held[id] = &heldUpload{keys, make(chan struct{})}
+			go q.scan(id)
+		}
+	}
+	return q, nil
+}
+
+// hold quarantines uploaded files until they are scanned, which starts with check. Files can be held before they
+// are stored, so that they are never available unscanned.
+func (q *Quarantine) hold(files []storedFile) {
+	if q == nil || len(files) == 0 {
+		return
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, f := range files {
+		id := f.id()
+		h, ok := q.held[id]
+		if !ok {
+			h = &heldUpload{done: make(chan struct{})}
+			q.held[id] = h
+		}
+		if !slices.Contains(h.keys, f.key) {
+			h.keys = append(h.keys, f.key)
+		}
+	}
+	q.save()
+}
+
+// check starts scanning held files, once stored.
+func (q *Quarantine) check(files []storedFile) {
+	if q == nil {
+		return
+	}
+	seen := make(map[string]bool)
+	for _, f := range files {
+		if id := f.id(); !seen[id] {
+			seen[id] = true
+			go q.scan(id)
+		}
+	}
+}
+
+// wait waits for an upload to be scanned, if held, and reports whether it is free to download.
+func (q *Quarantine) wait(ctx context.Context, id string) bool {
+	if q == nil {
+		return true
+	}
+	q.lock.Lock()
+	h, ok := q.held[id]
+	q.lock.Unlock()
+	if !ok {
+		return true
+	}
+	t := time.NewTimer(scanWait)
+	defer t.Stop()
+	select {
+	case <-h.done:
+		return true
+	case <-t.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+// release stops holding a deleted upload.
+func (q *Quarantine) release(id string) {
+	if q == nil {
+		return
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if h, ok := q.held[id]; ok {
+		delete(q.held, id)
+		close(h.done)
+		q.save()
+	}
+}
+
+// scan scans a held upload's files, releasing them if clean, and deleting them if not.
+func (q *Quarantine) scan(id string) {
+	q.sem <- struct{}{}
+	defer func() { <-q.sem }()
+
+	q.lock.Lock()
+	h, ok := q.held[id]
+	var keys []string
+	if ok {
+		keys = append(keys, h.keys...)
+	}
+	q.lock.Unlock()
+	if !ok { // deleted meanwhile
+		return
+	}
+
+	for _, key := range keys {
+		threat, err := q.scanFile(key)
+		if err != nil {
+			echo(Log{"t": "file_scan", "path": key, "error": err.Error()})
+			time.AfterFunc(scanRetry, func() { q.scan(id) })
+			return
+		}
+		if threat != "" {
+			echo(Log{"t": "file_scan", "path": key, "threat": threat})
+			if err := deleteUpload(q.dir, q.store, q.cas, id); err != nil {
+				echo(Log{"t": "file_scan", "upload": id, "error": "failed deleting infected upload: " + err.Error()})
+				time.AfterFunc(scanRetry, func() { q.scan(id) })
+				return
+			}
+			q.quotas.remove(id)
+			q.release(id)
+			return
+		}
+	}
+	echo(Log{"t": "file_scan", "upload": id, "files": strconv.Itoa(len(keys))})
+	q.release(id)
+}
+
+func (q *Quarantine) scanFile(key string) (string, error) {
+	ctx := context.Background()
+	var r io.ReadCloser
+	var err error
+	if q.store != nil {
+		r, err = q.store.Get(ctx, key, 0)
+	} else {
+		r, err = os.Open(filepath.Join(q.dir, filepath.FromSlash(key)))
+	}
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	return q.scanner.Scan(ctx, r)
+}
+
+// save records the held files on disk. The caller must hold the lock.
+func (q *Quarantine) save() {
+	held := make(map[string][]string, len(q.held))
+	for id, h := range q.held {
+		held[id] = h.keys
+	}
+	b, err := json.Marshal(held)
+	if err != nil {
+		echo(Log{"t": "file_scan", "error": err.Error()})
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(q.path), 0700); err != nil {
+		echo(Log{"t": "file_scan", "error": err.Error()})
+		return
+	}
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		echo(Log{"t": "file_scan", "error": err.Error()})
+		return
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		echo(Log{"t": "file_scan", "error": err.Error()})
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// OverflowPolicy decides what happens to a client whose outgoing queue is full, e.g. a slow browser tab.
+type OverflowPolicy int
+
+const (
+	overflowDisconnect OverflowPolicy = iota // disconnect the client, which reloads when it reconnects
+	overflowDropOldest                       // drop the oldest queued message
+	overflowCoalesce                         // merge queued changes into one message, or else ask the client to reload
+)
+
+var overflowPolicies = map[string]OverflowPolicy{
+	"disconnect":  overflowDisconnect,
+	"drop-oldest": overflowDropOldest,
+	"coalesce":    overflowCoalesce,
+}
+
+// ParseOverflowPolicy parses the name of an overflow policy: disconnect, drop-oldest or coalesce.
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	if p, ok := overflowPolicies[s]; ok {
+		return p, nil
+	}
+	return 0, fmt.Errorf("unknown overflow policy %q; want disconnect, drop-oldest or coalesce", s)
+}
+
+func (p OverflowPolicy) String() string {
+	for name, q := range overflowPolicies {
+		if q == p {
+			return name
+		}
+	}
+	return strconv.Itoa(int(p))
+}
+
+// send queues data to be sent to the client, and reports whether the client can stay connected.
+func (c *Client) send(data []byte) bool {
+	if data = c.filter.apply(data); data == nil {
+		return true
+	}
+
+	c.queueLock.Lock()
+	defer c.queueLock.Unlock()
+
+	select {
+	case c.data <- data:
+		c.stats.sent(len(data))
+		c.watchQueue()
+		return true
+	default:
+	}
+
+	c.overflows++
+	if c.overflows == 1 {
+		echo(Log{"t": "client_overflow", "client": c.id, "policy": c.overflow.String()})
+	}
+
+	switch c.overflow {
+	case overflowDropOldest:
+		select {
+		case <-c.data:
+			c.stats.drop(1)
+		default:
+		}
+	case overflowCoalesce:
+		queued := c.drain()
+		msgs := coalesce(append(queued, data))
+		if len(msgs) > cap(c.data) {
+			// Too many changes to fit; reloading is cheaper than catching up.
+			c.stats.drop(len(queued) + 1)
+			msgs, data = [][]byte{resetMsg}, resetMsg
+		}
+		for _, msg := range msgs {
+			c.data <- msg
+		}
+		c.stats.sent(len(data))
+		c.watchQueue()
+		return true
+	default:
+		c.stats.drop(1)
+		return false
+	}
+
+	select {
+	case c.data <- data:
+		c.stats.sent(len(data))
+	default: // drained by the client meanwhile, and refilled
+		c.stats.drop(1)
+	}
+	c.watchQueue()
+	return true
+}
+
+// drain removes and returns the messages queued for the client.
+func (c *Client) drain() [][]byte {
+	var msgs [][]byte
+	for {
+		select {
+		case msg, ok := <-c.data:
+			if !ok {
+				return msgs
+			}
+			msgs = append(msgs, msg)
+		default:
+			return msgs
+		}
+	}
+}
+
+// coalesce merges consecutive messages that only carry changes, e.g. {"d":[a]} and {"d":[b,c]} into {"d":[a,b,c]},
+// since clients apply changes in order anyway. Other messages are kept as is.
+func coalesce(msgs [][]byte) [][]byte {
+	var (
+		merged [][]byte
+		ops    []json.RawMessage
+	)
+	flush := func() {
+		if len(ops) == 0 {
+			return
+		}
+		if b, err := json.Marshal(deltasMsg{ops}); err == nil {
+			merged = append(merged, b)
+		}
+		ops = nil
+	}
+	for _, msg := range msgs {
+		if d, ok := deltas(msg); ok {
+			ops = append(ops, d...)
+			continue
+		}
+		flush()
+		merged = append(merged, msg)
+	}
+	flush()
+	return merged
+}
@@ -0,0 +1,100 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func newQueueTestClient(size int, overflow OverflowPolicy) *Client {
+	return &Client{id: "client", session: &Session{}, data: make(chan []byte, size), overflow: overflow}
+}
+
+func queued(c *Client) []string {
+	var msgs []string
+	for _, msg := range c.drain() {
+		msgs = append(msgs, string(msg))
+	}
+	return msgs
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	for _, name := range []string{"disconnect", "drop-oldest", "coalesce"} {
+		p, err := ParseOverflowPolicy(name)
+		no(err)
+		eq(p.String(), name)
+	}
+	_, err := ParseOverflowPolicy("block")
+	ok(err != nil)
+}
+
+func TestOverflowDisconnects(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	c := newQueueTestClient(1, overflowDisconnect)
+	ok(c.send([]byte(`{"d":[{"k":"a"}]}`)))
+	ok(!c.send([]byte(`{"d":[{"k":"b"}]}`)), "full")
+	eq(queued(c), []string{`{"d":[{"k":"a"}]}`})
+	eq(c.stats.counts.dropped, int64(1))
+}
+
+func TestOverflowDropsOldest(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	c := newQueueTestClient(2, overflowDropOldest)
+	for _, msg := range []string{`{"d":[1]}`, `{"d":[2]}`, `{"d":[3]}`} {
+		ok(c.send([]byte(msg)))
+	}
+	eq(queued(c), []string{`{"d":[2]}`, `{"d":[3]}`})
+	eq(c.overflows, 1)
+}
+
+func TestOverflowCoalesces(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	c := newQueueTestClient(2, overflowCoalesce)
+	for _, msg := range []string{`{"p":{"c":{}}}`, `{"d":[1]}`, `{"d":[2,3]}`} {
+		ok(c.send([]byte(msg)))
+	}
+	eq(queued(c), []string{`{"p":{"c":{}}}`, `{"d":[1,2,3]}`})
+
+	// Too many changes to merge: the client reloads instead.
+	c = newQueueTestClient(2, overflowCoalesce)
+	for _, msg := range []string{`{"d":[1]}`, `{"p":{"c":{}}}`, `{"d":[2]}`} {
+		ok(c.send([]byte(msg)))
+	}
+	eq(queued(c), []string{string(resetMsg)})
+	eq(c.stats.counts.dropped, int64(3))
+}
+
+func TestCoalesce(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	var got []string
+	for _, msg := range coalesce([][]byte{
+		[]byte(`{"d":[{"k":"a"}]}`),
+		[]byte(`{"d":[{"k":"b"},{"k":"c"}]}`),
+		[]byte(`{"p":{"c":{}}}`),
+		[]byte(`{"d":[{"k":"d"}]}`),
+		[]byte(`{"d":[],"u":"x"}`),
+	}) {
+		got = append(got, string(msg))
+	}
+	eq(got, []string{
+		`{"d":[{"k":"a"},{"k":"b"},{"k":"c"}]}`,
+		`{"p":{"c":{}}}`,
+		`{"d":[{"k":"d"}]}`,
+		`{"d":[],"u":"x"}`,
+	})
+}
@@ -0,0 +1,302 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+const anonymousUploader = "anonymous"
+
+var (
+	errUploadTooLarge = errors.New("upload exceeds maximum size")
+	errQuotaExceeded  = errors.New("upload quota exceeded")
+)
+
+// UploadQuotas records who uploaded each file, and how large it is, to cap how much each uploader stores.
+// Uploaders are API access keys ("key:<id>"), signed-in users ("user:<subject>"), or, without auth, "anonymous".
+//
+// Files uploaded before quotas were recorded are not counted.
+type UploadQuotas struct {
+	lock    sync.Mutex
+	path    string                  // JSON file the records are kept in
+	limit   int64                   // bytes per uploader; 0 for no limit
+	maxSize int64                   // bytes per upload request; 0 for no limit
+	files   map[string]UploadedFile // file id => record
+	apps    *AppLimiter             // caps what apps store; nil if apps aren't limited
+}
+
+// UploadedFile records an uploaded file, or directory, by its id, the first component of its path under /_f/.
+type UploadedFile struct {
+	Owner string     `json:"owner"`
+	Size  int64      `json:"size"`
+	Time  *time.Time `json:"time,omitempty"` // when uploaded; nil if recorded before upload times were
+}
+
+// QuotaUsage describes how much an uploader stores.
+type QuotaUsage struct {
+	Owner string `json:"owner"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+	Limit int64  `json:"limit,omitempty"` // 0 for no limit
+}
+
+// OpenUploadQuotas loads the records kept at path, if any.
+func OpenUploadQuotas(path string, limit, maxSize int64) (*UploadQuotas, error) {
+	q := &UploadQuotas{path: path, limit: limit, maxSize: maxSize, files: make(map[string]UploadedFile)}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return q, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &q.files); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// identifyUploader returns who is uploading, or false if the request is not allowed to upload.
+func identifyUploader(kc keychain.Authenticator, auth *Auth, r *http.Request) (string, bool) {
+	if kc.Allow(r) {
+		id, _, _ := r.BasicAuth()
+		return "key:" + id, true
+	}
+	if auth == nil {
+		return anonymousUploader, true
+	}
+	if session := auth.identify(r); session != nil {
+		return "user:" + session.subject, true
+	}
+	return "", false
+}
+
+// allowance returns how many bytes owner may upload in one request, or -1 if there is no limit.
+func (q *UploadQuotas) allowance(owner string) int64 {
+	if q == nil {
+		return -1
+	}
+	n := int64(-1)
+	if q.maxSize > 0 {
+		n = q.maxSize
+	}
+	if q.limit > 0 || q.apps != nil {
+		q.lock.Lock()
+		used := q.used(owner)
+		q.lock.Unlock()
+		if q.limit > 0 {
+			if left := max(q.limit-used, 0); n < 0 || left < n {
+				n = left
+			}
+		}
+		if left := q.apps.storageLeft(owner, used); left >= 0 && (n < 0 || left < n) {
+			n = left
+		}
+	}
+	return n
+}
+
+// check fails if owner may not upload size bytes in one request.
+func (q *UploadQuotas) check(owner string, size int64) error {
+	if q == nil {
+		return nil
+	}
+	if q.maxSize > 0 && size > q.maxSize {
+		return errUploadTooLarge
+	}
+	q.lock.Lock()
+	used := q.used(owner)
+	q.lock.Unlock()
+	if q.limit > 0 && used+size > q.limit {
+		return errQuotaExceeded
+	}
+	return q.apps.store(owner, used+size) // which may only warn
+}
+
+func (q *UploadQuotas) used(owner string) int64 {
+	var n int64
+	for _, f := range q.files {
+		if f.Owner == owner {
+			n += f.Size
+		}
+	}
+	return n
+}
+
+// add records files uploaded by owner, by id.
+func (q *UploadQuotas) add(owner string, files []storedFile) {
+	if q == nil || len(files) == 0 {
+		return
+	}
+	sizes := make(map[string]int64)
+	for _, f := range files {
+		sizes[f.id()] += f.size
+	}
+	now := time.Now().UTC()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for id, size := range sizes {
+		q.files[id] = UploadedFile{owner, size, &now}
+	}
+	q.save()
+}
+
+// remove forgets a deleted file, crediting its owner.
+func (q *UploadQuotas) remove(id string) {
+	if q == nil {
+		return
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, ok := q.files[id]; !ok {
+		return
+	}
+	delete(q.files, id)
+	q.save()
+}
+
+// save writes the records to disk, replacing the previous copy only once written.
+func (q *UploadQuotas) save() {
+	b, err := json.Marshal(q.files)
+	if err != nil {
+		echo(Log{"t": "upload_quota", "error": err.Error()})
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(q.path), 0700); err != nil {
+		echo(Log{"t": "upload_quota", "error": err.Error()})
+		return
+	}
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		echo(Log{"t": "upload_quota", "error": err.Error()})
+		return
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		echo(Log{"t": "upload_quota", "error": err.Error()})
+	}
+}
+
+// uploads returns a copy of the records, by file id.
+func (q *UploadQuotas) uploads() map[string]UploadedFile {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	files := make(map[string]UploadedFile, len(q.files))
+	for id, f := range q.files {
+		files[id] = f
+	}
+	return files
+}
+
+// usage describes how much owner stores.
+func (q *UploadQuotas) usage(owner string) QuotaUsage {
+	u := QuotaUsage{Owner: owner, Limit: q.limit}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, f := range q.files {
+		if f.Owner == owner {
+			u.Files++
+			u.Bytes += f.Size
+		}
+	}
+	return u
+}
+
+// all describes how much each uploader stores, largest first.
+func (q *UploadQuotas) all() []QuotaUsage {
+	q.lock.Lock()
+	byOwner := make(map[string]*QuotaUsage)
+	for _, f := range q.files {
+		u, ok := byOwner[f.Owner]
+		if !ok {
+			u = &QuotaUsage{Owner: f.Owner, Limit: q.limit}
+			byOwner[f.Owner] = u
+		}
+		u.Files++
+		u.Bytes += f.Size
+	}
+	q.lock.Unlock()
+	usages := make([]QuotaUsage, 0, len(byOwner))
+	for _, u := range byOwner {
+		usages = append(usages, *u)
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		if usages[i].Bytes != usages[j].Bytes {
+			return usages[i].Bytes > usages[j].Bytes
+		}
+		return usages[i].Owner < usages[j].Owner
+	})
+	return usages
+}
+
+// rejectUpload responds to an upload that exceeds a limit.
+func rejectUpload(w http.ResponseWriter, err error) {
+	if err == errQuotaExceeded {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+}
+
+// QuotaHandler reports upload quota usage: the caller's own, or, for admins, everyone's.
+//
+//	GET /_quota
+//	GET /_admin/quotas
+type QuotaHandler struct {
+	quotas   *UploadQuotas
+	keychain keychain.Authenticator // nil for admins
+	auth     *Auth
+	admins   keychain.Authenticator
+}
+
+func newQuotaHandler(quotas *UploadQuotas, keychain keychain.Authenticator, auth *Auth) http.Handler {
+	return &QuotaHandler{quotas, keychain, auth, nil}
+}
+
+func newQuotaAdminHandler(quotas *UploadQuotas, admins keychain.Authenticator) http.Handler {
+	return &QuotaHandler{quotas, nil, nil, admins}
+}
+
+func (h *QuotaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var res any
+	if h.admins != nil {
+		if !h.admins.Guard(w, r) {
+			return
+		}
+		res = h.quotas.all()
+	} else {
+		owner, ok := identifyUploader(h.keychain, h.auth, r)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		res = h.quotas.usage(owner)
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"github.com/h2oai/wave/pkg/keychain/keychaintest"
+)
+
+func TestUploadQuotas(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	path := filepath.Join(t.TempDir(), "quotas.json")
+	q, err := OpenUploadQuotas(path, 100, 60)
+	no(err)
+
+	eq(q.allowance("alice"), int64(60)) // capped by the upload size
+	no(q.check("alice", 60))
+	eq(q.check("alice", 61), errUploadTooLarge)
+
+	q.add("alice", []storedFile{{"f1/a.txt", 30}, {"f1/b.txt", 20}, {"f2/c.txt", 10}})
+	eq(q.usage("alice"), QuotaUsage{Owner: "alice", Files: 2, Bytes: 60, Limit: 100})
+	eq(q.allowance("alice"), int64(40)) // capped by the quota
+	no(q.check("alice", 40))
+	eq(q.check("alice", 41), errQuotaExceeded)
+	eq(q.allowance("bob"), int64(60)) // quotas are per uploader
+	no(q.check("bob", 60))
+
+	q.add("bob", []storedFile{{"f3/d.txt", 50}})
+	eq(q.all(), []QuotaUsage{{"alice", 2, 60, 100}, {"bob", 1, 50, 100}})
+
+	// Records survive restarts.
+	q, err = OpenUploadQuotas(path, 100, 60)
+	no(err)
+	files := q.uploads()
+	eq(len(files), 3)
+	eq(files["f1"].Owner, "alice")
+	eq(files["f1"].Size, int64(50))
+	ok(files["f1"].Time != nil)
+
+	// Deleting a file credits its owner.
+	q.remove("f1")
+	q.remove("f1")
+	q.remove("unknown")
+	eq(q.usage("alice"), QuotaUsage{Owner: "alice", Files: 1, Bytes: 10, Limit: 100})
+	eq(q.allowance("alice"), int64(60))
+	q, err = OpenUploadQuotas(path, 100, 60)
+	no(err)
+	eq(len(q.uploads()), 2)
+
+	// Without limits, anything goes.
+	q, err = OpenUploadQuotas(filepath.Join(t.TempDir(), "quotas.json"), 0, 0)
+	no(err)
+	q.add("alice", []storedFile{{"f1/a.txt", 1 << 40}})
+	eq(q.allowance("alice"), int64(-1))
+	no(q.check("alice", 1<<40))
+
+	var none *UploadQuotas
+	eq(none.allowance("alice"), int64(-1))
+	no(none.check("alice", 1<<40))
+	none.add("alice", []storedFile{{"f1/a.txt", 1}})
+	none.remove("f1")
+}
+
+func TestUploadQuotasCutOffUploads(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	kc, keys := keychaintest.New(t, 1)
+	owner := "key:" + keys[0].ID
+	dir := t.TempDir()
+	q, err := OpenUploadQuotas(filepath.Join(dir, "quotas.json"), 4000, 2000)
+	no(err)
+	fs := newFileServer(filepath.Join(dir, "files"), nil, kc, nil, "/_f", fileServerConf{quotas: q})
+
+	upload := func(size int, unknownLength bool) *httptest.ResponseRecorder {
+		var b bytes.Buffer
+		mw := multipart.NewWriter(&b)
+		fw, err := mw.CreateFormFile("files", "data.bin")
+		no(err)
+		_, err = fw.Write(bytes.Repeat([]byte("x"), size))
+		no(err)
+		no(mw.Close())
+		var body io.Reader = &b
+		if unknownLength {
+			body = io.MultiReader(&b) // e.g. chunked; can't be checked upfront
+		}
+		r := httptest.NewRequest(http.MethodPost, "/_f", body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		r.SetBasicAuth(keys[0].ID, keys[0].Secret)
+		w := httptest.NewRecorder()
+		fs.ServeHTTP(w, r)
+		return w
+	}
+
+	w := upload(1000, true)
+	eq(w.Code, http.StatusOK)
+	var res UploadResponse
+	no(json.NewDecoder(w.Body).Decode(&res))
+	eq(len(res.Files), 1)
+	eq(q.usage(owner).Bytes, int64(1000))
+
+	// Too large for one request: rejected upfront if the length is known, else cut off once read.
+	eq(upload(3000, false).Code, http.StatusRequestEntityTooLarge)
+	w = upload(3000, true)
+	eq(w.Code, http.StatusRequestEntityTooLarge)
+	ok(strings.Contains(w.Body.String(), errUploadTooLarge.Error()))
+	eq(q.usage(owner).Bytes, int64(1000))
+
+	w = upload(1500, true)
+	eq(w.Code, http.StatusOK)
+	eq(q.usage(owner).Bytes, int64(2500))
+
+	// Over quota: rejected upfront if the length is known, else cut off once read.
+	eq(upload(1600, false).Code, http.StatusForbidden)
+	w = upload(1600, true)
+	eq(w.Code, http.StatusForbidden)
+	ok(strings.Contains(w.Body.String(), errQuotaExceeded.Error()))
+	eq(q.usage(owner), QuotaUsage{Owner: owner, Files: 2, Bytes: 2500, Limit: 4000})
+}
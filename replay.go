@@ -0,0 +1,144 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// replayLog keeps recent messages published to each route, so that clients that reconnect after a network blip
+// can catch up on what they missed instead of reloading.
+//
+// Messages are numbered by the broker in the order they are published, across routes, and are logged before
+// they are sent. Each route keeps messages for up to maxAge, and up to maxSize bytes.
+// The log is only accessed from the broker's goroutine.
+type replayLog struct {
+	maxSize int64
+	maxAge  time.Duration
+	routes  map[string]*routeLog
+}
+
+type routeLog struct {
+	entries []replayEntry
+	size    int64
+	evicted uint64 // sequence number of the latest message evicted, if any
+}
+
+type replayEntry struct {
+	seq  uint64
+	time time.Time
+	data []byte
+}
+
+// Replay requests messages published to a reconnecting client's routes after seq.
+type Replay struct {
+	client *Client
+	seq    uint64
+	done   chan struct{}
+}
+
+func newReplayLog(maxSize int64, maxAge time.Duration) *replayLog {
+	if maxSize <= 0 {
+		return nil
+	}
+	return &replayLog{maxSize: maxSize, maxAge: maxAge, routes: make(map[string]*routeLog)}
+}
+
+// append logs a numbered message published to a route.
+func (l *replayLog) append(route string, seq uint64, data []byte) {
+	if l == nil {
+		return
+	}
+	r, ok := l.routes[route]
+	if !ok {
+		r = &routeLog{}
+		l.routes[route] = r
+	}
+	r.entries = append(r.entries, replayEntry{seq, time.Now(), data})
+	r.size += int64(len(data))
+	l.trim(r)
+}
+
+// trim evicts a route's messages that are too old, or don't fit.
+func (l *replayLog) trim(r *routeLog) {
+	n := 0
+	for _, e := range r.entries {
+		if r.size <= l.maxSize && (l.maxAge <= 0 || time.Since(e.time) <= l.maxAge) {
+			break
+		}
+		r.size -= int64(len(e.data))
+		r.evicted = e.seq
+		n++
+	}
+	if n > 0 {
+		r.entries = append(r.entries[:0:0], r.entries[n:]...)
+	}
+}
+
+// drop forgets a route, once no client watches it.
+func (l *replayLog) drop(route string) {
+	if l == nil {
+		return
+	}
+	delete(l.routes, route)
+}
+
+// since returns the messages published to routes after seq, in order,
+// or false if some of them have been evicted.
+func (l *replayLog) since(routes []string, seq uint64) ([][]byte, bool) {
+	var entries []replayEntry
+	for _, route := range routes {
+		r, ok := l.routes[route]
+		if !ok {
+			continue
+		}
+		l.trim(r)
+		if r.evicted > seq {
+			return nil, false
+		}
+		for _, e := range r.entries {
+			if e.seq > seq {
+				entries = append(entries, e)
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	msgs := make([][]byte, len(entries))
+	for i, e := range entries {
+		msgs[i] = e.data
+	}
+	return msgs, true
+}
+
+// numberMsg adds a sequence number to a message, e.g. {"d":[...]} => {"q":42,"d":[...]},
+// and if ack is set, asks clients to acknowledge it, e.g. {"q":42,"a":1,"d":[...]}.
+func numberMsg(data []byte, seq uint64, ack bool) []byte {
+	if len(data) < 2 || data[0] != '{' {
+		return data
+	}
+	b := make([]byte, 0, len(data)+32)
+	b = append(b, `{"q":`...)
+	b = strconv.AppendUint(b, seq, 10)
+	if ack {
+		b = append(b, `,"a":1`...)
+	}
+	if rest := bytes.TrimLeft(data[1:], " \t\r\n"); len(rest) > 0 && rest[0] != '}' {
+		b = append(b, ',')
+	}
+	return append(b, data[1:]...)
+}
@@ -0,0 +1,70 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+// ReplicaHandler accepts keychain changes pushed by peer servers, authenticated against the admin keychain.
+type ReplicaHandler struct {
+	admins         keychain.Authenticator
+	replicator     *keychain.Replicator
+	maxRequestSize int64
+}
+
+func newReplicaHandler(admins keychain.Authenticator, replicator *keychain.Replicator, maxRequestSize int64) *ReplicaHandler {
+	return &ReplicaHandler{admins, replicator, maxRequestSize}
+}
+
+func (h *ReplicaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.admins.Guard(w, r) {
+		return
+	}
+	b, err := readRequestWithLimit(w, r.Body, h.maxRequestSize)
+	if err != nil {
+		echo(Log{"t": "read replica request body", "error": err.Error()})
+		if isRequestTooLarge(err) {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	var ms []keychain.Mutation
+	if err := json.Unmarshal(b, &ms); err != nil {
+		echo(Log{"t": "json_unmarshal", "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if err := h.replicator.Merge(ms); err != nil {
+		echo(Log{"t": "replica_merge", "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+}
+
+func runReplicator(conf ServerConf) {
+	conf.Replicator.Run(conf.ReplicaSyncInterval, nil, func(peer string, err error) {
+		echo(Log{"t": "replica_push", "peer": peer, "error": err.Error()})
+	})
+}
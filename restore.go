@@ -26,6 +26,8 @@ var (
 	logSep = []byte(" ")
 )
 
+const maxAOFLine = 256 * 1024 * 1024 // compacted pages are written on one line each
+
 func initSite(site *Site, aofPath string) {
 	file, err := os.Open(aofPath)
 	if err != nil {
@@ -36,7 +38,8 @@ func initSite(site *Site, aofPath string) {
 	startTime := time.Now()
 	line, used := 0, 0
 	scanner := bufio.NewScanner(file)
-	for scanner.Scan() { // FIXME not reliable if line length > 65536 chars
+	scanner.Buffer(make([]byte, 64*1024), maxAOFLine)
+	for scanner.Scan() {
 		line++
 		data := scanner.Bytes()
 		tokens := bytes.SplitN(data, logSep, 4) // "date time marker entry"
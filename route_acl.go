@@ -0,0 +1,337 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+// RouteACL lists who may watch, read and change the pages at a route. Principals are:
+//
+//	user:<subject or username>  a signed-in user
+//	group:<name>                users in a group
+//	key:<id>                    an app or script using an API access key; key:* for any
+//	scope:<scope>               API access keys with a scope, as recorded by key policies
+//	*                           anyone
+type RouteACL struct {
+	Route string   `json:"route"`           // e.g. /reports/q1, or /reports/* for every route under /reports/
+	Read  []string `json:"read,omitempty"`  // may watch and read pages; writers may too
+	Write []string `json:"write,omitempty"` // may change pages
+	Owner string   `json:"owner,omitempty"` // key:<id> of the app that set the ACL, which may always change pages
+}
+
+func (acl *RouteACL) validate() error {
+	if !strings.HasPrefix(acl.Route, "/") {
+		return fmt.Errorf("invalid route %q: want /path or /path/*", acl.Route)
+	}
+	if i := strings.Index(acl.Route, "*"); i >= 0 && (i != len(acl.Route)-1 || !strings.HasSuffix(acl.Route, "/*")) {
+		return fmt.Errorf("invalid route %q: * is allowed only at the end, after /", acl.Route)
+	}
+	for _, p := range append(append([]string{}, acl.Read...), acl.Write...) {
+		if p == "*" {
+			continue
+		}
+		kind, name, ok := strings.Cut(p, ":")
+		if !ok || name == "" {
+			return fmt.Errorf("invalid principal %q: want user:, group:, key:, scope: or *", p)
+		}
+		switch kind {
+		case "user", "group", "key", "scope":
+		default:
+			return fmt.Errorf("invalid principal %q: want user:, group:, key:, scope: or *", p)
+		}
+	}
+	return nil
+}
+
+// RouteACLs is a RouteAuthorizer that enforces access control lists set on routes, by apps or admins. Routes without
+// an ACL are open to everyone. ACLs are kept in a JSON file, replaced only once written.
+type RouteACLs struct {
+	lock     sync.RWMutex
+	path     string
+	keychain *keychain.Keychain // to look up the scopes of API access keys
+	acls     map[string]RouteACL
+}
+
+// OpenRouteACLs loads the ACLs kept at path, if any.
+func OpenRouteACLs(path string, kc *keychain.Keychain) (*RouteACLs, error) {
+	a := &RouteACLs{path: path, keychain: kc, acls: make(map[string]RouteACL)}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return a, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &a.acls); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// find returns the ACL of a route: its own, else that of the closest route above it ending in /*.
+func (a *RouteACLs) find(route string) (RouteACL, bool) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	if acl, ok := a.acls[route]; ok {
+		return acl, true
+	}
+	for p := route; p != ""; {
+		i := strings.LastIndex(p, "/")
+		if i < 0 {
+			break
+		}
+		p = p[:i]
+		if acl, ok := a.acls[p+"/*"]; ok {
+			return acl, true
+		}
+	}
+	return RouteACL{}, false
+}
+
+func (a *RouteACLs) Authorize(id Identity, action RouteAction, route string) bool {
+	acl, ok := a.find(route)
+	if !ok {
+		return true
+	}
+	if id.Key != "" && "key:"+id.Key == acl.Owner {
+		return true
+	}
+	if a.match(id, acl.Write) {
+		return true
+	}
+	return action != RoutePublish && a.match(id, acl.Read)
+}
+
+// match reports whether id is any of principals.
+func (a *RouteACLs) match(id Identity, principals []string) bool {
+	for _, p := range principals {
+		if p == "*" {
+			return true
+		}
+		kind, name, _ := strings.Cut(p, ":")
+		switch kind {
+		case "user":
+			if id.Key == "" && (name == id.Subject || name == id.Username) {
+				return true
+			}
+		case "group":
+			if id.Key == "" {
+				for _, g := range id.Groups {
+					if g == name {
+						return true
+					}
+				}
+			}
+		case "key":
+			if id.Key != "" && (name == "*" || name == id.Key) {
+				return true
+			}
+		case "scope":
+			if id.Key != "" && a.keychain != nil {
+				if e, ok := a.keychain.Get(id.Key); ok && e.HasScope(name) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (a *RouteACLs) get(route string) (RouteACL, bool) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	acl, ok := a.acls[route]
+	return acl, ok
+}
+
+func (a *RouteACLs) all() []RouteACL {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	acls := make([]RouteACL, 0, len(a.acls))
+	for _, acl := range a.acls {
+		acls = append(acls, acl)
+	}
+	sort.Slice(acls, func(i, j int) bool { return acls[i].Route < acls[j].Route })
+	return acls
+}
+
+func (a *RouteACLs) set(acl RouteACL) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.acls[acl.Route] = acl
+	return a.save()
+}
+
+func (a *RouteACLs) remove(route string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.acls, route)
+	return a.save()
+}
+
+// save writes the ACLs to disk, replacing the previous copy only once written.
+func (a *RouteACLs) save() error {
+	b, err := json.Marshal(a.acls)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(a.path), 0700); err != nil {
+		return err
+	}
+	tmp := a.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+// routeAuthorizers allows an action only if every authorizer does.
+type routeAuthorizers []RouteAuthorizer
+
+func (as routeAuthorizers) Authorize(id Identity, action RouteAction, route string) bool {
+	for _, a := range as {
+		if !a.Authorize(id, action, route) {
+			return false
+		}
+	}
+	return true
+}
+
+// RouteACLHandler lets apps, and admins, manage the ACLs of routes.
+//
+//	GET    /_acl/<route>        get the ACL of a route
+//	PUT    /_acl/<route>        set it: {"read": ["group:finance"], "write": ["key:*"]}
+//	DELETE /_acl/<route>        remove it
+//
+// Apps may set ACLs only on routes they may change, and keep the right to change them; the app that first set an ACL
+// stays its owner, and only it may remove it. ACLs of routes ending in /*, which apply to every route below without
+// one, are set by admins only. Admins manage every ACL at /_admin/acls/<route>, and list them all at /_admin/acls/.
+type RouteACLHandler struct {
+	prefix         string
+	acls           *RouteACLs
+	broker         *Broker
+	keychain       keychain.Authenticator // apps; nil if admins
+	admins         keychain.Authenticator
+	maxRequestSize int64
+}
+
+func newRouteACLHandler(prefix string, acls *RouteACLs, broker *Broker, keychain keychain.Authenticator, maxRequestSize int64) http.Handler {
+	return &RouteACLHandler{prefix, acls, broker, keychain, nil, maxRequestSize}
+}
+
+func newRouteACLAdminHandler(prefix string, acls *RouteACLs, broker *Broker, admins keychain.Authenticator, maxRequestSize int64) http.Handler {
+	return &RouteACLHandler{prefix, acls, broker, nil, admins, maxRequestSize}
+}
+
+func (h *RouteACLHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var key string
+	if h.admins != nil {
+		if !h.admins.Guard(w, r) {
+			return
+		}
+	} else {
+		if !h.keychain.Guard(w, r) {
+			return
+		}
+		key, _, _ = r.BasicAuth()
+	}
+	route := "/" + strings.TrimPrefix(r.URL.Path, h.prefix)
+
+	if route == "/" && h.admins != nil && r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.acls.all())
+		return
+	}
+
+	// Apps may manage the ACLs only of routes they may change, and not of every route under a path.
+	if key != "" {
+		if strings.HasSuffix(route, "*") && r.Method != http.MethodGet {
+			http.Error(w, "ACLs of routes ending in /* are set by admins only", http.StatusForbidden)
+			return
+		}
+		if !h.broker.authorize(Identity{Key: key}, RoutePublish, strings.TrimSuffix(route, "*")) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		acl, ok := h.acls.get(route)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(acl)
+	case http.MethodPut:
+		b, err := readRequestWithLimit(w, r.Body, h.maxRequestSize)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		var acl RouteACL
+		if err := json.Unmarshal(b, &acl); err != nil {
+			http.Error(w, "invalid ACL: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		acl.Route, acl.Owner = route, ""
+		if prev, ok := h.acls.get(route); ok {
+			acl.Owner = prev.Owner // writers may change an ACL, but not take it over
+		} else if key != "" {
+			acl.Owner = "key:" + key
+		}
+		if err := acl.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.acls.set(acl); err != nil {
+			echo(Log{"t": "route_acl", "route": route, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		echo(Log{"t": "route_acl", "route": route, "by": h.by(key), "read": strings.Join(acl.Read, ","), "write": strings.Join(acl.Write, ",")})
+	case http.MethodDelete:
+		if prev, ok := h.acls.get(route); ok && key != "" && prev.Owner != "key:"+key {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if err := h.acls.remove(route); err != nil {
+			echo(Log{"t": "route_acl", "route": route, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		echo(Log{"t": "route_acl", "route": route, "by": h.by(key), "removed": "true"})
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *RouteACLHandler) by(key string) string {
+	if key == "" {
+		return "admin"
+	}
+	return "key:" + key
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"github.com/h2oai/wave/pkg/keychain"
+	"github.com/h2oai/wave/pkg/keychain/keychaintest"
+)
+
+type aclTest struct {
+	acls   *RouteACLs
+	apps   http.Handler
+	admins http.Handler
+	keys   []keychain.Credential
+	admin  keychain.Credential
+}
+
+func newACLTest(t *testing.T) *aclTest {
+	acls, err := OpenRouteACLs(filepath.Join(t.TempDir(), "acls.json"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kc, keys := keychaintest.New(t, 2)
+	admins, admin := keychaintest.New(t, 1)
+	broker := &Broker{authz: acls}
+	return &aclTest{
+		acls,
+		newRouteACLHandler("/_acl/", acls, broker, kc, 1024),
+		newRouteACLAdminHandler("/_admin/acls/", acls, broker, admins, 1024),
+		keys,
+		admin[0],
+	}
+}
+
+func (a *aclTest) do(h http.Handler, cred keychain.Credential, method, url, body string) int {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	r.SetBasicAuth(cred.ID, cred.Secret)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestRouteACLAuthorize(t *testing.T) {
+	_, ok, no := assert.Assert(t)
+	a := newACLTest(t)
+	no(a.acls.set(RouteACL{Route: "/reports/*", Read: []string{"group:finance"}, Write: []string{"key:writer"}}))
+	no(a.acls.set(RouteACL{Route: "/reports/public", Read: []string{"*"}, Owner: "key:owner"}))
+
+	alice := Identity{Subject: "alice", Groups: []string{"finance"}}
+	bob := Identity{Subject: "bob", Groups: []string{"sales"}}
+	ok(a.acls.Authorize(alice, RouteSubscribe, "/reports/q1"), "reader may watch")
+	ok(!a.acls.Authorize(alice, RoutePublish, "/reports/q1"), "reader may not change")
+	ok(!a.acls.Authorize(bob, RouteSubscribe, "/reports/q1"), "others may not watch")
+	ok(a.acls.Authorize(Identity{Key: "writer"}, RoutePublish, "/reports/q1/deep"), "wildcard covers routes below")
+	ok(a.acls.Authorize(bob, RouteSubscribe, "/reports/public"), "own ACL overrides wildcard")
+	ok(!a.acls.Authorize(Identity{Key: "writer"}, RoutePublish, "/reports/public"), "wildcard doesn't apply to routes with an ACL")
+	ok(a.acls.Authorize(Identity{Key: "owner"}, RoutePublish, "/reports/public"), "owner may always change")
+	ok(a.acls.Authorize(bob, RoutePublish, "/sales"), "routes without an ACL are open")
+}
+
+func TestRouteACLWildcardsAreAdminOnly(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	a := newACLTest(t)
+	eq(a.do(a.apps, a.keys[0], http.MethodPut, "/_acl/*", `{"write": ["key:`+a.keys[0].ID+`"]}`), http.StatusForbidden)
+	eq(a.do(a.apps, a.keys[0], http.MethodPut, "/_acl/reports/*", `{"write": ["key:`+a.keys[0].ID+`"]}`), http.StatusForbidden)
+	_, found := a.acls.get("/*")
+	ok(!found, "app set a wildcard ACL")
+
+	eq(a.do(a.admins, a.admin, http.MethodPut, "/_admin/acls/reports/*", `{"read": ["*"]}`), http.StatusOK)
+	eq(a.do(a.apps, a.keys[0], http.MethodDelete, "/_acl/reports/*", ""), http.StatusForbidden)
+	_, found = a.acls.get("/reports/*")
+	ok(found, "app removed a wildcard ACL")
+}
+
+func TestRouteACLOwnerIsKept(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	a := newACLTest(t)
+	owner, writer := a.keys[0], a.keys[1]
+	eq(a.do(a.apps, owner, http.MethodPut, "/_acl/sales", `{"write": ["key:*"]}`), http.StatusOK)
+
+	// Writers may change the ACL, but not take it over.
+	eq(a.do(a.apps, writer, http.MethodPut, "/_acl/sales", `{"write": ["key:`+writer.ID+`"]}`), http.StatusOK)
+	acl, _ := a.acls.get("/sales")
+	eq(acl.Owner, "key:"+owner.ID)
+	eq(a.do(a.apps, owner, http.MethodPut, "/_acl/sales", `{"write": []}`), http.StatusOK)
+	eq(a.do(a.apps, writer, http.MethodPut, "/_acl/sales", `{"write": ["key:*"]}`), http.StatusForbidden)
+
+	// Only the owner may remove it.
+	eq(a.do(a.apps, owner, http.MethodPut, "/_acl/sales", `{"write": ["key:*"]}`), http.StatusOK)
+	eq(a.do(a.apps, writer, http.MethodDelete, "/_acl/sales", ""), http.StatusForbidden)
+	eq(a.do(a.apps, owner, http.MethodDelete, "/_acl/sales", ""), http.StatusOK)
+}
+
+func TestRouteACLsApplyToMQTT(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	a := newACLTest(t)
+	writer, other := a.keys[0], a.keys[1]
+	no(a.acls.set(RouteACL{Route: "/dashboard", Read: []string{"*"}, Write: []string{"key:" + writer.ID}}))
+
+	broker := &Broker{authz: a.acls, publish: make(chan Pub, 10), noStore: true, noLog: true}
+	handle := handleMQTT(parseMQTTRoutes(map[string]string{"sensors/+/temperature": "/dashboard + value"}), broker)
+
+	handle(other.ID, "sensors/kitchen/temperature", []byte("21.5"))
+	eq(len(broker.publish), 0)
+	handle(writer.ID, "sensors/kitchen/temperature", []byte("21.5"))
+	eq(len(broker.publish), 1)
+	pub := <-broker.publish
+	eq(pub.route, "/dashboard")
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// Identity represents who is watching or changing a page: a user, or an app or script using an API access key.
+type Identity struct {
+	Key      string   `json:"key,omitempty"`      // ID of the API access key used; empty for users
+	Subject  string   `json:"subject,omitempty"`  // user's subject; "anon" if auth is disabled, "guest" for guests
+	Username string   `json:"username,omitempty"` // user's username
+	Groups   []string `json:"groups,omitempty"`   // user's groups, if any
+}
+
+// RouteAction represents what an identity is about to do on a route.
+type RouteAction string
+
+const (
+	// RouteSubscribe is a browser starting to watch a page or app.
+	RouteSubscribe RouteAction = "subscribe"
+	// RoutePublish is a change to a page, made through the API or by a user editing it.
+	RoutePublish RouteAction = "publish"
+	// RouteRead is a page's content being read through the API, e.g. to export or snapshot it.
+	RouteRead RouteAction = "read"
+)
+
+// RouteAuthorizer decides who may watch and change which pages, e.g. to enforce per-page access control lists
+// in one place. Authorizers are called synchronously as browsers subscribe and as changes are published,
+// and must be safe for concurrent use.
+type RouteAuthorizer interface {
+	Authorize(id Identity, action RouteAction, route string) bool
+}
+
+// RouteAuthorizerFunc adapts an ordinary function to a RouteAuthorizer.
+type RouteAuthorizerFunc func(id Identity, action RouteAction, route string) bool
+
+// Authorize calls f(id, action, route).
+func (f RouteAuthorizerFunc) Authorize(id Identity, action RouteAction, route string) bool {
+	return f(id, action, route)
+}
+
+// RouteAuthzRequest represents a question to a RouteWebhook.
+type RouteAuthzRequest struct {
+	Identity
+	Action RouteAction `json:"action"`
+	Route  string      `json:"route"`
+}
+
+type routeVerdict struct {
+	allowed bool
+	at      time.Time
+}
+
+// RouteWebhook is a RouteAuthorizer that delegates to an external service over HTTP.
+// Each question is POSTed as JSON; a 200 OK response allows the action, anything else denies it,
+// as does a failure to reach the service. Answers are cached for a TTL, since apps may publish many changes a second.
+type RouteWebhook struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+	cache  *lru.Cache
+}
+
+// NewRouteWebhook creates a RouteWebhook that posts questions to url, and caches answers for ttl.
+func NewRouteWebhook(url string, timeout, ttl time.Duration) (*RouteWebhook, error) {
+	cache, err := lru.New(10000)
+	if err != nil {
+		return nil, err
+	}
+	return &RouteWebhook{url, ttl, &http.Client{Timeout: timeout}, cache}, nil
+}
+
+func (h *RouteWebhook) Authorize(id Identity, action RouteAction, route string) bool {
+	key := strings.Join([]string{id.Key, id.Subject, strings.Join(id.Groups, ","), string(action), route}, "\x00")
+	now := time.Now()
+	if v, ok := h.cache.Get(key); ok {
+		if v := v.(routeVerdict); now.Sub(v.at) < h.ttl {
+			return v.allowed
+		}
+	}
+	b, err := json.Marshal(RouteAuthzRequest{id, action, route})
+	if err != nil {
+		return false
+	}
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		echo(Log{"t": "route_authz", "route": route, "action": string(action), "error": err.Error()})
+		return false
+	}
+	resp.Body.Close()
+	allowed := resp.StatusCode == http.StatusOK
+	if allowed || resp.StatusCode == http.StatusForbidden { // don't remember failures
+		h.cache.Add(key, routeVerdict{allowed, now})
+	} else {
+		echo(Log{"t": "route_authz", "route": route, "action": string(action), "error": resp.Status})
+	}
+	return allowed
+}
+
+// authorize reports whether id may take action on route. Everything is allowed if there's no authorizer.
+func (b *Broker) authorize(id Identity, action RouteAction, route string) bool {
+	if b.authz == nil || b.authz.Authorize(id, action, route) {
+		return true
+	}
+	echo(Log{"t": "route_authz", "route": route, "action": string(action), "key": id.Key, "subject": id.Subject, "error": "forbidden"})
+	return false
+}
@@ -0,0 +1,186 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/h2oai/wave/pkg/saml"
+)
+
+// samlProviderName identifies the SAML identity provider at login, alongside OIDC providers.
+const samlProviderName = "saml"
+
+// samlProvider is a SAML identity provider, and Wave as its service provider.
+type samlProvider struct {
+	conf *SAMLConf
+	sp   *saml.ServiceProvider
+}
+
+func connectToSAMLProvider(conf *SAMLConf) (*samlProvider, error) {
+	b, err := readSAMLMetadata(conf.IdPMetadata)
+	if err != nil {
+		return nil, err
+	}
+	idp, err := saml.ParseMetadata(b)
+	if err != nil {
+		return nil, err
+	}
+	entityID := conf.EntityID
+	if entityID == "" {
+		entityID = strings.TrimSuffix(conf.ACSURL, "/acs") + "/metadata"
+	}
+	return &samlProvider{conf, &saml.ServiceProvider{EntityID: entityID, ACSURL: conf.ACSURL, IdP: idp}}, nil
+}
+
+// readSAMLMetadata reads the identity provider's metadata from a file or URL.
+func readSAMLMetadata(location string) ([]byte, error) {
+	if !strings.HasPrefix(location, "https://") && !strings.HasPrefix(location, "http://") {
+		b, err := os.ReadFile(location)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading SAML metadata %s: %v", location, err)
+		}
+		return b, nil
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, fmt.Errorf("failed fetching SAML metadata %s: %v", location, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed fetching SAML metadata %s: %s", location, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// identity reads the username and groups from an assertion's attributes.
+func (p *samlProvider) identity(a *saml.Assertion) (string, []string) {
+	username := a.Subject
+	if values := a.Attributes[p.conf.UsernameAttribute]; p.conf.UsernameAttribute != "" && len(values) > 0 {
+		username = values[0]
+	}
+	var groups []string
+	if p.conf.GroupsAttribute != "" {
+		groups = a.Attributes[p.conf.GroupsAttribute]
+	}
+	return username, groups
+}
+
+// samlLogin sends the user to the SAML identity provider to authenticate.
+func (auth *Auth) samlLogin(w http.ResponseWriter, r *http.Request) {
+	stepUp := r.URL.Query().Get("step_up") != "" && auth.conf.StepUp != nil
+	var opts saml.AuthnOptions
+	if stepUp {
+		opts = saml.AuthnOptions{ForceAuthn: true, AuthnContexts: auth.conf.StepUp.ACR}
+	}
+	authURL, requestID, err := auth.saml.sp.AuthnRequestURL("", opts)
+	if err != nil {
+		echo(Log{"t": "saml_authn_request", "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	successURL := auth.baseURL
+	if nextValues, ok := r.URL.Query()["next"]; ok {
+		successURL = nextValues[0]
+	}
+
+	// The request ID is the state, to be matched by the response.
+	sessionID := uuid.New().String()
+	auth.set(&Session{id: sessionID, state: requestID, saml: true, successURL: successURL, expiry: time.Now().Add(auth.conf.InactivityTimeout)})
+
+	auth.setLoginCookie(w, auth.baseURL+"_auth/saml/acs", sessionID, true) // the response is posted back
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// SAMLMetadataHandler serves Wave's service provider metadata, for registration with the identity provider.
+type SAMLMetadataHandler struct {
+	auth *Auth
+}
+
+func newSAMLMetadataHandler(auth *Auth) http.Handler {
+	return &SAMLMetadataHandler{auth}
+}
+
+func (h *SAMLMetadataHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write(h.auth.saml.sp.Metadata())
+}
+
+// SAMLAssertionHandler is the assertion consumer service, which receives responses posted by the identity provider.
+type SAMLAssertionHandler struct {
+	auth   *Auth
+	broker *Broker
+}
+
+func newSAMLAssertionHandler(auth *Auth, broker *Broker) http.Handler {
+	return &SAMLAssertionHandler{auth, broker}
+}
+
+func (h *SAMLAssertionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Retrieve saved session.
+	cookie, err := r.Cookie(loginCookieName)
+	if err != nil {
+		echo(Log{"t": "saml_cookie", "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	session, ok := h.auth.get(cookie.Value)
+	if !ok || !session.saml || session.state == "" {
+		echo(Log{"t": "saml_session", "error": "not found"})
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	assertion, err := h.auth.saml.sp.ParseResponse(r.PostFormValue("SAMLResponse"), session.state)
+	if err != nil {
+		echo(Log{"t": "saml_response", "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	username, groups := h.auth.saml.identity(assertion)
+	session.state = "" // responses are accepted once
+	session.subject = assertion.Subject
+	session.username = username
+	session.groups = groups
+	session.sid = assertion.SessionIndex
+	session.authTime = assertion.AuthnInstant
+	if session.authTime.IsZero() {
+		session.authTime = time.Now()
+	}
+	session.acr = assertion.AuthnContext
+
+	echo(Log{"t": "login", "provider": samlProviderName, "subject": session.subject, "username": session.username})
+
+	h.auth.set(session)
+	endSessions(h.broker, h.auth.limitSessions(session), "session_limit")
+
+	h.auth.clearLoginCookie(w, h.auth.baseURL+"_auth/saml/acs", true)
+	h.auth.setSessionCookie(w, session.id)
+	http.Redirect(w, r, session.successURL, http.StatusFound)
+}
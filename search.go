@@ -0,0 +1,401 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+// SearchResult is a card matching a search.
+type SearchResult struct {
+	Route   string `json:"route"`
+	Card    string `json:"card"`
+	Title   string `json:"title,omitempty"`
+	Snippet string `json:"snippet,omitempty"` // text around the first match
+	Score   int    `json:"score"`
+}
+
+// searchDoc is a card, as indexed.
+type searchDoc struct {
+	route string
+	card  string
+	title string
+	terms map[string]int // term => occurrences
+}
+
+type indexedPage struct {
+	page    *Page
+	changes uint64
+	docs    []*searchDoc
+}
+
+// SearchIndex indexes the text on cards, their titles, content, items and data buffers, to find the pages showing a
+// metric or some text. Pages are reindexed when searched, if changed since.
+//
+//	GET /_search?q=revenue+emea[&limit=20]
+//
+// Searches are made with an API access key, or by signed-in users, who find only the pages they may read. Browsers
+// are shown a search form and results; other clients get JSON.
+type SearchIndex struct {
+	baseURL  string
+	broker   *Broker
+	auth     *Auth // nil if auth is disabled
+	keychain keychain.Authenticator
+	template *template.Template
+
+	lock  sync.Mutex
+	pages map[string]*indexedPage
+	terms map[string]map[*searchDoc]bool // term => docs
+}
+
+func newSearchIndex(baseURL string, broker *Broker, auth *Auth, keychain keychain.Authenticator) *SearchIndex {
+	return &SearchIndex{
+		baseURL:  baseURL,
+		broker:   broker,
+		auth:     auth,
+		keychain: keychain,
+		template: template.Must(template.New("search").Parse(searchTemplate)),
+		pages:    make(map[string]*indexedPage),
+		terms:    make(map[string]map[*searchDoc]bool),
+	}
+}
+
+const maxSearchResults = 100
+
+func (x *SearchIndex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	id, ok := x.identify(r)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+	limit := 20
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxSearchResults)
+	}
+	query := q.Get("q")
+	results := x.search(query, func(route string) bool { return x.broker.authorize(id, RouteRead, route) }, limit)
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		x.template.Execute(w, struct {
+			Query   string
+			BaseURL string
+			Results []SearchResult
+		}{query, strings.TrimSuffix(x.baseURL, "/"), results})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// identify returns who is searching: an API access key, a signed-in user, or anyone, if auth is disabled.
+func (x *SearchIndex) identify(r *http.Request) (Identity, bool) {
+	if x.keychain.Allow(r) {
+		key, _, _ := r.BasicAuth()
+		return Identity{Key: key}, true
+	}
+	session := anonymous
+	if x.auth != nil {
+		if session = x.auth.identify(r); session == nil {
+			return Identity{}, false
+		}
+	}
+	return Identity{Subject: session.subject, Username: session.username, Groups: session.groups}, true
+}
+
+// search returns the cards on pages allowed with every word in query, or words starting with them, best first.
+func (x *SearchIndex) search(query string, allowed func(route string) bool, limit int) []SearchResult {
+	words := tokenize(query)
+	if len(words) == 0 {
+		return []SearchResult{}
+	}
+
+	x.lock.Lock()
+	x.refresh()
+	var matches map[*searchDoc]int // doc => score
+	for i, word := range words {
+		found := make(map[*searchDoc]int)
+		for term, docs := range x.terms {
+			if !strings.HasPrefix(term, word) {
+				continue
+			}
+			for doc := range docs {
+				if i > 0 {
+					if _, ok := matches[doc]; !ok {
+						continue
+					}
+				}
+				found[doc] += doc.terms[term]
+			}
+		}
+		for doc := range found {
+			if strings.Contains(strings.ToLower(doc.title), word) {
+				found[doc] += 5 // titles matter most
+			}
+		}
+		for doc, score := range matches {
+			if _, ok := found[doc]; ok {
+				found[doc] += score
+			}
+		}
+		matches = found
+	}
+	results := make([]SearchResult, 0, len(matches))
+	for doc, score := range matches {
+		results = append(results, SearchResult{Route: doc.route, Card: doc.card, Title: doc.title, Score: score})
+	}
+	x.lock.Unlock()
+
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Route != b.Route {
+			return a.Route < b.Route
+		}
+		return a.Card < b.Card
+	})
+	allowedRoutes := make(map[string]bool)
+	n := 0
+	for _, result := range results {
+		ok, seen := allowedRoutes[result.Route]
+		if !seen {
+			ok = allowed(result.Route)
+			allowedRoutes[result.Route] = ok
+		}
+		if !ok {
+			continue
+		}
+		result.Snippet = x.snippet(result.Route, result.Card, words)
+		results[n] = result
+		n++
+		if n == limit {
+			break
+		}
+	}
+	return results[:n]
+}
+
+// refresh reindexes pages changed since last indexed, and forgets those gone.
+func (x *SearchIndex) refresh() {
+	site := x.broker.site
+	seen := make(map[string]bool)
+	for _, url := range site.urls() {
+		page := site.at(url)
+		if page == nil || x.broker.isUnicast(url) { // pages private to a browser tab are never searched
+			continue
+		}
+		seen[url] = true
+		page.RLock()
+		changes := page.changes
+		indexed, ok := x.pages[url]
+		if ok && indexed.page == page && indexed.changes == changes {
+			page.RUnlock()
+			continue
+		}
+		docs := make([]*searchDoc, 0, len(page.cards))
+		for k, card := range page.cards {
+			var texts []string
+			collectCardText(card.dump(), &texts)
+			doc := &searchDoc{route: url, card: k, terms: make(map[string]int)}
+			if title, ok := card.data["title"].(string); ok {
+				doc.title = title
+			}
+			for _, text := range texts {
+				for _, term := range tokenize(text) {
+					doc.terms[term]++
+				}
+			}
+			docs = append(docs, doc)
+		}
+		page.RUnlock()
+
+		if ok {
+			x.unindex(indexed)
+		}
+		for _, doc := range docs {
+			for term := range doc.terms {
+				if x.terms[term] == nil {
+					x.terms[term] = make(map[*searchDoc]bool)
+				}
+				x.terms[term][doc] = true
+			}
+		}
+		x.pages[url] = &indexedPage{page, changes, docs}
+	}
+	for url, indexed := range x.pages {
+		if !seen[url] {
+			x.unindex(indexed)
+			delete(x.pages, url)
+		}
+	}
+}
+
+func (x *SearchIndex) unindex(indexed *indexedPage) {
+	for _, doc := range indexed.docs {
+		for term := range doc.terms {
+			delete(x.terms[term], doc)
+			if len(x.terms[term]) == 0 {
+				delete(x.terms, term)
+			}
+		}
+	}
+}
+
+// snippet returns the text on a card around the first of words found.
+func (x *SearchIndex) snippet(route, card string, words []string) string {
+	page := x.broker.site.at(route)
+	if page == nil {
+		return ""
+	}
+	page.RLock()
+	c, ok := page.cards[card]
+	var texts []string
+	if ok {
+		collectCardText(c.dump(), &texts)
+	}
+	page.RUnlock()
+	for _, text := range texts {
+		lower := strings.ToLower(text)
+		for _, word := range words {
+			i := strings.Index(lower, word)
+			if i < 0 || len(lower) != len(text) { // offsets are off if lowercasing changed the text's length
+				continue
+			}
+			start, end := max(0, i-60), min(len(text), i+len(word)+100)
+			for start > 0 && !isRuneStart(text[start]) {
+				start--
+			}
+			for end < len(text) && !isRuneStart(text[end]) {
+				end++
+			}
+			s := strings.Join(strings.Fields(text[start:end]), " ")
+			if start > 0 {
+				s = "…" + s
+			}
+			if end < len(text) {
+				s += "…"
+			}
+			return s
+		}
+	}
+	return ""
+}
+
+func isRuneStart(b byte) bool { return b&0xC0 != 0x80 }
+
+// collectCardText collects the text on a card: strings in its data, other than its view and layout, and the fields
+// and strings in its data buffers.
+func collectCardText(d CardD, texts *[]string) {
+	for k, v := range d.D {
+		if k == "view" || k == "box" || strings.HasPrefix(k, dataPrefix) {
+			continue
+		}
+		collectText(v, texts)
+	}
+	for _, b := range d.B {
+		switch {
+		case b.C != nil:
+			collectText(b.C.F, texts)
+			collectText(b.C.D, texts)
+		case b.F != nil:
+			collectText(b.F.F, texts)
+			collectText(b.F.D, texts)
+		case b.M != nil:
+			collectText(b.M.F, texts)
+			for _, t := range b.M.D {
+				collectText(t, texts)
+			}
+		case b.L != nil:
+			collectText(b.L.F, texts)
+			collectText(b.L.D, texts)
+		}
+	}
+}
+
+func collectText(v any, texts *[]string) {
+	switch v := v.(type) {
+	case string:
+		if v != "" {
+			*texts = append(*texts, v)
+		}
+	case []string:
+		*texts = append(*texts, v...)
+	case []any:
+		for _, x := range v {
+			collectText(x, texts)
+		}
+	case [][]any:
+		for _, x := range v {
+			collectText(x, texts)
+		}
+	case map[string]any:
+		for _, x := range v {
+			collectText(x, texts)
+		}
+	}
+}
+
+// tokenize splits text into lowercase words.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+}
+
+const searchTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>Search</title>
+  <style>
+    body { font: 14px/1.4 -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif; margin: 2em; color: #222; max-width: 60em; }
+    input { font: inherit; padding: 6px 10px; width: 30em; }
+    ol { padding-left: 1.2em; }
+    li { margin: 1em 0; }
+    a { font-weight: 600; }
+    .card { color: #888; }
+    .snippet { color: #555; }
+  </style>
+</head>
+<body>
+  <form><input name="q" value="{{ .Query }}" placeholder="Search pages" autofocus></form>
+  {{- if .Query }}
+  <p>{{ len .Results }} result(s)</p>
+  <ol>
+  {{- range .Results }}
+    <li><a href="{{ $.BaseURL }}{{ .Route }}">{{ if .Title }}{{ .Title }}{{ else }}{{ .Route }}{{ end }}</a> <span class="card">{{ .Route }} &middot; {{ .Card }}</span><div class="snippet">{{ .Snippet }}</div></li>
+  {{- end }}
+  </ol>
+  {{- end }}
+</body>
+</html>`
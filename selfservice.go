@@ -0,0 +1,238 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+// Metadata attributes attached to self-service keys.
+const (
+	selfServiceOwner       = "owner"
+	selfServiceUsername    = "username"
+	selfServiceScope       = "scope"
+	selfServiceProvisioned = "provisioned"
+	selfServiceTag         = "self-service"
+)
+
+// SelfServiceKeyRequest represents a request by an end-user to mint an access key for themselves.
+type SelfServiceKeyRequest struct {
+	Scope string `json:"scope,omitempty"` // comma-separated scopes, each one the operator lets users request
+	TTL   string `json:"ttl,omitempty"`   // lifetime, e.g. "24h"; capped at the configured maximum
+}
+
+// SelfServiceKeyResponse represents a newly minted self-service key. The secret cannot be retrieved again.
+type SelfServiceKeyResponse struct {
+	ID      string    `json:"id"`
+	Secret  string    `json:"secret"`
+	Expires time.Time `json:"expires"`
+}
+
+// SelfServiceHandler lets OIDC-authenticated users mint, list and revoke their own expiring access keys.
+type SelfServiceHandler struct {
+	sync.Mutex // serializes minting, to enforce limits
+	prefix     string
+	auth       *Auth
+	keychain   *keychain.Keychain
+	limit      int
+	maxTTL     time.Duration
+	scopes     map[string]bool // scopes users may request
+	maxSize    int64
+}
+
+func newSelfServiceHandler(prefix string, auth *Auth, keychain *keychain.Keychain, limit int, maxTTL time.Duration, scopes []string, maxSize int64) *SelfServiceHandler {
+	allowed := make(map[string]bool, len(scopes))
+	for _, s := range scopes {
+		allowed[s] = true
+	}
+	return &SelfServiceHandler{prefix: prefix, auth: auth, keychain: keychain, limit: limit, maxTTL: maxTTL, scopes: allowed, maxSize: maxSize}
+}
+
+func (h *SelfServiceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	session := h.auth.identify(r)
+	if session == nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodGet && h.keychain.ReadOnly() {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, h.prefix), "/")
+	if id == "" {
+		switch r.Method {
+		case http.MethodGet:
+			h.writeJSON(w, h.owned(session.subject, false))
+		case http.MethodPost:
+			h.mint(w, r, session)
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if r.Method != http.MethodDelete {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if e, ok := h.keychain.Get(id); !ok || !isOwnedBy(e, session.subject) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err := h.keychain.Remove(id); err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	echo(Log{"t": "self_service_key_remove", "id": id, "subject": session.subject})
+	h.save(w)
+}
+
+func isOwnedBy(e keychain.Entry, subject string) bool {
+	return e.Metadata[selfServiceProvisioned] == selfServiceTag && e.Metadata[selfServiceOwner] == subject
+}
+
+// owned returns the self-service keys minted by subject, optionally excluding expired keys.
+func (h *SelfServiceHandler) owned(subject string, activeOnly bool) []keychain.Entry {
+	now := h.keychain.Now()
+	entries := []keychain.Entry{}
+	for _, e := range h.keychain.Entries() {
+		if !isOwnedBy(e, subject) {
+			continue
+		}
+		if activeOnly && !e.Active(now) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func (h *SelfServiceHandler) mint(w http.ResponseWriter, r *http.Request, session *Session) {
+	// Browsers cannot send JSON cross-origin without a CORS preflight, so this also guards against CSRF.
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != contentTypeJSON {
+		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var req SelfServiceKeyRequest
+	b, err := readRequestWithLimit(w, r.Body, h.maxSize)
+	if err != nil {
+		echo(Log{"t": "read self-service key request body", "error": err.Error()})
+		if isRequestTooLarge(err) {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &req); err != nil {
+			echo(Log{"t": "json_unmarshal", "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Scopes grant privileges, e.g. registering apps, so users may only request those the operator allows.
+	var scopes []string
+	for _, s := range strings.Split(req.Scope, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !h.scopes[s] {
+			echo(Log{"t": "self_service_key_create", "subject": session.subject, "scope": s, "error": "scope not allowed"})
+			http.Error(w, "scope not allowed: "+s, http.StatusForbidden)
+			return
+		}
+		scopes = append(scopes, s)
+	}
+
+	ttl := h.maxTTL
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid ttl", http.StatusBadRequest)
+			return
+		}
+		if d < ttl {
+			ttl = d
+		}
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	if len(h.owned(session.subject, true)) >= h.limit {
+		echo(Log{"t": "self_service_key_create", "subject": session.subject, "error": "limit reached"})
+		http.Error(w, "access key limit reached", http.StatusForbidden)
+		return
+	}
+
+	id, secret, hash, err := h.keychain.CreateAccessKey()
+	if err != nil {
+		echo(Log{"t": "self_service_key_create", "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	expires := h.keychain.Now().Add(ttl).UTC().Truncate(time.Second)
+	metadata := map[string]string{
+		selfServiceOwner:       session.subject,
+		selfServiceUsername:    session.username,
+		selfServiceProvisioned: selfServiceTag,
+	}
+	if len(scopes) > 0 {
+		metadata[selfServiceScope] = strings.Join(scopes, ",")
+	}
+	// Store the key with its owner and expiry at once, so that it never exists without them.
+	if err := h.keychain.Put(keychain.Entry{ID: id, Hash: hash, Expires: &expires, Metadata: metadata}); err != nil {
+		echo(Log{"t": "self_service_key_create", "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	echo(Log{"t": "self_service_key_create", "id": id, "subject": session.subject, "expires": expires.Format(time.RFC3339)})
+	if h.save(w) {
+		w.Header().Set("Cache-Control", "no-store")
+		h.writeJSON(w, SelfServiceKeyResponse{id, secret, expires})
+	}
+}
+
+func (h *SelfServiceHandler) save(w http.ResponseWriter) bool {
+	if err := h.keychain.Save(); err != nil {
+		echo(Log{"t": "self_service_keychain_save", "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+func (h *SelfServiceHandler) writeJSON(w http.ResponseWriter, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		echo(Log{"t": "self_service_marshal", "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.Write(b)
+}
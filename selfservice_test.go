@@ -0,0 +1,93 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"github.com/h2oai/wave/pkg/keychain/keychaintest"
+)
+
+func TestSelfServiceKeys(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	kc, _ := keychaintest.New(t, 0)
+	expiry := time.Now().Add(time.Hour)
+	auth := &Auth{conf: &AuthConf{InactivityTimeout: time.Hour}, sessions: map[string]*Session{
+		"s1": {id: "s1", saml: true, subject: "alice", username: "alice", expiry: expiry},
+		"s2": {id: "s2", saml: true, subject: "bob", username: "bob", expiry: expiry},
+	}}
+	h := newSelfServiceHandler("/_auth/keys", auth, kc, 2, 24*time.Hour, []string{"reports", "exports"}, 1<<10)
+
+	call := func(session, method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", contentTypeJSON)
+		if session != "" {
+			r.AddCookie(&http.Cookie{Name: authCookieName, Value: session})
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	mint := func(session, body string) SelfServiceKeyResponse {
+		w := call(session, http.MethodPost, "/_auth/keys", body)
+		eq(w.Code, http.StatusOK)
+		var res SelfServiceKeyResponse
+		no(json.NewDecoder(w.Body).Decode(&res))
+		return res
+	}
+
+	eq(call("", http.MethodGet, "/_auth/keys", "").Code, http.StatusUnauthorized)
+
+	// Scopes grant privileges: only those allowed may be requested.
+	eq(call("s1", http.MethodPost, "/_auth/keys", `{"scope":"app"}`).Code, http.StatusForbidden)
+	eq(call("s1", http.MethodPost, "/_auth/keys", `{"scope":"reports,app"}`).Code, http.StatusForbidden)
+	eq(kc.Len(), 0)
+
+	// TTLs are capped.
+	before := kc.Now()
+	key := mint("s1", `{"scope":"reports, exports","ttl":"1000h"}`)
+	ok(!key.Expires.After(kc.Now().Add(24*time.Hour)), "capped")
+	ok(key.Expires.After(before.Add(23 * time.Hour)))
+	ok(kc.Verify(key.ID, key.Secret))
+	e, found := kc.Get(key.ID)
+	ok(found)
+	eq(e.Metadata["owner"], "alice")
+	eq(e.Metadata["scope"], "reports,exports")
+	ok(e.Expires != nil && e.Expires.Equal(key.Expires))
+
+	short := mint("s1", `{"ttl":"1h"}`)
+	ok(!short.Expires.After(kc.Now().Add(time.Hour)))
+	eq(call("s1", http.MethodPost, "/_auth/keys", `{}`).Code, http.StatusForbidden) // limit reached
+	eq(call("s1", http.MethodPost, "/_auth/keys", `{"ttl":"soon"}`).Code, http.StatusBadRequest)
+
+	// Users see and revoke their own keys only.
+	bobs := mint("s2", ``)
+	var listed []struct{ ID string }
+	no(json.NewDecoder(call("s2", http.MethodGet, "/_auth/keys", "").Body).Decode(&listed))
+	eq(len(listed), 1)
+	eq(listed[0].ID, bobs.ID)
+	eq(call("s2", http.MethodDelete, "/_auth/keys/"+key.ID, "").Code, http.StatusNotFound)
+	ok(kc.Verify(key.ID, key.Secret))
+	eq(call("s1", http.MethodDelete, "/_auth/keys/"+key.ID, "").Code, http.StatusOK)
+	_, found = kc.Get(key.ID)
+	ok(!found)
+	mint("s1", `{}`) // below the limit again
+}
@@ -22,9 +22,14 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
+
+	"github.com/h2oai/wave/pkg/keychain"
 )
 
 const logo = `
@@ -85,15 +90,131 @@ func Run(conf ServerConf) {
 		initSite(site, conf.Init)
 	}
 
+	var pages *PageSync
+	if conf.PageStore != nil {
+		pages = newPageSync(conf.PageStore, site, conf.PageSyncInterval)
+		if err := pages.load(); err != nil {
+			panic(fmt.Errorf("failed loading pages: %v", err))
+		}
+		go pages.run()
+	}
+
+	if conf.AOF != nil {
+		conf.AOF.load(site)
+		go conf.AOF.run(conf.AOFCompactInterval)
+	}
+
 	handle := handleWithBaseURL(conf.BaseURL)
 
-	broker := newBroker(site, conf.Editable, conf.NoStore, conf.NoLog, conf.KeepAppLive, conf.Debug)
+	var cluster *Cluster
+	if conf.Cluster != "" {
+		var err error
+		if cluster, err = newCluster(conf.Cluster, conf.ClusterChannel); err != nil {
+			panic(fmt.Errorf("failed connecting to cluster: %v", err))
+		}
+	}
+
+	var bridge *KafkaBridge
+	if len(conf.KafkaBrokers) > 0 {
+		var err error
+		if bridge, err = newKafkaBridge(conf.KafkaBrokers, conf.KafkaConsume, conf.KafkaProduce); err != nil {
+			panic(fmt.Errorf("failed connecting to Kafka: %v", err))
+		}
+	}
+
+	acls, err := OpenRouteACLs(filepath.Join(conf.DataDir, "acls.json"), conf.Keychain)
+	if err != nil {
+		panic(fmt.Errorf("failed loading route ACLs: %v", err))
+	}
+	authz := routeAuthorizers{acls}
+	if conf.RouteAuthorizer != nil {
+		authz = append(authz, conf.RouteAuthorizer)
+	}
+
+	var health *AppHealth
+	if conf.AppHealthInterval > 0 {
+		health = newAppHealth(conf.AppHealthInterval, conf.AppHealthTimeout, conf.AppHealthPath, conf.AppHealthFailures, conf.AppHealthForget)
+	}
+	var limits *AppLimiter
+	if conf.AppLimits.enabled() {
+		limits = newAppLimiter(conf.AppLimits, site)
+	}
+	var queue *AppQueue
+	if conf.AppEventQueue > 0 {
+		queue = newAppQueue(conf.AppEventQueue, conf.AppEventTTL)
+	}
+	broker := newBroker(site, brokerConf{
+		editable:    conf.Editable,
+		noStore:     conf.NoStore,
+		noLog:       conf.NoLog,
+		keepAppLive: conf.KeepAppLive,
+		debug:       conf.Debug,
+		validate:    conf.ValidatePatches,
+		window:      conf.CoalesceWindow,
+		replayLog:   newReplayLog(conf.ReplayLogSize, conf.ReplayLogAge),
+		cluster:     cluster,
+		kafka:       bridge,
+		journal:     conf.Journal,
+		authz:       authz,
+		pages:       pages,
+		aof:         conf.AOF,
+		health:      health,
+		limits:      limits,
+		queue:       queue,
+	})
+	if conf.BufferHistory > 0 { // set once pages are restored, so that restoring them isn't recorded again
+		site.history = newBufferHistory(filepath.Join(conf.DataDir, "history"), conf.BufferHistory, broker.isUnicast)
+	}
 	go broker.run()
+	if health != nil {
+		go health.run(broker)
+	}
+	if queue != nil {
+		go queue.run(broker)
+	}
+	if cluster != nil {
+		go cluster.run(broker)
+	}
+	if bridge != nil {
+		go bridge.run(broker)
+	}
 
 	if conf.Debug {
 		handle("_d/site", newDebugHandler(broker))
 	}
 
+	quotas, err := OpenUploadQuotas(filepath.Join(conf.DataDir, "uploads.json"), conf.UploadQuota, conf.MaxUploadSize)
+	if err != nil {
+		panic(fmt.Errorf("failed reading upload quotas: %v", err))
+	}
+	quotas.apps = limits
+	fileDir, fileStore := filepath.Join(conf.DataDir, "f"), conf.FileStore
+	var cas *ContentStore
+	if conf.DedupeUploads {
+		if cas, err = OpenContentStore(filepath.Join(conf.DataDir, "content.json"), filepath.Join(conf.DataDir, "c"), fileDir, fileStore); err != nil {
+			panic(fmt.Errorf("failed reading uploaded content: %v", err))
+		}
+		if fileStore != nil {
+			fileStore = cas.bucket()
+		}
+	}
+	var quarantine *Quarantine
+	if conf.UploadScanner != nil {
+		if quarantine, err = newQuarantine(conf.UploadScanner, filepath.Join(conf.DataDir, "quarantine.json"), fileDir, fileStore, quotas, cas); err != nil {
+			panic(fmt.Errorf("failed reading quarantined uploads: %v", err))
+		}
+	}
+	var gc *FileGC
+	if conf.FileRetention != nil {
+		gc = newFileGC(conf.FileRetention, site, fileDir, fileStore, filepath.Join(conf.DataDir, "u"), quotas, quarantine, cas, conf.BaseURL+"_f", conf.FileGCDryRun)
+		go gc.run(conf.FileGCInterval)
+	}
+
+	authn := conf.Authenticator
+	if authn == nil {
+		authn = conf.Keychain
+	}
+
 	var auth *Auth
 
 	if conf.Auth != nil {
@@ -101,20 +222,140 @@ func Run(conf ServerConf) {
 		if auth, err = newAuth(conf.Auth, conf.BaseURL, conf.BaseURL+"_auth/init", conf.BaseURL+"_auth/login"); err != nil {
 			panic(fmt.Errorf("failed connecting to OIDC provider: %v", err))
 		}
+		if conf.Auth.RefreshInterval > 0 {
+			go auth.renew(conf.Auth.RefreshInterval)
+		}
 		handle("_auth/init", newLoginHandler(auth))
-		handle("_auth/callback", newAuthHandler(auth))
+		handle("_auth/providers", newProvidersHandler(auth))
+		handle("_auth/callback", newAuthHandler(auth, broker))
 		handle("_auth/logout", newLogoutHandler(auth, broker))
-		handle("_auth/refresh", newRefreshHandler(auth, conf.Keychain))
+		handle("_auth/backchannel-logout", newBackchannelLogoutHandler(auth, broker))
+		handle("_auth/frontchannel-logout", newFrontchannelLogoutHandler(auth, broker))
+		handle("_auth/refresh", newRefreshHandler(auth, authn))
+		if conf.Auth.SAML != nil {
+			handle("_auth/saml/metadata", newSAMLMetadataHandler(auth))
+			handle("_auth/saml/acs", newSAMLAssertionHandler(auth, broker))
+		}
+		if conf.Auth.SelfServiceKeyLimit > 0 {
+			selfService := newSelfServiceHandler(conf.BaseURL+"_auth/keys", auth, conf.Keychain, conf.Auth.SelfServiceKeyLimit, conf.Auth.SelfServiceKeyTTL, conf.Auth.SelfServiceScopes, conf.MaxRequestSize)
+			handle("_auth/keys", selfService)
+			handle("_auth/keys/", selfService)
+		}
+	}
+
+	if conf.Elector != nil {
+		go runElector(conf)
 	}
 
-	handle("_s/", newSocketServer(broker, auth, conf))
+	var backups *PageBackups
+	if conf.BackupStore != nil {
+		if backups, err = OpenPageBackups(conf.BackupStore, broker, conf.BackupRoutes, conf.BackupRetention, filepath.Join(conf.DataDir, "backups.json")); err != nil {
+			panic(fmt.Errorf("failed reading page backups: %v", err))
+		}
+		go backups.run(conf.BackupInterval)
+	}
 
-	fileDir := filepath.Join(conf.DataDir, "f")
-	handle("_f/", newFileServer(fileDir, conf.Keychain, auth, conf.BaseURL+"_f"))
+	var secrets *AppSecrets
+	if conf.AppSecrets != nil {
+		if secrets, err = newAppSecrets(conf.AppSecrets, conf.Keychain, conf.AppScope); err != nil {
+			panic(err)
+		}
+	}
+	var supervisor *Supervisor
+	if conf.Supervisor != nil {
+		supervisor = newSupervisor(conf.Supervisor, conf.Listen, isTLS, conf.BaseURL, secrets)
+		go supervisor.run()
+	}
+
+	if conf.AdminKeychain != nil {
+		var admins keychain.Authenticator = conf.AdminKeychain
+		if auth != nil && conf.Auth.Policy != nil {
+			admins = &policyAdmins{conf.AdminKeychain, auth}
+		}
+		handle("_admin/", newAdminServer(conf.BaseURL+"_admin/", admins, conf.Keychain, conf.AuditLog, conf.AdminKeyQuota, conf.MaxRequestSize))
+		if auth != nil {
+			sessionAdmin := newSessionAdminHandler(conf.BaseURL+"_admin/sessions", admins, auth, broker)
+			handle("_admin/sessions", sessionAdmin)
+			handle("_admin/sessions/", sessionAdmin)
+		}
+		if conf.AuditLog != nil {
+			handle("_audit", newAuditHandler(conf.AuditLog, admins))
+		}
+		handle("_admin/clients", newClientAdminHandler(admins, broker))
+		handle("_admin/metrics", newMetricsHandler(admins, broker))
+		handle("_admin/quotas", newQuotaAdminHandler(quotas, admins))
+		handle("_admin/acls/", newRouteACLAdminHandler(conf.BaseURL+"_admin/acls/", acls, broker, admins, conf.MaxRequestSize))
+		if gc != nil {
+			handle("_admin/gc", newGCHandler(gc, admins))
+		}
+		if backups != nil {
+			handle("_admin/backups", newPageBackupHandler(backups, admins))
+		}
+		deploymentAdmin := newDeploymentAdminHandler(conf.BaseURL+"_admin/deployments", broker, admins, conf.MaxRequestSize)
+		handle("_admin/deployments", deploymentAdmin)
+		handle("_admin/deployments/", deploymentAdmin)
+		if supervisor != nil {
+			processAdmin := newProcessAdminHandler(conf.BaseURL+"_admin/processes", supervisor, admins)
+			handle("_admin/processes", processAdmin)
+			handle("_admin/processes/", processAdmin)
+		}
+		if conf.FileAudit != nil {
+			handle("_admin/file-audit", newFileAuditHandler(conf.FileAudit, admins))
+		}
+		if conf.AdminGRPCListen != "" {
+			go runAdminService(conf, admins)
+		}
+		if conf.Replicator != nil {
+			handle("_replica", newReplicaHandler(conf.AdminKeychain, conf.Replicator, conf.MaxRequestSize))
+			go runReplicator(conf)
+		}
+	}
+
+	if conf.FederationKeychain != nil {
+		handle("_federation/verify", newFederationHandler(conf.FederationKeychain, conf.Keychain, conf.MaxRequestSize))
+	}
+
+	if len(conf.Tenants) > 0 {
+		handle("_tenants/", newTenantServer(conf.BaseURL+"_tenants/", conf.Tenants, conf.MaxRequestSize))
+	}
+
+	sockets := newSocketServer(broker, auth, conf)
+	handle("_s/", sockets)
+	handle("_e/", newEventServer(sockets))
+	handle("_presence", newPresenceHandler(authn, broker))
+
+	if conf.MQTTListen != "" {
+		go runMQTTServer(conf, broker, authn)
+	}
+
+	signable := []string{conf.BaseURL + "_f/"}
+	for _, dir := range conf.PrivateDirs {
+		prefix, _ := splitDirMapping(dir)
+		signable = append(signable, conf.BaseURL+prefix)
+	}
+	signer := newURLSigner(conf.Keychain, signable, conf.MaxSignedURLTTL)
+	var images *ImageTransformer
+	if conf.ImageTransforms {
+		images = newImageTransformer(filepath.Join(conf.DataDir, "thumbs"), conf.ImageCacheSize)
+	}
+	handle("_sign", newSignHandler(authn, signer))
+
+	files := newFileServer(fileDir, fileStore, authn, auth, conf.BaseURL+"_f", fileServerConf{
+		quotas: quotas,
+		held:   quarantine,
+		signer: signer,
+		cas:    cas,
+		images: images,
+		audit:  conf.FileAudit,
+		types:  conf.ContentPolicy,
+	})
+	handle("_f/", files)
+	handle("_u/", newUploadServer(conf.BaseURL+"_u/", filepath.Join(conf.DataDir, "u"), fileDir, fileStore, authn, auth, conf.BaseURL+"_f", quotas, quarantine, cas, conf.FileAudit, conf.ContentPolicy))
+	handle("_quota", newQuotaHandler(quotas, authn, auth))
 	for _, dir := range conf.PrivateDirs {
 		prefix, src := splitDirMapping(dir)
 		echo(Log{"t": "private_dir", "source": src, "address": prefix})
-		handle(prefix, http.StripPrefix(conf.BaseURL+prefix, newDirServer(src, conf.Keychain, auth)))
+		handle(prefix, http.StripPrefix(conf.BaseURL+prefix, newDirServer(src, authn, auth, signer)))
 	}
 	for _, dir := range conf.PublicDirs {
 		prefix, src := splitDirMapping(dir)
@@ -122,8 +363,22 @@ func Run(conf ServerConf) {
 		handle(prefix, http.StripPrefix(conf.BaseURL+prefix, http.FileServer(http.Dir(src))))
 	}
 
-	handle("_c/", newCache(conf.BaseURL+"_c/", conf.Keychain, conf.MaxCacheRequestSize))
-	handle("_m/", newMultipartServer(conf.BaseURL+"_m/", conf.Keychain, auth, conf.MaxRequestSize))
+	handle("_c/", newCache(conf.BaseURL+"_c/", authn, conf.MaxCacheRequestSize))
+	handle("_snapshots/", newSnapshots(conf.BaseURL+"_snapshots/", filepath.Join(conf.DataDir, "snapshots"), conf.SnapshotLimit, site, broker, authn))
+	handle("_acl/", newRouteACLHandler(conf.BaseURL+"_acl/", acls, broker, authn, conf.MaxRequestSize))
+	handle("_export/", newExporter(conf.BaseURL+"_export/", conf.BaseURL, conf.WebDir, broker, authn, conf.ExportChrome, conf.ExportTimeout))
+	handle("_archive/", newPageArchiver(conf.BaseURL+"_archive/", broker, files, authn))
+	handle("_search", newSearchIndex(conf.BaseURL, broker, auth, authn))
+	handle("_apps", newAppRegistryHandler(broker, authn, auth))
+	templates, err := OpenPageTemplates(filepath.Join(conf.DataDir, "templates.json"))
+	if err != nil {
+		panic(fmt.Errorf("failed loading page templates: %v", err))
+	}
+	if site.history != nil {
+		handle("_history/", newBufferHistoryHandler(conf.BaseURL+"_history/", site.history, broker, authn))
+	}
+	handle("_templates/", newPageTemplateHandler(conf.BaseURL+"_templates/", templates, broker, authn, conf.MaxRequestSize))
+	handle("_m/", newMultipartServer(conf.BaseURL+"_m/", authn, auth, conf.MaxRequestSize))
 
 	if conf.Proxy {
 		handle("_p/", newProxy(auth, conf.MaxProxyRequestSize, conf.MaxProxyResponseSize))
@@ -140,7 +395,11 @@ func Run(conf ServerConf) {
 		}))
 	}
 
-	webServer, err := newWebServer(site, broker, auth, conf.Keychain, conf.MaxRequestSize, conf.BaseURL, conf.WebDir, conf.Header)
+	var apps *AppKeychains
+	if conf.AppKeychainDir != "" {
+		apps = newAppKeychains(conf.AppKeychainDir, broker)
+	}
+	webServer, err := newWebServer(site, broker, auth, authn, apps, conf.AppScope, secrets, conf.MaxRequestSize, conf.BaseURL, conf.WebDir, conf.Header)
 	if err != nil {
 		panic(err)
 	}
@@ -152,15 +411,30 @@ func Run(conf ServerConf) {
 		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	}
 
+	srv := &http.Server{Addr: conf.Listen}
+	stopped := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		signal.Stop(sig) // a second signal kills the server right away
+		shutdown(srv, broker, conf.DrainTimeout)
+		supervisor.shutdown() // once browsers are gone, since apps serve them until then
+		close(stopped)
+	}()
+
 	if isTLS {
-		if err := http.ListenAndServeTLS(conf.Listen, conf.CertFile, conf.KeyFile, nil); err != nil {
+		if err := srv.ListenAndServeTLS(conf.CertFile, conf.KeyFile); err != nil && err != http.ErrServerClosed {
 			echo(Log{"t": "listen_tls", "error": err.Error()})
+			return
 		}
 	} else {
-		if err := http.ListenAndServe(conf.Listen, nil); err != nil {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			echo(Log{"t": "listen_no_tls", "error": err.Error()})
+			return
 		}
 	}
+	<-stopped
 }
 
 func splitDirMapping(m string) (string, string) {
@@ -0,0 +1,277 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/h2oai/wave/pkg/redis"
+	"github.com/lo5/sqlite3"
+	"golang.org/x/oauth2"
+)
+
+// SessionStore persists end-user sessions, so that they survive restarts and can be shared by several servers.
+// Sessions are opaque to stores.
+type SessionStore interface {
+	// Load returns the session with the given ID, or nil if there is none or it has expired.
+	Load(id string) ([]byte, error)
+	// Save creates or replaces a session, which expires after ttl.
+	Save(id string, data []byte, ttl time.Duration) error
+	// Delete removes a session.
+	Delete(id string) error
+	// IDs returns the IDs of all sessions, possibly including some that have expired.
+	IDs() ([]string, error)
+}
+
+// OpenSessionStore returns the session store at a URL of the form redis://..., rediss://... or sqlite:path.
+func OpenSessionStore(rawURL string) (SessionStore, error) {
+	if path, ok := strings.CutPrefix(rawURL, "sqlite:"); ok {
+		return &SQLiteSessionStore{path}, nil
+	}
+	return NewRedisSessionStore(rawURL)
+}
+
+// RedisSessionStore is a SessionStore backed by Redis.
+type RedisSessionStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisSessionStore creates a session store for the Redis server at a URL of the form
+// redis://[:password@]host[:port][/db] (or rediss:// for TLS).
+func NewRedisSessionStore(rawURL string) (*RedisSessionStore, error) {
+	client, err := redis.New(rawURL, 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisSessionStore{client, "wave:session:"}, nil
+}
+
+func (s *RedisSessionStore) Load(id string) ([]byte, error) {
+	v, err := s.client.Do("GET", s.prefix+id)
+	if err != nil || v == "" {
+		return nil, err
+	}
+	return []byte(v), nil
+}
+
+func (s *RedisSessionStore) Save(id string, data []byte, ttl time.Duration) error {
+	if _, err := s.client.Do("SET", s.prefix+id, string(data), "PX", strconv.FormatInt(max(ttl.Milliseconds(), 1), 10)); err != nil {
+		return err
+	}
+	_, err := s.client.Do("SADD", s.prefix+"ids", id)
+	return err
+}
+
+func (s *RedisSessionStore) Delete(id string) error {
+	if _, err := s.client.Do("DEL", s.prefix+id); err != nil {
+		return err
+	}
+	_, err := s.client.Do("SREM", s.prefix+"ids", id)
+	return err
+}
+
+func (s *RedisSessionStore) IDs() ([]string, error) {
+	return s.client.Strings("SMEMBERS", s.prefix+"ids")
+}
+
+// SQLiteSessionStore is a SessionStore backed by a SQLite database, with one row per session.
+type SQLiteSessionStore struct {
+	Name string
+}
+
+func (s *SQLiteSessionStore) open() (*sqlite3.Conn, error) {
+	conn, err := sqlite3.Open(s.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening %s: %v", s.Name, err)
+	}
+	conn.BusyTimeout(5 * time.Second) // shared by several servers
+	if err := conn.Exec(`create table if not exists sessions (id text primary key, data blob not null, expires integer not null)`); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed creating sessions table in %s: %v", s.Name, err)
+	}
+	return conn, nil
+}
+
+func (s *SQLiteSessionStore) Load(id string) ([]byte, error) {
+	conn, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	stmt, err := conn.Prepare(`select data from sessions where id = ? and expires > ?`, id, time.Now().UnixMilli())
+	if err != nil {
+		return nil, fmt.Errorf("failed reading %s: %v", s.Name, err)
+	}
+	defer stmt.Close()
+
+	hasRow, err := stmt.Step()
+	if err != nil {
+		return nil, fmt.Errorf("failed reading %s: %v", s.Name, err)
+	}
+	if !hasRow {
+		return nil, nil
+	}
+	var data []byte
+	if err := stmt.Scan(&data); err != nil {
+		return nil, fmt.Errorf("failed reading %s: %v", s.Name, err)
+	}
+	return data, nil
+}
+
+func (s *SQLiteSessionStore) Save(id string, data []byte, ttl time.Duration) error {
+	conn, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.Exec(`insert or replace into sessions (id, data, expires) values (?, ?, ?)`, id, data, time.Now().Add(ttl).UnixMilli()); err != nil {
+		return fmt.Errorf("failed writing %s: %v", s.Name, err)
+	}
+	return nil
+}
+
+func (s *SQLiteSessionStore) Delete(id string) error {
+	conn, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.Exec(`delete from sessions where id = ?`, id); err != nil {
+		return fmt.Errorf("failed writing %s: %v", s.Name, err)
+	}
+	return nil
+}
+
+func (s *SQLiteSessionStore) IDs() ([]string, error) {
+	conn, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// Purge expired sessions while at it.
+	if err := conn.Exec(`delete from sessions where expires <= ?`, time.Now().UnixMilli()); err != nil {
+		return nil, fmt.Errorf("failed writing %s: %v", s.Name, err)
+	}
+	stmt, err := conn.Prepare(`select id from sessions`)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading %s: %v", s.Name, err)
+	}
+	defer stmt.Close()
+
+	var ids []string
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, fmt.Errorf("failed reading %s: %v", s.Name, err)
+		}
+		if !hasRow {
+			break
+		}
+		var id string
+		if err := stmt.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed reading %s: %v", s.Name, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// sessionState is the persistent state of a session.
+type sessionState struct {
+	State      string      `json:"state,omitempty"`
+	Nonce      string      `json:"nonce,omitempty"`
+	Verifier   string      `json:"verifier,omitempty"`
+	Provider   string      `json:"provider,omitempty"`
+	SID        string      `json:"sid,omitempty"`
+	Subject    string      `json:"subject,omitempty"`
+	Username   string      `json:"username,omitempty"`
+	Groups     []string    `json:"groups,omitempty"`
+	AuthTime   time.Time   `json:"auth_time,omitempty"`
+	ACR        string      `json:"acr,omitempty"`
+	AMR        []string    `json:"amr,omitempty"`
+	StepUp     bool        `json:"step_up,omitempty"`
+	SuccessURL string      `json:"success_url,omitempty"`
+	Token      *tokenState `json:"token,omitempty"`
+	Expiry     time.Time   `json:"expiry"`
+}
+
+// tokenState is a token, including its ID token, which oauth2.Token does not marshal.
+type tokenState struct {
+	oauth2.Token
+	IDToken string `json:"id_token,omitempty"`
+}
+
+// marshal encodes the session; must be called with the session locked.
+func (s *Session) marshal() ([]byte, error) {
+	st := sessionState{
+		State:      s.state,
+		Nonce:      s.nonce,
+		Verifier:   s.verifier,
+		SID:        s.sid,
+		Subject:    s.subject,
+		Username:   s.username,
+		Groups:     s.groups,
+		AuthTime:   s.authTime,
+		ACR:        s.acr,
+		AMR:        s.amr,
+		StepUp:     s.stepUp,
+		SuccessURL: s.successURL,
+		Provider:   s.providerName(),
+		Expiry:     s.expiry,
+	}
+	if s.token != nil {
+		st.Token = &tokenState{Token: *s.token}
+		st.Token.IDToken, _ = s.token.Extra("id_token").(string)
+	}
+	return json.Marshal(st)
+}
+
+// unmarshal decodes the session; must be called with the session locked.
+func (s *Session) unmarshal(auth *Auth, data []byte) error {
+	var st sessionState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return err
+	}
+	var provider *oidcProvider
+	s.saml = st.Provider == samlProviderName
+	if st.Provider != "" && !s.saml {
+		p, ok := auth.provider(st.Provider)
+		if !ok {
+			return fmt.Errorf("unknown provider %s", st.Provider)
+		}
+		provider = p
+	}
+	s.state, s.nonce, s.verifier, s.provider = st.State, st.Nonce, st.Verifier, provider
+	s.sid, s.subject, s.username, s.groups = st.SID, st.Subject, st.Username, st.Groups
+	s.authTime, s.acr, s.amr, s.stepUp = st.AuthTime, st.ACR, st.AMR, st.StepUp
+	s.successURL, s.expiry, s.token = st.SuccessURL, st.Expiry, nil
+	if st.Token != nil {
+		token := st.Token.Token
+		s.token = &token
+		if st.Token.IDToken != "" {
+			s.token = token.WithExtra(map[string]any{"id_token": st.Token.IDToken})
+		}
+	}
+	return nil
+}
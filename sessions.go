@@ -0,0 +1,124 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+// providerName returns the name of the identity provider the session signed in with, if any.
+func (s *Session) providerName() string {
+	if s.provider != nil {
+		return s.provider.conf.Name
+	}
+	if s.saml {
+		return samlProviderName
+	}
+	return ""
+}
+
+// signedIn reports whether the session has completed login.
+func (s *Session) signedIn() bool {
+	return s.subject != "" && s != anonymous && s != guest
+}
+
+// sameUser reports whether two sessions belong to the same user of the same identity provider.
+func sameUser(a, b *Session) bool {
+	return a.subject == b.subject && a.provider == b.provider && a.saml == b.saml
+}
+
+// limitSessions ends the user's least recently active sessions other than session, so that they have no more
+// sessions than allowed, and returns them.
+func (auth *Auth) limitSessions(session *Session) []*Session {
+	limit := auth.conf.MaxSessions
+	if limit <= 0 {
+		return nil
+	}
+	others := auth.find(func(s *Session) bool {
+		return s.id != session.id && s.signedIn() && sameUser(s, session)
+	})
+	if len(others) < limit {
+		return nil
+	}
+	sort.Slice(others, func(i, j int) bool { return others[i].expiry.Before(others[j].expiry) })
+	excess := make(map[string]bool)
+	for _, s := range others[:len(others)-limit+1] {
+		excess[s.id] = true
+	}
+	return auth.end(func(s *Session) bool { return excess[s.id] })
+}
+
+// SessionInfo describes a signed-in session, without its ID, which is a credential.
+type SessionInfo struct {
+	Subject  string    `json:"subject"`
+	Username string    `json:"username"`
+	Provider string    `json:"provider,omitempty"`
+	Groups   []string  `json:"groups,omitempty"`
+	Expiry   time.Time `json:"expiry"` // when the session times out, unless active
+}
+
+// SessionAdminHandler lists signed-in sessions, and ends users' sessions, for admins.
+//
+//	GET    /_admin/sessions                           lists sessions
+//	DELETE /_admin/sessions/{subject}[?provider=NAME] logs the user out everywhere
+type SessionAdminHandler struct {
+	prefix string
+	admins keychain.Authenticator
+	auth   *Auth
+	broker *Broker
+}
+
+func newSessionAdminHandler(prefix string, admins keychain.Authenticator, auth *Auth, broker *Broker) http.Handler {
+	return &SessionAdminHandler{prefix, admins, auth, broker}
+}
+
+func (h *SessionAdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.admins.Guard(w, r) {
+		return
+	}
+	subject := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, h.prefix), "/")
+	switch {
+	case subject == "" && r.Method == http.MethodGet:
+		sessions := h.auth.find(func(s *Session) bool { return s.signedIn() })
+		infos := make([]SessionInfo, len(sessions))
+		for i, s := range sessions {
+			s.RLock()
+			infos[i] = SessionInfo{s.subject, s.username, s.providerName(), s.groups, s.expiry}
+			s.RUnlock()
+		}
+		sort.Slice(infos, func(i, j int) bool { return infos[i].Subject < infos[j].Subject })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(infos)
+	case subject != "" && r.Method == http.MethodDelete:
+		provider := r.URL.Query().Get("provider")
+		ended := h.auth.end(func(s *Session) bool {
+			return s.signedIn() && s.subject == subject && (provider == "" || s.providerName() == provider)
+		})
+		if len(ended) == 0 {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		endSessions(h.broker, ended, "admin")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+const defaultSignedURLTTL = time.Hour
+
+// URLSigner signs file URLs on behalf of API access keys, so that apps can embed downloads in pages without handing
+// browsers credentials. Signed URLs carry the key's ID, an expiry and a signature made with the keychain, and stop
+// working once expired, or once the key is disabled, expires or is removed.
+type URLSigner struct {
+	keychain *keychain.Keychain
+	prefixes []string      // paths that can be signed, e.g. /_f/
+	maxTTL   time.Duration // longest a signed URL may be valid for
+}
+
+func newURLSigner(keychain *keychain.Keychain, prefixes []string, maxTTL time.Duration) *URLSigner {
+	return &URLSigner{keychain, prefixes, maxTTL}
+}
+
+// signable reports whether p is a clean path to a file served at one of the signer's prefixes.
+func (s *URLSigner) signable(p string) bool {
+	if p == "" || path.Clean(p) != p {
+		return false
+	}
+	for _, prefix := range s.prefixes {
+		if strings.HasPrefix(p, prefix) && len(p) > len(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// sign returns p with a signature by id, valid for ttl.
+func (s *URLSigner) sign(id, p string, ttl time.Duration) (string, time.Time, error) {
+	expires := s.keychain.Now().Add(ttl).Truncate(time.Second)
+	sig, err := s.keychain.Sign(id, p, expires)
+	if err != nil {
+		return "", expires, err
+	}
+	q := url.Values{}
+	q.Set("key", id)
+	q.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	q.Set("sig", sig)
+	return (&url.URL{Path: p}).EscapedPath() + "?" + q.Encode(), expires, nil
+}
+
+// allow reports whether a request is for a validly signed URL.
+func (s *URLSigner) allow(r *http.Request) bool {
+	if s == nil {
+		return false
+	}
+	q := r.URL.Query()
+	id, sig := q.Get("key"), q.Get("sig")
+	if id == "" || sig == "" {
+		return false
+	}
+	// Verify against the path as requested, before any prefixes are stripped.
+	u, err := url.ParseRequestURI(r.RequestURI)
+	if err != nil || !s.signable(u.Path) {
+		return false
+	}
+	secs, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil {
+		return false
+	}
+	if err := s.keychain.VerifySignature(id, u.Path, time.Unix(secs, 0), sig); err != nil {
+		echo(Log{"t": "signed_url", "path": u.Path, "key": id, "error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// SignedURL represents a signed file URL.
+type SignedURL struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// SignHandler signs file URLs for apps.
+//
+//	POST /_sign?path=/_f/<id>/<name>&ttl=<seconds>
+type SignHandler struct {
+	authn  keychain.Authenticator
+	signer *URLSigner
+}
+
+func newSignHandler(authn keychain.Authenticator, signer *URLSigner) http.Handler {
+	return &SignHandler{authn, signer}
+}
+
+func (h *SignHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authn.Guard(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	p := r.FormValue("path")
+	if !h.signer.signable(p) {
+		http.Error(w, "path is not a file that can be signed", http.StatusBadRequest)
+		return
+	}
+	ttl := defaultSignedURLTTL
+	if s := r.FormValue("ttl"); s != "" {
+		secs, err := strconv.Atoi(s)
+		if err != nil || secs <= 0 {
+			http.Error(w, "invalid ttl: want seconds", http.StatusBadRequest)
+			return
+		}
+		ttl = time.Duration(secs) * time.Second
+	}
+	if h.signer.maxTTL > 0 && ttl > h.signer.maxTTL {
+		ttl = h.signer.maxTTL
+	}
+	id, _, _ := r.BasicAuth()
+	signed, expires, err := h.signer.sign(id, p, ttl)
+	if err != nil {
+		// Keys verified elsewhere, e.g. by a federated server or another authenticator, can't sign.
+		echo(Log{"t": "signed_url", "path": p, "key": id, "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	echo(Log{"t": "signed_url", "path": p, "key": id, "expires": expires.UTC().Format(time.RFC3339)})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SignedURL{signed, expires.UTC()})
+}
@@ -28,8 +28,9 @@ const (
 // Site represents the website, and holds a collection of pages.
 type Site struct {
 	sync.RWMutex
-	pages map[string]*Page // url => page
-	ns    *Namespace       // buffer type namespace
+	pages   map[string]*Page // url => page
+	ns      *Namespace       // buffer type namespace
+	history *BufferHistory   // nil if rows written to buffers aren't recorded
 }
 
 func newSite() *Site {
@@ -109,6 +110,7 @@ func (site *Site) exec(url string, ops OpsD) {
 			} else {
 				page.set(op.K, op.V)
 			}
+			site.history.record(url, page, op)
 		} else { // drop page
 			site.del(url)
 			page.Unlock()
@@ -117,6 +119,7 @@ func (site *Site) exec(url string, ops OpsD) {
 		}
 	}
 	page.cache = nil // will be re-cached on next call to site.get(url)
+	page.changes++
 	page.Unlock()
 }
 
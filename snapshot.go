@@ -0,0 +1,273 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+// PageSnapshot is a page's full card state at a point in time.
+type PageSnapshot struct {
+	Version int             `json:"version"`
+	Time    time.Time       `json:"time"`
+	Note    string          `json:"note,omitempty"`
+	Cards   int             `json:"cards"`
+	Page    json.RawMessage `json:"page,omitempty"` // as served to browsers, i.e. {"p":...}; omitted when listed
+}
+
+// Snapshots keeps numbered versions of pages on disk, one file per version, so that pages clobbered, e.g. by an
+// app bug, can be viewed as they were, and restored.
+//
+//	POST /_snapshots/<route>?note=...   snapshot the page
+//	GET  /_snapshots/<route>            list its versions, oldest first
+//	GET  /_snapshots/<route>?version=3  view version 3, read-only
+//	POST /_snapshots/<route>?restore=3  restore version 3, after snapshotting the page as it is
+type Snapshots struct {
+	prefix   string
+	dir      string
+	limit    int // versions kept per page; 0 for no limit
+	site     *Site
+	broker   *Broker
+	keychain keychain.Authenticator
+	lock     sync.Mutex
+}
+
+func newSnapshots(prefix, dir string, limit int, site *Site, broker *Broker, keychain keychain.Authenticator) *Snapshots {
+	return &Snapshots{prefix: prefix, dir: dir, limit: limit, site: site, broker: broker, keychain: keychain}
+}
+
+var errNoPage = errors.New("page not found")
+
+func (s *Snapshots) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.keychain.Guard(w, r) {
+		return
+	}
+	route := "/" + strings.TrimPrefix(r.URL.Path, s.prefix)
+	q := r.URL.Query()
+	action := RouteRead
+	if r.Method == http.MethodPost && q.Get("restore") != "" {
+		action = RoutePublish
+	}
+	if key, _, _ := r.BasicAuth(); !s.broker.authorize(Identity{Key: key}, action, route) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if v := q.Get("version"); v != "" {
+			version, err := strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, "invalid version", http.StatusBadRequest)
+				return
+			}
+			snapshot, err := s.read(route, version)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(snapshot.Page)
+			return
+		}
+		snapshots, err := s.list(route)
+		if err != nil {
+			echo(Log{"t": "page_snapshot", "route": route, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		for i := range snapshots {
+			snapshots[i].Page = nil
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(snapshots)
+	case http.MethodPost:
+		var snapshot PageSnapshot
+		var err error
+		if v := q.Get("restore"); v != "" {
+			version, perr := strconv.Atoi(v)
+			if perr != nil {
+				http.Error(w, "invalid version", http.StatusBadRequest)
+				return
+			}
+			snapshot, err = s.restore(route, version)
+		} else {
+			snapshot, err = s.take(route, q.Get("note"))
+		}
+		if err != nil {
+			if errors.Is(err, errNoPage) || errors.Is(err, os.ErrNotExist) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			echo(Log{"t": "page_snapshot", "route": route, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		snapshot.Page = nil
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(snapshot)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// pageDir returns the directory a page's versions are kept in.
+func (s *Snapshots) pageDir(route string) string {
+	sum := sha256.Sum256([]byte(route))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:16]))
+}
+
+// take snapshots the page at route as it is.
+func (s *Snapshots) take(route, note string) (PageSnapshot, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.save(route, note)
+}
+
+func (s *Snapshots) save(route, note string) (PageSnapshot, error) {
+	page := s.site.at(route)
+	if page == nil {
+		return PageSnapshot{}, errNoPage
+	}
+	page.RLock()
+	cards := len(page.cards)
+	page.RUnlock()
+	data := page.marshal()
+	if data == nil {
+		return PageSnapshot{}, errors.New("failed marshaling page")
+	}
+
+	snapshots, err := s.list(route)
+	if err != nil {
+		return PageSnapshot{}, err
+	}
+	version := 1
+	if n := len(snapshots); n > 0 {
+		version = snapshots[n-1].Version + 1
+	}
+	snapshot := PageSnapshot{version, time.Now().UTC(), note, cards, data}
+	b, err := json.Marshal(struct {
+		Route string `json:"route"`
+		PageSnapshot
+	}{route, snapshot})
+	if err != nil {
+		return PageSnapshot{}, err
+	}
+	dir := s.pageDir(route)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return PageSnapshot{}, err
+	}
+	p := filepath.Join(dir, strconv.Itoa(version)+".json")
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return PageSnapshot{}, err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		return PageSnapshot{}, err
+	}
+	echo(Log{"t": "page_snapshot", "route": route, "version": strconv.Itoa(version)})
+
+	// Delete the oldest versions, past the limit.
+	if s.limit > 0 {
+		for _, old := range snapshots[:max(0, len(snapshots)+1-s.limit)] {
+			os.Remove(filepath.Join(dir, strconv.Itoa(old.Version)+".json"))
+		}
+	}
+	return snapshot, nil
+}
+
+// list returns the versions of the page at route, oldest first.
+func (s *Snapshots) list(route string) ([]PageSnapshot, error) {
+	entries, err := os.ReadDir(s.pageDir(route))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []PageSnapshot{}, nil
+		}
+		return nil, err
+	}
+	snapshots := []PageSnapshot{}
+	for _, e := range entries {
+		v, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		version, err := strconv.Atoi(v)
+		if err != nil {
+			continue
+		}
+		snapshot, err := s.read(route, version)
+		if err != nil {
+			echo(Log{"t": "page_snapshot", "route": route, "version": v, "error": err.Error()})
+			continue
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Version < snapshots[j].Version })
+	return snapshots, nil
+}
+
+func (s *Snapshots) read(route string, version int) (PageSnapshot, error) {
+	b, err := os.ReadFile(filepath.Join(s.pageDir(route), strconv.Itoa(version)+".json"))
+	if err != nil {
+		return PageSnapshot{}, err
+	}
+	var snapshot PageSnapshot
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		return PageSnapshot{}, err
+	}
+	return snapshot, nil
+}
+
+// restore replaces the page at route with a version of it, after snapshotting it as it is, so that restores can
+// be undone. Browsers showing the page are updated, as for any other change.
+func (s *Snapshots) restore(route string, version int) (PageSnapshot, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	snapshot, err := s.read(route, version)
+	if err != nil {
+		return PageSnapshot{}, err
+	}
+	var ops OpsD
+	if err := json.Unmarshal(snapshot.Page, &ops); err != nil {
+		return PageSnapshot{}, err
+	}
+	if ops.P == nil {
+		return PageSnapshot{}, errors.New("snapshot has no page")
+	}
+	if _, err := s.save(route, "before restoring version "+strconv.Itoa(version)); err != nil && !errors.Is(err, errNoPage) {
+		return PageSnapshot{}, err
+	}
+
+	data, err := replacement(ops.P)
+	if err != nil {
+		return PageSnapshot{}, err
+	}
+	s.broker.patch(route, data, false)
+	echo(Log{"t": "page_restore", "route": route, "version": strconv.Itoa(version)})
+	return snapshot, nil
+}
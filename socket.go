@@ -17,6 +17,7 @@ package wave
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -27,11 +28,14 @@ import (
 type SocketServer struct {
 	broker           *Broker
 	auth             *Auth
-	editable         bool
+	clients          clientConf
 	baseURL          string
 	forwardedHeaders map[string]bool
 	pingInterval     time.Duration
-	reconnectTimeout time.Duration
+	pongTimeout      time.Duration
+	limits           SocketLimits
+	compressionLevel int   // 0 if compression is disabled
+	compressAbove    int64 // minimum size of messages to compress
 	upgrader         websocket.Upgrader
 }
 
@@ -46,8 +50,23 @@ func newSocketServer(broker *Broker, auth *Auth, conf ServerConf) *SocketServer
 		ReadBufferSize:  1024, // TODO review
 		WriteBufferSize: 1024, // TODO review
 		CheckOrigin:     checkOrigin,
+		// Negotiate permessage-deflate with browsers that support it, which all major browsers do.
+		EnableCompression: conf.SocketCompression != 0,
 	}
-	return &SocketServer{broker, auth, conf.Editable, conf.BaseURL, conf.ForwardedHeaders, conf.PingInterval, conf.ReconnectTimeout, upgrader}
+	if conf.SocketMsgpack {
+		upgrader.Subprotocols = []string{msgpackProtocol}
+	}
+	clients := clientConf{
+		editable:         conf.Editable,
+		baseURL:          conf.BaseURL,
+		pingInterval:     conf.PingInterval,
+		reconnectTimeout: conf.ReconnectTimeout,
+		idleTimeout:      conf.IdleTimeout,
+		queueSize:        conf.ClientQueueSize,
+		overflow:         conf.ClientQueueOverflow,
+		limits:           conf.SocketLimits,
+	}
+	return &SocketServer{broker, auth, clients, conf.BaseURL, conf.ForwardedHeaders, conf.PingInterval, conf.PongTimeout, conf.SocketLimits, conf.SocketCompression, conf.CompressThreshold, upgrader}
 }
 
 func (s *SocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -56,23 +75,34 @@ func (s *SocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		echo(Log{"t": "socket_upgrade", "err": err.Error()})
 		return
 	}
+	if s.compressionLevel != 0 {
+		conn.SetCompressionLevel(s.compressionLevel)
+	}
+	s.serve(r, newWSTransport(conn, s.pingInterval, s.pongTimeout, s.limits, s.compressAbove, conn.Subprotocol() == msgpackProtocol))
+}
 
-	session := anonymous
-	if s.auth != nil {
-		session = s.auth.identify(r)
-		if session == nil {
-			// As per websocket spec, clients are not required to follow HTTP redirects. So we send a redirect message.
-			if msg, err := json.Marshal(OpsD{U: s.baseURL + "_auth/logout"}); err == nil {
-				sw, err := conn.NextWriter(websocket.TextMessage)
-				if err != nil {
-					http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-					return
-				}
-				sw.Write(msg)
-				sw.Close()
-			}
-			return
+// identify returns the session of the user making a request, or nil if the user isn't signed in.
+func (s *SocketServer) identify(r *http.Request) *Session {
+	if s.auth == nil {
+		return anonymous
+	}
+	session := s.auth.identify(r)
+	if session == nil && len(s.auth.conf.Public) > 0 {
+		session = guest
+	}
+	return session
+}
+
+// serve connects a client over a transport, or reconnects the client over it if it's already known,
+// and returns the client, or nil if it couldn't be connected.
+func (s *SocketServer) serve(r *http.Request, t transport) *Client {
+	session := s.identify(r)
+	if session == nil {
+		// As per websocket spec, clients are not required to follow HTTP redirects. So we send a redirect message.
+		if msg, err := json.Marshal(OpsD{U: s.baseURL + "_auth/logout"}); err == nil {
+			t.write([][]byte{msg}, len(msg))
 		}
+		return nil
 	}
 
 	header := make(http.Header)
@@ -88,29 +118,28 @@ func (s *SocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if client != nil {
 		client.lock.Lock()
 		// Close prev connection gracefully.
-		client.conn.WriteMessage(websocket.CloseMessage, []byte{})
-		client.conn.Close()
-		client.conn = conn
+		client.conn.close()
+		client.conn = t
 		client.state = STATE_RECONNECT
 		client.addr = getRemoteAddr(r)
 		client.lock.Unlock()
 		echo(Log{"t": "client_reconnect", "client_id": client.id, "addr": client.addr})
+		if seq, err := strconv.ParseUint(r.URL.Query().Get("seq"), 10, 64); err == nil && s.broker.replayLog != nil {
+			s.broker.catchUp(client, seq)
+		}
 	} else {
-		client = newClient(getRemoteAddr(r), s.auth, session, s.broker, conn, s.editable, s.baseURL, &header, s.pingInterval, s.reconnectTimeout)
+		client = newClient(getRemoteAddr(r), s.auth, session, s.broker, t, &header, parseSubscriptionFilter(r.URL.Query().Get("filter")), s.clients)
 
 		helloMsg, err := json.Marshal(OpsD{I: client.id})
-		if err != nil {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return
-		}
-		if !client.send(helloMsg) {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return
+		if err != nil || !client.send(helloMsg) {
+			t.close()
+			return nil
 		}
 	}
 
 	go client.flush()
 	go client.listen()
+	return client
 }
 
 func getRemoteAddr(r *http.Request) string {
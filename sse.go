@@ -0,0 +1,225 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// EventServer connects clients behind proxies that break websockets, using server-sent events (SSE) instead:
+// a GET opens a stream of events carrying messages to the client, and each POST carries a message from the client.
+// Otherwise, clients connect, reconnect and are served exactly as they are over websockets.
+type EventServer struct {
+	sockets *SocketServer
+	streams map[string]eventStream // client ID => open stream
+	lock    sync.RWMutex
+}
+
+type eventStream struct {
+	client *Client
+	t      *sseTransport
+}
+
+func newEventServer(sockets *SocketServer) *EventServer {
+	return &EventServer{sockets: sockets, streams: make(map[string]eventStream)}
+}
+
+var errTransportClosed = errors.New("transport closed")
+
+// sseTransport is a server-sent events transport. Messages from the client are posted separately, and handed over
+// to the transport of the client they're posted for.
+type sseTransport struct {
+	w      http.ResponseWriter
+	rc     *http.ResponseController
+	in     chan []byte   // messages posted by the client
+	done   chan struct{} // closed once the stream ends
+	lock   sync.Mutex    // serializes writes, and writes with the end of the stream
+	closed bool
+}
+
+func newSSETransport(w http.ResponseWriter) *sseTransport {
+	return &sseTransport{w: w, rc: http.NewResponseController(w), in: make(chan []byte), done: make(chan struct{})}
+}
+
+func (t *sseTransport) read() ([]byte, error) {
+	select {
+	case msg := <-t.in:
+		return msg, nil
+	case <-t.done:
+		return nil, io.EOF
+	}
+}
+
+// write sends a batch of messages as a single event. Events can't contain newlines, so the batch is split
+// into data lines, which the client joins back with newlines.
+func (t *sseTransport) write(msgs [][]byte, size int) error {
+	var b bytes.Buffer
+	b.Grow(size + 16)
+	for i, msg := range msgs {
+		if i > 0 {
+			b.Write(newline)
+		}
+		b.Write(msg)
+	}
+	data := bytes.ReplaceAll(b.Bytes(), newline, []byte("\ndata: "))
+	return t.send([]byte("data: "), data, []byte("\n\n"))
+}
+
+// ping sends a comment, which the client ignores, but which fails if the client has gone.
+func (t *sseTransport) ping() error {
+	return t.send([]byte(": ping\n\n"))
+}
+
+func (t *sseTransport) send(parts ...[]byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed { // the response is no longer ours to write to
+		return errTransportClosed
+	}
+	t.rc.SetWriteDeadline(time.Now().Add(writeWait))
+	for _, p := range parts {
+		if _, err := t.w.Write(p); err != nil {
+			return err
+		}
+	}
+	return t.rc.Flush()
+}
+
+func (t *sseTransport) close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.closed {
+		t.closed = true
+		close(t.done)
+	}
+}
+
+// post hands a message from the client over to the transport.
+func (t *sseTransport) post(msg []byte) error {
+	select {
+	case t.in <- msg:
+		return nil
+	case <-t.done:
+		return errTransportClosed
+	case <-time.After(writeWait):
+		return errTransportClosed
+	}
+}
+
+func (s *EventServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.stream(w, r)
+	case http.MethodPost:
+		s.post(w, r)
+	default:
+		echo(Log{"t": "sse", "method": r.Method, "path": r.URL.Path, "error": "method not allowed"})
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// stream serves a client's stream of events until the client goes, or the client is closed.
+func (s *EventServer) stream(w http.ResponseWriter, r *http.Request) {
+	// Browsers send no origin with same-origin requests for events.
+	if check := s.sockets.upgrader.CheckOrigin; check != nil && r.Header.Get("Origin") != "" && !check(r) {
+		echo(Log{"t": "sse_stream", "origin": r.Header.Get("Origin"), "error": "forbidden"})
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no") // ask proxies, e.g. nginx, not to buffer events
+	w.WriteHeader(http.StatusOK)
+
+	// Connect the client before the stream opens, so that it may post as soon as it opens.
+	t := newSSETransport(w)
+	client := s.sockets.serve(r, t)
+	if client != nil {
+		s.lock.Lock()
+		s.streams[client.id] = eventStream{client, t}
+		s.lock.Unlock()
+		defer func() {
+			s.lock.Lock()
+			if s.streams[client.id].t == t { // else reconnected meanwhile
+				delete(s.streams, client.id)
+			}
+			s.lock.Unlock()
+		}()
+	}
+	if err := t.send(); err != nil {
+		echo(Log{"t": "sse_stream", "err": err.Error()})
+		t.close()
+		return
+	}
+	select {
+	case <-t.done:
+	case <-r.Context().Done():
+	}
+	t.close()
+}
+
+// post hands a message posted by a client over to the client's open stream.
+func (s *EventServer) post(w http.ResponseWriter, r *http.Request) {
+	s.lock.RLock()
+	stream, ok := s.streams[r.URL.Query().Get("client-id")]
+	s.lock.RUnlock()
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusGone), http.StatusGone)
+		return
+	}
+	client, t := stream.client, stream.t
+	// Only the client's own session may speak for it.
+	if !sameSession(s.sockets.identify(r), client.session) {
+		echo(Log{"t": "sse_post", "client": client.id, "error": "unauthorized"})
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	limit := client.limits.MaxMessageSize
+	if limit > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	msg, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			// As over websockets, messages that are too large end the connection.
+			socketStats.oversized.Add(1)
+			echo(Log{"t": "socket_limit", "client": client.id, "limit": "size", "max": strconv.FormatInt(limit, 10)})
+			t.close()
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if err := t.post(msg); err != nil {
+		http.Error(w, http.StatusText(http.StatusGone), http.StatusGone)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sameSession reports whether two sessions are the same, even if restored separately from a session store.
+func sameSession(a, b *Session) bool {
+	return a == b || (a != nil && b != nil && a.id != "" && a.id == b.id)
+}
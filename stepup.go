@@ -0,0 +1,93 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Operations that can be made to require step-up authentication.
+const (
+	stepUpAdmin      = "admin"       // the admin API, used with a browser session
+	stepUpFileDelete = "file-delete" // deleting uploaded files
+)
+
+// StepUpConf requires users to have authenticated recently, or strongly enough, for sensitive operations.
+type StepUpConf struct {
+	Operations []string      // operations that require step-up: "admin" and "file-delete"
+	MaxAge     time.Duration // maximum time since the user last authenticated; 0 for no limit
+	ACR        []string      // acceptable authentication context classes (acr), any of which will do; any if empty
+	AMR        []string      // authentication methods (amr), any of which is required; any if empty
+}
+
+func checkStepUp(c *StepUpConf) error {
+	if c == nil {
+		return nil
+	}
+	for _, op := range c.Operations {
+		if op != stepUpAdmin && op != stepUpFileDelete {
+			return fmt.Errorf("unknown step-up operation %q; want %s or %s", op, stepUpAdmin, stepUpFileDelete)
+		}
+	}
+	return nil
+}
+
+// requires reports whether an operation requires step-up authentication.
+func (c *StepUpConf) requires(op string) bool {
+	if c == nil {
+		return false
+	}
+	return slices.Contains(c.Operations, op)
+}
+
+// satisfiedBy reports whether the session's authentication is recent and strong enough.
+func (c *StepUpConf) satisfiedBy(session *Session) bool {
+	session.RLock()
+	defer session.RUnlock()
+	if c.MaxAge > 0 && (session.authTime.IsZero() || time.Since(session.authTime) > c.MaxAge) {
+		return false
+	}
+	if len(c.ACR) > 0 && !slices.Contains(c.ACR, session.acr) {
+		return false
+	}
+	if len(c.AMR) > 0 {
+		for _, m := range session.amr {
+			if slices.Contains(c.AMR, m) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// challenge rejects a request for want of step-up authentication, as in RFC 9470.
+// Users step up by signing in again at /_auth/login?step_up=1.
+func (c *StepUpConf) challenge(w http.ResponseWriter) {
+	params := []string{`error="insufficient_user_authentication"`}
+	if c.MaxAge > 0 {
+		params = append(params, "max_age="+strconv.Itoa(int(c.MaxAge.Seconds())))
+	}
+	if len(c.ACR) > 0 {
+		params = append(params, `acr_values="`+strings.Join(c.ACR, " ")+`"`)
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer "+strings.Join(params, ", "))
+	http.Error(w, "step-up authentication required", http.StatusUnauthorized)
+}
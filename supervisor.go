@@ -0,0 +1,371 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/h2oai/wave/pkg/keychain"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	minRestartDelay  = time.Second
+	maxRestartDelay  = time.Minute
+	stableAfter      = time.Minute      // processes running this long are restarted without delay if they exit
+	processStopGrace = 10 * time.Second // how long processes have to exit once asked to, before they are killed
+)
+
+var processNameRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// SupervisorConf lists the app processes the server runs.
+type SupervisorConf struct {
+	Apps []SupervisedApp `yaml:"apps"`
+}
+
+// SupervisedApp is an app process the server runs, and restarts if it exits.
+type SupervisedApp struct {
+	Name    string            `yaml:"name"`
+	Command []string          `yaml:"command"` // program and arguments, not run by a shell
+	Dir     string            `yaml:"dir"`     // working directory; the server's if empty
+	Env     map[string]string `yaml:"env"`     // added to the server's environment
+}
+
+// LoadSupervisorConf reads the app processes to run from a YAML file:
+//
+//	apps:
+//	  - name: sales
+//	    command: [python, -m, uvicorn, app:main, --port, "8001"]
+//	    dir: /srv/apps/sales
+//	    env:
+//	      H2O_WAVE_APP_ADDRESS: http://127.0.0.1:8001
+func LoadSupervisorConf(name string) (*SupervisorConf, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading supervisor file %s: %v", name, err)
+	}
+	var c SupervisorConf
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("invalid supervisor file %s: %v", name, err)
+	}
+	names := make(map[string]bool)
+	for i, app := range c.Apps {
+		if !processNameRE.MatchString(app.Name) {
+			return nil, fmt.Errorf("supervisor file %s: app %d: invalid name %q: want letters, digits, _, . or -", name, i+1, app.Name)
+		}
+		if names[app.Name] {
+			return nil, fmt.Errorf("supervisor file %s: app %q declared twice", name, app.Name)
+		}
+		names[app.Name] = true
+		if len(app.Command) == 0 {
+			return nil, fmt.Errorf("supervisor file %s: app %q: command is required", name, app.Name)
+		}
+	}
+	return &c, nil
+}
+
+// ProcessStatus is the state of an app process.
+type ProcessStatus struct {
+	Name     string     `json:"name"`
+	Command  []string   `json:"command"`
+	State    string     `json:"state"` // running, waiting (to be restarted) or stopped
+	PID      int        `json:"pid,omitempty"`
+	Started  *time.Time `json:"started,omitempty"`
+	Restarts int        `json:"restarts"`
+	LastExit string     `json:"last_exit,omitempty"` // how it last exited, e.g. "exit status 1"
+}
+
+// Supervisor runs app processes, restarting them when they exit, after a delay doubling with each exit in a row, up
+// to a minute, so that apps failing at startup don't spin.
+type Supervisor struct {
+	listen string // address the server listens at, from here
+	procs  []*appProcess
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+type appProcess struct {
+	app     SupervisedApp
+	env     []string
+	secrets *AppSecrets // added to env as the process starts; nil if none
+	restart chan struct{}
+
+	lock   sync.Mutex
+	status ProcessStatus
+}
+
+// newSupervisor prepares the app processes to run, pointed at the server listening at listen, unless they say
+// otherwise.
+func newSupervisor(conf *SupervisorConf, listen string, isTLS bool, baseURL string, secrets *AppSecrets) *Supervisor {
+	s := &Supervisor{listen: localAddress(listen), stop: make(chan struct{})}
+	addr := "http://" + s.listen
+	if isTLS {
+		addr = "https://" + s.listen
+	}
+	for _, app := range conf.Apps {
+		env := append(os.Environ(), "H2O_WAVE_ADDRESS="+addr, "H2O_WAVE_BASE_URL="+baseURL)
+		for k, v := range app.Env { // later values win
+			env = append(env, k+"="+v)
+		}
+		s.procs = append(s.procs, &appProcess{
+			app:     app,
+			env:     env,
+			secrets: secrets,
+			restart: make(chan struct{}, 1),
+			status:  ProcessStatus{Name: app.Name, Command: app.Command, State: "stopped"},
+		})
+	}
+	return s
+}
+
+// localAddress returns the address to reach a server listening at listen, e.g. :10101, from the same host.
+func localAddress(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return listen
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// run starts the app processes, once the server accepts connections, for apps to register with it.
+func (s *Supervisor) run() {
+	for i := 0; i < 100; i++ {
+		if conn, err := net.DialTimeout("tcp", s.listen, time.Second); err == nil {
+			conn.Close()
+			break
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	for _, p := range s.procs {
+		s.wg.Add(1)
+		go func(p *appProcess) {
+			defer s.wg.Done()
+			p.supervise(s.stop)
+		}(p)
+	}
+}
+
+// shutdown stops the app processes, and waits for them to exit.
+func (s *Supervisor) shutdown() {
+	if s == nil {
+		return
+	}
+	close(s.stop)
+	s.wg.Wait()
+}
+
+func (s *Supervisor) statuses() []ProcessStatus {
+	statuses := make([]ProcessStatus, len(s.procs))
+	for i, p := range s.procs {
+		p.lock.Lock()
+		statuses[i] = p.status
+		p.lock.Unlock()
+	}
+	return statuses
+}
+
+func (s *Supervisor) get(name string) *appProcess {
+	for _, p := range s.procs {
+		if p.app.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// supervise runs the process until stop is closed, restarting it if it exits.
+func (p *appProcess) supervise(stop <-chan struct{}) {
+	delay := minRestartDelay
+	for {
+		started := time.Now()
+		exited, err := p.start()
+		if err != nil {
+			p.exited(err.Error())
+		} else {
+			select {
+			case err := <-exited:
+				p.exited(exitReason(err))
+			case <-p.restart:
+				p.terminate(exited)
+				delay = minRestartDelay
+				continue
+			case <-stop:
+				p.terminate(exited)
+				p.lock.Lock()
+				p.status.State = "stopped"
+				p.lock.Unlock()
+				return
+			}
+		}
+		if time.Since(started) >= stableAfter {
+			delay = minRestartDelay
+		}
+		echo(Log{"t": "process", "app": p.app.Name, "restart_in": delay.String()})
+		select {
+		case <-time.After(delay):
+			delay = min(delay*2, maxRestartDelay)
+		case <-p.restart:
+			delay = minRestartDelay
+		case <-stop:
+			return
+		}
+	}
+}
+
+// start starts the process, and returns a channel receiving how it exits.
+func (p *appProcess) start() (<-chan error, error) {
+	secrets, err := p.secrets.forProcess(p.app.Name)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(p.app.Command[0], p.app.Command[1:]...)
+	cmd.Dir = p.app.Dir
+	cmd.Env = append(p.env[:len(p.env):len(p.env)], secrets...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	p.lock.Lock()
+	if p.status.Started != nil {
+		p.status.Restarts++
+	}
+	p.status.State, p.status.PID, p.status.Started = "running", cmd.Process.Pid, &now
+	p.lock.Unlock()
+	echo(Log{"t": "process", "app": p.app.Name, "pid": strconv.Itoa(cmd.Process.Pid), "state": "running"})
+
+	exited := make(chan error, 1)
+	go func() {
+		relay(p.app.Name, out)
+		exited <- cmd.Wait() // once output is read, as Wait closes it
+	}()
+	return exited, nil
+}
+
+// relay copies a process's output to the log, a line at a time.
+func relay(name string, out io.Reader) {
+	scanner := bufio.NewScanner(out)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		log.Println("# ["+name+"]", scanner.Text())
+	}
+	io.Copy(io.Discard, out) // lines too long
+}
+
+// terminate asks the process to exit, and kills it if it hasn't in time.
+func (p *appProcess) terminate(exited <-chan error) {
+	p.lock.Lock()
+	pid := p.status.PID
+	p.lock.Unlock()
+	if proc, err := os.FindProcess(pid); err == nil {
+		if err := proc.Signal(syscall.SIGTERM); err != nil { // not supported on Windows
+			proc.Kill()
+		}
+		select {
+		case err := <-exited:
+			p.exited(exitReason(err))
+			return
+		case <-time.After(processStopGrace):
+			proc.Kill()
+		}
+	}
+	p.exited(exitReason(<-exited))
+}
+
+func (p *appProcess) exited(reason string) {
+	p.lock.Lock()
+	p.status.State, p.status.PID, p.status.LastExit = "waiting", 0, reason
+	p.lock.Unlock()
+	echo(Log{"t": "process", "app": p.app.Name, "state": "exited", "reason": reason})
+}
+
+func exitReason(err error) string {
+	if err == nil {
+		return "exit status 0"
+	}
+	return err.Error()
+}
+
+// ProcessAdminHandler lets admins see the app processes the server runs, and restart them.
+//
+//	GET  /_admin/processes         list processes
+//	POST /_admin/processes/<name>  restart a process
+type ProcessAdminHandler struct {
+	prefix     string
+	supervisor *Supervisor
+	admins     keychain.Authenticator
+}
+
+func newProcessAdminHandler(prefix string, supervisor *Supervisor, admins keychain.Authenticator) http.Handler {
+	return &ProcessAdminHandler{prefix, supervisor, admins}
+}
+
+func (h *ProcessAdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.admins.Guard(w, r) {
+		return
+	}
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(h.prefix, "/")), "/")
+	switch r.Method {
+	case http.MethodGet:
+		if name != "" {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+	case http.MethodPost:
+		p := h.supervisor.get(name)
+		if p == nil {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		select {
+		case p.restart <- struct{}{}:
+		default: // already asked to
+		}
+		echo(Log{"t": "process", "app": name, "restart": "requested"})
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.supervisor.statuses())
+}
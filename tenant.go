@@ -0,0 +1,47 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+// TenantServer serves a key management API per tenant, each authenticated by the tenant's own admin keys.
+type TenantServer struct {
+	prefix  string
+	servers map[string]*AdminServer
+}
+
+func newTenantServer(prefix string, tenants []*keychain.Tenant, maxRequestSize int64) *TenantServer {
+	servers := make(map[string]*AdminServer, len(tenants))
+	for _, t := range tenants {
+		servers[t.Name] = newAdminServer(prefix+t.Name+"/", t.Admins, t.Keychain, nil, t.Quota, maxRequestSize)
+	}
+	return &TenantServer{prefix, servers}
+}
+
+func (s *TenantServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// {tenant}/...
+	tenant, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, s.prefix), "/")
+	server, ok := s.servers[tenant]
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	server.ServeHTTP(w, r)
+}
@@ -0,0 +1,133 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/h2oai/wave/pkg/msgpack"
+)
+
+// msgpackProtocol is the websocket subprotocol of browsers that would rather receive MessagePack than JSON.
+const msgpackProtocol = "wave.msgpack"
+
+// transport carries messages between the server and a client: a websocket, or server-sent events and HTTP POSTs
+// for clients behind proxies that break websockets.
+type transport interface {
+	// read returns the next message from the client.
+	read() ([]byte, error)
+	// write sends a batch of messages to the client, separated by newlines.
+	write(msgs [][]byte, size int) error
+	// ping checks that the client is still there.
+	ping() error
+	// close closes the transport, telling the client so if possible.
+	close()
+}
+
+// wsTransport is a websocket transport.
+type wsTransport struct {
+	conn          *websocket.Conn
+	limits        SocketLimits
+	pongWait      time.Duration // time allowed to read the next message or pong from the peer
+	compressAbove int64
+	binary        bool // send messages as MessagePack rather than JSON
+}
+
+func newWSTransport(conn *websocket.Conn, pingInterval, pongTimeout time.Duration, limits SocketLimits, compressAbove int64, binary bool) *wsTransport {
+	if pongTimeout <= 0 {
+		pongTimeout = pingInterval / 9
+	}
+	// Pings are sent a ping interval apart, and each must be answered within the pong timeout.
+	pongWait := pingInterval + pongTimeout
+	t := &wsTransport{conn, limits, pongWait, compressAbove, binary}
+	conn.SetReadLimit(limits.MaxMessageSize)
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+	return t
+}
+
+// read reads the next message from the client, up to the maximum message size. The size of compressed messages
+// is capped once decompressed, since a small message may decompress to a large one.
+func (t *wsTransport) read() ([]byte, error) {
+	t.conn.SetReadDeadline(time.Now().Add(t.pongWait))
+	_, r, err := t.conn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	if t.limits.MaxMessageSize <= 0 {
+		return io.ReadAll(r)
+	}
+	b, err := io.ReadAll(io.LimitReader(r, t.limits.MaxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > t.limits.MaxMessageSize {
+		t.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseMessageTooBig, ""), time.Now().Add(writeWait))
+		return nil, websocket.ErrReadLimit
+	}
+	return b, nil
+}
+
+func (t *wsTransport) write(msgs [][]byte, size int) error {
+	t.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	// Small messages aren't worth compressing.
+	t.conn.EnableWriteCompression(t.compressAbove >= 0 && int64(size) >= t.compressAbove)
+	if t.binary {
+		return t.writeBinary(msgs)
+	}
+	w, err := t.conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+	for i, msg := range msgs {
+		if i > 0 {
+			w.Write(newline)
+		}
+		w.Write(msg)
+	}
+	return w.Close()
+}
+
+// writeBinary sends a batch of messages as one binary frame of back-to-back MessagePack values.
+func (t *wsTransport) writeBinary(msgs [][]byte) error {
+	w, err := t.conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	var b []byte
+	for _, msg := range msgs {
+		if b, err = msgpack.FromJSON(b[:0], msg); err != nil {
+			echo(Log{"t": "msgpack", "error": err.Error()})
+			continue
+		}
+		w.Write(b)
+	}
+	return w.Close()
+}
+
+func (t *wsTransport) ping() error {
+	t.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return t.conn.WriteMessage(websocket.PingMessage, nil)
+}
+
+func (t *wsTransport) close() {
+	t.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	t.conn.WriteMessage(websocket.CloseMessage, []byte{})
+	t.conn.Close()
+}
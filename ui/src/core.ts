@@ -14,6 +14,8 @@
 
 /* eslint-disable @typescript-eslint/ban-types */
 
+import { unpack } from './msgpack'
+
 //
 // Dataflow
 // Mostly a port of H2O Flow's dataflow.coffee
@@ -196,6 +198,14 @@ interface OpsD {
   }
   c?: U // clear UI state
   i?: S // client id
+  q?: U // sequence number, if the server keeps recent messages for replay, or wants receipt acknowledged
+  a?: U // acknowledge receipt
+  x?: U // closed for inactivity; reconnect once the user is back
+  g?: MoveD // server shutting down; reconnect, likely to another server
+}
+interface MoveD {
+  r: U // reconnect within this many milliseconds, picked at random
+  a?: S[] // routes of apps served there, which may take a moment to be served again
 }
 interface OpD {
   k?: S
@@ -363,6 +373,19 @@ const
 
 type WaveEventHandler = (e: WaveEvent) => void
 
+/** A connection to the Wave server. */
+interface Socket {
+  send(data: S): void
+  close(): void
+}
+
+interface SocketHandlers {
+  onopen(): void
+  onclose(): void
+  onmessage(data: S | ArrayBuffer): void
+  onerror(): void
+}
+
 /** A set of changes to be made to a remote Page. */
 export interface ChangeSet {
   /** Get a reference to a card. */
@@ -420,6 +443,7 @@ const
   errorCodes: Dict<WaveErrorCode> = {
     not_found: WaveErrorCode.PageNotFound,
   },
+  invalidPatchErr = 'invalid_patch: ',
   decodeType = (d: S): [S, S] => {
     const i = d.indexOf(':')
     return (i > 0) ? [d.substring(0, i), d.substring(i + 1)] : ['', d]
@@ -931,27 +955,108 @@ const
       p = protocol === 'https:' ? 'wss' : 'ws'
     return p + "://" + host + path
   },
+  msgpackProtocol = 'wave.msgpack',
+  openWebSocket = (address: S, h: SocketHandlers): Socket => {
+    // Offer to receive MessagePack; servers that don't support it send JSON.
+    const socket = new WebSocket(address, msgpackProtocol)
+    socket.binaryType = 'arraybuffer'
+    socket.onopen = () => h.onopen()
+    socket.onclose = () => h.onclose()
+    socket.onmessage = e => h.onmessage(e.data)
+    socket.onerror = () => h.onerror()
+    return socket
+  },
+  // For browsers behind proxies that break websockets: messages arrive as server-sent events, and are sent as HTTP POSTs,
+  // in order, once the server has told us our client ID.
+  openEventSocket = (address: S, postAddress: S, clientID: () => S, h: SocketHandlers): Socket => {
+    const
+      source = new EventSource(address),
+      pending: S[] = []
+    let
+      opened = false,
+      closed = false,
+      posting = false
+    const
+      end = (failed: B) => {
+        if (closed) return
+        closed = true
+        source.close()
+        if (failed) h.onerror()
+        h.onclose()
+      },
+      post = async () => {
+        const id = clientID()
+        if (posting || closed || !id) return
+        posting = true
+        while (pending.length && !closed) {
+          try {
+            const res = await fetch(`${postAddress}?client-id=${encodeURIComponent(id)}`, { method: 'POST', body: pending[0] })
+            if (!res.ok) throw new Error(res.statusText)
+            pending.shift()
+          } catch (e) {
+            end(false)
+          }
+        }
+        posting = false
+      }
+    source.onopen = () => {
+      opened = true
+      h.onopen()
+    }
+    source.onmessage = e => {
+      h.onmessage(e.data)
+      post()
+    }
+    // Reconnect ourselves, rather than let the browser do so, to resume where we left off.
+    source.onerror = () => end(!opened)
+    return {
+      send: (data: S) => {
+        pending.push(data)
+        post()
+      },
+      close: () => end(false),
+    }
+  },
+  activityEvents = ['pointerdown', 'keydown', 'focus'],
+  appMoveTimeout = 30000, // how long to wait for an app to be served again after its server shut down, in milliseconds
   refreshRateB = box(-1) // TODO ugly; refactor
 
 export const
   disconnect = () => refreshRateB(0),
-  connect = (address: S, handle: WaveEventHandler): Wave => {
+  connect = (address: S, handle: WaveEventHandler, eventsAddress?: S): Wave => {
     let
-      _socket: WebSocket | null = null,
+      _socket: Socket | null = null,
       _page: XPage | null = null,
       _backoff = 1,
       _reconnectFailures = 0,
-      _clientID = ''
+      _opened = false, // whether a websocket has ever opened
+      _events = false, // whether to fall back to server-sent events
+      _idle = false, // whether the server is closing the connection for inactivity
+      _move: MoveD | null = null, // the server is shutting down
+      _appDeadline = 0, // until when to wait for this page's app to be served again
+      _clientID = '',
+      _seq = 0 // sequence number of the latest message received
 
     const
       slug = window.location.pathname,
       reconnect = (address: S) => {
-        let wsAddr = address
-        if (_clientID) wsAddr = `${address}?${new URLSearchParams({ 'client-id': _clientID })}`
+        const
+          params = new URLSearchParams(),
+          filter = new URLSearchParams(window.location.search).get('filter') // only cards and keys matching these patterns
+        if (filter) params.set('filter', filter)
+        if (_clientID) {
+          params.set('client-id', _clientID)
+          params.set('seq', String(_seq))
+        }
+        const query = params.toString() ? `?${params}` : ''
 
         const retry = () => reconnect(address)
-        const socket = new WebSocket(wsAddr)
-        socket.onopen = () => {
+        const handlers: SocketHandlers = { onopen, onclose, onmessage, onerror }
+        const socket: Socket = _events && eventsAddress
+          ? openEventSocket(eventsAddress + query, eventsAddress, () => _clientID, handlers)
+          : openWebSocket(address + query, handlers)
+        function onopen() {
+          _opened = true
           _reconnectFailures = 0
           _socket = socket
           handle(connectEvent)
@@ -959,13 +1064,35 @@ export const
           const hash = window.location.hash
           socket.send(`+ ${slug} ${hash.charAt(0) === '#' ? hash.substring(1) : hash}`) // protocol: t<sep>addr<sep>data
         }
-        socket.onclose = () => {
+        function onclose() {
           const refreshRate = refreshRateB()
           // TODO handle refreshRate > 0 case
           if (refreshRate === 0) return
 
           _socket = null
 
+          // Closed for inactivity: reconnect once the user is back.
+          if (_idle) {
+            _idle = false
+            const resume = () => {
+              for (const e of activityEvents) window.removeEventListener(e, resume)
+              retry()
+            }
+            for (const e of activityEvents) window.addEventListener(e, resume)
+            return
+          }
+
+          // Server shutting down: reconnect, likely to another server, at a random moment so that not everyone does at once.
+          if (_move) {
+            const { r, a } = _move
+            _move = null
+            if (a && a.includes(slug)) _appDeadline = Date.now() + appMoveTimeout
+            _clientID = '' // unknown to the next server
+            _seq = 0
+            window.setTimeout(retry, Math.random() * r)
+            return
+          }
+
           // If on unstable network, retry immediately if we haven't failed before.
           if (!_reconnectFailures) {
             retry()
@@ -978,13 +1105,31 @@ export const
           handle({ t: WaveEventType.Disconnect, retry: _backoff })
           window.setTimeout(retry, _backoff * 1000)
         }
-        socket.onmessage = (e) => {
-          if (!e.data) return
-          if (!e.data.length) return
+        function onmessage(data: S | ArrayBuffer) {
+          if (!data) return
+          let msgs: any[]
+          if (typeof data === 'string') {
+            if (!data.length) return
+            msgs = data.split('\n')
+          } else {
+            if (!data.byteLength) return
+            try {
+              msgs = unpack(data)
+            } catch (error) {
+              console.error(error)
+              handle({ t: WaveEventType.Exception, error })
+              return
+            }
+          }
           handle(dataEvent)
-          for (const line of e.data.split('\n')) {
+          for (const m of msgs) {
             try {
-              const msg = JSON.parse(line) as OpsD
+              const msg = (typeof m === 'string' ? JSON.parse(m) : m) as OpsD
+              if (msg.q) {
+                if (msg.a) socket.send(`! ${slug} ${msg.q}`) // protocol: t<sep>addr<sep>data
+                if (msg.q <= _seq) continue // already received, e.g. before reconnecting
+                _seq = msg.q
+              }
               if (msg.d) {
                 const page = exec(_page || newPage(), msg.d)
                 if (_page !== page) {
@@ -997,7 +1142,15 @@ export const
                 const page = _page = load(msg.p)
                 handle({ t: WaveEventType.Page, page })
               } else if (msg.e) {
-                handle({ t: WaveEventType.Error, code: errorCodes[msg.e] || WaveErrorCode.Unknown })
+                if (msg.e === 'not_found' && Date.now() < _appDeadline) {
+                  // The app has not registered with this server yet; try again.
+                  _move = { r: 1000 }
+                  socket.close()
+                } else if (msg.e.startsWith(invalidPatchErr)) {
+                  console.error(msg.e) // the page is intact; only the edit was rejected
+                } else {
+                  handle({ t: WaveEventType.Error, code: errorCodes[msg.e] || WaveErrorCode.Unknown })
+                }
               } else if (msg.c) {
                 handle(clearEvent)
               } else if (msg.r) {
@@ -1009,6 +1162,11 @@ export const
                 handle({ t: WaveEventType.Config, username, editable })
               } else if (msg.i) {
                 _clientID = msg.i
+              } else if (msg.x) {
+                _idle = true
+              } else if (msg.g) {
+                _move = msg.g
+                socket.close()
               }
             } catch (error) {
               console.error(error)
@@ -1016,9 +1174,11 @@ export const
             }
           }
         }
-        socket.onerror = () => {
+        function onerror() {
           handle(dataEvent)
           _reconnectFailures++
+          // A websocket that never opens is likely blocked, e.g. by a proxy; try server-sent events instead.
+          if (!_opened && eventsAddress) _events = true
         }
       },
       push = (data: unknown) => {
@@ -1058,6 +1218,14 @@ export const
       if (_socket) _socket.close()
     })
 
+    // Pages exported to standalone HTML carry their content, and have no server to connect to.
+    const exported = (window as any).__wave_export as OpsD | undefined
+    if (exported?.p) {
+      handle(dataEvent)
+      handle({ t: WaveEventType.Page, page: _page = load(exported.p) })
+      return { fork, push }
+    }
+
     reconnect(toSocketAddress(address))
 
     return { fork, push }
@@ -27,20 +27,48 @@ const
       justifyContent: 'center',
       flexDirection: 'column',
     },
+    provider: {
+      margin: 4,
+    },
   })
 
+type Provider = { name: string, label: string }
+
 const
+  actionURL = (provider?: string) => {
+    const params = new URLSearchParams(window.location.search)
+    if (provider) params.set('provider', provider)
+    const query = params.toString()
+    return query ? `${wave.initURL}?${query}` : wave.initURL
+  },
   Login = () => {
     const
-      action = `${wave.initURL}${window.location.search}`
+      [providers, setProviders] = React.useState<Provider[]>([])
+
+    React.useEffect(() => {
+      fetch(`${wave.baseURL}_auth/providers`)
+        .then(res => res.ok ? res.json() : [])
+        .then(setProviders)
+        .catch(() => setProviders([]))
+    }, [])
 
     return (
       <div className={css.login}>
-        <form action={action} method="POST">
-          <CompoundButton type="default" secondaryText="using OpenID Connect.">
-            Log In
-          </CompoundButton>
-        </form>
+        {providers.length > 1
+          ? providers.map(({ name, label }) => (
+            <form key={name} action={actionURL(name)} method="POST" className={css.provider}>
+              <CompoundButton type="default" secondaryText={`using ${label}.`}>
+                Log In
+              </CompoundButton>
+            </form>
+          ))
+          : (
+            <form action={actionURL()} method="POST">
+              <CompoundButton type="default" secondaryText="using OpenID Connect.">
+                Log In
+              </CompoundButton>
+            </form>
+          )}
       </div>
     )
   }
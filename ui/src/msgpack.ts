@@ -0,0 +1,80 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A MessagePack decoder for the types JSON has, i.e. what the Wave server sends.
+
+const utf8 = new TextDecoder()
+
+/** Decodes a sequence of back-to-back MessagePack values. */
+export const unpack = (buf: ArrayBuffer): any[] => {
+  const
+    v = new DataView(buf),
+    bytes = new Uint8Array(buf),
+    values: any[] = []
+  let i = 0
+  const
+    str = (n: number) => {
+      const s = utf8.decode(bytes.subarray(i, i + n))
+      i += n
+      return s
+    },
+    arr = (n: number) => {
+      const xs = new Array(n)
+      for (let j = 0; j < n; j++) xs[j] = next()
+      return xs
+    },
+    map = (n: number) => {
+      const m: { [k: string]: any } = {}
+      for (let j = 0; j < n; j++) {
+        const k = next()
+        m[k] = next()
+      }
+      return m
+    },
+    next = (): any => {
+      if (i >= bytes.length) throw new Error('msgpack: unexpected end of data')
+      const t = bytes[i++]
+      if (t <= 0x7f) return t
+      if (t >= 0xe0) return t - 0x100
+      if ((t & 0xf0) === 0x80) return map(t & 0x0f)
+      if ((t & 0xf0) === 0x90) return arr(t & 0x0f)
+      if ((t & 0xe0) === 0xa0) return str(t & 0x1f)
+      let x: any
+      switch (t) {
+        case 0xc0: return null
+        case 0xc2: return false
+        case 0xc3: return true
+        case 0xca: x = v.getFloat32(i); i += 4; return x
+        case 0xcb: x = v.getFloat64(i); i += 8; return x
+        case 0xcc: return bytes[i++]
+        case 0xcd: x = v.getUint16(i); i += 2; return x
+        case 0xce: x = v.getUint32(i); i += 4; return x
+        case 0xcf: x = Number(v.getBigUint64(i)); i += 8; return x
+        case 0xd0: return v.getInt8(i++)
+        case 0xd1: x = v.getInt16(i); i += 2; return x
+        case 0xd2: x = v.getInt32(i); i += 4; return x
+        case 0xd3: x = Number(v.getBigInt64(i)); i += 8; return x
+        case 0xd9: return str(bytes[i++])
+        case 0xda: x = v.getUint16(i); i += 2; return str(x)
+        case 0xdb: x = v.getUint32(i); i += 4; return str(x)
+        case 0xdc: x = v.getUint16(i); i += 2; return arr(x)
+        case 0xdd: x = v.getUint32(i); i += 4; return arr(x)
+        case 0xde: x = v.getUint16(i); i += 2; return map(x)
+        case 0xdf: x = v.getUint32(i); i += 4; return map(x)
+      }
+      throw new Error(`msgpack: unsupported type 0x${t.toString(16)}`)
+    }
+  while (i < bytes.length) values.push(next())
+  return values
+}
@@ -81,6 +81,7 @@ const
   },
   baseURL = bodyEl.getAttribute('data-base-url') ?? '/',
   socketURL = baseURL + getSocketURL(),
+  eventsURL = baseURL + '_e/',
   uploadURL = baseURL + '_f/',
   initURL = baseURL + '_auth/init',
   loginURL = baseURL + '_auth/login'
@@ -147,7 +148,7 @@ export const
           clearRec(args)
           break
       }
-    })
+    }, eventsURL)
   },
   push = () => {
     if (!_wave) return
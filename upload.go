@@ -0,0 +1,492 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/h2oai/wave/pkg/blob"
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+const (
+	tusVersion = "1.0.0"
+	// uploadExpiry is how long an unfinished upload is kept after it last received data.
+	uploadExpiry = 24 * time.Hour
+)
+
+// UploadServer accepts resumable uploads, speaking the tus protocol (https://tus.io/protocols/resumable-upload),
+// with the creation, expiration and termination extensions.
+//
+// Uploads are staged in a directory until all their bytes have arrived, then moved to the file server's directory,
+// or object store, at the path returned when the upload was created, e.g. /_f/<upload id>/<file name>.
+type UploadServer struct {
+	prefix   string
+	dir      string      // staging
+	files    string      // file server dir
+	store    blob.Bucket // file server object store; nil if not used
+	keychain keychain.Authenticator
+	auth     *Auth
+	baseURL  string // file server's
+	quotas   *UploadQuotas
+	held     *Quarantine
+	cas      *ContentStore
+	audit    *FileAudit
+	types    *ContentPolicy
+
+	lock    sync.Mutex
+	writing map[string]bool // upload id => being written to
+}
+
+// UploadInfo describes a staged upload.
+type UploadInfo struct {
+	Length      int64  `json:"length"`
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Owner       string `json:"owner"`
+}
+
+func newUploadServer(prefix, dir, files string, store blob.Bucket, keychain keychain.Authenticator, auth *Auth, baseURL string, quotas *UploadQuotas, held *Quarantine, cas *ContentStore, audit *FileAudit, types *ContentPolicy) *UploadServer {
+	return &UploadServer{
+		prefix:   prefix,
+		dir:      dir,
+		files:    files,
+		store:    store,
+		keychain: keychain,
+		auth:     auth,
+		baseURL:  baseURL,
+		quotas:   quotas,
+		held:     held,
+		cas:      cas,
+		audit:    audit,
+		types:    types,
+		writing:  make(map[string]bool),
+	}
+}
+
+var (
+	errUploadBusy     = errors.New("upload is being written to")
+	errUploadConflict = errors.New("upload offset mismatch")
+	errUploadTooLong  = errors.New("upload exceeds its length")
+)
+
+func (s *UploadServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,expiration,termination")
+		if s.quotas != nil && s.quotas.maxSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(s.quotas.maxSize, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Disallow if:
+	// - unauthorized api call
+	// - auth enabled and unauthorized
+	owner, ok := identifyUploader(s.keychain, s.auth, r) // API or UI
+	if !ok {
+		s.audit.record(r, fileUpload, r.URL.Path, "", 0)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	if v := r.Header.Get("Tus-Resumable"); v != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, http.StatusText(http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, s.prefix)
+	if r.Method == http.MethodPost {
+		if id != "" {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		s.create(w, r, owner)
+		return
+	}
+
+	if _, err := uuid.Parse(id); err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	info, err := s.read(id)
+	if err != nil || info.Owner != owner { // uploads are private to their uploader
+		if err != nil && !os.IsNotExist(err) {
+			echo(Log{"t": "file_upload", "upload": id, "error": err.Error()})
+		}
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		offset, modTime, err := s.offset(id)
+		if err != nil {
+			echo(Log{"t": "file_upload", "upload": id, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(info.Length, 10))
+		w.Header().Set("Upload-Expires", modTime.Add(uploadExpiry).UTC().Format(http.TimeFormat))
+
+	case http.MethodPatch:
+		if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+			http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+			return
+		}
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if !s.acquire(id) {
+			http.Error(w, errUploadBusy.Error(), http.StatusLocked)
+			return
+		}
+		defer s.release(id)
+
+		offset, err = s.append(id, info, offset, r.Body)
+		if err != nil {
+			echo(Log{"t": "file_upload", "upload": id, "offset": strconv.FormatInt(offset, 10), "error": err.Error()})
+			switch err {
+			case errUploadConflict:
+				http.Error(w, err.Error(), http.StatusConflict)
+			case errUploadTooLong:
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			default:
+				// The bytes received so far are kept; the client resumes from the offset it gets with HEAD.
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+		if offset == info.Length {
+			if err := s.sniff(id, info); err != nil {
+				echo(Log{"t": "file_upload", "upload": id, "error": err.Error()})
+				s.remove(id)
+				s.quotas.remove(id)
+				if errors.Is(err, errContentType) {
+					http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+					return
+				}
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if err := s.finish(r.Context(), id, info); err != nil {
+				echo(Log{"t": "file_upload", "upload": id, "error": err.Error()})
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			echo(Log{"t": "file_upload", "upload": id, "path": s.filePath(id, info), "size": strconv.FormatInt(info.Length, 10)})
+			s.audit.record(r, fileUpload, s.filePath(id, info), owner, info.Length)
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		if !s.acquire(id) {
+			http.Error(w, errUploadBusy.Error(), http.StatusLocked)
+			return
+		}
+		defer s.release(id)
+		s.remove(id)
+		s.quotas.remove(id)
+		s.held.release(id)
+		echo(Log{"t": "file_upload", "upload": id, "status": "terminated"})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		echo(Log{"t": "file_upload", "method": r.Method, "path": r.URL.Path, "error": "method not allowed"})
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// create starts an upload, and responds with its URL, and the path the file will be available at once uploaded.
+// The upload counts toward its owner's quota from the start, so that concurrent uploads cannot exceed it.
+func (s *UploadServer) create(w http.ResponseWriter, r *http.Request, owner string) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "want Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if err := s.quotas.check(owner, length); err != nil {
+		echo(Log{"t": "file_upload", "owner": owner, "length": strconv.FormatInt(length, 10), "error": err.Error()})
+		rejectUpload(w, err)
+		return
+	}
+	meta := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	name := path.Base(filepath.ToSlash(meta["filename"]))
+	if name == "" || name == "." || name == ".." || name == "/" {
+		http.Error(w, "want filename in Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = meta["filetype"]
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	if err := s.types.check(name, meta["filetype"], nil); err != nil {
+		echo(Log{"t": "file_upload", "owner": owner, "name": name, "error": err.Error()})
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	s.expire()
+
+	uid, err := uuid.NewRandom()
+	if err != nil {
+		echo(Log{"t": "file_upload", "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	id := uid.String()
+	info := UploadInfo{length, name, contentType, owner}
+	if err := s.write(id, info); err != nil {
+		echo(Log{"t": "file_upload", "upload": id, "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	s.quotas.add(owner, []storedFile{{id + "/" + name, length}})
+	if length == 0 { // nothing to wait for
+		if err := s.finish(r.Context(), id, info); err != nil {
+			echo(Log{"t": "file_upload", "upload": id, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	res, err := json.Marshal(UploadResponse{Files: []string{s.filePath(id, info)}})
+	if err != nil {
+		echo(Log{"t": "file_upload", "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	echo(Log{"t": "file_upload", "upload": id, "owner": owner, "name": name, "length": strconv.FormatInt(length, 10)})
+	w.Header().Set("Location", s.prefix+id)
+	w.Header().Set("Upload-Expires", time.Now().Add(uploadExpiry).UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(res)
+}
+
+// parseUploadMetadata parses a tus Upload-Metadata header, e.g. "filename d29ybGQ=,filetype dGV4dC9wbGFpbg==".
+func parseUploadMetadata(s string) map[string]string {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if k == "" {
+			continue
+		}
+		if b, err := base64.StdEncoding.DecodeString(v); err == nil {
+			meta[k] = string(b)
+		}
+	}
+	return meta
+}
+
+func (s *UploadServer) filePath(id string, info UploadInfo) string {
+	return path.Join(s.baseURL, id, info.Name)
+}
+
+func (s *UploadServer) dataPath(id string) string { return filepath.Join(s.dir, id) }
+func (s *UploadServer) infoPath(id string) string { return filepath.Join(s.dir, id+".json") }
+
+func (s *UploadServer) write(id string, info UploadInfo) error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return fmt.Errorf("failed creating upload dir %s: %v", s.dir, err)
+	}
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.dataPath(id), nil, 0600); err != nil {
+		return fmt.Errorf("failed creating upload: %v", err)
+	}
+	if err := os.WriteFile(s.infoPath(id), b, 0600); err != nil {
+		return fmt.Errorf("failed creating upload: %v", err)
+	}
+	return nil
+}
+
+func (s *UploadServer) read(id string) (UploadInfo, error) {
+	var info UploadInfo
+	b, err := os.ReadFile(s.infoPath(id))
+	if err != nil {
+		return info, err
+	}
+	if err := json.Unmarshal(b, &info); err != nil {
+		return info, fmt.Errorf("failed reading upload: %v", err)
+	}
+	return info, nil
+}
+
+// offset returns how many bytes of an upload have been received, and when it last received any.
+func (s *UploadServer) offset(id string) (int64, time.Time, error) {
+	fi, err := os.Stat(s.dataPath(id))
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return fi.Size(), fi.ModTime(), nil
+}
+
+// append writes the body of a PATCH request to an upload, as it arrives, starting at offset,
+// and returns the upload's new offset.
+func (s *UploadServer) append(id string, info UploadInfo, offset int64, body io.Reader) (int64, error) {
+	current, _, err := s.offset(id)
+	if err != nil {
+		return 0, err
+	}
+	if offset != current {
+		return current, errUploadConflict
+	}
+	f, err := os.OpenFile(s.dataPath(id), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return current, err
+	}
+	n, err := io.Copy(f, io.LimitReader(body, info.Length-offset))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	offset += n
+	if err != nil {
+		return offset, err
+	}
+	if offset == info.Length {
+		if n, _ := body.Read(make([]byte, 1)); n > 0 {
+			return offset, errUploadTooLong
+		}
+	}
+	return offset, nil
+}
+
+// finish moves a completed upload to the file server. On failure, the upload is kept, and finishing is retried
+// by the next PATCH request, at the upload's final offset.
+func (s *UploadServer) finish(ctx context.Context, id string, info UploadInfo) error {
+	stored := []storedFile{{id + "/" + info.Name, info.Length}}
+	s.held.hold(stored)
+	if s.store != nil {
+		f, err := os.Open(s.dataPath(id))
+		if err != nil {
+			return err
+		}
+		err = s.store.Put(ctx, id+"/"+info.Name, info.ContentType, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed storing uploaded file %s: %v", info.Name, err)
+		}
+		s.remove(id)
+		s.held.check(stored)
+		return nil
+	}
+	uploadDir := filepath.Join(s.files, id)
+	if err := os.MkdirAll(uploadDir, 0700); err != nil {
+		return fmt.Errorf("failed creating upload dir %s: %v", uploadDir, err)
+	}
+	uploadPath := filepath.Join(uploadDir, info.Name)
+	if err := os.Rename(s.dataPath(id), uploadPath); err != nil {
+		return fmt.Errorf("failed writing uploaded file %s: %v", uploadPath, err)
+	}
+	s.cas.intern(stored)
+	s.remove(id)
+	s.held.check(stored)
+	return nil
+}
+
+// sniff checks the type of an upload by its content, once all its bytes have arrived.
+func (s *UploadServer) sniff(id string, info UploadInfo) error {
+	if s.types == nil {
+		return nil
+	}
+	f, err := os.Open(s.dataPath(id))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	head, err := readHead(f)
+	if err != nil {
+		return err
+	}
+	return s.types.check(info.Name, info.ContentType, head)
+}
+
+func (s *UploadServer) remove(id string) {
+	os.Remove(s.dataPath(id))
+	os.Remove(s.infoPath(id))
+}
+
+// expire removes uploads that have not received data in uploadExpiry.
+func (s *UploadServer) expire() {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-uploadExpiry)
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		if _, modTime, err := s.offset(id); err == nil && modTime.After(cutoff) {
+			continue
+		}
+		if !s.acquire(id) {
+			continue
+		}
+		s.remove(id)
+		s.quotas.remove(id)
+		s.held.release(id)
+		s.release(id)
+		echo(Log{"t": "file_upload", "upload": id, "status": "expired"})
+	}
+}
+
+// acquire reserves an upload for writing, so that concurrent requests do not interleave their bytes.
+func (s *UploadServer) acquire(id string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.writing[id] {
+		return false
+	}
+	s.writing[id] = true
+	return true
+}
+
+func (s *UploadServer) release(id string) {
+	s.lock.Lock()
+	delete(s.writing, id)
+	s.lock.Unlock()
+}
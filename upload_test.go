@@ -0,0 +1,123 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"github.com/h2oai/wave/pkg/keychain"
+	"github.com/h2oai/wave/pkg/keychain/keychaintest"
+)
+
+func TestUploadResumes(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	kc, keys := keychaintest.New(t, 2)
+	dir := t.TempDir()
+	s := newUploadServer("/_up/", filepath.Join(dir, "staging"), filepath.Join(dir, "files"), nil, kc, nil, "/_f", nil, nil, nil, nil, nil)
+
+	call := func(key keychain.Credential, method, path, body string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.SetBasicAuth(key.ID, key.Secret)
+		r.Header.Set("Tus-Resumable", tusVersion)
+		for i := 0; i < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	create := func(length int) (string, string) {
+		w := call(keys[0], http.MethodPost, "/_up/", "", "Upload-Length", strconv.Itoa(length),
+			"Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("hello.txt")))
+		eq(w.Code, http.StatusCreated)
+		var res UploadResponse
+		no(json.NewDecoder(w.Body).Decode(&res))
+		eq(len(res.Files), 1)
+		return w.Header().Get("Location"), res.Files[0]
+	}
+	patch := func(key keychain.Credential, location string, offset int, body string) *httptest.ResponseRecorder {
+		return call(key, http.MethodPatch, location, body, "Content-Type", "application/offset+octet-stream", "Upload-Offset", strconv.Itoa(offset))
+	}
+
+	location, file := create(11)
+	ok(strings.HasPrefix(location, "/_up/"))
+	ok(strings.HasPrefix(file, "/_f/") && strings.HasSuffix(file, "/hello.txt"))
+
+	w := patch(keys[0], location, 0, "hello")
+	eq(w.Code, http.StatusNoContent)
+	eq(w.Header().Get("Upload-Offset"), "5")
+
+	// Resend from a stale offset, e.g. after a lost response.
+	eq(patch(keys[0], location, 0, "hello").Code, http.StatusConflict)
+
+	w = call(keys[0], http.MethodHead, location, "")
+	eq(w.Code, http.StatusOK)
+	eq(w.Header().Get("Upload-Offset"), "5")
+	eq(w.Header().Get("Upload-Length"), "11")
+
+	// Uploads are private to their uploader.
+	eq(call(keys[1], http.MethodHead, location, "").Code, http.StatusNotFound)
+	eq(patch(keys[1], location, 5, " world").Code, http.StatusNotFound)
+
+	w = patch(keys[0], location, 5, " world")
+	eq(w.Code, http.StatusNoContent)
+	eq(w.Header().Get("Upload-Offset"), "11")
+	b, err := os.ReadFile(filepath.Join(dir, "files", filepath.FromSlash(strings.TrimPrefix(file, "/_f/"))))
+	no(err)
+	eq(string(b), "hello world")
+	eq(call(keys[0], http.MethodHead, location, "").Code, http.StatusNotFound) // finished
+}
+
+func TestUploadRejects(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	kc, keys := keychaintest.New(t, 1)
+	dir := t.TempDir()
+	s := newUploadServer("/_up/", filepath.Join(dir, "staging"), filepath.Join(dir, "files"), nil, kc, nil, "/_f", nil, nil, nil, nil, nil)
+
+	call := func(method, path, body string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.SetBasicAuth(keys[0].ID, keys[0].Secret)
+		for i := 0; i < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	filename := "filename " + base64.StdEncoding.EncodeToString([]byte("a.txt"))
+
+	eq(call(http.MethodPost, "/_up/", "", "Upload-Length", "3", "Upload-Metadata", filename).Code, http.StatusPreconditionFailed)
+	eq(call(http.MethodPost, "/_up/", "", "Tus-Resumable", tusVersion, "Upload-Metadata", filename).Code, http.StatusBadRequest)
+	eq(call(http.MethodPost, "/_up/", "", "Tus-Resumable", tusVersion, "Upload-Length", "3").Code, http.StatusBadRequest)
+	eq(call(http.MethodHead, "/_up/not-an-id", "", "Tus-Resumable", tusVersion).Code, http.StatusNotFound)
+
+	w := call(http.MethodPost, "/_up/", "", "Tus-Resumable", tusVersion, "Upload-Length", "3", "Upload-Metadata", filename)
+	eq(w.Code, http.StatusCreated)
+	location := w.Header().Get("Location")
+	eq(call(http.MethodPatch, location, "abc", "Tus-Resumable", tusVersion, "Upload-Offset", "0").Code, http.StatusUnsupportedMediaType)
+	eq(call(http.MethodPatch, location, "abcde", "Tus-Resumable", tusVersion, "Content-Type", "application/offset+octet-stream", "Upload-Offset", "0").Code, http.StatusRequestEntityTooLarge)
+
+	eq(call(http.MethodDelete, location, "", "Tus-Resumable", tusVersion).Code, http.StatusNoContent)
+	eq(call(http.MethodHead, location, "", "Tus-Resumable", tusVersion).Code, http.StatusNotFound)
+}
@@ -0,0 +1,176 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// validateOps checks that data is a well-formed set of changes to a page, as sent by apps and editors,
+// and describes the first problem found, if any.
+func validateOps(data []byte) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	var ops OpsD
+	if err := d.Decode(&ops); err != nil {
+		return fmt.Errorf("malformed changes: %v", err)
+	}
+	if d.More() {
+		return errors.New("malformed changes: trailing data")
+	}
+	if ops.P != nil {
+		for k, c := range ops.P.C {
+			if strings.Contains(k, keySeparator) {
+				return fmt.Errorf("page: card %q: key must not contain %q", k, keySeparator)
+			}
+			if err := validateCard(c.D, c.B); err != nil {
+				return fmt.Errorf("page: card %q: %v", k, err)
+			}
+		}
+	}
+	for i, op := range ops.D {
+		if err := validateOp(op); err != nil {
+			return fmt.Errorf("change %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func validateOp(op OpD) error {
+	n := 0
+	for _, set := range []bool{op.V != nil, op.C != nil, op.F != nil, op.M != nil, op.L != nil, op.D != nil} {
+		if set {
+			n++
+		}
+	}
+	if len(op.K) == 0 { // drop page
+		if n > 0 || op.B != nil {
+			return errors.New("values need a key")
+		}
+		return nil
+	}
+	ks := strings.Split(op.K, keySeparator)
+	for _, k := range ks {
+		if len(k) == 0 {
+			return fmt.Errorf("key %q: empty segment", op.K)
+		}
+	}
+	if n > 1 {
+		return fmt.Errorf("key %q: more than one value", op.K)
+	}
+	if op.B != nil && op.D == nil {
+		return fmt.Errorf("key %q: buffers without card data", op.K)
+	}
+	if op.D != nil {
+		if len(ks) > 1 {
+			return fmt.Errorf("key %q: cards can only be put at the top level", op.K)
+		}
+		if err := validateCard(op.D, op.B); err != nil {
+			return fmt.Errorf("card %q: %v", op.K, err)
+		}
+		return nil
+	}
+	if n > 0 && len(ks) == 1 {
+		return fmt.Errorf("key %q: cards must be put with card data", op.K)
+	}
+	if err := validateBuf(BufD{op.C, op.F, op.M, op.L}, true); err != nil {
+		return fmt.Errorf("key %q: %v", op.K, err)
+	}
+	return nil
+}
+
+func validateCard(data map[string]interface{}, bufs []BufD) error {
+	for k, v := range data {
+		if !strings.HasPrefix(k, dataPrefix) {
+			continue
+		}
+		f, ok := v.(float64)
+		if !ok || f != float64(int(f)) || int(f) < 0 || int(f) >= len(bufs) {
+			return fmt.Errorf("%q: no such buffer: %v", k, v)
+		}
+	}
+	for i, b := range bufs {
+		if err := validateBuf(b, false); err != nil {
+			return fmt.Errorf("buffer %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// validateBuf checks a buffer; none is acceptable if optional is set.
+func validateBuf(b BufD, optional bool) error {
+	switch {
+	case b.C != nil && b.F == nil && b.M == nil && b.L == nil:
+		if err := validateTups(b.C.F, b.C.D, b.C.N); err != nil {
+			return err
+		}
+		if len(b.C.D) > 0 && (b.C.I < 0 || b.C.I >= len(b.C.D)) {
+			return fmt.Errorf("cyclic buffer index %d out of range", b.C.I)
+		}
+	case b.F != nil && b.C == nil && b.M == nil && b.L == nil:
+		return validateTups(b.F.F, b.F.D, b.F.N)
+	case b.M != nil && b.C == nil && b.F == nil && b.L == nil:
+		if err := validateFields(b.M.F); err != nil {
+			return err
+		}
+		for k, tup := range b.M.D {
+			if tup != nil && len(tup) != len(b.M.F) {
+				return fmt.Errorf("row %q: want %d values, got %d", k, len(b.M.F), len(tup))
+			}
+		}
+	case b.L != nil && b.C == nil && b.F == nil && b.M == nil:
+		return validateTups(b.L.F, b.L.D, b.L.N)
+	case b.C == nil && b.F == nil && b.M == nil && b.L == nil:
+		if !optional {
+			return errors.New("empty buffer")
+		}
+	default:
+		return errors.New("more than one kind of buffer")
+	}
+	return nil
+}
+
+func validateTups(fields []string, tups [][]interface{}, n int) error {
+	if err := validateFields(fields); err != nil {
+		return err
+	}
+	if n < 0 {
+		return fmt.Errorf("negative size %d", n)
+	}
+	for i, tup := range tups {
+		if tup != nil && len(tup) != len(fields) {
+			return fmt.Errorf("row %d: want %d values, got %d", i, len(fields), len(tup))
+		}
+	}
+	return nil
+}
+
+func validateFields(fields []string) error {
+	if len(fields) == 0 {
+		return errors.New("no fields")
+	}
+	seen := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		if seen[f] {
+			return fmt.Errorf("duplicate field %q", f)
+		}
+		seen[f] = true
+	}
+	return nil
+}
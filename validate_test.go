@@ -0,0 +1,134 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+var validateTests = []struct {
+	data string
+	err  string // substring of the error expected; empty if valid
+}{
+	{`{}`, ""},
+	{`{"d":[{"k":"card","d":{"view":"markdown","content":"hi"}}]}`, ""},
+	{`{"d":[{"k":"card title","v":"Hello"}]}`, ""},
+	{`{"d":[{"k":"card items 0","v":1}]}`, ""},
+	{`{"d":[{"k":""}]}`, ""},
+	{`{"d":[{"k":"card","d":{"view":"plot","~data":0},"b":[{"f":{"f":["x","y"],"d":[[1,2]],"n":10}}]}]}`, ""},
+	{`{"d":[{"k":"card","d":{"view":"plot","~data":0},"b":[{"c":{"f":["x"],"d":[[1],[2]],"n":2,"i":1}}]}]}`, ""},
+	{`{"d":[{"k":"card","d":{"view":"plot","~data":0},"b":[{"m":{"f":["x"],"d":{"a":[1]}}}]}]}`, ""},
+	{`{"d":[{"k":"card data","m":{"f":["x"],"d":{}}}]}`, ""},
+	{`{"p":{"c":{"card":{"d":{"view":"markdown"}}}}}`, ""},
+
+	{`{`, "malformed changes"},
+	{`{} {}`, "trailing data"},
+	{`{"z":1}`, "malformed changes"},
+	{`{"d":[{"k":"","v":1}]}`, "values need a key"},
+	{`{"d":[{"k":"card  title","v":1}]}`, "empty segment"},
+	{`{"d":[{"k":"card title","v":1,"d":{}}]}`, "more than one value"},
+	{`{"d":[{"k":"card","b":[{"f":{"f":["x"],"d":[],"n":1}}]}]}`, "buffers without card data"},
+	{`{"d":[{"k":"card title","d":{"view":"markdown"}}]}`, "cards can only be put at the top level"},
+	{`{"d":[{"k":"card","v":1}]}`, "cards must be put with card data"},
+	{`{"d":[{"k":"card","d":{"~data":1},"b":[{"f":{"f":["x"],"d":[],"n":1}}]}]}`, "no such buffer"},
+	{`{"d":[{"k":"card","d":{"~data":0},"b":[{}]}]}`, "empty buffer"},
+	{`{"d":[{"k":"card","d":{"~data":0},"b":[{"f":{"f":["x"],"d":[],"n":1},"l":{"f":["x"],"d":[],"n":1}}]}]}`, "more than one kind of buffer"},
+	{`{"d":[{"k":"card","d":{"~data":0},"b":[{"f":{"f":[],"d":[],"n":1}}]}]}`, "no fields"},
+	{`{"d":[{"k":"card","d":{"~data":0},"b":[{"f":{"f":["x","x"],"d":[],"n":1}}]}]}`, "duplicate field"},
+	{`{"d":[{"k":"card","d":{"~data":0},"b":[{"f":{"f":["x"],"d":[],"n":-1}}]}]}`, "negative size"},
+	{`{"d":[{"k":"card","d":{"~data":0},"b":[{"f":{"f":["x","y"],"d":[[1]],"n":1}}]}]}`, "want 2 values, got 1"},
+	{`{"d":[{"k":"card","d":{"~data":0},"b":[{"c":{"f":["x"],"d":[[1]],"n":1,"i":1}}]}]}`, "cyclic buffer index"},
+	{`{"d":[{"k":"card","d":{"~data":0},"b":[{"m":{"f":["x"],"d":{"a":[1,2]}}}]}]}`, "want 1 values, got 2"},
+	{`{"p":{"c":{"a b":{"d":{}}}}}`, "key must not contain"},
+	{`{"p":{"c":{"card":{"d":{"~data":0}}}}}`, "no such buffer"},
+}
+
+func TestValidateOps(t *testing.T) {
+	for _, tc := range validateTests {
+		err := validateOps([]byte(tc.data))
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tc.data, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: want error containing %q, got %v", tc.data, tc.err, err)
+		}
+	}
+}
+
+func newValidatingBroker() *Broker {
+	return newBroker(nil, brokerConf{validate: true, noStore: true, noLog: true})
+}
+
+func TestValidatePatchRequests(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	for _, tc := range validateTests {
+		b := newValidatingBroker()
+		s := &WebServer{broker: b, baseURL: "/", maxRequestSize: 1 << 10}
+		r := httptest.NewRequest(http.MethodPatch, "/page", strings.NewReader(tc.data))
+		w := httptest.NewRecorder()
+		s.patch(w, r)
+		if tc.err == "" {
+			eq(w.Code, http.StatusOK)
+			eq(len(b.publish), 1)
+		} else {
+			eq(w.Code, http.StatusBadRequest)
+			eq(len(b.publish), 0)
+		}
+	}
+}
+
+// scriptedTransport plays back messages from a client, then reports the connection closed.
+type scriptedTransport struct {
+	msgs [][]byte
+}
+
+func (t *scriptedTransport) read() ([]byte, error) {
+	if len(t.msgs) == 0 {
+		return nil, errors.New("closed")
+	}
+	msg := t.msgs[0]
+	t.msgs = t.msgs[1:]
+	return msg, nil
+}
+
+func (t *scriptedTransport) write(msgs [][]byte, size int) error { return nil }
+func (t *scriptedTransport) ping() error                         { return nil }
+func (t *scriptedTransport) close()                              {}
+
+func TestValidateClientPatches(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	for _, tc := range validateTests {
+		b := newValidatingBroker()
+		conn := &scriptedTransport{[][]byte{[]byte("* /page " + tc.data)}}
+		c := newClient("127.0.0.1:1234", nil, anonymous, b, conn, &http.Header{}, nil, clientConf{editable: true, baseURL: "/", queueSize: 10, reconnectTimeout: time.Millisecond})
+		c.listen()
+		if tc.err == "" {
+			eq(len(b.publish), 1)
+			eq(len(c.data), 0)
+		} else {
+			eq(len(b.publish), 0)
+			eq(len(c.data), 1)
+			ok(strings.Contains(string(<-c.data), tc.err), "error not sent to client:", tc.data)
+		}
+	}
+}
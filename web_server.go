@@ -21,6 +21,7 @@ import (
 	"net/http"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/h2oai/wave/pkg/keychain"
@@ -31,7 +32,10 @@ type WebServer struct {
 	site           *Site
 	broker         *Broker
 	fs             http.Handler
-	keychain       *keychain.Keychain
+	keychain       keychain.Authenticator
+	apps           *AppKeychains // optional
+	appScope       string        // scope of the keys apps must register with, if any
+	secrets        *AppSecrets   // passed to apps as they register; nil if none
 	maxRequestSize int64
 	baseURL        string
 }
@@ -45,7 +49,10 @@ func newWebServer(
 	site *Site,
 	broker *Broker,
 	auth *Auth,
-	keychain *keychain.Keychain,
+	keychain keychain.Authenticator,
+	apps *AppKeychains,
+	appScope string,
+	secrets *AppSecrets,
 	maxRequestSize int64,
 	baseURL string,
 	webDir string,
@@ -62,7 +69,7 @@ func newWebServer(
 	if auth != nil {
 		fs = auth.wrap(fs)
 	}
-	return &WebServer{site, broker, fs, keychain, maxRequestSize, baseURL}, nil
+	return &WebServer{site, broker, fs, keychain, apps, appScope, secrets, maxRequestSize, baseURL}, nil
 }
 
 func mungeIndexPage(baseURL, html string) string {
@@ -77,14 +84,14 @@ func mungeIndexPage(baseURL, html string) string {
 func (s *WebServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodPatch: // writes
-		if !s.keychain.Guard(w, r) {
+		if !s.guard(w, r) {
 			return
 		}
 		s.patch(w, r)
 	case http.MethodGet: // reads
 		switch r.Header.Get("Content-Type") {
 		case contentTypeJSON: // data
-			if !s.keychain.Guard(w, r) {
+			if !s.guard(w, r) {
 				return
 			}
 			s.get(w, r)
@@ -96,16 +103,103 @@ func (s *WebServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			h.ServeHTTP(w, r)
 		}
 	case http.MethodPost: // all other APIs
-		if !s.keychain.Guard(w, r) {
+		if s.apps == nil && !s.keychain.Guard(w, r) {
 			return
 		}
-		s.post(w, r)
+		s.post(w, r) // authenticates after reading the request if app keychains are enabled
 	default:
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 	}
 }
 
+// guard authenticates a page request against the keychain of the app owning the page, if any,
+// or else the server keychain.
+func (s *WebServer) guard(w http.ResponseWriter, r *http.Request) bool {
+	if s.apps != nil {
+		if kc := s.apps.match(resolveURL(r.URL.Path, s.baseURL)); kc != nil {
+			return kc.Guard(w, r)
+		}
+	}
+	return s.keychain.Guard(w, r)
+}
+
+// guardApp authenticates an app (un)registration request. A route bound to a keychain can only be
+// (un)registered with a key from that keychain; a route can only be bound to a keychain by a key from it, and only
+// while no app serves the route, so that keys from one app keychain can't take over the routes of other apps.
+func (s *WebServer) guardApp(w http.ResponseWriter, r *http.Request, route, declared string) (*keychain.Keychain, bool) {
+	if s.apps == nil {
+		return nil, true // already authenticated
+	}
+	bound := s.apps.bound(route)
+	if bound != nil && !bound.Guard(w, r) {
+		return nil, false
+	}
+	if declared == "" {
+		if bound != nil {
+			return nil, true
+		}
+		return nil, s.keychain.Guard(w, r)
+	}
+	kc, err := s.apps.load(declared)
+	if err != nil {
+		echo(Log{"t": "app_keychain", "route": route, "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return nil, false
+	}
+	if !kc.Guard(w, r) {
+		return nil, false
+	}
+	if bound != nil && bound.Name != kc.Name {
+		echo(Log{"t": "app_keychain", "route": route, "keychain": declared, "error": "route bound to another keychain"})
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return nil, false
+	}
+	if bound == nil && s.broker.serves(route) {
+		echo(Log{"t": "app_keychain", "route": route, "keychain": declared, "error": "route served by another app"})
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return nil, false
+	}
+	return kc, true
+}
+
+// keyLookup looks up access keys, e.g. a keychain.
+type keyLookup interface {
+	Get(id string) (keychain.Entry, bool)
+}
+
+// guardScope checks that an authenticated app (un)registration request carries a key with the scope apps must
+// register with, if any, from the keychain it was authenticated against: the declared keychain, if any, or else the
+// keychain bound to the route, or else the server keychain.
+func (s *WebServer) guardScope(w http.ResponseWriter, r *http.Request, route string, declared *keychain.Keychain) bool {
+	if s.appScope == "" {
+		return true
+	}
+	var kc keychain.Authenticator = s.keychain
+	if declared != nil {
+		kc = declared
+	} else if s.apps != nil {
+		if bound := s.apps.bound(route); bound != nil {
+			kc = bound
+		}
+	}
+	id, _, _ := r.BasicAuth()
+	// Only keychains know their keys' scopes; other authenticators can't vouch for them.
+	if keys, ok := kc.(keyLookup); ok {
+		if e, ok := keys.Get(id); ok && e.HasScope(s.appScope) {
+			return true
+		}
+	}
+	echo(Log{"t": "app_scope", "route": route, "key": id, "scope": s.appScope, "error": "key not scoped"})
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	return false
+}
+
 func (s *WebServer) patch(w http.ResponseWriter, r *http.Request) {
+	url := resolveURL(r.URL.Path, s.baseURL)
+	if key, _, _ := r.BasicAuth(); !s.broker.authorize(Identity{Key: key}, RoutePublish, url) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
 	data, err := readRequestWithLimit(w, r.Body, s.maxRequestSize)
 	if err != nil {
 		echo(Log{"t": "read patch request body", "error": err.Error()})
@@ -116,11 +210,29 @@ func (s *WebServer) patch(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-	s.broker.patch(resolveURL(r.URL.Path, s.baseURL), data)
+	if err := s.broker.check(data); err != nil {
+		echo(Log{"t": "invalid_patch", "route": url, "error": err.Error()})
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, _, _ := r.BasicAuth()
+	if err := s.broker.limits.admit(key, url, s.broker.isUnicast(url), data); err != nil {
+		if err == errAppPatchRate {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	s.broker.patch(url, data, r.Header.Get("Wave-Ack") != "")
 }
 
 func (s *WebServer) get(w http.ResponseWriter, r *http.Request) {
 	url := resolveURL(r.URL.Path, s.baseURL)
+	if key, _, _ := r.BasicAuth(); !s.broker.authorize(Identity{Key: key}, RouteRead, url) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
 	page := s.site.at(url)
 	if page == nil {
 		echo(Log{"t": "page_not_found", "url": url})
@@ -160,10 +272,67 @@ func (s *WebServer) post(w http.ResponseWriter, r *http.Request) {
 		}
 		if req.RegisterApp != nil {
 			q := req.RegisterApp
-			s.broker.addApp(q.Mode, q.Route, q.Address, q.KeyID, q.KeySecret)
+			kc, ok := s.guardApp(w, r, q.Route, q.Keychain)
+			if !ok || !s.guardScope(w, r, q.Route, kc) {
+				return
+			}
+			if q.Scale && toAppMode(q.Mode) == broadcastMode {
+				http.Error(w, "broadcast apps share one page, and can't scale", http.StatusBadRequest)
+				return
+			}
+			if q.Deployment != "" && toAppMode(q.Mode) == broadcastMode {
+				http.Error(w, "broadcast apps share one page, and can't run side by side", http.StatusBadRequest)
+				return
+			}
+			if kc != nil {
+				if !s.apps.bind(q.Route, kc) { // bound by another app meanwhile
+					echo(Log{"t": "app_keychain", "route": q.Route, "keychain": q.Keychain, "error": "route bound to another keychain"})
+					http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+					return
+				}
+				echo(Log{"t": "app_keychain", "route": q.Route, "keychain": q.Keychain})
+			}
+			var meta AppMeta
+			if q.Meta != nil {
+				meta = *q.Meta
+			}
+			owner, _, _ := r.BasicAuth()
+			var via string // app keychain the key is from, if any
+			if s.apps != nil {
+				if bound := s.apps.bound(q.Route); bound != nil {
+					via = filepath.Base(bound.Name)
+				}
+			}
+			secrets, err := s.secrets.forRoute(q.Route, owner, via)
+			if err != nil {
+				echo(Log{"t": "app_secrets", "route": q.Route, "error": err.Error()})
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			s.broker.addApp(q.Mode, q.Route, q.Address, q.KeyID, q.KeySecret, q.Ack, owner, q.Health, q.Scale, q.Deployment, meta)
+			if len(secrets) > 0 {
+				names := make([]string, 0, len(secrets))
+				for name := range secrets {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				echo(Log{"t": "app_secrets", "route": q.Route, "host": q.Address, "secrets": strings.Join(names, ",")})
+				w.Header().Set("Content-Type", contentTypeJSON)
+				json.NewEncoder(w).Encode(AppRegistered{secrets})
+			}
 		} else if req.UnregisterApp != nil {
 			q := req.UnregisterApp
-			s.broker.dropApp(q.Route)
+			if _, ok := s.guardApp(w, r, q.Route, ""); !ok || !s.guardScope(w, r, q.Route, nil) {
+				return
+			}
+			key, _, _ := r.BasicAuth()
+			if q.Address == "" {
+				s.broker.dropApp(q.Route, key)
+			} else if app := s.broker.getInstance(q.Route, q.Address); app != nil {
+				s.broker.dropInstance(app, key)
+			}
+		} else if s.apps != nil && !s.keychain.Guard(w, r) {
+			return
 		}
 	default:
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)